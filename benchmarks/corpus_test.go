@@ -0,0 +1,127 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package benchmarks
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+var corpora = []struct {
+	name     string   // Name of the benchmark.
+	logfile  string   // Log corpus.
+	programs []string // Programs run over the corpus together.
+}{
+	{
+		"nginx",
+		"testdata/nginx.log",
+		[]string{"../examples/apache_combined.mtail"},
+	},
+	{
+		"syslog",
+		"testdata/syslog.log",
+		[]string{"../examples/postfix.mtail", "../examples/sftp.mtail", "../examples/linecount.mtail"},
+	},
+	{
+		"json",
+		"testdata/json.log",
+		[]string{"testdata/json.mtail"},
+	},
+}
+
+// readLines returns the lines of the file at path.
+func readLines(tb testing.TB, path string) []string {
+	tb.Helper()
+	f, err := os.Open(path)
+	testutil.FatalIfErr(tb, err)
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	testutil.FatalIfErr(tb, scanner.Err())
+	return lines
+}
+
+// newEngine starts an Engine running the programs, with the options given.
+func newEngine(tb testing.TB, ctx context.Context, programs []string, options ...mtail.Option) *mtail.Engine {
+	tb.Helper()
+	var programOptions []mtail.Option
+	for _, p := range programs {
+		source, err := ioutil.ReadFile(p)
+		testutil.FatalIfErr(tb, err)
+		programOptions = append(programOptions, mtail.Program(filepath.Base(p), string(source)))
+	}
+	e, err := mtail.New(ctx, append(programOptions, options...)...)
+	testutil.FatalIfErr(tb, err)
+	return e
+}
+
+// TestCorpus checks that every program changes some metric on its corpus, so
+// that the benchmarks don't measure programs that match nothing.
+func TestCorpus(t *testing.T) {
+	for _, tc := range corpora {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			e := newEngine(t, ctx, tc.programs)
+			defer e.Close()
+			for _, line := range readLines(t, tc.logfile) {
+				e.ProcessLine(ctx, tc.logfile, line)
+			}
+			changed := make(map[string]bool)
+			for _, m := range e.Metrics() {
+				if m.Value != 0 || m.Count != 0 || m.Text != "" {
+					changed[m.Program] = true
+				}
+			}
+			for _, p := range tc.programs {
+				if !changed[filepath.Base(p)] {
+					t.Errorf("%s changed no metrics on %s", p, tc.logfile)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCorpus(b *testing.B) {
+	benchmarkCorpus(b)
+}
+
+// BenchmarkCorpusJIT runs the programs compiled by the JIT, which compiles
+// them after the first line.
+func BenchmarkCorpusJIT(b *testing.B) {
+	benchmarkCorpus(b, mtail.JIT(time.Nanosecond))
+}
+
+func benchmarkCorpus(b *testing.B, options ...mtail.Option) {
+	for _, bm := range corpora {
+		bm := bm
+		b.Run(bm.name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			lines := readLines(b, bm.logfile)
+			e := newEngine(b, ctx, bm.programs, options...)
+			defer e.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				e.ProcessLine(ctx, bm.logfile, lines[i%len(lines)])
+			}
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "lines/s")
+		})
+	}
+}
@@ -0,0 +1,12 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package benchmarks measures mtail programs over the log corpora in
+// testdata, which are synthetic and use only documentation addresses.  Run
+// them with
+//
+//	go test -run=XXX -bench=. -benchmem ./benchmarks
+//
+// Each benchmark op is one log line, so ns/op and allocs/op are per line; the
+// lines/s metric is the throughput.  Compare two runs with cmd/mbenchcmp.
+package benchmarks
@@ -0,0 +1,180 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Command mbenchcmp compares two runs of Go benchmarks and fails if any has
+// regressed by more than a threshold.
+//
+//	go test -run=XXX -bench=. -benchmem -count=5 ./benchmarks > old.txt
+//	# change the code
+//	go test -run=XXX -bench=. -benchmem -count=5 ./benchmarks > new.txt
+//	mbenchcmp --threshold=10 old.txt new.txt
+//
+// The median of the results of a benchmark run more than once is compared,
+// so that one noisy run doesn't fail the comparison.  Every unit a
+// benchmark reports in both runs is compared; a rate, like lines/s or MB/s,
+// regresses when it falls, and any other unit when it rises.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+var threshold = flag.Float64("threshold", 10, "Percentage by which a benchmark may regress before failing.")
+
+// result is the median of each unit a benchmark reported.
+type result map[string]float64
+
+// parse reads the benchmark results in go test output, taking the median of
+// the results of each benchmark by unit.
+func parse(r io.Reader) (map[string]result, error) {
+	values := make(map[string]map[string][]float64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Benchmark lines are a name, an iteration count, and value-unit pairs.
+		if len(fields) < 4 || len(fields)%2 != 0 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+		name := fields[0]
+		if values[name] == nil {
+			values[name] = make(map[string][]float64)
+		}
+		for i := 2; i < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad value %q: %s", name, fields[i], err)
+			}
+			values[name][fields[i+1]] = append(values[name][fields[i+1]], v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	results := make(map[string]result, len(values))
+	for name, units := range values {
+		results[name] = make(result, len(units))
+		for unit, vs := range units {
+			results[name][unit] = median(vs)
+		}
+	}
+	return results, nil
+}
+
+// median returns the median of vs, which it sorts.
+func median(vs []float64) float64 {
+	sort.Float64s(vs)
+	n := len(vs)
+	if n%2 == 1 {
+		return vs[n/2]
+	}
+	return (vs[n/2-1] + vs[n/2]) / 2
+}
+
+// change is the difference in one unit of a benchmark between two runs.
+type change struct {
+	name, unit string
+	old, new   float64
+}
+
+// delta returns the percentage change from old to new.
+func (c change) delta() float64 {
+	if c.old == 0 {
+		return 0
+	}
+	return (c.new - c.old) / c.old * 100
+}
+
+// regressed reports whether the change is worse than threshold percent.
+func (c change) regressed(threshold float64) bool {
+	if strings.HasSuffix(c.unit, "/s") {
+		return -c.delta() > threshold
+	}
+	return c.delta() > threshold
+}
+
+// compare returns the changes in the units reported by a benchmark in both
+// runs, ordered by benchmark and unit.
+func compare(old, new map[string]result) []change {
+	var changes []change
+	for name, o := range old {
+		n, ok := new[name]
+		if !ok {
+			continue
+		}
+		for unit, v := range o {
+			if w, ok := n[unit]; ok {
+				changes = append(changes, change{name, unit, v, w})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].name != changes[j].name {
+			return changes[i].name < changes[j].name
+		}
+		return changes[i].unit < changes[j].unit
+	})
+	return changes
+}
+
+func parseFile(path string) (map[string]result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parse(f)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] old.txt new.txt\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	old, err := parseFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	new, err := parseFile(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	changes := compare(old, new)
+	if len(changes) == 0 {
+		fmt.Println("No benchmarks in common.")
+		return
+	}
+	regressions := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "benchmark\tunit\told\tnew\tdelta\t")
+	for _, c := range changes {
+		mark := ""
+		if c.regressed(*threshold) {
+			mark = "REGRESSED"
+			regressions++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.4g\t%.4g\t%+.2f%%\t%s\n", c.name, c.unit, c.old, c.new, c.delta(), mark)
+	}
+	w.Flush()
+	if regressions > 0 {
+		fmt.Fprintf(os.Stderr, "%d results regressed by more than %g%%\n", regressions, *threshold)
+		os.Exit(1)
+	}
+}
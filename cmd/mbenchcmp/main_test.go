@@ -0,0 +1,68 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+const oldRun = `goos: linux
+BenchmarkCorpus/nginx-4    2000    7000 ns/op    140000 lines/s    36 allocs/op
+BenchmarkCorpus/nginx-4    2000    9000 ns/op    120000 lines/s    36 allocs/op
+BenchmarkCorpus/nginx-4    500     30000 ns/op   30000 lines/s     36 allocs/op
+BenchmarkCorpus/json-4     2000    8000 ns/op    125000 lines/s    33 allocs/op
+BenchmarkGone-4            10      100 ns/op
+PASS
+ok  	github.com/google/mtail/benchmarks	0.070s
+`
+
+const newRun = `BenchmarkCorpus/nginx-4    2000    8200 ns/op    122000 lines/s    36 allocs/op
+BenchmarkCorpus/json-4     2000    8000 ns/op    125000 lines/s    40 allocs/op
+`
+
+func TestCompare(t *testing.T) {
+	old, err := parse(strings.NewReader(oldRun))
+	testutil.FatalIfErr(t, err)
+	new, err := parse(strings.NewReader(newRun))
+	testutil.FatalIfErr(t, err)
+
+	changes := compare(old, new)
+	expected := []change{
+		{"BenchmarkCorpus/json-4", "allocs/op", 33, 40},
+		{"BenchmarkCorpus/json-4", "lines/s", 125000, 125000},
+		{"BenchmarkCorpus/json-4", "ns/op", 8000, 8000},
+		{"BenchmarkCorpus/nginx-4", "allocs/op", 36, 36},
+		{"BenchmarkCorpus/nginx-4", "lines/s", 120000, 122000},
+		{"BenchmarkCorpus/nginx-4", "ns/op", 9000, 8200},
+	}
+	testutil.ExpectNoDiff(t, expected, changes, testutil.AllowUnexported(change{}))
+
+	var regressed []string
+	for _, c := range changes {
+		if c.regressed(10) {
+			regressed = append(regressed, c.name+" "+c.unit)
+		}
+	}
+	testutil.ExpectNoDiff(t, []string{"BenchmarkCorpus/json-4 allocs/op"}, regressed)
+}
+
+func TestMedian(t *testing.T) {
+	testutil.ExpectNoDiff(t, 2.0, median([]float64{3, 1, 2}))
+	testutil.ExpectNoDiff(t, 2.5, median([]float64{4, 1, 3, 2}))
+}
+
+func TestRegressedRate(t *testing.T) {
+	if !(change{"b", "lines/s", 100, 80}).regressed(10) {
+		t.Error("a 20% fall in lines/s not a regression")
+	}
+	if (change{"b", "lines/s", 100, 200}).regressed(10) {
+		t.Error("a rise in lines/s is a regression")
+	}
+	if (change{"b", "ns/op", 100, 50}).regressed(10) {
+		t.Error("a fall in ns/op is a regression")
+	}
+}
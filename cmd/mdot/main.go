@@ -25,11 +25,9 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"strings"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/mtail"
-	"github.com/google/mtail/internal/vm/ast"
 	"github.com/google/mtail/internal/vm/checker"
 	"github.com/google/mtail/internal/vm/parser"
 )
@@ -39,97 +37,6 @@ var (
 	httpPort = flag.String("http_port", "", "Port number to run HTTP server on.")
 )
 
-type dotter struct {
-	w        io.Writer
-	id       int
-	parentID []int // id of the parent node
-}
-
-func (d *dotter) nextID() int {
-	d.id++
-	return d.id
-}
-
-func (d *dotter) emitNode(id int, node ast.Node) {
-	attrs := map[string]string{
-		"label":   strings.Split(fmt.Sprintf("%T", node), ".")[1] + "\n",
-		"shape":   "box",
-		"style":   "filled",
-		"tooltip": node.Type().String(),
-	}
-	switch n := node.(type) {
-	case *ast.VarDecl, *ast.DecoDecl:
-		attrs["fillcolor"] = "lightgreen"
-		switch n := n.(type) {
-		case *ast.VarDecl:
-			attrs["label"] += fmt.Sprintf("%s %s", n.Kind, n.Name)
-		case *ast.DecoDecl:
-			attrs["label"] += n.Name
-		}
-	case *ast.IdTerm, *ast.CaprefTerm:
-		attrs["fillcolor"] = "pink"
-		attrs["shape"] = "ellipse"
-		switch n := n.(type) {
-		case *ast.IdTerm:
-			attrs["label"] += n.Name
-		case *ast.CaprefTerm:
-			attrs["label"] += fmt.Sprintf("$%s", n.Name)
-		}
-	case *ast.IntLit, *ast.FloatLit, *ast.PatternLit, *ast.StringLit:
-		attrs["fillcolor"] = "pink"
-		attrs["shape"] = "ellipse"
-		switch n := n.(type) {
-		case *ast.IntLit:
-			attrs["label"] += fmt.Sprintf("%d", n.I)
-		case *ast.FloatLit:
-			attrs["label"] += fmt.Sprintf("%g", n.F)
-		case *ast.PatternLit:
-			attrs["label"] += fmt.Sprintf("/%s/", n.Pattern)
-		case *ast.StringLit:
-			attrs["label"] += n.Text
-		}
-	case *ast.IndexedExpr, *ast.BinaryExpr, *ast.UnaryExpr, *ast.PatternExpr, *ast.BuiltinExpr:
-		attrs["fillcolor"] = "lightblue"
-		switch n := n.(type) {
-		case *ast.BinaryExpr:
-			attrs["label"] += parser.Kind(n.Op).String()
-		case *ast.UnaryExpr:
-			attrs["label"] += parser.Kind(n.Op).String()
-		case *ast.BuiltinExpr:
-			attrs["label"] += n.Name
-		}
-	}
-	pos := node.Pos()
-	if pos != nil {
-		attrs["xlabel"] = pos.String()
-	}
-	fmt.Fprintf(d.w, "n%d [", id)
-	for k, v := range attrs {
-		fmt.Fprintf(d.w, "%s=\"%s\" ", k, v)
-	}
-	fmt.Fprintf(d.w, "]\n")
-}
-
-func (d *dotter) emitLine(src, dst int) {
-	fmt.Fprintf(d.w, "n%d -> n%d\n", src, dst)
-}
-
-func (d *dotter) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
-	id := d.nextID()
-	d.emitNode(id, node)
-	if len(d.parentID) > 0 {
-		parentID := d.parentID[len(d.parentID)-1]
-		d.emitLine(parentID, id)
-	}
-	d.parentID = append(d.parentID, id)
-	return d, node
-}
-
-func (d *dotter) VisitAfter(node ast.Node) ast.Node {
-	d.parentID = d.parentID[:len(d.parentID)-1]
-	return node
-}
-
 func makeDot(name string, w io.Writer) error {
 	f, err := os.Open(name)
 	if err != nil {
@@ -143,9 +50,8 @@ func makeDot(name string, w io.Writer) error {
 	if err != nil {
 		return err
 	}
-	fmt.Fprintf(w, "digraph \"%s\" {\n", *prog)
-	dot := &dotter{w: w}
-	ast.Walk(dot, n)
+	fmt.Fprintf(w, "digraph %s {\n", parser.DotQuote(*prog))
+	parser.WriteDot(w, n, "")
 	fmt.Fprintf(w, "}\n")
 	return nil
 }
@@ -154,11 +60,11 @@ func main() {
 	flag.Parse()
 
 	if *prog == "" {
-		glog.Exitf("No -prog given")
+		logging.Exitf("No -prog given")
 	}
 
 	if *httpPort == "" {
-		glog.Exit(makeDot(*prog, os.Stdout))
+		logging.Exit(makeDot(*prog, os.Stdout))
 	}
 
 	http.HandleFunc("/",
@@ -201,5 +107,5 @@ func main() {
 			}
 		})
 	http.HandleFunc("/favicon.ico", mtail.FaviconHandler)
-	glog.Info(http.ListenAndServe(fmt.Sprintf(":%s", *httpPort), nil))
+	logging.Info(http.ListenAndServe(fmt.Sprintf(":%s", *httpPort), nil))
 }
@@ -12,7 +12,7 @@ import (
 	"io"
 	"os"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/vm/checker"
 	"github.com/google/mtail/internal/vm/parser"
 )
@@ -26,20 +26,20 @@ func main() {
 	flag.Parse()
 
 	if *prog == "" {
-		glog.Exitf("No -prog given")
+		logging.Exitf("No -prog given")
 	}
 
 	f, err := os.OpenFile(*prog, os.O_RDWR, 0)
 	if err != nil {
-		glog.Exit(err)
+		logging.Exit(err)
 	}
 	ast, err := parser.Parse(*prog, f)
 	if err != nil {
-		glog.Exit(err)
+		logging.Exit(err)
 	}
 	ast, err = checker.Check(ast)
 	if err != nil {
-		glog.Exit(err)
+		logging.Exit(err)
 	}
 	up := parser.Unparser{}
 	out := up.Unparse(ast)
@@ -0,0 +1,123 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/vm"
+)
+
+// benchCommand implements `mtail bench`, which replays a log corpus through a
+// compiled program and reports its throughput and the cost of each line of
+// the program source.
+func benchCommand(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	prog := fs.String("prog", "", "Path of the mtail program to benchmark.")
+	var logs seqStringFlag
+	fs.Var(&logs, "logs", "List of log files to replay through the program, separated by commas.  This flag may be specified multiple times.")
+	iterations := fs.Int("iterations", 1, "Number of times to replay the log corpus.")
+	profile := fs.Bool("profile", true, "Measure the time spent on each line of the program source.  This adds overhead to every instruction, so disable it to measure raw throughput.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mtail bench --prog x.mtail --logs sample.log\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *prog == "" || len(logs) == 0 || *iterations < 1 {
+		fs.Usage()
+		return 2
+	}
+	if err := bench(os.Stdout, *prog, logs, *iterations, *profile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func bench(w io.Writer, prog string, logs []string, iterations int, profile bool) error {
+	src, err := ioutil.ReadFile(prog)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(prog)
+	v, err := vm.Compile(name, bytes.NewReader(src), vm.CompileOptions{SyslogUseCurrentYear: true})
+	if err != nil {
+		return err
+	}
+	if profile {
+		v.EnableProfile()
+	}
+
+	// Read the whole corpus before starting, so that only the program is measured.
+	var lines []*logline.LogLine
+	ctx := context.Background()
+	for _, pathname := range logs {
+		f, err := os.Open(pathname)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines = append(lines, logline.New(ctx, pathname, scanner.Text()))
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	if len(lines) == 0 {
+		return fmt.Errorf("no log lines found in %q", logs)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for n := 0; n < iterations; n++ {
+		for _, l := range lines {
+			v.ProcessLogLine(ctx, l)
+		}
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	total := int64(len(lines) * iterations)
+	fmt.Fprintf(w, "Program: %s\n", prog)
+	fmt.Fprintf(w, "Lines: %d in %s\n", total, elapsed)
+	fmt.Fprintf(w, "Throughput: %.0f lines/s, %d ns/line\n", float64(total)/elapsed.Seconds(), elapsed.Nanoseconds()/total)
+	fmt.Fprintf(w, "Allocations: %.1f allocs/line, %.0f B/line\n",
+		float64(after.Mallocs-before.Mallocs)/float64(total),
+		float64(after.TotalAlloc-before.TotalAlloc)/float64(total))
+	if !profile {
+		return nil
+	}
+
+	source := strings.Split(string(src), "\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w)
+	fmt.Fprintln(tw, "line\tinstrs/line\tns/line\t\tsource")
+	for _, e := range v.Profile() {
+		text := ""
+		if e.SourceLine > 0 && e.SourceLine <= len(source) {
+			text = strings.TrimSpace(source[e.SourceLine-1])
+		}
+		fmt.Fprintf(tw, "%d\t%.1f\t%d\t\t%s\n", e.SourceLine, float64(e.Executions)/float64(total), e.Nanoseconds/total, text)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/mtail/internal/vm"
+)
+
+// compileCommand implements `mtail compile`, which compiles programs into a
+// bundle that mtail loads without compiling them again.
+func compileCommand(args []string) int {
+	fs := flag.NewFlagSet("compile", flag.ContinueOnError)
+	output := fs.String("o", "", "Write the bundle to this file, which must end in .mtailc.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mtail compile -o bundle.mtailc program.mtail | directory ...\n\nDirectories are searched for programs ending in .mtail.  The bundle is only written if every program compiles.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *output == "" || filepath.Ext(*output) != ".mtailc" || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	paths, err := programPaths(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(paths) == 0 {
+		fmt.Fprintf(os.Stderr, "no programs found in %q\n", fs.Args())
+		return 1
+	}
+	if err := writeBundle(*output, paths); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Compiled %d programs into %s\n", len(paths), *output)
+	return 0
+}
+
+// writeBundle writes the bundle of the programs at paths to output, replacing
+// it at once so that an mtail loading it never reads a partial bundle.
+func writeBundle(output string, paths []string) error {
+	f, err := ioutil.TempFile(filepath.Dir(output), "."+filepath.Base(output))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := vm.WriteBundle(f, paths); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), output)
+}
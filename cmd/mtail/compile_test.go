@@ -0,0 +1,35 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestWriteBundle(t *testing.T) {
+	dir, rmDir := testutil.TestTempDir(t)
+	defer rmDir()
+	good := filepath.Join(dir, "good.mtail")
+	testutil.FatalIfErr(t, ioutil.WriteFile(good, []byte("counter a\n/x/ {\n  a++\n}\n"), 0600))
+	bad := filepath.Join(dir, "bad.mtail")
+	testutil.FatalIfErr(t, ioutil.WriteFile(bad, []byte("counter a\n/(/ {\n  a++\n}\n"), 0600))
+	output := filepath.Join(dir, "progs.mtailc")
+
+	if err := writeBundle(output, []string{good, bad}); err == nil {
+		t.Error("expected an error bundling a program that doesn't compile")
+	}
+	// Nothing is left behind by a failed compile.
+	fis, err := ioutil.ReadDir(dir)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, 2, len(fis))
+
+	testutil.FatalIfErr(t, writeBundle(output, []string{good}))
+	fis, err = ioutil.ReadDir(dir)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, 3, len(fis))
+}
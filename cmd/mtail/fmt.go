@@ -0,0 +1,129 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/mtail/internal/vm/parser"
+)
+
+// fmtCommand implements `mtail fmt`, which rewrites programs in the canonical
+// style.
+func fmtCommand(args []string) int {
+	fs := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	write := fs.Bool("w", false, "Write the formatted program back to its file instead of to standard output.")
+	list := fs.Bool("l", false, "List the programs that aren't in the canonical style instead of writing them out, and exit with status 1 if there are any.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mtail fmt [-l] [-w] [program.mtail | directory ...]\n\nWithout arguments, formats standard input to standard output.  Directories are searched for programs ending in .mtail.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		if *write {
+			fs.Usage()
+			return 2
+		}
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		changed, err := formatProgram(os.Stdout, "<stdin>", src, false, *list)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if changed && *list {
+			return 1
+		}
+		return 0
+	}
+	paths, err := programPaths(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	status := 0
+	for _, path := range paths {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		changed, err := formatProgram(os.Stdout, path, src, *write, *list)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		if changed && *list {
+			status = 1
+		}
+	}
+	return status
+}
+
+// programPaths returns the programs named by args, each either a program or a
+// directory of programs.
+func programPaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*.mtail"))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// formatProgram formats the program named name with source src, and reports
+// whether its formatting changed.  The name of a changed program is written to
+// w if list is set, and the program is written back to the file called name if
+// write is set.  Otherwise the formatted program is written to w.
+func formatProgram(w io.Writer, name string, src []byte, write, list bool) (bool, error) {
+	out, err := parser.Format(name, bytes.NewReader(src))
+	if err != nil {
+		return false, err
+	}
+	changed := !bytes.Equal(src, out)
+	if !write && !list {
+		_, err := w.Write(out)
+		return changed, err
+	}
+	if !changed {
+		return false, nil
+	}
+	if list {
+		if _, err := fmt.Fprintln(w, name); err != nil {
+			return true, err
+		}
+	}
+	if write {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return true, err
+		}
+		return true, ioutil.WriteFile(name, out, fi.Mode())
+	}
+	return true, nil
+}
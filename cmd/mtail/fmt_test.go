@@ -0,0 +1,45 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestFormatProgram(t *testing.T) {
+	dir, rmDir := testutil.TestTempDir(t)
+	defer rmDir()
+	path := filepath.Join(dir, "a.mtail")
+	src := []byte("counter a\n/x/{\n      a++\n}\n")
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, src, 0600))
+	formatted := "counter a\n/x/ {\n  a++\n}\n"
+
+	var out bytes.Buffer
+	changed, err := formatProgram(&out, path, src, false, false)
+	testutil.FatalIfErr(t, err)
+	if !changed {
+		t.Error("formatting not reported as changed")
+	}
+	testutil.ExpectNoDiff(t, formatted, out.String())
+
+	out.Reset()
+	_, err = formatProgram(&out, path, src, true, true)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, path+"\n", out.String())
+	got, err := ioutil.ReadFile(path)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, formatted, string(got))
+
+	out.Reset()
+	changed, err = formatProgram(&out, path, got, false, true)
+	testutil.FatalIfErr(t, err)
+	if changed || out.Len() > 0 {
+		t.Errorf("formatted program listed: %q", out.String())
+	}
+}
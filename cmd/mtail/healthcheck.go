@@ -0,0 +1,115 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// healthcheckCommand implements `mtail healthcheck`, which probes the health
+// endpoint of a running mtail and exits 0 if it is healthy and 1 if not, so
+// that container images without curl or wget can define health checks and
+// exec probes.
+func healthcheckCommand(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	address := fs.String("address", "localhost", "Address of the mtail to check: a host or IP address, checked at --port; a host:port pair, with an IPv6 address in brackets; or a UNIX socket path starting with /.")
+	port := fs.String("port", "3903", "HTTP port of the mtail to check, if --address has none.")
+	ready := fs.Bool("ready", false, "Check readiness at /readyz, instead of liveness at /healthz.")
+	timeout := fs.Duration("timeout", 5*time.Second, "Time to wait for the mtail to answer before reporting it unhealthy.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mtail healthcheck [--address localhost:3903] [--ready]\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 || *address == "" {
+		fs.Usage()
+		return 2
+	}
+	endpoint := "/healthz"
+	if *ready {
+		endpoint = "/readyz"
+	}
+	if err := healthcheck(os.Stdout, *address, *port, endpoint, *timeout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// healthcheck fetches endpoint from the mtail at address, and reports its
+// status to w, returning an error if it is not healthy.
+func healthcheck(w io.Writer, address, port, endpoint string, timeout time.Duration) error {
+	as, err := parseAddresses([]string{address}, port, "")
+	if err != nil {
+		return err
+	}
+	a := as[0]
+	host := a.host
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		// A listener on all addresses is reached on this host.
+		host = "localhost"
+	}
+	uri := "http://" + net.JoinHostPort(host, a.port) + endpoint
+	transport := &http.Transport{}
+	if a.unixSocket != "" {
+		uri = "http://unix" + endpoint
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", a.unixSocket)
+		}
+	}
+	client := &http.Client{Transport: transport, Timeout: timeout}
+	resp, err := client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var report struct {
+		Status     string
+		Components []struct {
+			Component string
+			Critical  bool
+			Ready     bool
+			Wedged    bool
+		}
+	}
+	if err := json.Unmarshal(b, &report); err != nil {
+		return errors.Errorf("%s returned %s, and not a health report: %s", endpoint, resp.Status, err)
+	}
+	var problems []string
+	for _, c := range report.Components {
+		switch {
+		case c.Wedged && c.Critical:
+			problems = append(problems, c.Component+" wedged")
+		case endpoint == "/readyz" && !c.Ready:
+			problems = append(problems, c.Component+" not ready")
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(problems) > 0 {
+			return errors.Errorf("%s: %s", report.Status, strings.Join(problems, ", "))
+		}
+		return errors.Errorf("%s: %s returned %s", report.Status, endpoint, resp.Status)
+	}
+	fmt.Fprintln(w, report.Status)
+	return nil
+}
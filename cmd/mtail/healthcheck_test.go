@@ -0,0 +1,73 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestHealthcheck(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.Write([]byte(`{"status":"ok","components":[{"component":"tailer","critical":true,"ready":true}]}`))
+		case "/readyz":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"status":"not ready","components":[{"component":"tailer","critical":true,"ready":true},{"component":"loader","critical":true}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+	addr := s.Listener.Addr().String()
+
+	var out bytes.Buffer
+	testutil.FatalIfErr(t, healthcheck(&out, addr, "3903", "/healthz", time.Second))
+	testutil.ExpectNoDiff(t, "ok\n", out.String())
+
+	err := healthcheck(&out, addr, "3903", "/readyz", time.Second)
+	if err == nil {
+		t.Fatal("expected an error from an instance that isn't ready")
+	}
+	testutil.ExpectNoDiff(t, "not ready: loader not ready", err.Error())
+
+	// Not an mtail.
+	if err := healthcheck(&out, addr, "3903", "/missing", time.Second); err == nil {
+		t.Error("expected an error for an endpoint that isn't a health report")
+	}
+
+	// Nothing listening.
+	_, port, err := net.SplitHostPort(addr)
+	testutil.FatalIfErr(t, err)
+	s.Close()
+	if err := healthcheck(&out, "127.0.0.1", port, "/healthz", time.Second); err == nil {
+		t.Error("expected an error with nothing listening")
+	}
+}
+
+func TestHealthcheckUnixSocket(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	socket := filepath.Join(tmpDir, "mtail.sock")
+	l, err := net.Listen("unix", socket)
+	testutil.FatalIfErr(t, err)
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+
+	var out bytes.Buffer
+	testutil.FatalIfErr(t, healthcheck(&out, socket, "3903", "/healthz", time.Second))
+	testutil.ExpectNoDiff(t, "ok\n", out.String())
+}
@@ -0,0 +1,45 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// lookupIds resolves the --setuid and --setgid flags, each either a name or a
+// number, to a uid and gid.  An empty username keeps the current uid, and an
+// empty groupname means the user's primary group.
+func lookupIds(username, groupname string) (uid, gid int, err error) {
+	uid, gid = os.Getuid(), os.Getgid()
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			if u, err = user.LookupId(username); err != nil {
+				return 0, 0, errors.Errorf("unknown user %q", username)
+			}
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, errors.Wrapf(err, "user %q", username)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return 0, 0, errors.Wrapf(err, "user %q", username)
+		}
+	}
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupname); err != nil {
+				return 0, 0, errors.Errorf("unknown group %q", groupname)
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, errors.Wrapf(err, "group %q", groupname)
+		}
+	}
+	return uid, gid, nil
+}
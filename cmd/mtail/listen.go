@@ -0,0 +1,107 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/pkg/errors"
+)
+
+// listenAddress is a host and port, or a UNIX socket path, for the HTTP
+// server to listen on.
+type listenAddress struct {
+	host, port string
+	unixSocket string
+}
+
+func (a listenAddress) option() mtail.Option {
+	if a.unixSocket != "" {
+		return mtail.BindUnixSocket(a.unixSocket)
+	}
+	return mtail.BindAddress(a.host, a.port)
+}
+
+// parseAddresses resolves the --address, --port and --unix_socket flags to the
+// addresses to listen on.  Each address is a host or IP address, listened on
+// at port; a host:port pair, with an IPv6 address in brackets; or a UNIX
+// socket path starting with /.  Without any addresses, all addresses are
+// listened on at port, unless there is a unixSocket.
+func parseAddresses(addresses []string, port, unixSocket string) ([]listenAddress, error) {
+	var as []listenAddress
+	for _, a := range addresses {
+		switch {
+		case a == "":
+			continue
+		case strings.HasPrefix(a, "/"):
+			as = append(as, listenAddress{unixSocket: a})
+		case strings.HasPrefix(a, "[") && strings.HasSuffix(a, "]"):
+			as = append(as, listenAddress{host: a[1 : len(a)-1], port: port})
+		default:
+			host, p, err := net.SplitHostPort(a)
+			if err != nil {
+				// Not a host:port pair, so a host alone, or an IPv6
+				// address without brackets.
+				if strings.Contains(a, "[") || strings.Contains(a, "]") {
+					return nil, errors.Errorf("invalid address %q", a)
+				}
+				host, p = a, port
+			}
+			as = append(as, listenAddress{host: host, port: p})
+		}
+	}
+	if unixSocket != "" {
+		as = append(as, listenAddress{unixSocket: unixSocket})
+	}
+	if len(as) == 0 {
+		as = append(as, listenAddress{port: port})
+	}
+	return as, nil
+}
+
+// bindOptions returns the options binding the HTTP server to each of the
+// addresses given by the --address, --port and --unix_socket flags.
+func bindOptions(addresses []string, port, unixSocket string) ([]mtail.Option, error) {
+	as, err := parseAddresses(addresses, port, unixSocket)
+	if err != nil {
+		return nil, err
+	}
+	opts := make([]mtail.Option, 0, len(as))
+	for _, a := range as {
+		opts = append(opts, a.option())
+	}
+	return opts, nil
+}
+
+// unixSocketPermissions resolves the --unix_socket_mode, --unix_socket_owner
+// and --unix_socket_group flags to a mode, uid and gid.  An empty flag leaves
+// that unchanged, as a mode of zero, or a uid or gid of -1.
+func unixSocketPermissions(mode, owner, group string) (os.FileMode, int, int, error) {
+	var m os.FileMode
+	if mode != "" {
+		v, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || v > 0o777 {
+			return 0, 0, 0, errors.Errorf("invalid mode %q, expecting octal permissions such as 0660", mode)
+		}
+		m = os.FileMode(v)
+	}
+	uid, gid := -1, -1
+	if owner != "" || group != "" {
+		u, g, err := lookupIds(owner, group)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if owner != "" {
+			uid = u
+		}
+		if group != "" {
+			gid = g
+		}
+	}
+	return m, uid, gid, nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestParseAddresses(t *testing.T) {
+	for _, tc := range []struct {
+		addresses  []string
+		unixSocket string
+		expected   []listenAddress
+	}{
+		{nil, "", []listenAddress{{port: "3903"}}},
+		{nil, "/run/mtail.sock", []listenAddress{{unixSocket: "/run/mtail.sock"}}},
+		{
+			[]string{"127.0.0.1", "::1", "[fe80::1]", "localhost:8080", "[::]:9090", "/run/mtail.sock"},
+			"",
+			[]listenAddress{
+				{host: "127.0.0.1", port: "3903"},
+				{host: "::1", port: "3903"},
+				{host: "fe80::1", port: "3903"},
+				{host: "localhost", port: "8080"},
+				{host: "::", port: "9090"},
+				{unixSocket: "/run/mtail.sock"},
+			},
+		},
+		{[]string{"0.0.0.0"}, "/run/mtail.sock", []listenAddress{{host: "0.0.0.0", port: "3903"}, {unixSocket: "/run/mtail.sock"}}},
+	} {
+		as, err := parseAddresses(tc.addresses, "3903", tc.unixSocket)
+		testutil.FatalIfErr(t, err)
+		testutil.ExpectNoDiff(t, tc.expected, as, testutil.AllowUnexported(listenAddress{}))
+	}
+	if _, err := parseAddresses([]string{"[::1"}, "3903", ""); err == nil {
+		t.Error("expected an error for an unclosed bracket")
+	}
+}
+
+func TestUnixSocketPermissions(t *testing.T) {
+	mode, uid, gid, err := unixSocketPermissions("0660", "", "")
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, []int{0o660, -1, -1}, []int{int(mode), uid, gid})
+	for _, mode := range []string{"rw-rw----", "1777", "9"} {
+		if _, _, _, err := unixSocketPermissions(mode, "", ""); err == nil {
+			t.Errorf("expected an error for mode %q", mode)
+		}
+	}
+}
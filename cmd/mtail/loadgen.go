@@ -0,0 +1,445 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// loadgenCommand implements `mtail loadgen`, which writes synthetic log lines
+// at a steady rate into files, named pipes or unix sockets tailed by a running
+// mtail, and measures how long the lines take to be counted in one of its
+// metrics, so that an installation can be sized before it meets production
+// traffic.
+func loadgenCommand(args []string) int {
+	fs := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	var outputs seqStringFlag
+	fs.Var(&outputs, "output", "List of the logs to write lines to, separated by commas: files, which are appended to, named pipes, or unixgram sockets that mtail is reading.  The lines are spread evenly over them.  This flag may be specified multiple times.")
+	format := fs.String("format", "common", "Format of the lines written: common, for the Apache common log format; syslog; or json.")
+	sample := fs.String("sample", "", "If set, a file of log lines to write in turn, over and over, instead of lines in --format.")
+	rate := fs.Float64("rate", 1000, "Lines to write per second, over all --outputs.  Zero writes as fast as possible.")
+	duration := fs.Duration("duration", 10*time.Second, "How long to write lines for.")
+	maxLines := fs.Int64("lines", 0, "If set, stop after writing this many lines, even if --duration hasn't passed.")
+	mtailURL := fs.String("mtail", "", "If set, the HTTP address of the mtail reading the --outputs, such as http://localhost:3903, to measure the latency of.")
+	metric := fs.String("metric", "", "Name of the metric of the --mtail that counts the lines written, summed over all its label sets, such as a counter incremented by every line of the --outputs.")
+	interval := fs.Duration("latency_interval", 100*time.Millisecond, "How often to read --metric while measuring latency.")
+	drainTimeout := fs.Duration("drain_timeout", 10*time.Second, "How long to wait, after writing stops, for --metric to count every line written.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mtail loadgen --output /var/log/loadgen.log --rate 5000 [--mtail http://localhost:3903 --metric loadgen_lines]\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 || len(outputs) == 0 || *rate < 0 || *duration <= 0 || (*mtailURL != "") != (*metric != "") || *interval <= 0 {
+		fs.Usage()
+		return 2
+	}
+	gen, ok := lineFormats[*format]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown --format %q, expecting one of %s\n", *format, strings.Join(lineFormatNames(), ", "))
+		return 2
+	}
+	if *sample != "" {
+		var err error
+		gen, err = sampleLines(*sample)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	l := &loadgen{
+		gen:      gen,
+		rate:     *rate,
+		duration: *duration,
+		maxLines: *maxLines,
+	}
+	for _, pathname := range outputs {
+		o, err := openLoadgenOutput(pathname)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer o.Close()
+		l.outputs = append(l.outputs, o)
+	}
+	if *mtailURL != "" {
+		l.probe = &latencyProbe{
+			uri:      strings.TrimRight(*mtailURL, "/") + "/metrics",
+			metric:   *metric,
+			interval: *interval,
+			drain:    *drainTimeout,
+			client:   &http.Client{Timeout: *interval * 10},
+		}
+	}
+	if err := l.run(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// A lineGenerator returns the text of the n'th line written, at time t.
+type lineGenerator func(n int64, t time.Time) string
+
+var (
+	loadgenPaths    = []string{"/", "/index.html", "/api/v1/users", "/api/v1/orders", "/static/app.js", "/healthz"}
+	loadgenStatuses = []int{200, 200, 200, 200, 200, 200, 200, 301, 404, 500}
+)
+
+// lineFormats are the built in formats of synthetic lines, chosen with
+// --format.
+var lineFormats = map[string]lineGenerator{
+	"common": func(n int64, t time.Time) string {
+		return fmt.Sprintf(`10.0.%d.%d - - [%s] "GET %s HTTP/1.1" %d %d`,
+			pick(n, 0, 256), pick(n, 1, 256), t.Format("02/Jan/2006:15:04:05 -0700"),
+			loadgenPaths[pick(n, 2, len(loadgenPaths))], loadgenStatuses[pick(n, 3, len(loadgenStatuses))], pick(n, 4, 20000))
+	},
+	"syslog": func(n int64, t time.Time) string {
+		return fmt.Sprintf("%s loadgen app[%d]: request %d for %s took %dms",
+			t.Format(time.Stamp), 1000+pick(n, 0, 8), n, loadgenPaths[pick(n, 2, len(loadgenPaths))], pick(n, 5, 500))
+	},
+	"json": func(n int64, t time.Time) string {
+		return fmt.Sprintf(`{"time":%q,"level":"info","path":%q,"status":%d,"latency_ms":%d,"seq":%d}`,
+			t.Format(time.RFC3339Nano), loadgenPaths[pick(n, 2, len(loadgenPaths))], loadgenStatuses[pick(n, 3, len(loadgenStatuses))], pick(n, 5, 500), n)
+	},
+}
+
+// pick returns a number less than k, for field i of the n'th line.  The
+// numbers look random, but are the same in every run, and cheap enough to
+// make for every line.
+func pick(n int64, i uint64, k int) int {
+	x := uint64(n)*0x9e3779b97f4a7c15 + i*0xbf58476d1ce4e5b9
+	x ^= x >> 31
+	x *= 0x94d049bb133111eb
+	x ^= x >> 29
+	return int(x % uint64(k))
+}
+
+func lineFormatNames() []string {
+	var names []string
+	for name := range lineFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sampleLines returns a generator of the lines of the file at pathname, in
+// turn.
+func sampleLines(pathname string) (lineGenerator, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errors.Errorf("no lines in sample %s", pathname)
+	}
+	return func(n int64, _ time.Time) string {
+		return lines[n%int64(len(lines))]
+	}, nil
+}
+
+// loadgenOutput is a log written to by loadgen.
+type loadgenOutput struct {
+	io.WriteCloser
+	maxWrite int // The most bytes written at once, or zero for no limit.
+}
+
+// maxDatagram is the largest datagram written to a unix socket, as the tailer
+// reads each into a buffer of this size.
+const maxDatagram = 4096
+
+// openLoadgenOutput opens the log at pathname for writing: a unixgram socket
+// if there is one there, and otherwise a file or named pipe, created if it
+// doesn't exist.
+func openLoadgenOutput(pathname string) (*loadgenOutput, error) {
+	if fi, err := os.Stat(pathname); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		c, err := net.Dial("unixgram", pathname)
+		if err != nil {
+			return nil, err
+		}
+		return &loadgenOutput{c, maxDatagram}, nil
+	}
+	f, err := os.OpenFile(pathname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &loadgenOutput{f, 0}, nil
+}
+
+// write writes b, which is whole lines, splitting it at line ends into writes
+// of at most maxWrite bytes.
+func (o *loadgenOutput) write(b []byte) error {
+	for len(b) > 0 {
+		n := len(b)
+		if o.maxWrite > 0 && n > o.maxWrite {
+			n = bytes.LastIndexByte(b[:o.maxWrite], '\n') + 1
+			if n == 0 {
+				// A line too long for one write is split over several.
+				n = o.maxWrite
+			}
+		}
+		if _, err := o.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// loadgen writes lines to its outputs at a steady rate.
+type loadgen struct {
+	gen      lineGenerator
+	outputs  []*loadgenOutput
+	rate     float64 // Lines per second, or zero for as fast as possible.
+	duration time.Duration
+	maxLines int64
+	probe    *latencyProbe // If set, measures the latency of the lines written.
+
+	mu      sync.Mutex
+	written []writeMark // The lines written by each time.
+}
+
+// A writeMark records that lines lines had been written at time t.
+type writeMark struct {
+	lines int64
+	t     time.Time
+}
+
+// loadgenTick is how often lines are written at a steady rate.
+const loadgenTick = 10 * time.Millisecond
+
+// loadgenBatch is how many lines are written at once when writing as fast as
+// possible.
+const loadgenBatch = 1000
+
+// run writes the lines, and writes a report of how many were written, and
+// their latency if measured, to w.
+func (l *loadgen) run(w io.Writer) error {
+	done := make(chan struct{})
+	probeErr := make(chan error, 1)
+	if l.probe != nil {
+		if err := l.probe.start(); err != nil {
+			return err
+		}
+		go func() {
+			probeErr <- l.probe.run(l.writtenAt, l.lines, done)
+		}()
+	}
+	start := time.Now()
+	end := start.Add(l.duration)
+	var n int64
+	var buf bytes.Buffer
+	ticker := time.NewTicker(loadgenTick)
+	defer ticker.Stop()
+	for now := start; now.Before(end) && (l.maxLines == 0 || n < l.maxLines); {
+		due := n + loadgenBatch
+		if l.rate > 0 {
+			due = int64(l.rate * now.Sub(start).Seconds())
+		}
+		if l.maxLines > 0 && due > l.maxLines {
+			due = l.maxLines
+		}
+		// Each output gets its share of the lines due, in turn.
+		for i, o := range l.outputs {
+			buf.Reset()
+			for j := n + int64(i); j < due; j += int64(len(l.outputs)) {
+				buf.WriteString(l.gen(j, now))
+				buf.WriteByte('\n')
+			}
+			if err := o.write(buf.Bytes()); err != nil {
+				close(done)
+				return err
+			}
+		}
+		if due > n {
+			n = due
+			l.mark(n, time.Now())
+		}
+		if l.rate > 0 {
+			now = <-ticker.C
+		} else {
+			now = time.Now()
+		}
+	}
+	elapsed := time.Since(start)
+	close(done)
+	fmt.Fprintf(w, "Wrote %d lines in %s: %.0f lines/s\n", n, elapsed.Round(time.Millisecond), float64(n)/elapsed.Seconds())
+	if l.probe == nil {
+		return nil
+	}
+	if err := <-probeErr; err != nil {
+		return err
+	}
+	l.probe.report(w, n)
+	return nil
+}
+
+func (l *loadgen) mark(n int64, t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.written = append(l.written, writeMark{n, t})
+}
+
+// lines returns how many lines have been written.
+func (l *loadgen) lines() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.written) == 0 {
+		return 0
+	}
+	return l.written[len(l.written)-1].lines
+}
+
+// writtenAt returns when the n'th line was written, or false if it
+// hasn't been.
+func (l *loadgen) writtenAt(n int64) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := sort.Search(len(l.written), func(i int) bool { return l.written[i].lines >= n })
+	if i == len(l.written) {
+		return time.Time{}, false
+	}
+	return l.written[i].t, true
+}
+
+// latencyProbe measures the latency of the lines written, as the time from
+// when the newest line counted by the metric was written until it was seen
+// counted.  Each reading is late by up to the interval between readings.
+type latencyProbe struct {
+	uri      string
+	metric   string
+	interval time.Duration
+	drain    time.Duration
+	client   *http.Client
+
+	base      float64         // The metric's value before any lines were written.
+	latencies []time.Duration // The latency at each reading that saw new lines counted.
+	counted   int64           // The lines counted at the last reading.
+}
+
+// start takes the value of the metric before any lines are written.
+func (p *latencyProbe) start() error {
+	v, err := p.read()
+	if err != nil {
+		return err
+	}
+	p.base = v
+	return nil
+}
+
+// read returns the value of the metric, summed over its label sets.
+func (p *latencyProbe) read() (float64, error) {
+	resp, err := p.client.Get(p.uri)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("%s returned %s", p.uri, resp.Status)
+	}
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parsing %s", p.uri)
+	}
+	mf, ok := mfs[p.metric]
+	if !ok {
+		return 0, errors.Errorf("no metric %q at %s", p.metric, p.uri)
+	}
+	return sumMetric(mf), nil
+}
+
+// sumMetric returns the sum of the values of a counter, gauge or untyped
+// metric.
+func sumMetric(mf *dto.MetricFamily) float64 {
+	var sum float64
+	for _, m := range mf.Metric {
+		switch {
+		case m.Counter != nil:
+			sum += m.Counter.GetValue()
+		case m.Gauge != nil:
+			sum += m.Gauge.GetValue()
+		case m.Untyped != nil:
+			sum += m.Untyped.GetValue()
+		}
+	}
+	return sum
+}
+
+// run reads the metric every interval, finding when the lines it counts were
+// written with writtenBy, until done is closed and every line written, as
+// returned by lines, has been counted, or the drain timeout passes.
+func (p *latencyProbe) run(writtenBy func(int64) (time.Time, bool), lines func() int64, done <-chan struct{}) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	var deadline <-chan time.Time
+	for {
+		select {
+		case <-done:
+			done = nil
+			deadline = time.After(p.drain)
+			continue
+		case <-deadline:
+			return nil
+		case <-ticker.C:
+		}
+		v, err := p.read()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		counted := int64(v - p.base)
+		if counted > p.counted {
+			p.counted = counted
+			if t, ok := writtenBy(counted); ok {
+				p.latencies = append(p.latencies, now.Sub(t))
+			}
+		}
+		if done == nil && p.counted >= lines() {
+			return nil
+		}
+	}
+}
+
+// report writes the percentiles of the latencies measured to w, and how many
+// of the written lines were counted.
+func (p *latencyProbe) report(w io.Writer, written int64) {
+	fmt.Fprintf(w, "Counted %d of %d lines in %s\n", p.counted, written, p.metric)
+	if len(p.latencies) == 0 {
+		fmt.Fprintln(w, "No latency measured")
+		return
+	}
+	l := append([]time.Duration(nil), p.latencies...)
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	q := func(f float64) time.Duration {
+		return l[int(f*float64(len(l)-1))].Round(time.Millisecond)
+	}
+	fmt.Fprintf(w, "Latency over %d readings: p50 %s, p90 %s, p99 %s, max %s\n", len(l), q(0.5), q(0.9), q(0.99), q(1))
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestLoadgenFiles(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	l := &loadgen{gen: lineFormats["json"], duration: time.Minute, maxLines: 2001}
+	var paths []string
+	for _, name := range []string{"a.log", "b.log"} {
+		pathname := filepath.Join(tmpDir, name)
+		o, err := openLoadgenOutput(pathname)
+		testutil.FatalIfErr(t, err)
+		defer o.Close()
+		l.outputs = append(l.outputs, o)
+		paths = append(paths, pathname)
+	}
+	var out bytes.Buffer
+	testutil.FatalIfErr(t, l.run(&out))
+	if !strings.HasPrefix(out.String(), "Wrote 2001 lines") {
+		t.Errorf("unexpected report: %s", out.String())
+	}
+	var total int
+	for _, pathname := range paths {
+		b, err := ioutil.ReadFile(pathname)
+		testutil.FatalIfErr(t, err)
+		lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+		total += len(lines)
+		var v map[string]interface{}
+		testutil.FatalIfErr(t, json.Unmarshal([]byte(lines[0]), &v))
+	}
+	testutil.ExpectNoDiff(t, 2001, total)
+}
+
+func TestLoadgenLatency(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	o, err := openLoadgenOutput(filepath.Join(tmpDir, "log"))
+	testutil.FatalIfErr(t, err)
+	defer o.Close()
+	l := &loadgen{gen: lineFormats["common"], outputs: []*loadgenOutput{o}, rate: 1000, duration: 200 * time.Millisecond}
+	// The fake mtail counts the lines as soon as they are written, on top of
+	// some it counted before.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# TYPE loadgen_lines counter\nloadgen_lines{prog=\"loadgen.mtail\"} %d\n", 37+l.lines())
+	}))
+	defer ts.Close()
+	l.probe = &latencyProbe{uri: ts.URL, metric: "loadgen_lines", interval: 10 * time.Millisecond, drain: time.Second, client: ts.Client()}
+	var out bytes.Buffer
+	testutil.FatalIfErr(t, l.run(&out))
+	n := l.lines()
+	if n == 0 {
+		t.Fatal("no lines written")
+	}
+	for _, want := range []string{fmt.Sprintf("Counted %d of %d lines", n, n), "Latency over "} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in report:\n%s", want, out.String())
+		}
+	}
+}
+
+type recordingWriter struct {
+	writes []string
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.writes = append(w.writes, string(b))
+	return len(b), nil
+}
+
+func (w *recordingWriter) Close() error {
+	return nil
+}
+
+func TestLoadgenOutputSplitsWrites(t *testing.T) {
+	w := &recordingWriter{}
+	o := &loadgenOutput{w, 8}
+	testutil.FatalIfErr(t, o.write([]byte("one\ntwo\nthree\nfourteen!\n")))
+	testutil.ExpectNoDiff(t, []string{"one\ntwo\n", "three\n", "fourteen", "!\n"}, w.writes)
+}
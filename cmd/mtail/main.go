@@ -4,17 +4,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"regexp"
 	"runtime"
 	"strings"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/action"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/record"
+	"github.com/google/mtail/internal/vm"
 	"github.com/google/mtail/internal/watcher"
 	"go.opencensus.io/trace"
 )
@@ -34,10 +40,32 @@ func (f *seqStringFlag) Set(value string) error {
 
 var logs seqStringFlag
 
+var sdLabels seqStringFlag
+
+var logPollIntervals seqStringFlag
+
+var logTimezones seqStringFlag
+
+var logRecords seqStringFlag
+
+var programLogs seqStringFlag
+
+var execCommandList seqStringFlag
+
+var externConstList seqStringFlag
+
+var anomalyMetrics seqStringFlag
+
+var lowPriorityLogs seqStringFlag
+
+var addresses seqStringFlag
+
 var (
 	port               = flag.String("port", "3903", "HTTP port to listen on.")
-	address            = flag.String("address", "", "Host or IP address on which to bind HTTP listener")
-	unixSocket         = flag.String("unix_socket", "", "UNIX Socket to listen on")
+	unixSocket         = flag.String("unix_socket", "", "UNIX Socket to listen on.  Without --address, only this socket is listened on.")
+	unixSocketMode     = flag.String("unix_socket_mode", "", "If set, the octal permissions to give the UNIX sockets listened on, such as 0660.")
+	unixSocketOwner    = flag.String("unix_socket_owner", "", "If set, the user name or uid to give the UNIX sockets listened on to.")
+	unixSocketGroup    = flag.String("unix_socket_group", "", "If set, the group name or gid to give the UNIX sockets listened on to.")
 	progs              = flag.String("progs", "", "Name of the directory containing mtail programs")
 	ignoreRegexPattern = flag.String("ignore_filename_regex_pattern", "", "")
 
@@ -50,21 +78,93 @@ var (
 	dumpAstTypes = flag.Bool("dump_ast_types", false, "Dump AST of programs with type annotation after typecheck (to INFO log).")
 	dumpBytecode = flag.Bool("dump_bytecode", false, "Dump bytecode of programs (to INFO log).")
 
+	strictStartup = flag.Bool("strict_startup", false, "Exit with the errors of every program that fails to load or compile before reading any logs, instead of starting with the programs that do.  A program that fails to compile when reloaded later keeps running its last version.")
+
+	oneShotParquetFile     = flag.String("one_shot_parquet_file", "", "With --one_shot, also write the final metrics to this file in Parquet format, for analysis with SQL engines or dataframe libraries.")
+	oneShotOrder           = flag.String("one_shot_order", "", "With --one_shot, read the logs in the order they were written: by 'rotation', each log in turn with rotated logs oldest first, or by 'timestamp', interleaving the lines of all the logs by the timestamps matched by --one_shot_timestamp_regexp.  Logs ending in .gz are decompressed.  If empty, each log is read in turn in the order the patterns match them.")
+	oneShotTimestampRegexp = flag.String("one_shot_timestamp_regexp", "", "With --one_shot_order=timestamp, a regular expression whose first capture group is the timestamp of each log line.  Lines without one keep the timestamp of the line before.")
+	oneShotTimestampLayout = flag.String("one_shot_timestamp_layout", time.RFC3339, "The Go time layout of the timestamps captured by --one_shot_timestamp_regexp.")
+
 	// VM Runtime behaviour flags
 	syslogUseCurrentYear = flag.Bool("syslog_use_current_year", true, "Patch yearless timestamps with the present year.")
 	overrideTimezone     = flag.String("override_timezone", "", "If set, use the provided timezone in timestamp conversion, instead of UTC.")
 	emitProgLabel        = flag.Bool("emit_prog_label", true, "Emit the 'prog' label in variable exports.")
+	severityCounts       = flag.Bool("severity_counts", false, "Count the lines of each log by the severity they were logged at, recognised from tokens like ERROR or [warn], level= keys, syslog priorities and glog prefixes, exported as mtail_log_lines_by_severity_total by log and severity.  No program is needed.")
+	correctCounterResets = flag.Bool("correct_counter_resets", false, "Export a counter that a program decreases as though it had carried on from the value it had before, so that it never decreases and rates computed from it aren't broken.  Decreases are counted in mtail_metric_counter_resets_total either way.")
+	streamUpdates        = flag.Bool("stream_updates", false, "Stream each change programs make to their metrics from /stream as Server-Sent Events, selected with the name and match query parameters, as for /json.  Programs are slower while this is enabled, even with no clients connected.")
+	instrumentConditions = flag.Bool("instrument_conditions", false, "Count the lines matched by each top-level condition of the programs, exported as mtail_program_condition_matches_total by program and source line, to find the branches that are hot or never taken.")
 	emitMetricTimestamp  = flag.Bool("emit_metric_timestamp", false, "Emit the recorded timestamp of a metric.  If disabled (the default) no explicit timestamp is sent to a collector.")
+	openMetrics          = flag.Bool("openmetrics", false, "Answer scrapes of /metrics that accept it in the OpenMetrics format, whose responses end with an explicit # EOF so a truncated scrape is detected, rather than taken as the disappearance of the series it left out.")
+	timestampPolicy      = flag.String("timestamp_policy", "accept", "What to do with metric updates timestamped by a program more than --timestamp_max_future ahead or --timestamp_max_age behind the current time: accept them, clamp them to the current time, or drop them.")
+	timestampMaxFuture   = flag.Duration("timestamp_max_future", time.Hour, "How far ahead of the current time a program-set timestamp may be before --timestamp_policy applies, or zero for no limit.")
+	timestampMaxAge      = flag.Duration("timestamp_max_age", 24*time.Hour, "How far behind the current time a program-set timestamp may be before --timestamp_policy applies, or zero for no limit.")
+	intOverflow          = flag.String("int_overflow", "wrap", "What to do when a program increments or decrements an integer metric past the limits of a 64-bit integer: wrap around, which a collector sees as a counter reset, or saturate at the limit.  Either way, prog_int_overflows_total counts them.")
+
+	alertWebhookURL      = flag.String("alert_webhook_url", "", "URL to POST the alerts raised by the alert() builtin to.  If unset, alerts are logged.")
+	alertWebhookTemplate = flag.String("alert_webhook_template", "", "Go text/template of the JSON payload posted for each alert, over the fields Program, Message, Filename, Line, Time and Suppressed.  The json function quotes a value.  Defaults to an object of all the fields.")
+	alertTokenFile       = flag.String("alert_webhook_token_file", "", "Path to a file holding the bearer token to authorize alert webhook posts with.  If unset, the token is taken from the MTAIL_ALERT_WEBHOOK_TOKEN environment variable, and without either none is sent.  The file is reread when it changes.")
+	execTimeout          = flag.Duration("exec_timeout", 10*time.Second, "How long a command run by exec() may take before it is killed.")
+	execInterval         = flag.Duration("exec_interval", time.Minute, "The least time between runs of each command by exec(); requests sooner, or while it is still running, are ignored.  Zero for no limit.")
+	alertInterval        = flag.Duration("alert_interval", time.Minute, "The least time between alerts posted from each program; alerts raised sooner are counted in the next one's Suppressed field.  Zero for no limit.")
+
+	geoipCountryDB     = flag.String("geoip_country_db", "", "Path to a MaxMind GeoIP2 or GeoLite2 Country database for the geoip_country() builtin.")
+	geoipASNDB         = flag.String("geoip_asn_db", "", "Path to a MaxMind GeoLite2 ASN database for the geoip_asn() builtin.")
+	geoipCheckInterval = flag.Duration("geoip_check_interval", time.Minute, "How often to check the GeoIP databases for changes, rereading them if they have been replaced.")
+
+	fileLabelsFile = flag.String("file_labels", "", "Path to a JSON file of rules adding labels to all metrics by the path of the log each update came from: a list of objects with a path regular expression, whose named groups are labels, and a labels object of fixed labels.")
+
+	anomalyInterval = flag.Duration("anomaly_interval", time.Minute, "How often the --anomaly_metrics are sampled.")
+	anomalyAlpha    = flag.Float64("anomaly_alpha", 0.1, "The weight of each new sample of the --anomaly_metrics in their moving averages, between 0 and 1.  Larger weights follow changes sooner.")
+
+	externConstsFile = flag.String("extern_consts_file", "", "File of NAME=value lines giving the values of the extern consts declared by programs, for those not given with --extern_consts.  Blank lines and lines starting with # are ignored.  The file is read each time all the programs are loaded.")
+
+	hmacKeyFile = flag.String("hmac_key_file", "", "Path to a file holding the secret key of the hmac() builtin.  If unset, the key is taken from the "+hmacKeyEnv+" environment variable, and without either hmac() is disabled.")
+
+	sandboxPrograms    = flag.Bool("experimental_sandbox_programs", false, "Compile programs to WebAssembly and run them in a sandbox, rather than interpreting them, stopping a program on any line that takes longer than --sandbox_line_timeout or makes more than --sandbox_line_bytes of strings.  Experimental, and needs mtail built with Go 1.18 or later.")
+	sandboxLineTimeout = flag.Duration("sandbox_line_timeout", 100*time.Millisecond, "With --experimental_sandbox_programs, the longest a program may take on a line.")
+	sandboxLineBytes   = flag.Int("sandbox_line_bytes", 1<<20, "With --experimental_sandbox_programs, the most bytes of strings a program may make from a line, like the captures it refers to.")
+
+	jitAfter = flag.Duration("jit_after", 0, "If set, compile the bytecode of each program to Go closures once it has spent this long interpreting lines, so that the hottest programs run without the overhead of the interpreter.  Sandboxed programs, and those being traced, profiled, or having their coverage recorded, aren't compiled.")
+
+	programBundleURL          = flag.String("program_bundle_url", "", "If set, the URL of a tar archive, optionally gzipped, of programs to fetch into the --progs directory, replacing the programs there, and reload.")
+	programBundleSignatureURL = flag.String("program_bundle_signature_url", "", "URL of the detached ed25519 signature of the program bundle.  Defaults to --program_bundle_url with .sig appended.")
+	programBundlePublicKey    = flag.String("program_bundle_public_key", "", "Path to the ed25519 public key, PEM or base64 encoded, that the program bundle's signature must verify with.  Required with --program_bundle_url.")
+	programBundleInterval     = flag.Duration("program_bundle_poll_interval", 5*time.Minute, "How often to fetch the program bundle to check for a new one.")
 
 	// Ops flags
+	watcherBackend              = flag.String("watcher", "poll", "Source of file change notifications: poll, inotify or fanotify on Linux, or kqueue on the BSDs and macOS.  Files are always polled at --poll_interval as well; the others report changes sooner.  fanotify watches whole mounts, needing no resources per file, but requires CAP_SYS_ADMIN.  fanotify falls back to inotify, inotify to kqueue, and kqueue to polling alone, if not available.")
+	watcherCoalesceWindow       = flag.Duration("watcher_coalesce_window", 0, "With a --watcher other than poll, how long to gather change notifications before reading the logs they name, so a burst of writes to a log is read in one pass.  With zero, only notifications already waiting are gathered.")
+	recordWatcherEvents         = flag.String("record_watcher_events", "", "If set, a file to record each event the watcher sends to the tailer in, with a snapshot of the metadata of the file it names, but not its contents.  The recording can be replayed with `mtail replay-events` to reproduce a problem following logs, such as with rotation, and grows with each change to a watched log.")
+	maxOpenLogFiles             = flag.Int("max_open_log_files", 0, "The most regular log files to keep open at once, or zero for no limit.  Beyond this the least recently read logs are closed, and reopened at the same offset when they next change, so more logs can be tailed than the file descriptor limit allows.")
+	dedupWindow                 = flag.Duration("dedup_window", 0, "If set, drop each line that exactly repeats one of the recent lines of its log passed on within this long, so a log storm of one repeated error can't flood the metrics.  Repeats are counted in log_lines_deduplicated_total.")
+	memoryLimitMB               = flag.Int("memory_limit_mb", 0, "The memory in megabytes mtail should stay under, or zero for no limit.  When the memory in use nears the limit, mtail sheds load in stages until it falls again: pausing the --low_priority_logs, then skipping the lines not yet read of every log, then removing expired metrics.")
+	gomaxprocsFromCgroup        = flag.Bool("gomaxprocs_from_cgroup", false, "Set GOMAXPROCS to the number of CPUs the cgroup CPU quota allows, rounded up, unless GOMAXPROCS is set in the environment.  Linux only.")
+	cpuLimitPercent             = flag.Float64("cpu_limit_percent", 0, "The percentage of one CPU's time mtail may use; when it has used more, lines are held back from the programs, and so read from the logs later.  Zero disables the limit.")
+	nice                        = flag.Int("nice", 0, "The nice value to run at, from -20 for the most favourable scheduling to 19 for the least.  Zero leaves the nice value unchanged.  Only a privileged process may lower it.")
+	dedupLines                  = flag.Int("dedup_lines", 0, "The most recent distinct lines of each log remembered for dropping repeats; with --dedup_window of zero, a line is dropped for as long as it is among them.  Zero remembers only the last line, and with --dedup_window unset disables dropping repeats.")
 	pollInterval                = flag.Duration("poll_interval", 250*time.Millisecond, "Set the interval to poll all log files for data; must be positive, or zero to disable polling.  With polling mode, only the files found at mtail startup will be polled.")
 	expiredMetricGcTickInterval = flag.Duration("expired_metrics_gc_interval", time.Hour, "interval between expired metric garbage collection runs")
 	staleLogGcTickInterval      = flag.Duration("stale_log_gc_interval", time.Hour, "interval between stale log garbage collection runs")
+	logRateInterval             = flag.Duration("log_rate_interval", time.Minute, "Interval over which the rates of lines and bytes read from each log are measured, for the mtail_log_lines_per_second and mtail_log_bytes_per_second metrics.  Zero disables them.")
+	diagnosticsFile             = flag.String("diagnostics_file", "", "If set, the file to append a dump of the tailed logs, loaded programs and metric store to on SIGUSR1, instead of the info log.")
+	healthStallTimeout          = flag.Duration("health_stall_timeout", time.Minute, "Time a component may go without making progress before /healthz reports it as wedged.")
+
+	// Logging flags
+	logFormat = flag.String("log_format", "text", "Encoding of mtail's own log: text, written by glog to the destinations its flags choose, or json, writing one JSON object per entry to standard error.")
+
+	// Security flags
+	setuid     = flag.String("setuid", "", "If set, the user name or uid to run as once the listening socket is open.")
+	setgid     = flag.String("setgid", "", "If set, the group name or gid to run as once the listening socket is open.  Defaults to the primary group of the --setuid user.")
+	chrootDir  = flag.String("chroot", "", "If set, the directory to chroot into once the listening socket is open.  The --progs directory and --logs patterns must be inside it.")
+	useSeccomp = flag.Bool("seccomp", false, "Install a seccomp filter once privileges are dropped, denying system calls such as execve and mount.  Linux only.")
 
 	// Debugging flags
 	blockProfileRate     = flag.Int("block_profile_rate", 0, "Nanoseconds of block time before goroutine blocking events reported. 0 turns off.  See https://golang.org/pkg/runtime/#SetBlockProfileRate")
 	mutexProfileFraction = flag.Int("mutex_profile_fraction", 0, "Fraction of mutex contention events reported.  0 turns off.  See http://golang.org/pkg/runtime/#SetMutexProfileFraction")
 
+	// Service discovery
+	sdTarget = flag.String("sd_target", "", "The host:port advertised as this instance's scrape target on the /sd service discovery endpoint.  Defaults to the first TCP address listened on, or the hostname and port if that is all addresses.")
+
 	// Tracing
 	jaegerEndpoint    = flag.String("jaeger_endpoint", "", "If set, collector endpoint URL of jaeger thrift service")
 	traceSamplePeriod = flag.Int("trace_sample_period", 0, "Sample period for traces.  If non-zero, every nth trace will be sampled.")
@@ -73,8 +173,42 @@ var (
 	_ = flag.Bool("disable_fsnotify", true, "DEPRECATED: this flag is no longer in use.")
 )
 
+// hmacKeyEnv is the environment variable holding the key of the hmac()
+// builtin, if there is no --hmac_key_file.
+const hmacKeyEnv = "MTAIL_HMAC_KEY"
+
+// readHMACKey returns the key in the file at path, without any trailing
+// newline, or if path is empty the key in the environment, if any.
+func readHMACKey(path string) ([]byte, error) {
+	if path == "" {
+		if k := os.Getenv(hmacKeyEnv); k != "" {
+			return []byte(k), nil
+		}
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimRight(b, "\r\n")
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return b, nil
+}
+
 func init() {
+	flag.Var(&addresses, "address", "List of addresses to bind the HTTP listener to, separated by commas: hosts or IP addresses, listened on at --port, host:port pairs, with IPv6 addresses in brackets as in [::1]:3903, or UNIX socket paths starting with /.  Defaults to all addresses at --port, or only --unix_socket if it is set.  This flag may be specified multiple times.")
 	flag.Var(&logs, "logs", "List of log files to monitor, separated by commas.  This flag may be specified multiple times.")
+	flag.Var(&logPollIntervals, "log_poll_intervals", "List of pattern=duration overrides of --poll_interval for the logs matching each glob pattern, separated by commas, e.g. /var/log/nginx/access.log=100ms.  The logs are polled at the shortest interval of any pattern they match.  This flag may be specified multiple times.")
+	flag.Var(&programLogs, "program_logs", "List of program=pattern bindings of programs to the glob patterns of the logs they process, separated by commas, e.g. apache.mtail=/var/log/apache2/*.log.  A program bound to patterns is only given the lines of logs matching one of them; programs not bound are given every line.  The logs must still be given with --logs.  This flag may be specified multiple times.")
+	flag.Var(&logTimezones, "log_timezones", "List of pattern=timezone overrides of --override_timezone for the logs matching each glob pattern, separated by commas, e.g. /var/log/app/*.log=America/New_York.  A log matching several patterns takes the timezone of the longest.  This flag may be specified multiple times.")
+	flag.Var(&logRecords, "log_records", "List of pattern=format bindings of the logs matching each glob pattern to the format of the records they are made of, separated by commas, e.g. /var/log/app/*.pb=/etc/mtail/app.pb:app.Request.  format is json, logfmt, csv, or plain for lines of text; auto to detect which from the first lines of each log; msgpack; avro for Avro object container files; avro:schema for Avro records with the JSON schema in the file schema; or descriptors:message for length-prefixed protocol buffers of the message type, with descriptors a descriptor set written by protoc --include_imports --descriptor_set_out.  This flag may be specified multiple times.")
+	flag.Var(&externConstList, "extern_consts", "List of NAME=value values of the extern consts declared by programs, separated by commas.  An extern const not given here or in --extern_consts_file is read from the environment variable MTAIL_NAME.  This flag may be specified multiple times.")
+	flag.Var(&execCommandList, "exec_commands", "List of name=/path/to/command [arg...] commands that programs may run with exec(\"name\", ...), separated by commas.  The arguments from the program follow those given here.  Without this flag, exec() is disabled.  This flag may be specified multiple times.")
+	flag.Var(&anomalyMetrics, "anomaly_metrics", "List of the names of counters and gauges to score against their moving averages, separated by commas.  Each is exported with <name>_ewma, the exponentially weighted moving average of a counter's rate per second or a gauge's value, and <name>_anomaly_score, the standard deviations of the last sample from it.  This flag may be specified multiple times.")
+	flag.Var(&lowPriorityLogs, "low_priority_logs", "List of glob patterns of the logs to stop reading first when the memory in use nears --memory_limit_mb, separated by commas.  They are read again once it falls.  This flag may be specified multiple times.")
+	flag.Var(&sdLabels, "sd_labels", "List of name=value labels advertised with the scrape target on the /sd service discovery endpoint, separated by commas.  This flag may be specified multiple times.")
 }
 
 var (
@@ -87,7 +221,29 @@ var (
 	Revision string = "invalid:-use-make-to-build"
 )
 
+// subcommands are alternative modes of the mtail binary, chosen by the first
+// argument on the command line.  Each has its own flags, and returns the exit
+// status of the process.
+var subcommands = map[string]func(args []string) int{
+	"bench":         benchCommand,
+	"compile":       compileCommand,
+	"fmt":           fmtCommand,
+	"healthcheck":   healthcheckCommand,
+	"loadgen":       loadgenCommand,
+	"replay":        replayCommand,
+	"replay-events": replayEventsCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			// Mark the global flags as parsed so glog logs as normal.
+			if err := flag.CommandLine.Parse(nil); err != nil {
+				logging.Exit(err)
+			}
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
 	buildInfo := mtail.BuildInfo{
 		Branch:   Branch,
 		Version:  Version,
@@ -104,10 +260,15 @@ func main() {
 		fmt.Println(buildInfo.String())
 		os.Exit(0)
 	}
-	glog.Info(buildInfo.String())
-	glog.Infof("Commandline: %q", os.Args)
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		logging.Exit(err)
+	}
+	logging.SetFormat(format)
+	logging.Info(buildInfo.String())
+	logging.Infof("Commandline: %q", os.Args)
 	if len(flag.Args()) > 0 {
-		glog.Exitf("Too many extra arguments specified: %q\n(the logs flag can be repeated, or the filenames separated by commas.)", flag.Args())
+		logging.Exitf("Too many extra arguments specified: %q\n(the logs flag can be repeated, or the filenames separated by commas.)", flag.Args())
 	}
 	loc, err := time.LoadLocation(*overrideTimezone)
 	if err != nil {
@@ -115,19 +276,19 @@ func main() {
 		os.Exit(1)
 	}
 	if *blockProfileRate > 0 {
-		glog.Infof("Setting block profile rate to %d", *blockProfileRate)
+		logging.Infof("Setting block profile rate to %d", *blockProfileRate)
 		runtime.SetBlockProfileRate(*blockProfileRate)
 	}
 	if *mutexProfileFraction > 0 {
-		glog.Infof("Setting mutex profile fraction to %d", *mutexProfileFraction)
+		logging.Infof("Setting mutex profile fraction to %d", *mutexProfileFraction)
 		runtime.SetMutexProfileFraction(*mutexProfileFraction)
 	}
 	if *progs == "" {
-		glog.Exitf("mtail requires programs that in instruct it how to extract metrics from logs; please use the flag -progs to specify the directory containing the programs.")
+		logging.Exitf("mtail requires programs that in instruct it how to extract metrics from logs; please use the flag -progs to specify the directory containing the programs.")
 	}
 	if !(*dumpBytecode || *dumpAst || *dumpAstTypes || *compileOnly) {
 		if len(logs) == 0 {
-			glog.Exitf("mtail requires the names of logs to follow in order to extract logs from them; please use the flag -logs one or more times to specify glob patterns describing these logs.")
+			logging.Exitf("mtail requires the names of logs to follow in order to extract logs from them; please use the flag -logs one or more times to specify glob patterns describing these logs.")
 		}
 	}
 
@@ -135,15 +296,25 @@ func main() {
 		trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1 / float64(*traceSamplePeriod))})
 	}
 	if *pollInterval == 0 {
-		glog.Infof("no poll interval specified; defaulting to 250ms poll")
+		logging.Infof("no poll interval specified; defaulting to 250ms poll")
 		*pollInterval = time.Millisecond * 250
 	}
-	w, err := watcher.NewLogWatcher(*pollInterval)
-	if err != nil {
-		glog.Exitf("Failure to create log watcher: %s", err)
-	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	watcherOpts := []watcher.Option{watcher.Backend(*watcherBackend), watcher.CoalesceWindow(*watcherCoalesceWindow)}
+	if *recordWatcherEvents != "" {
+		f, err := os.Create(*recordWatcherEvents)
+		if err != nil {
+			logging.Exitf("Failed to create watcher event recording: %s", err)
+		}
+		defer f.Close()
+		logging.Infof("Recording watcher events to %s", *recordWatcherEvents)
+		watcherOpts = append(watcherOpts, watcher.Record(f))
+	}
+	w, err := watcher.NewLogWatcher(ctx, *pollInterval, watcherOpts...)
+	if err != nil {
+		logging.Exitf("Failure to create log watcher: %s", err)
+	}
 	opts := []mtail.Option{
 		mtail.ProgramPath(*progs),
 		mtail.LogPathPatterns(logs...),
@@ -151,16 +322,44 @@ func main() {
 		mtail.SetBuildInfo(buildInfo),
 		mtail.OverrideLocation(loc),
 		mtail.StaleLogGcTickInterval(*staleLogGcTickInterval),
+		mtail.LogRateInterval(*logRateInterval),
 		mtail.LogPatternPollTickInterval(*pollInterval),
+		mtail.HealthStallTimeout(*healthStallTimeout),
+	}
+	bindOpts, err := bindOptions(addresses, *port, *unixSocket)
+	if err != nil {
+		logging.Exitf("Invalid --address: %s", err)
 	}
-	if *unixSocket == "" {
-		opts = append(opts, mtail.BindAddress(*address, *port))
-	} else {
-		opts = append(opts, mtail.BindUnixSocket(*unixSocket))
+	opts = append(opts, bindOpts...)
+	if *unixSocketMode != "" || *unixSocketOwner != "" || *unixSocketGroup != "" {
+		mode, uid, gid, err := unixSocketPermissions(*unixSocketMode, *unixSocketOwner, *unixSocketGroup)
+		if err != nil {
+			logging.Exitf("Invalid UNIX socket permissions: %s", err)
+		}
+		opts = append(opts, mtail.UnixSocketPermissions(mode, uid, gid))
 	}
 	if *oneShot {
 		opts = append(opts, mtail.OneShot)
 	}
+	if *oneShotParquetFile != "" {
+		opts = append(opts, mtail.OneShotParquetFile(*oneShotParquetFile))
+	}
+	switch *oneShotOrder {
+	case "":
+	case "rotation":
+		opts = append(opts, mtail.OneShotOrder(nil, ""))
+	case "timestamp":
+		re, err := regexp.Compile(*oneShotTimestampRegexp)
+		if err != nil || re.NumSubexp() < 1 {
+			logging.Exitf("Invalid --one_shot_timestamp_regexp %q: expecting a regular expression with a capture group", *oneShotTimestampRegexp)
+		}
+		opts = append(opts, mtail.OneShotOrder(re, *oneShotTimestampLayout))
+	default:
+		logging.Exitf("Invalid --one_shot_order %q, expecting rotation or timestamp", *oneShotOrder)
+	}
+	if *strictStartup {
+		opts = append(opts, mtail.StrictStartup)
+	}
 	if *compileOnly {
 		opts = append(opts, mtail.CompileOnly)
 	}
@@ -182,21 +381,210 @@ func main() {
 	if *emitMetricTimestamp {
 		opts = append(opts, mtail.EmitMetricTimestamp)
 	}
+	if len(anomalyMetrics) > 0 {
+		opts = append(opts, mtail.AnomalyDetection(anomalyMetrics, *anomalyInterval, *anomalyAlpha))
+	}
+	if *severityCounts {
+		opts = append(opts, mtail.SeverityCounts)
+	}
+	if *correctCounterResets {
+		opts = append(opts, mtail.CorrectCounterResets)
+	}
+	if *streamUpdates {
+		opts = append(opts, mtail.StreamUpdates)
+	}
+	if *instrumentConditions {
+		opts = append(opts, mtail.InstrumentConditions)
+	}
+	if *openMetrics {
+		opts = append(opts, mtail.OpenMetrics)
+	}
+	policy, err := vm.ParseTimestampPolicy(*timestampPolicy)
+	if err != nil {
+		logging.Exitf("Invalid --timestamp_policy: %s", err)
+	}
+	if policy != vm.AcceptTimestamps {
+		opts = append(opts, mtail.BoundTimestamps(policy, *timestampMaxFuture, *timestampMaxAge))
+	}
+	overflow, err := vm.ParseOverflowPolicy(*intOverflow)
+	if err != nil {
+		logging.Exitf("Invalid --int_overflow: %s", err)
+	}
+	opts = append(opts, mtail.IntOverflow(overflow))
+	if *programBundleURL != "" {
+		opts = append(opts, mtail.ProgramBundle(*programBundleURL, *programBundleSignatureURL, *programBundlePublicKey, *programBundleInterval))
+	}
+	if *alertWebhookURL != "" {
+		opts = append(opts, mtail.AlertWebhook(*alertWebhookURL, *alertWebhookTemplate, *alertTokenFile, *alertInterval))
+	}
+	if *geoipCountryDB != "" || *geoipASNDB != "" {
+		opts = append(opts, mtail.GeoIPDatabases(*geoipCountryDB, *geoipASNDB, *geoipCheckInterval))
+	}
+	if *fileLabelsFile != "" {
+		rules, err := vm.LoadFileLabels(*fileLabelsFile)
+		if err != nil {
+			logging.Exitf("Invalid --file_labels: %s", err)
+		}
+		opts = append(opts, mtail.FileLabels(rules))
+	}
+	if len(externConstList) > 0 || *externConstsFile != "" {
+		consts := make(map[string]string, len(externConstList))
+		for _, c := range externConstList {
+			if c == "" {
+				continue
+			}
+			i := strings.Index(c, "=")
+			if i <= 0 {
+				logging.Exitf("Invalid --extern_consts entry %q, expecting NAME=value", c)
+			}
+			consts[strings.TrimSpace(c[:i])] = c[i+1:]
+		}
+		opts = append(opts, mtail.ExternConsts(consts, *externConstsFile))
+	}
+	hmacKey, err := readHMACKey(*hmacKeyFile)
+	if err != nil {
+		logging.Exitf("Invalid --hmac_key_file: %s", err)
+	}
+	if hmacKey != nil {
+		opts = append(opts, mtail.HMACKey(hmacKey))
+	}
+	if *sandboxPrograms {
+		opts = append(opts, mtail.Sandbox(*sandboxLineTimeout, *sandboxLineBytes))
+	}
+	if *jitAfter > 0 {
+		opts = append(opts, mtail.JITAfter(*jitAfter))
+	}
+	if len(execCommandList) > 0 {
+		commands := make([]action.Command, 0, len(execCommandList))
+		for _, c := range execCommandList {
+			command, err := action.ParseCommand(c)
+			if err != nil {
+				logging.Exitf("Invalid --exec_commands entry: %s", err)
+			}
+			commands = append(commands, command)
+		}
+		opts = append(opts, mtail.ExecCommands(commands, *execTimeout, *execInterval))
+	}
 	if *jaegerEndpoint != "" {
 		opts = append(opts, mtail.JaegerReporter(*jaegerEndpoint))
 	}
+	if *sdTarget != "" {
+		opts = append(opts, mtail.ServiceDiscoveryTarget(*sdTarget))
+	}
+	if len(sdLabels) > 0 {
+		labels := make(map[string]string, len(sdLabels))
+		for _, l := range sdLabels {
+			kv := strings.SplitN(l, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				logging.Exitf("Invalid --sd_labels entry %q, expecting name=value", l)
+			}
+			labels[kv[0]] = kv[1]
+		}
+		opts = append(opts, mtail.ServiceDiscoveryLabels(labels))
+	}
+	if *dedupWindow > 0 || *dedupLines > 0 {
+		opts = append(opts, mtail.DedupLines(*dedupWindow, *dedupLines))
+	}
+	if *memoryLimitMB > 0 {
+		opts = append(opts, mtail.MemoryLimit(uint64(*memoryLimitMB)<<20, lowPriorityLogs))
+	}
+	if *gomaxprocsFromCgroup {
+		opts = append(opts, mtail.GOMAXPROCSFromCgroup)
+	}
+	if *cpuLimitPercent > 0 {
+		opts = append(opts, mtail.CPULimit(*cpuLimitPercent))
+	}
+	if *nice != 0 {
+		opts = append(opts, mtail.Niceness(*nice))
+	}
+	if *maxOpenLogFiles > 0 {
+		opts = append(opts, mtail.MaxOpenLogFiles(*maxOpenLogFiles))
+	}
+	if len(logPollIntervals) > 0 {
+		intervals := make(map[string]time.Duration, len(logPollIntervals))
+		for _, l := range logPollIntervals {
+			i := strings.LastIndex(l, "=")
+			if i <= 0 {
+				logging.Exitf("Invalid --log_poll_intervals entry %q, expecting pattern=duration", l)
+			}
+			d, err := time.ParseDuration(l[i+1:])
+			if err != nil || d <= 0 {
+				logging.Exitf("Invalid --log_poll_intervals entry %q, expecting a positive duration", l)
+			}
+			intervals[l[:i]] = d
+		}
+		opts = append(opts, mtail.LogPollIntervals(intervals))
+	}
+	if len(programLogs) > 0 {
+		patterns := make(map[string][]string)
+		for _, b := range programLogs {
+			i := strings.Index(b, "=")
+			if i <= 0 || i == len(b)-1 {
+				logging.Exitf("Invalid --program_logs entry %q, expecting program=pattern", b)
+			}
+			patterns[b[:i]] = append(patterns[b[:i]], b[i+1:])
+		}
+		opts = append(opts, mtail.ProgramLogPatterns(patterns))
+	}
+	if len(logTimezones) > 0 {
+		timezones := make(map[string]*time.Location, len(logTimezones))
+		for _, l := range logTimezones {
+			i := strings.LastIndex(l, "=")
+			if i <= 0 {
+				logging.Exitf("Invalid --log_timezones entry %q, expecting pattern=timezone", l)
+			}
+			tz, err := time.LoadLocation(l[i+1:])
+			if err != nil {
+				logging.Exitf("Invalid --log_timezones entry %q: %s", l, err)
+			}
+			timezones[l[:i]] = tz
+		}
+		opts = append(opts, mtail.LogTimezones(timezones))
+	}
+	if len(logRecords) > 0 {
+		records := make(map[string]record.Format, len(logRecords))
+		for _, l := range logRecords {
+			i := strings.Index(l, "=")
+			if i <= 0 || i == len(l)-1 {
+				logging.Exitf("Invalid --log_records entry %q, expecting pattern=format", l)
+			}
+			f, err := record.Parse(l[i+1:])
+			if err != nil {
+				logging.Exitf("Invalid --log_records entry %q: %s", l, err)
+			}
+			records[l[:i]] = f
+		}
+		opts = append(opts, mtail.LogRecords(records))
+	}
+	if *diagnosticsFile != "" {
+		opts = append(opts, mtail.DiagnosticsFile(*diagnosticsFile))
+	}
+	if *chrootDir != "" {
+		opts = append(opts, mtail.Chroot(*chrootDir))
+	}
+	if *setuid != "" || *setgid != "" {
+		uid, gid, err := lookupIds(*setuid, *setgid)
+		if err != nil {
+			logging.Exit(err)
+		}
+		opts = append(opts, mtail.DropPrivileges(uid, gid))
+	}
+	if *useSeccomp {
+		opts = append(opts, mtail.Seccomp)
+	}
 	store := metrics.NewStore()
 	if *expiredMetricGcTickInterval > 0 {
 		store.StartGcLoop(ctx, *expiredMetricGcTickInterval)
 	}
+	store.StartResetLoop(ctx)
 	m, err := mtail.New(ctx, store, w, opts...)
 	if err != nil {
-		glog.Error(err)
+		logging.Error(err)
 		os.Exit(1)
 	}
 	err = m.Run()
 	if err != nil {
-		glog.Error(err)
+		logging.Error(err)
 		os.Exit(1)
 	}
 }
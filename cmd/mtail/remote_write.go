@@ -0,0 +1,193 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// remoteWriteSink sends each sample of the metrics to a Prometheus remote
+// write endpoint as soon as it is taken, so the samples of every series
+// arrive in timestamp order as the protocol requires.
+type remoteWriteSink struct {
+	url    string
+	client *http.Client
+}
+
+// newRemoteWriteSink returns a sink writing to url with transport, or
+// http.DefaultTransport if it's nil.
+func newRemoteWriteSink(url string, transport http.RoundTripper) *remoteWriteSink {
+	return &remoteWriteSink{url: url, client: &http.Client{Transport: transport, Timeout: 30 * time.Second}}
+}
+
+// remoteWriteLabel and remoteWriteSeries mirror the Label and TimeSeries
+// messages of the remote write protocol.
+type remoteWriteLabel struct {
+	name, value string
+}
+
+type remoteWriteSeries struct {
+	labels    []remoteWriteLabel
+	value     float64
+	timestamp int64 // milliseconds since the epoch
+}
+
+func (s *remoteWriteSink) write(mfs []*dto.MetricFamily) error {
+	series := remoteWriteSeriesFromFamilies(mfs)
+	if len(series) == 0 {
+		return nil
+	}
+	body := snappyEncode(encodeWriteRequest(series))
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "mtail-replay")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("remote write to %s failed: %s: %s", s.url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (s *remoteWriteSink) close() error {
+	return nil
+}
+
+// remoteWriteSeriesFromFamilies flattens the metric families into series,
+// expanding histograms into their bucket, sum, and count series like the
+// Prometheus text format does.
+func remoteWriteSeriesFromFamilies(mfs []*dto.MetricFamily) []remoteWriteSeries {
+	var r []remoteWriteSeries
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			labels := make([]remoteWriteLabel, 0, len(m.Label)+2)
+			for _, l := range m.Label {
+				labels = append(labels, remoteWriteLabel{l.GetName(), l.GetValue()})
+			}
+			add := func(name string, value float64, extra ...remoteWriteLabel) {
+				ls := make([]remoteWriteLabel, 0, len(labels)+len(extra)+1)
+				ls = append(ls, remoteWriteLabel{"__name__", name})
+				ls = append(ls, labels...)
+				ls = append(ls, extra...)
+				sort.Slice(ls, func(i, j int) bool { return ls[i].name < ls[j].name })
+				r = append(r, remoteWriteSeries{labels: ls, value: value, timestamp: m.GetTimestampMs()})
+			}
+			switch {
+			case m.Counter != nil:
+				add(name, m.Counter.GetValue())
+			case m.Gauge != nil:
+				add(name, m.Gauge.GetValue())
+			case m.Untyped != nil:
+				add(name, m.Untyped.GetValue())
+			case m.Histogram != nil:
+				h := m.Histogram
+				for _, b := range h.Bucket {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), remoteWriteLabel{"le", formatBound(b.GetUpperBound())})
+				}
+				add(name+"_bucket", float64(h.GetSampleCount()), remoteWriteLabel{"le", "+Inf"})
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return r
+}
+
+func formatBound(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest marshals the series as a remote write WriteRequest
+// protocol buffer:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []remoteWriteSeries) []byte {
+	var b []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			var lb []byte
+			lb = appendProtoBytes(lb, 1, []byte(l.name))
+			lb = appendProtoBytes(lb, 2, []byte(l.value))
+			ts = appendProtoBytes(ts, 1, lb)
+		}
+		var sb []byte
+		sb = appendProtoTag(sb, 1, 1)
+		var f [8]byte
+		binary.LittleEndian.PutUint64(f[:], math.Float64bits(s.value))
+		sb = append(sb, f[:]...)
+		sb = appendProtoTag(sb, 2, 0)
+		sb = appendUvarint(sb, uint64(s.timestamp))
+		ts = appendProtoBytes(ts, 2, sb)
+		b = appendProtoBytes(b, 1, ts)
+	}
+	return b
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendProtoTag(b []byte, field, wireType uint64) []byte {
+	return appendUvarint(b, field<<3|wireType)
+}
+
+func appendProtoBytes(b []byte, field uint64, v []byte) []byte {
+	b = appendProtoTag(b, field, 2)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// snappyEncode frames src as a snappy block, which the remote write protocol
+// requires.  It emits only literals: the payload is not compressed, but any
+// snappy decoder can read it.
+func snappyEncode(src []byte) []byte {
+	b := appendUvarint(nil, uint64(len(src)))
+	for len(src) > 0 {
+		n := len(src)
+		if n > 1<<16 {
+			n = 1 << 16
+		}
+		switch {
+		case n <= 60:
+			b = append(b, byte(n-1)<<2)
+		case n <= 1<<8:
+			b = append(b, 60<<2, byte(n-1))
+		default:
+			b = append(b, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		b = append(b, src[:n]...)
+		src = src[n:]
+	}
+	return b
+}
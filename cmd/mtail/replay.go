@@ -0,0 +1,449 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/mtail/internal/exporter"
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/vm"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// replayCommand implements `mtail replay`, which runs historical logs through
+// the programs and writes out the timeseries they would have produced, so that
+// a new program can be backfilled.
+func replayCommand(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	progs := fs.String("progs", "", "Name of the directory containing mtail programs, or a single program.")
+	var logs seqStringFlag
+	fs.Var(&logs, "logs", "List of log files or glob patterns to replay, separated by commas.  This flag may be specified multiple times.  Files ending in .gz are decompressed.")
+	output := fs.String("output", "-", "File to write the timeseries to in OpenMetrics format, suitable for `promtool tsdb create-blocks-from openmetrics`.  The default writes to standard output.")
+	remoteWrite := fs.String("remote_write", "", "If set, the URL of a Prometheus remote write endpoint to send the timeseries to instead of --output.")
+	step := fs.Duration("step", time.Minute, "Interval of log time between samples of the metrics.")
+	speedup := fs.Float64("speedup", 0, "Replay the logs at this many times the rate they were written, according to the program timestamps.  Zero replays as fast as possible.")
+	timestampRegexp := fs.String("timestamp_regexp", "", "If set, a regular expression whose first capture group is the timestamp of each log line.  Lines from different files are then interleaved in timestamp order; otherwise each file is replayed in turn, oldest first.")
+	timestampLayout := fs.String("timestamp_layout", time.RFC3339, "The Go time layout of the timestamps captured by --timestamp_regexp.")
+	overrideTimezone := fs.String("override_timezone", "", "If set, use the provided timezone in timestamp conversion, instead of UTC.")
+	syslogUseCurrentYear := fs.Bool("syslog_use_current_year", true, "Patch yearless timestamps with the present year.")
+	// Remote writes are made like metric pushes, through their proxy.
+	for _, name := range []string{"metric_push_proxy", "metric_push_proxy_password_file", "metric_push_dial_timeout", "metric_push_keepalive"} {
+		f := flag.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mtail replay --progs ./progs --logs '/var/log/foo.log*' [--output foo.om | --remote_write http://prometheus:9090/api/v1/write]\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *progs == "" || len(logs) == 0 || *step <= 0 || *speedup < 0 {
+		fs.Usage()
+		return 2
+	}
+	r := &replayer{
+		step:                 *step,
+		speedup:              *speedup,
+		layout:               *timestampLayout,
+		syslogUseCurrentYear: *syslogUseCurrentYear,
+		loc:                  time.UTC,
+	}
+	if *overrideTimezone != "" {
+		loc, err := time.LoadLocation(*overrideTimezone)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't parse timezone %q: %s\n", *overrideTimezone, err)
+			return 2
+		}
+		r.loc = loc
+	}
+	if *timestampRegexp != "" {
+		re, err := regexp.Compile(*timestampRegexp)
+		if err != nil || re.NumSubexp() < 1 {
+			fmt.Fprintf(os.Stderr, "--timestamp_regexp must be a regular expression with a capture group: %q\n", *timestampRegexp)
+			return 2
+		}
+		r.timestampRegexp = re
+	}
+	var s replaySink
+	if *remoteWrite != "" {
+		transport, err := exporter.NewTransport()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		s = newRemoteWriteSink(*remoteWrite, transport)
+	} else {
+		w := os.Stdout
+		if *output != "-" {
+			f, err := os.Create(*output)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			defer f.Close()
+			w = f
+		}
+		s = newOpenMetricsSink(w)
+	}
+	if err := r.replay(*progs, logs, s); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// A replaySink receives the samples of the metrics taken during a replay.
+type replaySink interface {
+	write(mfs []*dto.MetricFamily) error
+	close() error
+}
+
+// replayer holds the configuration of a replay.
+type replayer struct {
+	step                 time.Duration
+	speedup              float64
+	timestampRegexp      *regexp.Regexp
+	layout               string
+	syslogUseCurrentYear bool
+	loc                  *time.Location
+
+	sleep func(time.Duration) // Replaced in tests.
+}
+
+func (r *replayer) replay(progs string, patterns []string, s replaySink) error {
+	store := metrics.NewStore()
+	vms, err := compileReplayPrograms(progs, store, r.syslogUseCurrentYear, r.loc)
+	if err != nil {
+		return err
+	}
+	e, err := exporter.New(context.Background(), store)
+	if err != nil {
+		return err
+	}
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(e); err != nil {
+		return err
+	}
+	sources, err := r.openSources(patterns)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, src := range sources {
+			src.close()
+		}
+	}()
+
+	snapshot := func(ts time.Time) error {
+		mfs, err := reg.Gather()
+		if err != nil {
+			return err
+		}
+		ms := ts.UnixNano() / 1e6
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				m.TimestampMs = &ms
+			}
+		}
+		return s.write(mfs)
+	}
+
+	sleep := r.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	ctx := context.Background()
+	var clock, next, last time.Time
+	lines := 0
+	for {
+		src := r.nextSource(sources)
+		if src == nil {
+			break
+		}
+		ll := logline.New(ctx, src.pathname, src.line)
+		ll.Offset, ll.Number = src.offset, src.number
+		// The replay clock stands in for the time the line was read.
+		ll.IngestTime = src.time
+		lineTime := src.time
+		for _, v := range vms {
+			if !v.ProcessesLog(src.pathname) {
+				continue
+			}
+			v.ProcessLogLine(ctx, ll)
+			if t := v.LineTime(); t.After(lineTime) {
+				lineTime = t
+			}
+		}
+		lines++
+		if err := src.advance(r); err != nil {
+			return err
+		}
+		// Log time never goes backwards, so a line without a timestamp, or
+		// out of order, is counted at the latest time seen.
+		if !lineTime.After(clock) {
+			continue
+		}
+		if r.speedup > 0 && !clock.IsZero() {
+			sleep(time.Duration(float64(lineTime.Sub(clock)) / r.speedup))
+		}
+		clock = lineTime
+		// Sample at the first line in each step, with its own timestamp, as
+		// only then is it certain that no later line has been counted.
+		if !clock.Before(next) {
+			if err := snapshot(clock); err != nil {
+				return err
+			}
+			last = clock
+			next = clock.Truncate(r.step).Add(r.step)
+		}
+	}
+	if lines == 0 {
+		return errors.Errorf("no log lines found in %q", patterns)
+	}
+	// Take a final sample with the last lines, unless it would duplicate the
+	// last step.
+	if clock.IsZero() {
+		clock = time.Now()
+	}
+	if clock.After(last) {
+		if err := snapshot(clock); err != nil {
+			return err
+		}
+	}
+	return s.close()
+}
+
+// compileReplayPrograms compiles the program at progs, or the programs in the
+// directory progs, and adds their metrics to the store.
+func compileReplayPrograms(progs string, store *metrics.Store, syslogUseCurrentYear bool, loc *time.Location) ([]*vm.VM, error) {
+	fi, err := os.Stat(progs)
+	if err != nil {
+		return nil, err
+	}
+	pathnames := []string{progs}
+	if fi.IsDir() {
+		pathnames, err = filepath.Glob(filepath.Join(progs, "*.mtail"))
+		if err != nil {
+			return nil, err
+		}
+		if len(pathnames) == 0 {
+			return nil, errors.Errorf("no programs found in %q", progs)
+		}
+	}
+	var vms []*vm.VM
+	for _, pathname := range pathnames {
+		f, err := os.Open(pathname)
+		if err != nil {
+			return nil, err
+		}
+		v, err := vm.Compile(pathname, f, vm.CompileOptions{SyslogUseCurrentYear: syslogUseCurrentYear, OverrideLocation: loc})
+		f.Close()
+		if err != nil {
+			return nil, errors.Errorf("compile failed for %s:\n%s", pathname, err)
+		}
+		for _, m := range v.Metrics() {
+			if m.Hidden {
+				continue
+			}
+			if err := store.Add(m); err != nil {
+				return nil, err
+			}
+		}
+		vms = append(vms, v)
+	}
+	return vms, nil
+}
+
+// replaySource is a log file being replayed.
+type replaySource struct {
+	pathname string
+	f        *os.File
+	scanner  *bufio.Scanner
+	line     string    // The next line to replay.
+	time     time.Time // The timestamp of the next line, if known.
+	offset   int64     // The offset of the next line in the uncompressed log.
+	number   int64     // The number of the next line.
+	scanned  int64     // Bytes consumed by the scanner.
+	done     bool
+}
+
+// openSources opens the log files matching patterns, oldest first, and reads
+// the first line from each.  Rotated logs are usually named by rotation
+// number rather than date, so the modification time is the best guide to the
+// order they were written.
+func (r *replayer) openSources(patterns []string) ([]*replaySource, error) {
+	seen := make(map[string]struct{})
+	var pathnames []string
+	mtimes := make(map[string]time.Time)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("no log files match %q", pattern)
+		}
+		for _, pathname := range matches {
+			if _, ok := seen[pathname]; ok {
+				continue
+			}
+			fi, err := os.Stat(pathname)
+			if err != nil {
+				return nil, err
+			}
+			if fi.IsDir() {
+				continue
+			}
+			seen[pathname] = struct{}{}
+			mtimes[pathname] = fi.ModTime()
+			pathnames = append(pathnames, pathname)
+		}
+	}
+	sort.SliceStable(pathnames, func(i, j int) bool { return mtimes[pathnames[i]].Before(mtimes[pathnames[j]]) })
+
+	var sources []*replaySource
+	for _, pathname := range pathnames {
+		f, err := os.Open(pathname)
+		if err != nil {
+			return sources, err
+		}
+		src := &replaySource{pathname: pathname, f: f}
+		sources = append(sources, src)
+		var rd io.Reader = f
+		if strings.HasSuffix(pathname, ".gz") {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				return sources, errors.Wrapf(err, "reading %s", pathname)
+			}
+			rd = gz
+		}
+		src.scanner = bufio.NewScanner(rd)
+		src.scanner.Buffer(nil, 1<<20)
+		src.scanner.Split(src.scanLines)
+		if err := src.advance(r); err != nil {
+			return sources, err
+		}
+	}
+	return sources, nil
+}
+
+// advance reads the next line from the source, and its timestamp if the
+// replayer has a timestamp pattern.  Lines without a timestamp keep the
+// timestamp of the line before.
+func (s *replaySource) advance(r *replayer) error {
+	offset := s.scanned
+	if !s.scanner.Scan() {
+		s.done = true
+		return errors.Wrapf(s.scanner.Err(), "reading %s", s.pathname)
+	}
+	s.line = s.scanner.Text()
+	s.offset = offset
+	s.number++
+	if r.timestampRegexp == nil {
+		return nil
+	}
+	if m := r.timestampRegexp.FindStringSubmatch(s.line); m != nil {
+		if t, err := time.ParseInLocation(r.layout, m[1], r.loc); err == nil {
+			s.time = t
+		}
+	}
+	return nil
+}
+
+// scanLines splits lines like bufio.ScanLines, counting the bytes consumed
+// so each line's offset is known.
+func (s *replaySource) scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	s.scanned += int64(advance)
+	return advance, token, err
+}
+
+func (s *replaySource) close() {
+	s.f.Close()
+}
+
+// nextSource returns the source with the next line to replay, or nil when all
+// the sources are exhausted.  Without a timestamp pattern this is the first
+// unfinished source, otherwise the one with the earliest timestamp, with ties
+// going to the older file.
+func (r *replayer) nextSource(sources []*replaySource) *replaySource {
+	var next *replaySource
+	for _, s := range sources {
+		if s.done {
+			continue
+		}
+		if r.timestampRegexp == nil {
+			return s
+		}
+		if next == nil || s.time.Before(next.time) {
+			next = s
+		}
+	}
+	return next
+}
+
+// openMetricsSink collects the samples of each metric family, as OpenMetrics
+// requires all the samples of a family to be written together.
+type openMetricsSink struct {
+	w        io.Writer
+	names    []string
+	families map[string]*dto.MetricFamily
+}
+
+func newOpenMetricsSink(w io.Writer) *openMetricsSink {
+	return &openMetricsSink{w: w, families: make(map[string]*dto.MetricFamily)}
+}
+
+func (s *openMetricsSink) write(mfs []*dto.MetricFamily) error {
+	for _, mf := range mfs {
+		f, ok := s.families[mf.GetName()]
+		if !ok {
+			s.families[mf.GetName()] = mf
+			s.names = append(s.names, mf.GetName())
+			continue
+		}
+		f.Metric = append(f.Metric, mf.Metric...)
+	}
+	return nil
+}
+
+func (s *openMetricsSink) close() error {
+	sort.Strings(s.names)
+	for _, name := range s.names {
+		mf := s.families[name]
+		// The OpenMetrics encoder appends _total to counter names, which
+		// would no longer match the series mtail exports to Prometheus, so
+		// write counters as unknown.
+		if mf.GetType() == dto.MetricType_COUNTER {
+			t := dto.MetricType_UNTYPED
+			mf.Type = &t
+			for _, m := range mf.Metric {
+				m.Untyped = &dto.Untyped{Value: m.Counter.Value}
+				m.Counter = nil
+			}
+		}
+		if _, err := expfmt.MetricFamilyToOpenMetrics(s.w, mf); err != nil {
+			return err
+		}
+	}
+	_, err := expfmt.FinalizeOpenMetrics(s.w)
+	return err
+}
@@ -0,0 +1,349 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/tailer"
+	"github.com/google/mtail/internal/watcher"
+	"github.com/pkg/errors"
+)
+
+// replayEventsCommand implements `mtail replay-events`, which replays a
+// recording of watcher events made with --record_watcher_events into a tailer,
+// recreating the recorded files as it goes, so that a problem following logs
+// seen only in production can be reproduced from the recording attached to a
+// bug report.
+func replayEventsCommand(args []string) int {
+	fs := flag.NewFlagSet("replay-events", flag.ContinueOnError)
+	var logs seqStringFlag
+	fs.Var(&logs, "logs", "List of the glob patterns of logs given to the mtail that made the recording, separated by commas.  This flag may be specified multiple times.")
+	dir := fs.String("dir", "", "Directory to recreate the recorded files under, which is kept afterwards.  By default a temporary directory is used, and removed.")
+	v := fs.Int("v", 0, "Verbosity of the tailer's log, written to standard error.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mtail replay-events --logs '/var/log/app/*.log' recording.jsonl\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 || len(logs) == 0 {
+		fs.Usage()
+		return 2
+	}
+	for _, pattern := range logs {
+		if !filepath.IsAbs(pattern) {
+			fmt.Fprintf(os.Stderr, "--logs patterns must be absolute, as the recorded paths are: %q\n", pattern)
+			return 2
+		}
+	}
+	_ = flag.Set("logtostderr", "true")
+	if err := logging.SetVerbosity(*v); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	events, err := watcher.ReadRecording(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	root := *dir
+	if root == "" {
+		root, err = ioutil.TempDir("", "mtail-replay-events")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer os.RemoveAll(root)
+	}
+	if err := replayEvents(os.Stdout, root, logs, events); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// fileKey identifies a recorded file across renames.
+type fileKey struct {
+	dev, ino uint64
+	pathname string // Stands in for the inode on windows, which has none.
+}
+
+// recordedKey returns the key of the file recorded by an entry.
+func recordedKey(e watcher.RecordedEvent) fileKey {
+	k := fileKey{dev: e.Stat.Dev, ino: e.Stat.Ino}
+	if k.ino == 0 {
+		k.pathname = e.Pathname
+	}
+	return k
+}
+
+// eventReplayer recreates recorded files under root, following the snapshots
+// in the recording.  Only the metadata of the files is recorded, so their
+// contents are made up.
+type eventReplayer struct {
+	root   string
+	events []watcher.RecordedEvent
+	files  map[fileKey]string // The path each recorded file is at now.
+	keys   map[string]fileKey // The recorded file at each path.
+	moved  int                // The number of files set aside.
+}
+
+// replayEvents replays the recorded events into a tailer of the logs matching
+// patterns, under root, and reports each event and what the tailer then read
+// to out.
+func replayEvents(out io.Writer, root string, patterns []string, events []watcher.RecordedEvent) error {
+	r := &eventReplayer{root: root, events: events, files: make(map[fileKey]string), keys: make(map[string]fileKey)}
+	w := watcher.NewFakeWatcher()
+	lines := &lineCounter{counts: make(map[string]*lineCount)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	t, err := tailer.New(ctx, lines, w)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	// The files found when the recording began are made before the tailer
+	// starts, which reads them from their end.
+	i := 0
+	for ; i < len(events) && events[i].Op == watcher.RecordObserve; i++ {
+		if err := r.apply(i); err != nil {
+			return err
+		}
+	}
+	for _, pattern := range patterns {
+		if err := t.TailPattern(r.path(pattern)); err != nil {
+			logging.Info(err)
+		}
+	}
+	var total int64
+	for ; i < len(events); i++ {
+		e := events[i]
+		if err := r.apply(i); err != nil {
+			return err
+		}
+		event, ok := e.Event()
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(out, "%s %s %s%s\n", e.Time.Format(time.RFC3339Nano), e.Op, e.Pathname, describeStat(e.Stat))
+		event.Pathname = r.path(event.Pathname)
+		w.SendEvent(event)
+		for _, c := range lines.take() {
+			fmt.Fprintf(out, "\tread %d bytes in %d lines from %s\n", c.bytes, c.lines, strings.TrimPrefix(c.pathname, root))
+			total += c.bytes
+		}
+	}
+	fmt.Fprintf(out, "Replayed %d entries; read %d bytes\n", len(events), total)
+	return nil
+}
+
+// describeStat describes a recorded snapshot of a file.
+func describeStat(st *watcher.FileStat) string {
+	switch {
+	case st == nil:
+		return " (missing)"
+	case st.Mode.IsDir():
+		return " (directory)"
+	}
+	return fmt.Sprintf(" (size %d, inode %d, mode %s)", st.Size, st.Ino, st.Mode)
+}
+
+// path returns where the recorded path pathname is recreated.
+func (r *eventReplayer) path(pathname string) string {
+	return filepath.Join(r.root, pathname)
+}
+
+// apply makes the file at the path of the i'th entry match its snapshot.  A file that was
+// recorded at another path is renamed, as by a log rotation; a file that has
+// shrunk is truncated; and a file that has grown is appended to with lines of
+// filler.
+func (r *eventReplayer) apply(i int) error {
+	e := r.events[i]
+	p := r.path(e.Pathname)
+	st := e.Stat
+	if st == nil {
+		return r.setAside(p, i)
+	}
+	if st.Mode.IsDir() {
+		return os.MkdirAll(p, 0755)
+	}
+	if !st.Mode.IsRegular() {
+		logging.Infof("Can't recreate %s, which is not a regular file", e.Pathname)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	key := recordedKey(e)
+	cur, ok := r.files[key]
+	if cur != p {
+		if err := r.setAside(p, i); err != nil {
+			return err
+		}
+	}
+	switch {
+	case ok && cur != p:
+		delete(r.keys, cur)
+		if err := os.Rename(cur, p); err != nil {
+			return err
+		}
+	case !ok:
+		f, err := os.Create(p)
+		if err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	r.files[key], r.keys[p] = p, key
+
+	// Make sure the file can be written while it is resized.
+	if err := os.Chmod(p, st.Mode.Perm()|0600); err != nil {
+		return err
+	}
+	if err := resize(p, st.Size); err != nil {
+		return err
+	}
+	if err := os.Chmod(p, st.Mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(p, st.ModTime, st.ModTime)
+}
+
+// setAside moves the recorded file at path p out of the way, at the i'th
+// entry, where it is kept in case it was renamed and turns up at another path
+// later in the recording.  Anything else at p, such as a directory and the
+// files in it, is removed.
+func (r *eventReplayer) setAside(p string, i int) error {
+	key, ok := r.keys[p]
+	if !ok {
+		for q, key := range r.keys {
+			if strings.HasPrefix(q, p+string(filepath.Separator)) {
+				delete(r.keys, q)
+				delete(r.files, key)
+			}
+		}
+		return os.RemoveAll(p)
+	}
+	r.moved++
+	aside := filepath.Join(r.root, movedDir, strconv.Itoa(r.moved))
+	if err := os.MkdirAll(filepath.Dir(aside), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(p, aside); err != nil {
+		return err
+	}
+	delete(r.keys, p)
+	r.files[key], r.keys[aside] = aside, key
+	// The file was only seen again after it was renamed, so anything written
+	// to it by then is taken to have been written before, while it could
+	// still be read at p.
+	for _, e := range r.events[i+1:] {
+		if e.Stat != nil && e.Stat.Mode.IsRegular() && recordedKey(e) == key {
+			return resize(aside, e.Stat.Size)
+		}
+	}
+	return nil
+}
+
+// movedDir is where files are set aside under the root of a replay.
+const movedDir = ".replay-moved"
+
+// fillerLineLength is the length of the lines of filler appended to a file
+// that has grown, including the newline.
+const fillerLineLength = 80
+
+// resize truncates the file at p to size bytes, or extends it with filler.
+// The filler is text, as a file starting with zeros would look binary to the
+// tailer.
+func resize(p string, size int64) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if size <= fi.Size() {
+		return os.Truncate(p, size)
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	n := size - fi.Size()
+	line := append(bytes.Repeat([]byte{'x'}, fillerLineLength-1), '\n')
+	for ; n > fillerLineLength; n -= fillerLineLength {
+		if _, err := f.Write(line); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	// The last line ends the growth, so the tailer reads whole lines.
+	if _, err := f.Write(line[fillerLineLength-int(n):]); err != nil {
+		f.Close()
+		return err
+	}
+	return errors.Wrapf(f.Close(), "resizing %s", p)
+}
+
+// lineCounter counts the lines and bytes read from each log.  As the
+// contents of a replayed log are filler, only the bytes read are the same
+// as when it was recorded.
+type lineCounter struct {
+	mu     sync.Mutex
+	counts map[string]*lineCount
+}
+
+func (l *lineCounter) ProcessLogLine(ctx context.Context, ll *logline.LogLine) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.counts[ll.Filename]
+	if !ok {
+		c = &lineCount{pathname: ll.Filename}
+		l.counts[ll.Filename] = c
+	}
+	c.lines++
+	c.bytes += int64(len(ll.Line)) + 1
+}
+
+type lineCount struct {
+	pathname string
+	lines    int
+	bytes    int64
+}
+
+// take returns the counts since it was last called, by log.
+func (l *lineCounter) take() []lineCount {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var r []lineCount
+	for _, c := range l.counts {
+		r = append(r, *c)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].pathname < r[j].pathname })
+	l.counts = make(map[string]*lineCount)
+	return r
+}
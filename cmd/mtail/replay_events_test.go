@@ -0,0 +1,67 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/tailer"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/watcher"
+)
+
+func TestReplayEventsRotation(t *testing.T) {
+	testutil.SkipIfShort(t)
+	logDir, rmLogDir := testutil.TestTempDir(t)
+	defer rmLogDir()
+
+	// Record a tailer following a log through a rotation.
+	var recording bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, err := watcher.NewLogWatcher(ctx, 0, watcher.Record(&recording))
+	testutil.FatalIfErr(t, err)
+	lines := &lineCounter{counts: make(map[string]*lineCount)}
+	ta, err := tailer.New(ctx, lines, w)
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(logDir, "app.log")
+	f := testutil.TestOpenFile(t, logfile)
+	testutil.WriteString(t, f, "before start\n")
+	pattern := filepath.Join(logDir, "*.log")
+	testutil.FatalIfErr(t, ta.TailPattern(pattern))
+	testutil.WriteString(t, f, "1\n")
+	w.Poll()
+	testutil.FatalIfErr(t, os.Rename(logfile, logfile+".1"))
+	testutil.WriteString(t, f, "2\n")
+	testutil.FatalIfErr(t, f.Close())
+	f = testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "3\n4\n")
+	w.Poll()
+	testutil.WriteString(t, f, "5\n")
+	w.Poll()
+	testutil.FatalIfErr(t, ta.Close())
+	testutil.FatalIfErr(t, w.Close())
+	expected := lines.take()
+
+	events, err := watcher.ReadRecording(&recording)
+	testutil.FatalIfErr(t, err)
+	root, rmRoot := testutil.TestTempDir(t)
+	defer rmRoot()
+	var out bytes.Buffer
+	testutil.FatalIfErr(t, replayEvents(&out, root, []string{pattern}, events))
+
+	// The replay reads as much from the recreated log as was read from the
+	// real one, though the made up lines differ.
+	testutil.ExpectNoDiff(t, []lineCount{{logfile, 5, 10}}, expected, testutil.AllowUnexported(lineCount{}))
+	if !strings.HasSuffix(out.String(), "; read 10 bytes\n") {
+		t.Errorf("expected 10 bytes read in the replay:\n%s", out.String())
+	}
+}
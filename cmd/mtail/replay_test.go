@@ -0,0 +1,146 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+const replayTestProg = `counter lines by code
+
+/^(?P<ts>\S+) (?P<code>\d+)$/ {
+  strptime($ts, "2006-01-02T15:04:05Z07:00")
+  lines[$code]++
+}
+`
+
+func writeReplayTestFiles(t *testing.T, logs map[string]string) string {
+	t.Helper()
+	dir, rmDir := testutil.TestTempDir(t)
+	t.Cleanup(rmDir)
+	testutil.FatalIfErr(t, os.Mkdir(filepath.Join(dir, "progs"), 0700))
+	testutil.FatalIfErr(t, ioutil.WriteFile(filepath.Join(dir, "progs", "lines.mtail"), []byte(replayTestProg), 0600))
+	for name, contents := range logs {
+		testutil.FatalIfErr(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600))
+	}
+	return dir
+}
+
+func TestReplayOpenMetrics(t *testing.T) {
+	dir := writeReplayTestFiles(t, map[string]string{
+		"a.log": "2020-01-01T00:00:10Z 200\n2020-01-01T00:02:30Z 500\n",
+		"b.log": "2020-01-01T00:01:10Z 404\n",
+	})
+	r := &replayer{
+		step:            time.Minute,
+		timestampRegexp: regexp.MustCompile(`^(\S+)`),
+		layout:          time.RFC3339,
+		loc:             time.UTC,
+	}
+	var out bytes.Buffer
+	testutil.FatalIfErr(t, r.replay(filepath.Join(dir, "progs"), []string{filepath.Join(dir, "*.log")}, newOpenMetricsSink(&out)))
+	expected := `# HELP lines defined at lines.mtail:1:9-13
+# TYPE lines unknown
+lines{code="200",prog="lines.mtail"} 1.0 1.57783681e+09
+lines{code="200",prog="lines.mtail"} 1.0 1.57783687e+09
+lines{code="404",prog="lines.mtail"} 1.0 1.57783687e+09
+lines{code="200",prog="lines.mtail"} 1.0 1.57783695e+09
+lines{code="404",prog="lines.mtail"} 1.0 1.57783695e+09
+lines{code="500",prog="lines.mtail"} 1.0 1.57783695e+09
+# EOF
+`
+	testutil.ExpectNoDiff(t, expected, out.String())
+}
+
+func TestReplaySpeedup(t *testing.T) {
+	dir := writeReplayTestFiles(t, map[string]string{
+		"a.log": "2020-01-01T00:00:00Z 200\n2020-01-01T00:01:00Z 200\n2020-01-01T00:01:30Z 200\n",
+	})
+	var slept time.Duration
+	r := &replayer{
+		step:    time.Minute,
+		speedup: 60,
+		loc:     time.UTC,
+		sleep:   func(d time.Duration) { slept += d },
+	}
+	testutil.FatalIfErr(t, r.replay(filepath.Join(dir, "progs", "lines.mtail"), []string{filepath.Join(dir, "a.log")}, newOpenMetricsSink(ioutil.Discard)))
+	if slept != 1500*time.Millisecond {
+		t.Errorf("slept %s, expected 1.5s for 90s of log at 60x", slept)
+	}
+}
+
+// snappyDecodeLiterals decodes a snappy block made only of literals, as
+// written by snappyEncode.
+func snappyDecodeLiterals(t *testing.T, b []byte) []byte {
+	t.Helper()
+	n, l := binary.Uvarint(b)
+	b = b[l:]
+	var r []byte
+	for len(b) > 0 {
+		tag := b[0] >> 2
+		b = b[1:]
+		size := int(tag) + 1
+		switch tag {
+		case 60:
+			size = int(b[0]) + 1
+			b = b[1:]
+		case 61:
+			size = int(b[0]) + int(b[1])<<8 + 1
+			b = b[2:]
+		}
+		r = append(r, b[:size]...)
+		b = b[size:]
+	}
+	if uint64(len(r)) != n {
+		t.Fatalf("decoded %d bytes, header says %d", len(r), n)
+	}
+	return r
+}
+
+func TestSnappyEncode(t *testing.T) {
+	for _, n := range []int{1, 60, 61, 256, 257, 70000} {
+		src := bytes.Repeat([]byte{'x'}, n)
+		testutil.ExpectNoDiff(t, src, snappyDecodeLiterals(t, snappyEncode(src)))
+	}
+}
+
+func TestReplayRemoteWrite(t *testing.T) {
+	var bodies [][]byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("unexpected content encoding %q", r.Header.Get("Content-Encoding"))
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		testutil.FatalIfErr(t, err)
+		bodies = append(bodies, snappyDecodeLiterals(t, b))
+	}))
+	defer ts.Close()
+	dir := writeReplayTestFiles(t, map[string]string{
+		"a.log": "2020-01-01T00:00:10Z 200\n2020-01-01T00:02:30Z 500\n",
+	})
+	r := &replayer{step: time.Minute, loc: time.UTC}
+	testutil.FatalIfErr(t, r.replay(filepath.Join(dir, "progs"), []string{filepath.Join(dir, "a.log")}, newRemoteWriteSink(ts.URL, nil)))
+	if len(bodies) != 2 {
+		t.Fatalf("expected 2 writes, received %d", len(bodies))
+	}
+	expected := encodeWriteRequest([]remoteWriteSeries{
+		{labels: []remoteWriteLabel{{"__name__", "lines"}, {"code", "200"}, {"prog", "lines.mtail"}}, value: 1, timestamp: 1577836810000},
+	})
+	testutil.ExpectNoDiff(t, expected, bodies[0])
+	if !strings.Contains(string(bodies[1]), "500") {
+		t.Errorf("second write missing the 500 series: %q", bodies[1])
+	}
+}
@@ -0,0 +1,391 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package mtail embeds mtail's log processing engine in other Go programs.
+//
+// An Engine runs mtail programs over log lines, either tailed from the logs
+// matching some glob patterns, or given to it one at a time.  The metrics the
+// programs define can be read with Metrics, exported to Prometheus with
+// Handler, or followed as they change with OnUpdate:
+//
+//	e, err := mtail.New(ctx,
+//		mtail.Program("lines.mtail", "counter lines_total\n/$/ {\n  lines_total++\n}\n"),
+//		mtail.OnUpdate(func(m mtail.Metric) { log.Printf("%s = %g", m.Name, m.Value) }))
+//	if err != nil {
+//		return err
+//	}
+//	defer e.Close()
+//	e.ProcessLine(ctx, "app.log", "hello")
+//
+// The Engine stops when the context passed to New is cancelled, or Close is
+// called.
+package mtail
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/mtail/internal/exporter"
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/tailer"
+	"github.com/google/mtail/internal/vm"
+	"github.com/google/mtail/internal/watcher"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Defaults match those of the mtail command.
+const (
+	defaultPollInterval      = 250 * time.Millisecond
+	logPatternPollInterval   = time.Minute
+	staleLogGcInterval       = time.Hour
+	expiredMetricsGcInterval = time.Hour
+)
+
+// Metric is the value of one metric, for one set of label values.
+type Metric struct {
+	Program string            // The program that defines the metric.
+	Name    string            // The name of the metric.
+	Kind    string            // One of counter, gauge, timer, text, histogram, topk, distinct, min, max, or avg.
+	Labels  map[string]string // The label values, by label name.
+
+	Value   float64            // The value of a numeric metric, or the sum of a histogram's observations.
+	Text    string             // The value of a text metric.
+	Count   uint64             // The number of observations in a histogram.
+	Buckets map[float64]uint64 // The cumulative observations in a histogram, by bucket upper bound.
+
+	Time time.Time // When the value last changed.
+}
+
+// Option configures a new Engine.
+type Option func(*Engine) error
+
+// Program loads a program from its source when the Engine starts.  The name
+// is used in errors and as the prog label of the program's metrics.
+func Program(name, source string) Option {
+	return func(e *Engine) error {
+		e.programs = append(e.programs, program{name, source})
+		return nil
+	}
+}
+
+// ProgramPath loads the programs in a directory, or a single program file,
+// when the Engine starts.  They are reloaded on SIGHUP.
+func ProgramPath(path string) Option {
+	return func(e *Engine) error {
+		e.programPath = path
+		return nil
+	}
+}
+
+// LogPatterns tails the logs matching the glob patterns, giving each new line
+// to the programs.
+func LogPatterns(patterns ...string) Option {
+	return func(e *Engine) error {
+		e.logPatterns = append(e.logPatterns, patterns...)
+		return nil
+	}
+}
+
+// PollInterval sets how often the tailed logs are polled for new lines.
+func PollInterval(interval time.Duration) Option {
+	return func(e *Engine) error {
+		if interval <= 0 {
+			return errors.New("poll interval must be positive")
+		}
+		e.pollInterval = interval
+		return nil
+	}
+}
+
+// OverrideLocation sets the timezone of the timestamps parsed by the programs.
+func OverrideLocation(loc *time.Location) Option {
+	return func(e *Engine) error {
+		e.loaderOptions = append(e.loaderOptions, vm.OverrideLocation(loc))
+		return nil
+	}
+}
+
+// OnUpdate sets a function called with the new value of each metric a
+// program changes.  It is called synchronously by the program, so it must not
+// block; to receive the changes on a channel, send to it without blocking.
+func OnUpdate(f func(Metric)) Option {
+	return func(e *Engine) error {
+		e.loaderOptions = append(e.loaderOptions, vm.OnUpdate(func(u vm.Update) {
+			f(metricValue(u.Metric, labels(u.Metric.Keys, u.Labels), u.Datum))
+		}))
+		return nil
+	}
+}
+
+// Coverage records which lines of the programs' source are exercised by the
+// lines processed, for WriteCoverage.  It slows the programs down, so is meant
+// for tests.
+func Coverage() Option {
+	return func(e *Engine) error {
+		e.loaderOptions = append(e.loaderOptions, vm.Coverage())
+		return nil
+	}
+}
+
+// JIT compiles the bytecode of each program to Go closures once it has spent
+// the duration given interpreting lines, for when the interpreter's overhead is
+// what limits how many lines the programs can process.
+func JIT(after time.Duration) Option {
+	return func(e *Engine) error {
+		e.loaderOptions = append(e.loaderOptions, vm.JIT(after))
+		return nil
+	}
+}
+
+// ExternConsts gives the values of the extern consts declared by programs, by
+// name, and the file of NAME=value lines giving those not in values, if any.
+func ExternConsts(values map[string]string, file string) Option {
+	return func(e *Engine) error {
+		e.loaderOptions = append(e.loaderOptions, vm.ExternConsts(values, file))
+		return nil
+	}
+}
+
+type program struct {
+	name, source string
+}
+
+// Engine runs mtail programs over log lines.
+type Engine struct {
+	programs      []program
+	programPath   string
+	logPatterns   []string
+	pollInterval  time.Duration
+	loaderOptions []vm.Option
+
+	cancel context.CancelFunc
+	store  *metrics.Store
+	l      *vm.Loader
+	t      *tailer.Tailer
+	reg    *prometheus.Registry
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// New creates and starts an Engine configured by the options.
+func New(ctx context.Context, options ...Option) (*Engine, error) {
+	e := &Engine{
+		pollInterval: defaultPollInterval,
+		store:        metrics.NewStore(),
+		reg:          prometheus.NewRegistry(),
+		done:         make(chan struct{}),
+	}
+	for _, option := range options {
+		if err := option(e); err != nil {
+			return nil, err
+		}
+	}
+	ctx, e.cancel = context.WithCancel(ctx)
+	if err := e.start(ctx); err != nil {
+		e.cancel()
+		e.close()
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		e.close()
+	}()
+	return e, nil
+}
+
+// start loads the programs and starts tailing the logs.
+func (e *Engine) start(ctx context.Context) (err error) {
+	e.l, err = vm.NewLoader(ctx, e.programPath, e.store, e.loaderOptions...)
+	if err != nil {
+		return err
+	}
+	for _, p := range e.programs {
+		if err := e.l.CompileAndRun(p.name, strings.NewReader(p.source)); err != nil {
+			return err
+		}
+	}
+	if e.programPath != "" {
+		if err := e.l.LoadAllPrograms(); err != nil {
+			return errors.Errorf("Compile encountered errors:\n%s", err)
+		}
+	}
+	x, err := exporter.New(ctx, e.store)
+	if err != nil {
+		return err
+	}
+	e.reg.MustRegister(x)
+	e.store.StartGcLoop(ctx, expiredMetricsGcInterval)
+	e.store.StartResetLoop(ctx)
+	if len(e.logPatterns) == 0 {
+		return nil
+	}
+	w, err := watcher.NewLogWatcher(ctx, e.pollInterval)
+	if err != nil {
+		return err
+	}
+	e.t, err = tailer.New(ctx, e.l, w,
+		tailer.LogPatternPollTickInterval(logPatternPollInterval),
+		tailer.StaleLogGcTickInterval(staleLogGcInterval),
+		tailer.LogPatterns(e.logPatterns))
+	if err != nil {
+		w.Close()
+		return err
+	}
+	for _, pattern := range e.logPatterns {
+		if err := e.t.TailPattern(pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadProgram compiles and starts the program source, replacing any program
+// of the same name.  If it fails to compile, the program it would replace
+// keeps running.
+func (e *Engine) LoadProgram(name, source string) error {
+	return e.l.CompileAndRun(name, strings.NewReader(source))
+}
+
+// UnloadProgram stops the named program and removes its metrics.
+func (e *Engine) UnloadProgram(name string) {
+	e.l.UnloadProgram(name)
+}
+
+// ProcessLine gives a line from the log filename to the programs.
+func (e *Engine) ProcessLine(ctx context.Context, filename, line string) {
+	e.l.ProcessLogLine(ctx, logline.New(ctx, filename, line))
+}
+
+// Metrics returns the current value of every metric, ordered by name,
+// program, and labels.  The values are from one instant between lines.
+func (e *Engine) Metrics() []Metric {
+	s := e.store.Snapshot()
+	var r []Metric
+	for _, ml := range s.Metrics {
+		for _, m := range ml {
+			if m.Hidden {
+				continue
+			}
+			for _, lv := range m.LabelValues {
+				r = append(r, metricValue(m, labels(m.Keys, lv.Labels), lv.Value))
+			}
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Name != r[j].Name {
+			return r[i].Name < r[j].Name
+		}
+		if r[i].Program != r[j].Program {
+			return r[i].Program < r[j].Program
+		}
+		return labelString(r[i].Labels) < labelString(r[j].Labels)
+	})
+	return r
+}
+
+// WriteCoverage writes the source of each program to w, annotated with the
+// times each line was executed and each condition matched.  The Engine must
+// have been created with the Coverage option.
+func (e *Engine) WriteCoverage(w io.Writer) error {
+	return e.l.WriteCoverage(w)
+}
+
+// Handler returns an http.Handler serving the metrics in the Prometheus
+// exposition format.
+func (e *Engine) Handler() http.Handler {
+	return promhttp.HandlerFor(e.reg, promhttp.HandlerOpts{})
+}
+
+// Close stops the Engine, its programs, and the tailing of logs.
+func (e *Engine) Close() error {
+	e.cancel()
+	<-e.done
+	return nil
+}
+
+// Done returns a channel closed when the Engine has stopped.
+func (e *Engine) Done() <-chan struct{} {
+	return e.done
+}
+
+// close shuts down the parts of the Engine started, once.
+func (e *Engine) close() {
+	e.closeOnce.Do(func() {
+		if e.t != nil {
+			if err := e.t.Close(); err != nil {
+				logging.Infof("tailer close failed: %s", err)
+			}
+		}
+		if e.l != nil {
+			e.l.Close()
+		}
+		close(e.done)
+	})
+}
+
+// labels pairs the label names keys with their values.
+func labels(keys, values []string) map[string]string {
+	r := make(map[string]string, len(keys))
+	for i, k := range keys {
+		if i < len(values) {
+			r[k] = values[i]
+		}
+	}
+	return r
+}
+
+// labelString formats labels in a stable order, for sorting.
+func labelString(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+// metricValue describes the value d of metric m with labels.
+func metricValue(m *metrics.Metric, labels map[string]string, d datum.Datum) Metric {
+	r := Metric{
+		Program: m.Program,
+		Name:    m.Name,
+		Kind:    strings.ToLower(m.Kind.String()),
+		Labels:  labels,
+		Time:    d.TimeUTC(),
+	}
+	switch d := d.(type) {
+	case *datum.Int:
+		r.Value = float64(d.Get())
+	case *datum.Float:
+		r.Value = d.Get()
+	case *datum.String:
+		r.Text = d.Get()
+	case *datum.Buckets:
+		r.Value = d.GetSum()
+		r.Count = d.GetCount()
+		r.Buckets = datum.GetBucketsCumByMax(d)
+	case *datum.Sketch:
+		r.Value = float64(d.Estimate())
+	case *datum.Aggregate:
+		r.Value, _ = d.Get()
+	}
+	return r
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+const linesProgram = `counter lines_total by code
+/(\d+)/ {
+  lines_total[$1]++
+}
+`
+
+func TestEngine(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var updates []Metric
+	e, err := New(ctx, Program("lines.mtail", linesProgram), OnUpdate(func(m Metric) {
+		updates = append(updates, m)
+	}))
+	testutil.FatalIfErr(t, err)
+	defer e.Close()
+
+	e.ProcessLine(ctx, "app.log", "200")
+	e.ProcessLine(ctx, "app.log", "200")
+	e.ProcessLine(ctx, "app.log", "500")
+
+	ignoreTime := testutil.IgnoreFields(Metric{}, "Time")
+	expected := []Metric{
+		{Program: "lines.mtail", Name: "lines_total", Kind: "counter", Labels: map[string]string{"code": "200"}, Value: 2},
+		{Program: "lines.mtail", Name: "lines_total", Kind: "counter", Labels: map[string]string{"code": "500"}, Value: 1},
+	}
+	testutil.ExpectNoDiff(t, expected, e.Metrics(), ignoreTime)
+	testutil.ExpectNoDiff(t, []float64{1, 2, 1}, values(updates))
+	if updates[2].Labels["code"] != "500" {
+		t.Errorf("expected the last update to be for code 500, got %v", updates[2])
+	}
+
+	w := httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `lines_total{code="500",prog="lines.mtail"} 1`) {
+		t.Errorf("metric missing from export:\n%s", w.Body.String())
+	}
+}
+
+// values returns the values of the metrics ms.
+func values(ms []Metric) []float64 {
+	r := make([]float64, 0, len(ms))
+	for _, m := range ms {
+		r = append(r, m.Value)
+	}
+	return r
+}
+
+func TestEngineDistinct(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e, err := New(ctx, Program("users.mtail", `syntax = "v2"
+distinct users
+/user=(\S+)/ {
+  users = $1
+}
+`))
+	testutil.FatalIfErr(t, err)
+	defer e.Close()
+
+	e.ProcessLine(ctx, "app.log", "user=a")
+	e.ProcessLine(ctx, "app.log", "user=b")
+	e.ProcessLine(ctx, "app.log", "user=a")
+
+	expected := []Metric{
+		{Program: "users.mtail", Name: "users", Kind: "distinct", Labels: map[string]string{}, Value: 2},
+	}
+	testutil.ExpectNoDiff(t, expected, e.Metrics(), testutil.IgnoreFields(Metric{}, "Time"))
+}
+
+func TestEngineAggregate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e, err := New(ctx, Program("latency.mtail", `syntax = "v2"
+max latency_max
+avg latency_avg
+/latency=(\d+)/ {
+  latency_max = $1
+  latency_avg = $1
+}
+`))
+	testutil.FatalIfErr(t, err)
+	defer e.Close()
+
+	e.ProcessLine(ctx, "app.log", "latency=3")
+	e.ProcessLine(ctx, "app.log", "latency=7")
+	e.ProcessLine(ctx, "app.log", "latency=5")
+
+	expected := []Metric{
+		{Program: "latency.mtail", Name: "latency_avg", Kind: "avg", Labels: map[string]string{}, Value: 5},
+		{Program: "latency.mtail", Name: "latency_max", Kind: "max", Labels: map[string]string{}, Value: 7},
+	}
+	testutil.ExpectNoDiff(t, expected, e.Metrics(), testutil.IgnoreFields(Metric{}, "Time"))
+}
+
+func TestEngineLoadProgram(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e, err := New(ctx)
+	testutil.FatalIfErr(t, err)
+	defer e.Close()
+
+	testutil.FatalIfErr(t, e.LoadProgram("lines.mtail", linesProgram))
+	if err := e.LoadProgram("lines.mtail", "counter"); err == nil {
+		t.Error("expected a compile error")
+	}
+	// The program that failed to compile didn't replace the one running.
+	e.ProcessLine(ctx, "app.log", "200")
+	if m := e.Metrics(); len(m) != 1 || m[0].Value != 1 {
+		t.Errorf("unexpected metrics %v", m)
+	}
+
+	e.UnloadProgram("lines.mtail")
+	if m := e.Metrics(); len(m) != 0 {
+		t.Errorf("expected no metrics after unloading, got %v", m)
+	}
+}
+
+func TestEngineProgramError(t *testing.T) {
+	if _, err := New(context.Background(), Program("bad.mtail", "counter")); err == nil {
+		t.Error("expected a compile error")
+	}
+}
+
+func TestEngineCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	e, err := New(ctx, Program("lines.mtail", linesProgram))
+	testutil.FatalIfErr(t, err)
+	cancel()
+	select {
+	case <-e.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("engine didn't stop when its context was cancelled")
+	}
+	testutil.FatalIfErr(t, e.Close())
+}
+
+func TestEngineLogPatterns(t *testing.T) {
+	dir, rmdir := testutil.TestTempDir(t)
+	defer rmdir()
+	logFile := filepath.Join(dir, "app.log")
+	testutil.FatalIfErr(t, ioutil.WriteFile(logFile, nil, 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e, err := New(ctx, Program("lines.mtail", linesProgram), LogPatterns(filepath.Join(dir, "*.log")), PollInterval(10*time.Millisecond))
+	testutil.FatalIfErr(t, err)
+	defer e.Close()
+
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0)
+	testutil.FatalIfErr(t, err)
+	defer f.Close()
+	testutil.WriteString(t, f, "200\n")
+
+	ok, err := testutil.DoOrTimeout(func() (bool, error) {
+		m := e.Metrics()
+		return len(m) == 1 && m[0].Value == 1, nil
+	}, 5*time.Second, 10*time.Millisecond)
+	testutil.FatalIfErr(t, err)
+	if !ok {
+		t.Errorf("line not processed, metrics %v", e.Metrics())
+	}
+}
@@ -9,7 +9,9 @@ require (
 	github.com/google/go-cmp v0.5.4
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.9.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.15.0
+	github.com/tetratelabs/wazero v1.0.3
 	go.opencensus.io v0.22.5
 	golang.org/x/net v0.0.0-20200822124328-c89045814202 // indirect
 	golang.org/x/sys v0.0.0-20201214210602-f9fddec55a1e
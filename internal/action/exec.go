@@ -0,0 +1,177 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package action runs the commands that mtail programs request with the
+// exec() builtin, for remediation such as restarting a stuck daemon when its
+// log shows it is wedged.
+//
+// Programs may only run commands named on an allow-list.  A command is run
+// directly, never through a shell, with an empty environment apart from a
+// fixed PATH, no standard input, and in the root directory, so the values a
+// program passes cannot be interpreted as anything but arguments.  It runs as
+// the user mtail runs as, so drop privileges with --setuid and --setgid to
+// confine the commands further.
+package action
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/pkg/errors"
+)
+
+var (
+	// execRuns counts the runs of each command.
+	execRuns = expvar.NewMap("exec_runs_total")
+	// execSuppressed counts the requests to run each command that were
+	// ignored, because it had already run within the interval or was still
+	// running.
+	execSuppressed = expvar.NewMap("exec_suppressed_total")
+	// execErrors counts the runs of each command that failed to start, timed
+	// out, or exited with an error.
+	execErrors = expvar.NewMap("exec_errors_total")
+)
+
+// maxOutput is how much of a command's output is logged.
+const maxOutput = 4096
+
+// safePath is the PATH in the environment of each command.
+const safePath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Command is a command on the allow-list.
+type Command struct {
+	Name string   // The name programs run the command by.
+	Path string   // The absolute path of the executable.
+	Args []string // Arguments given before those from the program.
+}
+
+// ParseCommand parses a command definition of the form name=/path/to/command
+// [arg...], with the arguments separated by spaces.
+func ParseCommand(s string) (Command, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return Command{}, errors.Errorf("invalid command %q, expecting name=/path/to/command [arg...]", s)
+	}
+	fields := strings.Fields(s[i+1:])
+	if len(fields) == 0 || !filepath.IsAbs(fields[0]) {
+		return Command{}, errors.Errorf("invalid command %q, the command must be an absolute path", s)
+	}
+	return Command{Name: s[:i], Path: fields[0], Args: fields[1:]}, nil
+}
+
+// Executor runs the commands requested by programs.
+type Executor interface {
+	// Exec runs the command name with the extra args on behalf of program.
+	// It returns an error if the command is not allowed, and otherwise does
+	// not wait for the command to finish.
+	Exec(program, name string, args []string) error
+}
+
+// Runner is an Executor of the commands on an allow-list.  Each command runs
+// at most once per interval, never more than one at a time, and is killed if
+// it runs longer than the timeout.
+type Runner struct {
+	commands map[string]Command
+	timeout  time.Duration
+	interval time.Duration
+
+	mu      sync.Mutex
+	last    map[string]time.Time // when each command last started
+	running map[string]bool      // the commands running now
+	wg      sync.WaitGroup       // the runs in progress
+
+	now func() time.Time // for testing
+}
+
+// NewRunner creates a Runner of commands.  An interval of zero does not limit
+// how often they run.
+func NewRunner(commands []Command, timeout, interval time.Duration) (*Runner, error) {
+	if timeout <= 0 {
+		return nil, errors.New("exec timeout must be positive")
+	}
+	r := &Runner{
+		commands: make(map[string]Command, len(commands)),
+		timeout:  timeout,
+		interval: interval,
+		last:     make(map[string]time.Time),
+		running:  make(map[string]bool),
+		now:      time.Now,
+	}
+	for _, c := range commands {
+		if _, ok := r.commands[c.Name]; ok {
+			return nil, errors.Errorf("command %q defined more than once", c.Name)
+		}
+		r.commands[c.Name] = c
+	}
+	return r, nil
+}
+
+// Exec starts the command name with args, unless it is already running or
+// ran within the interval.
+func (r *Runner) Exec(program, name string, args []string) error {
+	c, ok := r.commands[name]
+	if !ok {
+		return errors.Errorf("command %q is not allowed", name)
+	}
+	r.mu.Lock()
+	now := r.now()
+	last, ran := r.last[name]
+	if r.running[name] || (ran && r.interval > 0 && now.Sub(last) < r.interval) {
+		r.mu.Unlock()
+		execSuppressed.Add(name, 1)
+		logging.V(1).Infof("Not running %s for %s, ran at %s", name, program, last)
+		return nil
+	}
+	r.last[name] = now
+	r.running[name] = true
+	r.mu.Unlock()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.run(program, c, args)
+		r.mu.Lock()
+		delete(r.running, name)
+		r.mu.Unlock()
+	}()
+	return nil
+}
+
+// Wait waits for the commands running now to finish.
+func (r *Runner) Wait() {
+	r.wg.Wait()
+}
+
+func (r *Runner) run(program string, c Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.Path, append(append([]string{}, c.Args...), args...)...)
+	cmd.Env = []string{safePath}
+	cmd.Dir = "/"
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	execRuns.Add(c.Name, 1)
+	logging.Infof("Running %s for %s: %s %q", c.Name, program, c.Path, cmd.Args[1:])
+	err := cmd.Run()
+	output := out.String()
+	if len(output) > maxOutput {
+		output = output[:maxOutput] + "..."
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.Errorf("killed after %s", r.timeout)
+	}
+	if err != nil {
+		execErrors.Add(c.Name, 1)
+		logging.Warningf("Command %s for %s failed: %s; output: %q", c.Name, program, err, output)
+		return
+	}
+	logging.V(1).Infof("Command %s for %s succeeded; output: %q", c.Name, program, output)
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package action
+
+import (
+	"expvar"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestParseCommand(t *testing.T) {
+	c, err := ParseCommand("restart=/usr/bin/systemctl restart")
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, Command{"restart", "/usr/bin/systemctl", []string{"restart"}}, c)
+
+	for _, s := range []string{"", "restart", "=/bin/true", "restart=", "restart=systemctl restart"} {
+		if _, err := ParseCommand(s); err == nil {
+			t.Errorf("ParseCommand(%q) returned no error", s)
+		}
+	}
+}
+
+// writeScript writes an executable shell script of body to dir.
+func writeScript(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0700))
+	return path
+}
+
+func TestRunner(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	out := filepath.Join(tmpDir, "out")
+	record := writeScript(t, tmpDir, "record", `printf '%s|' "$@" "$PWD" "$FOO" >>`+out)
+
+	r, err := NewRunner([]Command{{"record", record, []string{"fixed"}}}, 10*time.Second, time.Minute)
+	testutil.FatalIfErr(t, err)
+	now := time.Unix(1600000000, 0)
+	r.now = func() time.Time { return now }
+
+	// The arguments are passed as they are, without a shell or the
+	// environment of mtail.
+	testutil.FatalIfErr(t, r.Exec("prog.mtail", "record", []string{"a b", "$(reboot)"}))
+	r.Wait()
+	// Within the interval, the command doesn't run again.
+	testutil.FatalIfErr(t, r.Exec("prog.mtail", "record", []string{"again"}))
+	r.Wait()
+	now = now.Add(time.Minute)
+	testutil.FatalIfErr(t, r.Exec("prog.mtail", "record", []string{"later"}))
+	r.Wait()
+	b, err := ioutil.ReadFile(out)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "fixed|a b|$(reboot)|/||fixed|later|/||", string(b))
+
+	if err := r.Exec("prog.mtail", "reboot", nil); err == nil {
+		t.Error("Exec of a command not allowed returned no error")
+	}
+}
+
+func count(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestRunnerTimeout(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	hang := writeScript(t, tmpDir, "hang", "exec sleep 60")
+
+	r, err := NewRunner([]Command{{"hang", hang, nil}}, 100*time.Millisecond, 0)
+	testutil.FatalIfErr(t, err)
+	errorsBefore, suppressedBefore := count(execErrors, "hang"), count(execSuppressed, "hang")
+	start := time.Now()
+	testutil.FatalIfErr(t, r.Exec("prog.mtail", "hang", nil))
+	// Not run again while still running.
+	testutil.FatalIfErr(t, r.Exec("prog.mtail", "hang", nil))
+	r.Wait()
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("command ran for %s, expected it killed after 100ms", d)
+	}
+	testutil.ExpectNoDiff(t, int64(1), count(execErrors, "hang")-errorsBefore)
+	testutil.ExpectNoDiff(t, int64(1), count(execSuppressed, "hang")-suppressedBefore)
+}
+
+func TestNewRunnerErrors(t *testing.T) {
+	if _, err := NewRunner(nil, 0, 0); err == nil {
+		t.Error("expected an error for a zero timeout")
+	}
+	c := Command{"true", "/bin/true", nil}
+	if _, err := NewRunner([]Command{c, c}, time.Second, 0); err == nil {
+		t.Error("expected an error for a duplicate command")
+	}
+}
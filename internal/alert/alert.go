@@ -0,0 +1,174 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package alert sends the alerts raised by mtail programs to a webhook, so a
+// program can page on a log line without a separate alerting stack.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/secret"
+	"github.com/pkg/errors"
+)
+
+var (
+	// alertsTotal counts the alerts raised by programs.
+	alertsTotal = expvar.NewMap("alerts_total")
+	// alertsSuppressed counts the alerts not sent, because the program had
+	// already alerted within the interval, or the queue was full.
+	alertsSuppressed = expvar.NewMap("alerts_suppressed_total")
+	// webhookErrors counts the alerts that the webhook failed to accept.
+	webhookErrors = expvar.NewInt("alert_webhook_errors_total")
+)
+
+// DefaultTemplate is the webhook payload used when no template is given: a
+// JSON object of the fields of the Alert.
+const DefaultTemplate = `{"program":{{json .Program}},"message":{{json .Message}},"filename":{{json .Filename}},"line":{{.Line}},"time":{{json .Time}},"suppressed":{{.Suppressed}}}`
+
+// Alert is raised by the alert() builtin.  Its fields are available to the
+// payload template.
+type Alert struct {
+	Program  string    // The program that raised the alert.
+	Message  string    // The argument to alert().
+	Filename string    // The log the line that raised the alert was read from.
+	Line     int64     // The line number of that line.
+	Time     time.Time // The timestamp register of the program, or the time of the alert if unset.
+
+	Suppressed int64 // The number of alerts from the program suppressed since the last sent.
+}
+
+// Alerter receives the alerts raised by programs.
+type Alerter interface {
+	Alert(a Alert)
+}
+
+// queueSize is how many alerts may wait to be posted before more are dropped.
+const queueSize = 100
+
+// Webhook posts alerts to a URL, as the payload made by a template.  Each
+// program may send one alert per interval; the alerts it raises within that
+// interval are counted, and the count sent with its next alert.
+type Webhook struct {
+	url      string
+	token    *secret.Secret // if set, sent as a bearer token
+	tmpl     *template.Template
+	interval time.Duration
+	client   *http.Client
+
+	mu         sync.Mutex
+	last       map[string]time.Time // when each program last sent an alert
+	suppressed map[string]int64     // alerts from each program suppressed since
+
+	queue chan []byte
+	now   func() time.Time // for testing
+}
+
+// NewWebhook creates a Webhook posting to url until ctx is done.  An empty
+// tmpl uses DefaultTemplate, and an interval of zero does not limit alerts.
+// If token is not nil, each post is authorized with it as a bearer token.
+// Posts are made with transport, or http.DefaultTransport if it's nil.
+func NewWebhook(ctx context.Context, url, tmpl string, token *secret.Secret, interval time.Duration, transport http.RoundTripper) (*Webhook, error) {
+	if url == "" {
+		return nil, errors.New("alert webhook needs a URL")
+	}
+	if tmpl == "" {
+		tmpl = DefaultTemplate
+	}
+	t, err := template.New("alert").Funcs(template.FuncMap{"json": jsonString}).Parse(tmpl)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing alert template")
+	}
+	w := &Webhook{
+		url:        url,
+		token:      token,
+		tmpl:       t,
+		interval:   interval,
+		client:     &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		last:       make(map[string]time.Time),
+		suppressed: make(map[string]int64),
+		queue:      make(chan []byte, queueSize),
+		now:        time.Now,
+	}
+	go w.run(ctx)
+	return w, nil
+}
+
+// jsonString returns v encoded as JSON, for use in templates of JSON payloads.
+func jsonString(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// Alert queues a to be posted, unless its program has already alerted within
+// the interval.  It never blocks the program.
+func (w *Webhook) Alert(a Alert) {
+	alertsTotal.Add(a.Program, 1)
+	w.mu.Lock()
+	now := w.now()
+	if last, ok := w.last[a.Program]; ok && w.interval > 0 && now.Sub(last) < w.interval {
+		w.suppressed[a.Program]++
+		w.mu.Unlock()
+		alertsSuppressed.Add(a.Program, 1)
+		return
+	}
+	w.last[a.Program] = now
+	a.Suppressed = w.suppressed[a.Program]
+	delete(w.suppressed, a.Program)
+	w.mu.Unlock()
+
+	var b bytes.Buffer
+	if err := w.tmpl.Execute(&b, a); err != nil {
+		logging.Warningf("Failed to make alert payload for %s: %s", a.Program, err)
+		return
+	}
+	select {
+	case w.queue <- b.Bytes():
+	default:
+		alertsSuppressed.Add(a.Program, 1)
+		logging.Warningf("Alert queue full, dropped alert from %s: %s", a.Program, a.Message)
+	}
+}
+
+// run posts the queued alerts until ctx is done.
+func (w *Webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case b := <-w.queue:
+			if err := w.post(ctx, b); err != nil {
+				webhookErrors.Add(1)
+				logging.Warningf("Failed to post alert: %s", err)
+			}
+		}
+	}
+}
+
+func (w *Webhook) post(ctx context.Context, b []byte) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.token != nil {
+		req.Header.Set("Authorization", "Bearer "+w.token.Value())
+	}
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package alert
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/secret"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// fakeWebhook returns a server that sends the body of each request it
+// receives to the returned channel.
+func fakeWebhook(t *testing.T, status int) (*httptest.Server, chan string) {
+	t.Helper()
+	bodies := make(chan string, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type %q, expected application/json", ct)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+		bodies <- string(b)
+	}))
+	return s, bodies
+}
+
+func receive(t *testing.T, bodies chan string) string {
+	t.Helper()
+	select {
+	case b := <-bodies:
+		return b
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for alert")
+	}
+	return ""
+}
+
+func TestWebhook(t *testing.T) {
+	s, bodies := fakeWebhook(t, http.StatusOK)
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := NewWebhook(ctx, s.URL, "", nil, time.Minute, nil)
+	testutil.FatalIfErr(t, err)
+	now := time.Unix(1600000000, 0).UTC()
+	w.now = func() time.Time { return now }
+
+	a := Alert{Program: "prog.mtail", Message: `"FATAL" seen`, Filename: "/var/log/app.log", Line: 7, Time: now}
+	w.Alert(a)
+	testutil.ExpectNoDiff(t, `{"program":"prog.mtail","message":"\"FATAL\" seen","filename":"/var/log/app.log","line":7,"time":"2020-09-13T12:26:40Z","suppressed":0}`, receive(t, bodies))
+
+	// Alerts within the interval are counted in the next one sent.
+	w.Alert(a)
+	w.Alert(a)
+	// Other programs have their own interval.
+	w.Alert(Alert{Program: "other.mtail", Message: "other", Time: now})
+	testutil.ExpectNoDiff(t, `{"program":"other.mtail","message":"other","filename":"","line":0,"time":"2020-09-13T12:26:40Z","suppressed":0}`, receive(t, bodies))
+
+	now = now.Add(time.Minute)
+	a.Time = now
+	w.Alert(a)
+	testutil.ExpectNoDiff(t, `{"program":"prog.mtail","message":"\"FATAL\" seen","filename":"/var/log/app.log","line":7,"time":"2020-09-13T12:27:40Z","suppressed":2}`, receive(t, bodies))
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	s, bodies := fakeWebhook(t, http.StatusInternalServerError)
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := NewWebhook(ctx, s.URL, `{"text":{{json (printf "%s: %s" .Program .Message)}}}`, nil, 0, nil)
+	testutil.FatalIfErr(t, err)
+	w.Alert(Alert{Program: "prog.mtail", Message: "FATAL"})
+	testutil.ExpectNoDiff(t, `{"text":"prog.mtail: FATAL"}`, receive(t, bodies))
+	// Without an interval, every alert is sent, even when the webhook fails.
+	w.Alert(Alert{Program: "prog.mtail", Message: "FATAL"})
+	testutil.ExpectNoDiff(t, `{"text":"prog.mtail: FATAL"}`, receive(t, bodies))
+}
+
+func TestWebhookToken(t *testing.T) {
+	auth := make(chan string, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+	}))
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	tokenFile := filepath.Join(tmpDir, "token")
+	testutil.FatalIfErr(t, ioutil.WriteFile(tokenFile, []byte("s3cr3t\n"), 0600))
+	token, err := secret.New("alert_webhook_token", tokenFile)
+	testutil.FatalIfErr(t, err)
+
+	w, err := NewWebhook(ctx, s.URL, "", token, 0, nil)
+	testutil.FatalIfErr(t, err)
+	w.Alert(Alert{Program: "prog.mtail", Message: "FATAL"})
+	select {
+	case a := <-auth:
+		testutil.ExpectNoDiff(t, "Bearer s3cr3t", a)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for alert")
+	}
+}
+
+func TestNewWebhookErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := NewWebhook(ctx, "", "", nil, 0, nil); err == nil {
+		t.Error("expected an error without a URL")
+	}
+	if _, err := NewWebhook(ctx, "http://localhost/", "{{.Program", nil, 0, nil); err == nil {
+		t.Error("expected an error for a bad template")
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package anomaly scores how far the latest value of selected metrics is from
+// their recent history, so that spikes can be alerted on with a fixed
+// threshold, without a time series database to compute the history.
+//
+// Each stream of a metric, one per label set, is sampled at a fixed interval:
+// the rate per second of a counter, or the value of a gauge.  Each sample is
+// scored by its distance from the exponentially weighted moving average of
+// the samples before it, in exponentially weighted standard deviations.
+package anomaly
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Detector samples and scores the streams of the metrics it is given.
+type Detector struct {
+	store *metrics.Store
+	names map[string]bool // The names of the metrics sampled.
+	alpha float64         // The weight of each new sample in the averages.
+
+	clock         clock.Clock
+	omitProgLabel bool
+
+	mu      sync.Mutex
+	streams map[string]*stream // By program, metric name and label values.
+}
+
+// stream is the history of the samples of one label set of a metric.
+type stream struct {
+	prog, name string
+	keys, vals []string
+	counter    bool
+
+	last     float64   // The last value read, for the rate of a counter.
+	lastTime time.Time // When it was read.
+	seen     bool      // True once the stream has been read.
+
+	samples  int     // The samples added to the averages.
+	mean     float64 // The moving average of the samples.
+	variance float64 // The moving variance of the samples about the average.
+	score    float64 // The score of the last sample.
+}
+
+// Option configures a new Detector.
+type Option func(*Detector) error
+
+// Clock sets the clock that samples are timed by, instead of the system clock.
+func Clock(c clock.Clock) Option {
+	return func(d *Detector) error {
+		d.clock = c
+		return nil
+	}
+}
+
+// OmitProgLabel leaves the prog label off the gauges exported, as for the
+// metrics they are of.
+func OmitProgLabel() Option {
+	return func(d *Detector) error {
+		d.omitProgLabel = true
+		return nil
+	}
+}
+
+// New returns a Detector of the metrics in store named by names, whose
+// averages weight each new sample by alpha, between 0 and 1.
+func New(store *metrics.Store, names []string, alpha float64, options ...Option) (*Detector, error) {
+	if store == nil {
+		return nil, errors.New("anomaly detector needs a Store")
+	}
+	if len(names) == 0 {
+		return nil, errors.New("anomaly detector needs metrics to sample")
+	}
+	if alpha <= 0 || alpha >= 1 {
+		return nil, errors.Errorf("anomaly detector weight %v must be between 0 and 1", alpha)
+	}
+	d := &Detector{
+		store:   store,
+		names:   make(map[string]bool, len(names)),
+		alpha:   alpha,
+		clock:   clock.Real,
+		streams: make(map[string]*stream),
+	}
+	for _, name := range names {
+		d.names[name] = true
+	}
+	for _, option := range options {
+		if err := option(d); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Sample reads each stream of the metrics and scores its latest sample.
+// Streams that have gone from the store are forgotten.
+func (d *Detector) Sample() {
+	now := d.clock.Now()
+	store := d.store.Snapshot()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	streams := make(map[string]*stream, len(d.streams))
+	for name, ml := range store.Metrics {
+		if !d.names[name] {
+			continue
+		}
+		for _, m := range ml {
+			m.RLock()
+			if m.Kind != metrics.Counter && m.Kind != metrics.Gauge {
+				m.RUnlock()
+				continue
+			}
+			for _, lv := range m.LabelValues {
+				v, ok := value(lv.Value)
+				if !ok {
+					continue
+				}
+				id := m.Program + "\x00" + name + "\x00" + strings.Join(lv.Labels, "\x00")
+				s, ok := d.streams[id]
+				if !ok {
+					s = &stream{prog: m.Program, name: name, counter: m.Kind == metrics.Counter}
+					s.keys, s.vals = sortedLabels(m.Keys, lv.Labels)
+				}
+				d.read(s, v, now)
+				streams[id] = s
+			}
+			m.RUnlock()
+		}
+	}
+	d.streams = streams
+}
+
+// value returns the value of a number datum.
+func value(dt datum.Datum) (float64, bool) {
+	switch dt := dt.(type) {
+	case *datum.Int:
+		return float64(dt.Get()), true
+	case *datum.Float:
+		return dt.Get(), true
+	}
+	return 0, false
+}
+
+// sortedLabels returns the label names and values ordered by name.
+func sortedLabels(keys, labels []string) ([]string, []string) {
+	i := make([]int, len(keys))
+	for j := range i {
+		i[j] = j
+	}
+	sort.Slice(i, func(a, b int) bool { return keys[i[a]] < keys[i[b]] })
+	k := make([]string, len(keys))
+	v := make([]string, len(keys))
+	for j, n := range i {
+		k[j], v[j] = keys[n], labels[n]
+	}
+	return k, v
+}
+
+// read takes a reading v of the stream at now, and adds the sample it gives
+// to the stream's averages.  A counter's first reading, and a reading after it
+// was reset, only start its next rate.
+func (d *Detector) read(s *stream, v float64, now time.Time) {
+	x := v
+	if s.counter {
+		ok := s.seen && now.After(s.lastTime) && v >= s.last
+		if ok {
+			x = (v - s.last) / now.Sub(s.lastTime).Seconds()
+		}
+		s.last, s.lastTime, s.seen = v, now, true
+		if !ok {
+			return
+		}
+	}
+	d.add(s, x)
+}
+
+// add scores the sample x against the averages of the samples before it, and
+// then moves the averages towards it.
+func (d *Detector) add(s *stream, x float64) {
+	if s.samples == 0 {
+		s.mean, s.variance, s.score = x, 0, 0
+		s.samples++
+		return
+	}
+	diff := x - s.mean
+	s.score = 0
+	if s.variance > 0 {
+		s.score = diff / math.Sqrt(s.variance)
+	}
+	incr := d.alpha * diff
+	s.mean += incr
+	s.variance = (1 - d.alpha) * (s.variance + diff*incr)
+	s.samples++
+}
+
+// Run samples the metrics every interval until ctx is cancelled.
+func (d *Detector) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		logging.Info("Anomaly detection disabled")
+		return
+	}
+	ticker := d.clock.NewTicker(interval)
+	d.Sample()
+	go func() {
+		logging.Infof("Starting anomaly detection loop every %s", interval.String())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				d.Sample()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Describe implements prometheus.Collector.
+func (d *Detector) Describe(c chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(d, c)
+}
+
+// Collect implements prometheus.Collector, exporting the moving average and
+// the score of the last sample of each stream that has been sampled, as
+// <metric>_ewma and <metric>_anomaly_score.
+func (d *Detector) Collect(c chan<- prometheus.Metric) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range d.streams {
+		if s.samples == 0 {
+			continue
+		}
+		keys, vals := s.keys, s.vals
+		if !d.omitProgLabel {
+			keys = append([]string{"prog"}, keys...)
+			vals = append([]string{s.prog}, vals...)
+		}
+		name := strings.Replace(s.name, "-", "_", -1)
+		of := "value"
+		if s.counter {
+			of = "rate per second"
+		}
+		c <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(name+"_ewma", "exponentially weighted moving average of the "+of+" of "+s.name, keys, nil),
+			prometheus.GaugeValue, s.mean, vals...)
+		c <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(name+"_anomaly_score", "standard deviations of the last "+of+" of "+s.name+" from its moving average", keys, nil),
+			prometheus.GaugeValue, s.score, vals...)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package anomaly
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDetector(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	store := metrics.NewStore()
+	requests := metrics.NewMetric("requests", "web", metrics.Counter, metrics.Int, "code")
+	testutil.FatalIfErr(t, store.Add(requests))
+	queue := metrics.NewMetric("queue", "web", metrics.Gauge, metrics.Float)
+	testutil.FatalIfErr(t, store.Add(queue))
+	other := metrics.NewMetric("other", "web", metrics.Counter, metrics.Int)
+	testutil.FatalIfErr(t, store.Add(other))
+	ok, err := requests.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	q, err := queue.GetDatum()
+	testutil.FatalIfErr(t, err)
+
+	d, err := New(store, []string{"requests", "queue"}, 0.5, Clock(clk))
+	testutil.FatalIfErr(t, err)
+
+	// The counter's rates are 1, 2 and 1 per second.
+	for i, v := range []int64{0, 10, 30, 40} {
+		if i > 0 {
+			clk.Advance(10 * time.Second)
+		}
+		datum.SetInt(ok, v, clk.Now())
+		datum.SetFloat(q, float64(v), clk.Now())
+		d.Sample()
+	}
+	expected := `
+# HELP queue_anomaly_score standard deviations of the last value of queue from its moving average
+# TYPE queue_anomaly_score gauge
+queue_anomaly_score{prog="web"} 1.7320508075688772
+# HELP queue_ewma exponentially weighted moving average of the value of queue
+# TYPE queue_ewma gauge
+queue_ewma{prog="web"} 28.75
+# HELP requests_anomaly_score standard deviations of the last rate per second of requests from its moving average
+# TYPE requests_anomaly_score gauge
+requests_anomaly_score{code="200",prog="web"} -1
+# HELP requests_ewma exponentially weighted moving average of the rate per second of requests
+# TYPE requests_ewma gauge
+requests_ewma{code="200",prog="web"} 1.25
+`
+	testutil.FatalIfErr(t, promtest.CollectAndCompare(d, strings.NewReader(expected)))
+
+	// A spike scores high.
+	clk.Advance(10 * time.Second)
+	datum.SetInt(ok, 140, clk.Now())
+	d.Sample()
+	if s := d.streams["web\x00requests\x00200"].score; s < 3 {
+		t.Errorf("spike scored %v, expected more than 3", s)
+	}
+
+	// A counter reset isn't scored, and starts the next rate.
+	clk.Advance(10 * time.Second)
+	datum.SetInt(ok, 5, clk.Now())
+	s := *d.streams["web\x00requests\x00200"]
+	d.Sample()
+	after := d.streams["web\x00requests\x00200"]
+	testutil.ExpectNoDiff(t, s.samples, after.samples)
+	testutil.ExpectNoDiff(t, float64(5), after.last)
+
+	// Streams removed from the store are forgotten.
+	testutil.FatalIfErr(t, requests.RemoveDatum("200"))
+	d.Sample()
+	if _, ok := d.streams["web\x00requests\x00200"]; ok {
+		t.Error("removed stream still sampled")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	store := metrics.NewStore()
+	for _, tc := range []struct {
+		names []string
+		alpha float64
+	}{
+		{nil, 0.5},
+		{[]string{"a"}, 0},
+		{[]string{"a"}, 1},
+	} {
+		if _, err := New(store, tc.names, tc.alpha); err == nil {
+			t.Errorf("%v, %v: expected an error", tc.names, tc.alpha)
+		}
+	}
+	if _, err := New(nil, []string{"a"}, 0.5); err == nil {
+		t.Error("expected an error without a store")
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package bundle fetches signed bundles of mtail programs from a URL into the
+// program directory, so that the programs of many hosts can be managed from
+// one place.
+//
+// A bundle is a tar archive, optionally gzipped, of programs and their
+// sidecar manifests.  It is only installed if its detached ed25519 signature
+// verifies against the public key configured, so a compromised or spoofed
+// server can't make mtail run programs that weren't signed.  An installed
+// bundle replaces all the programs in the directory.
+package bundle
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/pkg/errors"
+)
+
+var (
+	// bundleFetches counts the attempts to fetch a bundle.
+	bundleFetches = expvar.NewInt("prog_bundle_fetches_total")
+	// bundleFetchErrors counts the fetches that failed, either to download
+	// the bundle or because it did not verify.
+	bundleFetchErrors = expvar.NewInt("prog_bundle_fetch_errors_total")
+	// bundleUpdates counts the new bundles installed.
+	bundleUpdates = expvar.NewInt("prog_bundle_updates_total")
+)
+
+const (
+	// maxBundleSize limits the size of a bundle, compressed or not.
+	maxBundleSize = 16 << 20
+	// maxSignatureSize limits the size of a signature file.
+	maxSignatureSize = 1 << 10
+
+	programExt  = ".mtail"
+	manifestExt = ".mtail.manifest"
+)
+
+// Fetcher fetches bundles of programs into a directory.
+type Fetcher struct {
+	url, signatureURL string
+	key               ed25519.PublicKey
+	dir               string
+	client            *http.Client
+
+	etag string   // of the bundle last installed
+	sum  [32]byte // of the bundle last installed
+}
+
+// NewFetcher creates a Fetcher of the bundle at url into dir, verified by the
+// signature at signatureURL, or url with .sig appended if empty, with key.
+// Fetches are made with transport, or http.DefaultTransport if it's nil.
+func NewFetcher(url, signatureURL string, key ed25519.PublicKey, dir string, transport http.RoundTripper) (*Fetcher, error) {
+	if url == "" {
+		return nil, errors.New("program bundle needs a URL")
+	}
+	if signatureURL == "" {
+		signatureURL = url + ".sig"
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.Errorf("program bundles are installed into a directory, and %q is not one", dir)
+	}
+	return &Fetcher{
+		url:          url,
+		signatureURL: signatureURL,
+		key:          key,
+		dir:          dir,
+		client:       &http.Client{Transport: transport, Timeout: time.Minute},
+	}, nil
+}
+
+// ReadPublicKey reads an ed25519 public key, either PEM encoded as made by
+// openssl pkey -pubout, or the 32 bytes of the key base64 encoded.
+func ReadPublicKey(path string) (ed25519.PublicKey, error) {
+	if path == "" {
+		return nil, errors.New("program bundle needs a public key to verify it")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing public key %s", path)
+		}
+		key, ok := k.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.Errorf("public key %s is not an ed25519 key", path)
+		}
+		return key, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.Errorf("public key %s is neither PEM nor a base64 ed25519 key", path)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Run fetches the bundle every interval until ctx is done, calling reload
+// after a new bundle is installed.
+func (f *Fetcher) Run(ctx context.Context, interval time.Duration, reload func() error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			changed, err := f.Fetch(ctx)
+			if err != nil {
+				logging.Warningf("Failed to fetch program bundle: %s", err)
+				continue
+			}
+			if changed {
+				if err := reload(); err != nil {
+					logging.Warning(err)
+				}
+			}
+		}
+	}
+}
+
+// Fetch downloads the bundle and installs it if it has changed since the last
+// one installed and its signature verifies, returning whether it did.
+func (f *Fetcher) Fetch(ctx context.Context) (changed bool, err error) {
+	bundleFetches.Add(1)
+	defer func() {
+		if err != nil {
+			bundleFetchErrors.Add(1)
+		}
+	}()
+	b, etag, err := f.get(ctx, f.url, f.etag, maxBundleSize)
+	if err != nil || b == nil {
+		return false, err
+	}
+	sum := sha256.Sum256(b)
+	if sum == f.sum {
+		f.etag = etag
+		return false, nil
+	}
+	sig, _, err := f.get(ctx, f.signatureURL, "", maxSignatureSize)
+	if err != nil {
+		return false, err
+	}
+	if err := f.verify(b, sig); err != nil {
+		return false, err
+	}
+	files, err := extract(b)
+	if err != nil {
+		return false, err
+	}
+	if err := f.install(files); err != nil {
+		return false, err
+	}
+	f.etag, f.sum = etag, sum
+	bundleUpdates.Add(1)
+	logging.Infof("Installed program bundle from %s with %d files", f.url, len(files))
+	return true, nil
+}
+
+// get returns the body of url and its ETag, or nil if it matches etag.
+func (f *Fetcher) get(ctx context.Context, url, etag string, limit int64) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && etag != "":
+		return nil, etag, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, "", errors.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	b, err := readLimited(resp.Body, limit)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "fetching %s", url)
+	}
+	return b, resp.Header.Get("ETag"), nil
+}
+
+// readLimited reads all of r, unless it is longer than limit.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, errors.Errorf("longer than %d bytes", limit)
+	}
+	return b, nil
+}
+
+// verify checks the signature sig of the bundle b, either the raw signature
+// as made by openssl pkeyutl -sign, or base64 encoded.
+func (f *Fetcher) verify(b, sig []byte) error {
+	if len(sig) != ed25519.SignatureSize {
+		d, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+		if err != nil || len(d) != ed25519.SignatureSize {
+			return errors.Errorf("signature %s is not an ed25519 signature", f.signatureURL)
+		}
+		sig = d
+	}
+	if !ed25519.Verify(f.key, b, sig) {
+		return errors.Errorf("signature %s does not verify the bundle %s", f.signatureURL, f.url)
+	}
+	return nil
+}
+
+// extract returns the programs and manifests in the bundle b by filename.
+// Files in directories are taken by their base name, so that bundles made by
+// archiving a directory, or by a source host's archive of a Git ref, can be
+// used as they are.
+func extract(b []byte) (map[string][]byte, error) {
+	br := bufio.NewReader(bytes.NewReader(b))
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading bundle")
+		}
+		r = zr
+	}
+	files := make(map[string][]byte)
+	var total int64
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading bundle")
+		}
+		name := filepath.Base(filepath.Clean("/" + h.Name))
+		if h.Typeflag != tar.TypeReg || strings.HasPrefix(name, ".") ||
+			!(strings.HasSuffix(name, programExt) || strings.HasSuffix(name, manifestExt)) {
+			continue
+		}
+		if _, ok := files[name]; ok {
+			return nil, errors.Errorf("bundle has more than one %s", name)
+		}
+		total += h.Size
+		if total > maxBundleSize {
+			return nil, errors.Errorf("bundle is larger than %d bytes uncompressed", maxBundleSize)
+		}
+		if files[name], err = readLimited(tr, h.Size); err != nil {
+			return nil, errors.Wrapf(err, "reading %s from bundle", name)
+		}
+	}
+	return files, nil
+}
+
+// install writes files into the directory, each replaced atomically, and
+// removes the programs and manifests that the bundle doesn't have.
+func (f *Fetcher) install(files map[string][]byte) error {
+	for name, b := range files {
+		tmp := filepath.Join(f.dir, "."+name+".tmp")
+		if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, filepath.Join(f.dir, name)); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	fis, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		if _, ok := files[name]; ok || fi.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, programExt) || strings.HasSuffix(name, manifestExt) {
+			if err := os.Remove(filepath.Join(f.dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
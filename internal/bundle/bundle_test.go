@@ -0,0 +1,205 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+// makeBundle returns a gzipped tar archive of files, under a top directory as
+// made by archiving a Git ref.
+func makeBundle(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(zw)
+	testutil.FatalIfErr(t, tw.WriteHeader(&tar.Header{Name: "progs-v1/", Typeflag: tar.TypeDir, Mode: 0755}))
+	for name, body := range files {
+		testutil.FatalIfErr(t, tw.WriteHeader(&tar.Header{Name: "progs-v1/" + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(body))}))
+		_, err := tw.Write([]byte(body))
+		testutil.FatalIfErr(t, err)
+	}
+	testutil.FatalIfErr(t, tw.Close())
+	testutil.FatalIfErr(t, zw.Close())
+	return b.Bytes()
+}
+
+// bundleServer serves a bundle and its signature, with an ETag.
+type bundleServer struct {
+	mu     sync.Mutex
+	bundle []byte
+	sig    []byte
+	etag   string
+}
+
+func (s *bundleServer) set(bundle, sig []byte, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bundle, s.sig, s.etag = bundle, sig, etag
+}
+
+func (s *bundleServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.URL.Path {
+	case "/progs.tar.gz":
+		if r.Header.Get("If-None-Match") == s.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", s.etag)
+		w.Write(s.bundle)
+	case "/progs.tar.gz.sig":
+		w.Write(s.sig)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	fis, err := ioutil.ReadDir(dir)
+	testutil.FatalIfErr(t, err)
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFetch(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	testutil.FatalIfErr(t, err)
+	s := &bundleServer{}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	dir, rmDir := testutil.TestTempDir(t)
+	defer rmDir()
+	testutil.FatalIfErr(t, ioutil.WriteFile(filepath.Join(dir, "old.mtail"), []byte("/$/ {}\n"), 0644))
+	testutil.FatalIfErr(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("kept"), 0644))
+
+	f, err := NewFetcher(ts.URL+"/progs.tar.gz", "", pub, dir, nil)
+	testutil.FatalIfErr(t, err)
+	ctx := context.Background()
+
+	b := makeBundle(t, map[string]string{
+		"a.mtail":          "counter a\n",
+		"a.mtail.manifest": `{"version": "1"}`,
+		"sub/b.mtail":      "counter b\n",
+		"notes.txt":        "not a program",
+	})
+	s.set(b, ed25519.Sign(priv, b), `"1"`)
+	changed, err := f.Fetch(ctx)
+	testutil.FatalIfErr(t, err)
+	if !changed {
+		t.Error("first fetch did not install the bundle")
+	}
+	testutil.ExpectNoDiff(t, []string{"README", "a.mtail", "a.mtail.manifest", "b.mtail"}, listDir(t, dir))
+	a, err := ioutil.ReadFile(filepath.Join(dir, "a.mtail"))
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "counter a\n", string(a))
+
+	// Not modified.
+	changed, err = f.Fetch(ctx)
+	testutil.FatalIfErr(t, err)
+	if changed {
+		t.Error("unchanged bundle installed again")
+	}
+
+	// A new bundle with a bad signature is not installed.
+	b2 := makeBundle(t, map[string]string{"c.mtail": "counter c\n"})
+	s.set(b2, ed25519.Sign(priv, b), `"2"`)
+	if _, err := f.Fetch(ctx); err == nil {
+		t.Error("bundle with a bad signature installed")
+	}
+	testutil.ExpectNoDiff(t, []string{"README", "a.mtail", "a.mtail.manifest", "b.mtail"}, listDir(t, dir))
+
+	// A base64 signature also verifies, and replaces the programs.
+	s.set(b2, []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, b2))+"\n"), `"2"`)
+	changed, err = f.Fetch(ctx)
+	testutil.FatalIfErr(t, err)
+	if !changed {
+		t.Error("new bundle not installed")
+	}
+	testutil.ExpectNoDiff(t, []string{"README", "c.mtail"}, listDir(t, dir))
+}
+
+func TestReadPublicKey(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	testutil.FatalIfErr(t, err)
+	dir, rmDir := testutil.TestTempDir(t)
+	defer rmDir()
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	testutil.FatalIfErr(t, err)
+	pemPath := filepath.Join(dir, "key.pem")
+	testutil.FatalIfErr(t, ioutil.WriteFile(pemPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+	k, err := ReadPublicKey(pemPath)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, pub, k)
+
+	b64Path := filepath.Join(dir, "key.b64")
+	testutil.FatalIfErr(t, ioutil.WriteFile(b64Path, []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644))
+	k, err = ReadPublicKey(b64Path)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, pub, k)
+
+	badPath := filepath.Join(dir, "bad")
+	testutil.FatalIfErr(t, ioutil.WriteFile(badPath, []byte("not a key"), 0644))
+	for _, path := range []string{"", badPath, filepath.Join(dir, "missing")} {
+		if _, err := ReadPublicKey(path); err == nil {
+			t.Errorf("ReadPublicKey(%q) returned no error", path)
+		}
+	}
+}
+
+func TestExtractErrors(t *testing.T) {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, name := range []string{"x/a.mtail", "y/a.mtail"} {
+		testutil.FatalIfErr(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}))
+	}
+	testutil.FatalIfErr(t, tw.Close())
+	if _, err := extract(b.Bytes()); err == nil {
+		t.Error("expected an error for two programs with the same name")
+	}
+	if _, err := extract([]byte{0x1f, 0x8b, 0}); err == nil {
+		t.Error("expected an error for a bad gzip stream")
+	}
+}
+
+func TestNewFetcherErrors(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	testutil.FatalIfErr(t, err)
+	dir, rmDir := testutil.TestTempDir(t)
+	defer rmDir()
+	file := filepath.Join(dir, "file")
+	testutil.FatalIfErr(t, ioutil.WriteFile(file, nil, 0644))
+	for _, tc := range []struct{ url, dir string }{
+		{"", dir},
+		{"http://localhost/progs.tar", file},
+		{"http://localhost/progs.tar", filepath.Join(dir, "missing")},
+	} {
+		if _, err := NewFetcher(tc.url, "", pub, tc.dir, nil); err == nil {
+			t.Errorf("NewFetcher(%q, %q) returned no error", tc.url, tc.dir)
+		}
+	}
+}
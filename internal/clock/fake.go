@@ -0,0 +1,156 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a Clock whose time only moves when a test advances it.  Its tickers
+// and timers fire as the time passes them.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer // The tickers and timers made, fired or not.
+	changed *sync.Cond   // Broadcast when the waiting tickers and timers change.
+}
+
+// NewFake returns a Fake starting at the time now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.changed = sync.NewCond(&f.mu)
+	return f
+}
+
+// Now returns the Fake's time.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTicker returns a Ticker that fires every d of the Fake's time.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{f.add(d, d)}
+}
+
+// NewTimer returns a Timer that fires once d of the Fake's time has passed.
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return f.add(d, 0)
+}
+
+func (f *Fake) add(d, period time.Duration) *fakeTimer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTimer{f: f, c: make(chan time.Time, 1), when: f.now.Add(d), period: period, active: true}
+	f.waiters = append(f.waiters, t)
+	f.changed.Broadcast()
+	return t
+}
+
+// Advance moves the Fake's time forward by d, firing the tickers and timers
+// due by then in the order they are due.  Like a real ticker whose receiver
+// falls behind, a ticker fires at most once for each Advance.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := f.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range f.waiters {
+			if t.active && !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		f.now = next.when
+		select {
+		case next.c <- f.now:
+		default:
+		}
+		if next.period == 0 {
+			next.active = false
+			continue
+		}
+		// Skip the ticks that would be dropped before end.
+		next.when = next.when.Add(next.period)
+		if !next.when.After(end) {
+			next.when = next.when.Add(end.Sub(next.when).Truncate(next.period) + next.period)
+		}
+	}
+	f.now = end
+	f.changed.Broadcast()
+}
+
+// BlockUntil waits until n tickers and timers are waiting to fire, for tests
+// that must know a loop has started before advancing the time.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for f.waiting() < n {
+		f.changed.Wait()
+	}
+}
+
+// waiting returns the number of tickers and timers waiting to fire.
+func (f *Fake) waiting() int {
+	n := 0
+	for _, t := range f.waiters {
+		if t.active {
+			n++
+		}
+	}
+	return n
+}
+
+// fakeTicker is a ticker of a Fake.
+type fakeTicker struct {
+	*fakeTimer
+}
+
+// Stop stops the ticker firing.
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+// fakeTimer is a timer of a Fake, or the ticker it wraps.
+type fakeTimer struct {
+	f      *Fake
+	c      chan time.Time
+	when   time.Time     // When it next fires, protected by f.mu.
+	period time.Duration // The interval between ticks, or zero for a timer.
+	active bool          // Whether it will fire, protected by f.mu.
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop stops the ticker or timer firing, returning whether it was going to.
+func (t *fakeTimer) Stop() bool {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	active := t.active
+	t.active = false
+	t.f.changed.Broadcast()
+	return active
+}
+
+// Reset makes the ticker or timer next fire once d has passed, returning
+// whether it was going to fire.
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	active := t.active
+	t.when = t.f.now.Add(d)
+	t.active = true
+	t.f.changed.Broadcast()
+	return active
+}
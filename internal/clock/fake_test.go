@@ -0,0 +1,89 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fired returns the tick waiting on c, or the zero time if there is none.
+func fired(c <-chan time.Time) time.Time {
+	select {
+	case tm := <-c:
+		return tm
+	default:
+		return time.Time{}
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(epoch)
+	tk := f.NewTicker(time.Minute)
+
+	f.Advance(59 * time.Second)
+	testutil.ExpectNoDiff(t, time.Time{}, fired(tk.C()))
+	f.Advance(time.Second)
+	testutil.ExpectNoDiff(t, epoch.Add(time.Minute), fired(tk.C()))
+	testutil.ExpectNoDiff(t, epoch.Add(time.Minute), f.Now())
+
+	// Ticks are dropped while the last is unreceived.
+	f.Advance(10 * time.Minute)
+	testutil.ExpectNoDiff(t, epoch.Add(2*time.Minute), fired(tk.C()))
+	testutil.ExpectNoDiff(t, time.Time{}, fired(tk.C()))
+	// The ticker keeps its phase.
+	f.Advance(time.Minute)
+	testutil.ExpectNoDiff(t, epoch.Add(12*time.Minute), fired(tk.C()))
+
+	tk.Stop()
+	f.Advance(time.Hour)
+	testutil.ExpectNoDiff(t, time.Time{}, fired(tk.C()))
+}
+
+func TestFakeTimer(t *testing.T) {
+	f := NewFake(epoch)
+	tm := f.NewTimer(time.Second)
+
+	f.Advance(time.Hour)
+	testutil.ExpectNoDiff(t, epoch.Add(time.Second), fired(tm.C()))
+	if tm.Stop() {
+		t.Error("Stop reported a fired timer as active")
+	}
+
+	if tm.Reset(time.Second) {
+		t.Error("Reset reported a fired timer as active")
+	}
+	if !tm.Stop() {
+		t.Error("Stop reported a reset timer as inactive")
+	}
+	f.Advance(time.Hour)
+	testutil.ExpectNoDiff(t, time.Time{}, fired(tm.C()))
+}
+
+func TestFakeOrder(t *testing.T) {
+	f := NewFake(epoch)
+	slow := f.NewTimer(2 * time.Second)
+	fast := f.NewTimer(time.Second)
+
+	f.Advance(time.Minute)
+	testutil.ExpectNoDiff(t, epoch.Add(time.Second), fired(fast.C()))
+	testutil.ExpectNoDiff(t, epoch.Add(2*time.Second), fired(slow.C()))
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(epoch)
+	done := make(chan struct{})
+	go func() {
+		tk := f.NewTicker(time.Second)
+		<-tk.C()
+		close(done)
+	}()
+	f.BlockUntil(1)
+	f.Advance(time.Second)
+	<-done
+}
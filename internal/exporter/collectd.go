@@ -41,8 +41,9 @@ func metricToCollectd(hostname string, m *metrics.Metric, l *metrics.LabelSet) s
 }
 
 func kindToCollectdType(kind metrics.Kind) string {
-	if kind != metrics.Timer {
-		return strings.ToLower(kind.String())
+	switch kind {
+	case metrics.Timer, metrics.TopK, metrics.Distinct, metrics.Min, metrics.Max, metrics.Avg:
+		return "gauge"
 	}
-	return "gauge"
+	return strings.ToLower(kind.String())
 }
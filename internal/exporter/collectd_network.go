@@ -0,0 +1,218 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"expvar"
+	"flag"
+	"math"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/secret"
+	"github.com/pkg/errors"
+)
+
+var (
+	collectdNetworkHostPort = flag.String("collectd_network_host_port", "",
+		"Host:port of a collectd network plugin server to send metrics to over UDP in the collectd binary protocol.")
+	collectdSecurityLevel = flag.String("collectd_security_level", "none",
+		"Security of the packets sent to --collectd_network_host_port: none, sign or encrypt.")
+	collectdUsername = flag.String("collectd_username", "",
+		"Username to sign or encrypt collectd network packets as.")
+	collectdPasswordFile = flag.String("collectd_password_file", "",
+		"File containing the password to sign or encrypt collectd network packets with.  If unset, it is taken from the MTAIL_COLLECTD_PASSWORD environment variable.  The file is reread when it changes.")
+
+	collectdNetworkExportTotal   = expvar.NewInt("collectd_network_export_total")
+	collectdNetworkExportSuccess = expvar.NewInt("collectd_network_export_success")
+)
+
+// Part types of the collectd binary protocol, from
+// https://collectd.org/wiki/index.php/Binary_protocol
+const (
+	collectdPartHost           = 0x0000
+	collectdPartPlugin         = 0x0002
+	collectdPartPluginInstance = 0x0003
+	collectdPartType           = 0x0004
+	collectdPartTypeInstance   = 0x0005
+	collectdPartValues         = 0x0006
+	collectdPartTimeHR         = 0x0008
+	collectdPartIntervalHR     = 0x0009
+	collectdPartSignature      = 0x0200
+	collectdPartEncryption     = 0x0210
+)
+
+// Data source types of a value in a values part.
+const (
+	collectdDSCounter = 0
+	collectdDSGauge   = 1
+)
+
+// collectdSecurity signs or encrypts collectd network packets as a user, as
+// the collectd network plugin's SecurityLevel option does.
+type collectdSecurity struct {
+	level    string
+	username string
+	password *secret.Secret
+}
+
+func newCollectdSecurity(level, username, passwordFile string) (*collectdSecurity, error) {
+	switch level {
+	case "none":
+		return &collectdSecurity{level: level}, nil
+	case "sign", "encrypt":
+	default:
+		return nil, errors.Errorf("unknown collectd security level %q, expecting none, sign or encrypt", level)
+	}
+	password, err := secret.New("collectd_password", passwordFile)
+	if err != nil {
+		return nil, err
+	}
+	if username == "" || password == nil {
+		return nil, errors.Errorf("collectd security level %s needs a username and password", level)
+	}
+	return &collectdSecurity{level, username, password}, nil
+}
+
+// seal returns the packet made from payload at the security level.
+func (s *collectdSecurity) seal(payload []byte) ([]byte, error) {
+	switch s.level {
+	case "sign":
+		// The signature is of the username and the rest of the packet.
+		mac := hmac.New(sha256.New, []byte(s.password.Value()))
+		mac.Write([]byte(s.username))
+		mac.Write(payload)
+		b := appendCollectdHeader(nil, collectdPartSignature, 4+sha256.Size+len(s.username))
+		b = mac.Sum(b)
+		b = append(b, s.username...)
+		return append(b, payload...), nil
+	case "encrypt":
+		key := sha256.Sum256([]byte(s.password.Value()))
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, aes.BlockSize)
+		if _, err := rand.Read(iv); err != nil {
+			return nil, err
+		}
+		// The protocol checks the decrypted payload with its SHA-1 hash.
+		hash := sha1.Sum(payload)
+		plain := append(hash[:], payload...)
+		b := appendCollectdHeader(nil, collectdPartEncryption, 4+2+len(s.username)+len(iv)+len(plain))
+		b = appendUint16(b, uint16(len(s.username)))
+		b = append(b, s.username...)
+		b = append(b, iv...)
+		n := len(b)
+		b = append(b, plain...)
+		cipher.NewOFB(block, iv).XORKeyStream(b[n:], b[n:])
+		return b, nil
+	}
+	return payload, nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var a [2]byte
+	binary.BigEndian.PutUint16(a[:], v)
+	return append(b, a[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var a [8]byte
+	binary.BigEndian.PutUint64(a[:], v)
+	return append(b, a[:]...)
+}
+
+func appendCollectdHeader(b []byte, typ uint16, length int) []byte {
+	return appendUint16(appendUint16(b, typ), uint16(length))
+}
+
+func appendCollectdString(b []byte, typ uint16, s string) []byte {
+	b = appendCollectdHeader(b, typ, 4+len(s)+1)
+	b = append(b, s...)
+	return append(b, 0)
+}
+
+func appendCollectdNumber(b []byte, typ uint16, v uint64) []byte {
+	return appendUint64(appendCollectdHeader(b, typ, 12), v)
+}
+
+// collectdTime converts nanoseconds since the epoch to the collectd high
+// resolution time, in units of 2^-30 seconds.
+func collectdTime(nsec int64) uint64 {
+	return uint64(nsec/1e9)<<30 | uint64(nsec%1e9)<<30/1e9
+}
+
+// collectdNetworkFormatter returns a formatter that encodes each LabelSet as
+// one packet of the collectd binary protocol, in the same names as the
+// unixsock text format uses, so the values can be stored under the standard
+// counter and gauge types.  Histograms have no standard type, so are left
+// out.
+func collectdNetworkFormatter(s *collectdSecurity) formatter {
+	return func(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+		var ds byte
+		var v uint64
+		switch m.Kind {
+		case metrics.Counter:
+			ds = collectdDSCounter
+			switch d := l.Datum.(type) {
+			case *datum.Int:
+				v = uint64(d.Get())
+			case *datum.Float:
+				v = uint64(d.Get())
+			default:
+				return ""
+			}
+		case metrics.Gauge, metrics.Timer, metrics.TopK, metrics.Distinct, metrics.Min, metrics.Max, metrics.Avg:
+			ds = collectdDSGauge
+			switch d := l.Datum.(type) {
+			case *datum.Int:
+				v = math.Float64bits(float64(d.Get()))
+			case *datum.Float:
+				v = math.Float64bits(d.Get())
+			case *datum.Sketch:
+				v = math.Float64bits(float64(d.Estimate()))
+			case *datum.Aggregate:
+				a, _ := d.Get()
+				v = math.Float64bits(a)
+			default:
+				return ""
+			}
+		default:
+			return ""
+		}
+		b := appendCollectdString(nil, collectdPartHost, hostname)
+		b = appendCollectdNumber(b, collectdPartTimeHR, collectdTime(l.Datum.TimeUTC().UnixNano()))
+		b = appendCollectdNumber(b, collectdPartIntervalHR, uint64(*pushInterval)<<30)
+		b = appendCollectdString(b, collectdPartPlugin, *collectdPrefix+"mtail")
+		b = appendCollectdString(b, collectdPartPluginInstance, m.Program)
+		b = appendCollectdString(b, collectdPartType, kindToCollectdType(m.Kind))
+		b = appendCollectdString(b, collectdPartTypeInstance, formatLabels(m.Name, l.Labels, "-", "-", "_"))
+		b = appendCollectdHeader(b, collectdPartValues, 4+2+1+8)
+		b = appendUint16(b, 1)
+		b = append(b, ds)
+		if ds == collectdDSGauge {
+			// Gauges alone are in little endian byte order.
+			var a [8]byte
+			binary.LittleEndian.PutUint64(a[:], v)
+			b = append(b, a[:]...)
+		} else {
+			b = appendUint64(b, v)
+		}
+		p, err := s.seal(b)
+		if err != nil {
+			logging.Infof("collectd packet not sent: %s", err)
+			return ""
+		}
+		return string(p)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+type collectdPart struct {
+	Type    uint16
+	Payload []byte
+}
+
+func decodeCollectdParts(t *testing.T, b []byte) []collectdPart {
+	t.Helper()
+	var parts []collectdPart
+	for len(b) > 0 {
+		if len(b) < 4 {
+			t.Fatalf("short part header %v", b)
+		}
+		typ := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if n < 4 || n > len(b) {
+			t.Fatalf("part length %d out of range in %v", n, b)
+		}
+		parts = append(parts, collectdPart{typ, b[4:n]})
+		b = b[n:]
+	}
+	return parts
+}
+
+func collectdValuesPayload(ds byte, v uint64) []byte {
+	b := []byte{0, 1, ds}
+	var a [8]byte
+	if ds == collectdDSGauge {
+		binary.LittleEndian.PutUint64(a[:], v)
+	} else {
+		binary.BigEndian.PutUint64(a[:], v)
+	}
+	return append(b, a[:]...)
+}
+
+func collectdNumberPayload(v uint64) []byte {
+	var a [8]byte
+	binary.BigEndian.PutUint64(a[:], v)
+	return a[:]
+}
+
+func TestMetricToCollectdNetwork(t *testing.T) {
+	oldPrefix := *collectdPrefix
+	*collectdPrefix = ""
+	defer func() { *collectdPrefix = oldPrefix }()
+	ts := time.Unix(1343124840, 500000000)
+
+	counter := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	d, _ := counter.GetDatum()
+	datum.SetInt(d, 37, ts)
+	gauge := metrics.NewMetric("bar", "prog", metrics.Gauge, metrics.Float, "label")
+	d, _ = gauge.GetDatum("quux")
+	datum.SetFloat(d, 1.5, ts)
+	histogram := metrics.NewMetric("baz", "prog", metrics.Histogram, metrics.Buckets)
+	histogram.Buckets = []datum.Range{{0, 1}}
+	_, _ = histogram.GetDatum()
+
+	f := collectdNetworkFormatter(&collectdSecurity{level: "none"})
+	timeHR := collectdNumberPayload(1343124840<<30 | 1<<29)
+	interval := collectdNumberPayload(60 << 30)
+	for _, tc := range []struct {
+		m            *metrics.Metric
+		typ          string
+		typeInstance string
+		values       []byte
+	}{
+		{counter, "counter", "foo", collectdValuesPayload(collectdDSCounter, 37)},
+		{gauge, "gauge", "bar-label-quux", collectdValuesPayload(collectdDSGauge, math.Float64bits(1.5))},
+	} {
+		r := FakeSocketWrite(f, tc.m)
+		if len(r) != 1 {
+			t.Fatalf("expected one packet, received %d", len(r))
+		}
+		expected := []collectdPart{
+			{collectdPartHost, []byte("gunstar\x00")},
+			{collectdPartTimeHR, timeHR},
+			{collectdPartIntervalHR, interval},
+			{collectdPartPlugin, []byte("mtail\x00")},
+			{collectdPartPluginInstance, []byte("prog\x00")},
+			{collectdPartType, []byte(tc.typ + "\x00")},
+			{collectdPartTypeInstance, []byte(tc.typeInstance + "\x00")},
+			{collectdPartValues, tc.values},
+		}
+		testutil.ExpectNoDiff(t, expected, decodeCollectdParts(t, []byte(r[0])))
+	}
+
+	testutil.ExpectNoDiff(t, []string{""}, FakeSocketWrite(f, histogram))
+}
+
+func TestCollectdSecurity(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	passwordFile := filepath.Join(tmpDir, "password")
+	testutil.FatalIfErr(t, ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600))
+	payload := []byte("\x00\x00\x00\x0cgunstar\x00")
+
+	s, err := newCollectdSecurity("sign", "mtail", passwordFile)
+	testutil.FatalIfErr(t, err)
+	p, err := s.seal(payload)
+	testutil.FatalIfErr(t, err)
+	sig := decodeCollectdParts(t, p[:4+sha256.Size+len("mtail")])
+	if len(sig) != 1 || sig[0].Type != collectdPartSignature {
+		t.Fatalf("expected a signature part, received %v", sig)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("mtail"))
+	mac.Write(payload)
+	testutil.ExpectNoDiff(t, mac.Sum(nil), sig[0].Payload[:sha256.Size])
+	testutil.ExpectNoDiff(t, "mtail", string(sig[0].Payload[sha256.Size:]))
+	testutil.ExpectNoDiff(t, payload, p[len(p)-len(payload):])
+
+	s, err = newCollectdSecurity("encrypt", "mtail", passwordFile)
+	testutil.FatalIfErr(t, err)
+	p, err = s.seal(payload)
+	testutil.FatalIfErr(t, err)
+	enc := decodeCollectdParts(t, p)
+	if len(enc) != 1 || enc[0].Type != collectdPartEncryption {
+		t.Fatalf("expected one encryption part, received %v", enc)
+	}
+	b := enc[0].Payload
+	if n := int(binary.BigEndian.Uint16(b)); string(b[2:2+n]) != "mtail" {
+		t.Errorf("username %q, expected mtail", b[2:2+n])
+	}
+	b = b[2+len("mtail"):]
+	key := sha256.Sum256([]byte("secret"))
+	block, err := aes.NewCipher(key[:])
+	testutil.FatalIfErr(t, err)
+	plain := make([]byte, len(b)-aes.BlockSize)
+	cipher.NewOFB(block, b[:aes.BlockSize]).XORKeyStream(plain, b[aes.BlockSize:])
+	hash := sha1.Sum(plain[sha1.Size:])
+	if !bytes.Equal(hash[:], plain[:sha1.Size]) {
+		t.Errorf("hash of decrypted payload doesn't match")
+	}
+	testutil.ExpectNoDiff(t, payload, plain[sha1.Size:])
+
+	for _, tc := range []struct{ level, username, passwordFile string }{
+		{"bogus", "", ""},
+		{"sign", "", passwordFile},
+		{"encrypt", "mtail", ""},
+		{"sign", "mtail", filepath.Join(tmpDir, "missing")},
+	} {
+		if _, err := newCollectdSecurity(tc.level, tc.username, tc.passwordFile); err == nil {
+			t.Errorf("newCollectdSecurity(%q, %q, %q) returned no error", tc.level, tc.username, tc.passwordFile)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/mtail/internal/secret"
+	"github.com/pkg/errors"
+)
+
+var (
+	pushProxy = flag.String("metric_push_proxy", "",
+		"URL of a proxy to make the TCP connections of metric pushes, alert webhooks, program bundle fetches and remote writes through: http://host:port, or https://host:port to connect to the proxy over TLS, for an HTTP CONNECT proxy, or socks5://host:port for a SOCKS5 proxy.  A user to authenticate as may be given in the URL, but not a password; that is read from --metric_push_proxy_password_file.  Pushes over UDP or unix sockets are not proxied.")
+	pushProxyPasswordFile = flag.String("metric_push_proxy_password_file", "",
+		"File containing the password of the user in --metric_push_proxy.  If unset, it is taken from the MTAIL_METRIC_PUSH_PROXY_PASSWORD environment variable.  The file is reread when it changes.")
+	pushDialTimeout = flag.Duration("metric_push_dial_timeout", 0,
+		"Time to wait for the connection of a metric push, including any proxy handshake, to be made.  Defaults to --metric_push_write_deadline.")
+	pushKeepAlive = flag.Duration("metric_push_keepalive", 0,
+		"Interval between TCP keepalive probes on the connections of metric pushes.  Zero uses the system default, and a negative interval disables them.")
+)
+
+// A dialer makes the connections that metrics are pushed over.
+type dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// pushDialer returns the dialer of metric pushes set by the flags.
+func pushDialer() (dialer, error) {
+	timeout := *pushDialTimeout
+	if timeout == 0 {
+		timeout = *writeDeadline
+	}
+	return newDialer(*pushProxy, *pushProxyPasswordFile, timeout, *pushKeepAlive)
+}
+
+// NewTransport returns an HTTP transport that makes its connections in the
+// same way as metric pushes, through --metric_push_proxy if it is set, for
+// the other requests mtail makes to hosts outside.
+func NewTransport() (*http.Transport, error) {
+	d, err := pushDialer()
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = d.DialContext
+	if *pushProxy != "" {
+		// The connections are made through the proxy already.
+		t.Proxy = nil
+	}
+	return t, nil
+}
+
+// newDialer returns the dialer of metric pushes, which connects through the
+// proxy at proxyURL if it is not empty, authenticating with the password in
+// passwordFile or the environment.
+func newDialer(proxyURL, passwordFile string, timeout, keepAlive time.Duration) (dialer, error) {
+	d := &net.Dialer{Timeout: timeout, KeepAlive: keepAlive}
+	if proxyURL == "" {
+		return d, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing metric push proxy")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.Errorf("unknown metric push proxy scheme %q, expecting http, https or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf("metric push proxy %q has no host", proxyURL)
+	}
+	if _, ok := u.User.Password(); ok {
+		return nil, errors.New("metric push proxy password must be given in a file, not the URL")
+	}
+	password, err := secret.New("metric_push_proxy_password", passwordFile)
+	if err != nil {
+		return nil, err
+	}
+	if password != nil && u.User.Username() == "" {
+		return nil, errors.New("metric push proxy password needs a user in the proxy URL")
+	}
+	return &proxyDialer{forward: d, proxy: u, password: password}, nil
+}
+
+// proxyDialer makes TCP connections through an HTTP CONNECT or SOCKS5 proxy,
+// and other connections directly.
+type proxyDialer struct {
+	forward  *net.Dialer
+	proxy    *url.URL
+	password *secret.Secret // if set, the password of the proxy user
+}
+
+// DialContext connects to addr on the named network.
+func (p *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return p.forward.DialContext(ctx, network, addr)
+	}
+	host := p.proxy.Host
+	if p.proxy.Port() == "" {
+		host = net.JoinHostPort(p.proxy.Hostname(), defaultProxyPort[p.proxy.Scheme])
+	}
+	c, err := p.forward.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, errors.Wrap(err, "dialing metric push proxy")
+	}
+	// The handshake is bounded by the dial timeout and ctx too.
+	var deadline time.Time
+	if p.forward.Timeout > 0 {
+		deadline = time.Now().Add(p.forward.Timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	if err := c.SetDeadline(deadline); err != nil {
+		c.Close()
+		return nil, err
+	}
+	stop := interruptOnDone(ctx, c)
+	if p.proxy.Scheme == "https" {
+		c = tls.Client(c, &tls.Config{ServerName: p.proxy.Hostname()})
+	}
+	var password string
+	if p.password != nil {
+		password = p.password.Value()
+	}
+	if p.proxy.Scheme == "socks5" {
+		err = socks5Connect(c, addr, p.proxy.User.Username(), password)
+	} else {
+		c, err = httpConnect(c, addr, p.proxy.User, password)
+	}
+	stop()
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrapf(err, "connecting to %s through proxy %s", addr, p.proxy.Host)
+	}
+	if err := c.SetDeadline(time.Time{}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// interruptOnDone ends any read or write of c in progress when ctx is done,
+// by setting a deadline that has passed, until stop is called.
+func interruptOnDone(ctx context.Context, c net.Conn) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// defaultProxyPort is the port of a proxy URL without one, by scheme.
+var defaultProxyPort = map[string]string{"http": "80", "https": "443", "socks5": "1080"}
+
+// httpConnect asks the HTTP proxy connected to by c to connect to addr, and
+// returns the connection to addr.
+func httpConnect(c net.Conn, addr string, user *url.Userinfo, password string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(c); err != nil {
+		return c, err
+	}
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return c, errors.Wrap(err, "reading proxy response")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return c, errors.Errorf("proxy returned %s", resp.Status)
+	}
+	if r.Buffered() > 0 {
+		// The server at addr has already sent something, as a NATS server
+		// does on connecting.
+		return &bufferedConn{c, r}, nil
+	}
+	return c, nil
+}
+
+// bufferedConn is a connection whose first bytes have already been read into
+// a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// SOCKS5 protocol values, from RFC 1928 and RFC 1929.
+const (
+	socks5Version      = 0x05
+	socks5NoAuth       = 0x00
+	socks5UserPassword = 0x02
+	socks5CmdConnect   = 0x01
+	socks5IPv4         = 0x01
+	socks5Domain       = 0x03
+	socks5IPv6         = 0x04
+)
+
+// socks5Errors describes the reply codes of a failed SOCKS5 request.
+var socks5Errors = []string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5Connect asks the SOCKS5 proxy connected to by c to connect to addr,
+// authenticating as user if it is not empty.  Host names are resolved by the
+// proxy.
+func socks5Connect(c net.Conn, addr, user, password string) error {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return errors.Errorf("invalid port in %q", addr)
+	}
+
+	method := byte(socks5NoAuth)
+	if user != "" {
+		method = socks5UserPassword
+	}
+	if _, err := c.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(c, reply[:]); err != nil {
+		return errors.Wrap(err, "reading SOCKS5 method")
+	}
+	if reply[0] != socks5Version {
+		return errors.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	if reply[1] != method {
+		return errors.New("SOCKS5 proxy refused the authentication method")
+	}
+	if method == socks5UserPassword {
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 user or password longer than 255 bytes")
+		}
+		b := append([]byte{1, byte(len(user))}, user...)
+		b = append(append(b, byte(len(password))), password...)
+		if _, err := c.Write(b); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, reply[:]); err != nil {
+			return errors.Wrap(err, "reading SOCKS5 authentication status")
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS5 proxy rejected the user and password")
+		}
+	}
+
+	b := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, socks5IPv4), ip4...)
+		} else {
+			b = append(append(b, socks5IPv6), ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.Errorf("host name %q too long for SOCKS5", host)
+		}
+		b = append(append(b, socks5Domain, byte(len(host))), host...)
+	}
+	b = appendUint16(b, uint16(port))
+	if _, err := c.Write(b); err != nil {
+		return err
+	}
+	var head [4]byte
+	if _, err := io.ReadFull(c, head[:]); err != nil {
+		return errors.Wrap(err, "reading SOCKS5 reply")
+	}
+	if head[1] != 0 {
+		if int(head[1]) < len(socks5Errors) {
+			return errors.Errorf("SOCKS5 proxy: %s", socks5Errors[head[1]])
+		}
+		return errors.Errorf("SOCKS5 proxy failed with code %d", head[1])
+	}
+	// Skip the address the proxy connected from.
+	var n int
+	switch head[3] {
+	case socks5IPv4:
+		n = net.IPv4len
+	case socks5IPv6:
+		n = net.IPv6len
+	case socks5Domain:
+		var l [1]byte
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			return errors.Wrap(err, "reading SOCKS5 reply")
+		}
+		n = int(l[0])
+	default:
+		return errors.Errorf("unknown SOCKS5 address type %d", head[3])
+	}
+	if _, err := io.ReadFull(c, make([]byte, n+2)); err != nil {
+		return errors.Wrap(err, "reading SOCKS5 reply")
+	}
+	return nil
+}
@@ -6,6 +6,8 @@
 package exporter
 
 import (
+	"context"
+	"encoding/json"
 	"expvar"
 	"flag"
 	"fmt"
@@ -15,8 +17,11 @@ import (
 	"strings"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/health"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/pkg/errors"
 )
 
@@ -29,11 +34,16 @@ var (
 
 // Exporter manages the export of metrics to passive and active collectors.
 type Exporter struct {
+	health health.Activity // records each push, and kept first so it is 64-bit aligned
+
+	ctx           context.Context
 	store         *metrics.Store
 	hostname      string
 	omitProgLabel bool
 	emitTimestamp bool
 	pushTargets   []pushOptions
+	dialer        dialer      // Makes the connections of metric pushes.
+	clock         clock.Clock // Times the metric pushes.
 }
 
 // Option configures a new Exporter.
@@ -63,12 +73,21 @@ func EmitTimestamp() Option {
 	}
 }
 
-// New creates a new Exporter.
-func New(store *metrics.Store, options ...Option) (*Exporter, error) {
+// Clock sets the clock that metric pushes are timed by, instead of the system
+// clock.
+func Clock(c clock.Clock) Option {
+	return func(e *Exporter) error {
+		e.clock = c
+		return nil
+	}
+}
+
+// New creates a new Exporter.  Metric pushes stop when ctx is cancelled.
+func New(ctx context.Context, store *metrics.Store, options ...Option) (*Exporter, error) {
 	if store == nil {
 		return nil, errors.New("exporter needs a Store")
 	}
-	e := &Exporter{store: store}
+	e := &Exporter{ctx: ctx, store: store, clock: clock.Real}
 	if err := e.SetOption(options...); err != nil {
 		return nil, err
 	}
@@ -80,17 +99,46 @@ func New(store *metrics.Store, options ...Option) (*Exporter, error) {
 			return nil, errors.Wrap(err, "getting hostname")
 		}
 	}
+	var err error
+	e.dialer, err = pushDialer()
+	if err != nil {
+		return nil, err
+	}
 
 	if *collectdSocketPath != "" {
-		o := pushOptions{"unix", *collectdSocketPath, metricToCollectd, collectdExportTotal, collectdExportSuccess}
+		o := pushOptions{"unix", *collectdSocketPath, metricToCollectd, collectdExportTotal, collectdExportSuccess, nil}
+		e.RegisterPushExport(o)
+	}
+	if *collectdNetworkHostPort != "" {
+		s, err := newCollectdSecurity(*collectdSecurityLevel, *collectdUsername, *collectdPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		o := pushOptions{"udp", *collectdNetworkHostPort, collectdNetworkFormatter(s), collectdNetworkExportTotal, collectdNetworkExportSuccess, nil}
 		e.RegisterPushExport(o)
 	}
 	if *graphiteHostPort != "" {
-		o := pushOptions{"tcp", *graphiteHostPort, metricToGraphite, graphiteExportTotal, graphiteExportSuccess}
+		o := pushOptions{"tcp", *graphiteHostPort, metricToGraphite, graphiteExportTotal, graphiteExportSuccess, nil}
+		e.RegisterPushExport(o)
+	}
+	if *natsHostPort != "" {
+		session, err := natsSession(*natsUser, *natsPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		o := pushOptions{"tcp", *natsHostPort, metricToNATS, natsExportTotal, natsExportSuccess, session}
+		e.RegisterPushExport(o)
+	}
+	if *mqttHostPort != "" {
+		session, err := mqttSession(mqttClientID(e.hostname), *mqttUsername, *mqttPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		o := pushOptions{"tcp", *mqttHostPort, metricToMQTT, mqttExportTotal, mqttExportSuccess, session}
 		e.RegisterPushExport(o)
 	}
 	if *statsdHostPort != "" {
-		o := pushOptions{"udp", *statsdHostPort, metricToStatsd, statsdExportTotal, statsdExportSuccess}
+		o := pushOptions{"udp", *statsdHostPort, metricToStatsd, statsdExportTotal, statsdExportSuccess, nil}
 		e.RegisterPushExport(o)
 	}
 
@@ -125,15 +173,50 @@ func formatLabels(name string, m map[string]string, ksep, sep, rep string) strin
 	return r
 }
 
+// metricMessage is the JSON encoding of a LabelSet published as a message.
+type metricMessage struct {
+	Host    string            `json:"host"`
+	Program string            `json:"prog"`
+	Name    string            `json:"name"`
+	Kind    string            `json:"kind"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Value   interface{}       `json:"value"`
+	Time    time.Time         `json:"time"`
+}
+
+// jsonMessage encodes a LabelSet of the metric m as a metricMessage.
+func jsonMessage(hostname string, m *metrics.Metric, l *metrics.LabelSet) ([]byte, error) {
+	msg := metricMessage{
+		Host:    hostname,
+		Program: m.Program,
+		Name:    m.Name,
+		Kind:    strings.ToLower(m.Kind.String()),
+		Labels:  l.Labels,
+		Time:    l.Datum.TimeUTC().UTC(),
+	}
+	switch d := l.Datum.(type) {
+	case *datum.Int:
+		msg.Value = d.Get()
+	case *datum.Float:
+		msg.Value = d.Get()
+	case *datum.String:
+		msg.Value = d.Get()
+	case *datum.Sketch:
+		msg.Value = d.Estimate()
+	case *datum.Aggregate:
+		msg.Value, _ = d.Get()
+	default:
+		msg.Value = d
+	}
+	return json.Marshal(msg)
+}
+
 // Format a LabelSet into a string to be written to one of the timeseries
 // sockets.
 type formatter func(string, *metrics.Metric, *metrics.LabelSet) string
 
-func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *expvar.Int, exportSuccess *expvar.Int) error {
-	e.store.RLock()
-	defer e.store.RUnlock()
-
-	for _, ml := range e.store.Metrics {
+func (e *Exporter) writeSocketMetrics(store *metrics.Store, c io.Writer, f formatter, exportTotal *expvar.Int, exportSuccess *expvar.Int) error {
+	for _, ml := range store.Metrics {
 		for _, m := range ml {
 			m.RLock()
 			// Don't try to send text metrics to any push service.
@@ -145,9 +228,19 @@ func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *exp
 			lc := make(chan *metrics.LabelSet)
 			go m.EmitLabelSets(lc)
 			for l := range lc {
+				if a, ok := l.Datum.(*datum.Aggregate); ok {
+					if _, ok := a.Get(); !ok {
+						// Nothing was observed since the last push.
+						continue
+					}
+				}
 				line := f(e.hostname, m, l)
+				if line == "" {
+					// The formatter has nothing to send for this label set.
+					continue
+				}
 				n, err := fmt.Fprint(c, line)
-				glog.V(2).Infof("Sent %d bytes\n", n)
+				logging.V(2).Infof("Sent %d bytes\n", n)
 				if err == nil {
 					exportSuccess.Add(1)
 				} else {
@@ -160,39 +253,61 @@ func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *exp
 	return nil
 }
 
-// PushMetrics sends metrics to each of the configured services.
+// PushMetrics sends metrics to each of the configured services.  The same
+// snapshot is sent to each, and the Min, Max, and Avg metrics are reset after
+// it is taken.
 func (e *Exporter) PushMetrics() {
+	e.health.Start()
+	defer e.health.Done()
+	store := e.store.SnapshotAndReset()
 	for _, target := range e.pushTargets {
-		glog.V(2).Infof("pushing to %s", target.addr)
-		conn, err := net.DialTimeout(target.net, target.addr, *writeDeadline)
+		logging.V(2).Infof("pushing to %s", target.addr)
+		conn, err := e.dialer.DialContext(e.ctx, target.net, target.addr)
 		if err != nil {
-			glog.Infof("pusher dial error: %s", err)
+			e.health.Error()
+			logging.Infof("pusher dial error: %s", err)
 			continue
 		}
 		err = conn.SetDeadline(time.Now().Add(*writeDeadline))
 		if err != nil {
-			glog.Infof("Couldn't set deadline on connection: %s", err)
+			logging.Infof("Couldn't set deadline on connection: %s", err)
+		}
+		push := func() error {
+			return e.writeSocketMetrics(store, conn, target.f, target.total, target.success)
+		}
+		if target.session != nil {
+			err = target.session(conn, push)
+		} else {
+			err = push()
 		}
-		err = e.writeSocketMetrics(conn, target.f, target.total, target.success)
 		if err != nil {
-			glog.Infof("pusher write error: %s", err)
+			e.health.Error()
+			logging.Infof("pusher write error: %s", err)
 		}
 		err = conn.Close()
 		if err != nil {
 
-			glog.Infof("connection close failed: %s", err)
+			logging.Infof("connection close failed: %s", err)
 		}
 	}
 }
 
-// StartMetricPush pushes metrics to the configured services each interval.
+// StartMetricPush pushes metrics to the configured services each interval,
+// until the Exporter's context is cancelled.
 func (e *Exporter) StartMetricPush() {
 	if len(e.pushTargets) > 0 {
-		glog.Info("Started metric push.")
-		ticker := time.NewTicker(time.Duration(*pushInterval) * time.Second)
+		logging.Info("Started metric push.")
+		e.health.Done()
+		ticker := e.clock.NewTicker(time.Duration(*pushInterval) * time.Second)
 		go func() {
-			for range ticker.C {
-				e.PushMetrics()
+			defer ticker.Stop()
+			for {
+				select {
+				case <-e.ctx.Done():
+					return
+				case <-ticker.C():
+					e.PushMetrics()
+				}
 			}
 		}()
 	}
@@ -202,11 +317,27 @@ type pushOptions struct {
 	net, addr      string
 	f              formatter
 	total, success *expvar.Int
+	session        pushSession
 }
 
+// A pushSession runs push, which writes the metrics to the connection c, for
+// protocols that need a handshake before them or an acknowledgement after.
+type pushSession func(c net.Conn, push func() error) error
+
 // RegisterPushExport adds a push export connection to the Exporter.  Items in
 // the list must describe a Dial()able connection and will have all the metrics
 // pushed to each pushInterval.
 func (e *Exporter) RegisterPushExport(p pushOptions) {
 	e.pushTargets = append(e.pushTargets, p)
 }
+
+// Health reports when the Exporter last pushed metrics, and the push errors.
+// Failing pushes are not critical, as the metrics can still be collected.
+func (e *Exporter) Health() health.Status {
+	s := e.health.Status("exporter")
+	if len(e.pushTargets) > 0 {
+		s.Interval = time.Duration(*pushInterval) * time.Second
+	}
+	s.Message = fmt.Sprintf("%d push targets", len(e.pushTargets))
+	return s
+}
@@ -4,7 +4,10 @@
 package exporter
 
 import (
+	"context"
 	"errors"
+	"io/ioutil"
+	"net"
 	"reflect"
 	"sort"
 	"testing"
@@ -18,19 +21,19 @@ import (
 const prefix = "prefix"
 
 func TestCreateExporter(t *testing.T) {
-	_, err := New(nil)
+	_, err := New(context.Background(), nil)
 	if err == nil {
 		t.Error("expecting error, got nil")
 	}
 	store := metrics.NewStore()
-	_, err = New(store)
+	_, err = New(context.Background(), store)
 	if err != nil {
 		t.Errorf("unexpected error:%s", err)
 	}
 	failopt := func(*Exporter) error {
 		return errors.New("busted")
 	}
-	_, err = New(store, failopt)
+	_, err = New(context.Background(), store, failopt)
 	if err == nil {
 		t.Errorf("unexpected success")
 	}
@@ -169,3 +172,61 @@ func TestMetricToStatsd(t *testing.T) {
 		t.Errorf("prefixed string didn't match:\n\texpected: %v\n\treceived: %v", expected, r)
 	}
 }
+
+func TestJSONMessage(t *testing.T) {
+	ts := time.Date(2012, 7, 24, 10, 14, 0, 0, time.UTC)
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int, "l")
+	d, _ := m.GetDatum("quux")
+	datum.SetInt(d, 37, ts)
+	r := FakeSocketWrite(func(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+		b, err := jsonMessage(hostname, m, l)
+		testutil.FatalIfErr(t, err)
+		return string(b)
+	}, m)
+	expected := []string{`{"host":"gunstar","prog":"prog","name":"foo","kind":"counter","labels":{"l":"quux"},"value":37,"time":"2012-07-24T10:14:00Z"}`}
+	testutil.ExpectNoDiff(t, expected, r)
+}
+
+func TestPushResetsAggregates(t *testing.T) {
+	defer testutil.TestSetFlag(t, "statsd_prefix", "")()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.FatalIfErr(t, err)
+	defer l.Close()
+	received := make(chan string)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b, _ := ioutil.ReadAll(c)
+			c.Close()
+			received <- string(b)
+		}
+	}()
+
+	store := metrics.NewStore()
+	m := metrics.NewMetric("latency", "prog", metrics.Max, metrics.Aggregate)
+	testutil.FatalIfErr(t, store.Add(m))
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+	ts := time.Unix(37, 0)
+	datum.SetFloat(d, 3, ts)
+	datum.SetFloat(d, 7, ts)
+	datum.SetFloat(d, 5, ts)
+
+	e, err := New(context.Background(), store, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	e.RegisterPushExport(pushOptions{"tcp", l.Addr().String(), metricToStatsd, statsdExportTotal, statsdExportSuccess, nil})
+
+	e.PushMetrics()
+	testutil.ExpectNoDiff(t, "prog.latency:7|g", <-received)
+
+	// Nothing was observed since the last push, so nothing is sent.
+	e.PushMetrics()
+	testutil.ExpectNoDiff(t, "", <-received)
+
+	datum.SetFloat(d, 2, ts)
+	e.PushMetrics()
+	testutil.ExpectNoDiff(t, "prog.latency:2|g", <-received)
+}
@@ -8,25 +8,41 @@ import (
 	"expvar"
 	"net/http"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 )
 
 var (
 	exportJSONErrors = expvar.NewInt("exporter_json_errors")
 )
 
-// HandleJSON exports the metrics in JSON format via HTTP.
+// HandleJSON exports the metrics in JSON format via HTTP.  Query parameters
+// filter and aggregate the metrics, see query, and then the response is a list
+// of query results instead of the metrics.
 func (e *Exporter) HandleJSON(w http.ResponseWriter, r *http.Request) {
-	b, err := json.MarshalIndent(e.store, "", "  ")
+	q, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	store := e.store.Snapshot()
+	var v interface{} = store
+	if q != nil {
+		results := q.run(store)
+		if results == nil {
+			results = []*queryResult{}
+		}
+		v = results
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		exportJSONErrors.Add(1)
-		glog.Info("error marshalling metrics into json:", err.Error())
+		logging.Info("error marshalling metrics into json:", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("content-type", "application/json")
 	if _, err := w.Write(b); err != nil {
-		glog.Error(err)
+		logging.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
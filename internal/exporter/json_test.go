@@ -4,6 +4,7 @@
 package exporter
 
 import (
+	"context"
 	"io/ioutil"
 	"math"
 	"net/http"
@@ -139,7 +140,7 @@ func TestHandleJSON(t *testing.T) {
 			for _, metric := range tc.metrics {
 				testutil.FatalIfErr(t, ms.Add(metric))
 			}
-			e, err := New(ms, Hostname("gunstar"))
+			e, err := New(context.Background(), ms, Hostname("gunstar"))
 			testutil.FatalIfErr(t, err)
 			response := httptest.NewRecorder()
 			e.HandleJSON(response, &http.Request{})
@@ -0,0 +1,144 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"flag"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/secret"
+	"github.com/pkg/errors"
+)
+
+var (
+	mqttHostPort = flag.String("mqtt_host_port", "",
+		"Host:port of an MQTT broker to publish metrics to as JSON messages.")
+	mqttTopic = flag.String("mqtt_topic", "mtail",
+		"Topic prefix of the MQTT messages; each metric is published to <prefix>/<program>/<metric>.")
+	mqttClientIDFlag = flag.String("mqtt_client_id", "",
+		"Client identifier to connect to the MQTT broker with.  Defaults to mtail-<hostname>.")
+	mqttUsername = flag.String("mqtt_username", "",
+		"Username to connect to the MQTT broker as.")
+	mqttPasswordFile = flag.String("mqtt_password_file", "",
+		"File containing the password of --mqtt_username.  If unset, it is taken from the MTAIL_MQTT_PASSWORD environment variable.  The file is reread when it changes.")
+
+	mqttExportTotal   = expvar.NewInt("mqtt_export_total")
+	mqttExportSuccess = expvar.NewInt("mqtt_export_success")
+)
+
+// MQTT 3.1.1 control packet types, in the high nibble of the first byte.
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttDisconnect = 0xe0
+)
+
+// mqttTopicLevel replaces the characters that separate or match MQTT topic
+// levels, so that a program or metric name is always one level.
+var mqttTopicLevel = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// mqttClientID returns the client identifier given by --mqtt_client_id, or
+// one made from hostname.
+func mqttClientID(hostname string) string {
+	if *mqttClientIDFlag != "" {
+		return *mqttClientIDFlag
+	}
+	return "mtail-" + hostname
+}
+
+// appendMQTTLength appends the variable length encoding of n used for the
+// remaining length of an MQTT packet.
+func appendMQTTLength(b []byte, n int) []byte {
+	for {
+		c := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	return append(appendUint16(b, uint16(len(s))), s...)
+}
+
+// mqttPacket returns the MQTT control packet of typ with body.
+func mqttPacket(typ byte, body []byte) []byte {
+	return append(appendMQTTLength([]byte{typ}, len(body)), body...)
+}
+
+// metricToMQTT encodes a LabelSet as an MQTT PUBLISH of its JSON message, at
+// QoS 0 so no acknowledgement is expected.  The metric lock is held before
+// entering this function.
+func metricToMQTT(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+	b, err := jsonMessage(hostname, m, l)
+	if err != nil {
+		logging.Infof("MQTT message not sent: %s", err)
+		return ""
+	}
+	topic := *mqttTopic + "/" + mqttTopicLevel.Replace(m.Program) + "/" + mqttTopicLevel.Replace(m.Name)
+	return string(mqttPacket(mqttPublish, append(appendMQTTString(nil, topic), b...)))
+}
+
+// mqttSession returns a pushSession that connects to an MQTT broker as
+// clientID before the metrics are published, and disconnects after them.
+// The password is read from passwordFile, or the environment, each time it
+// connects.
+func mqttSession(clientID, username, passwordFile string) (pushSession, error) {
+	password, err := secret.New("mqtt_password", passwordFile)
+	if err != nil {
+		return nil, err
+	}
+	if password != nil && username == "" {
+		return nil, errors.New("MQTT password needs a username")
+	}
+	// Protocol name and level 4 for MQTT 3.1.1, and a clean session.
+	flags := byte(0x02)
+	if username != "" {
+		flags |= 0x80
+	}
+	if password != nil {
+		flags |= 0x40
+	}
+	return func(c net.Conn, push func() error) error {
+		body := appendMQTTString(nil, "MQTT")
+		body = append(body, 4, flags)
+		body = appendUint16(body, uint16(2**pushInterval))
+		body = appendMQTTString(body, clientID)
+		if username != "" {
+			body = appendMQTTString(body, username)
+		}
+		if password != nil {
+			body = appendMQTTString(body, password.Value())
+		}
+		if _, err := c.Write(mqttPacket(mqttConnect, body)); err != nil {
+			return err
+		}
+		var connack [4]byte
+		if _, err := io.ReadFull(c, connack[:]); err != nil {
+			return errors.Wrap(err, "reading MQTT CONNACK")
+		}
+		if connack[0] != mqttConnack || connack[1] != 2 {
+			return errors.Errorf("expecting CONNACK from MQTT broker, received %v", connack)
+		}
+		if connack[3] != 0 {
+			return errors.Errorf("MQTT broker refused connection, return code %d", connack[3])
+		}
+		if err := push(); err != nil {
+			return err
+		}
+		_, err := c.Write(mqttPacket(mqttDisconnect, nil))
+		return err
+	}, nil
+}
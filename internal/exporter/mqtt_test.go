@@ -0,0 +1,118 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestAppendMQTTLength(t *testing.T) {
+	for _, tc := range []struct {
+		n        int
+		expected []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	} {
+		testutil.ExpectNoDiff(t, tc.expected, appendMQTTLength(nil, tc.n))
+	}
+}
+
+func TestMetricToMQTT(t *testing.T) {
+	ts := time.Date(2012, 7, 24, 10, 14, 0, 0, time.UTC)
+	m := metrics.NewMetric("foo/bar", "prog", metrics.Counter, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 37, ts)
+	r := FakeSocketWrite(metricToMQTT, m)
+	if len(r) != 1 {
+		t.Fatalf("expected one packet, received %d", len(r))
+	}
+	topic := "mtail/prog/foo_bar"
+	msg := `{"host":"gunstar","prog":"prog","name":"foo/bar","kind":"counter","value":37,"time":"2012-07-24T10:14:00Z"}`
+	expected := append([]byte{mqttPublish, byte(2 + len(topic) + len(msg)), 0, byte(len(topic))}, topic+msg...)
+	testutil.ExpectNoDiff(t, expected, []byte(r[0]))
+}
+
+func TestMQTTSession(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	passwordFile := filepath.Join(tmpDir, "password")
+	testutil.FatalIfErr(t, ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600))
+
+	for _, tc := range []struct {
+		name       string
+		returnCode byte
+		wantErr    bool
+	}{
+		{"accepted", 0, false},
+		{"not authorized", 5, true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			session, err := mqttSession("mtail-gunstar", "mtail", passwordFile)
+			testutil.FatalIfErr(t, err)
+			client, server := net.Pipe()
+			defer client.Close()
+			publish := mqttPacket(mqttPublish, append(appendMQTTString(nil, "mtail/prog/foo"), "37"...))
+			received := make(chan []byte, 1)
+			go func() {
+				defer server.Close()
+				var b bytes.Buffer
+				connect := make([]byte, 2+10+2+len("mtail-gunstar")+2+len("mtail")+2+len("secret"))
+				if _, err := io.ReadFull(server, connect); err != nil {
+					received <- nil
+					return
+				}
+				b.Write(connect)
+				server.Write([]byte{mqttConnack, 2, 0, tc.returnCode})
+				rest, _ := ioutil.ReadAll(server)
+				b.Write(rest)
+				received <- b.Bytes()
+			}()
+			err = session(client, func() error {
+				_, err := client.Write(publish)
+				return err
+			})
+			if tc.wantErr != (err != nil) {
+				t.Errorf("session error %v, want error %v", err, tc.wantErr)
+			}
+			client.Close()
+
+			var expected []byte
+			expected = append(expected, mqttConnect, 10+2+13+2+5+2+6)
+			expected = append(expected, 0, 4)
+			expected = append(expected, "MQTT"...)
+			expected = append(expected, 4, 0xc2, 0, 120)
+			expected = append(expected, 0, 13)
+			expected = append(expected, "mtail-gunstar"...)
+			expected = append(expected, 0, 5)
+			expected = append(expected, "mtail"...)
+			expected = append(expected, 0, 6)
+			expected = append(expected, "secret"...)
+			if !tc.wantErr {
+				expected = append(expected, publish...)
+				expected = append(expected, mqttDisconnect, 0)
+			}
+			testutil.ExpectNoDiff(t, expected, <-received)
+		})
+	}
+
+	if _, err := mqttSession("mtail", "", passwordFile); err == nil || !strings.Contains(err.Error(), "username") {
+		t.Errorf("expected an error for a password without a username, received %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/secret"
+	"github.com/pkg/errors"
+)
+
+var (
+	natsHostPort = flag.String("nats_host_port", "",
+		"Host:port of a NATS server to publish metrics to as JSON messages.")
+	natsSubject = flag.String("nats_subject", "mtail",
+		"Subject prefix of the NATS messages; each metric is published to <prefix>.<program>.<metric>.")
+	natsUser = flag.String("nats_user", "",
+		"User to connect to the NATS server as.")
+	natsPasswordFile = flag.String("nats_password_file", "",
+		"File containing the password of --nats_user, or an authentication token if there is no user.  If unset, it is taken from the MTAIL_NATS_PASSWORD environment variable.  The file is reread when it changes.")
+
+	natsExportTotal   = expvar.NewInt("nats_export_total")
+	natsExportSuccess = expvar.NewInt("nats_export_success")
+)
+
+// natsToken replaces the characters that separate or match NATS subject
+// tokens, so that a program or metric name is always one token.
+var natsToken = strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_")
+
+// metricToNATS encodes a LabelSet as a NATS PUB of its JSON message.  The
+// metric lock is held before entering this function.
+func metricToNATS(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+	b, err := jsonMessage(hostname, m, l)
+	if err != nil {
+		logging.Infof("NATS message not sent: %s", err)
+		return ""
+	}
+	subject := *natsSubject + "." + natsToken.Replace(m.Program) + "." + natsToken.Replace(m.Name)
+	return fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(b), b)
+}
+
+// natsConnect is the CONNECT message of the NATS client protocol.
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// natsSession returns a pushSession that connects as user to a NATS server
+// before the metrics are published, then waits for the server to answer a
+// PING after them, so that any error from the server is reported.  The
+// password is read from passwordFile, or the environment, each time it
+// connects.
+func natsSession(user, passwordFile string) (pushSession, error) {
+	password, err := secret.New("nats_password", passwordFile)
+	if err != nil {
+		return nil, err
+	}
+	return func(c net.Conn, push func() error) error {
+		connect := natsConnect{Name: "mtail", Lang: "go", Version: "1.0.0", User: user}
+		if password != nil {
+			if user != "" {
+				connect.Pass = password.Value()
+			} else {
+				connect.AuthToken = password.Value()
+			}
+		}
+		msg, err := json.Marshal(connect)
+		if err != nil {
+			return err
+		}
+		r := bufio.NewReader(c)
+		info, err := r.ReadString('\n')
+		if err != nil {
+			return errors.Wrap(err, "reading NATS server INFO")
+		}
+		if !strings.HasPrefix(info, "INFO ") {
+			return errors.Errorf("expecting INFO from NATS server, received %q", strings.TrimSpace(info))
+		}
+		if _, err := fmt.Fprintf(c, "CONNECT %s\r\n", msg); err != nil {
+			return err
+		}
+		if err := push(); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprint(c, "PING\r\n"); err != nil {
+			return err
+		}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return errors.Wrap(err, "waiting for NATS PONG")
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case line == "PONG":
+				return nil
+			case line == "PING":
+				if _, err := fmt.Fprint(c, "PONG\r\n"); err != nil {
+					return err
+				}
+			case strings.HasPrefix(line, "-ERR"):
+				return errors.Errorf("NATS server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+			}
+		}
+	}, nil
+}
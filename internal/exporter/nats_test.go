@@ -0,0 +1,88 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestMetricToNATS(t *testing.T) {
+	ts := time.Date(2012, 7, 24, 10, 14, 0, 0, time.UTC)
+	m := metrics.NewMetric("foo.bar", "prog.mtail", metrics.Gauge, metrics.Float)
+	d, _ := m.GetDatum()
+	datum.SetFloat(d, 1.5, ts)
+	msg := `{"host":"gunstar","prog":"prog.mtail","name":"foo.bar","kind":"gauge","value":1.5,"time":"2012-07-24T10:14:00Z"}`
+	expected := []string{fmt.Sprintf("PUB mtail.prog_mtail.foo_bar %d\r\n%s\r\n", len(msg), msg)}
+	testutil.ExpectNoDiff(t, expected, FakeSocketWrite(metricToNATS, m))
+}
+
+func TestNATSSession(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		reply   string
+		wantErr bool
+	}{
+		{"pong", "PONG\r\n", false},
+		{"ping then pong", "PING\r\nPONG\r\n", false},
+		{"error", "-ERR 'Authorization Violation'\r\n", true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			session, err := natsSession("", "")
+			testutil.FatalIfErr(t, err)
+			client, server := net.Pipe()
+			defer client.Close()
+			received := make(chan []string, 1)
+			go func() {
+				defer server.Close()
+				fmt.Fprint(server, "INFO {\"server_id\":\"test\"}\r\n")
+				r := bufio.NewReader(server)
+				var lines []string
+				readLine := func() bool {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return false
+					}
+					lines = append(lines, strings.TrimSpace(line))
+					return true
+				}
+				for readLine() && lines[len(lines)-1] != "PING" {
+				}
+				fmt.Fprint(server, tc.reply)
+				if strings.HasPrefix(tc.reply, "PING") {
+					// Expect the client to answer the server's PING.
+					readLine()
+				}
+				received <- lines
+			}()
+			err = session(client, func() error {
+				_, err := fmt.Fprint(client, "PUB mtail.prog.foo 2\r\n37\r\n")
+				return err
+			})
+			if tc.wantErr != (err != nil) {
+				t.Errorf("session error %v, want error %v", err, tc.wantErr)
+			}
+			lines := <-received
+			expected := []string{
+				`CONNECT {"verbose":false,"pedantic":false,"name":"mtail","lang":"go","version":"1.0.0"}`,
+				"PUB mtail.prog.foo 2",
+				"37",
+				"PING",
+			}
+			if strings.HasPrefix(tc.reply, "PING") {
+				expected = append(expected, "PONG")
+			}
+			testutil.ExpectNoDiff(t, expected, lines)
+		})
+	}
+}
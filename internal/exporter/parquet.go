@@ -0,0 +1,358 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+)
+
+// The Parquet file written by WriteParquet has one row per metric and label
+// set, in a flat schema of required columns, so that it can be read by any
+// Parquet reader:
+//
+//   prog      string   the program that exports the metric
+//   name      string   the metric name; histograms have name_bucket,
+//                      name_sum and name_count rows, as in Prometheus
+//   kind      string   counter, gauge, timer or histogram
+//   labels    json     an object of the label names and values
+//   value     double
+//   timestamp int64    milliseconds since the epoch, UTC
+//
+// The file has one row group of uncompressed, plainly encoded pages, as is
+// described in https://github.com/apache/parquet-format.
+
+// Parquet physical types, converted types and other enumerations.
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+	parquetJSON            = 19
+
+	parquetRequired = 0
+	parquetPlain    = 0
+	parquetRLE      = 3
+	parquetDataPage = 0
+)
+
+const parquetMagic = "PAR1"
+
+type parquetColumn struct {
+	name          string
+	typ           int32
+	convertedType int32
+	values        int64
+	data          []byte // plainly encoded values
+}
+
+func (c *parquetColumn) appendString(s string) {
+	var a [4]byte
+	binary.LittleEndian.PutUint32(a[:], uint32(len(s)))
+	c.data = append(append(c.data, a[:]...), s...)
+	c.values++
+}
+
+func (c *parquetColumn) appendUint64(v uint64) {
+	var a [8]byte
+	binary.LittleEndian.PutUint64(a[:], v)
+	c.data = append(c.data, a[:]...)
+	c.values++
+}
+
+// parquetTable holds the columns of the metrics as they are added.
+type parquetTable struct {
+	prog, name, kind, labels, value, timestamp parquetColumn
+	rows                                       int64
+}
+
+func newParquetTable() *parquetTable {
+	return &parquetTable{
+		prog:      parquetColumn{name: "prog", typ: parquetByteArray, convertedType: parquetUTF8},
+		name:      parquetColumn{name: "name", typ: parquetByteArray, convertedType: parquetUTF8},
+		kind:      parquetColumn{name: "kind", typ: parquetByteArray, convertedType: parquetUTF8},
+		labels:    parquetColumn{name: "labels", typ: parquetByteArray, convertedType: parquetJSON},
+		value:     parquetColumn{name: "value", typ: parquetDouble, convertedType: -1},
+		timestamp: parquetColumn{name: "timestamp", typ: parquetInt64, convertedType: parquetTimestampMillis},
+	}
+}
+
+func (t *parquetTable) columns() []*parquetColumn {
+	return []*parquetColumn{&t.prog, &t.name, &t.kind, &t.labels, &t.value, &t.timestamp}
+}
+
+func (t *parquetTable) addRow(m *metrics.Metric, name string, labels map[string]string, v float64, ms int64) error {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	b, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+	t.prog.appendString(m.Program)
+	t.name.appendString(name)
+	t.kind.appendString(strings.ToLower(m.Kind.String()))
+	t.labels.appendString(string(b))
+	t.value.appendUint64(math.Float64bits(v))
+	t.timestamp.appendUint64(uint64(ms))
+	t.rows++
+	return nil
+}
+
+func (t *parquetTable) addLabelSet(m *metrics.Metric, l *metrics.LabelSet) error {
+	ms := l.Datum.TimeUTC().UnixNano() / 1e6
+	switch d := l.Datum.(type) {
+	case *datum.Int:
+		return t.addRow(m, m.Name, l.Labels, float64(d.Get()), ms)
+	case *datum.Float:
+		return t.addRow(m, m.Name, l.Labels, d.Get(), ms)
+	case *datum.Sketch:
+		return t.addRow(m, m.Name, l.Labels, float64(d.Estimate()), ms)
+	case *datum.Aggregate:
+		if v, ok := d.Get(); ok {
+			return t.addRow(m, m.Name, l.Labels, v, ms)
+		}
+		return nil
+	case *datum.Buckets:
+		buckets := datum.GetBucketsCumByMax(d)
+		maxes := make([]float64, 0, len(buckets))
+		for max := range buckets {
+			maxes = append(maxes, max)
+		}
+		sort.Float64s(maxes)
+		for _, max := range maxes {
+			labels := make(map[string]string, len(l.Labels)+1)
+			for k, v := range l.Labels {
+				labels[k] = v
+			}
+			labels["le"] = fmt.Sprint(max)
+			if math.IsInf(max, 1) {
+				labels["le"] = "+Inf"
+			}
+			if err := t.addRow(m, m.Name+"_bucket", labels, float64(buckets[max]), ms); err != nil {
+				return err
+			}
+		}
+		if err := t.addRow(m, m.Name+"_sum", l.Labels, datum.GetBucketsSum(d), ms); err != nil {
+			return err
+		}
+		return t.addRow(m, m.Name+"_count", l.Labels, float64(datum.GetBucketsCount(d)), ms)
+	}
+	// Text metrics have no value to analyse.
+	return nil
+}
+
+// WriteParquet writes the metrics in the store to w as a Parquet file.
+func (e *Exporter) WriteParquet(w io.Writer) error {
+	t := newParquetTable()
+	store := e.store.Snapshot()
+	for _, ml := range store.Metrics {
+		for _, m := range ml {
+			m.RLock()
+			lc := make(chan *metrics.LabelSet)
+			go m.EmitLabelSets(lc)
+			var err error
+			for l := range lc {
+				if err == nil {
+					err = t.addLabelSet(m, l)
+				}
+			}
+			m.RUnlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err := w.Write(t.encode())
+	return err
+}
+
+// encode returns the Parquet file of the table.
+func (t *parquetTable) encode() []byte {
+	b := []byte(parquetMagic)
+
+	var chunks thriftList
+	var total int64
+	for _, c := range t.columns() {
+		offset := int64(len(b))
+		var header thriftStruct
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(c.data)))
+		header.i32(3, int32(len(c.data)))
+		var dataPage thriftStruct
+		dataPage.i32(1, int32(c.values))
+		dataPage.i32(2, parquetPlain)
+		dataPage.i32(3, parquetRLE)
+		dataPage.i32(4, parquetRLE)
+		header.structure(5, &dataPage)
+		b = append(b, header.bytes()...)
+		b = append(b, c.data...)
+		size := int64(len(b)) - offset
+		total += size
+
+		var encodings, path thriftList
+		encodings.i32(parquetPlain)
+		path.binary(c.name)
+		var meta thriftStruct
+		meta.i32(1, c.typ)
+		meta.list(2, thriftTypeI32, &encodings)
+		meta.list(3, thriftTypeBinary, &path)
+		meta.i32(4, 0) // UNCOMPRESSED
+		meta.i64(5, c.values)
+		meta.i64(6, size)
+		meta.i64(7, size)
+		meta.i64(9, offset)
+		var chunk thriftStruct
+		chunk.i64(2, offset)
+		chunk.structure(3, &meta)
+		chunks.structure(&chunk)
+	}
+
+	var schema thriftList
+	var root thriftStruct
+	root.binary(4, "mtail")
+	root.i32(5, int32(len(t.columns())))
+	schema.structure(&root)
+	for _, c := range t.columns() {
+		var s thriftStruct
+		s.i32(1, c.typ)
+		s.i32(3, parquetRequired)
+		s.binary(4, c.name)
+		if c.convertedType >= 0 {
+			s.i32(6, c.convertedType)
+		}
+		schema.structure(&s)
+	}
+
+	var rowGroups thriftList
+	if t.rows > 0 {
+		var rowGroup thriftStruct
+		rowGroup.list(1, thriftTypeStruct, &chunks)
+		rowGroup.i64(2, total)
+		rowGroup.i64(3, t.rows)
+		rowGroups.structure(&rowGroup)
+	}
+
+	var footer thriftStruct
+	footer.i32(1, 1)
+	footer.list(2, thriftTypeStruct, &schema)
+	footer.i64(3, t.rows)
+	footer.list(4, thriftTypeStruct, &rowGroups)
+	footer.binary(6, "mtail")
+	f := footer.bytes()
+	b = append(b, f...)
+	var a [4]byte
+	binary.LittleEndian.PutUint32(a[:], uint32(len(f)))
+	b = append(b, a[:]...)
+	return append(b, parquetMagic...)
+}
+
+// Types of the Thrift compact protocol, in which the Parquet metadata is
+// encoded.
+const (
+	thriftTypeI32    = 5
+	thriftTypeI64    = 6
+	thriftTypeBinary = 8
+	thriftTypeList   = 9
+	thriftTypeStruct = 12
+)
+
+// thriftStruct encodes the fields of a struct in the Thrift compact protocol.
+// Fields must be added in increasing order of their ids.
+type thriftStruct struct {
+	b    []byte
+	last int16
+}
+
+func (s *thriftStruct) field(id int16, typ byte) {
+	if delta := id - s.last; delta > 0 && delta <= 15 {
+		s.b = append(s.b, byte(delta)<<4|typ)
+	} else {
+		s.b = append(s.b, typ)
+		s.b = appendVarint(s.b, int64(id))
+	}
+	s.last = id
+}
+
+func (s *thriftStruct) i32(id int16, v int32) {
+	s.field(id, thriftTypeI32)
+	s.b = appendVarint(s.b, int64(v))
+}
+
+func (s *thriftStruct) i64(id int16, v int64) {
+	s.field(id, thriftTypeI64)
+	s.b = appendVarint(s.b, v)
+}
+
+func (s *thriftStruct) binary(id int16, v string) {
+	s.field(id, thriftTypeBinary)
+	s.b = appendThriftBinary(s.b, v)
+}
+
+func (s *thriftStruct) structure(id int16, v *thriftStruct) {
+	s.field(id, thriftTypeStruct)
+	s.b = append(s.b, v.bytes()...)
+}
+
+func (s *thriftStruct) list(id int16, elem byte, v *thriftList) {
+	s.field(id, thriftTypeList)
+	if v.n < 15 {
+		s.b = append(s.b, byte(v.n)<<4|elem)
+	} else {
+		s.b = append(s.b, 0xf0|elem)
+		s.b = appendUvarint(s.b, uint64(v.n))
+	}
+	s.b = append(s.b, v.b...)
+}
+
+// bytes returns the encoded struct, with its stop field.
+func (s *thriftStruct) bytes() []byte {
+	return append(s.b[:len(s.b):len(s.b)], 0)
+}
+
+// thriftList encodes the elements of a list in the Thrift compact protocol.
+type thriftList struct {
+	b []byte
+	n int
+}
+
+func (l *thriftList) i32(v int32) {
+	l.b = appendVarint(l.b, int64(v))
+	l.n++
+}
+
+func (l *thriftList) binary(v string) {
+	l.b = appendThriftBinary(l.b, v)
+	l.n++
+}
+
+func (l *thriftList) structure(v *thriftStruct) {
+	l.b = append(l.b, v.bytes()...)
+	l.n++
+}
+
+// appendVarint appends the zigzag varint encoding of v.
+func appendVarint(b []byte, v int64) []byte {
+	var a [binary.MaxVarintLen64]byte
+	return append(b, a[:binary.PutVarint(a[:], v)]...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var a [binary.MaxVarintLen64]byte
+	return append(b, a[:binary.PutUvarint(a[:], v)]...)
+}
+
+func appendThriftBinary(b []byte, v string) []byte {
+	return append(appendUvarint(b, uint64(len(v))), v...)
+}
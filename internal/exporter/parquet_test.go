@@ -0,0 +1,173 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// thriftReader decodes the Thrift compact protocol into maps of field id to
+// value, enough to check the Parquet metadata.
+type thriftReader struct {
+	t *testing.T
+	b []byte
+}
+
+func (r *thriftReader) byte() byte {
+	if len(r.b) == 0 {
+		r.t.Fatal("unexpected end of thrift data")
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.t.Fatalf("bad varint in %v", r.b)
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.t.Fatalf("bad varint in %v", r.b)
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftTypeI32, thriftTypeI64:
+		return r.varint()
+	case thriftTypeBinary:
+		n := r.uvarint()
+		s := string(r.b[:n])
+		r.b = r.b[n:]
+		return s
+	case thriftTypeList:
+		h := r.byte()
+		n := uint64(h >> 4)
+		if n == 15 {
+			n = r.uvarint()
+		}
+		l := []interface{}{}
+		for i := uint64(0); i < n; i++ {
+			l = append(l, r.value(h&0x0f))
+		}
+		return l
+	case thriftTypeStruct:
+		s := map[int16]interface{}{}
+		var id int16
+		for {
+			h := r.byte()
+			if h == 0 {
+				return s
+			}
+			if h>>4 == 0 {
+				id = int16(r.varint())
+			} else {
+				id += int16(h >> 4)
+			}
+			s[id] = r.value(h & 0x0f)
+		}
+	}
+	r.t.Fatalf("unexpected thrift type %d", typ)
+	return nil
+}
+
+func TestWriteParquet(t *testing.T) {
+	ts := time.Date(2012, 7, 24, 10, 14, 0, 0, time.UTC)
+	store := metrics.NewStore()
+	counter := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int, "l")
+	d, _ := counter.GetDatum("quux")
+	datum.SetInt(d, 37, ts)
+	testutil.FatalIfErr(t, store.Add(counter))
+	histogram := metrics.NewMetric("bar", "prog", metrics.Histogram, metrics.Buckets)
+	histogram.Buckets = []datum.Range{{0, 1}, {1, math.Inf(1)}}
+	d, _ = histogram.GetDatum()
+	d.(*datum.Buckets).Observe(0.5, ts)
+	d.(*datum.Buckets).Observe(2, ts)
+	testutil.FatalIfErr(t, store.Add(histogram))
+	text := metrics.NewMetric("baz", "prog", metrics.Text, metrics.String)
+	testutil.FatalIfErr(t, store.Add(text))
+
+	e, err := New(context.Background(), store, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	var buf bytes.Buffer
+	testutil.FatalIfErr(t, e.WriteParquet(&buf))
+	b := buf.Bytes()
+
+	if !bytes.HasPrefix(b, []byte("PAR1")) || !bytes.HasSuffix(b, []byte("PAR1")) {
+		t.Fatalf("missing Parquet magic in %q", b)
+	}
+	n := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	r := &thriftReader{t, b[len(b)-8-n : len(b)-8]}
+	footer := r.value(thriftTypeStruct).(map[int16]interface{})
+	if len(r.b) != 0 {
+		t.Errorf("%d bytes left after footer", len(r.b))
+	}
+
+	var names []string
+	for _, s := range footer[2].([]interface{}) {
+		names = append(names, s.(map[int16]interface{})[4].(string))
+	}
+	testutil.ExpectNoDiff(t, []string{"mtail", "prog", "name", "kind", "labels", "value", "timestamp"}, names)
+	// One row for the counter, and one for each bucket, the sum and the count.
+	testutil.ExpectNoDiff(t, int64(5), footer[3])
+
+	columns := map[string][]interface{}{}
+	rowGroup := footer[4].([]interface{})[0].(map[int16]interface{})
+	for _, c := range rowGroup[1].([]interface{}) {
+		meta := c.(map[int16]interface{})[3].(map[int16]interface{})
+		name := meta[3].([]interface{})[0].(string)
+		r := &thriftReader{t, b[meta[9].(int64):]}
+		header := r.value(thriftTypeStruct).(map[int16]interface{})
+		page := r.b[:header[3].(int64)]
+		for len(page) > 0 {
+			switch meta[1].(int64) {
+			case parquetByteArray:
+				n := binary.LittleEndian.Uint32(page)
+				columns[name] = append(columns[name], string(page[4:4+n]))
+				page = page[4+n:]
+			case parquetDouble:
+				columns[name] = append(columns[name], math.Float64frombits(binary.LittleEndian.Uint64(page)))
+				page = page[8:]
+			case parquetInt64:
+				columns[name] = append(columns[name], int64(binary.LittleEndian.Uint64(page)))
+				page = page[8:]
+			}
+		}
+	}
+
+	// Sort the rows as the store's map order is random.
+	rows := map[string][]interface{}{}
+	for i := range columns["name"] {
+		rows[columns["name"][i].(string)+columns["labels"][i].(string)] = []interface{}{
+			columns["prog"][i], columns["kind"][i], columns["value"][i], columns["timestamp"][i],
+		}
+	}
+	ms := ts.UnixNano() / 1e6
+	expected := map[string][]interface{}{
+		`foo{"l":"quux"}`:         {"prog", "counter", 37.0, ms},
+		`bar_bucket{"le":"1"}`:    {"prog", "histogram", 1.0, ms},
+		`bar_bucket{"le":"+Inf"}`: {"prog", "histogram", 2.0, ms},
+		`bar_sum{}`:               {"prog", "histogram", 2.5, ms},
+		`bar_count{}`:             {"prog", "histogram", 2.0, ms},
+	}
+	testutil.ExpectNoDiff(t, expected, rows)
+}
@@ -8,7 +8,7 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
 
@@ -30,11 +30,12 @@ func (e *Exporter) Describe(c chan<- *prometheus.Desc) {
 
 // Collect implements the prometheus.Collector interface.
 func (e *Exporter) Collect(c chan<- prometheus.Metric) {
-	e.store.RLock()
-	defer e.store.RUnlock()
-
-	for _, ml := range e.store.Metrics {
+	store := e.store.Snapshot()
+	for _, ml := range store.Metrics {
 		lastSource := ""
+		// Distinct metrics with the same labels are merged, as when the prog
+		// label is omitted, and exported after the rest.
+		var distincts []*distinctSet
 		for _, m := range ml {
 			m.RLock()
 			// We don't have a way of converting text metrics to prometheus format.
@@ -60,6 +61,15 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 					keys = append(keys, k)
 					vals = append(vals, v)
 				}
+				if a, ok := ls.Datum.(*datum.Aggregate); ok {
+					if _, ok := a.Get(); !ok {
+						continue
+					}
+				}
+				if m.Kind == metrics.Distinct {
+					distincts = mergeDistinct(distincts, m, keys, vals, ls.Datum)
+					continue
+				}
 				var pM prometheus.Metric
 				var err error
 				if m.Kind == metrics.Histogram {
@@ -79,7 +89,7 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 						vals...)
 				}
 				if err != nil {
-					glog.Warning(err)
+					logging.Warning(err)
 					continue
 				}
 				// By default no timestamp is emitted to Prometheus. Setting a
@@ -87,7 +97,7 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 				// if the timestamp is not updated or moved fowarded enough to avoid
 				// triggering Promtheus staleness handling.
 				// Read more in docs/faq.md
-				if e.emitTimestamp {
+				if e.exportTimestamp(m) {
 					c <- prometheus.NewMetricWithTimestamp(ls.Datum.TimeUTC(), pM)
 				} else {
 					c <- pM
@@ -95,7 +105,69 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 			}
 			m.RUnlock()
 		}
+		for _, d := range distincts {
+			pM, err := prometheus.NewConstMetric(
+				prometheus.NewDesc(noHyphens(d.m.Name),
+					fmt.Sprintf("defined at %s", lastSource), d.keys, nil),
+				prometheus.GaugeValue,
+				float64(d.sketch.Estimate()),
+				d.vals...)
+			if err != nil {
+				logging.Warning(err)
+				continue
+			}
+			if e.exportTimestamp(d.m) {
+				c <- prometheus.NewMetricWithTimestamp(d.sketch.TimeUTC(), pM)
+			} else {
+				c <- pM
+			}
+		}
+	}
+}
+
+// distinctSet is the merged sketch of the label sets of distinct metrics that
+// are exported with the same labels.
+type distinctSet struct {
+	m          *metrics.Metric
+	keys, vals []string
+	sketch     *datum.Sketch
+}
+
+// mergeDistinct merges the sketch d of a label set of m, exported with keys
+// and vals, into the set in sets with the same labels, or adds a new one.
+func mergeDistinct(sets []*distinctSet, m *metrics.Metric, keys, vals []string, d datum.Datum) []*distinctSet {
+	labels := make(map[string]string, len(keys))
+	for i, k := range keys {
+		labels[k] = vals[i]
+	}
+Loop:
+	for _, s := range sets {
+		if len(s.keys) != len(keys) {
+			continue
+		}
+		for i, k := range s.keys {
+			if v, ok := labels[k]; !ok || v != s.vals[i] {
+				continue Loop
+			}
+		}
+		s.sketch.Merge(datum.GetSketch(d))
+		return sets
+	}
+	sketch := datum.GetSketch(datum.NewSketch(0))
+	sketch.Merge(datum.GetSketch(d))
+	return append(sets, &distinctSet{m, keys, vals, sketch})
+}
+
+// exportTimestamp reports whether m is exported with its timestamp, as chosen
+// in its declaration or else by the emitTimestamp option.
+func (e *Exporter) exportTimestamp(m *metrics.Metric) bool {
+	switch m.Timestamp {
+	case metrics.EmitTimestamp:
+		return true
+	case metrics.OmitTimestamp:
+		return false
 	}
+	return e.emitTimestamp
 }
 
 func promTypeForKind(k metrics.Kind) prometheus.ValueType {
@@ -104,7 +176,7 @@ func promTypeForKind(k metrics.Kind) prometheus.ValueType {
 		return prometheus.CounterValue
 	case metrics.Gauge:
 		return prometheus.GaugeValue
-	case metrics.Timer:
+	case metrics.Timer, metrics.TopK, metrics.Distinct, metrics.Min, metrics.Max, metrics.Avg:
 		return prometheus.GaugeValue
 	}
 	return prometheus.UntypedValue
@@ -116,6 +188,11 @@ func promValueForDatum(d datum.Datum) float64 {
 		return float64(n.Get())
 	case *datum.Float:
 		return n.Get()
+	case *datum.Sketch:
+		return float64(n.Estimate())
+	case *datum.Aggregate:
+		v, _ := n.Get()
+		return v
 	}
 	return 0.
 }
@@ -4,6 +4,7 @@
 package exporter
 
 import (
+	"context"
 	"math"
 	"strings"
 	"testing"
@@ -15,6 +16,15 @@ import (
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 )
 
+// sketchOf returns a distinct count datum of values.
+func sketchOf(values ...string) datum.Datum {
+	d := datum.NewSketch(0)
+	for _, v := range values {
+		datum.SetString(d, v, time.Unix(0, 0))
+	}
+	return d
+}
+
 var handlePrometheusTests = []struct {
 	name      string
 	progLabel bool
@@ -221,6 +231,63 @@ foo_bucket{a="bar",prog="test",le="2"} 2
 foo_bucket{a="bar",prog="test",le="+Inf"} 4
 foo_sum{a="bar",prog="test"} 5
 foo_count{a="bar",prog="test"} 4
+`,
+	},
+	{"distinct",
+		true,
+		[]*metrics.Metric{
+			{
+				Name:        "users",
+				Program:     "a",
+				Kind:        metrics.Distinct,
+				Type:        metrics.Sketch,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: sketchOf("alice", "bob")}},
+				Source:      "a.mtail:1",
+			},
+			{
+				Name:        "users",
+				Program:     "b",
+				Kind:        metrics.Distinct,
+				Type:        metrics.Sketch,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: sketchOf("bob", "carol")}},
+				Source:      "b.mtail:1",
+			},
+		},
+		`# HELP users defined at a.mtail:1
+# TYPE users gauge
+users{prog="a"} 2
+users{prog="b"} 2
+`,
+	},
+	{"distinct merged without prog label",
+		false,
+		[]*metrics.Metric{
+			{
+				Name:        "users",
+				Program:     "a",
+				Kind:        metrics.Distinct,
+				Type:        metrics.Sketch,
+				Keys:        []string{"country"},
+				LabelValues: []*metrics.LabelValue{{Labels: []string{"au"}, Value: sketchOf("alice", "bob")}},
+				Source:      "a.mtail:1",
+			},
+			{
+				Name:    "users",
+				Program: "b",
+				Kind:    metrics.Distinct,
+				Type:    metrics.Sketch,
+				Keys:    []string{"country"},
+				LabelValues: []*metrics.LabelValue{
+					{Labels: []string{"au"}, Value: sketchOf("bob", "carol")},
+					{Labels: []string{"nz"}, Value: sketchOf("dave")},
+				},
+				Source: "b.mtail:1",
+			},
+		},
+		`# HELP users defined at a.mtail:1
+# TYPE users gauge
+users{country="au"} 3
+users{country="nz"} 1
 `,
 	},
 }
@@ -239,7 +306,7 @@ func TestHandlePrometheus(t *testing.T) {
 			if !tc.progLabel {
 				opts = append(opts, OmitProgLabel())
 			}
-			e, err := New(ms, opts...)
+			e, err := New(context.Background(), ms, opts...)
 			testutil.FatalIfErr(t, err)
 			r := strings.NewReader(tc.expected)
 			if err = promtest.CollectAndCompare(e, r); err != nil {
@@ -248,3 +315,29 @@ func TestHandlePrometheus(t *testing.T) {
 		})
 	}
 }
+
+func TestExportTimestamp(t *testing.T) {
+	for _, tc := range []struct {
+		emitTimestamp bool
+		timestamp     metrics.TimestampExport
+		expected      bool
+	}{
+		{false, metrics.DefaultTimestamp, false},
+		{true, metrics.DefaultTimestamp, true},
+		{false, metrics.EmitTimestamp, true},
+		{true, metrics.EmitTimestamp, true},
+		{false, metrics.OmitTimestamp, false},
+		{true, metrics.OmitTimestamp, false},
+	} {
+		var opts []Option
+		if tc.emitTimestamp {
+			opts = append(opts, EmitTimestamp())
+		}
+		e, err := New(context.Background(), metrics.NewStore(), opts...)
+		testutil.FatalIfErr(t, err)
+		m := &metrics.Metric{Name: "foo", Timestamp: tc.timestamp}
+		if got := e.exportTimestamp(m); got != tc.expected {
+			t.Errorf("emitTimestamp %v, timestamp %v: exported %v, expected %v", tc.emitTimestamp, tc.timestamp, got, tc.expected)
+		}
+	}
+}
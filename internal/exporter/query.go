@@ -0,0 +1,330 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+// A query selects and aggregates the values in the metric store, for the
+// varz and JSON handlers.  It is built from the request parameters:
+//
+//	name=errors           only metrics with this name; may be repeated
+//	match=vhost=~^www\.   only values whose labels match; may be repeated, and
+//	                      the operators are =, !=, =~ and !~
+//	by=vhost,code         sum the values of each metric grouped by these labels
+//	agg=avg               aggregate with avg instead of sum, over all labels if no by
+//	topk=10               only the ten largest values
+//
+// The prog label matches the program that created the metric.
+type query struct {
+	names    map[string]struct{}
+	matchers []labelMatcher
+	by       []string
+	agg      string // "", "sum" or "avg"
+	topk     int
+}
+
+// labelMatcher matches the value of the label named key.
+type labelMatcher struct {
+	key   string
+	value string
+	re    *regexp.Regexp // for the regular expression operators
+	not   bool
+}
+
+func (lm labelMatcher) matches(labels map[string]string) bool {
+	v := labels[lm.key]
+	var ok bool
+	if lm.re != nil {
+		ok = lm.re.MatchString(v)
+	} else {
+		ok = v == lm.value
+	}
+	return ok != lm.not
+}
+
+// parseLabelMatcher parses a matcher of the form key op value.
+func parseLabelMatcher(s string) (labelMatcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i < 1 || i == len(s)-1 {
+		return labelMatcher{}, errors.Errorf("invalid label matcher %q", s)
+	}
+	lm := labelMatcher{key: s[:i]}
+	rest := s[i:]
+	var op string
+	for _, o := range []string{"=~", "!~", "!=", "="} {
+		if strings.HasPrefix(rest, o) {
+			op = o
+			break
+		}
+	}
+	if op == "" {
+		return labelMatcher{}, errors.Errorf("invalid label matcher %q", s)
+	}
+	lm.value = rest[len(op):]
+	lm.not = op[0] == '!'
+	if strings.HasSuffix(op, "~") {
+		// Anchor the expression like Prometheus does.
+		re, err := regexp.Compile("^(?:" + lm.value + ")$")
+		if err != nil {
+			return labelMatcher{}, errors.Wrapf(err, "invalid label matcher %q", s)
+		}
+		lm.re = re
+	}
+	return lm, nil
+}
+
+// parseQuery builds a query from the request parameters.  It returns nil if
+// the request has no query parameters, so the handler can export everything as
+// before.
+func parseQuery(r *http.Request) (*query, error) {
+	if r.URL == nil {
+		return nil, nil
+	}
+	v := r.URL.Query()
+	q := &query{}
+	seen := false
+	for _, n := range v["name"] {
+		if q.names == nil {
+			q.names = make(map[string]struct{})
+		}
+		q.names[n] = struct{}{}
+		seen = true
+	}
+	for _, m := range v["match"] {
+		lm, err := parseLabelMatcher(m)
+		if err != nil {
+			return nil, err
+		}
+		q.matchers = append(q.matchers, lm)
+		seen = true
+	}
+	if by, ok := v["by"]; ok {
+		for _, b := range by {
+			for _, l := range strings.Split(b, ",") {
+				if l != "" {
+					q.by = append(q.by, l)
+				}
+			}
+		}
+		q.agg = "sum"
+		seen = true
+	}
+	if agg := v.Get("agg"); agg != "" {
+		if agg != "sum" && agg != "avg" {
+			return nil, errors.Errorf("invalid aggregation %q, expecting sum or avg", agg)
+		}
+		q.agg = agg
+		seen = true
+	}
+	if topk := v.Get("topk"); topk != "" {
+		n, err := strconv.Atoi(topk)
+		if err != nil || n < 1 {
+			return nil, errors.Errorf("invalid topk %q, expecting a positive number", topk)
+		}
+		q.topk = n
+		seen = true
+	}
+	if !seen {
+		return nil, nil
+	}
+	return q, nil
+}
+
+// queryResult is one value selected by a query.
+type queryResult struct {
+	Name    string            `json:"name"`
+	Program string            `json:"program"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Value   interface{}       `json:"value"` // The original datum's value, or a float64 if aggregated.
+
+	v       float64 // The value as a number, for sorting
+	str     string  // The value as formatted for varz
+	numeric bool
+	count   int // The number of values aggregated
+}
+
+// numericValue returns the value of d as a float64, and false if d is not a
+// number.
+func numericValue(d datum.Datum) (float64, bool) {
+	switch d := d.(type) {
+	case *datum.Int:
+		return float64(datum.GetInt(d)), true
+	case *datum.Float:
+		return datum.GetFloat(d), true
+	case *datum.Sketch:
+		return float64(d.Estimate()), true
+	case *datum.Aggregate:
+		return d.Get()
+	default:
+		return 0, false
+	}
+}
+
+// datumValue returns the value of d for the JSON output.
+func datumValue(d datum.Datum) interface{} {
+	switch d := d.(type) {
+	case *datum.Int:
+		return datum.GetInt(d)
+	case *datum.Float:
+		return datum.GetFloat(d)
+	case *datum.Sketch:
+		return d.Estimate()
+	case *datum.Aggregate:
+		v, _ := d.Get()
+		return v
+	default:
+		return d.ValueString()
+	}
+}
+
+// run evaluates the query against the store.  Values that can't be
+// aggregated or ranked, like strings and histograms, are left out of
+// aggregations and top-N selections.
+func (q *query) run(store *metrics.Store) []*queryResult {
+	store.RLock()
+	defer store.RUnlock()
+	var results []*queryResult
+	groups := make(map[string]*queryResult)
+	for _, ml := range store.Metrics {
+		for _, m := range ml {
+			if q.names != nil {
+				if _, ok := q.names[m.Name]; !ok {
+					continue
+				}
+			}
+			m.RLock()
+			lc := make(chan *metrics.LabelSet)
+			go m.EmitLabelSets(lc)
+			for ls := range lc {
+				if !q.matches(m, ls.Labels) {
+					continue
+				}
+				v, numeric := numericValue(ls.Datum)
+				if q.agg == "" {
+					if q.topk > 0 && !numeric {
+						continue
+					}
+					results = append(results, &queryResult{Name: m.Name, Program: m.Program, Labels: ls.Labels, Value: datumValue(ls.Datum), v: v, str: ls.Datum.ValueString(), numeric: numeric})
+					continue
+				}
+				if !numeric {
+					continue
+				}
+				labels := make(map[string]string, len(q.by))
+				key := []string{m.Name, m.Program}
+				for _, b := range q.by {
+					if l, ok := ls.Labels[b]; ok {
+						labels[b] = l
+					}
+					key = append(key, ls.Labels[b])
+				}
+				k := strings.Join(key, "\x00")
+				g, ok := groups[k]
+				if !ok {
+					g = &queryResult{Name: m.Name, Program: m.Program, Labels: labels, numeric: true}
+					groups[k] = g
+					results = append(results, g)
+				}
+				g.v += v
+				g.count++
+			}
+			m.RUnlock()
+		}
+	}
+	if q.agg != "" {
+		for _, g := range results {
+			if q.agg == "avg" {
+				g.v /= float64(g.count)
+			}
+			g.Value = g.v
+			g.str = strconv.FormatFloat(g.v, 'g', -1, 64)
+		}
+	}
+	if q.topk > 0 {
+		sort.SliceStable(results, func(i, j int) bool { return results[i].v > results[j].v })
+		if len(results) > q.topk {
+			results = results[:q.topk]
+		}
+	} else {
+		sort.SliceStable(results, func(i, j int) bool { return results[i].less(results[j]) })
+	}
+	return results
+}
+
+// queryResultToVarz formats a query result like metricToVarz.
+func queryResultToVarz(r *queryResult, omitProgLabel bool, hostname string) string {
+	s := make([]string, 0, len(r.Labels)+2)
+	for k, v := range r.Labels {
+		s = append(s, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(s)
+	if !omitProgLabel {
+		s = append(s, fmt.Sprintf("prog=%s", r.Program))
+	}
+	s = append(s, fmt.Sprintf("instance=%s", hostname))
+	return fmt.Sprintf(varzFormat, r.Name, strings.Join(s, ","), r.str)
+}
+
+// selects reports whether the query selects the value of m with these labels,
+// by both its name and its labels.
+func (q *query) selects(m *metrics.Metric, labels map[string]string) bool {
+	if q.names != nil {
+		if _, ok := q.names[m.Name]; !ok {
+			return false
+		}
+	}
+	return q.matches(m, labels)
+}
+
+func (q *query) matches(m *metrics.Metric, labels map[string]string) bool {
+	if len(q.matchers) == 0 {
+		return true
+	}
+	if _, ok := labels["prog"]; !ok {
+		withProg := make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			withProg[k] = v
+		}
+		withProg["prog"] = m.Program
+		labels = withProg
+	}
+	for _, lm := range q.matchers {
+		if !lm.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// less orders results by name, program, then labels, for stable output.
+func (r *queryResult) less(o *queryResult) bool {
+	if r.Name != o.Name {
+		return r.Name < o.Name
+	}
+	if r.Program != o.Program {
+		return r.Program < o.Program
+	}
+	return labelString(r.Labels) < labelString(o.Labels)
+}
+
+// labelString formats labels as sorted key=value pairs.
+func labelString(labels map[string]string) string {
+	s := make([]string, 0, len(labels))
+	for k, v := range labels {
+		s = append(s, k+"="+v)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
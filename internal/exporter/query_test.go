@@ -0,0 +1,163 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func queryTestStore(t *testing.T) *metrics.Store {
+	t.Helper()
+	ts := time.Unix(1397586900, 0)
+	ms := metrics.NewStore()
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:    "errors",
+		Program: "web",
+		Kind:    metrics.Counter,
+		Keys:    []string{"vhost", "code"},
+		LabelValues: []*metrics.LabelValue{
+			{Labels: []string{"a", "500"}, Value: datum.MakeInt(3, ts)},
+			{Labels: []string{"a", "503"}, Value: datum.MakeInt(4, ts)},
+			{Labels: []string{"b", "500"}, Value: datum.MakeInt(10, ts)},
+			{Labels: []string{"c", "404"}, Value: datum.MakeInt(1, ts)},
+		},
+	}))
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:        "version",
+		Program:     "web",
+		Kind:        metrics.Text,
+		LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeString("1.0", ts)}},
+	}))
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:        "errors",
+		Program:     "mail",
+		Kind:        metrics.Counter,
+		LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(2, ts)}},
+	}))
+	return ms
+}
+
+var handleVarzQueryTests = []struct {
+	name     string
+	query    string
+	expected string
+}{
+	{"name",
+		"name=version",
+		`version{prog=web,instance=gunstar} 1.0
+`,
+	},
+	{"match",
+		"match=vhost=a",
+		`errors{code=500,vhost=a,prog=web,instance=gunstar} 3
+errors{code=503,vhost=a,prog=web,instance=gunstar} 4
+`,
+	},
+	{"match regexp",
+		"match=code=~5..&match=vhost!=a",
+		`errors{code=500,vhost=b,prog=web,instance=gunstar} 10
+`,
+	},
+	{"match prog",
+		"name=errors&match=prog=mail",
+		`errors{prog=mail,instance=gunstar} 2
+`,
+	},
+	{"sum by",
+		"match=prog=web&by=vhost",
+		`errors{vhost=a,prog=web,instance=gunstar} 7
+errors{vhost=b,prog=web,instance=gunstar} 10
+errors{vhost=c,prog=web,instance=gunstar} 1
+`,
+	},
+	{"avg",
+		"name=errors&match=prog=web&agg=avg",
+		`errors{prog=web,instance=gunstar} 4.5
+`,
+	},
+	{"topk by",
+		"name=errors&by=vhost&topk=2",
+		`errors{vhost=b,prog=web,instance=gunstar} 10
+errors{vhost=a,prog=web,instance=gunstar} 7
+`,
+	},
+	{"topk skips text",
+		"topk=1",
+		`errors{code=500,vhost=b,prog=web,instance=gunstar} 10
+`,
+	},
+}
+
+func TestHandleVarzQuery(t *testing.T) {
+	for _, tc := range handleVarzQueryTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := New(context.Background(), queryTestStore(t), Hostname("gunstar"))
+			testutil.FatalIfErr(t, err)
+			u, err := url.Parse("/varz?" + tc.query)
+			testutil.FatalIfErr(t, err)
+			response := httptest.NewRecorder()
+			e.HandleVarz(response, &http.Request{URL: u})
+			if response.Code != 200 {
+				t.Errorf("response code not 200: %d", response.Code)
+			}
+			b, err := ioutil.ReadAll(response.Body)
+			testutil.FatalIfErr(t, err)
+			testutil.ExpectNoDiff(t, tc.expected, string(b))
+		})
+	}
+}
+
+func TestHandleJSONQuery(t *testing.T) {
+	e, err := New(context.Background(), queryTestStore(t), Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	u, err := url.Parse("/json?name=errors&by=vhost&topk=1")
+	testutil.FatalIfErr(t, err)
+	response := httptest.NewRecorder()
+	e.HandleJSON(response, &http.Request{URL: u})
+	if response.Code != 200 {
+		t.Errorf("response code not 200: %d", response.Code)
+	}
+	var got []map[string]interface{}
+	testutil.FatalIfErr(t, json.Unmarshal(response.Body.Bytes(), &got))
+	expected := []map[string]interface{}{
+		{"name": "errors", "program": "web", "labels": map[string]interface{}{"vhost": "b"}, "value": 10.0},
+	}
+	testutil.ExpectNoDiff(t, expected, got)
+}
+
+func TestHandleQueryErrors(t *testing.T) {
+	for _, q := range []string{
+		"match=vhost",
+		"match==a",
+		"match=vhost=~(",
+		"agg=max",
+		"topk=0",
+		"topk=ten",
+	} {
+		q := q
+		t.Run(q, func(t *testing.T) {
+			e, err := New(context.Background(), queryTestStore(t), Hostname("gunstar"))
+			testutil.FatalIfErr(t, err)
+			u, err := url.Parse("/varz?" + q)
+			testutil.FatalIfErr(t, err)
+			response := httptest.NewRecorder()
+			e.HandleVarz(response, &http.Request{URL: u})
+			if response.Code != http.StatusBadRequest {
+				t.Errorf("response code not 400: %d", response.Code)
+			}
+		})
+	}
+}
@@ -28,7 +28,7 @@ func metricToStatsd(hostname string, m *metrics.Metric, l *metrics.LabelSet) str
 	switch m.Kind {
 	case metrics.Counter:
 		t = "c" // StatsD Counter
-	case metrics.Gauge:
+	case metrics.Gauge, metrics.TopK, metrics.Distinct, metrics.Min, metrics.Max, metrics.Avg:
 		t = "g" // StatsD Gauge
 	case metrics.Timer:
 		t = "ms" // StatsD Timer
@@ -0,0 +1,222 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/vm"
+)
+
+var (
+	// streamClients counts the clients connected to the stream.
+	streamClients = expvar.NewInt("stream_clients")
+	// streamEventsDropped counts the events dropped because a client's queue
+	// was full.
+	streamEventsDropped = expvar.NewInt("stream_events_dropped_total")
+)
+
+const (
+	streamQueueLength       = 256              // The events queued for each client.
+	streamKeepaliveInterval = 15 * time.Second // How often an idle stream is sent a comment.
+	streamLastValues        = 10000            // The label sets whose last values are kept, those changed least recently being forgotten.
+)
+
+// StreamEvent is a change to one label set of a metric, as sent to clients
+// of the stream.
+type StreamEvent struct {
+	Program string            `json:"program"`
+	Name    string            `json:"name"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Old     interface{}       `json:"old,omitempty"` // Not set if the label set has not changed since the first client connected, or not for long.
+	New     interface{}       `json:"new"`
+	Time    time.Time         `json:"time"`
+}
+
+// bucketsValue is the value streamed of a histogram.
+type bucketsValue struct {
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+}
+
+// Stream sends the changes programs make to their metrics to HTTP clients as
+// they happen, as Server-Sent Events.  Each client selects the changes it is
+// sent with the name and match parameters of the varz and JSON handlers.  A
+// client too slow to read its events loses those that do not fit in its
+// queue, rather than holding up the programs.
+type Stream struct {
+	clients int32 // The number of clients connected, read without the lock.
+
+	mu      sync.Mutex
+	queues  map[*streamClient]struct{}
+	last    *lru.Cache // The last values sent, by program, metric name and label values.
+	closed  bool
+	closing chan struct{} // Closed to disconnect the clients.
+}
+
+// streamClient is the queue and selection of one connected client.
+type streamClient struct {
+	q      *query // nil to select every change.
+	events chan StreamEvent
+}
+
+// NewStream returns a Stream with no clients connected.
+func NewStream() *Stream {
+	return &Stream{
+		queues:  make(map[*streamClient]struct{}),
+		last:    lru.New(streamLastValues),
+		closing: make(chan struct{}),
+	}
+}
+
+// Update sends the change u to the clients that have selected it.  It is
+// called by the programs with each change to their metrics, set with
+// vm.OnUpdate.
+func (s *Stream) Update(u vm.Update) {
+	if atomic.LoadInt32(&s.clients) == 0 || u.Metric.Hidden {
+		return
+	}
+	e := StreamEvent{
+		Program: u.Program,
+		Name:    u.Metric.Name,
+		Labels:  make(map[string]string, len(u.Labels)),
+		New:     streamValue(u.Datum),
+		Time:    u.Datum.TimeUTC(),
+	}
+	for i, k := range u.Metric.Keys {
+		if i < len(u.Labels) {
+			e.Labels[k] = u.Labels[i]
+		}
+	}
+	id := u.Program + "\x00" + u.Metric.Name + "\x00" + strings.Join(u.Labels, "\x00")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.Old, _ = s.last.Get(id)
+	s.last.Add(id, e.New)
+	for c := range s.queues {
+		if c.q != nil && !c.q.selects(u.Metric, e.Labels) {
+			continue
+		}
+		select {
+		case c.events <- e:
+		default:
+			streamEventsDropped.Add(1)
+		}
+	}
+}
+
+// Close disconnects the clients, and refuses new ones.
+func (s *Stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.closing)
+	}
+}
+
+func (s *Stream) add(c *streamClient) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.queues[c] = struct{}{}
+	atomic.AddInt32(&s.clients, 1)
+	streamClients.Add(1)
+	return true
+}
+
+func (s *Stream) remove(c *streamClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.queues, c)
+	atomic.AddInt32(&s.clients, -1)
+	streamClients.Add(-1)
+	// The last values are only needed while there is someone to send them to.
+	if len(s.queues) == 0 {
+		s.last.Clear()
+	}
+}
+
+// ServeHTTP streams the changes selected by the request parameters, until the
+// client disconnects or the Stream is closed.
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported by this connection", http.StatusInternalServerError)
+		return
+	}
+	q, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q != nil && (q.agg != "" || q.topk > 0) {
+		http.Error(w, "changes can only be selected with name and match", http.StatusBadRequest)
+		return
+	}
+	c := &streamClient{q: q, events: make(chan StreamEvent, streamQueueLength)}
+	if !s.add(c) {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.remove(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprint(w, ": mtail metric updates\n\n"); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		case e := <-c.events:
+			b, err := json.Marshal(e)
+			if err != nil {
+				logging.Warningf("Failed to marshal stream event for %s: %s", e.Name, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: update\ndata: %s\n\n", b); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		// Send what has been written now, unless more events are already
+		// waiting to be written with it.
+		if len(c.events) == 0 {
+			flusher.Flush()
+		}
+	}
+}
+
+// streamValue returns the value of d as it is sent to clients of the stream.
+func streamValue(d datum.Datum) interface{} {
+	if b, ok := d.(*datum.Buckets); ok {
+		return bucketsValue{Count: b.GetCount(), Sum: b.GetSum()}
+	}
+	return datumValue(d)
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/vm"
+)
+
+// nextEvent returns the next event read from the stream r.
+func nextEvent(t *testing.T, r *bufio.Reader) map[string]interface{} {
+	t.Helper()
+	var kind string
+	for {
+		line, err := r.ReadString('\n')
+		testutil.FatalIfErr(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			kind = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if kind != "update" {
+				t.Fatalf("event %q, expected update", kind)
+			}
+			var e map[string]interface{}
+			testutil.FatalIfErr(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e))
+			return e
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	h := NewStream()
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "?name=requests&name=bytes&match=code=200")
+	testutil.FatalIfErr(t, err)
+	defer resp.Body.Close()
+	testutil.ExpectNoDiff(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	for atomic.LoadInt32(&h.clients) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	requests := metrics.NewMetric("requests", "web", metrics.Counter, metrics.Int, "code")
+	other := metrics.NewMetric("other", "web", metrics.Counter, metrics.Int, "code")
+	hidden := metrics.NewMetric("requests", "web", metrics.Counter, metrics.Int, "code")
+	hidden.Hidden = true
+	ts := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	update := func(m *metrics.Metric, code string, v int64) {
+		d, err := m.GetDatum(code)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, v, ts)
+		h.Update(vm.Update{Program: "web", Metric: m, Labels: []string{code}, Datum: d})
+	}
+	update(other, "200", 1)
+	update(hidden, "200", 1)
+	update(requests, "500", 1)
+	update(requests, "200", 1)
+	update(requests, "200", 2)
+
+	r := bufio.NewReader(resp.Body)
+	expected := map[string]interface{}{
+		"program": "web",
+		"name":    "requests",
+		"labels":  map[string]interface{}{"code": "200"},
+		"new":     1.0,
+		"time":    "2020-01-01T00:00:00Z",
+	}
+	testutil.ExpectNoDiff(t, expected, nextEvent(t, r))
+	expected["old"] = 1.0
+	expected["new"] = 2.0
+	testutil.ExpectNoDiff(t, expected, nextEvent(t, r))
+
+	// The last values of the label sets changed least recently are
+	// forgotten.
+	for i := 0; i < streamLastValues; i++ {
+		update(other, strconv.Itoa(i), 1)
+	}
+	testutil.ExpectNoDiff(t, streamLastValues, h.last.Len())
+	update(requests, "200", 3)
+	delete(expected, "old")
+	expected["new"] = 3.0
+	testutil.ExpectNoDiff(t, expected, nextEvent(t, r))
+
+	// Closing the hub ends the stream.
+	h.Close()
+	rest, err := ioutil.ReadAll(r)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "\n", string(rest))
+}
+
+func TestStreamSelection(t *testing.T) {
+	m := metrics.NewMetric("requests", "web", metrics.Counter, metrics.Int, "code", "method")
+	labels := map[string]string{"code": "200", "method": "GET"}
+	for _, tc := range []struct {
+		query    string
+		expected bool
+	}{
+		{"name=requests", true},
+		{"name=bytes", false},
+		{"name=bytes&name=requests", true},
+		{"match=prog=web", true},
+		{"match=prog=db", false},
+		{"match=code=~2..", true},
+		{"match=code=200&match=method!=GET", false},
+		{"match=host=a", false},
+	} {
+		q, err := parseQuery(httptest.NewRequest("GET", "/stream?"+tc.query, nil))
+		testutil.FatalIfErr(t, err)
+		if got := q.selects(m, labels); got != tc.expected {
+			t.Errorf("%q: selected %v, expected %v", tc.query, got, tc.expected)
+		}
+	}
+}
+
+func TestStreamRejectsAggregation(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewStream().ServeHTTP(w, httptest.NewRequest("GET", "/stream?by=code", nil))
+	testutil.ExpectNoDiff(t, http.StatusBadRequest, w.Code)
+}
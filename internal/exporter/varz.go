@@ -20,13 +20,26 @@ var (
 const varzFormat = "%s{%s} %s\n"
 
 // HandleVarz exports the metrics in Varz format via HTTP.
+// Query parameters filter and aggregate the metrics, see query.
 func (e *Exporter) HandleVarz(w http.ResponseWriter, r *http.Request) {
-	e.store.RLock()
-	defer e.store.RUnlock()
+	q, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	store := e.store.Snapshot()
+	if q != nil {
+		w.Header().Add("Content-type", "text/plain")
+		for _, result := range q.run(store) {
+			exportVarzTotal.Add(1)
+			fmt.Fprint(w, queryResultToVarz(result, e.omitProgLabel, e.hostname))
+		}
+		return
+	}
 
 	w.Header().Add("Content-type", "text/plain")
 
-	for _, ml := range e.store.Metrics {
+	for _, ml := range store.Metrics {
 		for _, m := range ml {
 			select {
 			case <-r.Context().Done():
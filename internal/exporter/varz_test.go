@@ -4,6 +4,7 @@
 package exporter
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -71,7 +72,7 @@ func TestHandleVarz(t *testing.T) {
 			for _, metric := range tc.metrics {
 				testutil.FatalIfErr(t, ms.Add(metric))
 			}
-			e, err := New(ms, Hostname("gunstar"))
+			e, err := New(context.Background(), ms, Hostname("gunstar"))
 			testutil.FatalIfErr(t, err)
 			response := httptest.NewRecorder()
 			e.HandleVarz(response, &http.Request{})
@@ -0,0 +1,169 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package geoip looks up the country and autonomous system of IP addresses in
+// MaxMind DB files, like the GeoLite2 databases, for the geoip_country() and
+// geoip_asn() builtins.
+package geoip
+
+import (
+	"context"
+	"expvar"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/logging"
+	"github.com/pkg/errors"
+)
+
+var (
+	// dbReloads counts the database files reread after they changed.
+	dbReloads = expvar.NewInt("geoip_database_reloads_total")
+	// dbReloadErrors counts the changed database files that couldn't be read.
+	dbReloadErrors = expvar.NewInt("geoip_database_reload_errors_total")
+)
+
+// DB is a MaxMind DB file, reread when it changes.
+type DB struct {
+	path  string
+	clock clock.Clock // Times the rereads of the file, or nil for the system clock.
+
+	mu      sync.RWMutex
+	r       *Reader   // The contents of the file when last read.
+	modTime time.Time // The modification time of the file when last read.
+	size    int64     // The size of the file when last read.
+}
+
+// Open reads the MaxMind DB file at path.
+func Open(path string) (*DB, error) {
+	db := &DB{path: path}
+	if _, err := db.reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// reload rereads the file if its size or modification time has changed since
+// it was last read, returning whether it did.
+func (db *DB) reload() (bool, error) {
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		return false, err
+	}
+	db.mu.RLock()
+	unchanged := db.r != nil && fi.ModTime().Equal(db.modTime) && fi.Size() == db.size
+	db.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	buf, err := ioutil.ReadFile(db.path)
+	if err != nil {
+		return false, err
+	}
+	r, err := NewReader(buf)
+	if err != nil {
+		return false, errors.Wrap(err, db.path)
+	}
+	db.mu.Lock()
+	db.r, db.modTime, db.size = r, fi.ModTime(), fi.Size()
+	db.mu.Unlock()
+	return true, nil
+}
+
+// SetClock sets the clock that Run rereads the file by, instead of the system
+// clock.  It must be set before Run starts.
+func (db *DB) SetClock(c clock.Clock) {
+	db.clock = c
+}
+
+// Run rereads the file every interval if it has changed, until ctx is done.
+// If the changed file can't be read, the last one read stays in use.
+func (db *DB) Run(ctx context.Context, interval time.Duration) {
+	c := db.clock
+	if c == nil {
+		c = clock.Real
+	}
+	t := c.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C():
+			changed, err := db.reload()
+			if err != nil {
+				dbReloadErrors.Add(1)
+				logging.Warningf("Failed to reload GeoIP database: %s", err)
+				continue
+			}
+			if changed {
+				dbReloads.Add(1)
+				logging.Infof("Reloaded GeoIP database %s", db.path)
+			}
+		}
+	}
+}
+
+// Lookup returns the record for the network containing ip, as Reader.Lookup
+// does.
+func (db *DB) Lookup(ip net.IP) (interface{}, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.r.Lookup(ip)
+}
+
+// Locator looks up the IP addresses given to the geoip builtins.
+type Locator interface {
+	// Country returns the ISO 3166 code of the country of ip, or "" if it is
+	// unknown.
+	Country(ip net.IP) (string, error)
+	// ASN returns the number of the autonomous system that ip is in, or 0 if
+	// it is unknown.
+	ASN(ip net.IP) (int64, error)
+}
+
+// Databases is a Locator using a GeoIP2 or GeoLite2 Country database and an
+// ASN database.  Either may be nil, making its lookups errors.
+type Databases struct {
+	CountryDB *DB
+	ASNDB     *DB
+}
+
+// Country looks up ip in the country database.  If the country an address is
+// used in is unknown, the country it is registered to is returned.
+func (d Databases) Country(ip net.IP) (string, error) {
+	if d.CountryDB == nil {
+		return "", errors.New("no GeoIP country database")
+	}
+	v, err := d.CountryDB.Lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	record, _ := v.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := record[key].(map[string]interface{}); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return code, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// ASN looks up ip in the ASN database.
+func (d Databases) ASN(ip net.IP) (int64, error) {
+	if d.ASNDB == nil {
+		return 0, errors.New("no GeoIP ASN database")
+	}
+	v, err := d.ASNDB.Lookup(ip)
+	if err != nil {
+		return 0, err
+	}
+	record, _ := v.(map[string]interface{})
+	n, _ := record["autonomous_system_number"].(uint64)
+	return int64(n), nil
+}
@@ -0,0 +1,386 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package geoip
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// encode returns v in the MaxMind DB data section format.
+func encode(v interface{}) []byte {
+	var typ int
+	var size int
+	var body []byte
+	switch v := v.(type) {
+	case string:
+		typ, size, body = typeString, len(v), []byte(v)
+	case uint16:
+		body = trimZeroes(uint64(v))
+		typ, size = typeUint16, len(body)
+	case uint32:
+		body = trimZeroes(uint64(v))
+		typ, size = typeUint32, len(body)
+	case uint64:
+		body = trimZeroes(v)
+		typ, size = typeUint64, len(body)
+	case float64:
+		body = make([]byte, 8)
+		binary.BigEndian.PutUint64(body, math.Float64bits(v))
+		typ, size = typeDouble, 8
+	case bool:
+		typ = typeBool
+		if v {
+			size = 1
+		}
+	case []interface{}:
+		typ, size = typeArray, len(v)
+		for _, e := range v {
+			body = append(body, encode(e)...)
+		}
+	case map[string]interface{}:
+		typ, size = typeMap, len(v)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			body = append(body, encode(k)...)
+			body = append(body, encode(v[k])...)
+		}
+	default:
+		panic(v)
+	}
+	var b []byte
+	ctrl := byte(typ << 5)
+	if typ > 7 {
+		ctrl = 0
+	}
+	switch {
+	case size < 29:
+		b = []byte{ctrl | byte(size)}
+	case size < 285:
+		b = []byte{ctrl | 29, byte(size - 29)}
+	case size < 65821:
+		b = []byte{ctrl | 30, byte((size - 285) >> 8), byte(size - 285)}
+	default:
+		s := size - 65821
+		b = []byte{ctrl | 31, byte(s >> 16), byte(s >> 8), byte(s)}
+	}
+	if typ > 7 {
+		// The extended type comes between the control byte and the size.
+		b = append([]byte{b[0], byte(typ - 7)}, b[1:]...)
+	}
+	return append(b, body...)
+}
+
+func trimZeroes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+// buildDB returns a MaxMind DB file of the given IP version and record size,
+// holding the records of the networks, which mustn't overlap.
+func buildDB(t *testing.T, ipVersion, recordSize int, networks map[string]map[string]interface{}) []byte {
+	t.Helper()
+	// A record is 0 if empty, the index of a node if positive, and the
+	// offset of a data field plus one if negative.
+	nodes := [][2]int{{}}
+	var data []byte
+	cidrs := make([]string, 0, len(networks))
+	for c := range networks {
+		cidrs = append(cidrs, c)
+	}
+	sort.Strings(cidrs)
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		testutil.FatalIfErr(t, err)
+		ones, _ := n.Mask.Size()
+		ip := n.IP.To4()
+		if ipVersion == 6 {
+			if ip != nil {
+				ip = append(make(net.IP, 12), ip...)
+				ones += 96
+			} else {
+				ip = n.IP.To16()
+			}
+		}
+		off := len(data)
+		data = append(data, encode(networks[c])...)
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -(off + 1)
+				break
+			}
+			if nodes[node][bit] <= 0 {
+				nodes = append(nodes, [2]int{})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+	count := len(nodes)
+	value := func(r int) uint32 {
+		switch {
+		case r == 0:
+			return uint32(count)
+		case r > 0:
+			return uint32(r)
+		default:
+			return uint32(count + 16 - r - 1)
+		}
+	}
+	var buf []byte
+	for _, n := range nodes {
+		l, r := value(n[0]), value(n[1])
+		switch recordSize {
+		case 24:
+			buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(l>>24)<<4|byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			buf = append(buf, byte(l>>24), byte(l>>16), byte(l>>8), byte(l), byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, metadataMarker...)
+	return append(buf, encode(map[string]interface{}{
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(recordSize),
+		"ip_version":                  uint16(ipVersion),
+		"database_type":               "Test",
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+	})...)
+}
+
+func country(code string) map[string]interface{} {
+	return map[string]interface{}{"country": map[string]interface{}{"iso_code": code}}
+}
+
+func TestLookup(t *testing.T) {
+	networks := map[int]map[string]map[string]interface{}{
+		4: {
+			"192.0.2.0/24": country("NZ"),
+		},
+		6: {
+			"192.0.2.0/24": country("NZ"),
+			"198.51.100.0/25": {
+				"registered_country": map[string]interface{}{"iso_code": "AU"},
+			},
+			"2001:db8::/32": country("DE"),
+		},
+	}
+	for _, tc := range []struct {
+		ip, want  string
+		ipVersion int // The lowest IP version of database to look the address up in.
+	}{
+		{"192.0.2.200", "NZ", 4},
+		{"192.0.3.1", "", 4},
+		{"198.51.100.1", "AU", 6},
+		{"2001:db8::1", "DE", 6},
+		{"2001:db9::1", "", 6},
+	} {
+		for _, ipVersion := range []int{4, 6} {
+			if ipVersion < tc.ipVersion {
+				continue
+			}
+			for _, recordSize := range []int{24, 28, 32} {
+				r, err := NewReader(buildDB(t, ipVersion, recordSize, networks[ipVersion]))
+				testutil.FatalIfErr(t, err)
+				d := Databases{CountryDB: &DB{r: r}}
+				got, err := d.Country(net.ParseIP(tc.ip))
+				if err != nil || got != tc.want {
+					t.Errorf("IPv%d %d-bit: Country(%s) expected %q, received %q, %v", ipVersion, recordSize, tc.ip, tc.want, got, err)
+				}
+			}
+		}
+	}
+}
+
+func TestDatabaseType(t *testing.T) {
+	r, err := NewReader(buildDB(t, 4, 24, nil))
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "Test", r.DatabaseType)
+}
+
+func TestLookupIPv6InIPv4Database(t *testing.T) {
+	r, err := NewReader(buildDB(t, 4, 24, map[string]map[string]interface{}{"192.0.2.0/24": country("NZ")}))
+	testutil.FatalIfErr(t, err)
+	if _, err := r.Lookup(net.ParseIP("2001:db8::1")); err == nil {
+		t.Error("IPv6 lookup in an IPv4 database didn't fail")
+	}
+}
+
+func TestASN(t *testing.T) {
+	r, err := NewReader(buildDB(t, 6, 24, map[string]map[string]interface{}{
+		"192.0.2.0/24": {"autonomous_system_number": uint32(64496), "autonomous_system_organization": "Example"},
+	}))
+	testutil.FatalIfErr(t, err)
+	d := Databases{ASNDB: &DB{r: r}}
+	n, err := d.ASN(net.ParseIP("192.0.2.1"))
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, int64(64496), n)
+	n, err = d.ASN(net.ParseIP("203.0.113.1"))
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, int64(0), n)
+
+	if _, err := d.Country(net.ParseIP("192.0.2.1")); err == nil {
+		t.Error("Country without a country database didn't fail")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	v := map[string]interface{}{
+		"names":  []interface{}{"a", long, strings.Repeat("y", 70000)},
+		"big":    uint64(1) << 40,
+		"small":  uint16(7),
+		"pi":     3.25,
+		"ok":     true,
+		"nested": map[string]interface{}{"empty": map[string]interface{}{}},
+	}
+	got, _, err := decoder{encode(v)}.decode(0, 0)
+	testutil.FatalIfErr(t, err)
+	expected := map[string]interface{}{
+		"names":  []interface{}{"a", long, strings.Repeat("y", 70000)},
+		"big":    uint64(1) << 40,
+		"small":  uint64(7),
+		"pi":     3.25,
+		"ok":     true,
+		"nested": map[string]interface{}{"empty": map[string]interface{}{}},
+	}
+	testutil.ExpectNoDiff(t, expected, got)
+}
+
+func TestDecodePointer(t *testing.T) {
+	buf := encode("iso_code")
+	m := len(buf)
+	// A map of one entry whose key points to the string at 0.
+	buf = append(buf, typeMap<<5|1, typePointer<<5, 0)
+	buf = append(buf, encode("DE")...)
+	got, _, err := decoder{buf}.decode(uint(m), 0)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, map[string]interface{}{"iso_code": "DE"}, got)
+
+	// A pointer to a pointer is invalid.
+	p := len(buf)
+	buf = append(buf, typePointer<<5, byte(m+1))
+	if _, _, err := (decoder{buf}).decode(uint(p), 0); err == nil {
+		t.Error("pointer to a pointer decoded")
+	}
+}
+
+func TestNewReaderErrors(t *testing.T) {
+	for name, buf := range map[string][]byte{
+		"empty":     nil,
+		"no marker": []byte("not a database"),
+		"truncated": append([]byte(metadataMarker), typeMap<<5|3),
+		"no nodes":  append([]byte(metadataMarker), encode(map[string]interface{}{"record_size": uint16(24), "ip_version": uint16(4)})...),
+		"too big": append([]byte(metadataMarker), encode(map[string]interface{}{
+			"node_count": uint32(1000), "record_size": uint16(24), "ip_version": uint16(4),
+		})...),
+	} {
+		if _, err := NewReader(buf); err == nil {
+			t.Errorf("%s: NewReader succeeded", name)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, rmdir := testutil.TestTempDir(t)
+	defer rmdir()
+	path := filepath.Join(dir, "country.mmdb")
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, buildDB(t, 6, 24, map[string]map[string]interface{}{"192.0.2.0/24": country("NZ")}), 0600))
+	db, err := Open(path)
+	testutil.FatalIfErr(t, err)
+	d := Databases{CountryDB: db}
+	ip := net.ParseIP("192.0.2.1")
+
+	changed, err := db.reload()
+	testutil.FatalIfErr(t, err)
+	if changed {
+		t.Error("unchanged database reloaded")
+	}
+
+	// A replaced database is reread.
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, buildDB(t, 6, 24, map[string]map[string]interface{}{"192.0.2.0/24": country("FR"), "10.0.0.0/8": country("US")}), 0600))
+	future := time.Now().Add(time.Minute)
+	testutil.FatalIfErr(t, os.Chtimes(path, future, future))
+	changed, err = db.reload()
+	testutil.FatalIfErr(t, err)
+	if !changed {
+		t.Error("changed database not reloaded")
+	}
+	c, err := d.Country(ip)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "FR", c)
+
+	// A broken database is not used.
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte("garbage"), 0600))
+	if _, err := db.reload(); err == nil {
+		t.Error("broken database reloaded")
+	}
+	c, err = d.Country(ip)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "FR", c)
+}
+
+func TestRun(t *testing.T) {
+	dir, rmdir := testutil.TestTempDir(t)
+	defer rmdir()
+	path := filepath.Join(dir, "country.mmdb")
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, buildDB(t, 6, 24, map[string]map[string]interface{}{"192.0.2.0/24": country("NZ")}), 0600))
+	db, err := Open(path)
+	testutil.FatalIfErr(t, err)
+	clk := clock.NewFake(time.Now())
+	db.SetClock(clk)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		db.Run(ctx, time.Hour)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	clk.BlockUntil(1)
+
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, buildDB(t, 6, 24, map[string]map[string]interface{}{"192.0.2.0/24": country("FR")}), 0600))
+	future := time.Now().Add(time.Minute)
+	testutil.FatalIfErr(t, os.Chtimes(path, future, future))
+	// The file is reread on the next tick of the clock.
+	d := Databases{CountryDB: db}
+	ip := net.ParseIP("192.0.2.1")
+	c, err := d.Country(ip)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "NZ", c)
+	clk.Advance(time.Hour)
+	for deadline := time.Now().Add(5 * time.Second); c != "FR" && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		c, err = d.Country(ip)
+		testutil.FatalIfErr(t, err)
+	}
+	testutil.ExpectNoDiff(t, "FR", c)
+}
@@ -0,0 +1,332 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/big"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// metadataMarker precedes the metadata at the end of a MaxMind DB file.
+const metadataMarker = "\xab\xcd\xefMaxMind.com"
+
+// The types of field in the data section of a MaxMind DB file.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// maxDepth is the deepest nesting of maps and arrays that is decoded, so that
+// a corrupt file can't exhaust the stack.
+const maxDepth = 32
+
+// uintSizes are the largest sizes in bytes of the unsigned integer types.
+var uintSizes = map[uint]uint{typeUint16: 2, typeUint32: 4, typeUint64: 8}
+
+var errTruncated = errors.New("truncated data section")
+
+// Reader looks up IP addresses in a MaxMind DB file, as described at
+// https://maxmind.github.io/MaxMind-DB/.
+type Reader struct {
+	tree []byte // The search tree.
+	data []byte // The data section.
+
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // The node at which IPv4 addresses start in an IPv6 tree.
+
+	DatabaseType string // The type of the database, like "GeoLite2-Country".
+}
+
+// NewReader returns a Reader of the MaxMind DB file contents buf.
+func NewReader(buf []byte) (*Reader, error) {
+	i := bytes.LastIndex(buf, []byte(metadataMarker))
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file: no metadata")
+	}
+	v, _, err := decoder{buf[i+len(metadataMarker):]}.decode(0, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad metadata")
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("bad metadata: not a map")
+	}
+	r := &Reader{}
+	r.DatabaseType, _ = meta["database_type"].(string)
+	for _, f := range []struct {
+		key string
+		v   *uint
+	}{
+		{"node_count", &r.nodeCount},
+		{"record_size", &r.recordSize},
+		{"ip_version", &r.ipVersion},
+	} {
+		n, ok := meta[f.key].(uint64)
+		if !ok {
+			return nil, errors.Errorf("bad metadata: no %s", f.key)
+		}
+		*f.v = uint(n)
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, errors.Errorf("unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, errors.Errorf("unsupported IP version %d", r.ipVersion)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	// The search tree is followed by 16 bytes of zeroes, then the data.
+	if treeSize+16 > uint(i) {
+		return nil, errors.Errorf("search tree of %d nodes is larger than the file", r.nodeCount)
+	}
+	r.tree = buf[:treeSize]
+	r.data = buf[treeSize+16 : i]
+	if r.ipVersion == 6 {
+		// IPv4 addresses are in the tree as IPv6 addresses with 96 zero bits.
+		for j := 0; j < 96 && r.ipv4Start < r.nodeCount; j++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// record returns the left record of node if bit is 0, and the right if it is
+// 1.
+func (r *Reader) record(node, bit uint) uint {
+	b := r.tree
+	switch r.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(b[off+3]&0xf0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+		return uint(b[off+3]&0x0f)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[node*8+bit*4:]))
+	}
+}
+
+// Lookup returns the record for the network containing ip, or nil if there is
+// none.  Maps are returned as map[string]interface{}, arrays as
+// []interface{}, unsigned integers as uint64 or, if 128 bits, *big.Int, and
+// signed integers as int64.
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if ip = ip.To16(); ip == nil {
+		return nil, errors.New("invalid IP address")
+	} else if r.ipVersion == 4 {
+		return nil, errors.Errorf("IPv6 address %s looked up in an IPv4 database", ip)
+	}
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	switch {
+	case node == r.nodeCount:
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, errors.New("search tree is deeper than the address")
+	}
+	off := node - r.nodeCount - 16
+	if off >= uint(len(r.data)) {
+		return nil, errors.Errorf("record %d points past the data section", node)
+	}
+	v, _, err := decoder{r.data}.decode(off, 0)
+	return v, err
+}
+
+// decoder decodes the fields of a data section.
+type decoder struct {
+	buf []byte
+}
+
+// decode returns the field at off and the offset of the field after it.
+func (d decoder) decode(off uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("fields nested too deeply")
+	}
+	if off >= uint(len(d.buf)) {
+		return nil, 0, errTruncated
+	}
+	ctrl := d.buf[off]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == typePointer {
+		p, next, err := d.pointer(ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		if p < uint(len(d.buf)) && d.buf[p]>>5 == typePointer {
+			return nil, 0, errors.New("pointer to a pointer")
+		}
+		v, _, err := d.decode(p, depth+1)
+		return v, next, err
+	}
+	if typ == typeExtended {
+		if off >= uint(len(d.buf)) {
+			return nil, 0, errTruncated
+		}
+		typ = 7 + uint(d.buf[off])
+		off++
+	}
+	size, off, err := d.size(ctrl, off)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Every field takes at least a byte, so a map or array can't have more
+	// entries than there are bytes left.
+	if (typ == typeMap || typ == typeArray) && size > uint(len(d.buf))-off {
+		return nil, 0, errTruncated
+	}
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			if k, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.Errorf("map key %v is not a string", k)
+			}
+			if v, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			if v, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, off, nil
+	case typeBool:
+		if size > 1 {
+			return nil, 0, errors.Errorf("bad boolean size %d", size)
+		}
+		return size == 1, off, nil
+	}
+	if off+size > uint(len(d.buf)) {
+		return nil, 0, errTruncated
+	}
+	b := d.buf[off : off+size]
+	off += size
+	switch typ {
+	case typeString:
+		return string(b), off, nil
+	case typeBytes:
+		return append([]byte(nil), b...), off, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.Errorf("bad double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.Errorf("bad float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > uintSizes[typ] {
+			return nil, 0, errors.Errorf("bad unsigned integer size %d", size)
+		}
+		return uintValue(b), off, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errors.Errorf("bad int32 size %d", size)
+		}
+		return int64(int32(uintValue(b))), off, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, errors.Errorf("bad uint128 size %d", size)
+		}
+		return new(big.Int).SetBytes(b), off, nil
+	}
+	return nil, 0, errors.Errorf("unexpected field type %d", typ)
+}
+
+// pointer returns the offset that the pointer with control byte ctrl at off
+// points to, and the offset after it.
+func (d decoder) pointer(ctrl byte, off uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&3 + 1
+	if off+n > uint(len(d.buf)) {
+		return 0, 0, errTruncated
+	}
+	b := d.buf[off : off+n]
+	v := uint(ctrl & 7)
+	switch n {
+	case 1:
+		return v<<8 | uint(b[0]), off + n, nil
+	case 2:
+		return (v<<16 | uint(b[0])<<8 | uint(b[1])) + 2048, off + n, nil
+	case 3:
+		return (v<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336, off + n, nil
+	default:
+		return uint(binary.BigEndian.Uint32(b)), off + n, nil
+	}
+}
+
+// size returns the size of the field with control byte ctrl, whose size
+// bytes start at off, and the offset after them.
+func (d decoder) size(ctrl byte, off uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, off, nil
+	}
+	n := size - 28
+	if off+n > uint(len(d.buf)) {
+		return 0, 0, errTruncated
+	}
+	v := uint(uintValue(d.buf[off : off+n]))
+	switch n {
+	case 1:
+		return 29 + v, off + n, nil
+	case 2:
+		return 285 + v, off + n, nil
+	default:
+		return 65821 + v, off + n, nil
+	}
+}
+
+// uintValue returns the big-endian unsigned integer of up to eight bytes in
+// b.
+func uintValue(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package health describes the health of mtail's components, so the server
+// can report on them for liveness and readiness checks.
+package health
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Status is a snapshot of the health of one component.
+type Status struct {
+	Component    string        `json:"component"`
+	Critical     bool          `json:"critical"`      // A wedged critical component fails the liveness check.
+	Ready        bool          `json:"ready"`         // The component has what it needs to do useful work.
+	LastActivity time.Time     `json:"last_activity"` // When the component last finished some work.
+	BusySince    time.Time     `json:"busy_since"`    // When the work in progress started, or zero if idle.
+	Interval     time.Duration `json:"interval"`      // Expected time between activity, or zero if the component is not periodic.
+	Errors       int64         `json:"errors"`
+	Message      string        `json:"message,omitempty"`
+}
+
+// Wedged returns true if the component has not made progress for longer than
+// timeout, either because some work has been in progress that long, or
+// because a periodic component has missed its interval by that long.
+func (s Status) Wedged(now time.Time, timeout time.Duration) bool {
+	if !s.BusySince.IsZero() && now.Sub(s.BusySince) > timeout {
+		return true
+	}
+	if s.Interval > 0 && !s.LastActivity.IsZero() && now.Sub(s.LastActivity) > s.Interval+timeout {
+		return true
+	}
+	return false
+}
+
+// Reporter is implemented by components that can report their health.
+type Reporter interface {
+	Health() Status
+}
+
+// Activity records the progress of a component.  It is safe for concurrent
+// use, and cheap enough to call on every event processed.  When work is
+// started concurrently, BusySince tracks the most recently started.
+//
+// Its fields are updated atomically, which needs them 64-bit aligned; on
+// 32-bit platforms that holds only at the start of an allocated struct, so an
+// Activity must be the first field of any struct containing it.
+type Activity struct {
+	last   int64 // UnixNano of the last Done
+	busy   int64 // UnixNano of the last Start, or zero if idle
+	errors int64
+}
+
+// Start records that the component has begun some work.
+func (a *Activity) Start() {
+	atomic.StoreInt64(&a.busy, time.Now().UnixNano())
+}
+
+// Done records that the component has finished the work in progress.
+func (a *Activity) Done() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+	atomic.StoreInt64(&a.busy, 0)
+}
+
+// Error counts an error encountered by the component.
+func (a *Activity) Error() {
+	atomic.AddInt64(&a.errors, 1)
+}
+
+// Status returns a Status for component populated from the recorded activity.
+func (a *Activity) Status(component string) Status {
+	s := Status{
+		Component: component,
+		Ready:     true,
+		Errors:    atomic.LoadInt64(&a.errors),
+	}
+	if t := atomic.LoadInt64(&a.last); t != 0 {
+		s.LastActivity = time.Unix(0, t)
+	}
+	if t := atomic.LoadInt64(&a.busy); t != 0 {
+		s.BusySince = time.Unix(0, t)
+	}
+	return s
+}
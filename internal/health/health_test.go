@@ -0,0 +1,47 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package health
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWedged(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name string
+		s    Status
+		want bool
+	}{
+		{"idle", Status{}, false},
+		{"busy briefly", Status{BusySince: now.Add(-time.Second)}, false},
+		{"busy too long", Status{BusySince: now.Add(-time.Hour)}, true},
+		{"periodic on time", Status{Interval: time.Second, LastActivity: now.Add(-time.Second)}, false},
+		{"periodic overdue", Status{Interval: time.Second, LastActivity: now.Add(-2 * time.Minute)}, true},
+		{"aperiodic quiet", Status{LastActivity: now.Add(-time.Hour)}, false},
+	} {
+		if got := tc.s.Wedged(now, time.Minute); got != tc.want {
+			t.Errorf("%s: Wedged() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestActivity(t *testing.T) {
+	var a Activity
+	s := a.Status("test")
+	if !s.LastActivity.IsZero() || !s.BusySince.IsZero() || s.Errors != 0 {
+		t.Errorf("new activity not empty: %+v", s)
+	}
+	a.Start()
+	if s = a.Status("test"); s.BusySince.IsZero() {
+		t.Errorf("started activity not busy: %+v", s)
+	}
+	a.Error()
+	a.Done()
+	s = a.Status("test")
+	if s.Component != "test" || s.LastActivity.IsZero() || !s.BusySince.IsZero() || s.Errors != 1 {
+		t.Errorf("unexpected status after done: %+v", s)
+	}
+}
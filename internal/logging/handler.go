@@ -0,0 +1,51 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+type levelStatus struct {
+	Format  string `json:"format"`
+	V       int    `json:"v"`
+	VModule string `json:"vmodule"`
+}
+
+// LevelHandler reports the log format and V levels, and with POST sets the
+// global V level from the v parameter and the per file levels from the
+// vmodule parameter, either of which may be left out.
+func LevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if v := r.FormValue("v"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err == nil {
+				err = SetVerbosity(n)
+			}
+			if err != nil {
+				http.Error(w, "invalid v parameter: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if _, ok := r.Form["vmodule"]; ok {
+			if err := SetVModule(r.FormValue("vmodule")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		Infof("Log levels set to v=%d vmodule=%q by %s", Verbosity(), VModule(), r.RemoteAddr)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(levelStatus{CurrentFormat().String(), Verbosity(), VModule()}); err != nil {
+		Info(err)
+	}
+}
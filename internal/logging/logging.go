@@ -0,0 +1,189 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package logging is mtail's own leveled logging.  By default it writes
+// through glog, so the glog flags choose where the logs go.  With the JSON
+// format each entry is instead written to standard error as a JSON object,
+// for collection by a log pipeline.  The verbosity of V logging starts from
+// the glog -v and -vmodule flags, and can be changed while running.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// Format is the encoding of log entries.
+type Format int32
+
+const (
+	// TextFormat writes entries through glog.
+	TextFormat Format = iota
+	// JSONFormat writes each entry to standard error as a JSON object.
+	JSONFormat
+)
+
+var formatNames = map[Format]string{
+	TextFormat: "text",
+	JSONFormat: "json",
+}
+
+func (f Format) String() string {
+	return formatNames[f]
+}
+
+// ParseFormat returns the Format named by s, either "text" or "json".
+func ParseFormat(s string) (Format, error) {
+	for f, name := range formatNames {
+		if s == name {
+			return f, nil
+		}
+	}
+	return TextFormat, errors.Errorf("unknown log format %q, expecting text or json", s)
+}
+
+var (
+	format int32 // The current Format.
+
+	outMu sync.Mutex // protects out
+	out   io.Writer  = os.Stderr
+
+	exit = os.Exit
+)
+
+// SetFormat sets the encoding of subsequent log entries.
+func SetFormat(f Format) {
+	atomic.StoreInt32(&format, int32(f))
+}
+
+// CurrentFormat returns the encoding of log entries.
+func CurrentFormat() Format {
+	return Format(atomic.LoadInt32(&format))
+}
+
+type severity int
+
+const (
+	infoSeverity severity = iota
+	warningSeverity
+	errorSeverity
+	fatalSeverity
+)
+
+var severityNames = []string{"info", "warning", "error", "fatal"}
+
+// entry is the JSON encoding of a log entry.
+type entry struct {
+	Time     string `json:"time"`
+	Severity string `json:"severity"`
+	Caller   string `json:"caller"`
+	Message  string `json:"message"`
+}
+
+// output writes msg at severity s, attributed to the caller depth frames
+// above output's caller.
+func output(s severity, depth int, msg string) {
+	remember(s, msg)
+	if CurrentFormat() == TextFormat {
+		switch s {
+		case infoSeverity:
+			glog.InfoDepth(depth+1, msg)
+		case warningSeverity:
+			glog.WarningDepth(depth+1, msg)
+		case errorSeverity:
+			glog.ErrorDepth(depth+1, msg)
+		}
+		return
+	}
+	e := entry{
+		Time:     time.Now().Format(time.RFC3339Nano),
+		Severity: severityNames[s],
+		Caller:   "???",
+		Message:  msg,
+	}
+	if _, file, line, ok := runtime.Caller(depth + 1); ok {
+		e.Caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		b = []byte(fmt.Sprintf(`{"severity":"error","message":%q}`, err.Error()))
+	}
+	outMu.Lock()
+	defer outMu.Unlock()
+	_, _ = out.Write(append(b, '\n'))
+}
+
+// Info logs its arguments, formatted as by fmt.Sprint, at info severity.
+func Info(args ...interface{}) {
+	output(infoSeverity, 1, fmt.Sprint(args...))
+}
+
+// Infof logs its arguments, formatted as by fmt.Sprintf, at info severity.
+func Infof(format string, args ...interface{}) {
+	output(infoSeverity, 1, fmt.Sprintf(format, args...))
+}
+
+// Warning logs its arguments, formatted as by fmt.Sprint, at warning severity.
+func Warning(args ...interface{}) {
+	output(warningSeverity, 1, fmt.Sprint(args...))
+}
+
+// Warningf logs its arguments, formatted as by fmt.Sprintf, at warning severity.
+func Warningf(format string, args ...interface{}) {
+	output(warningSeverity, 1, fmt.Sprintf(format, args...))
+}
+
+// Error logs its arguments, formatted as by fmt.Sprint, at error severity.
+func Error(args ...interface{}) {
+	output(errorSeverity, 1, fmt.Sprint(args...))
+}
+
+// Errorf logs its arguments, formatted as by fmt.Sprintf, at error severity.
+func Errorf(format string, args ...interface{}) {
+	output(errorSeverity, 1, fmt.Sprintf(format, args...))
+}
+
+// Fatal logs its arguments at fatal severity, with the stacks of all
+// goroutines, then exits with status 255.
+func Fatal(args ...interface{}) {
+	if CurrentFormat() == TextFormat {
+		glog.FatalDepth(1, args...)
+		return
+	}
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	output(fatalSeverity, 1, fmt.Sprint(args...)+"\n"+string(buf))
+	exit(255)
+}
+
+// Exit logs its arguments, formatted as by fmt.Sprint, at fatal severity,
+// then exits with status 1.
+func Exit(args ...interface{}) {
+	if CurrentFormat() == TextFormat {
+		glog.ExitDepth(1, args...)
+		return
+	}
+	output(fatalSeverity, 1, fmt.Sprint(args...))
+	exit(1)
+}
+
+// Exitf logs its arguments, formatted as by fmt.Sprintf, at fatal severity,
+// then exits with status 1.
+func Exitf(format string, args ...interface{}) {
+	if CurrentFormat() == TextFormat {
+		glog.ExitDepth(1, fmt.Sprintf(format, args...))
+		return
+	}
+	output(fatalSeverity, 1, fmt.Sprintf(format, args...))
+	exit(1)
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func fatalIfErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectNoDiff(t *testing.T, a, b interface{}) {
+	t.Helper()
+	if diff := cmp.Diff(a, b); diff != "" {
+		t.Errorf("Unexpected diff, -expected +received:\n%s", diff)
+	}
+}
+
+// thisLine returns the number of the line it is called from.
+func thisLine() int {
+	_, _, line, _ := runtime.Caller(1)
+	return line
+}
+
+// callerAt returns the caller logged for a call on line l of this file.
+func callerAt(l int) string {
+	_, file, _, _ := runtime.Caller(0)
+	return fmt.Sprintf("%s:%d", filepath.Base(file), l)
+}
+
+// captureJSON switches to the JSON format writing to a buffer, until the
+// returned function is called.
+func captureJSON(t *testing.T) (*bytes.Buffer, func()) {
+	t.Helper()
+	var b bytes.Buffer
+	oldOut, oldFormat := out, CurrentFormat()
+	out = &b
+	SetFormat(JSONFormat)
+	return &b, func() {
+		out = oldOut
+		SetFormat(oldFormat)
+	}
+}
+
+func decodeEntries(t *testing.T, b *bytes.Buffer) []entry {
+	t.Helper()
+	var r []entry
+	d := json.NewDecoder(b)
+	for d.More() {
+		var e entry
+		fatalIfErr(t, d.Decode(&e))
+		e.Time = ""
+		r = append(r, e)
+	}
+	return r
+}
+
+func TestJSONFormat(t *testing.T) {
+	b, restore := captureJSON(t)
+	defer restore()
+	line := thisLine()
+	Infof("hello %s", "world")
+	Warning("careful")
+	Error("oops")
+	expected := []entry{
+		{Severity: "info", Caller: callerAt(line + 1), Message: "hello world"},
+		{Severity: "warning", Caller: callerAt(line + 2), Message: "careful"},
+		{Severity: "error", Caller: callerAt(line + 3), Message: "oops"},
+	}
+	expectNoDiff(t, expected, decodeEntries(t, b))
+}
+
+func TestExitJSON(t *testing.T) {
+	b, restore := captureJSON(t)
+	defer restore()
+	var status int
+	oldExit := exit
+	exit = func(code int) { status = code }
+	defer func() { exit = oldExit }()
+	line := thisLine()
+	Exitf("bad flag %q", "x")
+	if status != 1 {
+		t.Errorf("exit status %d, expected 1", status)
+	}
+	expectNoDiff(t, []entry{{Severity: "fatal", Caller: callerAt(line + 1), Message: `bad flag "x"`}}, decodeEntries(t, b))
+}
+
+func TestV(t *testing.T) {
+	b, restore := captureJSON(t)
+	defer restore()
+	oldV, oldVModule := Verbosity(), VModule()
+	defer func() {
+		fatalIfErr(t, SetVerbosity(oldV))
+		fatalIfErr(t, SetVModule(oldVModule))
+	}()
+
+	fatalIfErr(t, SetVerbosity(1))
+	fatalIfErr(t, SetVModule(""))
+	V(1).Info("one")
+	V(2).Info("two")
+	if V(2) {
+		t.Error("V(2) enabled at verbosity 1")
+	}
+	fatalIfErr(t, SetVModule("other=3,logging_t*=2"))
+	V(2).Infof("%s", "module two")
+	V(3).Info("module three")
+
+	var messages []string
+	for _, e := range decodeEntries(t, b) {
+		messages = append(messages, e.Message)
+	}
+	expectNoDiff(t, []string{"one", "module two"}, messages)
+
+	for _, bad := range []string{"x", "x=y", "[=1", "x=-1"} {
+		if err := SetVModule(bad); err == nil {
+			t.Errorf("SetVModule(%q) returned no error", bad)
+		}
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	_, restore := captureJSON(t)
+	defer restore()
+	oldV, oldVModule := Verbosity(), VModule()
+	defer func() {
+		fatalIfErr(t, SetVerbosity(oldV))
+		fatalIfErr(t, SetVModule(oldVModule))
+	}()
+
+	for _, tc := range []struct {
+		method, query string
+		code          int
+		expected      string
+	}{
+		{http.MethodPost, "v=2&vmodule=tail%3D3", http.StatusOK, `{"format":"json","v":2,"vmodule":"tail=3"}`},
+		{http.MethodGet, "", http.StatusOK, `{"format":"json","v":2,"vmodule":"tail=3"}`},
+		{http.MethodPost, "v=0", http.StatusOK, `{"format":"json","v":0,"vmodule":"tail=3"}`},
+		{http.MethodPost, "vmodule=", http.StatusOK, `{"format":"json","v":0,"vmodule":""}`},
+		{http.MethodPost, "v=x", http.StatusBadRequest, ""},
+		{http.MethodPost, "vmodule=tail", http.StatusBadRequest, ""},
+		{http.MethodDelete, "", http.StatusMethodNotAllowed, ""},
+	} {
+		w := httptest.NewRecorder()
+		LevelHandler(w, httptest.NewRequest(tc.method, "/loglevel?"+tc.query, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s %s: status %d, expected %d", tc.method, tc.query, w.Code, tc.code)
+			continue
+		}
+		if tc.expected != "" {
+			expectNoDiff(t, tc.expected, strings.TrimSpace(w.Body.String()))
+		}
+	}
+}
+
+func TestRecent(t *testing.T) {
+	_, restore := captureJSON(t)
+	defer restore()
+	before := len(Recent())
+	Info("not kept")
+	Warning("kept")
+	Errorf("also %s", "kept")
+	r := Recent()
+	expectNoDiff(t, before+2, len(r))
+	var got []string
+	for _, e := range r[len(r)-2:] {
+		got = append(got, e.Severity+": "+e.Message)
+	}
+	expectNoDiff(t, []string{"warning: kept", "error: also kept"}, got)
+
+	// Only the latest are kept, oldest first.
+	Warning("first")
+	for i := 0; i < recentLength-1; i++ {
+		Warning("middle")
+	}
+	Warning("last")
+	r = Recent()
+	expectNoDiff(t, recentLength, len(r))
+	expectNoDiff(t, "middle", r[0].Message)
+	expectNoDiff(t, "last", r[len(r)-1].Message)
+}
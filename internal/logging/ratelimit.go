@@ -0,0 +1,65 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logging
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// messagesSuppressed counts the log messages dropped by all RateLimiters.
+var messagesSuppressed = expvar.NewInt("log_messages_suppressed_total")
+
+// RateLimiter is a token bucket that limits how often a source of similar
+// messages logs, such as errors repeated on every line of a log whose format
+// has changed.  It allows burst messages at once, then rate each second.  The
+// messages it drops are counted, and reported by the next one it allows.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu         sync.Mutex
+	tokens     float64
+	last       time.Time
+	suppressed int64
+
+	now func() time.Time // for testing
+}
+
+// NewRateLimiter returns a RateLimiter allowing burst messages at once and
+// rate messages per second after that.  A rate of zero or less disables the
+// limit.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), now: time.Now}
+}
+
+// Allow reports whether a message may be logged now, and if so how many
+// messages were suppressed since the last one was allowed.
+func (r *RateLimiter) Allow() (ok bool, suppressed int64) {
+	if r.rate <= 0 {
+		return true, 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if !r.last.IsZero() {
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		if r.tokens > r.burst {
+			r.tokens = r.burst
+		}
+	}
+	r.last = now
+	if r.tokens < 1 {
+		r.suppressed++
+		messagesSuppressed.Add(1)
+		return false, 0
+	}
+	r.tokens--
+	suppressed, r.suppressed = r.suppressed, 0
+	return true, suppressed
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	r := NewRateLimiter(2, 3)
+	r.now = func() time.Time { return now }
+
+	type result struct {
+		OK         bool
+		Suppressed int64
+	}
+	allow := func() result {
+		ok, suppressed := r.Allow()
+		return result{ok, suppressed}
+	}
+	var got []result
+	for i := 0; i < 5; i++ {
+		got = append(got, allow())
+	}
+	// Half a second refills one token.
+	now = now.Add(500 * time.Millisecond)
+	got = append(got, allow(), allow())
+	// A long pause refills no more than the burst.
+	now = now.Add(time.Minute)
+	for i := 0; i < 4; i++ {
+		got = append(got, allow())
+	}
+	expected := []result{
+		{true, 0}, {true, 0}, {true, 0}, {false, 0}, {false, 0},
+		{true, 2}, {false, 0},
+		{true, 1}, {true, 0}, {true, 0}, {false, 0},
+	}
+	expectNoDiff(t, expected, got)
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	r := NewRateLimiter(0, 1)
+	for i := 0; i < 100; i++ {
+		if ok, _ := r.Allow(); !ok {
+			t.Fatalf("message %d not allowed without a limit", i)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logging
+
+import (
+	"sync"
+	"time"
+)
+
+// recentLength is how many of the latest warnings and errors are kept.
+const recentLength = 50
+
+// Entry is a warning or error logged recently.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	Message  string    `json:"message"`
+}
+
+var (
+	recentMu sync.Mutex // protects recent and recentNext
+	recent   []Entry    // A ring of the latest entries.
+
+	recentNext int // Where the next entry goes in recent once it is full.
+)
+
+// remember keeps an entry logged at severity s, if it is a warning or worse.
+func remember(s severity, msg string) {
+	if s < warningSeverity {
+		return
+	}
+	e := Entry{Time: time.Now().UTC(), Severity: severityNames[s], Message: msg}
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	if len(recent) < recentLength {
+		recent = append(recent, e)
+		return
+	}
+	recent[recentNext] = e
+	recentNext = (recentNext + 1) % recentLength
+}
+
+// Recent returns the latest warnings and errors logged, oldest first, however
+// the logs are written.
+func Recent() []Entry {
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	r := make([]Entry, 0, len(recent))
+	r = append(r, recent[recentNext:]...)
+	return append(r, recent[:recentNext]...)
+}
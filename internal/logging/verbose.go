@@ -0,0 +1,176 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// modulePat is one pattern=level setting of the vmodule.
+type modulePat struct {
+	pattern string
+	level   int32
+}
+
+var (
+	fromFlags sync.Once // Reads the initial verbosity from the glog flags.
+
+	verbosity    int32 // The global V level.
+	filterLength int32 // The number of vmodule patterns, so V needn't lock when there are none.
+
+	vmoduleMu sync.Mutex        // protects the vmodule state
+	vmodule   string            // The vmodule setting, as given.
+	filter    []modulePat       // The parsed vmodule setting.
+	vmap      map[uintptr]int32 // V level of each call site, when the vmodule is set.
+)
+
+// initFromFlags takes the starting verbosity from the glog flags, once they
+// have been parsed.
+func initFromFlags() {
+	fromFlags.Do(func() {
+		if f := flag.Lookup("v"); f != nil {
+			if v, err := strconv.Atoi(f.Value.String()); err == nil {
+				atomic.StoreInt32(&verbosity, int32(v))
+			}
+		}
+		if f := flag.Lookup("vmodule"); f != nil {
+			_ = setVModule(f.Value.String())
+		}
+	})
+}
+
+// Verbosity returns the global V level.
+func Verbosity() int {
+	initFromFlags()
+	return int(atomic.LoadInt32(&verbosity))
+}
+
+// SetVerbosity sets the global V level.
+func SetVerbosity(v int) error {
+	if v < 0 {
+		return errors.New("negative verbosity")
+	}
+	initFromFlags()
+	atomic.StoreInt32(&verbosity, int32(v))
+	return nil
+}
+
+// VModule returns the per file V levels, in the same form as the -vmodule
+// flag.
+func VModule() string {
+	initFromFlags()
+	vmoduleMu.Lock()
+	defer vmoduleMu.Unlock()
+	return vmodule
+}
+
+// SetVModule sets the per file V levels from a comma separated list of
+// pattern=N settings, like the -vmodule flag.  A pattern matches the name of
+// a source file without its directory or .go extension.
+func SetVModule(value string) error {
+	initFromFlags()
+	return setVModule(value)
+}
+
+func setVModule(value string) error {
+	var f []modulePat
+	for _, pat := range strings.Split(value, ",") {
+		if pat == "" {
+			continue
+		}
+		kv := strings.Split(pat, "=")
+		if len(kv) != 2 || kv[0] == "" {
+			return errors.Errorf("invalid vmodule setting %q, expecting pattern=N", pat)
+		}
+		if _, err := filepath.Match(kv[0], ""); err != nil {
+			return errors.Wrapf(err, "invalid vmodule pattern %q", kv[0])
+		}
+		v, err := strconv.Atoi(kv[1])
+		if err != nil || v < 0 {
+			return errors.Errorf("invalid vmodule level in %q", pat)
+		}
+		if v == 0 {
+			continue
+		}
+		f = append(f, modulePat{kv[0], int32(v)})
+	}
+	vmoduleMu.Lock()
+	defer vmoduleMu.Unlock()
+	vmodule = value
+	filter = f
+	vmap = make(map[uintptr]int32)
+	atomic.StoreInt32(&filterLength, int32(len(f)))
+	return nil
+}
+
+// siteLevel returns the vmodule V level of the call site at pc.
+// vmoduleMu is held.
+func siteLevel(pc uintptr) int32 {
+	if v, ok := vmap[pc]; ok {
+		return v
+	}
+	file, _ := runtime.FuncForPC(pc).FileLine(pc)
+	file = strings.TrimSuffix(filepath.Base(file), ".go")
+	var v int32
+	for _, f := range filter {
+		if matched, _ := filepath.Match(f.pattern, file); matched {
+			v = f.level
+			break
+		}
+	}
+	vmap[pc] = v
+	return v
+}
+
+// Verbose is true if V logging is enabled at the call site, and provides the
+// info severity logging functions that only log if it is.
+type Verbose bool
+
+// V reports whether the global V level, or the vmodule level for the file
+// calling V, is at least level.  Either use it as a condition,
+//
+//	if logging.V(2) { logging.Info("expensive", describe(x)) }
+//
+// or call the logging functions of the result, which log only if it's true:
+//
+//	logging.V(2).Info("cheap")
+func V(level int32) Verbose {
+	initFromFlags()
+	if atomic.LoadInt32(&verbosity) >= level {
+		return true
+	}
+	if atomic.LoadInt32(&filterLength) == 0 {
+		return false
+	}
+	var pcs [1]uintptr
+	if runtime.Callers(2, pcs[:]) == 0 {
+		return false
+	}
+	vmoduleMu.Lock()
+	defer vmoduleMu.Unlock()
+	return siteLevel(pcs[0]) >= level
+}
+
+// Info logs its arguments, formatted as by fmt.Sprint, if v is true.
+func (v Verbose) Info(args ...interface{}) {
+	if v {
+		output(infoSeverity, 1, fmt.Sprint(args...))
+	}
+}
+
+// Infof logs its arguments, formatted as by fmt.Sprintf, if v is true.
+func (v Verbose) Infof(format string, args ...interface{}) {
+	if v {
+		output(infoSeverity, 1, fmt.Sprintf(format, args...))
+	}
+}
@@ -3,7 +3,10 @@
 
 package logline
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 // LogLine contains all the information about a line just read from a log.
 type LogLine struct {
@@ -11,9 +14,33 @@ type LogLine struct {
 
 	Filename string // The log filename that this line was read from
 	Line     string // The text of the log line itself up to the newline.
+
+	// Offset is the position in the log of the first byte of the line, and
+	// Number the count of lines up to and including this one, both since
+	// the tailer began reading the log or it was last rotated or truncated.
+	Offset int64
+	Number int64
+
+	// IngestTime is when the tailer read the end of the line from the log.
+	IngestTime time.Time
+
+	// WriteTime is the modification time of the log when the tailer first
+	// saw it had been written past the end of the line, so the line was
+	// written no later than this.  It is zero if the log has no
+	// modification time, like a pipe or socket.
+	WriteTime time.Time
+
+	// Location is the timezone of timestamps in the line that don't name
+	// one, if it's not the one the programs are configured with.
+	Location *time.Location
+
+	// Fields are the values of the fields of a binary record, by their
+	// path, when the line was decoded from one; Line is then the record in
+	// text form.  They are nil for lines of text.
+	Fields map[string]string
 }
 
 // New creates a new LogLine object.
 func New(ctx context.Context, filename string, line string) *LogLine {
-	return &LogLine{ctx, filename, line}
+	return &LogLine{Context: ctx, Filename: filename, Line: line}
 }
@@ -0,0 +1,101 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package datum
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AggregateFunc chooses which summary of its observations an Aggregate
+// reports as its value.
+type AggregateFunc int
+
+const (
+	// AggregateMin reports the smallest value observed.
+	AggregateMin AggregateFunc = iota
+	// AggregateMax reports the largest value observed.
+	AggregateMax
+	// AggregateAvg reports the mean of the values observed.
+	AggregateAvg
+)
+
+// Aggregate summarises the values observed since it was last reset.
+type Aggregate struct {
+	BaseDatum
+	sync.RWMutex
+	Func  AggregateFunc
+	Count uint64
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+func (d *Aggregate) Observe(v float64, ts time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.Count == 0 || v < d.Min {
+		d.Min = v
+	}
+	if d.Count == 0 || v > d.Max {
+		d.Max = v
+	}
+	d.Count++
+	d.Sum += v
+
+	d.stamp(ts)
+}
+
+// Reset forgets the values observed, so the next observation starts a new
+// summary.
+func (d *Aggregate) Reset() {
+	d.Lock()
+	defer d.Unlock()
+
+	d.Count = 0
+	d.Sum = 0
+	d.Min = 0
+	d.Max = 0
+}
+
+// Get returns the value of the aggregate, and false if nothing has been
+// observed since it was reset.
+func (d *Aggregate) Get() (float64, bool) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.Count == 0 {
+		return 0, false
+	}
+	switch d.Func {
+	case AggregateMin:
+		return d.Min, true
+	case AggregateMax:
+		return d.Max, true
+	}
+	return d.Sum / float64(d.Count), true
+}
+
+func (d *Aggregate) ValueString() string {
+	v, _ := d.Get()
+	return fmt.Sprintf("%g", v)
+}
+
+func (d *Aggregate) MarshalJSON() ([]byte, error) {
+	v, _ := d.Get()
+	d.RLock()
+	defer d.RUnlock()
+
+	j := struct {
+		Value float64
+		Count uint64
+		Time  int64
+	}{v, d.Count, atomic.LoadInt64(&d.Time)}
+
+	return json.Marshal(j)
+}
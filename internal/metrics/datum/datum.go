@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"math"
 	"sort"
+	"strconv"
 	"sync/atomic"
 	"time"
 )
@@ -71,6 +72,18 @@ func NewBuckets(buckets []Range) Datum {
 	return MakeBuckets(buckets, zeroTime)
 }
 
+// NewSketch creates a new empty sketch datum, emptied at the start of each
+// window if window is not zero.
+func NewSketch(window time.Duration) Datum {
+	return &Sketch{Window: window}
+}
+
+// NewAggregate creates a new empty aggregate datum, reporting the summary fn
+// of its observations.
+func NewAggregate(fn AggregateFunc) Datum {
+	return &Aggregate{Func: fn}
+}
+
 // MakeInt creates a new integer datum with the provided value and timestamp.
 func MakeInt(v int64, ts time.Time) Datum {
 	d := &Int{}
@@ -112,6 +125,44 @@ func MakeBuckets(buckets []Range, ts time.Time) Datum {
 	return d
 }
 
+// Copy returns a new Datum with the value and timestamp of d.
+func Copy(d Datum) Datum {
+	switch d := d.(type) {
+	case *Int:
+		c := &Int{Value: d.Get()}
+		c.Time = atomic.LoadInt64(&d.Time)
+		return c
+	case *Float:
+		c := &Float{Valuebits: atomic.LoadUint64(&d.Valuebits)}
+		c.Time = atomic.LoadInt64(&d.Time)
+		return c
+	case *String:
+		c := &String{Value: d.Get()}
+		c.Time = atomic.LoadInt64(&d.Time)
+		return c
+	case *Buckets:
+		d.RLock()
+		defer d.RUnlock()
+		c := &Buckets{Buckets: append([]BucketCount(nil), d.Buckets...), Count: d.Count, Sum: d.Sum}
+		c.Time = atomic.LoadInt64(&d.Time)
+		return c
+	case *Aggregate:
+		d.RLock()
+		defer d.RUnlock()
+		c := &Aggregate{Func: d.Func, Count: d.Count, Sum: d.Sum, Min: d.Min, Max: d.Max}
+		c.Time = atomic.LoadInt64(&d.Time)
+		return c
+	case *Sketch:
+		d.RLock()
+		defer d.RUnlock()
+		c := &Sketch{Window: d.Window, Start: d.Start, Registers: append([]uint8(nil), d.Registers...)}
+		c.Time = atomic.LoadInt64(&d.Time)
+		return c
+	default:
+		panic(fmt.Sprintf("datum %v has unknown type %T", d, d))
+	}
+}
+
 // GetInt returns the integer value of a datum, or error.
 func GetInt(d Datum) int64 {
 	switch d := d.(type) {
@@ -149,6 +200,10 @@ func SetInt(d Datum, v int64, ts time.Time) {
 		d.Set(v, ts)
 	case *Buckets:
 		d.Observe(float64(v), ts)
+	case *Aggregate:
+		d.Observe(float64(v), ts)
+	case *Sketch:
+		d.Add(strconv.FormatInt(v, 10), ts)
 	default:
 		panic(fmt.Sprintf("datum %v is not an Int", d))
 	}
@@ -161,6 +216,10 @@ func SetFloat(d Datum, v float64, ts time.Time) {
 		d.Set(v, ts)
 	case *Buckets:
 		d.Observe(v, ts)
+	case *Aggregate:
+		d.Observe(v, ts)
+	case *Sketch:
+		d.Add(strconv.FormatFloat(v, 'g', -1, 64), ts)
 	default:
 		panic(fmt.Sprintf("datum %v is not a Float", d))
 	}
@@ -171,26 +230,48 @@ func SetString(d Datum, v string, ts time.Time) {
 	switch d := d.(type) {
 	case *String:
 		d.Set(v, ts)
+	case *Sketch:
+		d.Add(v, ts)
 	default:
 		panic(fmt.Sprintf("datum %v is not a String", d))
 	}
 }
 
-// IncIntBy increments an integer Datum by the provided value, at time ts, or panics if the Datum is not an IntDatum.
-func IncIntBy(d Datum, v int64, ts time.Time) {
+// IncIntBy increments an integer Datum by the provided value, at time ts, or panics if the Datum is not an IntDatum.  It returns whether the value wrapped around.
+func IncIntBy(d Datum, v int64, ts time.Time) bool {
 	switch d := d.(type) {
 	case *Int:
-		d.IncBy(v, ts)
+		return d.IncBy(v, ts)
 	default:
 		panic(fmt.Sprintf("datum %v is not an Int", d))
 	}
 }
 
-// DecIntBy increments an integer Datum by the provided value, at time ts, or panics if the Datum is not an IntDatum.
-func DecIntBy(d Datum, v int64, ts time.Time) {
+// DecIntBy decrements an integer Datum by the provided value, at time ts, or panics if the Datum is not an IntDatum.  It returns whether the value wrapped around.
+func DecIntBy(d Datum, v int64, ts time.Time) bool {
 	switch d := d.(type) {
 	case *Int:
-		d.DecBy(v, ts)
+		return d.DecBy(v, ts)
+	default:
+		panic(fmt.Sprintf("datum %v is not an Int", d))
+	}
+}
+
+// SaturatingIncIntBy increments an integer Datum by the provided value, at time ts, stopping at the limits of an int64, or panics if the Datum is not an IntDatum.  It returns whether the value was limited.
+func SaturatingIncIntBy(d Datum, v int64, ts time.Time) bool {
+	switch d := d.(type) {
+	case *Int:
+		return d.SaturatingIncBy(v, ts)
+	default:
+		panic(fmt.Sprintf("datum %v is not an Int", d))
+	}
+}
+
+// SaturatingDecIntBy decrements an integer Datum by the provided value, at time ts, stopping at the limits of an int64, or panics if the Datum is not an IntDatum.  It returns whether the value was limited.
+func SaturatingDecIntBy(d Datum, v int64, ts time.Time) bool {
+	switch d := d.(type) {
+	case *Int:
+		return d.SaturatingDecBy(v, ts)
 	default:
 		panic(fmt.Sprintf("datum %v is not an Int", d))
 	}
@@ -257,3 +338,23 @@ func GetBucketsCumByMax(d Datum) map[float64]uint64 {
 		panic(fmt.Sprintf("datum %v is not a Buckets", d))
 	}
 }
+
+// GetSketch returns d as a Sketch, or panics if d is not a Sketch.
+func GetSketch(d Datum) *Sketch {
+	switch d := d.(type) {
+	case *Sketch:
+		return d
+	default:
+		panic(fmt.Sprintf("datum %v is not a Sketch", d))
+	}
+}
+
+// GetAggregate returns d as an Aggregate, or panics if d is not an Aggregate.
+func GetAggregate(d Datum) *Aggregate {
+	switch d := d.(type) {
+	case *Aggregate:
+		return d
+	default:
+		panic(fmt.Sprintf("datum %v is not an Aggregate", d))
+	}
+}
@@ -58,3 +58,61 @@ func TestMarshalJSON(t *testing.T) {
 		testutil.ExpectNoDiff(t, tc.expected, string(b))
 	}
 }
+
+func TestCopy(t *testing.T) {
+	ts := time.Unix(37, 42)
+	for _, d := range []Datum{
+		MakeInt(12, ts),
+		MakeFloat(1.5, ts),
+		MakeString("x", ts),
+		MakeBuckets([]Range{{0, 1}, {1, 2}}, ts),
+	} {
+		if b, ok := d.(*Buckets); ok {
+			b.Observe(0.5, ts)
+		}
+		c := Copy(d)
+		testutil.ExpectNoDiff(t, d.ValueString(), c.ValueString())
+		testutil.ExpectNoDiff(t, d.TimeUTC(), c.TimeUTC())
+		if c == d {
+			t.Errorf("Copy(%v) returned the same datum", d)
+		}
+	}
+	b := MakeBuckets([]Range{{0, 1}}, ts).(*Buckets)
+	c := Copy(b).(*Buckets)
+	b.Observe(0.5, ts)
+	if c.GetCount() != 0 || c.Buckets[0].Count != 0 {
+		t.Errorf("copy changed by an observation of the original: %v", c)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	ts := time.Unix(37, 0)
+	for _, tc := range []struct {
+		fn       AggregateFunc
+		expected float64
+	}{
+		{AggregateMin, 1},
+		{AggregateMax, 6},
+		{AggregateAvg, 3},
+	} {
+		d := NewAggregate(tc.fn)
+		if _, ok := GetAggregate(d).Get(); ok {
+			t.Errorf("%v: empty aggregate has a value", tc.fn)
+		}
+		SetInt(d, 2, ts)
+		SetFloat(d, 6, ts)
+		SetInt(d, 1, ts)
+		v, ok := GetAggregate(d).Get()
+		if !ok || v != tc.expected {
+			t.Errorf("%v: expected %v, received %v, %v", tc.fn, tc.expected, v, ok)
+		}
+		c := Copy(d)
+		GetAggregate(d).Reset()
+		if _, ok := GetAggregate(d).Get(); ok {
+			t.Errorf("%v: reset aggregate has a value", tc.fn)
+		}
+		if v, _ := GetAggregate(c).Get(); v != tc.expected {
+			t.Errorf("%v: copy expected %v, received %v", tc.fn, tc.expected, v)
+		}
+	}
+}
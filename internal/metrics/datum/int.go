@@ -6,6 +6,7 @@ package datum
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"sync/atomic"
 	"time"
 )
@@ -22,16 +23,70 @@ func (d *Int) Set(value int64, timestamp time.Time) {
 	d.stamp(timestamp)
 }
 
-// IncBy increments the Int's value by the value provided, at timestamp.
-func (d *Int) IncBy(delta int64, timestamp time.Time) {
-	atomic.AddInt64(&d.Value, delta)
+// IncBy increments the Int's value by delta, at timestamp.  If the sum passes
+// the limits of an int64 it wraps around, and IncBy returns true.
+func (d *Int) IncBy(delta int64, timestamp time.Time) bool {
+	n := atomic.AddInt64(&d.Value, delta)
 	d.stamp(timestamp)
+	return wrapped(n-delta, n, delta, false)
 }
 
-// DecBy increments the Int's value by the value provided, at timestamp.
-func (d *Int) DecBy(delta int64, timestamp time.Time) {
-	atomic.AddInt64(&d.Value, -delta)
+// DecBy decrements the Int's value by delta, at timestamp.  If the difference
+// passes the limits of an int64 it wraps around, and DecBy returns true.
+func (d *Int) DecBy(delta int64, timestamp time.Time) bool {
+	n := atomic.AddInt64(&d.Value, -delta)
 	d.stamp(timestamp)
+	return wrapped(n+delta, n, delta, true)
+}
+
+// SaturatingIncBy increments the Int's value by delta, at timestamp.  If the
+// sum passes the limits of an int64 the value stops at the limit, and
+// SaturatingIncBy returns true.
+func (d *Int) SaturatingIncBy(delta int64, timestamp time.Time) bool {
+	saturated := d.saturatingAdd(delta, false)
+	d.stamp(timestamp)
+	return saturated
+}
+
+// SaturatingDecBy decrements the Int's value by delta, at timestamp.  If the
+// difference passes the limits of an int64 the value stops at the limit, and
+// SaturatingDecBy returns true.
+func (d *Int) SaturatingDecBy(delta int64, timestamp time.Time) bool {
+	saturated := d.saturatingAdd(delta, true)
+	d.stamp(timestamp)
+	return saturated
+}
+
+// saturatingAdd adds delta to the value, or subtracts it if neg, stopping at
+// the limits of an int64.  It returns whether the value was limited.
+func (d *Int) saturatingAdd(delta int64, neg bool) bool {
+	up := (delta > 0) != neg
+	for {
+		old := atomic.LoadInt64(&d.Value)
+		n := old + delta
+		if neg {
+			n = old - delta
+		}
+		saturated := wrapped(old, n, delta, neg)
+		if saturated {
+			n = math.MaxInt64
+			if !up {
+				n = math.MinInt64
+			}
+		}
+		if atomic.CompareAndSwapInt64(&d.Value, old, n) {
+			return saturated
+		}
+	}
+}
+
+// wrapped reports whether old plus delta, or minus delta if neg, passed the
+// limits of an int64 and wrapped around to give n.
+func wrapped(old, n, delta int64, neg bool) bool {
+	if neg {
+		return delta > 0 && n > old || delta < 0 && n < old
+	}
+	return delta > 0 && n < old || delta < 0 && n > old
 }
 
 // Get returns the value of the Int
@@ -4,6 +4,7 @@
 package datum
 
 import (
+	"math"
 	"testing"
 	"time"
 )
@@ -38,3 +39,38 @@ func TestDecrementScalarInt(t *testing.T) {
 		t.Errorf("expected 0, got %d", r)
 	}
 }
+
+func TestIntOverflow(t *testing.T) {
+	ts := time.Now().UTC()
+	for _, tc := range []struct {
+		name      string
+		start     int64
+		op        func(d *Int) bool
+		want      int64
+		overflows bool
+	}{
+		{"inc", 1, func(d *Int) bool { return d.IncBy(1, ts) }, 2, false},
+		{"inc wraps", math.MaxInt64, func(d *Int) bool { return d.IncBy(1, ts) }, math.MinInt64, true},
+		{"inc negative wraps", math.MinInt64, func(d *Int) bool { return d.IncBy(-1, ts) }, math.MaxInt64, true},
+		{"dec wraps", math.MinInt64, func(d *Int) bool { return d.DecBy(1, ts) }, math.MaxInt64, true},
+		{"dec by min", -1, func(d *Int) bool { return d.DecBy(math.MinInt64, ts) }, math.MaxInt64, false},
+		{"dec by min wraps", 0, func(d *Int) bool { return d.DecBy(math.MinInt64, ts) }, math.MinInt64, true},
+		{"saturating inc", 1, func(d *Int) bool { return d.SaturatingIncBy(2, ts) }, 3, false},
+		{"saturating inc saturates", math.MaxInt64 - 1, func(d *Int) bool { return d.SaturatingIncBy(2, ts) }, math.MaxInt64, true},
+		{"saturating inc at max", math.MaxInt64, func(d *Int) bool { return d.SaturatingIncBy(1, ts) }, math.MaxInt64, true},
+		{"saturating inc negative saturates", math.MinInt64, func(d *Int) bool { return d.SaturatingIncBy(-1, ts) }, math.MinInt64, true},
+		{"saturating dec saturates", math.MinInt64 + 1, func(d *Int) bool { return d.SaturatingDecBy(2, ts) }, math.MinInt64, true},
+		{"saturating dec by min saturates", 0, func(d *Int) bool { return d.SaturatingDecBy(math.MinInt64, ts) }, math.MaxInt64, true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			d := &Int{Value: tc.start}
+			if overflowed := tc.op(d); overflowed != tc.overflows {
+				t.Errorf("overflowed %v, expected %v", overflowed, tc.overflows)
+			}
+			if r := d.Get(); r != tc.want {
+				t.Errorf("expected %d, got %d", tc.want, r)
+			}
+		})
+	}
+}
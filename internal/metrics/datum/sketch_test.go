@@ -0,0 +1,95 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package datum_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics/datum"
+)
+
+// within reports whether the estimate e is within 5% of n, three standard
+// deviations of the sketch's error.
+func within(e uint64, n int) bool {
+	return math.Abs(float64(e)-float64(n)) <= 0.05*float64(n)
+}
+
+func TestSketchEstimate(t *testing.T) {
+	ts := time.Unix(37, 0)
+	for _, n := range []int{0, 1, 10, 1000, 100000} {
+		d := datum.GetSketch(datum.NewSketch(0))
+		for i := 0; i < n; i++ {
+			// Each value is added twice, and counted once.
+			d.Add(fmt.Sprintf("user%d", i), ts)
+			d.Add(fmt.Sprintf("user%d", i), ts)
+		}
+		if e := d.Estimate(); !within(e, n) {
+			t.Errorf("%d values: estimated %d", n, e)
+		}
+	}
+}
+
+func TestSketchSetTypes(t *testing.T) {
+	d := datum.NewSketch(0)
+	ts := time.Unix(37, 0)
+	datum.SetInt(d, 1, ts)
+	datum.SetFloat(d, 1.5, ts)
+	datum.SetString(d, "a", ts)
+	datum.SetString(d, "a", ts)
+	if e := datum.GetSketch(d).Estimate(); e != 3 {
+		t.Errorf("estimated %d, expected 3", e)
+	}
+	if d.ValueString() != "3" {
+		t.Errorf("value string %q, expected 3", d.ValueString())
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	ts := time.Unix(37, 0)
+	a := datum.GetSketch(datum.NewSketch(0))
+	b := datum.GetSketch(datum.NewSketch(0))
+	for i := 0; i < 3000; i++ {
+		a.Add(fmt.Sprint(i), ts)
+		b.Add(fmt.Sprint(i+1000), ts)
+	}
+	a.Merge(b)
+	if e := a.Estimate(); !within(e, 4000) {
+		t.Errorf("merged estimated %d, expected about 4000", e)
+	}
+	c := datum.Copy(a).(*datum.Sketch)
+	if c.Estimate() != a.Estimate() {
+		t.Errorf("copy estimated %d, expected %d", c.Estimate(), a.Estimate())
+	}
+}
+
+func TestSketchWindow(t *testing.T) {
+	d := datum.GetSketch(datum.NewSketch(time.Hour))
+	start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	d.Add("a", start.Add(10*time.Minute))
+	d.Add("b", start.Add(50*time.Minute))
+	if e := d.Estimate(); e != 2 {
+		t.Errorf("first hour estimated %d, expected 2", e)
+	}
+	// The next hour starts over.
+	d.Add("a", start.Add(70*time.Minute))
+	if e := d.Estimate(); e != 1 {
+		t.Errorf("second hour estimated %d, expected 1", e)
+	}
+
+	// A merge keeps the later window.
+	old := datum.GetSketch(datum.NewSketch(time.Hour))
+	old.Add("c", start)
+	old.Add("d", start)
+	d.Merge(old)
+	if e := d.Estimate(); e != 1 {
+		t.Errorf("merged earlier window estimated %d, expected 1", e)
+	}
+	old.Merge(d)
+	if e := old.Estimate(); e != 1 {
+		t.Errorf("merged later window estimated %d, expected 1", e)
+	}
+}
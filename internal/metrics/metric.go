@@ -39,6 +39,24 @@ const (
 	// Histogram is a Kind that observes a value and stores the value
 	// in a bucket.
 	Histogram
+
+	// TopK is a Kind that counts the most frequent label values, keeping at
+	// most Limit of them.  A new label value replaces the one with the
+	// lowest count, taking over its count, so the counts kept are estimates
+	// that can only be too high.
+	TopK
+
+	// Distinct is a Kind that estimates the number of distinct values
+	// assigned to it, with a HyperLogLog sketch, and may be emptied at the
+	// start of each Window.
+	Distinct
+
+	// Min, Max and Avg are Kinds that summarise the values observed since
+	// the metrics were last pushed, as the smallest, the largest, or the
+	// mean of them.
+	Min
+	Max
+	Avg
 )
 
 func (m Kind) String() string {
@@ -53,10 +71,34 @@ func (m Kind) String() string {
 		return "Text"
 	case Histogram:
 		return "Histogram"
+	case TopK:
+		return "TopK"
+	case Distinct:
+		return "Distinct"
+	case Min:
+		return "Min"
+	case Max:
+		return "Max"
+	case Avg:
+		return "Avg"
 	}
 	return "Unknown"
 }
 
+// TimestampExport chooses whether a Metric is exported with the timestamp of
+// its last update, where the exporter supports leaving it out.
+type TimestampExport int
+
+const (
+	// DefaultTimestamp exports the timestamp as the exporter is configured to.
+	DefaultTimestamp TimestampExport = iota
+	// EmitTimestamp always exports the timestamp.
+	EmitTimestamp
+	// OmitTimestamp never exports the timestamp, so the collector uses the
+	// time of collection.
+	OmitTimestamp
+)
+
 // LabelValue is an object that names a Datum value with a list of label
 // strings.
 type LabelValue struct {
@@ -81,6 +123,12 @@ type Metric struct {
 	LabelValues []*LabelValue `json:",omitempty"`
 	Source      string        `json:"-"`
 	Buckets     []datum.Range `json:",omitempty"`
+	Limit       int           `json:",omitempty"` // The most label values kept by a TopK metric.
+	Window      time.Duration `json:",omitempty"` // How often a Distinct metric is emptied.
+	Reset       time.Duration `json:",omitempty"` // How often the metric is reset to zero.
+	WindowStart time.Time     `json:"-"`          // When the current reset window started.
+
+	Timestamp TimestampExport `json:",omitempty"` // Whether to export the timestamp.
 }
 
 // NewMetric returns a new empty metric of dimension len(keys).
@@ -94,6 +142,33 @@ func NewMetric(name string, prog string, kind Kind, typ Type, keys ...string) *M
 	return m
 }
 
+// copy returns a new Metric with the description of m and copies of its
+// label values and data.
+func (m *Metric) copy() *Metric {
+	m.RLock()
+	defer m.RUnlock()
+	c := &Metric{
+		Name:        m.Name,
+		Program:     m.Program,
+		Kind:        m.Kind,
+		Type:        m.Type,
+		Hidden:      m.Hidden,
+		Keys:        m.Keys,
+		LabelValues: make([]*LabelValue, 0, len(m.LabelValues)),
+		Source:      m.Source,
+		Buckets:     m.Buckets,
+		Limit:       m.Limit,
+		Window:      m.Window,
+		Reset:       m.Reset,
+		WindowStart: m.WindowStart,
+		Timestamp:   m.Timestamp,
+	}
+	for _, lv := range m.LabelValues {
+		c.LabelValues = append(c.LabelValues, &LabelValue{Labels: lv.Labels, Value: datum.Copy(lv.Value), Expiry: lv.Expiry})
+	}
+	return c
+}
+
 // newMetric returns a new empty Metric
 func newMetric(len int) *Metric {
 	return &Metric{Keys: make([]string, len),
@@ -123,26 +198,72 @@ func (m *Metric) GetDatum(labelvalues ...string) (d datum.Datum, err error) {
 	defer m.Unlock()
 	if lv := m.FindLabelValueOrNil(labelvalues); lv != nil {
 		d = lv.Value
+	} else if lv := m.evict(); lv != nil {
+		lv.Labels = labelvalues
+		lv.Expiry = 0
+		d = lv.Value
 	} else {
-		switch m.Type {
-		case Int:
-			d = datum.NewInt()
-		case Float:
-			d = datum.NewFloat()
-		case String:
-			d = datum.NewString()
-		case Buckets:
-			buckets := m.Buckets
-			if buckets == nil {
-				buckets = make([]datum.Range, 0)
-			}
-			d = datum.NewBuckets(buckets)
-		}
+		d = m.newDatum()
 		m.LabelValues = append(m.LabelValues, &LabelValue{Labels: labelvalues, Value: d})
 	}
 	return d, nil
 }
 
+// aggregateFuncs are the summaries reported by the aggregate Kinds.
+var aggregateFuncs = map[Kind]datum.AggregateFunc{
+	Min: datum.AggregateMin,
+	Max: datum.AggregateMax,
+	Avg: datum.AggregateAvg,
+}
+
+// newDatum returns a new zero datum of the type of m.
+func (m *Metric) newDatum() datum.Datum {
+	switch m.Type {
+	case Int:
+		return datum.NewInt()
+	case Float:
+		return datum.NewFloat()
+	case String:
+		return datum.NewString()
+	case Buckets:
+		buckets := m.Buckets
+		if buckets == nil {
+			buckets = make([]datum.Range, 0)
+		}
+		return datum.NewBuckets(buckets)
+	case Sketch:
+		return datum.NewSketch(m.Window)
+	case Aggregate:
+		return datum.NewAggregate(aggregateFuncs[m.Kind])
+	}
+	return nil
+}
+
+// evict returns the label value of a full TopK metric with the lowest count,
+// to be replaced by a new one, or nil if there is room for another.
+func (m *Metric) evict() *LabelValue {
+	if m.Kind != TopK || m.Limit <= 0 || len(m.LabelValues) < m.Limit {
+		return nil
+	}
+	min := m.LabelValues[0]
+	for _, lv := range m.LabelValues[1:] {
+		if count(lv.Value) < count(min.Value) {
+			min = lv
+		}
+	}
+	return min
+}
+
+func count(d datum.Datum) float64 {
+	switch d := d.(type) {
+	case *datum.Int:
+		return float64(d.Get())
+	case *datum.Float:
+		return d.Get()
+	}
+	return 0
+}
+
 // RemoveDatum removes the Datum described by labelvalues from the Metric m.
 func (m *Metric) RemoveDatum(labelvalues ...string) error {
 	if len(labelvalues) != len(m.Keys) {
@@ -159,6 +280,7 @@ Loop:
 		}
 		// remove from the slice
 		m.LabelValues = append(m.LabelValues[:i], m.LabelValues[i+1:]...)
+		break
 	}
 	return nil
 }
@@ -236,3 +236,28 @@ func TestRemoveMetricLabelValue(t *testing.T) {
 		t.Errorf("label value still exists")
 	}
 }
+
+func TestTopKEvict(t *testing.T) {
+	m := NewMetric("test", "prog", TopK, Int, "client")
+	m.Limit = 2
+	for _, c := range []string{"a", "a", "a", "b", "c", "c"} {
+		d, err := m.GetDatum(c)
+		testutil.FatalIfErr(t, err)
+		datum.IncIntBy(d, 1, time.Now().UTC())
+	}
+	// c replaced b, the least frequent, and took over its count.
+	if len(m.LabelValues) != 2 {
+		t.Fatalf("expected 2 label values, received %v", m.LabelValues)
+	}
+	for c, expected := range map[string]string{"a": "3", "c": "3"} {
+		lv := m.FindLabelValueOrNil([]string{c})
+		if lv == nil {
+			t.Errorf("no label value for %s", c)
+			continue
+		}
+		testutil.ExpectNoDiff(t, expected, lv.Value.ValueString())
+	}
+	if lv := m.FindLabelValueOrNil([]string{"b"}); lv != nil {
+		t.Errorf("b still kept: %v", lv)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package metrics
+
+import (
+	"expvar"
+	"strings"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/metrics/datum"
+)
+
+// counterResets counts the decreases of counters found between snapshots of
+// the Store, by metric name.
+var counterResets = expvar.NewMap("metric_counter_resets_total")
+
+// counterState is what was seen of one label set of a counter at the last
+// snapshot.
+type counterState struct {
+	last     float64 // The value at the last snapshot, before any correction.
+	offset   float64 // Added to the value to correct the decreases seen.
+	reported bool    // True once a decrease has been logged.
+}
+
+// SetCorrectCounterResets sets whether a counter that has decreased since the
+// last snapshot is corrected, by adding the value it had before the decrease,
+// so that it is exported as never decreasing.  It must be set before the
+// Store is exported.
+func (s *Store) SetCorrectCounterResets(correct bool) {
+	s.correctCounterResets = correct
+}
+
+// checkCounters compares the counters in the snapshot r with the last
+// snapshot.  A counter that has decreased, which a program should never do,
+// is counted as a reset, and corrected in r if the Store is set to.  The
+// caller holds the updates, which guards the counter states.
+func (s *Store) checkCounters(r *Store) {
+	counters := make(map[string]*counterState, len(s.counters))
+	for name, ml := range r.Metrics {
+		for _, m := range ml {
+			// Counters reset every window are meant to decrease.
+			if m.Kind != Counter || m.Reset > 0 {
+				continue
+			}
+			for _, lv := range m.LabelValues {
+				v, ok := counterValue(lv.Value)
+				if !ok {
+					continue
+				}
+				id := m.Program + "\x00" + name + "\x00" + strings.Join(lv.Labels, "\x00")
+				c, ok := s.counters[id]
+				if !ok {
+					c = &counterState{last: v}
+				} else if v < c.last {
+					counterResets.Add(name, 1)
+					if !c.reported {
+						logging.Infof("Counter %s from program %s with labels %q decreased from %v to %v, which is exported as a reset", name, m.Program, lv.Labels, c.last, v)
+						c.reported = true
+					}
+					if s.correctCounterResets {
+						c.offset += c.last
+					}
+				}
+				c.last = v
+				if c.offset != 0 {
+					lv.Value = offsetCounter(lv.Value, c.offset)
+				}
+				counters[id] = c
+			}
+		}
+	}
+	s.counters = counters
+}
+
+// counterValue returns the value of a counter datum.
+func counterValue(d datum.Datum) (float64, bool) {
+	switch d := d.(type) {
+	case *datum.Int:
+		return float64(d.Get()), true
+	case *datum.Float:
+		return d.Get(), true
+	}
+	return 0, false
+}
+
+// offsetCounter returns a datum with the value of d plus offset, and the same
+// timestamp.
+func offsetCounter(d datum.Datum, offset float64) datum.Datum {
+	switch d := d.(type) {
+	case *datum.Int:
+		return datum.MakeInt(d.Get()+int64(offset), d.TimeUTC())
+	case *datum.Float:
+		return datum.MakeFloat(d.Get()+offset, d.TimeUTC())
+	}
+	return d
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package metrics
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// exported returns the value of the label set of the metric called name in a
+// new snapshot of s.
+func exported(t *testing.T, s *Store, name string, labels ...string) int64 {
+	t.Helper()
+	m := s.Snapshot().Metrics[name][0]
+	d, err := m.GetDatum(labels...)
+	testutil.FatalIfErr(t, err)
+	return datum.GetInt(d)
+}
+
+// resets returns the number of resets counted of the metric called name.
+func resets(name string) int64 {
+	if v, ok := counterResets.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestCounterResets(t *testing.T) {
+	for _, correct := range []bool{false, true} {
+		s := NewStore()
+		s.SetCorrectCounterResets(correct)
+		m := NewMetric("requests", "prog", Counter, Int, "code")
+		testutil.FatalIfErr(t, s.Add(m))
+		d, err := m.GetDatum("200")
+		testutil.FatalIfErr(t, err)
+		ts := time.Unix(37, 0)
+
+		before := resets("requests")
+		datum.SetInt(d, 10, ts)
+		testutil.ExpectNoDiff(t, int64(10), exported(t, s, "requests", "200"))
+
+		// The program mistakenly sets the counter back.
+		datum.SetInt(d, 4, ts)
+		expected := int64(4)
+		if correct {
+			expected = 14
+		}
+		testutil.ExpectNoDiff(t, expected, exported(t, s, "requests", "200"))
+		datum.SetInt(d, 6, ts)
+		testutil.ExpectNoDiff(t, expected+2, exported(t, s, "requests", "200"))
+
+		testutil.ExpectNoDiff(t, before+1, resets("requests"))
+
+		// The store itself is left as the program set it.
+		testutil.ExpectNoDiff(t, int64(6), datum.GetInt(d))
+	}
+}
+
+func TestCounterResetsSkipsWindows(t *testing.T) {
+	s := NewStore()
+	s.SetCorrectCounterResets(true)
+	m := NewMetric("requests", "prog", Counter, Int)
+	m.Reset = time.Hour
+	testutil.FatalIfErr(t, s.Add(m))
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 10, time.Unix(37, 0))
+	testutil.ExpectNoDiff(t, int64(10), exported(t, s, "requests"))
+	datum.SetInt(d, 0, time.Unix(37, 0))
+	testutil.ExpectNoDiff(t, int64(0), exported(t, s, "requests"))
+}
@@ -10,7 +10,9 @@ import (
 	"sync"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/pkg/errors"
 )
 
@@ -18,6 +20,13 @@ import (
 type Store struct {
 	sync.RWMutex
 	Metrics map[string][]*Metric
+
+	updateMu sync.RWMutex // Held shared while metrics are updated, and exclusively by Snapshot.
+
+	clock clock.Clock // Times the gc loop and metric expiry, or nil for the system clock.
+
+	counters             map[string]*counterState // The counters seen at the last snapshot, guarded by updateMu.
+	correctCounterResets bool                     // Whether counters that decrease are corrected in snapshots.
 }
 
 // NewStore returns a new metric Store.
@@ -27,11 +36,25 @@ func NewStore() (s *Store) {
 	return
 }
 
+// SetClock sets the clock that metrics expire by, and that the gc loop runs
+// by, instead of the system clock.  It must be set before the gc loop starts.
+func (s *Store) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// getClock returns the Store's clock.
+func (s *Store) getClock() clock.Clock {
+	if s.clock == nil {
+		return clock.Real
+	}
+	return s.clock
+}
+
 // Add is used to add one metric to the Store.
 func (s *Store) Add(m *Metric) error {
 	s.Lock()
 	defer s.Unlock()
-	glog.V(1).Infof("Adding a new metric %v", m)
+	logging.V(1).Infof("Adding a new metric %v", m)
 	dupeIndex := -1
 	if len(s.Metrics[m.Name]) > 0 {
 		t := s.Metrics[m.Name][0].Kind
@@ -54,19 +77,20 @@ func (s *Store) Add(m *Metric) error {
 				continue
 			}
 			dupeIndex = i
-			glog.V(2).Infof("v keys: %v m.keys: %v", v.Keys, m.Keys)
+			logging.V(2).Infof("v keys: %v m.keys: %v", v.Keys, m.Keys)
 			// If a set of label keys has changed, discard
 			// old metric completely, w/o even copying old
 			// data, as they are now incompatible.
 			if len(v.Keys) != len(m.Keys) || !reflect.DeepEqual(v.Keys, m.Keys) {
 				break
 			}
-			glog.V(2).Infof("v buckets: %v m.buckets: %v", v.Buckets, m.Buckets)
+			logging.V(2).Infof("v buckets: %v m.buckets: %v", v.Buckets, m.Buckets)
 
 			// Otherwise, copy everything into the new metric
-			glog.V(2).Infof("Found duped metric: %d", dupeIndex)
+			logging.V(2).Infof("Found duped metric: %d", dupeIndex)
+			m.WindowStart = v.WindowStart
 			for j, oldLabel := range v.LabelValues {
-				glog.V(2).Infof("Labels: %d %s", j, oldLabel.Labels)
+				logging.V(2).Infof("Labels: %d %s", j, oldLabel.Labels)
 				d, err := v.GetDatum(oldLabel.Labels...)
 				if err == nil {
 					if err = m.RemoveDatum(oldLabel.Labels...); err == nil {
@@ -84,6 +108,60 @@ func (s *Store) Add(m *Metric) error {
 	return nil
 }
 
+// BeginUpdate marks the start of a batch of updates to the values of metrics
+// in the Store, such as all the changes made by the programs for one log line.
+// A Snapshot is taken between batches, never during one.  Each BeginUpdate
+// must be followed by an EndUpdate.
+func (s *Store) BeginUpdate() {
+	s.updateMu.RLock()
+}
+
+// EndUpdate marks the end of a batch of updates started by BeginUpdate.
+func (s *Store) EndUpdate() {
+	s.updateMu.RUnlock()
+}
+
+// Snapshot returns a copy of the Store, with the metrics and their values at
+// one instant between batches of updates.  An export made from it is
+// consistent across metrics, such as the sum and count of a histogram, even
+// while lines are being processed.  Updates wait while the copy is made.
+// Counters that have decreased since the last snapshot are counted as
+// resets, and corrected if the Store is set to.
+func (s *Store) Snapshot() *Store {
+	return s.snapshot(false)
+}
+
+// SnapshotAndReset returns a Snapshot of the Store, and resets the Min, Max
+// and Avg metrics in the Store, so that each push of the metrics summarises
+// the values observed since the last one.
+func (s *Store) SnapshotAndReset() *Store {
+	return s.snapshot(true)
+}
+
+func (s *Store) snapshot(reset bool) *Store {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	s.RLock()
+	defer s.RUnlock()
+	r := &Store{Metrics: make(map[string][]*Metric, len(s.Metrics))}
+	for name, ml := range s.Metrics {
+		cl := make([]*Metric, 0, len(ml))
+		for _, m := range ml {
+			cl = append(cl, m.copy())
+			if reset && m.Type == Aggregate {
+				m.RLock()
+				for _, lv := range m.LabelValues {
+					datum.GetAggregate(lv.Value).Reset()
+				}
+				m.RUnlock()
+			}
+		}
+		r.Metrics[name] = cl
+	}
+	s.checkCounters(r)
+	return r
+}
+
 // ClearMetrics empties the store of all metrics.
 func (s *Store) ClearMetrics() {
 	s.Lock()
@@ -103,45 +181,193 @@ func (s *Store) MarshalJSON() (b []byte, err error) {
 }
 
 // Gc iterates through the Store looking for metrics that have been marked
-// for expiry, and removing them if their expiration time has passed.
+// for expiry, and removing them if their expiration time has passed.  The
+// Store is locked for the whole pass, so an export sees each expired label
+// set either present or gone, never a partial removal.
 func (s *Store) Gc() error {
-	glog.Info("Running Store.Expire()")
+	logging.Info("Running Store.Expire()")
 	s.Lock()
 	defer s.Unlock()
-	now := time.Now()
+	now := s.getClock().Now()
 	for _, ml := range s.Metrics {
 		for _, m := range ml {
+			m.Lock()
+			lvs := m.LabelValues[:0]
 			for _, lv := range m.LabelValues {
-				if lv.Expiry <= 0 {
+				if lv.Expiry > 0 && now.Sub(lv.Value.TimeUTC()) > lv.Expiry {
 					continue
 				}
-				if now.Sub(lv.Value.TimeUTC()) > lv.Expiry {
-					err := m.RemoveDatum(lv.Labels...)
-					if err != nil {
-						return err
-					}
-				}
+				lvs = append(lvs, lv)
 			}
+			for i := len(lvs); i < len(m.LabelValues); i++ {
+				m.LabelValues[i] = nil
+			}
+			m.LabelValues = lvs
+			m.Unlock()
 		}
 	}
 	return nil
 }
 
+// PreviousSuffix is appended to the name of a metric that is reset every
+// window, to name the metric holding its values from the last window.
+const PreviousSuffix = "_previous"
+
+// resetCheckInterval is how often the reset loop looks for metrics whose
+// reset window has ended.
+const resetCheckInterval = time.Second
+
+// ResetWindows resets to zero each metric whose reset window has ended,
+// moving the values it had into the metric of the same name with
+// PreviousSuffix, which is created the first time.  Windows start at
+// multiples of the metric's Reset duration, so an hourly metric is reset on
+// the hour.  Updates wait while the metrics are reset, so the values of a
+// line are all counted in the same window.
+func (s *Store) ResetWindows() {
+	now := s.getClock().Now()
+	if !s.windowEnded(now) {
+		return
+	}
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	s.Lock()
+	defer s.Unlock()
+	var windowed []*Metric
+	for _, ml := range s.Metrics {
+		for _, m := range ml {
+			if m.Reset > 0 {
+				windowed = append(windowed, m)
+			}
+		}
+	}
+	for _, m := range windowed {
+		m.Lock()
+		start := now.Truncate(m.Reset)
+		switch {
+		case m.WindowStart.IsZero():
+			m.WindowStart = start
+		case start.After(m.WindowStart):
+			s.reset(m, start)
+		}
+		m.Unlock()
+	}
+}
+
+// windowEnded reports whether the reset window of any metric has ended at
+// now, so that most checks don't hold up updates.
+func (s *Store) windowEnded(now time.Time) bool {
+	s.RLock()
+	defer s.RUnlock()
+	for _, ml := range s.Metrics {
+		for _, m := range ml {
+			m.RLock()
+			ended := m.Reset > 0 && (m.WindowStart.IsZero() || now.Truncate(m.Reset).After(m.WindowStart))
+			m.RUnlock()
+			if ended {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reset starts a new window of m at start, keeping the values of the last
+// window in its previous metric.  The Store and m are locked by the caller.
+func (s *Store) reset(m *Metric, start time.Time) {
+	zero := make([]*LabelValue, 0, len(m.LabelValues))
+	for _, lv := range m.LabelValues {
+		zero = append(zero, &LabelValue{Labels: lv.Labels, Value: m.newDatum(), Expiry: lv.Expiry})
+	}
+	previous := m.LabelValues
+	// If the whole of the last window passed without a reset, nothing was
+	// counted in it.
+	if start.Sub(m.WindowStart) > m.Reset {
+		previous = make([]*LabelValue, 0, len(zero))
+		for _, lv := range zero {
+			previous = append(previous, &LabelValue{Labels: lv.Labels, Value: m.newDatum(), Expiry: lv.Expiry})
+		}
+	}
+	m.LabelValues = zero
+	m.WindowStart = start
+
+	name := m.Name + PreviousSuffix
+	var p *Metric
+	for _, pm := range s.Metrics[name] {
+		if pm.Program == m.Program {
+			p = pm
+		}
+	}
+	if p == nil {
+		// The last window's value of a counter isn't monotonic, so it is
+		// exported as a gauge.
+		kind := Gauge
+		if m.Kind == Histogram {
+			kind = Histogram
+		}
+		p = NewMetric(name, m.Program, kind, m.Type, m.Keys...)
+		p.Source = m.Source
+		p.Hidden = m.Hidden
+		p.Buckets = m.Buckets
+		p.Timestamp = m.Timestamp
+		s.Metrics[name] = append(s.Metrics[name], p)
+	}
+	p.Lock()
+	p.LabelValues = previous
+	p.Unlock()
+}
+
+// StartResetLoop runs a permanent goroutine that resets the metrics declared
+// to reset every window, as their windows end.
+func (s *Store) StartResetLoop(ctx context.Context) {
+	ticker := s.getClock().NewTicker(resetCheckInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				s.ResetWindows()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// RemoveProgram removes all the metrics defined by the named program from the
+// Store, so they are no longer exported once the program is unloaded.
+func (s *Store) RemoveProgram(name string) {
+	s.Lock()
+	defer s.Unlock()
+	for n, ml := range s.Metrics {
+		kept := ml[:0]
+		for _, m := range ml {
+			if m.Program != name {
+				kept = append(kept, m)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.Metrics, n)
+			continue
+		}
+		s.Metrics[n] = kept
+	}
+}
+
 // StartGcLoop runs a permanent goroutine to expire metrics every duration.
 func (s *Store) StartGcLoop(ctx context.Context, duration time.Duration) {
 	if duration <= 0 {
-		glog.Infof("Metric store expiration disabled")
+		logging.Infof("Metric store expiration disabled")
 		return
 	}
+	ticker := s.getClock().NewTicker(duration)
 	go func() {
-		glog.Infof("Starting metric store expiry loop every %s", duration.String())
-		ticker := time.NewTicker(duration)
+		logging.Infof("Starting metric store expiry loop every %s", duration.String())
 		defer ticker.Stop()
 		for {
 			select {
-			case <-ticker.C:
+			case <-ticker.C():
 				if err := s.Gc(); err != nil {
-					glog.Info(err)
+					logging.Info(err)
 				}
 			case <-ctx.Done():
 				return
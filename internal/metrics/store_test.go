@@ -4,10 +4,12 @@
 package metrics
 
 import (
+	"context"
 	"testing"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/testutil"
 )
@@ -35,27 +37,27 @@ func TestDuplicateMetric(t *testing.T) {
 	}
 
 	_ = s.Add(NewMetric("foo", "prog", Counter, Float))
-	glog.Infof("Store: %v", s)
+	logging.Infof("Store: %v", s)
 	expectedMetrics++
 	if len(s.Metrics["foo"]) != expectedMetrics {
 		t.Fatalf("should add metric of a different type: %v", s)
 	}
 
 	_ = s.Add(NewMetric("foo", "prog", Counter, Int, "user", "host", "zone", "domain"))
-	glog.Infof("Store: %v", s)
+	logging.Infof("Store: %v", s)
 	if len(s.Metrics["foo"]) != expectedMetrics {
 		t.Fatalf("should not add duplicate metric, but replace the old one. Store: %v", s)
 	}
 
 	_ = s.Add(NewMetric("foo", "prog1", Counter, Int))
-	glog.Infof("Store: %v", s)
+	logging.Infof("Store: %v", s)
 	expectedMetrics++
 	if len(s.Metrics["foo"]) != expectedMetrics {
 		t.Fatalf("should add metric with a different prog: %v", s)
 	}
 
 	_ = s.Add(NewMetric("foo", "prog1", Counter, Float))
-	glog.Infof("Store: %v", s)
+	logging.Infof("Store: %v", s)
 	expectedMetrics++
 	if len(s.Metrics["foo"]) != expectedMetrics {
 		t.Fatalf("should add metric of a different type: %v", s)
@@ -124,3 +126,166 @@ func TestExpireMetric(t *testing.T) {
 		t.Logf("Store: %#v", s)
 	}
 }
+
+func TestExpireAdjacentMetrics(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int, "a")
+	testutil.FatalIfErr(t, s.Add(m))
+	for _, l := range []string{"1", "2", "3", "4"} {
+		d, err := m.GetDatum(l)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, 1, time.Now().Add(-time.Hour))
+		if l != "4" {
+			testutil.FatalIfErr(t, m.ExpireDatum(time.Minute, l))
+		}
+	}
+
+	testutil.FatalIfErr(t, s.Gc())
+	var remaining [][]string
+	for _, lv := range m.LabelValues {
+		remaining = append(remaining, lv.Labels)
+	}
+	testutil.ExpectNoDiff(t, [][]string{{"4"}}, remaining)
+}
+
+func TestRemoveProgram(t *testing.T) {
+	s := NewStore()
+	testutil.FatalIfErr(t, s.Add(NewMetric("foo", "a", Counter, Int)))
+	testutil.FatalIfErr(t, s.Add(NewMetric("foo", "b", Counter, Int)))
+	testutil.FatalIfErr(t, s.Add(NewMetric("bar", "a", Gauge, Int)))
+
+	s.RemoveProgram("a")
+	if _, ok := s.Metrics["bar"]; ok {
+		t.Errorf("bar not removed: %v", s.Metrics)
+	}
+	if len(s.Metrics["foo"]) != 1 || s.Metrics["foo"][0].Program != "b" {
+		t.Errorf("expected only foo from b to remain: %v", s.Metrics["foo"])
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s := NewStore()
+	m := NewMetric("foo", "prog", Counter, Int, "a")
+	testutil.FatalIfErr(t, s.Add(m))
+	d, err := m.GetDatum("1")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, time.Unix(1600000000, 0))
+
+	snap := s.Snapshot()
+	datum.SetInt(d, 2, time.Unix(1600000001, 0))
+	_, err = m.GetDatum("2")
+	testutil.FatalIfErr(t, err)
+
+	sm := snap.Metrics["foo"][0]
+	if len(sm.LabelValues) != 1 {
+		t.Fatalf("snapshot has label values %v, expected only the first", sm.LabelValues)
+	}
+	testutil.ExpectNoDiff(t, int64(1), datum.GetInt(sm.LabelValues[0].Value))
+	testutil.ExpectNoDiff(t, time.Unix(1600000000, 0), sm.LabelValues[0].Value.TimeUTC())
+}
+
+func TestSnapshotConsistent(t *testing.T) {
+	s := NewStore()
+	count := NewMetric("count", "prog", Counter, Int)
+	sum := NewMetric("sum", "prog", Counter, Int)
+	testutil.FatalIfErr(t, s.Add(count))
+	testutil.FatalIfErr(t, s.Add(sum))
+	c, err := count.GetDatum()
+	testutil.FatalIfErr(t, err)
+	d, err := sum.GetDatum()
+	testutil.FatalIfErr(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10000; i++ {
+			s.BeginUpdate()
+			datum.IncIntBy(c, 1, time.Time{})
+			datum.IncIntBy(d, 2, time.Time{})
+			s.EndUpdate()
+		}
+	}()
+	for {
+		snap := s.Snapshot()
+		n := datum.GetInt(snap.Metrics["count"][0].LabelValues[0].Value)
+		total := datum.GetInt(snap.Metrics["sum"][0].LabelValues[0].Value)
+		if total != 2*n {
+			t.Fatalf("snapshot mixes updates: count %d, sum %d", n, total)
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+	}
+}
+
+func TestStoreGcLoop(t *testing.T) {
+	c := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := NewStore()
+	s.SetClock(c)
+	m := NewMetric("foo", "prog", Counter, Int, "a")
+	testutil.FatalIfErr(t, s.Add(m))
+	d, err := m.GetDatum("1")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, c.Now())
+	testutil.FatalIfErr(t, m.ExpireDatum(time.Hour, "1"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.StartGcLoop(ctx, time.Minute)
+
+	// The datum outlives its expiry, and the next gc removes it.
+	c.Advance(61 * time.Minute)
+	ok, err := testutil.DoOrTimeout(func() (bool, error) {
+		m.RLock()
+		defer m.RUnlock()
+		return len(m.LabelValues) == 0, nil
+	}, 5*time.Second, time.Millisecond)
+	testutil.FatalIfErr(t, err)
+	if !ok {
+		t.Error("expired datum not removed")
+	}
+}
+
+func TestResetWindows(t *testing.T) {
+	c := clock.NewFake(time.Date(2020, 1, 1, 10, 30, 0, 0, time.UTC))
+	s := NewStore()
+	s.SetClock(c)
+	m := NewMetric("reqs", "prog", Counter, Int, "code")
+	m.Reset = time.Hour
+	testutil.FatalIfErr(t, s.Add(m))
+	d, err := m.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 3, c.Now())
+
+	// The first check starts the window, and a check within it does nothing.
+	s.ResetWindows()
+	c.Advance(20 * time.Minute)
+	s.ResetWindows()
+	testutil.ExpectNoDiff(t, int64(3), datum.GetInt(d))
+	if _, ok := s.Metrics["reqs"+PreviousSuffix]; ok {
+		t.Error("previous window exported before one ended")
+	}
+
+	// At the end of the hour the value moves to the previous metric.
+	c.Advance(10 * time.Minute)
+	s.ResetWindows()
+	d, err = m.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, int64(0), datum.GetInt(d))
+	p := s.Metrics["reqs"+PreviousSuffix][0]
+	testutil.ExpectNoDiff(t, Gauge, p.Kind)
+	pd, err := p.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, int64(3), datum.GetInt(pd))
+
+	// A window that ended without a reset counted nothing.
+	datum.SetInt(d, 5, c.Now())
+	c.Advance(2 * time.Hour)
+	s.ResetWindows()
+	pd, err = p.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, int64(0), datum.GetInt(pd))
+	testutil.ExpectNoDiff(t, 1, len(s.Metrics["reqs"+PreviousSuffix]))
+}
@@ -15,6 +15,10 @@ const (
 	String
 	// Buckets indicates this metric is a histogram metric type.
 	Buckets
+	// Sketch indicates this metric is a distinct count metric type.
+	Sketch
+	// Aggregate indicates this metric is a min, max or avg metric type.
+	Aggregate
 )
 
 func (t Type) String() string {
@@ -27,6 +31,10 @@ func (t Type) String() string {
 		return "String"
 	case Buckets:
 		return "Buckets"
+	case Sketch:
+		return "Sketch"
+	case Aggregate:
+		return "Aggregate"
 	}
 	return "?"
 }
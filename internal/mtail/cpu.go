@@ -0,0 +1,273 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"expvar"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/logline"
+	"github.com/pkg/errors"
+)
+
+// cpuThrottled counts the time lines were held back to keep within the CPU
+// limit.
+var cpuThrottled = expvar.NewFloat("cpu_throttled_seconds_total")
+
+const (
+	cpuThrottleCheckLines = 32                     // How many lines are processed between checks of the CPU time used.
+	cpuThrottleWindow     = time.Second            // How long the CPU time used is measured over.
+	cpuThrottleMaxDelay   = 250 * time.Millisecond // The longest a line is held back at once.
+)
+
+// GOMAXPROCSFromCgroup sets GOMAXPROCS to the number of CPUs the cgroup CPU
+// quota of the process allows, rounded up, so that the Go runtime doesn't run
+// more threads than the quota can schedule.  GOMAXPROCS set in the
+// environment takes precedence.
+var GOMAXPROCSFromCgroup = &niladicOption{
+	func(m *Server) error {
+		m.gomaxprocsFromCgroup = true
+		return nil
+	}}
+
+// CPULimit sets the Server to hold back lines from the programs whenever it
+// has used more than percent of one CPU's time, so that a log storm can't take
+// the CPU from the services being monitored.
+type CPULimit float64
+
+func (opt CPULimit) apply(m *Server) error {
+	if opt <= 0 {
+		return errors.New("CPU limit must be a positive percentage")
+	}
+	if _, err := processCPUTime(); err != nil {
+		return errors.Wrap(err, "can't limit CPU use")
+	}
+	m.cpuLimit = float64(opt) / 100
+	return nil
+}
+
+// Niceness sets the scheduling priority of the process to the nice value
+// given, from -20 for the most favourable to 19 for the least.  Only a
+// privileged process may lower its nice value.
+type Niceness int
+
+func (opt Niceness) apply(m *Server) error {
+	if opt < -20 || opt > 19 {
+		return errors.Errorf("nice value %d is not between -20 and 19", opt)
+	}
+	n := int(opt)
+	m.niceness = &n
+	return nil
+}
+
+// limitCPU sets GOMAXPROCS and the scheduling priority as requested.  It is
+// called before privileges are dropped, so that a privileged process may
+// raise its priority.
+func (m *Server) limitCPU() error {
+	if m.gomaxprocsFromCgroup {
+		switch cpus, ok := cgroupCPULimit("/sys/fs/cgroup", "/proc/self/cgroup"); {
+		case os.Getenv("GOMAXPROCS") != "":
+			logging.Infof("GOMAXPROCS is set in the environment; leaving it at %d", runtime.GOMAXPROCS(0))
+		case !ok:
+			logging.Infof("No cgroup CPU quota found; leaving GOMAXPROCS at %d", runtime.GOMAXPROCS(0))
+		default:
+			n := int(math.Ceil(cpus))
+			if n < 1 {
+				n = 1
+			}
+			if n > runtime.NumCPU() {
+				n = runtime.NumCPU()
+			}
+			logging.Infof("Setting GOMAXPROCS to %d for a cgroup CPU quota of %g CPUs", n, cpus)
+			runtime.GOMAXPROCS(n)
+		}
+	}
+	if m.niceness != nil {
+		logging.Infof("Setting nice value to %d", *m.niceness)
+		if err := setNice(*m.niceness); err != nil {
+			return errors.Wrap(err, "failed to set scheduling priority")
+		}
+	}
+	return nil
+}
+
+// cgroupCPULimit returns the number of CPUs the cgroup CPU quotas of the
+// process allow it, reading the cgroups it is in from cgroupFile and the
+// quotas from the cgroup filesystem mounted at root, and true; or false if
+// no quota is set.  Both cgroup v1 and v2 are read.  The quota of a cgroup
+// limits its descendants too, so the smallest along each path is taken.
+func cgroupCPULimit(root, cgroupFile string) (float64, bool) {
+	b, err := ioutil.ReadFile(cgroupFile)
+	if err != nil {
+		return 0, false
+	}
+	limit, found := math.Inf(1), false
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		// Each line is hierarchy-ID:controller-list:cgroup-path.
+		parts := strings.SplitN(s.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		var base string
+		var read func(dir string) (float64, bool)
+		switch {
+		case parts[0] == "0" && parts[1] == "":
+			base, read = root, readCPUMax
+		case hasController(parts[1], "cpu"):
+			base, read = filepath.Join(root, "cpu"), readCFSQuota
+		default:
+			continue
+		}
+		// The path is as seen from the root of the hierarchy, which inside
+		// a container may not be where it is mounted, so each directory up
+		// from it that exists is read.
+		for p := path.Clean("/" + parts[2]); ; p = path.Dir(p) {
+			if cpus, ok := read(filepath.Join(base, filepath.FromSlash(p))); ok {
+				limit, found = math.Min(limit, cpus), true
+			}
+			if p == "/" {
+				break
+			}
+		}
+	}
+	return limit, found
+}
+
+// hasController reports whether the comma separated list of cgroup v1
+// controllers includes c.
+func hasController(list, c string) bool {
+	for _, l := range strings.Split(list, ",") {
+		if l == c {
+			return true
+		}
+	}
+	return false
+}
+
+// readCPUMax reads the cgroup v2 CPU quota of the cgroup at dir, from
+// cpu.max, which holds the quota and period in microseconds, or "max" for the
+// quota if there is none.
+func readCPUMax(dir string) (float64, bool) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "cpu.max"))
+	if err != nil {
+		return 0, false
+	}
+	f := strings.Fields(string(b))
+	if len(f) != 2 || f[0] == "max" {
+		return 0, false
+	}
+	return quota(f[0], f[1])
+}
+
+// readCFSQuota reads the cgroup v1 CPU quota of the cgroup at dir, from
+// cpu.cfs_quota_us, which is -1 if there is none, and cpu.cfs_period_us.
+func readCFSQuota(dir string) (float64, bool) {
+	q, err := ioutil.ReadFile(filepath.Join(dir, "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0, false
+	}
+	p, err := ioutil.ReadFile(filepath.Join(dir, "cpu.cfs_period_us"))
+	if err != nil {
+		return 0, false
+	}
+	return quota(strings.TrimSpace(string(q)), strings.TrimSpace(string(p)))
+}
+
+// quota returns the CPUs allowed by a quota of q microseconds in each period
+// of p microseconds, and false if either is not positive.
+func quota(q, p string) (float64, bool) {
+	qv, err := strconv.ParseFloat(q, 64)
+	if err != nil || qv <= 0 {
+		return 0, false
+	}
+	pv, err := strconv.ParseFloat(p, 64)
+	if err != nil || pv <= 0 {
+		return 0, false
+	}
+	return qv / pv, true
+}
+
+// cpuThrottle passes lines on to the programs, and holds back the next line
+// whenever mtail has used more than its limit of CPU time over the last
+// cpuThrottleWindow.  Held back lines stay unread in their logs, so none are
+// lost, but they are processed later.
+type cpuThrottle struct {
+	next    logline.Processor
+	limit   float64                              // The share of one CPU's time that may be used.
+	cpuTime func() (time.Duration, error)        // Returns the CPU time used by the process.
+	now     func() time.Time                     // Returns the current time.
+	sleep   func(context.Context, time.Duration) // Waits for the time given, or until the context is done.
+
+	lines uint32 // The lines processed, updated atomically.
+
+	mu       sync.Mutex
+	start    time.Time     // When the current window started.
+	startCPU time.Duration // The CPU time used when the current window started.
+}
+
+func newCPUThrottle(next logline.Processor, limit float64) *cpuThrottle {
+	return &cpuThrottle{next: next, limit: limit, cpuTime: processCPUTime, now: time.Now, sleep: sleepContext}
+}
+
+// ProcessLogLine implements the logline.Processor interface.
+func (c *cpuThrottle) ProcessLogLine(ctx context.Context, ll *logline.LogLine) {
+	c.next.ProcessLogLine(ctx, ll)
+	if atomic.AddUint32(&c.lines, 1)%cpuThrottleCheckLines != 0 {
+		return
+	}
+	if d := c.delay(); d > 0 {
+		cpuThrottled.Add(d.Seconds())
+		c.sleep(ctx, d)
+	}
+}
+
+// delay returns how long to wait for the CPU time used in the current window
+// to fall back within the limit.
+func (c *cpuThrottle) delay() time.Duration {
+	used, err := c.cpuTime()
+	if err != nil {
+		return 0
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.start.IsZero() {
+		c.start, c.startCPU = now, used
+		return 0
+	}
+	elapsed := now.Sub(c.start)
+	d := time.Duration(float64(used-c.startCPU)/c.limit) - elapsed
+	if elapsed >= cpuThrottleWindow {
+		c.start, c.startCPU = now, used
+	}
+	if d > cpuThrottleMaxDelay {
+		d = cpuThrottleMaxDelay
+	}
+	return d
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func writeCgroupFile(t *testing.T, name, contents string) {
+	t.Helper()
+	testutil.FatalIfErr(t, os.MkdirAll(filepath.Dir(name), 0o755))
+	testutil.FatalIfErr(t, ioutil.WriteFile(name, []byte(contents), 0o644))
+}
+
+func TestCgroupCPULimit(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cgroup  string
+		files   map[string]string
+		cpus    float64
+		limited bool
+	}{
+		{
+			name:   "v2",
+			cgroup: "0::/system.slice/mtail.service\n",
+			files: map[string]string{
+				"system.slice/mtail.service/cpu.max": "150000 100000\n",
+				"system.slice/cpu.max":               "max 100000\n",
+			},
+			cpus:    1.5,
+			limited: true,
+		},
+		{
+			name:    "v2 parent",
+			cgroup:  "0::/system.slice/mtail.service\n",
+			files:   map[string]string{"system.slice/cpu.max": "50000 100000\n"},
+			cpus:    0.5,
+			limited: true,
+		},
+		{
+			name:   "v2 unlimited",
+			cgroup: "0::/\n",
+			files:  map[string]string{"cpu.max": "max 100000\n"},
+		},
+		{
+			name:   "v1",
+			cgroup: "4:memory:/docker/abc\n3:cpu,cpuacct:/docker/abc\n0::/\n",
+			files: map[string]string{
+				// Mounted from within the container, so the path isn't there.
+				"cpu/cpu.cfs_quota_us":  "200000\n",
+				"cpu/cpu.cfs_period_us": "100000\n",
+			},
+			cpus:    2,
+			limited: true,
+		},
+		{
+			name:   "v1 unlimited",
+			cgroup: "3:cpu,cpuacct:/\n",
+			files: map[string]string{
+				"cpu/cpu.cfs_quota_us":  "-1\n",
+				"cpu/cpu.cfs_period_us": "100000\n",
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			root, rmRoot := testutil.TestTempDir(t)
+			defer rmRoot()
+			for name, contents := range tc.files {
+				writeCgroupFile(t, filepath.Join(root, "fs", name), contents)
+			}
+			cgroupFile := filepath.Join(root, "cgroup")
+			writeCgroupFile(t, cgroupFile, tc.cgroup)
+			cpus, ok := cgroupCPULimit(filepath.Join(root, "fs"), cgroupFile)
+			testutil.ExpectNoDiff(t, tc.limited, ok)
+			if ok {
+				testutil.ExpectNoDiff(t, tc.cpus, cpus)
+			}
+		})
+	}
+}
+
+type countingProcessor int
+
+func (c *countingProcessor) ProcessLogLine(context.Context, *logline.LogLine) {
+	*c++
+}
+
+func TestCPUThrottle(t *testing.T) {
+	var lines countingProcessor
+	c := newCPUThrottle(&lines, 0.5)
+	now := time.Unix(37, 0)
+	var used time.Duration
+	var slept []time.Duration
+	c.now = func() time.Time { return now }
+	c.cpuTime = func() (time.Duration, error) { return used, nil }
+	c.sleep = func(_ context.Context, d time.Duration) {
+		slept = append(slept, d)
+		now = now.Add(d)
+	}
+	process := func() {
+		for i := 0; i < cpuThrottleCheckLines; i++ {
+			c.ProcessLogLine(context.Background(), logline.New(context.Background(), "log", "line"))
+		}
+	}
+
+	// The first check starts the window.
+	process()
+	// Within the limit, the lines aren't held back.
+	now, used = now.Add(100*time.Millisecond), used+40*time.Millisecond
+	process()
+	// Over it, they are held back until the CPU time used is within the
+	// limit of the time passed.
+	now, used = now.Add(100*time.Millisecond), used+80*time.Millisecond
+	process()
+	testutil.ExpectNoDiff(t, []time.Duration{40 * time.Millisecond}, slept)
+	// But for no longer than cpuThrottleMaxDelay at once.
+	used += time.Second
+	process()
+	testutil.ExpectNoDiff(t, []time.Duration{40 * time.Millisecond, cpuThrottleMaxDelay}, slept)
+	testutil.ExpectNoDiff(t, 4*cpuThrottleCheckLines, int(lines))
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package mtail
+
+import (
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// processCPUTime returns the user and system CPU time used by the process.
+func processCPUTime() (time.Duration, error) {
+	var ru unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &ru); err != nil {
+		return 0, err
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), nil
+}
+
+// setNice sets the nice value of the process.  Linux sets the priority of
+// each thread on its own, so where /proc lists the threads of the process
+// each is set; threads started later take the priority of the thread that
+// starts them.
+func setNice(n int) error {
+	if err := unix.Setpriority(unix.PRIO_PROCESS, 0, n); err != nil {
+		return err
+	}
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return nil
+	}
+	for _, t := range tasks {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			continue
+		}
+		// A thread may have exited since it was listed.
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, n); err != nil && err != unix.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func processCPUTime() (time.Duration, error) {
+	return 0, errors.New("measuring CPU time is not supported on windows")
+}
+
+func setNice(n int) error {
+	return errors.New("setting the nice value is not supported on windows")
+}
@@ -0,0 +1,291 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/tailer"
+	"github.com/google/mtail/internal/vm"
+)
+
+const (
+	dashboardSampleInterval = time.Second // The shortest time metric rates are measured over.
+	dashboardTopMetrics     = 10          // How many of the metrics updated fastest are shown.
+)
+
+// dashboardPage is the dashboard, which fetches /dashboard/data and shows it,
+// refreshing every few seconds.  It is self-contained so that it needs
+// nothing but mtail to be served.
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mtail dashboard</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; vertical-align: top; }
+th { background: #f0f0f0; }
+td.num { text-align: right; }
+pre { margin: 0; white-space: pre-wrap; max-width: 60em; }
+.ok { color: #080; }
+.bad { color: #c00; font-weight: bold; }
+#updated { color: #888; }
+</style>
+</head>
+<body>
+<h1>mtail <span id="status"></span></h1>
+<p id="updated">Loading&hellip;</p>
+<h2>Components</h2>
+<table><thead><tr><th>component</th><th>ready</th><th>wedged</th><th>errors</th><th>last activity</th><th>message</th></tr></thead><tbody id="components"></tbody></table>
+<h2>Programs</h2>
+<table><thead><tr><th>program</th><th>version</th><th>loaded</th><th>loads</th><th>load errors</th><th>runtime errors</th><th>last match</th><th>last error</th></tr></thead><tbody id="programs"></tbody></table>
+<h2>Logs</h2>
+<table><thead><tr><th>log</th><th>type</th><th>open</th><th>offset</th><th>size</th><th>lines</th><th>rotations</th><th>truncations</th><th>read errors</th><th>last read</th></tr></thead><tbody id="logs"></tbody></table>
+<h2>Metrics updated fastest</h2>
+<table><thead><tr><th>metric</th><th>program</th><th>kind</th><th>updates per second</th></tr></thead><tbody id="metrics"></tbody></table>
+<h2>Recent warnings and errors</h2>
+<table><thead><tr><th>time</th><th>severity</th><th>message</th></tr></thead><tbody id="errors"></tbody></table>
+<script>
+"use strict";
+function ago(t) {
+  var d = new Date(t);
+  if (isNaN(d) || d.getFullYear() < 1971) { return "never"; }
+  var s = Math.round((Date.now() - d) / 1000);
+  if (s < 120) { return s + "s ago"; }
+  if (s < 7200) { return Math.round(s / 60) + "m ago"; }
+  return d.toLocaleString();
+}
+function cell(row, value, cls, pre) {
+  var td = document.createElement("td");
+  if (cls) { td.className = cls; }
+  if (pre) {
+    var p = document.createElement("pre");
+    p.textContent = value;
+    td.appendChild(p);
+  } else {
+    td.textContent = value;
+  }
+  row.appendChild(td);
+}
+function fill(id, items, render) {
+  var body = document.getElementById(id);
+  body.textContent = "";
+  (items || []).forEach(function(item) {
+    var row = document.createElement("tr");
+    render(row, item);
+    body.appendChild(row);
+  });
+}
+function yes(b) { return b ? "yes" : "no"; }
+function refresh() {
+  fetch("/dashboard/data").then(function(r) { return r.json(); }).then(function(d) {
+    var status = document.getElementById("status");
+    status.textContent = d.status;
+    status.className = d.status === "ok" ? "ok" : "bad";
+    fill("components", d.components, function(row, c) {
+      cell(row, c.component);
+      cell(row, yes(c.ready), c.ready ? "ok" : "bad");
+      cell(row, yes(c.wedged), c.wedged ? "bad" : "ok");
+      cell(row, c.errors, "num");
+      cell(row, ago(c.last_activity));
+      cell(row, c.message || "");
+    });
+    fill("programs", d.programs, function(row, p) {
+      cell(row, p.name);
+      cell(row, p.version || "");
+      cell(row, yes(p.loaded), p.loaded ? "ok" : "bad");
+      cell(row, p.loads, "num");
+      cell(row, p.load_errors, p.load_errors ? "num bad" : "num");
+      cell(row, p.runtime_errors, p.runtime_errors ? "num bad" : "num");
+      cell(row, p.loaded ? ago(p.last_match) : "");
+      cell(row, p.compile_error || p.last_runtime_error || "", "", true);
+    });
+    fill("logs", d.logs, function(row, l) {
+      cell(row, l.name);
+      cell(row, l.type);
+      cell(row, yes(l.open));
+      cell(row, l.offset, "num");
+      cell(row, l.size, "num");
+      cell(row, l.lines, "num");
+      cell(row, l.rotations, "num");
+      cell(row, l.truncations, "num");
+      cell(row, l.read_errors, l.read_errors ? "num bad" : "num");
+      cell(row, ago(l.last_read));
+    });
+    fill("metrics", d.metrics, function(row, m) {
+      cell(row, m.name);
+      cell(row, m.program);
+      cell(row, m.kind);
+      cell(row, m.rate.toPrecision(3), "num");
+    });
+    fill("errors", (d.errors || []).slice().reverse(), function(row, e) {
+      cell(row, new Date(e.time).toLocaleString());
+      cell(row, e.severity, "bad");
+      cell(row, e.message, "", true);
+    });
+    document.getElementById("updated").textContent = "Updated " + new Date().toLocaleTimeString() + ".";
+  }).catch(function(err) {
+    document.getElementById("updated").textContent = "Failed to fetch the dashboard: " + err;
+  });
+}
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
+
+// dashboardData is what the dashboard shows, served as JSON.
+type dashboardData struct {
+	Status     string             `json:"status"`
+	Components []componentHealth  `json:"components"`
+	Programs   []vm.ProgramStatus `json:"programs"`
+	Logs       []tailer.LogStats  `json:"logs"`
+	Metrics    []metricRate       `json:"metrics"`
+	Errors     []logging.Entry    `json:"errors"`
+}
+
+// metricRate is how fast a metric is being updated.
+type metricRate struct {
+	Name    string  `json:"name"`
+	Program string  `json:"program"`
+	Kind    string  `json:"kind"`
+	Rate    float64 `json:"rate"`
+}
+
+// metricRates measures how fast each metric is updated between the samples
+// taken as the dashboard is refreshed.  A counter's rate is how fast it
+// increases, and a histogram's how fast it is observed; for the other kinds,
+// it is how many label sets are changed per second.
+type metricRates struct {
+	mu       sync.Mutex
+	last     map[string]float64 // The totals of the counters and histograms at the last sample, by program and name.
+	lastTime time.Time          // When the last sample was taken.
+	rates    []metricRate       // The rates measured at the last sample, fastest first.
+}
+
+// sample measures the rates of the metrics in store since the last sample,
+// and returns the fastest.  Samples closer together than
+// dashboardSampleInterval return the rates of the last.
+func (r *metricRates) sample(store *metrics.Store, now time.Time) []metricRate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.lastTime.IsZero() && now.Sub(r.lastTime) < dashboardSampleInterval {
+		return r.rates
+	}
+	elapsed := now.Sub(r.lastTime).Seconds()
+	totals := make(map[string]float64)
+	var rates []metricRate
+	for name, ml := range store.Snapshot().Metrics {
+		for _, m := range ml {
+			if m.Hidden {
+				continue
+			}
+			id := m.Program + "\x00" + name
+			n, cumulative := updates(m, r.lastTime)
+			if cumulative {
+				totals[id] = n
+				// A counter that has started over, or a new one, has
+				// increased by its whole value.
+				if last, ok := r.last[id]; ok && n >= last {
+					n -= last
+				}
+			}
+			if r.lastTime.IsZero() || n <= 0 {
+				continue
+			}
+			rates = append(rates, metricRate{Name: name, Program: m.Program, Kind: m.Kind.String(), Rate: n / elapsed})
+		}
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].Rate != rates[j].Rate {
+			return rates[i].Rate > rates[j].Rate
+		}
+		if rates[i].Name != rates[j].Name {
+			return rates[i].Name < rates[j].Name
+		}
+		return rates[i].Program < rates[j].Program
+	})
+	if len(rates) > dashboardTopMetrics {
+		rates = rates[:dashboardTopMetrics]
+	}
+	r.last, r.lastTime, r.rates = totals, now, rates
+	return rates
+}
+
+// updates returns the total of the values of a counter, or the observations
+// of a histogram, with true; or, for other kinds, the label sets of m changed
+// since the time given, with false.
+func updates(m *metrics.Metric, since time.Time) (float64, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	var n float64
+	switch m.Kind {
+	case metrics.Counter, metrics.Histogram:
+		for _, lv := range m.LabelValues {
+			switch d := lv.Value.(type) {
+			case *datum.Int:
+				n += float64(d.Get())
+			case *datum.Float:
+				n += d.Get()
+			case *datum.Buckets:
+				n += float64(d.GetCount())
+			}
+		}
+		return n, true
+	}
+	for _, lv := range m.LabelValues {
+		if lv.Value.TimeUTC().After(since) {
+			n++
+		}
+	}
+	return n, false
+}
+
+// dashboardHandler serves the dashboard.
+func (m *Server) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := w.Write([]byte(dashboardPage)); err != nil {
+		logging.Warning(err)
+	}
+}
+
+// dashboardDataHandler serves what the dashboard shows as JSON.
+func (m *Server) dashboardDataHandler(w http.ResponseWriter, r *http.Request) {
+	report, healthy, ready := m.checkHealth()
+	d := dashboardData{
+		Status:     "ok",
+		Components: report.Components,
+		Programs:   m.l.ProgramStatuses(),
+		Logs:       m.t.Stats(),
+		Metrics:    m.rates.sample(m.store, time.Now()),
+		Errors:     logging.Recent(),
+	}
+	switch {
+	case !healthy:
+		d.Status = "unhealthy"
+	case !ready:
+		d.Status = "not ready"
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		logging.Warning(err)
+	}
+}
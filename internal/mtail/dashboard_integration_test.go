@@ -0,0 +1,54 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestDashboard(t *testing.T) {
+	testutil.SkipIfShort(t)
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	progDir := path.Join(tmpDir, "progs")
+	testutil.FatalIfErr(t, os.Mkdir(progDir, 0700))
+	testutil.TestOpenFile(t, progDir+"/nocode.mtail")
+
+	m, stopM := mtail.TestStartServer(t, 0, mtail.ProgramPath(progDir))
+	defer stopM()
+
+	resp, err := http.Get("http://" + m.Addr() + "/dashboard")
+	testutil.FatalIfErr(t, err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("dashboard: expected 200 with HTML, received %d with %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	resp, err = http.Get("http://" + m.Addr() + "/dashboard/data")
+	testutil.FatalIfErr(t, err)
+	defer resp.Body.Close()
+	var data struct {
+		Status   string
+		Programs []struct {
+			Name   string
+			Loaded bool
+		}
+	}
+	testutil.FatalIfErr(t, json.NewDecoder(resp.Body).Decode(&data))
+	if data.Status == "" {
+		t.Error("dashboard data has no status")
+	}
+	if len(data.Programs) != 1 || data.Programs[0].Name != "nocode.mtail" || !data.Programs[0].Loaded {
+		t.Errorf("expected nocode.mtail loaded, received %+v", data.Programs)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestMetricRates(t *testing.T) {
+	store := metrics.NewStore()
+	requests := metrics.NewMetric("requests", "web", metrics.Counter, metrics.Int, "code")
+	testutil.FatalIfErr(t, store.Add(requests))
+	queue := metrics.NewMetric("queue", "web", metrics.Gauge, metrics.Int, "host")
+	testutil.FatalIfErr(t, store.Add(queue))
+	idle := metrics.NewMetric("idle", "web", metrics.Counter, metrics.Int)
+	testutil.FatalIfErr(t, store.Add(idle))
+	ok, err := requests.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	a, err := queue.GetDatum("a")
+	testutil.FatalIfErr(t, err)
+	b, err := queue.GetDatum("b")
+	testutil.FatalIfErr(t, err)
+	i, err := idle.GetDatum()
+	testutil.FatalIfErr(t, err)
+
+	start := time.Now()
+	datum.SetInt(ok, 100, start)
+	datum.SetInt(i, 5, start)
+	var r metricRates
+	// The first sample has nothing to measure from.
+	testutil.ExpectNoDiff(t, []metricRate(nil), r.sample(store, start))
+
+	datum.SetInt(ok, 140, start.Add(time.Second))
+	datum.SetInt(a, 1, start.Add(time.Second))
+	datum.SetInt(b, 1, start.Add(time.Second))
+	expected := []metricRate{
+		{Name: "requests", Program: "web", Kind: "Counter", Rate: 4},
+		{Name: "queue", Program: "web", Kind: "Gauge", Rate: 0.2},
+	}
+	testutil.ExpectNoDiff(t, expected, r.sample(store, start.Add(10*time.Second)))
+	// Samples too close together return the last rates.
+	datum.SetInt(ok, 1000, start.Add(11*time.Second))
+	testutil.ExpectNoDiff(t, expected, r.sample(store, start.Add(10*time.Second+time.Millisecond)))
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/tailer"
+)
+
+// writeDiagnostics writes the state of the tailer, loader and metric store to
+// w, for debugging a running mtail without restarting it.
+func (m *Server) writeDiagnostics(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(tw, "mtail diagnostics at %s\n%s\n", time.Now().Format(time.RFC3339), m.buildInfo)
+	if m.t != nil {
+		fmt.Fprintln(tw, "\nPatterns:")
+		for _, p := range m.t.Patterns() {
+			fmt.Fprintf(tw, "  %s\n", p)
+		}
+		offsets := make(map[string]tailer.LogOffset)
+		for _, o := range m.t.Offsets() {
+			offsets[o.Pathname] = o
+		}
+		fmt.Fprintln(tw, "\nLogs:\tOffset\tDevice\tInode")
+		for _, l := range m.t.Logs() {
+			if o, ok := offsets[l]; ok {
+				fmt.Fprintf(tw, "  %s\t%d\t%d\t%d\n", l, o.Offset, o.Dev, o.Ino)
+			} else {
+				fmt.Fprintf(tw, "  %s\t-\t-\t-\n", l)
+			}
+		}
+	}
+	if m.l != nil {
+		fmt.Fprintln(tw, "\nPrograms:")
+		names := m.l.ProgramNames()
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(tw, "  %s\n", name)
+		}
+	}
+	m.store.RLock()
+	names := make([]string, 0, len(m.store.Metrics))
+	for name := range m.store.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var metrics, labelSets int
+	fmt.Fprintln(tw, "\nMetrics:\tProgram\tKind\tLabel sets")
+	for _, name := range names {
+		for _, ml := range m.store.Metrics[name] {
+			ml.RLock()
+			n := len(ml.LabelValues)
+			ml.RUnlock()
+			metrics++
+			labelSets += n
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%d\n", name, ml.Program, ml.Kind, n)
+		}
+	}
+	m.store.RUnlock()
+	fmt.Fprintf(tw, "\n%d metrics with %d label sets\n\n", metrics, labelSets)
+	return tw.Flush()
+}
+
+// dumpDiagnostics writes the diagnostics to the end of the diagnostics file,
+// or to the info log if there isn't one.  The file is opened for each dump,
+// so it can be rotated away between them.
+func (m *Server) dumpDiagnostics() {
+	if m.diagnosticsFile == "" {
+		var b bytes.Buffer
+		if err := m.writeDiagnostics(&b); err != nil {
+			logging.Warningf("Failed to write diagnostics: %s", err)
+			return
+		}
+		logging.Info(b.String())
+		return
+	}
+	f, err := os.OpenFile(m.diagnosticsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logging.Warningf("Failed to open diagnostics file: %s", err)
+		return
+	}
+	defer f.Close()
+	if err := m.writeDiagnostics(f); err != nil {
+		logging.Warningf("Failed to write diagnostics to %s: %s", m.diagnosticsFile, err)
+		return
+	}
+	logging.Infof("Wrote diagnostics to %s", m.diagnosticsFile)
+}
@@ -0,0 +1,41 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestDumpDiagnostics(t *testing.T) {
+	testutil.SkipIfShort(t)
+	logDir, rmLogDir := testutil.TestTempDir(t)
+	defer rmLogDir()
+	logFile := filepath.Join(logDir, "log")
+	f := testutil.TestOpenFile(t, logFile)
+	defer f.Close()
+	dumpFile := filepath.Join(logDir, "diagnostics")
+
+	m, stopM := TestStartServer(t, 0, ProgramPath("../../examples/linecount.mtail"), LogPathPatterns(logFile), DiagnosticsFile(dumpFile))
+	defer stopM()
+
+	// Each dump is appended.
+	m.dumpDiagnostics()
+	m.dumpDiagnostics()
+	b, err := ioutil.ReadFile(dumpFile)
+	testutil.FatalIfErr(t, err)
+	dump := string(b)
+	if n := strings.Count(dump, "diagnostics at"); n != 2 {
+		t.Errorf("expected 2 dumps, found %d:\n%s", n, dump)
+	}
+	for _, expected := range []string{logFile, "linecount.mtail", "lines_total", "metrics with"} {
+		if !strings.Contains(dump, expected) {
+			t.Errorf("dump missing %q:\n%s", expected, dump)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package mtail
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDiagnostics relays the signal requesting a diagnostic dump to c.
+func notifyDiagnostics(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
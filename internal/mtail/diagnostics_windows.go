@@ -0,0 +1,10 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import "os"
+
+// notifyDiagnostics does nothing, as there is no signal to request a
+// diagnostic dump on windows.
+func notifyDiagnostics(c chan<- os.Signal) {}
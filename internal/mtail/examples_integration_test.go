@@ -173,7 +173,7 @@ func TestExamplePrograms(t *testing.T) {
 			err = mtail.Close(true)
 			testutil.FatalIfErr(t, err)
 
-			testutil.ExpectNoDiff(t, goldenStore, store, testutil.IgnoreUnexported(sync.RWMutex{}, datum.String{}))
+			testutil.ExpectNoDiff(t, goldenStore, store, testutil.IgnoreUnexported(sync.RWMutex{}, metrics.Store{}, datum.String{}))
 		})
 	}
 }
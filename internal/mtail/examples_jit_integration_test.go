@@ -0,0 +1,54 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/mtail/golden"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/watcher"
+)
+
+// The example programs make the same metrics when they're compiled by the JIT,
+// after their first line, as when they're interpreted.
+func TestCompiledExamplePrograms(t *testing.T) {
+	testutil.SkipIfShort(t)
+	for _, tc := range exampleProgramTests {
+		tc := tc
+		t.Run(fmt.Sprintf("%s on %s", tc.programfile, tc.logfile), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			w := watcher.NewFakeWatcher()
+			store := metrics.NewStore()
+			programFile := path.Join("../..", tc.programfile)
+			mtail, err := mtail.New(ctx, store, w, mtail.ProgramPath(programFile), mtail.LogPathPatterns(tc.logfile), mtail.OneShot, mtail.OmitMetricSource, mtail.JITAfter(time.Nanosecond), mtail.OmitDumpMetricStore)
+			testutil.FatalIfErr(t, err)
+
+			err = mtail.Run()
+			testutil.FatalIfErr(t, err)
+
+			g, err := os.Open(tc.goldenfile)
+			testutil.FatalIfErr(t, err)
+			defer g.Close()
+
+			goldenStore := metrics.NewStore()
+			golden.ReadTestData(g, tc.programfile, goldenStore)
+
+			err = mtail.Close(true)
+			testutil.FatalIfErr(t, err)
+
+			testutil.ExpectNoDiff(t, goldenStore, store, testutil.IgnoreUnexported(sync.RWMutex{}, metrics.Store{}, datum.String{}))
+		})
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build go1.18
+// +build go1.18
+
+package mtail_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/mtail/golden"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/watcher"
+)
+
+// The example programs compiled to WebAssembly make the same metrics as when
+// they're interpreted.
+func TestSandboxedExamplePrograms(t *testing.T) {
+	testutil.SkipIfShort(t)
+	for _, tc := range exampleProgramTests {
+		tc := tc
+		t.Run(fmt.Sprintf("%s on %s", tc.programfile, tc.logfile), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			w := watcher.NewFakeWatcher()
+			store := metrics.NewStore()
+			programFile := path.Join("../..", tc.programfile)
+			mtail, err := mtail.New(ctx, store, w, mtail.ProgramPath(programFile), mtail.LogPathPatterns(tc.logfile), mtail.OneShot, mtail.OmitMetricSource, mtail.Sandbox(time.Minute, 1<<20), mtail.OmitDumpMetricStore)
+			testutil.FatalIfErr(t, err)
+
+			err = mtail.Run()
+			testutil.FatalIfErr(t, err)
+
+			g, err := os.Open(tc.goldenfile)
+			testutil.FatalIfErr(t, err)
+			defer g.Close()
+
+			goldenStore := metrics.NewStore()
+			golden.ReadTestData(g, tc.programfile, goldenStore)
+
+			err = mtail.Close(true)
+			testutil.FatalIfErr(t, err)
+
+			testutil.ExpectNoDiff(t, goldenStore, store, testutil.IgnoreUnexported(sync.RWMutex{}, metrics.Store{}, datum.String{}))
+		})
+	}
+}
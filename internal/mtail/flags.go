@@ -0,0 +1,157 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/watcher"
+	"github.com/pkg/errors"
+)
+
+// A runtimeFlag is a flag that can be changed while mtail is running, through
+// /debug/flags.  Only settings that are safe to change under load, and that
+// don't affect what the metrics mean, are runtime flags, so that a live
+// instance can be tuned while debugging without a restart resetting its
+// counters.
+type runtimeFlag struct {
+	get func() string
+	set func(string) error
+}
+
+// runtimeFlags returns the runtime flags of the Server, by flag name.
+func (m *Server) runtimeFlags() map[string]runtimeFlag {
+	flags := map[string]runtimeFlag{
+		"v": {
+			get: func() string { return strconv.Itoa(logging.Verbosity()) },
+			set: func(s string) error {
+				n, err := strconv.Atoi(s)
+				if err != nil {
+					return err
+				}
+				return logging.SetVerbosity(n)
+			},
+		},
+		"vmodule": {
+			get: logging.VModule,
+			set: logging.SetVModule,
+		},
+		"log_format": {
+			get: func() string { return logging.CurrentFormat().String() },
+			set: func(s string) error {
+				f, err := logging.ParseFormat(s)
+				if err != nil {
+					return err
+				}
+				logging.SetFormat(f)
+				return nil
+			},
+		},
+	}
+	if w, ok := m.w.(watcher.DefaultPollIntervalSetter); ok {
+		flags["poll_interval"] = runtimeFlag{
+			get: func() string { return w.DefaultPollInterval().String() },
+			set: func(s string) error {
+				d, err := time.ParseDuration(s)
+				if err != nil {
+					return err
+				}
+				return w.SetDefaultPollInterval(d)
+			},
+		}
+	}
+	return flags
+}
+
+type flagStatus struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Default  string `json:"default"`
+	Usage    string `json:"usage"`
+	Settable bool   `json:"settable"`
+}
+
+// flagsHandler lists the flags mtail was started with, showing the current
+// values of the runtime flags, and with POST sets the runtime flags named by
+// the form parameters to their values.
+func (m *Server) flagsHandler(w http.ResponseWriter, r *http.Request) {
+	flags := m.runtimeFlags()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := setRuntimeFlags(flags, r.PostForm, r.RemoteAddr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var status []flagStatus
+	flag.VisitAll(func(f *flag.Flag) {
+		s := flagStatus{Name: f.Name, Value: f.Value.String(), Default: f.DefValue, Usage: f.Usage}
+		if rf, ok := flags[f.Name]; ok {
+			s.Value, s.Settable = rf.get(), true
+		}
+		status = append(status, s)
+	})
+	// A program embedding mtail may not have flags for all of them.
+	for name, rf := range flags {
+		if flag.Lookup(name) == nil {
+			status = append(status, flagStatus{Name: name, Value: rf.get(), Settable: true})
+		}
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	b, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		logging.Warning(err)
+	}
+}
+
+// setRuntimeFlags sets each flag named in values to its value, on behalf of
+// the client at addr.  The names are all checked before any flag is set, and
+// an invalid value stops the flags after it, in name order, being set.
+func setRuntimeFlags(flags map[string]runtimeFlag, values map[string][]string, addr string) error {
+	if len(values) == 0 {
+		return errors.New("no flags given, expecting name=value parameters")
+	}
+	names := make([]string, 0, len(values))
+	for name, v := range values {
+		if _, ok := flags[name]; !ok {
+			if flag.Lookup(name) == nil {
+				return errors.Errorf("unknown flag %q", name)
+			}
+			return errors.Errorf("flag %q can't be changed while mtail is running", name)
+		}
+		if len(v) != 1 {
+			return errors.Errorf("flag %q given more than once", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		old, value := flags[name].get(), values[name][0]
+		if err := flags[name].set(value); err != nil {
+			return errors.Wrapf(err, "setting flag %q", name)
+		}
+		logging.Infof("Flag %s changed from %q to %q by %s", name, old, value, addr)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/watcher"
+)
+
+func postFlags(m *Server, values url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/debug/flags", strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	m.flagsHandler(rec, req)
+	return rec
+}
+
+func TestFlagsHandler(t *testing.T) {
+	w, err := watcher.NewLogWatcher(context.Background(), time.Hour)
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	m := &Server{w: w}
+	defer logging.SetVerbosity(logging.Verbosity())
+
+	rec := postFlags(m, url.Values{"poll_interval": {"1s"}, "v": {"2"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST: expected 200, received %d: %s", rec.Code, rec.Body)
+	}
+	testutil.ExpectNoDiff(t, time.Second, w.DefaultPollInterval())
+	testutil.ExpectNoDiff(t, 2, logging.Verbosity())
+
+	var status []flagStatus
+	testutil.FatalIfErr(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	values := make(map[string]flagStatus)
+	for _, s := range status {
+		values[s.Name] = s
+	}
+	testutil.ExpectNoDiff(t, flagStatus{Name: "poll_interval", Value: "1s", Settable: true}, values["poll_interval"])
+	if s := values["test.timeout"]; s.Name == "" || s.Settable {
+		t.Errorf("expected test.timeout to be listed and not settable, received %+v", s)
+	}
+
+	for _, bad := range []url.Values{
+		{},
+		{"no_such_flag": {"1"}},
+		{"test.timeout": {"1m"}},
+		{"poll_interval": {"soon"}},
+		{"v": {"1", "2"}},
+	} {
+		if rec := postFlags(m, bad); rec.Code != http.StatusBadRequest {
+			t.Errorf("POST %v: expected 400, received %d", bad, rec.Code)
+		}
+	}
+	testutil.ExpectNoDiff(t, time.Second, w.DefaultPollInterval())
+	testutil.ExpectNoDiff(t, 2, logging.Verbosity())
+}
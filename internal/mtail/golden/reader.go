@@ -12,7 +12,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
 )
@@ -36,9 +36,9 @@ func ReadTestData(file io.Reader, programfile string, store *metrics.Store) {
 	prog := filepath.Base(programfile)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		glog.V(2).Infof("'%s'\n", scanner.Text())
+		logging.V(2).Infof("'%s'\n", scanner.Text())
 		match := varRe.FindStringSubmatch(scanner.Text())
-		glog.V(2).Infof("len match: %d\n", len(match))
+		logging.V(2).Infof("len match: %d\n", len(match))
 		if len(match) == 0 {
 			continue
 		}
@@ -46,7 +46,7 @@ func ReadTestData(file io.Reader, programfile string, store *metrics.Store) {
 		vals := make([]string, 0)
 		if match[3] != "" {
 			for _, pair := range strings.Split(match[3], ",") {
-				glog.V(2).Infof("pair: %s\n", pair)
+				logging.V(2).Infof("pair: %s\n", pair)
 				kv := strings.Split(pair, "=")
 				keys = append(keys, kv[0])
 				if kv[1] != "" {
@@ -71,7 +71,7 @@ func ReadTestData(file io.Reader, programfile string, store *metrics.Store) {
 		case "histogram":
 			kind = metrics.Histogram
 		}
-		glog.V(2).Infof("match[4]: %q", match[4])
+		logging.V(2).Infof("match[4]: %q", match[4])
 		typ := metrics.Int
 		var (
 			ival int64
@@ -90,10 +90,10 @@ func ReadTestData(file io.Reader, programfile string, store *metrics.Store) {
 					typ = metrics.String
 				}
 			}
-			glog.V(2).Infof("type is %q", typ)
+			logging.V(2).Infof("type is %q", typ)
 		}
 		var timestamp time.Time
-		glog.V(2).Infof("match 5: %q\n", match[5])
+		logging.V(2).Infof("match 5: %q\n", match[5])
 		if match[5] != "" {
 			timestamp, err = time.Parse(time.RFC3339, match[5])
 			if err != nil {
@@ -101,17 +101,17 @@ func ReadTestData(file io.Reader, programfile string, store *metrics.Store) {
 				if err == nil {
 					timestamp = time.Unix(j/1000000000, j%1000000000)
 				} else {
-					glog.V(2).Info(err)
+					logging.V(2).Info(err)
 				}
 			}
 		}
-		glog.V(2).Infof("timestamp is %s which is %v in unix", timestamp.Format(time.RFC3339), timestamp.Unix())
+		logging.V(2).Infof("timestamp is %s which is %v in unix", timestamp.Format(time.RFC3339), timestamp.Unix())
 
 		// Now we have enough information to get orcreate a metric.
 		m := FindMetricOrNil(store, match[2])
 		if m != nil {
 			if m.Type != typ {
-				glog.V(2).Infof("The type of the fetched metric is not %s: %s", typ, m)
+				logging.V(2).Infof("The type of the fetched metric is not %s: %s", typ, m)
 				continue
 			}
 		} else {
@@ -119,7 +119,7 @@ func ReadTestData(file io.Reader, programfile string, store *metrics.Store) {
 			if kind == metrics.Counter && len(keys) == 0 {
 				d, err := m.GetDatum()
 				if err != nil {
-					glog.Fatal(err)
+					logging.Fatal(err)
 				}
 				// Initialize to zero at the zero time.
 				switch typ {
@@ -129,32 +129,32 @@ func ReadTestData(file io.Reader, programfile string, store *metrics.Store) {
 					datum.SetFloat(d, 0, time.Unix(0, 0))
 				}
 			}
-			glog.V(2).Infof("making a new %v\n", m)
+			logging.V(2).Infof("making a new %v\n", m)
 			if err := store.Add(m); err != nil {
-				glog.Infof("Failed to add metric %v to store: %s", m, err)
+				logging.Infof("Failed to add metric %v to store: %s", m, err)
 			}
 		}
 
 		if match[4] != "" {
 			d, err := m.GetDatum(vals...)
 			if err != nil {
-				glog.V(2).Infof("Failed to get datum: %s", err)
+				logging.V(2).Infof("Failed to get datum: %s", err)
 				continue
 			}
-			glog.V(2).Infof("got datum %v", d)
+			logging.V(2).Infof("got datum %v", d)
 
 			switch typ {
 			case metrics.Int:
-				glog.V(2).Infof("setting %v with vals %v to %v at %v\n", d, vals, ival, timestamp)
+				logging.V(2).Infof("setting %v with vals %v to %v at %v\n", d, vals, ival, timestamp)
 				datum.SetInt(d, ival, timestamp)
 			case metrics.Float:
-				glog.V(2).Infof("setting %v with vals %v to %v at %v\n", d, vals, fval, timestamp)
+				logging.V(2).Infof("setting %v with vals %v to %v at %v\n", d, vals, fval, timestamp)
 				datum.SetFloat(d, fval, timestamp)
 			case metrics.String:
-				glog.V(2).Infof("setting %v with vals %v to %v at %v\n", d, vals, sval, timestamp)
+				logging.V(2).Infof("setting %v with vals %v to %v at %v\n", d, vals, sval, timestamp)
 				datum.SetString(d, sval, timestamp)
 			}
 		}
-		glog.V(2).Infof("Metric is now %s", m)
+		logging.V(2).Infof("Metric is now %s", m)
 	}
 }
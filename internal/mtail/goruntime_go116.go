@@ -0,0 +1,104 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build go1.16
+// +build go1.16
+
+package mtail
+
+import (
+	"math"
+	"runtime/metrics"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// goRuntimeCollector exports the metrics the Go runtime describes about
+// itself through runtime/metrics, such as the GC pause and scheduling latency
+// distributions, which the standard Go collector doesn't.
+type goRuntimeCollector struct {
+	samples []metrics.Sample
+	descs   []*prometheus.Desc // The descriptions of samples, in the same order.
+	types   []prometheus.ValueType
+}
+
+// newGoRuntimeCollector returns a collector of every supported runtime metric,
+// named go_ and then the metric's name with its unit, such as
+// go_gc_heap_allocs_bytes for /gc/heap/allocs:bytes.
+func newGoRuntimeCollector() prometheus.Collector {
+	c := &goRuntimeCollector{}
+	for _, d := range metrics.All() {
+		if d.Kind == metrics.KindBad {
+			continue
+		}
+		typ := prometheus.GaugeValue
+		if d.Cumulative {
+			typ = prometheus.CounterValue
+		}
+		c.samples = append(c.samples, metrics.Sample{Name: d.Name})
+		c.descs = append(c.descs, prometheus.NewDesc(goRuntimeMetricName(d.Name), d.Description, nil, nil))
+		c.types = append(c.types, typ)
+	}
+	return c
+}
+
+// goRuntimeMetricName returns the Prometheus name of the runtime metric named
+// name.
+func goRuntimeMetricName(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	return "go_" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Describe implements prometheus.Collector.
+func (c *goRuntimeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.  Distributions are exported as
+// histograms whose sums are estimated from the bucket boundaries, as the
+// runtime doesn't keep them.
+func (c *goRuntimeCollector) Collect(ch chan<- prometheus.Metric) {
+	samples := make([]metrics.Sample, len(c.samples))
+	copy(samples, c.samples)
+	metrics.Read(samples)
+	for i, s := range samples {
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			ch <- prometheus.MustNewConstMetric(c.descs[i], c.types[i], float64(s.Value.Uint64()))
+		case metrics.KindFloat64:
+			ch <- prometheus.MustNewConstMetric(c.descs[i], c.types[i], s.Value.Float64())
+		case metrics.KindFloat64Histogram:
+			count, sum, buckets := runtimeHistogram(s.Value.Float64Histogram())
+			ch <- prometheus.MustNewConstHistogram(c.descs[i], count, sum, buckets)
+		}
+	}
+}
+
+// runtimeHistogram returns the count, estimated sum, and cumulative buckets by
+// upper bound of a runtime distribution.
+func runtimeHistogram(h *metrics.Float64Histogram) (count uint64, sum float64, buckets map[float64]uint64) {
+	buckets = make(map[float64]uint64, len(h.Counts))
+	for i, n := range h.Counts {
+		count += n
+		lower, upper := h.Buckets[i], h.Buckets[i+1]
+		// Each value is taken to be at the lower bound of its bucket, or the
+		// upper if the lower is infinite.
+		v := lower
+		if math.IsInf(v, -1) {
+			v = upper
+		}
+		sum += v * float64(n)
+		if !math.IsInf(upper, 1) {
+			buckets[upper] = count
+		}
+	}
+	return count, sum, buckets
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build go1.16
+// +build go1.16
+
+package mtail
+
+import (
+	"math"
+	"runtime/metrics"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestGoRuntimeCollector(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	testutil.FatalIfErr(t, prometheus.WrapRegistererWithPrefix("mtail_", reg).Register(newGoRuntimeCollector()))
+	families, err := reg.Gather()
+	testutil.FatalIfErr(t, err)
+	types := make(map[string]dto.MetricType)
+	for _, f := range families {
+		types[f.GetName()] = f.GetType()
+	}
+	for name, typ := range map[string]dto.MetricType{
+		"mtail_go_sched_goroutines_goroutines": dto.MetricType_GAUGE,
+		"mtail_go_gc_heap_allocs_bytes":        dto.MetricType_COUNTER,
+		"mtail_go_sched_latencies_seconds":     dto.MetricType_HISTOGRAM,
+	} {
+		got, ok := types[name]
+		if !ok {
+			t.Errorf("%s not collected", name)
+			continue
+		}
+		testutil.ExpectNoDiff(t, typ, got)
+	}
+}
+
+func TestRuntimeHistogram(t *testing.T) {
+	h := &metrics.Float64Histogram{
+		Counts:  []uint64{1, 2, 3, 4},
+		Buckets: []float64{math.Inf(-1), 1, 2, 4, math.Inf(1)},
+	}
+	count, sum, buckets := runtimeHistogram(h)
+	testutil.ExpectNoDiff(t, uint64(10), count)
+	testutil.ExpectNoDiff(t, 1.0+2*1+3*2+4*4, sum)
+	testutil.ExpectNoDiff(t, map[float64]uint64{1: 1, 2: 3, 4: 6}, buckets)
+}
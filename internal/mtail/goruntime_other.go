@@ -0,0 +1,16 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !go1.16
+// +build !go1.16
+
+package mtail
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newGoRuntimeCollector returns nil, as runtime/metrics is new in Go 1.16.
+func newGoRuntimeCollector() prometheus.Collector {
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/mtail/internal/health"
+	"github.com/google/mtail/internal/logging"
+)
+
+// componentHealth is the health of one component as reported by the health
+// endpoints.
+type componentHealth struct {
+	health.Status
+	Wedged bool `json:"wedged"`
+}
+
+// healthReport is the response body of the health endpoints.
+type healthReport struct {
+	Status     string            `json:"status"`
+	Components []componentHealth `json:"components"`
+}
+
+// healthReporters returns the Server's components that report their health.
+func (m *Server) healthReporters() []health.Reporter {
+	var r []health.Reporter
+	if w, ok := m.w.(health.Reporter); ok {
+		r = append(r, w)
+	}
+	if m.t != nil {
+		r = append(r, m.t)
+	}
+	if m.l != nil {
+		r = append(r, m.l)
+	}
+	if m.e != nil {
+		r = append(r, m.e)
+	}
+	return r
+}
+
+// checkHealth collects the health of each component.  The Server is healthy
+// unless a critical component is wedged, and ready if it is healthy and every
+// component is ready.
+func (m *Server) checkHealth() (report healthReport, healthy, ready bool) {
+	now := time.Now()
+	healthy, ready = true, true
+	for _, r := range m.healthReporters() {
+		c := componentHealth{Status: r.Health()}
+		c.Wedged = c.Status.Wedged(now, m.healthStallTimeout)
+		if c.Wedged && c.Critical {
+			healthy = false
+		}
+		if !c.Ready {
+			ready = false
+		}
+		report.Components = append(report.Components, c)
+	}
+	ready = ready && healthy
+	return
+}
+
+// healthzHandler serves the liveness check, failing if a critical component
+// is wedged.
+func (m *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	report, healthy, _ := m.checkHealth()
+	m.writeHealthReport(w, report, healthy, "ok", "unhealthy")
+}
+
+// readyzHandler serves the readiness check, failing if the Server is
+// unhealthy or a component is not yet ready, such as when no programs are
+// loaded.
+func (m *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	report, _, ready := m.checkHealth()
+	m.writeHealthReport(w, report, ready, "ready", "not ready")
+}
+
+func (m *Server) writeHealthReport(w http.ResponseWriter, report healthReport, ok bool, okStatus, failStatus string) {
+	status := http.StatusOK
+	report.Status = okStatus
+	if !ok {
+		status = http.StatusServiceUnavailable
+		report.Status = failStatus
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(b); err != nil {
+		logging.Warning(err)
+	}
+}
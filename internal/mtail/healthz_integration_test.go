@@ -0,0 +1,66 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// getHealth fetches a health endpoint, returning the status code and the
+// component names reported.
+func getHealth(t *testing.T, addr, endpoint string) (int, []string) {
+	t.Helper()
+	resp, err := http.Get("http://" + addr + endpoint)
+	testutil.FatalIfErr(t, err)
+	defer resp.Body.Close()
+	var report struct {
+		Components []struct {
+			Component string
+		}
+	}
+	testutil.FatalIfErr(t, json.NewDecoder(resp.Body).Decode(&report))
+	var names []string
+	for _, c := range report.Components {
+		names = append(names, c.Component)
+	}
+	return resp.StatusCode, names
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	testutil.SkipIfShort(t)
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logDir := path.Join(tmpDir, "logs")
+	progDir := path.Join(tmpDir, "progs")
+	testutil.FatalIfErr(t, os.Mkdir(logDir, 0700))
+	testutil.FatalIfErr(t, os.Mkdir(progDir, 0700))
+
+	m, stopM := mtail.TestStartServer(t, 0, mtail.ProgramPath(progDir), mtail.LogPathPatterns(logDir+"/*"))
+	defer stopM()
+
+	code, names := getHealth(t, m.Addr(), "/healthz")
+	if code != http.StatusOK {
+		t.Errorf("healthz: expected 200, received %d", code)
+	}
+	testutil.ExpectNoDiff(t, []string{"watcher", "tailer", "loader", "exporter"}, names)
+
+	// Not ready until a program is loaded.
+	if code, _ = getHealth(t, m.Addr(), "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz with no programs: expected 503, received %d", code)
+	}
+	testutil.TestOpenFile(t, progDir+"/nocode.mtail")
+	m.PollWatched()
+	if code, _ = getHealth(t, m.Addr(), "/readyz"); code != http.StatusOK {
+		t.Errorf("readyz with a program: expected 200, received %d", code)
+	}
+}
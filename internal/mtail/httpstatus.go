@@ -9,8 +9,9 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 )
 
 const statusTemplate = `
@@ -21,8 +22,9 @@ const statusTemplate = `
 <body>
 <h1>mtail on {{.BindAddress}}</h1>
 <p>Build: {{.BuildInfo}}</p>
-<p>Metrics: <a href="/json">json</a>, <a href="/metrics">prometheus</a>, <a href="/varz">varz</a></p>
-<p>Debug: <a href="/debug/pprof">debug/pprof</a>, <a href="/debug/vars">debug/vars</a>, <a href="/tracez">tracez</a>, <a href="/progz">progz</a></p>
+<p>Status: <a href="/dashboard">dashboard</a></p>
+<p>Metrics: <a href="/json">json</a>, <a href="/metrics">prometheus</a>, <a href="/varz">varz</a>, <a href="/sd">service discovery</a></p>
+<p>Debug: <a href="/debug/pprof">debug/pprof</a>, <a href="/debug/vars">debug/vars</a>, <a href="/tracez">tracez</a>, <a href="/progz">progz</a>, <a href="/logs">logs</a>, <a href="/logs/stats">logs/stats</a>, <a href="/healthz">healthz</a>, <a href="/readyz">readyz</a>, <a href="/loglevel">loglevel</a></p>
 `
 
 // ServeHTTP satisfies the http.Handler interface, and is used to serve the
@@ -38,7 +40,7 @@ func (m *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		BindAddress string
 		BuildInfo   string
 	}{
-		m.bindAddress,
+		strings.Join(m.bindAddresses, ", "),
 		m.buildInfo.String(),
 	}
 	w.Header().Add("Content-type", "text/html")
@@ -48,11 +50,11 @@ func (m *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	err = m.l.WriteStatusHTML(w)
 	if err != nil {
-		glog.Warningf("Error while writing loader status: %s", err)
+		logging.Warningf("Error while writing loader status: %s", err)
 	}
 	err = m.t.WriteStatusHTML(w)
 	if err != nil {
-		glog.Warningf("Error while writing tailer status: %s", err)
+		logging.Warningf("Error while writing tailer status: %s", err)
 	}
 }
 
@@ -76,3 +78,13 @@ func (m *Server) quitHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Exiting...")
 	close(m.webquit)
 }
+
+// streamHandler streams the changes programs make to their metrics, if the
+// Server was started with streaming enabled.
+func (m *Server) streamHandler(w http.ResponseWriter, r *http.Request) {
+	if m.updateStream == nil {
+		http.Error(w, "The metric update stream is not enabled; start mtail with --stream_updates.", http.StatusNotFound)
+		return
+	}
+	m.updateStream.ServeHTTP(w, r)
+}
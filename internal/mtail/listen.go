@@ -0,0 +1,57 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"net"
+	"os"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/pkg/errors"
+)
+
+// bind adds a listener on addr to the Server.  If the listeners were handed
+// over by an upgrade, the previous process has already bound each address
+// given, so only the address is recorded.
+func (m *Server) bind(network, addr string) error {
+	m.bindAddresses = append(m.bindAddresses, addr)
+	if m.listenersInherited {
+		return nil
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	m.listeners = append(m.listeners, l)
+	return nil
+}
+
+// setUnixSocketPermissions gives the UNIX sockets listened on the mode and
+// owner requested.  It is called before privileges are dropped, so that a
+// privileged process may give the sockets away.
+func (m *Server) setUnixSocketPermissions() error {
+	p := m.unixSocketPermissions
+	if p == nil || m.listenersInherited {
+		return nil
+	}
+	for _, l := range m.listeners {
+		if _, ok := l.(*net.UnixListener); !ok {
+			continue
+		}
+		path := l.Addr().String()
+		if p.uid != -1 || p.gid != -1 {
+			logging.Infof("Changing owner of UNIX socket %s to uid %d gid %d", path, p.uid, p.gid)
+			if err := os.Lchown(path, p.uid, p.gid); err != nil {
+				return errors.Wrap(err, "failed to change owner of UNIX socket")
+			}
+		}
+		if p.mode != 0 {
+			logging.Infof("Changing mode of UNIX socket %s to %#o", path, p.mode)
+			if err := os.Chmod(path, p.mode); err != nil {
+				return errors.Wrap(err, "failed to change mode of UNIX socket")
+			}
+		}
+	}
+	return nil
+}
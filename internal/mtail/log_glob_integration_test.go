@@ -9,7 +9,7 @@ import (
 	"sync"
 	"testing"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/mtail"
 	"github.com/google/mtail/internal/testutil"
 )
@@ -289,5 +289,5 @@ func TestGlobRelativeAfterStart(t *testing.T) {
 		wg.Wait()
 	}
 
-	glog.Infof("end")
+	logging.Infof("end")
 }
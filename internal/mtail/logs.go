@@ -0,0 +1,77 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/tailer"
+	"github.com/pkg/errors"
+)
+
+// AddLogPattern starts tailing the logs matching a glob pattern, and any
+// created later, while the Server is running.
+func (m *Server) AddLogPattern(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return errors.Wrapf(err, "pattern %q", pattern)
+	}
+	err := m.t.TailPattern(pattern)
+	if errors.Cause(err) == tailer.ErrNoMatches {
+		logging.Info(err)
+		return nil
+	}
+	return err
+}
+
+// RemoveLogPattern stops tailing the logs matching a glob pattern, unless
+// they also match another.
+func (m *Server) RemoveLogPattern(pattern string) error {
+	return m.t.RemovePattern(pattern)
+}
+
+type logsStatus struct {
+	Patterns []string `json:"patterns"`
+	Logs     []string `json:"logs"`
+}
+
+// logsHandler lists the log path patterns and the logs being tailed, and
+// adds or removes a pattern given by the pattern parameter with POST or
+// DELETE.
+func (m *Server) logsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		pattern := r.FormValue("pattern")
+		if pattern == "" {
+			http.Error(w, "missing pattern parameter", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if r.Method == http.MethodPost {
+			err = m.AddLogPattern(pattern)
+		} else {
+			err = m.RemoveLogPattern(pattern)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Add("Allow", "GET, POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := json.MarshalIndent(logsStatus{Patterns: m.t.Patterns(), Logs: m.t.Logs()}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		logging.Warning(err)
+	}
+}
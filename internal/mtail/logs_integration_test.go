@@ -0,0 +1,74 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+type logsStatus struct {
+	Patterns []string
+	Logs     []string
+}
+
+func doLogsRequest(t *testing.T, method, addr, pattern string, expectedCode int) logsStatus {
+	t.Helper()
+	u := "http://" + addr + "/logs"
+	if pattern != "" {
+		u += "?pattern=" + url.QueryEscape(pattern)
+	}
+	req, err := http.NewRequest(method, u, nil)
+	testutil.FatalIfErr(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	testutil.FatalIfErr(t, err)
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedCode {
+		t.Fatalf("%s %s: expected %d, received %d", method, u, expectedCode, resp.StatusCode)
+	}
+	var s logsStatus
+	if resp.StatusCode == http.StatusOK {
+		testutil.FatalIfErr(t, json.NewDecoder(resp.Body).Decode(&s))
+	}
+	return s
+}
+
+func TestLogsHandlerAddRemove(t *testing.T) {
+	testutil.SkipIfShort(t)
+	logDir, rmLogDir := testutil.TestTempDir(t)
+	defer rmLogDir()
+
+	m, stopM := mtail.TestStartServer(t, 0, mtail.ProgramPath("../../examples/linecount.mtail"))
+	defer stopM()
+
+	logFile := filepath.Join(logDir, "log")
+	f := testutil.TestOpenFile(t, logFile)
+	defer f.Close()
+	pattern := filepath.Join(logDir, "*")
+
+	s := doLogsRequest(t, http.MethodPost, m.Addr(), pattern, http.StatusOK)
+	testutil.ExpectNoDiff(t, logsStatus{Patterns: []string{pattern}, Logs: []string{logFile}}, s)
+
+	lineCountCheck := m.ExpectMetricDeltaWithDeadline("lines_total", 3)
+	for i := 1; i <= 3; i++ {
+		testutil.WriteString(t, f, fmt.Sprintf("%d\n", i))
+	}
+	m.PollWatched()
+	lineCountCheck()
+
+	s = doLogsRequest(t, http.MethodDelete, m.Addr(), pattern, http.StatusOK)
+	testutil.ExpectNoDiff(t, logsStatus{Patterns: []string{}, Logs: []string{}}, s)
+
+	doLogsRequest(t, http.MethodDelete, m.Addr(), pattern, http.StatusBadRequest)
+	doLogsRequest(t, http.MethodPost, m.Addr(), "", http.StatusBadRequest)
+	doLogsRequest(t, http.MethodPost, m.Addr(), filepath.Join(logDir, "["), http.StatusBadRequest)
+	doLogsRequest(t, http.MethodPut, m.Addr(), pattern, http.StatusMethodNotAllowed)
+}
@@ -18,9 +18,18 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/action"
+	"github.com/google/mtail/internal/alert"
+	"github.com/google/mtail/internal/anomaly"
+	"github.com/google/mtail/internal/bundle"
 	"github.com/google/mtail/internal/exporter"
+	"github.com/google/mtail/internal/geoip"
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/record"
+	"github.com/google/mtail/internal/secret"
+	"github.com/google/mtail/internal/severity"
 	"github.com/google/mtail/internal/tailer"
 	"github.com/google/mtail/internal/vm"
 	"github.com/google/mtail/internal/watcher"
@@ -44,15 +53,16 @@ type Server struct {
 
 	reg *prometheus.Registry
 
-	h        *http.Server
-	listener net.Listener
+	h                  *http.Server
+	listeners          []net.Listener
+	listenersInherited bool // if set, the listeners were handed over by an upgrade
+
+	resumeOffsets []tailer.LogOffset // log offsets handed over by an upgrade
 
 	webquit   chan struct{} // Channel to signal shutdown from web UI
-	closeQuit chan struct{} // Channel to signal shutdown from code
 	closeOnce sync.Once     // Ensure shutdown happens only once
 
-	bindAddress        string    // address to bind HTTP server
-	bindUnixSocket     string    // path of the UNIX socket to bind HTTP server
+	bindAddresses      []string  // addresses and UNIX socket paths to bind HTTP server
 	buildInfo          BuildInfo // go build information
 	programPath        string    // path to programs to load
 	logPathPatterns    []string  // list of patterns to watch for log files to tail
@@ -64,24 +74,89 @@ type Server struct {
 	dumpAstTypes bool // if set, mtail prints the program syntax tree after type checking
 	dumpBytecode bool // if set, mtail prints the program bytecode after code generation
 
+	strictStartup bool // if set, mtail fails before reading any logs unless every program loads
+
 	overrideLocation            *time.Location // Timezone location to use when parsing timestamps
 	expiredMetricGcTickInterval time.Duration  // Interval between expired metric removal runs
 	staleLogGcTickInterval      time.Duration  // Interval between stale log gc runs
 	logPatternPollTickInterval  time.Duration  // Interval between log pattern polls
+	logRateInterval             time.Duration  // Interval between measurements of the rates logs are read at
+	healthStallTimeout          time.Duration  // Time without progress after which a component is wedged
 	syslogUseCurrentYear        bool           // if set, use the current year for timestamps that have no year information
 	omitMetricSource            bool           // if set, do not link the source program to a metric
+	instrumentConditions        bool           // if set, count the matches of each top-level condition of the programs
 	omitProgLabel               bool           // if set, do not put the program name in the metric labels
 	emitMetricTimestamp         bool           // if set, emit the metric's recorded timestamp
 	omitDumpMetricsStore        bool           // if set, do not print the metric store; useful in test
+
+	logPollIntervals map[string]time.Duration  // poll intervals for the logs matching each pattern, overriding the watcher's
+	logTimezones     map[string]*time.Location // timezones for the logs matching each pattern, overriding overrideLocation
+	logRecords       map[string]record.Format  // binary record formats of the logs matching each pattern
+	maxOpenLogFiles  int                       // if set, the most log files to keep open at once
+	dedupLines       *dedupLines               // if set, how repeated lines are dropped from each log
+
+	programLogPatterns map[string][]string // if set, the patterns of the logs each program is bound to
+
+	timestampBounds *boundTimestamps  // if set, the policy for metric updates at implausible timestamps
+	intOverflow     vm.OverflowPolicy // what programs do when an integer metric passes the limits of an int64
+
+	alertWebhook *alertWebhook // if set, where the alerts raised by programs are posted
+	execCommands *execCommands // if set, the commands programs may run with exec()
+	runner       *action.Runner
+
+	geoipDatabases *geoipDatabases // if set, the databases the geoip builtins look addresses up in
+	hmacKey        []byte          // if set, the key of the hmac builtin
+	externConsts   *externConsts   // if set, the values of the extern consts declared by programs
+
+	sandbox  *vm.SandboxLimits // if set, the limits of the WebAssembly sandbox programs are run in
+	jitAfter time.Duration     // if set, how long programs are interpreted before they're compiled
+
+	fileLabels []vm.FileLabelRule // if set, the labels added to metrics from the paths of logs
+
+	programBundle *programBundle // if set, where programs are fetched from
+
+	openMetrics bool // if set, offer the OpenMetrics format on /metrics
+
+	severityCounts   bool              // if set, count the lines of each log by severity
+	anomalyDetection *anomalyDetection // if set, the metrics scored against their moving averages
+	memoryBudget     *memoryBudget     // if set, the memory limit load is shed to stay under
+
+	gomaxprocsFromCgroup bool    // if set, GOMAXPROCS is set from the cgroup CPU quota
+	cpuLimit             float64 // if set, the share of one CPU's time lines are processed within
+	niceness             *int    // if set, the nice value to run at
+
+	rates metricRates // how fast each metric is updated, for the dashboard
+
+	updateStream *exporter.Stream // if set, where the changes programs make to their metrics are streamed to clients
+
+	diagnosticsFile string // if set, the file to append diagnostics to on SIGUSR1, instead of the info log
+
+	oneShotParquetFile string                // if set, the file to write the metrics to in Parquet format after a one-shot run
+	oneShotOrder       *tailer.BackfillOrder // if set, a one-shot run reads the logs in the order they were written
+
+	chrootDir string // if set, chroot to this directory after opening the listener
+	dropIds   bool   // if set, change to uid and gid after opening the listener
+	uid, gid  int    // unprivileged user and group to run as
+	seccomp   bool   // if set, install a seccomp filter after dropping privileges
+
+	unixSocketPermissions *unixSocketPermissions // if set, the mode and owner to give the UNIX sockets listened on
+
+	serviceDiscoveryTarget string            // host:port to advertise for scraping, if not the listener address
+	serviceDiscoveryLabels map[string]string // extra labels to advertise with the target
 }
 
 // StartTailing adds each log path pattern to the tailer.
 func (m *Server) StartTailing() error {
+	if m.oneShot && m.oneShotOrder != nil {
+		order := *m.oneShotOrder
+		order.Location = m.overrideLocation
+		return m.t.Backfill(m.logPathPatterns, order)
+	}
 	var err error
 	for _, pattern := range m.logPathPatterns {
-		glog.V(1).Infof("Tail pattern %q", pattern)
+		logging.V(1).Infof("Tail pattern %q", pattern)
 		if err = m.t.TailPattern(pattern); err != nil {
-			glog.Warning(err)
+			logging.Warning(err)
 		}
 	}
 	return nil
@@ -113,9 +188,79 @@ func (m *Server) initLoader() error {
 	if m.omitMetricSource {
 		opts = append(opts, vm.OmitMetricSource())
 	}
+	if m.instrumentConditions {
+		opts = append(opts, vm.InstrumentConditions())
+	}
 	if m.overrideLocation != nil {
 		opts = append(opts, vm.OverrideLocation(m.overrideLocation))
 	}
+	if len(m.programLogPatterns) > 0 {
+		opts = append(opts, vm.ProgramLogPatterns(m.programLogPatterns))
+	}
+	if b := m.timestampBounds; b != nil {
+		opts = append(opts, vm.BoundTimestamps(b.policy, b.maxFuture, b.maxAge))
+	}
+	if m.intOverflow != vm.WrapOverflow {
+		opts = append(opts, vm.IntOverflow(m.intOverflow))
+	}
+	// Alerts and bundles are sent and fetched like metrics are pushed,
+	// through the proxy if there is one.
+	var transport http.RoundTripper
+	if m.alertWebhook != nil || m.programBundle != nil {
+		t, err := exporter.NewTransport()
+		if err != nil {
+			return err
+		}
+		transport = t
+	}
+	if a := m.alertWebhook; a != nil {
+		token, err := secret.New("alert_webhook_token", a.tokenFile)
+		if err != nil {
+			return err
+		}
+		w, err := alert.NewWebhook(m.ctx, a.url, a.tmpl, token, a.interval, transport)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, vm.Alerter(w))
+	}
+	if e := m.execCommands; e != nil {
+		var err error
+		m.runner, err = action.NewRunner(e.commands, e.timeout, e.interval)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, vm.Executor(m.runner))
+	}
+	if g := m.geoipDatabases; g != nil {
+		var d geoip.Databases
+		var err error
+		if d.CountryDB, err = m.openGeoIPDatabase(g.countryPath, g.interval); err != nil {
+			return err
+		}
+		if d.ASNDB, err = m.openGeoIPDatabase(g.asnPath, g.interval); err != nil {
+			return err
+		}
+		opts = append(opts, vm.GeoIP(d))
+	}
+	if len(m.hmacKey) > 0 {
+		opts = append(opts, vm.HMACKey(m.hmacKey))
+	}
+	if m.externConsts != nil {
+		opts = append(opts, vm.ExternConsts(m.externConsts.values, m.externConsts.file))
+	}
+	if len(m.fileLabels) > 0 {
+		opts = append(opts, vm.FileLabels(m.fileLabels))
+	}
+	if m.sandbox != nil {
+		opts = append(opts, vm.Sandbox(*m.sandbox))
+	}
+	if m.jitAfter > 0 {
+		opts = append(opts, vm.JIT(m.jitAfter))
+	}
+	if m.updateStream != nil {
+		opts = append(opts, vm.OnUpdate(m.updateStream.Update))
+	}
 	var err error
 	m.l, err = vm.NewLoader(m.ctx, m.programPath, m.store, opts...)
 	if err != nil {
@@ -124,12 +269,46 @@ func (m *Server) initLoader() error {
 	if m.programPath == "" {
 		return nil
 	}
-	if errs := m.l.LoadAllPrograms(); errs != nil {
+	if b := m.programBundle; b != nil {
+		f, err := bundle.NewFetcher(b.url, b.signatureURL, b.key, m.programPath, transport)
+		if err != nil {
+			return err
+		}
+		// If the bundle can't be fetched, the programs from the last one
+		// installed are loaded.
+		if _, err := f.Fetch(m.ctx); err != nil {
+			logging.Warningf("Failed to fetch program bundle: %s", err)
+		}
+		if !m.oneShot && !m.compileOnly {
+			go f.Run(m.ctx, b.interval, m.l.LoadAllPrograms)
+		}
+	}
+	load := m.l.LoadAllPrograms
+	if m.strictStartup {
+		load = m.l.CompileAllPrograms
+	}
+	if errs := load(); errs != nil {
 		return errors.Errorf("Compile encountered errors:\n%s", errs)
 	}
 	return nil
 }
 
+// openGeoIPDatabase opens the GeoIP database at path, if there is one, and
+// rereads it whenever it changes while the Server runs.
+func (m *Server) openGeoIPDatabase(path string, interval time.Duration) (*geoip.DB, error) {
+	if path == "" {
+		return nil, nil
+	}
+	db, err := geoip.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !m.oneShot && !m.compileOnly {
+		go db.Run(m.ctx, interval)
+	}
+	return db, nil
+}
+
 // initExporter sets up an Exporter for this Server.
 func (m *Server) initExporter() (err error) {
 	opts := []exporter.Option{}
@@ -139,12 +318,25 @@ func (m *Server) initExporter() (err error) {
 	if m.emitMetricTimestamp {
 		opts = append(opts, exporter.EmitTimestamp())
 	}
-	m.e, err = exporter.New(m.store, opts...)
+	m.e, err = exporter.New(m.ctx, m.store, opts...)
 	if err != nil {
 		return err
 	}
 	m.reg.MustRegister(m.e)
 
+	if a := m.anomalyDetection; a != nil {
+		var opts []anomaly.Option
+		if m.omitProgLabel {
+			opts = append(opts, anomaly.OmitProgLabel())
+		}
+		d, err := anomaly.New(m.store, a.names, a.alpha, opts...)
+		if err != nil {
+			return err
+		}
+		m.reg.MustRegister(d)
+		d.Run(m.ctx, a.interval)
+	}
+
 	// Create mtail_build_info metric.
 	version.Branch = m.buildInfo.Branch
 	version.Version = m.buildInfo.Version
@@ -158,6 +350,7 @@ func (m *Server) initTailer() (err error) {
 	opts := []tailer.Option{
 		tailer.LogPatternPollTickInterval(m.logPatternPollTickInterval),
 		tailer.StaleLogGcTickInterval(m.staleLogGcTickInterval),
+		tailer.LogRateInterval(m.logRateInterval),
 	}
 	if m.oneShot {
 		opts = append(opts, tailer.OneShot)
@@ -165,38 +358,153 @@ func (m *Server) initTailer() (err error) {
 	if m.ignoreRegexPattern != "" {
 		opts = append(opts, tailer.IgnoreRegex(m.ignoreRegexPattern))
 	}
+	if m.maxOpenLogFiles > 0 {
+		opts = append(opts, tailer.MaxOpenFiles(m.maxOpenLogFiles))
+	}
+	if m.dedupLines != nil {
+		opts = append(opts, tailer.Dedup(m.dedupLines.window, m.dedupLines.count))
+	}
+	if len(m.logPollIntervals) > 0 {
+		opts = append(opts, tailer.PollIntervals(m.logPollIntervals))
+	}
+	if len(m.logTimezones) > 0 {
+		opts = append(opts, tailer.Timezones(m.logTimezones))
+	}
+	if len(m.logRecords) > 0 {
+		opts = append(opts, tailer.RecordFormats(m.logRecords))
+	}
 	if len(m.logPathPatterns) > 0 {
 		opts = append(opts, tailer.LogPatterns(m.logPathPatterns))
 	}
-	m.t, err = tailer.New(m.ctx, m.l, m.w, opts...)
+	if len(m.resumeOffsets) > 0 {
+		opts = append(opts, tailer.ResumeOffsets(m.resumeOffsets))
+	}
+	var llp logline.Processor = m.l
+	if m.severityCounts {
+		c := severity.NewCounter(llp)
+		m.reg.MustRegister(c)
+		llp = c
+	}
+	if m.cpuLimit > 0 {
+		llp = newCPUThrottle(llp, m.cpuLimit)
+	}
+	m.t, err = tailer.New(m.ctx, llp, m.w, opts...)
+	if err != nil {
+		return
+	}
+	m.reg.MustRegister(m.t)
+	if m.memoryBudget != nil && !m.oneShot {
+		go newLoadShedder(*m.memoryBudget, m.t, m.store).run(m.ctx, shedCheckInterval)
+	}
 	return
 }
 
 // New creates a MtailServer from the supplied Options.
 func New(ctx context.Context, store *metrics.Store, w watcher.Watcher, options ...Option) (*Server, error) {
 	m := &Server{
-		store:     store,
-		w:         w,
-		webquit:   make(chan struct{}),
-		closeQuit: make(chan struct{}),
-		h:         &http.Server{},
+		store:   store,
+		w:       w,
+		webquit: make(chan struct{}),
+		h:       &http.Server{},
+
+		healthStallTimeout: time.Minute,
 		// Using a non-pedantic registry means we can be looser with metrics that
 		// are not fully specified at startup.
 		reg: prometheus.NewRegistry(),
 	}
 	m.ctx, m.cancel = context.WithCancel(ctx)
 
+	ls, offsets, err := inheritUpgrade()
+	if err != nil {
+		return nil, err
+	}
+	if ls != nil {
+		m.listeners, m.listenersInherited = ls, true
+		m.resumeOffsets = offsets
+	}
+
 	expvarDescs := map[string]*prometheus.Desc{
 		// internal/tailer/file.go
 		"log_errors_total":    prometheus.NewDesc("log_errors_total", "number of IO errors encountered per log file", []string{"logfile"}, nil),
 		"log_rotations_total": prometheus.NewDesc("log_rotations_total", "number of log rotation events per log file", []string{"logfile"}, nil),
 		"log_truncates_total": prometheus.NewDesc("log_truncates_total", "number of log truncation events log file", []string{"logfile"}, nil),
 		"log_lines_total":     prometheus.NewDesc("log_lines_total", "number of lines read per log file", []string{"logfile"}, nil),
+		"log_bytes_total":     prometheus.NewDesc("log_bytes_total", "number of bytes read per log file", []string{"logfile"}, nil),
+		// internal/tailer/budget.go
+		"log_idle_closes_total": prometheus.NewDesc("log_idle_closes_total", "number of idle log files closed to stay within the open file budget", nil, nil),
+		"log_files_open":        prometheus.NewDesc("log_files_open", "number of log files holding a file descriptor, when the open files are limited", nil, nil),
+		// internal/tailer/binary.go
+		"log_binary_skipped_total": prometheus.NewDesc("log_binary_skipped_total", "number of files matching a log pattern that were not tailed because they look binary", nil, nil),
+		// internal/tailer/record.go
+		"log_record_errors_total": prometheus.NewDesc("log_record_errors_total", "number of binary records that could not be decoded per log file", []string{"logfile"}, nil),
+		// internal/tailer/dedup.go
+		"log_lines_deduplicated_total": prometheus.NewDesc("log_lines_deduplicated_total", "number of lines dropped as repeats of a recent line per log file", []string{"logfile"}, nil),
+		// internal/tailer/shed.go
+		"log_bytes_shed_total": prometheus.NewDesc("log_bytes_shed_total", "number of bytes skipped without being read to shed load under memory pressure per log file", []string{"logfile"}, nil),
+		"logs_paused":          prometheus.NewDesc("logs_paused", "number of low priority log files not being read to shed load under memory pressure", nil, nil),
+		// internal/watcher/notify.go
+		"log_watcher_notify_fallbacks_total":        prometheus.NewDesc("log_watcher_notify_fallbacks_total", "number of watched paths the change notifier could not watch, which are polled instead", nil, nil),
+		"log_watcher_notifications_total":           prometheus.NewDesc("log_watcher_notifications_total", "number of change notifications received from the change notifier", nil, nil),
+		"log_watcher_notifications_coalesced_total": prometheus.NewDesc("log_watcher_notifications_coalesced_total", "number of change notifications for a path already waiting to be polled", nil, nil),
 		// internal/vm/loader.go
-		"lines_total":               prometheus.NewDesc("lines_total", "number of lines received by the program loader", nil, nil),
-		"prog_loads_total":          prometheus.NewDesc("prog_loads_total", "number of program load events by program source filename", []string{"prog"}, nil),
-		"prog_load_errors_total":    prometheus.NewDesc("prog_load_errors_total", "number of errors encountered when loading per program source filename", []string{"prog"}, nil),
-		"prog_runtime_errors_total": prometheus.NewDesc("prog_runtime_errors_total", "number of errors encountered when executing programs per source filename", []string{"prog"}, nil),
+		"lines_total":                  prometheus.NewDesc("lines_total", "number of lines received by the program loader", nil, nil),
+		"prog_loads_total":             prometheus.NewDesc("prog_loads_total", "number of program load events by program source filename", []string{"prog"}, nil),
+		"prog_load_errors_total":       prometheus.NewDesc("prog_load_errors_total", "number of errors encountered when loading per program source filename", []string{"prog"}, nil),
+		"prog_runtime_errors_total":    prometheus.NewDesc("prog_runtime_errors_total", "number of errors encountered when executing programs per source filename", []string{"prog"}, nil),
+		"prog_runtime_panics_total":    prometheus.NewDesc("prog_runtime_panics_total", "number of panics recovered when executing programs per source filename", []string{"prog"}, nil),
+		"prog_conversion_errors_total": prometheus.NewDesc("prog_conversion_errors_total", "number of conversion and timestamp parse errors in strict programs per source filename", []string{"prog"}, nil),
+		// internal/vm/scope.go
+		"prog_scoped_lines_total":         prometheus.NewDesc("prog_scoped_lines_total", "number of lines given to each program bound to log patterns", []string{"prog"}, nil),
+		"prog_scoped_lines_skipped_total": prometheus.NewDesc("prog_scoped_lines_skipped_total", "number of lines not given to each program bound to log patterns because their log matched none", []string{"prog"}, nil),
+		// internal/vm/timestamp.go
+		"prog_timestamps_clamped_total": prometheus.NewDesc("prog_timestamps_clamped_total", "number of metric updates with out of bounds timestamps made at the current time instead per source filename", []string{"prog"}, nil),
+		"prog_timestamps_dropped_total": prometheus.NewDesc("prog_timestamps_dropped_total", "number of metric updates dropped for out of bounds timestamps per source filename", []string{"prog"}, nil),
+		// internal/vm/overflow.go
+		"prog_int_overflows_total": prometheus.NewDesc("prog_int_overflows_total", "number of integer metric increments and decrements that passed the limits of an int64 per source filename", []string{"prog"}, nil),
+		// internal/vm/backtrack.go
+		"prog_backtracking_step_limits_total": prometheus.NewDesc("prog_backtracking_step_limits_total", "number of matches of backtracking regular expressions that gave up after too many steps per source filename", []string{"prog"}, nil),
+		// internal/vm/sample.go
+		"prog_sample_rate":          prometheus.NewDesc("prog_sample_rate", "one in how many times the block of each sample statement runs, per program source filename and line", []string{"prog", "line"}, nil),
+		"prog_sample_skipped_total": prometheus.NewDesc("prog_sample_skipped_total", "number of times a sample statement skipped its block per source filename", []string{"prog"}, nil),
+		// internal/vm/router.go
+		"prog_filtered_logs_total": prometheus.NewDesc("prog_filtered_logs_total", "number of logs not processed by each program because their filename did not pass its filters per source filename", []string{"prog"}, nil),
+		// internal/vm/codegen/regexps.go
+		"regexp_cache_hits_total": prometheus.NewDesc("regexp_cache_hits_total", "number of regular expressions shared with the programs already loaded rather than compiled", nil, nil),
+		"regexp_cache_size":       prometheus.NewDesc("regexp_cache_size", "number of distinct regular expressions used by the programs loaded", nil, nil),
+		// internal/vm/sandbox.go
+		"prog_sandbox_timeouts_total": prometheus.NewDesc("prog_sandbox_timeouts_total", "number of lines sandboxed programs ran out of time processing per source filename", []string{"prog"}, nil),
+		// internal/vm/jit.go
+		"prog_jit_compiles_total": prometheus.NewDesc("prog_jit_compiles_total", "number of times each program was compiled to closures once it was hot per source filename", []string{"prog"}, nil),
+		// internal/metrics/monotonic.go
+		"metric_counter_resets_total": prometheus.NewDesc("metric_counter_resets_total", "number of times a counter was found to have decreased since the metrics were last exported per metric", []string{"metric"}, nil),
+		// internal/exporter/stream.go
+		"stream_clients":              prometheus.NewDesc("stream_clients", "number of clients connected to the metric update stream", nil, nil),
+		"stream_events_dropped_total": prometheus.NewDesc("stream_events_dropped_total", "number of metric update events dropped because a stream client was reading too slowly", nil, nil),
+		// internal/mtail/shed.go
+		"memory_shed_level":  prometheus.NewDesc("memory_shed_level", "number of stages of load shedding in effect because the memory in use is near the limit", nil, nil),
+		"memory_sheds_total": prometheus.NewDesc("memory_sheds_total", "number of load shedding actions taken under memory pressure per action", []string{"action"}, nil),
+		// internal/mtail/cpu.go
+		"cpu_throttled_seconds_total": prometheus.NewDesc("cpu_throttled_seconds_total", "time lines were held back from the programs to keep within the CPU limit", nil, nil),
+		// internal/logging/ratelimit.go
+		"log_messages_suppressed_total": prometheus.NewDesc("log_messages_suppressed_total", "number of repeated messages left out of the mtail log by rate limiting", nil, nil),
+		// internal/alert/alert.go
+		"alerts_total":               prometheus.NewDesc("alerts_total", "number of alerts raised per program", []string{"prog"}, nil),
+		"alerts_suppressed_total":    prometheus.NewDesc("alerts_suppressed_total", "number of alerts not posted to the webhook because of the alert interval or a full queue per program", []string{"prog"}, nil),
+		"alert_webhook_errors_total": prometheus.NewDesc("alert_webhook_errors_total", "number of alerts the webhook failed to accept", nil, nil),
+		// internal/secret/secret.go
+		"secret_reloads_total":       prometheus.NewDesc("secret_reloads_total", "number of times a secret was reread after its file changed per secret", []string{"secret"}, nil),
+		"secret_reload_errors_total": prometheus.NewDesc("secret_reload_errors_total", "number of failures to reread a secret per secret", []string{"secret"}, nil),
+		// internal/geoip/geoip.go
+		"geoip_database_reloads_total":       prometheus.NewDesc("geoip_database_reloads_total", "number of GeoIP database files reread after they changed", nil, nil),
+		"geoip_database_reload_errors_total": prometheus.NewDesc("geoip_database_reload_errors_total", "number of changed GeoIP database files that could not be read", nil, nil),
+		// internal/bundle/bundle.go
+		"prog_bundle_fetches_total":      prometheus.NewDesc("prog_bundle_fetches_total", "number of attempts to fetch the program bundle", nil, nil),
+		"prog_bundle_fetch_errors_total": prometheus.NewDesc("prog_bundle_fetch_errors_total", "number of program bundle fetches that failed to download or verify", nil, nil),
+		"prog_bundle_updates_total":      prometheus.NewDesc("prog_bundle_updates_total", "number of new program bundles installed", nil, nil),
+		// internal/action/exec.go
+		"exec_runs_total":       prometheus.NewDesc("exec_runs_total", "number of runs of each command requested by programs", []string{"command"}, nil),
+		"exec_suppressed_total": prometheus.NewDesc("exec_suppressed_total", "number of requests to run each command ignored because it ran within the interval or was still running", []string{"command"}, nil),
+		"exec_errors_total":     prometheus.NewDesc("exec_errors_total", "number of runs of each command that failed to start, timed out, or exited with an error", []string{"command"}, nil),
 	}
 	m.reg.MustRegister(
 		prometheus.NewGoCollector(),
@@ -204,9 +512,21 @@ func New(ctx context.Context, store *metrics.Store, w watcher.Watcher, options .
 	// Prefix all expvar metrics with 'mtail_'
 	prometheus.WrapRegistererWithPrefix("mtail_", m.reg).MustRegister(
 		prometheus.NewExpvarCollector(expvarDescs))
+	if c := newGoRuntimeCollector(); c != nil {
+		prometheus.WrapRegistererWithPrefix("mtail_", m.reg).MustRegister(c)
+	}
 	if err := m.SetOption(options...); err != nil {
 		return nil, err
 	}
+	if err := m.setUnixSocketPermissions(); err != nil {
+		return nil, err
+	}
+	if err := m.limitCPU(); err != nil {
+		return nil, err
+	}
+	if err := m.dropPrivileges(); err != nil {
+		return nil, err
+	}
 	if err := m.initExporter(); err != nil {
 		return nil, err
 	}
@@ -242,19 +562,49 @@ func (m *Server) WriteMetrics(w io.Writer) error {
 	return err
 }
 
+// writeParquetFile writes the metrics store in Parquet format to the
+// oneShotParquetFile.
+func (m *Server) writeParquetFile() error {
+	f, err := os.Create(m.oneShotParquetFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to create Parquet file")
+	}
+	if err := m.e.WriteParquet(f); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write Parquet file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to write Parquet file")
+	}
+	logging.Infof("Wrote metrics to %s", m.oneShotParquetFile)
+	return nil
+}
+
 // Serve begins the webserver and awaits a shutdown instruction.
 func (m *Server) Serve() error {
-	if m.bindAddress == "" && m.bindUnixSocket == "" {
+	if len(m.listeners) == 0 {
 		return errors.Errorf("No bind address provided.")
 	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/favicon.ico", FaviconHandler)
 	mux.Handle("/", m)
+	mux.HandleFunc("/dashboard", m.dashboardHandler)
+	mux.HandleFunc("/dashboard/data", m.dashboardDataHandler)
 	mux.Handle("/progz", http.HandlerFunc(m.l.ProgzHandler))
+	mux.Handle("/progz/trace", http.HandlerFunc(m.l.TraceHandler))
+	mux.Handle("/progz/", http.HandlerFunc(m.l.ASTHandler))
+	mux.HandleFunc("/healthz", m.healthzHandler)
+	mux.HandleFunc("/readyz", m.readyzHandler)
+	mux.HandleFunc("/sd", m.sdHandler)
+	mux.HandleFunc("/logs", m.logsHandler)
+	mux.HandleFunc("/logs/stats", m.t.StatsHandler)
 	mux.HandleFunc("/json", http.HandlerFunc(m.e.HandleJSON))
-	mux.Handle("/metrics", promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/stream", m.streamHandler)
+	mux.Handle("/metrics", promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{EnableOpenMetrics: m.openMetrics}))
 	mux.HandleFunc("/varz", http.HandlerFunc(m.e.HandleVarz))
 	mux.HandleFunc("/quitquitquit", http.HandlerFunc(m.quitHandler))
+	mux.HandleFunc("/loglevel", logging.LevelHandler)
+	mux.HandleFunc("/debug/flags", m.flagsHandler)
 	mux.Handle("/debug/vars", expvar.Handler())
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -265,41 +615,71 @@ func (m *Server) Serve() error {
 	m.h.Handler = mux
 	m.e.StartMetricPush()
 
-	errc := make(chan error, 1)
-	go func() {
-		if m.bindAddress != "" {
-			glog.Infof("Listening on %s", m.listener.Addr())
-		} else {
-			glog.Infof("Listening on UNIX socket %s", m.bindUnixSocket)
-		}
+	errc := make(chan error, len(m.listeners))
+	for _, l := range m.listeners {
+		l := l
+		go func() {
+			if _, ok := l.(*net.UnixListener); ok {
+				logging.Infof("Listening on UNIX socket %s", l.Addr())
+			} else {
+				logging.Infof("Listening on %s", l.Addr())
+			}
 
-		err := m.h.Serve(m.listener)
+			err := m.h.Serve(l)
 
-		if err == http.ErrServerClosed {
-			err = nil
-		}
-		errc <- err
-	}()
+			if err == http.ErrServerClosed {
+				err = nil
+			}
+			errc <- err
+		}()
+	}
 	m.WaitForShutdown()
-	return <-errc
+	var err error
+	for range m.listeners {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
-// WaitForShutdown handles shutdown requests from the system or the UI.
+// WaitForShutdown handles shutdown requests from the system or the UI, and
+// upgrade requests, which shut down this Server once a new process has taken
+// over.
 func (m *Server) WaitForShutdown() {
 	n := make(chan os.Signal, 1)
 	signal.Notify(n, os.Interrupt, syscall.SIGTERM)
-	select {
-	case <-m.ctx.Done():
-		glog.Info("External shutdown, exiting...")
-	case <-n:
-		glog.Info("Received SIGTERM, exiting...")
-	case <-m.webquit:
-		glog.Info("Received Quit from HTTP, exiting...")
-	case <-m.closeQuit:
-		glog.Info("Received quit internally, exiting...")
+	u := make(chan os.Signal, 1)
+	notifyUpgrade(u)
+	defer signal.Stop(u)
+	d := make(chan os.Signal, 1)
+	notifyDiagnostics(d)
+	defer signal.Stop(d)
+	for {
+		select {
+		case <-m.ctx.Done():
+			// Close cancels the context too.
+			logging.Info("Context cancelled, exiting...")
+		case <-n:
+			logging.Info("Received SIGTERM, exiting...")
+		case <-m.webquit:
+			logging.Info("Received Quit from HTTP, exiting...")
+		case <-u:
+			logging.Info("Received SIGUSR2, upgrading...")
+			if err := m.upgrade(); err != nil {
+				logging.Errorf("Upgrade failed, continuing to run: %s", err)
+				continue
+			}
+			logging.Info("Upgrade started, exiting...")
+		case <-d:
+			logging.Info("Received SIGUSR1, dumping diagnostics...")
+			m.dumpDiagnostics()
+			continue
+		}
+		break
 	}
 	if err := m.Close(false); err != nil {
-		glog.Warning(err)
+		logging.Warning(err)
 	}
 }
 
@@ -308,38 +688,46 @@ func (m *Server) WaitForShutdown() {
 // waiting.
 func (m *Server) Close(fast bool) error {
 	m.closeOnce.Do(func() {
-		glog.Info("Shutdown requested.")
-		close(m.closeQuit)
-		// Ensure we're cancelling our child context just in case Close is
-		// called outside context cancellation.
+		logging.Info("Shutdown requested.")
+		// Cancelling the context stops WaitForShutdown, the exporter, and
+		// any loops of the loader and tailer not closed below.
 		m.cancel()
 		// If we have a tailer (i.e. not in test) then signal the tailer to
 		// shut down, which will cause the watcher to shut down.
 		if m.t != nil {
 			err := m.t.Close()
 			if err != nil {
-				glog.Infof("tailer close failed: %s", err)
+				logging.Infof("tailer close failed: %s", err)
 			}
 		}
 		// If we have a loader, shut it down.
 		if m.l != nil {
 			m.l.Close()
 		} else {
-			glog.V(2).Info("No loader, so not waiting for loader shutdown.")
+			logging.V(2).Info("No loader, so not waiting for loader shutdown.")
+		}
+		// Let the commands started by the last lines finish.
+		if m.runner != nil {
+			m.runner.Wait()
+		}
+		// Streams never finish by themselves, so end them before waiting for
+		// the requests being served.
+		if m.updateStream != nil {
+			m.updateStream.Close()
 		}
 		if m.h != nil {
-			glog.Info("Shutting down http server")
+			logging.Info("Shutting down http server")
 			if fast {
 				m.h.Close()
 			} else {
 				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 				if err := m.h.Shutdown(ctx); err != nil {
-					glog.Error(err)
+					logging.Error(err)
 				}
 				cancel()
 			}
 		}
-		glog.Info("END OF LINE")
+		logging.Info("END OF LINE")
 	})
 	return nil
 }
@@ -349,7 +737,7 @@ func (m *Server) Close(fast bool) error {
 // OneShot mode is enabled, it will exit.
 func (m *Server) Run() error {
 	if m.compileOnly {
-		glog.Info("compile-only is set, exiting")
+		logging.Info("compile-only is set, exiting")
 		return nil
 	}
 	if err := m.StartTailing(); err != nil {
@@ -359,8 +747,13 @@ func (m *Server) Run() error {
 		if err := m.Close(true); err != nil {
 			return err
 		}
+		if m.oneShotParquetFile != "" {
+			if err := m.writeParquetFile(); err != nil {
+				return err
+			}
+		}
 		if m.omitDumpMetricsStore {
-			glog.Info("Store dump disabled, exiting")
+			logging.Info("Store dump disabled, exiting")
 			return nil
 		}
 		fmt.Printf("Metrics store:")
@@ -375,9 +768,10 @@ func (m *Server) Run() error {
 	return nil
 }
 
+// Addr returns the address of the first listener of the HTTP server.
 func (m *Server) Addr() string {
-	if m.listener == nil {
+	if len(m.listeners) == 0 {
 		return "none"
 	}
-	return m.listener.Addr().String()
+	return m.listeners[0].Addr().String()
 }
@@ -8,7 +8,7 @@ import (
 	"path"
 	"testing"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/mtail"
 	"github.com/google/mtail/internal/testutil"
 )
@@ -36,7 +36,7 @@ func TestMultipleLinesInOneWrite(t *testing.T) {
 		lineCountCheck := m.ExpectMetricDeltaWithDeadline("lines_total", 1)
 		n, err := f.WriteString("line 1\n")
 		testutil.FatalIfErr(t, err)
-		glog.Infof("Wrote %d bytes", n)
+		logging.Infof("Wrote %d bytes", n)
 		m.PollWatched()
 		lineCountCheck()
 	}
@@ -45,7 +45,7 @@ func TestMultipleLinesInOneWrite(t *testing.T) {
 		lineCountCheck := m.ExpectMetricDeltaWithDeadline("lines_total", 2)
 		n, err := f.WriteString("line 2\nline 3\n")
 		testutil.FatalIfErr(t, err)
-		glog.Infof("Wrote %d bytes", n)
+		logging.Infof("Wrote %d bytes", n)
 		m.PollWatched()
 		lineCountCheck()
 	}
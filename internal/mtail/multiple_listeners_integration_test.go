@@ -0,0 +1,43 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package mtail_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestMultipleListeners(t *testing.T) {
+	testutil.SkipIfShort(t)
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	unixSocket := filepath.Join(tmpDir, "mtail.socket")
+
+	ts, stopM := mtail.TestStartServer(t, 0,
+		mtail.LogPathPatterns(filepath.Join(tmpDir, "*.log")),
+		mtail.ProgramPath("../../examples/linecount.mtail"),
+		mtail.BindAddress("127.0.0.1", "0"),
+		mtail.BindUnixSocket(unixSocket),
+		mtail.UnixSocketPermissions(0o600, -1, -1))
+	defer stopM()
+
+	// The first listener is the TCP address given.
+	if mtail.TestGetMetric(t, ts.Addr(), "log_count") == nil {
+		t.Error("no log_count from the TCP listener")
+	}
+	if getMetricFromUNIXSocket(t, unixSocket, "log_count") == nil {
+		t.Error("no log_count from the UNIX socket listener")
+	}
+	fi, err := os.Stat(unixSocket)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, os.FileMode(0o600), fi.Mode().Perm())
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"compress/gzip"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/watcher"
+)
+
+const outOfOrderProgram = `counter out_of_order
+gauge last_seq
+/^(\d+)$/ {
+  $1 < last_seq {
+    out_of_order++
+  }
+  last_seq = $1
+}
+`
+
+func TestOneShotOrder(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	progFile := filepath.Join(tmpDir, "order.mtail")
+	p := testutil.TestOpenFile(t, progFile)
+	testutil.WriteString(t, p, outOfOrderProgram)
+	testutil.FatalIfErr(t, p.Close())
+	// Read in name order, the newest log comes first.
+	f := testutil.TestOpenFile(t, filepath.Join(tmpDir, "app.log"))
+	testutil.WriteString(t, f, "5\n6\n")
+	testutil.FatalIfErr(t, f.Close())
+	f = testutil.TestOpenFile(t, filepath.Join(tmpDir, "app.log.1"))
+	testutil.WriteString(t, f, "3\n4\n")
+	testutil.FatalIfErr(t, f.Close())
+	f = testutil.TestOpenFile(t, filepath.Join(tmpDir, "app.log.2.gz"))
+	gz := gzip.NewWriter(f)
+	_, err := gz.Write([]byte("1\n2\n"))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, gz.Close())
+	testutil.FatalIfErr(t, f.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := metrics.NewStore()
+	m, err := mtail.New(ctx, store, watcher.NewFakeWatcher(),
+		mtail.ProgramPath(progFile),
+		mtail.LogPathPatterns(filepath.Join(tmpDir, "app.log*")),
+		mtail.OneShot,
+		mtail.OneShotOrder(nil, ""),
+		mtail.OmitDumpMetricStore)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, m.Run())
+
+	for name, expected := range map[string]int64{"out_of_order": 0, "last_seq": 6} {
+		d, err := store.Metrics[name][0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		testutil.ExpectNoDiff(t, expected, datum.GetInt(d))
+	}
+}
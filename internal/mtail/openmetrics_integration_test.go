@@ -0,0 +1,55 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+const openMetricsAccept = "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5"
+
+func scrape(t *testing.T, addr string) (contentType, body string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", "http://"+addr+"/metrics", nil)
+	testutil.FatalIfErr(t, err)
+	req.Header.Set("Accept", openMetricsAccept)
+	resp, err := http.DefaultClient.Do(req)
+	testutil.FatalIfErr(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	testutil.FatalIfErr(t, err)
+	return resp.Header.Get("Content-Type"), string(b)
+}
+
+func TestOpenMetricsExposition(t *testing.T) {
+	testutil.SkipIfShort(t)
+
+	for _, tc := range []struct {
+		name    string
+		options []mtail.Option
+		eof     bool
+	}{
+		{"default", nil, false},
+		{"openmetrics", []mtail.Option{mtail.OpenMetrics}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, stopM := mtail.TestStartServer(t, 0, tc.options...)
+			defer stopM()
+
+			contentType, body := scrape(t, m.Addr())
+			if got := strings.HasPrefix(contentType, "application/openmetrics-text"); got != tc.eof {
+				t.Errorf("Content-Type %q, expected OpenMetrics %v", contentType, tc.eof)
+			}
+			if got := strings.HasSuffix(body, "# EOF\n"); got != tc.eof {
+				t.Errorf("response ends with # EOF %v, expected %v", got, tc.eof)
+			}
+		})
+	}
+}
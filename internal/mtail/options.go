@@ -4,11 +4,22 @@
 package mtail
 
 import (
+	"crypto/ed25519"
+	"crypto/x509"
 	"fmt"
 	"net"
+	"os"
+	"regexp"
 	"time"
 
 	"contrib.go.opencensus.io/exporter/jaeger"
+	"github.com/google/mtail/internal/action"
+	"github.com/google/mtail/internal/bundle"
+	"github.com/google/mtail/internal/exporter"
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/record"
+	"github.com/google/mtail/internal/tailer"
+	"github.com/google/mtail/internal/vm"
 	"go.opencensus.io/trace"
 )
 
@@ -45,7 +56,8 @@ func (opt IgnoreRegexPattern) apply(m *Server) error {
 	return nil
 }
 
-// BindAddress sets the HTTP server address in Server.
+// BindAddress adds an address for the HTTP server to listen on.  It, and
+// BindUnixSocket, may be given more than once to listen on several addresses.
 func BindAddress(address, port string) Option {
 	return &bindAddress{address, port}
 }
@@ -55,26 +67,57 @@ type bindAddress struct {
 }
 
 func (opt bindAddress) apply(m *Server) error {
-	if m.listener != nil {
-		return fmt.Errorf("HTTP server bind address already supplied")
-	}
-	m.bindAddress = net.JoinHostPort(opt.address, opt.port)
-	var err error
-	m.listener, err = net.Listen("tcp", m.bindAddress)
-	return err
+	return m.bind("tcp", net.JoinHostPort(opt.address, opt.port))
 }
 
-// BindUnixSocket sets the UNIX socket path in Server.
+// BindUnixSocket adds a UNIX socket path for the HTTP server to listen on.
 type BindUnixSocket string
 
 func (opt BindUnixSocket) apply(m *Server) error {
-	if m.listener != nil {
-		return fmt.Errorf("HTTP server bind address already supplied")
-	}
-	m.bindUnixSocket = string(opt)
-	var err error
-	m.listener, err = net.Listen("unix", string(opt))
-	return err
+	return m.bind("unix", string(opt))
+}
+
+// UnixSocketPermissions sets the mode, owner and group of the UNIX sockets
+// the HTTP server listens on, once they are made.  A mode of zero, or a uid or
+// gid of -1, leaves that unchanged.
+func UnixSocketPermissions(mode os.FileMode, uid, gid int) Option {
+	return &unixSocketPermissions{mode, uid, gid}
+}
+
+type unixSocketPermissions struct {
+	mode     os.FileMode
+	uid, gid int
+}
+
+func (opt unixSocketPermissions) apply(m *Server) error {
+	m.unixSocketPermissions = &opt
+	return nil
+}
+
+// Chroot sets the directory that the Server changes its root directory to,
+// once the listening socket is open.  The program path and log path patterns
+// must be inside this directory.
+type Chroot string
+
+func (opt Chroot) apply(m *Server) error {
+	m.chrootDir = string(opt)
+	return nil
+}
+
+// DropPrivileges sets the user and group the Server runs as, once the
+// listening socket is open.
+func DropPrivileges(uid, gid int) Option {
+	return &dropPrivileges{uid, gid}
+}
+
+type dropPrivileges struct {
+	uid, gid int
+}
+
+func (opt dropPrivileges) apply(m *Server) error {
+	m.dropIds = true
+	m.uid, m.gid = opt.uid, opt.gid
+	return nil
 }
 
 // SetBuildInfo sets the mtail program build information in the Server.
@@ -115,6 +158,331 @@ func (opt LogPatternPollTickInterval) apply(m *Server) error {
 	return nil
 }
 
+// LogRateInterval sets how often the tailer measures the rates of lines and
+// bytes read from each log.
+type LogRateInterval time.Duration
+
+func (opt LogRateInterval) apply(m *Server) error {
+	m.logRateInterval = time.Duration(opt)
+	return nil
+}
+
+// MaxOpenLogFiles sets how many log files are kept open at once; the least
+// recently read are closed beyond that, and reopened when they change.
+type MaxOpenLogFiles int
+
+func (opt MaxOpenLogFiles) apply(m *Server) error {
+	m.maxOpenLogFiles = int(opt)
+	return nil
+}
+
+// DedupLines sets the Server to drop each line that exactly repeats one of the
+// last count distinct lines of its log passed on within window.
+func DedupLines(window time.Duration, count int) Option {
+	return &dedupLines{window, count}
+}
+
+type dedupLines struct {
+	window time.Duration
+	count  int
+}
+
+func (opt dedupLines) apply(m *Server) error {
+	m.dedupLines = &opt
+	return nil
+}
+
+// LogTimezones sets the timezone of timestamps that don't name one in the logs
+// matching each glob pattern, instead of the OverrideLocation.
+type LogTimezones map[string]*time.Location
+
+func (opt LogTimezones) apply(m *Server) error {
+	m.logTimezones = opt
+	return nil
+}
+
+// LogRecords sets the format of the binary records that the logs matching
+// each glob pattern are made of.
+type LogRecords map[string]record.Format
+
+func (opt LogRecords) apply(m *Server) error {
+	m.logRecords = opt
+	return nil
+}
+
+// DiagnosticsFile sets the file that diagnostics are appended to when
+// requested, instead of the info log.
+type DiagnosticsFile string
+
+func (opt DiagnosticsFile) apply(m *Server) error {
+	m.diagnosticsFile = string(opt)
+	return nil
+}
+
+// OneShotParquetFile sets the file that the metrics are written to in Parquet
+// format at the end of a one-shot run.
+type OneShotParquetFile string
+
+func (opt OneShotParquetFile) apply(m *Server) error {
+	m.oneShotParquetFile = string(opt)
+	return nil
+}
+
+// OneShotOrder has a one-shot run read the logs in the order they were
+// written, with rotated logs, including gzipped ones, oldest first.  If
+// timestamp is not nil, the lines of all the logs are interleaved in the
+// order of the timestamps its first capture group matches, parsed with
+// layout.
+func OneShotOrder(timestamp *regexp.Regexp, layout string) Option {
+	return oneShotOrder{tailer.BackfillOrder{Timestamp: timestamp, Layout: layout}}
+}
+
+type oneShotOrder struct {
+	order tailer.BackfillOrder
+}
+
+func (opt oneShotOrder) apply(m *Server) error {
+	m.oneShotOrder = &opt.order
+	return nil
+}
+
+// BoundTimestamps sets what programs do with metric updates timestamped more
+// than maxFuture ahead of or maxAge behind the current time.
+func BoundTimestamps(policy vm.TimestampPolicy, maxFuture, maxAge time.Duration) Option {
+	return &boundTimestamps{policy, maxFuture, maxAge}
+}
+
+type boundTimestamps struct {
+	policy            vm.TimestampPolicy
+	maxFuture, maxAge time.Duration
+}
+
+func (opt boundTimestamps) apply(m *Server) error {
+	m.timestampBounds = &opt
+	return nil
+}
+
+// IntOverflow sets what programs do when incrementing or decrementing an
+// integer metric passes the limits of an int64.
+func IntOverflow(policy vm.OverflowPolicy) Option {
+	return intOverflow(policy)
+}
+
+type intOverflow vm.OverflowPolicy
+
+func (opt intOverflow) apply(m *Server) error {
+	m.intOverflow = vm.OverflowPolicy(opt)
+	return nil
+}
+
+// AlertWebhook sets the URL that the alerts raised by programs are posted to,
+// as the payload made by tmpl, at most once per interval from each program.
+// The posts are authorized with the bearer token in tokenFile, if set, or
+// else in the environment.
+func AlertWebhook(url, tmpl, tokenFile string, interval time.Duration) Option {
+	return &alertWebhook{url, tmpl, tokenFile, interval}
+}
+
+type alertWebhook struct {
+	url, tmpl, tokenFile string
+	interval             time.Duration
+}
+
+func (opt alertWebhook) apply(m *Server) error {
+	m.alertWebhook = &opt
+	return nil
+}
+
+// ExecCommands sets the commands that programs may run with exec(), killed
+// after timeout, and run at most once per interval.
+func ExecCommands(commands []action.Command, timeout, interval time.Duration) Option {
+	return &execCommands{commands, timeout, interval}
+}
+
+type execCommands struct {
+	commands          []action.Command
+	timeout, interval time.Duration
+}
+
+func (opt execCommands) apply(m *Server) error {
+	m.execCommands = &opt
+	return nil
+}
+
+// AnomalyDetection sets the Server to score the rates of the counters and
+// the values of the gauges named by names against their moving averages,
+// sampled every interval, with each sample weighted by alpha.
+func AnomalyDetection(names []string, interval time.Duration, alpha float64) Option {
+	return &anomalyDetection{names, interval, alpha}
+}
+
+type anomalyDetection struct {
+	names    []string
+	interval time.Duration
+	alpha    float64
+}
+
+func (opt anomalyDetection) apply(m *Server) error {
+	if opt.interval <= 0 {
+		return fmt.Errorf("anomaly detection interval must be positive")
+	}
+	m.anomalyDetection = &opt
+	return nil
+}
+
+// GeoIPDatabases sets the paths of the MaxMind DB files that the
+// geoip_country() and geoip_asn() builtins look addresses up in, either of
+// which may be empty, and how often they are checked for changes.
+func GeoIPDatabases(countryPath, asnPath string, interval time.Duration) Option {
+	return &geoipDatabases{countryPath, asnPath, interval}
+}
+
+type geoipDatabases struct {
+	countryPath, asnPath string
+	interval             time.Duration
+}
+
+func (opt geoipDatabases) apply(m *Server) error {
+	if opt.interval <= 0 {
+		return fmt.Errorf("GeoIP database check interval must be positive")
+	}
+	m.geoipDatabases = &opt
+	return nil
+}
+
+// HMACKey sets the secret key that the hmac() builtin hashes with.
+type HMACKey []byte
+
+func (opt HMACKey) apply(m *Server) error {
+	m.hmacKey = opt
+	return nil
+}
+
+// Sandbox sets the Server to compile programs to WebAssembly and run them in a
+// sandbox, which stops a program taking longer than lineTimeout or making more
+// than lineBytes of strings on a line.  It is experimental.
+func Sandbox(lineTimeout time.Duration, lineBytes int) Option {
+	return &sandboxLimits{lineTimeout, lineBytes}
+}
+
+type sandboxLimits vm.SandboxLimits
+
+func (opt sandboxLimits) apply(m *Server) error {
+	m.sandbox = (*vm.SandboxLimits)(&opt)
+	return nil
+}
+
+// ExternConsts sets the values of the extern consts declared by programs, by
+// name, and the file of NAME=value lines giving those not in values, if any.
+func ExternConsts(values map[string]string, file string) Option {
+	return &externConsts{values, file}
+}
+
+type externConsts struct {
+	values map[string]string
+	file   string
+}
+
+func (opt *externConsts) apply(m *Server) error {
+	m.externConsts = opt
+	return nil
+}
+
+// JITAfter sets the Server to compile the bytecode of each program to Go
+// closures once it has spent this long interpreting lines.
+type JITAfter time.Duration
+
+func (opt JITAfter) apply(m *Server) error {
+	m.jitAfter = time.Duration(opt)
+	return nil
+}
+
+// FileLabels sets the rules that label the metrics of every program by the
+// path of the log each update came from.
+type FileLabels []vm.FileLabelRule
+
+func (opt FileLabels) apply(m *Server) error {
+	m.fileLabels = opt
+	return nil
+}
+
+// ProgramBundle sets the URL of a bundle of programs that the Server fetches
+// into the program path every interval, and the signature URL and public key
+// file that it must verify with.
+func ProgramBundle(url, signatureURL, publicKeyPath string, interval time.Duration) Option {
+	return &programBundle{url: url, signatureURL: signatureURL, publicKeyPath: publicKeyPath, interval: interval}
+}
+
+type programBundle struct {
+	url, signatureURL, publicKeyPath string
+	interval                         time.Duration
+
+	key ed25519.PublicKey
+}
+
+func (opt programBundle) apply(m *Server) error {
+	if opt.interval <= 0 {
+		return fmt.Errorf("program bundle poll interval must be positive")
+	}
+	// Read the key, and the system's certificate authorities for HTTPS, now
+	// as they may not be readable once privileges are dropped.
+	var err error
+	if opt.key, err = bundle.ReadPublicKey(opt.publicKeyPath); err != nil {
+		return err
+	}
+	if _, err := x509.SystemCertPool(); err != nil {
+		logging.Warningf("Failed to load system certificates: %s", err)
+	}
+	m.programBundle = &opt
+	return nil
+}
+
+// ProgramLogPatterns binds programs, by name, to the glob patterns of the logs
+// whose lines they process.  Programs not bound process every log.
+type ProgramLogPatterns map[string][]string
+
+func (opt ProgramLogPatterns) apply(m *Server) error {
+	m.programLogPatterns = opt
+	return nil
+}
+
+// LogPollIntervals sets how often the logs matching each glob pattern are
+// polled, instead of the watcher's poll interval.
+type LogPollIntervals map[string]time.Duration
+
+func (opt LogPollIntervals) apply(m *Server) error {
+	m.logPollIntervals = opt
+	return nil
+}
+
+// ServiceDiscoveryTarget sets the host:port the Server advertises as its
+// scrape target on the service discovery endpoint, instead of the listener
+// address.
+type ServiceDiscoveryTarget string
+
+func (opt ServiceDiscoveryTarget) apply(m *Server) error {
+	m.serviceDiscoveryTarget = string(opt)
+	return nil
+}
+
+// ServiceDiscoveryLabels sets extra labels the Server advertises with its
+// scrape target on the service discovery endpoint.
+type ServiceDiscoveryLabels map[string]string
+
+func (opt ServiceDiscoveryLabels) apply(m *Server) error {
+	m.serviceDiscoveryLabels = opt
+	return nil
+}
+
+// HealthStallTimeout sets how long a component may go without making progress
+// before the health endpoints report it as wedged.
+type HealthStallTimeout time.Duration
+
+func (opt HealthStallTimeout) apply(m *Server) error {
+	m.healthStallTimeout = time.Duration(opt)
+	return nil
+}
+
 type niladicOption struct {
 	applyfunc func(m *Server) error
 }
@@ -179,6 +547,39 @@ var OmitMetricSource = &niladicOption{
 		return nil
 	}}
 
+// InstrumentConditions sets the Server to count the lines matched by each
+// top-level condition of its programs.
+var InstrumentConditions = &niladicOption{
+	func(m *Server) error {
+		m.instrumentConditions = true
+		return nil
+	}}
+
+// SeverityCounts sets the Server to count the lines of each log by the
+// severity they were logged at, without a program.
+var SeverityCounts = &niladicOption{
+	func(m *Server) error {
+		m.severityCounts = true
+		return nil
+	}}
+
+// CorrectCounterResets sets the Server to export a counter that decreases as
+// though it had carried on from the value it had before, so that it never
+// decreases.
+var CorrectCounterResets = &niladicOption{
+	func(m *Server) error {
+		m.store.SetCorrectCounterResets(true)
+		return nil
+	}}
+
+// StreamUpdates sets the Server to stream the changes programs make to their
+// metrics to clients of /stream.
+var StreamUpdates = &niladicOption{
+	func(m *Server) error {
+		m.updateStream = exporter.NewStream()
+		return nil
+	}}
+
 // EmitMetricTimestamp tells the Server to export the metric's timestamp.
 var EmitMetricTimestamp = &niladicOption{
 	func(m *Server) error {
@@ -186,6 +587,31 @@ var EmitMetricTimestamp = &niladicOption{
 		return nil
 	}}
 
+// OpenMetrics lets the Server answer a scrape in the OpenMetrics text format,
+// ending with "# EOF", when the scraper asks for it.
+var OpenMetrics = &niladicOption{
+	func(m *Server) error {
+		m.openMetrics = true
+		return nil
+	}}
+
+// StrictStartup instructs the Server to fail unless every program loads and
+// compiles, before any log is read, rather than starting with the programs
+// that do.
+var StrictStartup = &niladicOption{
+	func(m *Server) error {
+		m.strictStartup = true
+		return nil
+	}}
+
+// Seccomp instructs the Server to install a seccomp filter after dropping
+// privileges, denying system calls it has no use for such as execve and mount.
+var Seccomp = &niladicOption{
+	func(m *Server) error {
+		m.seccomp = true
+		return nil
+	}}
+
 // JaegerReporter creates a new jaeger reporter that sends to the given Jaeger endpoint address.
 type JaegerReporter string
 
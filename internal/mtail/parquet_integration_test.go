@@ -0,0 +1,44 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/watcher"
+)
+
+func TestOneShotParquetFile(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	parquetFile := filepath.Join(tmpDir, "metrics.parquet")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m, err := mtail.New(ctx, metrics.NewStore(), watcher.NewFakeWatcher(),
+		mtail.ProgramPath("../../examples/rsyncd.mtail"),
+		mtail.LogPathPatterns("testdata/rsyncd.log"),
+		mtail.OneShot,
+		mtail.OneShotParquetFile(parquetFile),
+		mtail.OmitDumpMetricStore)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, m.Run())
+
+	b, err := ioutil.ReadFile(parquetFile)
+	testutil.FatalIfErr(t, err)
+	if !bytes.HasPrefix(b, []byte("PAR1")) || !bytes.HasSuffix(b, []byte("PAR1")) {
+		t.Errorf("%s is not a Parquet file", parquetFile)
+	}
+	if !bytes.Contains(b, []byte("transfers_total")) {
+		t.Errorf("%s has no transfers_total rows", parquetFile)
+	}
+}
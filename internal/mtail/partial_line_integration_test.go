@@ -8,7 +8,7 @@ import (
 	"path"
 	"testing"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/mtail"
 	"github.com/google/mtail/internal/testutil"
 )
@@ -38,7 +38,7 @@ func TestPartialLineRead(t *testing.T) {
 		lineCountCheck := m.ExpectMetricDeltaWithDeadline("lines_total", 1)
 		n, err := f.WriteString("line 1\n")
 		testutil.FatalIfErr(t, err)
-		glog.Infof("Wrote %d bytes", n)
+		logging.Infof("Wrote %d bytes", n)
 		m.PollWatched()
 		lineCountCheck()
 	}
@@ -47,7 +47,7 @@ func TestPartialLineRead(t *testing.T) {
 		lineCountCheck := m.ExpectMetricDeltaWithDeadline("lines_total", 0)
 		n, err := f.WriteString("line ")
 		testutil.FatalIfErr(t, err)
-		glog.Infof("Wrote %d bytes", n)
+		logging.Infof("Wrote %d bytes", n)
 		m.PollWatched()
 		lineCountCheck()
 	}
@@ -56,7 +56,7 @@ func TestPartialLineRead(t *testing.T) {
 		lineCountCheck := m.ExpectMetricDeltaWithDeadline("lines_total", 1)
 		n, err := f.WriteString("2\n")
 		testutil.FatalIfErr(t, err)
-		glog.Infof("Wrote %d bytes", n)
+		logging.Infof("Wrote %d bytes", n)
 		m.PollWatched()
 		lineCountCheck()
 	}
@@ -0,0 +1,91 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/pkg/errors"
+)
+
+// dropPrivileges confines the Server after the listening socket has been
+// opened, and before any programs or logs are read: it enters the chroot
+// directory, changes to the unprivileged user and group, and then installs
+// the seccomp filter, each if requested.
+func (m *Server) dropPrivileges() error {
+	if m.chrootDir != "" {
+		if err := m.enterChroot(); err != nil {
+			return err
+		}
+	}
+	// A process started by an upgrade inherits the unprivileged ids.
+	if m.dropIds && !(os.Getuid() == m.uid && os.Getgid() == m.gid) {
+		logging.Infof("Changing to uid %d gid %d", m.uid, m.gid)
+		if err := setIds(m.uid, m.gid); err != nil {
+			return errors.Wrap(err, "failed to drop privileges")
+		}
+	}
+	if m.seccomp {
+		if m.execCommands != nil {
+			return errors.New("programs can't run commands with exec() under a seccomp filter, which denies execve")
+		}
+		logging.Info("Installing seccomp filter")
+		if err := installSeccompFilter(); err != nil {
+			return errors.Wrap(err, "failed to install seccomp filter")
+		}
+	}
+	return nil
+}
+
+// enterChroot changes the root directory to m.chrootDir, and rewrites the
+// program path and log path patterns so they resolve to the same files inside
+// the chroot.
+func (m *Server) enterChroot() error {
+	root, err := filepath.Abs(m.chrootDir)
+	if err != nil {
+		return err
+	}
+	if m.programPath != "" {
+		if m.programPath, err = chrootPath(root, m.programPath); err != nil {
+			return err
+		}
+	}
+	for i, p := range m.logPathPatterns {
+		if m.logPathPatterns[i], err = chrootPath(root, p); err != nil {
+			return err
+		}
+	}
+	for prog, patterns := range m.programLogPatterns {
+		for i, p := range patterns {
+			if patterns[i], err = chrootPath(root, p); err != nil {
+				return errors.Wrapf(err, "log pattern for program %s", prog)
+			}
+		}
+	}
+	logging.Infof("Changing root directory to %s", root)
+	if err := chroot(root); err != nil {
+		return errors.Wrapf(err, "failed to chroot to %q", root)
+	}
+	return nil
+}
+
+// chrootPath returns the name of path p after a chroot to root, or an error if
+// p is not beneath root.
+func chrootPath(root, p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("%q is outside the chroot directory %q", p, root)
+	}
+	return filepath.Join(string(filepath.Separator), rel), nil
+}
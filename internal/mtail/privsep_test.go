@@ -0,0 +1,40 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestChrootPath(t *testing.T) {
+	root := filepath.FromSlash("/var/log")
+	for _, tc := range []struct {
+		p       string
+		want    string
+		wantErr bool
+	}{
+		{"/var/log", "/", false},
+		{"/var/log/syslog", "/syslog", false},
+		{"/var/log/nginx/*.log", "/nginx/*.log", false},
+		{"/var/log/../lib/mtail/progs", "", true},
+		{"/var/logs/syslog", "", true},
+		{"/etc/mtail", "", true},
+	} {
+		got, err := chrootPath(root, filepath.FromSlash(tc.p))
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("chrootPath(%q): expected error, received %q", tc.p, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("chrootPath(%q): unexpected error %s", tc.p, err)
+			continue
+		}
+		if got != filepath.FromSlash(tc.want) {
+			t.Errorf("chrootPath(%q): expected %q, received %q", tc.p, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package mtail
+
+import (
+	"os"
+	"syscall"
+)
+
+func chroot(dir string) error {
+	if err := syscall.Chroot(dir); err != nil {
+		return err
+	}
+	return os.Chdir("/")
+}
+
+// setIds changes the process to run as uid and gid, with no supplementary
+// groups.  The group must be changed first, while we still have the privilege
+// to do so.
+func setIds(uid, gid int) error {
+	if err := syscall.Setgroups(nil); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
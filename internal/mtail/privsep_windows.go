@@ -0,0 +1,16 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"github.com/pkg/errors"
+)
+
+func chroot(dir string) error {
+	return errors.New("chroot is not supported on windows")
+}
+
+func setIds(uid, gid int) error {
+	return errors.New("changing user and group is not supported on windows")
+}
@@ -8,7 +8,7 @@ import (
 	"path"
 	"testing"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/mtail"
 	"github.com/google/mtail/internal/testutil"
 )
@@ -20,7 +20,7 @@ func TestRelativeLog(t *testing.T) {
 
 	cwd, err := os.Getwd()
 	testutil.FatalIfErr(t, err)
-	glog.Infof("cwd is %q", cwd)
+	logging.Infof("cwd is %q", cwd)
 
 	testutil.FatalIfErr(t, os.Chdir(workdir))
 	defer func() {
@@ -0,0 +1,90 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/mtail/internal/logging"
+)
+
+// targetGroup is a Prometheus HTTP service discovery target group.  See
+// https://prometheus.io/docs/prometheus/latest/http_sd/
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdTarget returns the host:port that Prometheus should scrape this Server
+// at, the first TCP address it listens on, or the empty string if it is not
+// listening on TCP.
+func (m *Server) sdTarget() string {
+	if m.serviceDiscoveryTarget != "" {
+		return m.serviceDiscoveryTarget
+	}
+	var addr *net.TCPAddr
+	for _, l := range m.listeners {
+		if a, ok := l.Addr().(*net.TCPAddr); ok {
+			addr = a
+			break
+		}
+	}
+	if addr == nil {
+		return ""
+	}
+	host := addr.IP.String()
+	if addr.IP.IsUnspecified() {
+		// Listening on all addresses, so advertise the name of this host.
+		var err error
+		if host, err = os.Hostname(); err != nil {
+			logging.Warning(err)
+			return ""
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(addr.Port))
+}
+
+// sdLabels returns the labels to attach to this Server's target.  The
+// __meta_ labels are available to relabelling rules but are not attached to
+// the scraped metrics.
+func (m *Server) sdLabels() map[string]string {
+	labels := map[string]string{
+		"__metrics_path__":     "/metrics",
+		"__meta_mtail_version": m.buildInfo.Version,
+	}
+	if m.l != nil {
+		progs := m.l.ProgramNames()
+		sort.Strings(progs)
+		labels["__meta_mtail_programs"] = strings.Join(progs, ",")
+	}
+	for k, v := range m.serviceDiscoveryLabels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// sdHandler serves this Server's scrape target in the Prometheus HTTP
+// service discovery format, so Prometheus can discover a fleet of mtail
+// instances by asking each one, or a proxy that merges their responses.
+func (m *Server) sdHandler(w http.ResponseWriter, r *http.Request) {
+	groups := []targetGroup{}
+	if target := m.sdTarget(); target != "" {
+		groups = append(groups, targetGroup{Targets: []string{target}, Labels: m.sdLabels()})
+	}
+	b, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		logging.Warning(err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+type targetGroup struct {
+	Targets []string
+	Labels  map[string]string
+}
+
+func getTargetGroups(t *testing.T, addr string) []targetGroup {
+	t.Helper()
+	resp, err := http.Get("http://" + addr + "/sd")
+	testutil.FatalIfErr(t, err)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("sd: expected 200, received %d", resp.StatusCode)
+	}
+	var groups []targetGroup
+	testutil.FatalIfErr(t, json.NewDecoder(resp.Body).Decode(&groups))
+	return groups
+}
+
+func TestServiceDiscovery(t *testing.T) {
+	testutil.SkipIfShort(t)
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	progDir := path.Join(tmpDir, "progs")
+	testutil.FatalIfErr(t, os.Mkdir(progDir, 0700))
+	testutil.TestOpenFile(t, progDir+"/nocode.mtail")
+
+	m, stopM := mtail.TestStartServer(t, 0, mtail.ProgramPath(progDir))
+	defer stopM()
+
+	groups := getTargetGroups(t, m.Addr())
+	if len(groups) != 1 || len(groups[0].Targets) != 1 {
+		t.Fatalf("expected one target, received %v", groups)
+	}
+	_, port, err := net.SplitHostPort(m.Addr())
+	testutil.FatalIfErr(t, err)
+	hostname, err := os.Hostname()
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, net.JoinHostPort(hostname, port), groups[0].Targets[0])
+	testutil.ExpectNoDiff(t, "/metrics", groups[0].Labels["__metrics_path__"])
+	testutil.ExpectNoDiff(t, "nocode.mtail", groups[0].Labels["__meta_mtail_programs"])
+}
+
+func TestServiceDiscoveryOverrides(t *testing.T) {
+	testutil.SkipIfShort(t)
+
+	m, stopM := mtail.TestStartServer(t, 0,
+		mtail.ServiceDiscoveryTarget("mtail.example.com:3903"),
+		mtail.ServiceDiscoveryLabels{"job": "mtail", "env": "prod"})
+	defer stopM()
+
+	groups := getTargetGroups(t, m.Addr())
+	if len(groups) != 1 {
+		t.Fatalf("expected one target group, received %v", groups)
+	}
+	testutil.ExpectNoDiff(t, []string{"mtail.example.com:3903"}, groups[0].Targets)
+	testutil.ExpectNoDiff(t, "mtail", groups[0].Labels["job"])
+	testutil.ExpectNoDiff(t, "prod", groups[0].Labels["env"])
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"runtime"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Constants from linux/seccomp.h and linux/audit.h that are not in x/sys/unix.
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+
+	seccompRetAllow = 0x7fff0000
+	seccompRetErrno = 0x00050000
+
+	seccompDataNrOffset   = 0 // offsetof(struct seccomp_data, nr)
+	seccompDataArchOffset = 4 // offsetof(struct seccomp_data, arch)
+
+	x32SyscallBit = 0x40000000
+)
+
+// auditArches maps GOARCH to the AUDIT_ARCH value the kernel reports in the
+// seccomp data, so the filter can reject syscalls made with a different ABI.
+var auditArches = map[string]uint32{
+	"386":      0x40000003,
+	"amd64":    0xc000003e,
+	"arm":      0x40000028,
+	"arm64":    0xc00000b7,
+	"mips":     0x00000008,
+	"mipsle":   0x40000008,
+	"mips64":   0x80000008,
+	"mips64le": 0xc0000008,
+	"ppc64":    0x80000015,
+	"ppc64le":  0xc0000015,
+	"riscv64":  0xc00000f3,
+	"s390x":    0x80000016,
+}
+
+// deniedSyscalls are the system calls that mtail never needs once it is
+// running, and that are useful to an attacker who has subverted it.  A
+// denylist is used because the Go runtime's own use of system calls varies
+// between releases.
+var deniedSyscalls = []uint32{
+	unix.SYS_EXECVE,
+	unix.SYS_EXECVEAT,
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_PERSONALITY,
+	unix.SYS_MOUNT,
+	unix.SYS_UMOUNT2,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_CHROOT,
+	unix.SYS_SETNS,
+	unix.SYS_UNSHARE,
+	unix.SYS_REBOOT,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+	unix.SYS_ACCT,
+}
+
+// seccompFilter builds a BPF program that fails the denied system calls with
+// EPERM, and allows everything else made with the native ABI.
+func seccompFilter(arch uint32) []unix.SockFilter {
+	deny := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)}
+	f := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataArchOffset},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch},
+		deny,
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataNrOffset},
+	}
+	if runtime.GOARCH == "amd64" {
+		// The x32 ABI shares the amd64 audit arch, but numbers its
+		// syscalls from x32SyscallBit.
+		f = append(f,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jf: 1, K: x32SyscallBit},
+			deny)
+	}
+	for _, nr := range deniedSyscalls {
+		f = append(f,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 1, K: nr},
+			deny)
+	}
+	return append(f, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow})
+}
+
+// installSeccompFilter applies the seccomp filter to every thread in the
+// process.  It also sets no_new_privs, which the kernel requires of
+// unprivileged processes installing a filter.
+func installSeccompFilter() error {
+	arch, ok := auditArches[runtime.GOARCH]
+	if !ok {
+		return errors.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return errors.Wrap(err, "prctl(PR_SET_NO_NEW_PRIVS)")
+	}
+	filter := seccompFilter(arch)
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	r, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return errno
+	}
+	if r != 0 {
+		return errors.Errorf("thread %d could not be synchronised to the filter", r)
+	}
+	return nil
+}
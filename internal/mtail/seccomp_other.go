@@ -0,0 +1,15 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !linux
+// +build !linux
+
+package mtail
+
+import (
+	"github.com/pkg/errors"
+)
+
+func installSeccompFilter() error {
+	return errors.New("seccomp is only supported on linux")
+}
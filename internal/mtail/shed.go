@@ -0,0 +1,150 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"context"
+	"expvar"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/pkg/errors"
+)
+
+var (
+	// memoryShedLevel records how many stages of load shedding are in
+	// effect.
+	memoryShedLevel = expvar.NewInt("memory_shed_level")
+	// memorySheds counts the load shedding actions taken, by action.
+	memorySheds = expvar.NewMap("memory_sheds_total")
+)
+
+const (
+	shedCheckInterval = time.Second // How often the memory in use is checked.
+	shedHighWater     = 0.9         // The fraction of the limit at which load is shed.
+	shedLowWater      = 0.8         // The fraction of the limit below which shedding stops.
+)
+
+// The stages of load shedding, taken in order while the memory in use stays
+// over the high water mark.
+const (
+	shedPauseLogs     = iota + 1 // Stop reading the low priority logs.
+	shedSkipBacklog              // Drop the lines not yet read from every log.
+	shedExpireMetrics            // Remove the expired metrics, and return free memory to the OS.
+)
+
+var shedActions = map[int]string{
+	shedPauseLogs:     "pause_logs",
+	shedSkipBacklog:   "skip_backlog",
+	shedExpireMetrics: "expire_metrics",
+}
+
+// MemoryLimit sets the Server to shed load when the memory it uses
+// approaches limit bytes: first pausing the logs matching the lowPriority
+// glob patterns, then dropping the lines not yet read of every log, then
+// expiring metrics, until the memory in use falls again.
+func MemoryLimit(limit uint64, lowPriority []string) Option {
+	return &memoryBudget{limit, lowPriority}
+}
+
+type memoryBudget struct {
+	limit       uint64
+	lowPriority []string
+}
+
+func (opt memoryBudget) apply(m *Server) error {
+	if opt.limit == 0 {
+		return errors.New("memory limit must be positive")
+	}
+	m.memoryBudget = &opt
+	return nil
+}
+
+// logShedder is the part of the Tailer that loads are shed from.
+type logShedder interface {
+	PauseLogs(patterns []string)
+	ResumeLogs()
+	SkipBacklog()
+}
+
+// loadShedder sheds load in stages while the memory in use is over the
+// budget.
+type loadShedder struct {
+	budget memoryBudget
+	logs   logShedder
+	store  *metrics.Store
+	inUse  func() uint64 // Returns the bytes of memory in use.
+	clock  clock.Clock   // Times the checks.
+
+	level int // The last stage taken, or zero if not shedding.
+}
+
+// memoryInUse returns the memory the Go runtime holds from the OS.
+func memoryInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Sys - ms.HeapReleased
+}
+
+func newLoadShedder(budget memoryBudget, logs logShedder, store *metrics.Store) *loadShedder {
+	return &loadShedder{budget: budget, logs: logs, store: store, inUse: memoryInUse, clock: clock.Real}
+}
+
+// run checks the memory in use every interval until ctx is done.
+func (s *loadShedder) run(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			s.check()
+		}
+	}
+}
+
+// check takes the next stage of shedding if the memory in use is over the
+// high water mark, repeating the last while it stays there, and stops
+// shedding once it is below the low water mark.
+func (s *loadShedder) check() {
+	inUse := s.inUse()
+	switch {
+	case float64(inUse) >= shedHighWater*float64(s.budget.limit):
+		if s.level < shedExpireMetrics {
+			s.level++
+			logging.Warningf("Memory in use is %d bytes of the %d byte limit; shedding load: %s", inUse, s.budget.limit, shedActions[s.level])
+		}
+		s.shed(s.level)
+	case s.level > 0 && float64(inUse) < shedLowWater*float64(s.budget.limit):
+		logging.Infof("Memory in use is %d bytes of the %d byte limit; no longer shedding load", inUse, s.budget.limit)
+		s.level = 0
+		s.logs.ResumeLogs()
+	}
+	memoryShedLevel.Set(int64(s.level))
+}
+
+// shed takes the stage given.
+func (s *loadShedder) shed(level int) {
+	switch level {
+	case shedPauseLogs:
+		if len(s.budget.lowPriority) == 0 {
+			return
+		}
+		s.logs.PauseLogs(s.budget.lowPriority)
+	case shedSkipBacklog:
+		s.logs.SkipBacklog()
+	case shedExpireMetrics:
+		s.logs.SkipBacklog()
+		if err := s.store.Gc(); err != nil {
+			logging.Info(err)
+		}
+		debug.FreeOSMemory()
+	}
+	memorySheds.Add(shedActions[level], 1)
+}
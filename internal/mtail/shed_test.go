@@ -0,0 +1,100 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// fakeLogShedder records the calls made to shed load from the logs.
+type fakeLogShedder struct {
+	calls []string
+}
+
+func (f *fakeLogShedder) PauseLogs(patterns []string) {
+	f.calls = append(f.calls, "pause "+strings.Join(patterns, ","))
+}
+
+func (f *fakeLogShedder) ResumeLogs() {
+	f.calls = append(f.calls, "resume")
+}
+
+func (f *fakeLogShedder) SkipBacklog() {
+	f.calls = append(f.calls, "skip")
+}
+
+func TestLoadShedder(t *testing.T) {
+	logs := &fakeLogShedder{}
+	s := newLoadShedder(memoryBudget{limit: 1000, lowPriority: []string{"/var/log/debug*"}}, logs, metrics.NewStore())
+	var inUse uint64
+	s.inUse = func() uint64 { return inUse }
+
+	for _, tc := range []struct {
+		inUse uint64
+		level int
+		calls []string
+	}{
+		{500, 0, nil},
+		{900, shedPauseLogs, []string{"pause /var/log/debug*"}},
+		{950, shedSkipBacklog, []string{"skip"}},
+		{990, shedExpireMetrics, []string{"skip"}},
+		// Still over, so the last stage is repeated.
+		{990, shedExpireMetrics, []string{"skip"}},
+		// Between the low and high water marks nothing changes.
+		{850, shedExpireMetrics, nil},
+		{700, 0, []string{"resume"}},
+		{700, 0, nil},
+	} {
+		logs.calls = nil
+		inUse = tc.inUse
+		s.check()
+		testutil.ExpectNoDiff(t, tc.level, s.level)
+		testutil.ExpectNoDiff(t, tc.calls, logs.calls)
+		testutil.ExpectNoDiff(t, int64(tc.level), memoryShedLevel.Value())
+	}
+}
+
+func TestLoadShedderNoLowPriorityLogs(t *testing.T) {
+	logs := &fakeLogShedder{}
+	s := newLoadShedder(memoryBudget{limit: 1000}, logs, metrics.NewStore())
+	s.inUse = func() uint64 { return 1000 }
+	s.check()
+	testutil.ExpectNoDiff(t, shedPauseLogs, s.level)
+	testutil.ExpectNoDiff(t, []string(nil), logs.calls)
+	s.check()
+	testutil.ExpectNoDiff(t, []string{"skip"}, logs.calls)
+}
+
+func TestLoadShedderRun(t *testing.T) {
+	logs := &fakeLogShedder{}
+	s := newLoadShedder(memoryBudget{limit: 1000}, logs, metrics.NewStore())
+	checked := make(chan struct{})
+	s.inUse = func() uint64 {
+		checked <- struct{}{}
+		return 0
+	}
+	clk := clock.NewFake(time.Now())
+	s.clock = clk
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx, time.Second)
+	}()
+	clk.BlockUntil(1)
+	// The memory in use is checked on each tick of the clock.
+	for i := 0; i < 2; i++ {
+		clk.Advance(time.Second)
+		<-checked
+	}
+	cancel()
+	<-done
+}
@@ -9,7 +9,7 @@ import (
 	"sync"
 	"testing"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/mtail"
 	"github.com/google/mtail/internal/testutil"
 )
@@ -31,7 +31,7 @@ func TestSoftLinkChange(t *testing.T) {
 	defer trueLog1.Close()
 
 	testutil.FatalIfErr(t, os.Symlink(logFilepath+".true1", logFilepath))
-	glog.Info("symlinked")
+	logging.Info("symlinked")
 	m.PollWatched()
 
 	inputLines := []string{"hi1", "hi2", "hi3"}
@@ -9,22 +9,19 @@ import (
 	"encoding/json"
 	"expvar"
 	"fmt"
-	"net"
 	"net/http"
 	"os"
 	"runtime"
 	"testing"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/testutil"
 	"github.com/google/mtail/internal/watcher"
 )
 
-const timeoutMultiplier = 3
-
 const defaultDoOrTimeoutDeadline = 10 * time.Second
 
 type TestServer struct {
@@ -50,9 +47,9 @@ func TestMakeServer(tb testing.TB, pollInterval time.Duration, options ...Option
 	expvar.Get("log_rotations_total").(*expvar.Map).Init()
 	expvar.Get("prog_loads_total").(*expvar.Map).Init()
 
-	w, err := watcher.NewLogWatcher(pollInterval)
-	testutil.FatalIfErr(tb, err)
 	ctx, cancel := context.WithCancel(context.Background())
+	w, err := watcher.NewLogWatcher(ctx, pollInterval)
+	testutil.FatalIfErr(tb, err)
 	m, err := New(ctx, metrics.NewStore(), w, options...)
 	testutil.FatalIfErr(tb, err)
 	return &TestServer{Server: m, w: w, tb: tb, cancel: cancel}
@@ -72,21 +69,13 @@ func TestStartServer(tb testing.TB, pollInterval time.Duration, options ...Optio
 func (m *TestServer) Start() func() {
 	m.tb.Helper()
 	errc := make(chan error, 1)
+	// The listener is bound when the server is made, so connections are
+	// accepted as soon as it runs.
 	go func() {
 		err := m.Run()
 		errc <- err
 	}()
 
-	glog.Infof("check that server is listening")
-	count := 0
-	for _, err := net.DialTimeout("tcp", m.Addr(), 10*time.Millisecond*timeoutMultiplier); err != nil && count < 10; count++ {
-		glog.Infof("err: %s, retrying to dial %s", err, m.Addr())
-		time.Sleep(100 * time.Millisecond * timeoutMultiplier)
-	}
-	if count >= 10 {
-		m.tb.Fatal("server wasn't listening after 10 attempts")
-	}
-
 	return func() {
 		defer m.cancel()
 
@@ -107,7 +96,7 @@ func (m *TestServer) Start() func() {
 
 // Poll all watched logs for updates.
 func (m *TestServer) PollWatched() {
-	glog.Info("TestServer polling watched objects")
+	logging.Info("TestServer polling watched objects")
 	m.w.Poll()
 	m.t.Poll()
 	m.l.LoadAllPrograms()
@@ -130,12 +119,12 @@ func TestGetMetric(tb testing.TB, addr, name string) interface{} {
 	n, err := buf.ReadFrom(resp.Body)
 	resp.Body.Close()
 	testutil.FatalIfErr(tb, err)
-	glog.V(2).Infof("TestGetMetric: http client read %d bytes from debug/vars", n)
+	logging.V(2).Infof("TestGetMetric: http client read %d bytes from debug/vars", n)
 	var r map[string]interface{}
 	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
 		tb.Fatalf("%s: body was %s", err, buf.String())
 	}
-	glog.V(2).Infof("TestGetMetric: returned value for %s: %v", name, r[name])
+	logging.V(2).Infof("TestGetMetric: returned value for %s: %v", name, r[name])
 	return r[name]
 }
 
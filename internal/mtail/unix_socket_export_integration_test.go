@@ -17,7 +17,7 @@ import (
 	"testing"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/mtail"
 	"github.com/google/mtail/internal/testutil"
@@ -28,10 +28,11 @@ import (
 // the server. It returns the server, or any errors the new server creates.
 func makeServer(tb testing.TB, pollInterval time.Duration, options ...mtail.Option) (*mtail.Server, error) {
 	tb.Helper()
-	w, err := watcher.NewLogWatcher(pollInterval)
+	ctx := context.Background()
+	w, err := watcher.NewLogWatcher(ctx, pollInterval)
 	testutil.FatalIfErr(tb, err)
 
-	return mtail.New(context.Background(), metrics.NewStore(), w, options...)
+	return mtail.New(ctx, metrics.NewStore(), w, options...)
 }
 
 // startUNIXSocketServer creates a new Server serving through a UNIX
@@ -55,7 +56,7 @@ func startUNIXSocketServer(tb testing.TB, pollInterval time.Duration, options ..
 		errc <- err
 	}()
 
-	glog.Infof("check that server is listening")
+	logging.Infof("check that server is listening")
 
 	addr, err := net.ResolveUnixAddr("unix", unixSocket)
 	testutil.FatalIfErr(tb, err)
@@ -98,12 +99,12 @@ func getMetricFromUNIXSocket(tb testing.TB, sockPath, name string) interface{} {
 	buf := new(bytes.Buffer)
 	n, err := buf.ReadFrom(resp.Body)
 	testutil.FatalIfErr(tb, err)
-	glog.V(2).Infof("TestGetMetric: http client read %d bytes from debug/vars", n)
+	logging.V(2).Infof("TestGetMetric: http client read %d bytes from debug/vars", n)
 	var r map[string]interface{}
 	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
 		tb.Fatalf("%s: body was %s", err, buf.String())
 	}
-	glog.Infof("TestGetMetric: returned value for %s: %v", name, r[name])
+	logging.Infof("TestGetMetric: returned value for %s: %v", name, r[name])
 	return r[name]
 }
 
@@ -0,0 +1,168 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package mtail
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/tailer"
+	"github.com/pkg/errors"
+)
+
+// upgradeEnv is set in the environment of a new mtail process started by
+// upgrade to the number of listening sockets it inherits.  The first is file
+// descriptor 3, the JSON encoded log offsets are file descriptor 4, and any
+// other listening sockets follow.
+const upgradeEnv = "MTAIL_UPGRADE"
+
+const (
+	upgradeListenerFd = 3
+	upgradeOffsetsFd  = 4
+)
+
+// notifyUpgrade relays the signal requesting an upgrade to c.
+func notifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// upgrade starts a new mtail process from the current executable, handing it
+// the listening sockets and the offsets read in each log file.  The Tailer is
+// left suspended if the new process starts, so the caller should then shut
+// down.
+func (m *Server) upgrade() error {
+	if m.chrootDir != "" {
+		return errors.New("can't upgrade from inside a chroot")
+	}
+	if m.seccomp {
+		return errors.New("can't upgrade with the seccomp filter installed")
+	}
+	if len(m.listeners) == 0 {
+		return errors.New("no listening sockets to hand off")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var listenFiles []*os.File
+	defer func() {
+		for _, f := range listenFiles {
+			f.Close()
+		}
+	}()
+	for _, l := range m.listeners {
+		lf, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return errors.Errorf("can't hand off a listener of type %T", l)
+		}
+		f, err := lf.File()
+		if err != nil {
+			return errors.Wrap(err, "failed to get listening socket")
+		}
+		listenFiles = append(listenFiles, f)
+	}
+	offsetsFile, err := ioutil.TempFile("", "mtail-upgrade")
+	if err != nil {
+		return err
+	}
+	defer offsetsFile.Close()
+	if err := os.Remove(offsetsFile.Name()); err != nil {
+		return err
+	}
+
+	resume := func() {}
+	var offsets []tailer.LogOffset
+	if m.t != nil {
+		resume = m.t.Suspend()
+		offsets = m.t.Offsets()
+	}
+	if err := json.NewEncoder(offsetsFile).Encode(offsets); err != nil {
+		resume()
+		return err
+	}
+	if _, err := offsetsFile.Seek(0, io.SeekStart); err != nil {
+		resume()
+		return err
+	}
+	// The new process owns the socket paths now.
+	setUnlinkOnClose := func(unlink bool) {
+		for _, l := range m.listeners {
+			if ul, ok := l.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(unlink)
+			}
+		}
+	}
+	setUnlinkOnClose(false)
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr, listenFiles[0], offsetsFile}
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   append(os.Environ(), upgradeEnv+"="+strconv.Itoa(len(listenFiles))),
+		Files: append(files, listenFiles[1:]...),
+	})
+	if err != nil {
+		setUnlinkOnClose(true)
+		resume()
+		return errors.Wrapf(err, "failed to start %s", exe)
+	}
+	logging.Infof("Started new mtail process %d, handed off %d log offsets", p.Pid, len(offsets))
+	return p.Release()
+}
+
+// inheritUpgrade returns the listeners and log offsets handed over by the
+// previous mtail process, if this process was started by an upgrade.
+func inheritUpgrade() ([]net.Listener, []tailer.LogOffset, error) {
+	v := os.Getenv(upgradeEnv)
+	if v == "" {
+		return nil, nil, nil
+	}
+	// Don't pass the file descriptors on to any process we start.
+	if err := os.Unsetenv(upgradeEnv); err != nil {
+		return nil, nil, err
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return nil, nil, errors.Errorf("invalid %s %q", upgradeEnv, v)
+	}
+	fds := []uintptr{upgradeListenerFd}
+	for i := 1; i < n; i++ {
+		fds = append(fds, uintptr(upgradeOffsetsFd+i))
+	}
+	var ls []net.Listener
+	closeAll := func() {
+		for _, l := range ls {
+			l.Close()
+		}
+	}
+	for _, fd := range fds {
+		listenFile := os.NewFile(fd, "listener")
+		l, err := net.FileListener(listenFile)
+		listenFile.Close()
+		if err != nil {
+			closeAll()
+			return nil, nil, errors.Wrap(err, "failed to inherit listening socket")
+		}
+		ls = append(ls, l)
+	}
+	offsetsFile := os.NewFile(upgradeOffsetsFd, "offsets")
+	defer offsetsFile.Close()
+	var offsets []tailer.LogOffset
+	if err := json.NewDecoder(offsetsFile).Decode(&offsets); err != nil {
+		closeAll()
+		return nil, nil, errors.Wrap(err, "failed to read inherited log offsets")
+	}
+	for _, l := range ls {
+		logging.Infof("Inherited listener on %s from previous mtail process", l.Addr())
+	}
+	logging.Infof("Inherited %d log offsets from previous mtail process", len(offsets))
+	return ls, offsets, nil
+}
@@ -0,0 +1,23 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"net"
+	"os"
+
+	"github.com/google/mtail/internal/tailer"
+	"github.com/pkg/errors"
+)
+
+// notifyUpgrade does nothing, as there is no signal to request an upgrade on windows.
+func notifyUpgrade(c chan<- os.Signal) {}
+
+func (m *Server) upgrade() error {
+	return errors.New("upgrade is not supported on windows")
+}
+
+func inheritUpgrade() ([]net.Listener, []tailer.LogOffset, error) {
+	return nil, nil, nil
+}
@@ -0,0 +1,286 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package protorecord
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The types of fields, as numbered by FieldDescriptorProto.Type.
+const (
+	typeDouble   = 1
+	typeFloat    = 2
+	typeInt64    = 3
+	typeUint64   = 4
+	typeInt32    = 5
+	typeFixed64  = 6
+	typeFixed32  = 7
+	typeBool     = 8
+	typeString   = 9
+	typeGroup    = 10
+	typeMessage  = 11
+	typeBytes    = 12
+	typeUint32   = 13
+	typeEnum     = 14
+	typeSfixed32 = 15
+	typeSfixed64 = 16
+	typeSint32   = 17
+	typeSint64   = 18
+)
+
+// labelRepeated is FieldDescriptorProto.Label for repeated fields.
+const labelRepeated = 3
+
+// Message describes the fields of one type of protocol buffer message, for
+// decoding records of it.
+type Message struct {
+	name   string // The full name, like "pkg.Request".
+	fields map[int32]*field
+}
+
+// Name returns the full name of the message type.
+func (m *Message) Name() string {
+	return m.name
+}
+
+// field describes one field of a message.
+type field struct {
+	name     string
+	typ      int32
+	repeated bool
+	typeName string           // The full name of the message or enum type, for those fields.
+	message  *Message         // The type of a message field.
+	enum     map[int32]string // The names of the values of an enum field, by number.
+}
+
+// Load reads the descriptor set written by protoc's --descriptor_set_out
+// option to path, and returns the message type named by its full name, like
+// "pkg.Request".  The set must include the files of any types it refers to,
+// with protoc's --include_imports option.
+func Load(path, name string) (*Message, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading protocol buffer descriptors")
+	}
+	m, err := Parse(b, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s", path)
+	}
+	return m, nil
+}
+
+// Parse returns the message type called name from the encoded
+// FileDescriptorSet b.
+func Parse(b []byte, name string) (*Message, error) {
+	d := &descriptors{messages: make(map[string]*Message), enums: make(map[string]map[int32]string)}
+	r := &wireReader{b: b}
+	for !r.done() {
+		f, err := r.next()
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid descriptor set")
+		}
+		if f.num == 1 && f.wireType == wireBytes {
+			if err := d.addFile(f.b); err != nil {
+				return nil, errors.Wrap(err, "invalid descriptor set")
+			}
+		}
+	}
+	for _, m := range d.messages {
+		for _, f := range m.fields {
+			if err := d.resolve(m, f); err != nil {
+				return nil, err
+			}
+		}
+	}
+	m, ok := d.messages[strings.TrimPrefix(name, ".")]
+	if !ok {
+		return nil, errors.Errorf("no message type %q in the descriptor set", name)
+	}
+	return m, nil
+}
+
+// descriptors are the message and enum types of a descriptor set, by full
+// name.
+type descriptors struct {
+	messages map[string]*Message
+	enums    map[string]map[int32]string
+}
+
+// addFile adds the types of the encoded FileDescriptorProto b.
+func (d *descriptors) addFile(b []byte) error {
+	var pkg string
+	var messages, enums [][]byte
+	r := &wireReader{b: b}
+	for !r.done() {
+		f, err := r.next()
+		if err != nil {
+			return err
+		}
+		if f.wireType != wireBytes {
+			continue
+		}
+		switch f.num {
+		case 2:
+			pkg = string(f.b)
+		case 4:
+			messages = append(messages, f.b)
+		case 5:
+			enums = append(enums, f.b)
+		}
+	}
+	for _, e := range enums {
+		if err := d.addEnum(pkg, e); err != nil {
+			return err
+		}
+	}
+	for _, m := range messages {
+		if err := d.addMessage(pkg, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// qualify returns name in the scope scope.
+func qualify(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+// addMessage adds the encoded DescriptorProto b, and its nested types, in
+// the scope scope.
+func (d *descriptors) addMessage(scope string, b []byte) error {
+	m := &Message{fields: make(map[int32]*field)}
+	var nested, enums, fields [][]byte
+	r := &wireReader{b: b}
+	for !r.done() {
+		f, err := r.next()
+		if err != nil {
+			return err
+		}
+		if f.wireType != wireBytes {
+			continue
+		}
+		switch f.num {
+		case 1:
+			m.name = qualify(scope, string(f.b))
+		case 2:
+			fields = append(fields, f.b)
+		case 3:
+			nested = append(nested, f.b)
+		case 4:
+			enums = append(enums, f.b)
+		}
+	}
+	for _, b := range fields {
+		num, f, err := parseField(b)
+		if err != nil {
+			return errors.Wrapf(err, "message %s", m.name)
+		}
+		m.fields[num] = f
+	}
+	d.messages[m.name] = m
+	for _, e := range enums {
+		if err := d.addEnum(m.name, e); err != nil {
+			return err
+		}
+	}
+	for _, n := range nested {
+		if err := d.addMessage(m.name, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseField returns the number and description of the encoded
+// FieldDescriptorProto b.
+func parseField(b []byte) (int32, *field, error) {
+	var num int32
+	f := &field{}
+	r := &wireReader{b: b}
+	for !r.done() {
+		w, err := r.next()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch {
+		case w.num == 1 && w.wireType == wireBytes:
+			f.name = string(w.b)
+		case w.num == 3 && w.wireType == wireVarint:
+			num = int32(w.v)
+		case w.num == 4 && w.wireType == wireVarint:
+			f.repeated = w.v == labelRepeated
+		case w.num == 5 && w.wireType == wireVarint:
+			f.typ = int32(w.v)
+		case w.num == 6 && w.wireType == wireBytes:
+			f.typeName = strings.TrimPrefix(string(w.b), ".")
+		}
+	}
+	if f.name == "" || num <= 0 || f.typ < typeDouble || f.typ > typeSint64 {
+		return 0, nil, errors.Errorf("invalid field %q", f.name)
+	}
+	return num, f, nil
+}
+
+// addEnum adds the encoded EnumDescriptorProto b in the scope scope.
+func (d *descriptors) addEnum(scope string, b []byte) error {
+	var name string
+	values := make(map[int32]string)
+	r := &wireReader{b: b}
+	for !r.done() {
+		f, err := r.next()
+		if err != nil {
+			return err
+		}
+		if f.wireType != wireBytes {
+			continue
+		}
+		switch f.num {
+		case 1:
+			name = string(f.b)
+		case 2:
+			var valueName string
+			var number int32
+			vr := &wireReader{b: f.b}
+			for !vr.done() {
+				v, err := vr.next()
+				if err != nil {
+					return err
+				}
+				switch {
+				case v.num == 1 && v.wireType == wireBytes:
+					valueName = string(v.b)
+				case v.num == 2 && v.wireType == wireVarint:
+					number = int32(v.v)
+				}
+			}
+			if _, ok := values[number]; !ok {
+				values[number] = valueName
+			}
+		}
+	}
+	d.enums[qualify(scope, name)] = values
+	return nil
+}
+
+// resolve finds the type of the message or enum field f of m.
+func (d *descriptors) resolve(m *Message, f *field) error {
+	switch f.typ {
+	case typeMessage, typeGroup:
+		if f.message = d.messages[f.typeName]; f.message == nil {
+			return errors.Errorf("field %s.%s has unknown type %q; was the descriptor set written with --include_imports?", m.name, f.name, f.typeName)
+		}
+	case typeEnum:
+		if f.enum = d.enums[f.typeName]; f.enum == nil {
+			return errors.Errorf("field %s.%s has unknown type %q; was the descriptor set written with --include_imports?", m.name, f.name, f.typeName)
+		}
+	}
+	return nil
+}
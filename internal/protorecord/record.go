@@ -0,0 +1,196 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package protorecord decodes logs of binary protocol buffer records, each
+// prefixed by its length as a varint, like those written by Java's
+// writeDelimitedTo and C++'s SerializeDelimitedToOstream.  Records are
+// decoded with the descriptor of their message type, without generated code,
+// into the text of the record and its fields by name.
+package protorecord
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MaxSize is the largest record accepted, in bytes.  A larger length is
+// taken to mean the log is corrupt.
+const MaxSize = 64 << 20
+
+// maxDepth is the deepest that messages may be nested in a record.
+const maxDepth = 100
+
+// Next returns the first record framed in b, and the length of b it took up
+// with its length prefix.  If b doesn't hold a whole record yet, n is 0.
+func Next(b []byte) (record []byte, n int, err error) {
+	size, m := binary.Uvarint(b)
+	switch {
+	case m == 0:
+		return nil, 0, nil
+	case m < 0 || size > MaxSize:
+		return nil, 0, errors.Errorf("invalid record length")
+	case uint64(len(b)-m) < size:
+		return nil, 0, nil
+	}
+	return b[m : m+int(size)], m + int(size), nil
+}
+
+// Decode decodes the record b as a message of type m.  It returns the record
+// in the compact text format, like `status: 200 request { path: "/a" }`,
+// and the values of its fields by their path, like "request.path", with
+// strings not quoted and enums by name.  The values of a repeated field are
+// separated by commas.  Fields not in the descriptor are left out.
+func (m *Message) Decode(b []byte) (text string, fields map[string]string, err error) {
+	d := &decoder{fields: make(map[string]string)}
+	if err := d.message(m, b, "", false, 0); err != nil {
+		return "", nil, err
+	}
+	return d.text.String(), d.fields, nil
+}
+
+// decoder holds the state of decoding one record.
+type decoder struct {
+	text   strings.Builder
+	fields map[string]string
+}
+
+// message decodes b as a message of type m, whose fields have paths
+// starting with prefix.  repeated is set inside repeated fields.
+func (d *decoder) message(m *Message, b []byte, prefix string, repeated bool, depth int) error {
+	if depth > maxDepth {
+		return errors.Errorf("messages nested more than %d deep", maxDepth)
+	}
+	r := &wireReader{b: b}
+	for !r.done() {
+		w, err := r.next()
+		if err != nil {
+			return err
+		}
+		f, ok := m.fields[w.num]
+		if !ok || w.wireType == wireStartGroup || f.typ == typeGroup {
+			continue
+		}
+		path := prefix + f.name
+		inRepeated := repeated || f.repeated
+		switch {
+		case f.typ == typeMessage:
+			if w.wireType != wireBytes {
+				return wireTypeError(m, f, w)
+			}
+			d.separate()
+			d.text.WriteString(f.name + " {")
+			if err := d.message(f.message, w.b, path+".", inRepeated, depth+1); err != nil {
+				return err
+			}
+			d.separate()
+			d.text.WriteString("}")
+		case w.wireType == wireBytes && f.typ != typeString && f.typ != typeBytes:
+			// Packed repeated scalars.
+			pr := &wireReader{b: w.b}
+			for !pr.done() {
+				v, err := pr.scalar(f.typ)
+				if err != nil {
+					return errors.Wrapf(err, "field %s.%s", m.name, f.name)
+				}
+				d.scalar(f, path, inRepeated, v)
+			}
+		default:
+			if w.wireType != wireTypes[f.typ] {
+				return wireTypeError(m, f, w)
+			}
+			d.scalar(f, path, inRepeated, w)
+		}
+	}
+	return nil
+}
+
+// wireTypes are the wire types of the unpacked scalar field types.
+var wireTypes = map[int32]int{
+	typeDouble:   wireFixed64,
+	typeFloat:    wireFixed32,
+	typeInt64:    wireVarint,
+	typeUint64:   wireVarint,
+	typeInt32:    wireVarint,
+	typeFixed64:  wireFixed64,
+	typeFixed32:  wireFixed32,
+	typeBool:     wireVarint,
+	typeString:   wireBytes,
+	typeBytes:    wireBytes,
+	typeUint32:   wireVarint,
+	typeEnum:     wireVarint,
+	typeSfixed32: wireFixed32,
+	typeSfixed64: wireFixed64,
+	typeSint32:   wireVarint,
+	typeSint64:   wireVarint,
+}
+
+func wireTypeError(m *Message, f *field, w wireField) error {
+	return errors.Errorf("field %s.%s has wire type %d", m.name, f.name, w.wireType)
+}
+
+// scalar reads one element of a packed field of type typ.
+func (r *wireReader) scalar(typ int32) (wireField, error) {
+	w := wireField{wireType: wireTypes[typ]}
+	var err error
+	switch w.wireType {
+	case wireVarint:
+		w.v, err = r.varint()
+	case wireFixed64:
+		w.v, err = r.fixed(8)
+	case wireFixed32:
+		w.v, err = r.fixed(4)
+	}
+	return w, err
+}
+
+// separate writes a space between fields of the text.
+func (d *decoder) separate() {
+	if d.text.Len() > 0 {
+		d.text.WriteByte(' ')
+	}
+}
+
+// scalar records the value w of the scalar field f, whose path is path.
+func (d *decoder) scalar(f *field, path string, repeated bool, w wireField) {
+	var value, text string
+	switch f.typ {
+	case typeDouble:
+		value = strconv.FormatFloat(math.Float64frombits(w.v), 'g', -1, 64)
+	case typeFloat:
+		value = strconv.FormatFloat(float64(math.Float32frombits(uint32(w.v))), 'g', -1, 32)
+	case typeInt64, typeSfixed64:
+		value = strconv.FormatInt(int64(w.v), 10)
+	case typeInt32:
+		value = strconv.FormatInt(int64(int32(w.v)), 10)
+	case typeSfixed32:
+		value = strconv.FormatInt(int64(int32(uint32(w.v))), 10)
+	case typeUint64, typeFixed64, typeUint32, typeFixed32:
+		value = strconv.FormatUint(w.v, 10)
+	case typeSint32, typeSint64:
+		value = strconv.FormatInt(int64(w.v>>1)^-int64(w.v&1), 10)
+	case typeBool:
+		value = strconv.FormatBool(w.v != 0)
+	case typeEnum:
+		var ok bool
+		if value, ok = f.enum[int32(w.v)]; !ok {
+			value = strconv.FormatInt(int64(int32(w.v)), 10)
+		}
+	case typeString, typeBytes:
+		value = string(w.b)
+		text = strconv.Quote(value)
+	}
+	if text == "" {
+		text = value
+	}
+	d.separate()
+	fmt.Fprintf(&d.text, "%s: %s", f.name, text)
+	if old, ok := d.fields[path]; ok && repeated {
+		value = old + "," + value
+	}
+	d.fields[path] = value
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package protorecord
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+// The helpers below encode protocol buffers by hand, as there is no protoc
+// to write descriptor sets or records in the tests.
+
+func varint(v uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, v)]
+}
+
+func varintField(num int, v uint64) []byte {
+	return append(varint(uint64(num)<<3|wireVarint), varint(v)...)
+}
+
+func bytesField(num int, parts ...[]byte) []byte {
+	var body []byte
+	for _, p := range parts {
+		body = append(body, p...)
+	}
+	b := append(varint(uint64(num)<<3|wireBytes), varint(uint64(len(body)))...)
+	return append(b, body...)
+}
+
+func stringField(num int, s string) []byte {
+	return bytesField(num, []byte(s))
+}
+
+func fixed64Field(num int, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return append(varint(uint64(num)<<3|wireFixed64), b...)
+}
+
+// fieldDescriptor encodes a FieldDescriptorProto.
+func fieldDescriptor(name string, num, typ int, repeated bool, typeName string) []byte {
+	label := uint64(1)
+	if repeated {
+		label = labelRepeated
+	}
+	parts := [][]byte{stringField(1, name), varintField(3, uint64(num)), varintField(4, label), varintField(5, uint64(typ))}
+	if typeName != "" {
+		parts = append(parts, stringField(6, typeName))
+	}
+	return bytesField(2, parts...)
+}
+
+// testDescriptorSet is the encoded FileDescriptorSet of:
+//
+//	package test;
+//	enum Method { GET = 0; POST = 1; }
+//	message Request {
+//	  string path = 1;
+//	  Method method = 2;
+//	  repeated string tags = 3;
+//	}
+//	message Entry {
+//	  int32 status = 1;
+//	  Request request = 2;
+//	  repeated int64 sizes = 3;
+//	  double latency = 4;
+//	  sint32 delta = 5;
+//	  message Peer { bytes addr = 1; }
+//	  repeated Peer peers = 6;
+//	}
+var testDescriptorSet = bytesField(1,
+	stringField(1, "test.proto"),
+	stringField(2, "test"),
+	bytesField(5,
+		stringField(1, "Method"),
+		bytesField(2, stringField(1, "GET"), varintField(2, 0)),
+		bytesField(2, stringField(1, "POST"), varintField(2, 1))),
+	bytesField(4,
+		stringField(1, "Request"),
+		fieldDescriptor("path", 1, typeString, false, ""),
+		fieldDescriptor("method", 2, typeEnum, false, ".test.Method"),
+		fieldDescriptor("tags", 3, typeString, true, "")),
+	bytesField(4,
+		stringField(1, "Entry"),
+		fieldDescriptor("status", 1, typeInt32, false, ""),
+		fieldDescriptor("request", 2, typeMessage, false, ".test.Request"),
+		fieldDescriptor("sizes", 3, typeInt64, true, ""),
+		fieldDescriptor("latency", 4, typeDouble, false, ""),
+		fieldDescriptor("delta", 5, typeSint32, false, ""),
+		fieldDescriptor("peers", 6, typeMessage, true, ".test.Entry.Peer"),
+		bytesField(3,
+			stringField(1, "Peer"),
+			fieldDescriptor("addr", 1, typeBytes, false, ""))))
+
+func TestDecode(t *testing.T) {
+	m, err := Parse(testDescriptorSet, ".test.Entry")
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "test.Entry", m.Name())
+
+	var record []byte
+	for _, f := range [][]byte{
+		varintField(1, 200),
+		bytesField(2, stringField(1, "/a"), varintField(2, 1), stringField(3, "x"), stringField(3, "y")),
+		bytesField(3, varint(10), varint(20)),
+		fixed64Field(4, math.Float64bits(0.25)),
+		varintField(5, 3), // -2, zigzag encoded.
+		bytesField(6, stringField(1, "a")),
+		bytesField(6, stringField(1, "b")),
+		varintField(99, 1), // Not in the descriptor.
+	} {
+		record = append(record, f...)
+	}
+	text, fields, err := m.Decode(record)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, `status: 200 request { path: "/a" method: POST tags: "x" tags: "y" } sizes: 10 sizes: 20 latency: 0.25 delta: -2 peers { addr: "a" } peers { addr: "b" }`, text)
+	testutil.ExpectNoDiff(t, map[string]string{
+		"status":         "200",
+		"request.path":   "/a",
+		"request.method": "POST",
+		"request.tags":   "x,y",
+		"sizes":          "10,20",
+		"latency":        "0.25",
+		"delta":          "-2",
+		"peers.addr":     "a,b",
+	}, fields)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	m, err := Parse(testDescriptorSet, "test.Entry")
+	testutil.FatalIfErr(t, err)
+	for _, tc := range []struct {
+		record   []byte
+		expected string
+	}{
+		{[]byte{0x08}, "truncated protocol buffer"},
+		{fixed64Field(1, 200), "field test.Entry.status has wire type 1"},
+		{bytesField(2, varintField(2, 1))[:3], "truncated protocol buffer"},
+	} {
+		_, _, err := m.Decode(tc.record)
+		if err == nil {
+			t.Errorf("%x: expected an error", tc.record)
+			continue
+		}
+		testutil.ExpectNoDiff(t, tc.expected, err.Error())
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	if _, err := Parse(testDescriptorSet, "test.Missing"); err == nil || err.Error() != `no message type "test.Missing" in the descriptor set` {
+		t.Errorf("unexpected error %v", err)
+	}
+	unresolved := bytesField(1, stringField(2, "test"),
+		bytesField(4, stringField(1, "A"), fieldDescriptor("b", 1, typeMessage, false, ".other.B")))
+	if _, err := Parse(unresolved, "test.A"); err == nil || err.Error() != `field test.A.b has unknown type "other.B"; was the descriptor set written with --include_imports?` {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestNext(t *testing.T) {
+	b := append(varint(2), "ab"...)
+	b = append(b, 5, 'c')
+	record, n, err := Next(b)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "ab", string(record))
+	testutil.ExpectNoDiff(t, 3, n)
+
+	// The second record is incomplete.
+	_, n, err = Next(b[n:])
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, 0, n)
+
+	if _, _, err := Next([]byte{0xff, 0xff, 0xff, 0xff, 0x7f}); err == nil {
+		t.Error("expected an error for an oversized length")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	m, err := Load("testdata/request.pb", "test.Request")
+	testutil.FatalIfErr(t, err)
+	// path: "/a" status: 200 method: POST timing { latency: 0.5 }
+	record := append([]byte{0x0a, 0x02, '/', 'a', 0x10, 0xc8, 0x01, 0x18, 0x01}, bytesField(4, fixed64Field(1, math.Float64bits(0.5)))...)
+	text, fields, err := m.Decode(record)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, `path: "/a" status: 200 method: POST timing { latency: 0.5 }`, text)
+	testutil.ExpectNoDiff(t, map[string]string{"path": "/a", "status": "200", "method": "POST", "timing.latency": "0.5"}, fields)
+
+	if _, err := Load("testdata/missing.pb", "test.Request"); err == nil {
+		t.Error("expected an error loading a missing descriptor set")
+	}
+}
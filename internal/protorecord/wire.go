@@ -0,0 +1,148 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package protorecord
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// The wire types of the protocol buffer encoding.
+const (
+	wireVarint     = 0
+	wireFixed64    = 1
+	wireBytes      = 2
+	wireStartGroup = 3
+	wireEndGroup   = 4
+	wireFixed32    = 5
+)
+
+// maxGroupDepth is the deepest that groups may be nested in skipped fields.
+const maxGroupDepth = 100
+
+var errTruncated = errors.New("truncated protocol buffer")
+
+// wireField is one field read from the encoding of a message.  A varint or
+// fixed-size value is in v, and a length-delimited one in b.
+type wireField struct {
+	num      int32
+	wireType int
+	v        uint64
+	b        []byte
+}
+
+// wireReader reads the fields of an encoded message in turn.
+type wireReader struct {
+	b []byte
+}
+
+func (r *wireReader) done() bool {
+	return len(r.b) == 0
+}
+
+func (r *wireReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		if n == 0 {
+			return 0, errTruncated
+		}
+		return 0, errors.New("varint overflows 64 bits")
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+func (r *wireReader) fixed(size int) (uint64, error) {
+	if len(r.b) < size {
+		return 0, errTruncated
+	}
+	var v uint64
+	if size == 4 {
+		v = uint64(binary.LittleEndian.Uint32(r.b))
+	} else {
+		v = binary.LittleEndian.Uint64(r.b)
+	}
+	r.b = r.b[size:]
+	return v, nil
+}
+
+// next reads the next field.  Groups, which descriptors of current messages
+// don't use, are skipped whole, and returned with no value.
+func (r *wireReader) next() (wireField, error) {
+	key, err := r.varint()
+	if err != nil {
+		return wireField{}, err
+	}
+	f := wireField{num: int32(key >> 3), wireType: int(key & 7)}
+	if f.num <= 0 {
+		return wireField{}, errors.Errorf("invalid field number %d", key>>3)
+	}
+	switch f.wireType {
+	case wireVarint:
+		f.v, err = r.varint()
+	case wireFixed64:
+		f.v, err = r.fixed(8)
+	case wireFixed32:
+		f.v, err = r.fixed(4)
+	case wireBytes:
+		var n uint64
+		n, err = r.varint()
+		if err == nil && n > uint64(len(r.b)) {
+			err = errTruncated
+		}
+		if err == nil {
+			f.b, r.b = r.b[:n], r.b[n:]
+		}
+	case wireStartGroup:
+		err = r.skipGroup(f.num, 1)
+	default:
+		err = errors.Errorf("invalid wire type %d for field %d", f.wireType, f.num)
+	}
+	return f, err
+}
+
+// skipGroup skips the fields of the group numbered num, up to and including
+// its end, at depth groups deep.
+func (r *wireReader) skipGroup(num int32, depth int) error {
+	if depth > maxGroupDepth {
+		return errors.Errorf("groups nested more than %d deep", maxGroupDepth)
+	}
+	for !r.done() {
+		key, err := r.varint()
+		if err != nil {
+			return err
+		}
+		switch int(key & 7) {
+		case wireVarint:
+			_, err = r.varint()
+		case wireFixed64:
+			_, err = r.fixed(8)
+		case wireFixed32:
+			_, err = r.fixed(4)
+		case wireBytes:
+			var n uint64
+			n, err = r.varint()
+			if err == nil && n > uint64(len(r.b)) {
+				err = errTruncated
+			}
+			if err == nil {
+				r.b = r.b[n:]
+			}
+		case wireStartGroup:
+			err = r.skipGroup(int32(key>>3), depth+1)
+		case wireEndGroup:
+			if int32(key>>3) != num {
+				return errors.Errorf("group %d ended by field %d", num, key>>3)
+			}
+			return nil
+		default:
+			err = errors.Errorf("invalid wire type %d for field %d", key&7, key>>3)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return errTruncated
+}
@@ -0,0 +1,355 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// avroSchema is a parsed Avro schema.
+type avroSchema struct {
+	typ      string // A primitive type, or "record", "enum", "array", "map", "fixed", or "union".
+	name     string // The full name of a record, enum, or fixed type.
+	fields   []avroField
+	symbols  []string      // The symbols of an enum.
+	items    *avroSchema   // The items of an array, or values of a map.
+	branches []*avroSchema // The types of a union.
+	size     int64         // The size of a fixed type.
+}
+
+// avroField is one field of a record.
+type avroField struct {
+	name   string
+	schema *avroSchema
+}
+
+var avroPrimitives = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"int":     true,
+	"long":    true,
+	"float":   true,
+	"double":  true,
+	"bytes":   true,
+	"string":  true,
+}
+
+// LoadAvroSchema reads the JSON schema in the file path, and returns the
+// format of records of it written one after another, without a container
+// file header.
+func LoadAvroSchema(path string) (Format, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading Avro schema")
+	}
+	s, err := parseAvroSchema(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s", path)
+	}
+	return avroFormat{s}, nil
+}
+
+// parseAvroSchema parses the JSON schema b.
+func parseAvroSchema(b []byte) (*avroSchema, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var j interface{}
+	if err := d.Decode(&j); err != nil {
+		return nil, errors.Wrap(err, "invalid Avro schema")
+	}
+	p := &avroParser{named: make(map[string]*avroSchema)}
+	s, err := p.parse(j, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid Avro schema")
+	}
+	return s, nil
+}
+
+// avroParser holds the named types of the schema being parsed, by full
+// name.
+type avroParser struct {
+	named map[string]*avroSchema
+}
+
+// parse parses the schema j, in the namespace namespace.
+func (p *avroParser) parse(j interface{}, namespace string) (*avroSchema, error) {
+	switch j := j.(type) {
+	case string:
+		if avroPrimitives[j] {
+			return &avroSchema{typ: j}, nil
+		}
+		if s, ok := p.named[fullName(j, namespace)]; ok {
+			return s, nil
+		}
+		if s, ok := p.named[j]; ok {
+			return s, nil
+		}
+		return nil, errors.Errorf("unknown type %q", j)
+	case []interface{}:
+		s := &avroSchema{typ: "union"}
+		for _, b := range j {
+			bs, err := p.parse(b, namespace)
+			if err != nil {
+				return nil, err
+			}
+			s.branches = append(s.branches, bs)
+		}
+		return s, nil
+	case map[string]interface{}:
+		return p.complex(j, namespace)
+	}
+	return nil, errors.Errorf("invalid type %v", j)
+}
+
+// fullName returns the full name of the type called name in namespace.
+func fullName(name, namespace string) string {
+	if namespace == "" || strings.Contains(name, ".") {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// complex parses the schema object j, in the namespace namespace.
+func (p *avroParser) complex(j map[string]interface{}, namespace string) (*avroSchema, error) {
+	typ, _ := j["type"].(string)
+	switch typ {
+	case "array":
+		items, err := p.parse(j["items"], namespace)
+		return &avroSchema{typ: typ, items: items}, err
+	case "map":
+		values, err := p.parse(j["values"], namespace)
+		return &avroSchema{typ: typ, items: values}, err
+	case "record", "error", "enum", "fixed":
+	default:
+		// A primitive or named type, perhaps with a logical type, which
+		// is decoded as the underlying type.
+		if j["type"] == nil {
+			return nil, errors.New("type without a \"type\"")
+		}
+		return p.parse(j["type"], namespace)
+	}
+	name, _ := j["name"].(string)
+	if name == "" {
+		return nil, errors.Errorf("%s without a name", typ)
+	}
+	if ns, ok := j["namespace"].(string); ok {
+		namespace = ns
+	}
+	s := &avroSchema{typ: typ, name: fullName(name, namespace)}
+	if i := strings.LastIndex(s.name, "."); i >= 0 {
+		namespace = s.name[:i]
+	} else {
+		namespace = ""
+	}
+	// Named before its fields, which may refer to it.
+	p.named[s.name] = s
+	switch typ {
+	case "record", "error":
+		s.typ = "record"
+		fields, _ := j["fields"].([]interface{})
+		for _, f := range fields {
+			f, _ := f.(map[string]interface{})
+			name, _ := f["name"].(string)
+			if name == "" {
+				return nil, errors.Errorf("field of %s without a name", s.name)
+			}
+			fs, err := p.parse(f["type"], namespace)
+			if err != nil {
+				return nil, errors.Wrapf(err, "field %s.%s", s.name, name)
+			}
+			s.fields = append(s.fields, avroField{name, fs})
+		}
+	case "enum":
+		symbols, _ := j["symbols"].([]interface{})
+		for _, sym := range symbols {
+			sym, ok := sym.(string)
+			if !ok {
+				return nil, errors.Errorf("enum %s has a symbol that isn't a string", s.name)
+			}
+			s.symbols = append(s.symbols, sym)
+		}
+	case "fixed":
+		size, _ := j["size"].(json.Number)
+		n, err := size.Int64()
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("fixed %s has invalid size %q", s.name, size)
+		}
+		s.size = n
+	}
+	return s, nil
+}
+
+// long reads a zig-zag encoded int or long.
+func (r *reader) long() (int64, error) {
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		if n == 0 {
+			return 0, errTruncated
+		}
+		return 0, errors.New("varint overflows 64 bits")
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+// avroBytes reads bytes or a string.
+func (r *reader) avroBytes() ([]byte, error) {
+	n, err := r.long()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > MaxSize {
+		return nil, errors.Errorf("invalid length %d", n)
+	}
+	return r.next(uint64(n))
+}
+
+// avroBlocks reads the blocks of an array or map, calling item for each of
+// their items.
+func (r *reader) avroBlocks(item func() error) error {
+	for {
+		n, err := r.long()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if n < 0 {
+			// The block's size in bytes follows a negated count.
+			if n = -n; n < 0 {
+				return errors.Errorf("invalid block count %d", n)
+			}
+			if _, err := r.long(); err != nil {
+				return err
+			}
+		}
+		if uint64(n) > uint64(len(r.b)) {
+			return errTruncated
+		}
+		for i := int64(0); i < n; i++ {
+			if err := item(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// avro reads one datum of the schema s, depth values deep.
+func (r *reader) avro(s *avroSchema, depth int) (value, error) {
+	if depth > maxDepth {
+		return nil, errors.Errorf("values nested more than %d deep", maxDepth)
+	}
+	switch s.typ {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := r.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case "int", "long":
+		return r.long()
+	case "float":
+		b, err := r.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+	case "double":
+		b, err := r.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case "bytes", "string":
+		b, err := r.avroBytes()
+		return string(b), err
+	case "fixed":
+		b, err := r.next(uint64(s.size))
+		return string(b), err
+	case "enum":
+		i, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(s.symbols)) {
+			return nil, errors.Errorf("enum %s has no symbol %d", s.name, i)
+		}
+		return s.symbols[i], nil
+	case "union":
+		i, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(s.branches)) {
+			return nil, errors.Errorf("union has no branch %d", i)
+		}
+		return r.avro(s.branches[i], depth+1)
+	case "record":
+		o := &object{}
+		for _, f := range s.fields {
+			v, err := r.avro(f.schema, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			o.add(f.name, v)
+		}
+		return o, nil
+	case "array":
+		a := []value{}
+		err := r.avroBlocks(func() error {
+			v, err := r.avro(s.items, depth+1)
+			a = append(a, v)
+			return err
+		})
+		return a, err
+	case "map":
+		o := &object{}
+		err := r.avroBlocks(func() error {
+			k, err := r.avroBytes()
+			if err != nil {
+				return err
+			}
+			v, err := r.avro(s.items, depth+1)
+			o.add(string(k), v)
+			return err
+		})
+		return o, err
+	}
+	return nil, errors.Errorf("invalid type %q", s.typ)
+}
+
+// avroFormat is the format of records of a schema written one after another.
+type avroFormat struct {
+	schema *avroSchema
+}
+
+func (a avroFormat) NewDecoder(io.ReaderAt, int64) Decoder {
+	return a
+}
+
+func (a avroFormat) Decode(b []byte) ([]Record, int, error) {
+	if len(b) == 0 {
+		return nil, 0, nil
+	}
+	r := &reader{b: b}
+	v, err := r.avro(a.schema, 0)
+	if err == errTruncated && len(b) <= MaxSize {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "invalid Avro record")
+	}
+	return []Record{newRecord(v)}, len(b) - len(r.b), nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package record
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+// request1 and request2 are records of testdata/request.avsc.
+const (
+	request1 = "\x04/a\x90\x03\x02\x02\x00\x00\x00\x00\x00\x00\xe0\x3f\x04\x02x\x02y\x00\x02\x02k\x06\x00\x00"
+	// With an empty array, a map block with its size, and a parent.
+	request2 = "\x04/b\xa8\x06\x00\x00\x00\x01\x06\x02k\x02\x00\x02\x02/\x00\x00\x00\x00\x00\x00"
+)
+
+var (
+	record1 = Record{
+		Text:   `{"path":"/a","status":200,"method":"POST","timing":{"latency":0.5},"tags":["x","y"],"labels":{"k":3},"parent":null}`,
+		Fields: map[string]string{"path": "/a", "status": "200", "method": "POST", "timing.latency": "0.5", "tags": "x,y", "labels.k": "3", "parent": ""},
+	}
+	record2 = Record{
+		Text: `{"path":"/b","status":404,"method":"GET","timing":null,"tags":[],"labels":{"k":1},"parent":{"path":"/","status":0,"method":"GET","timing":null,"tags":[],"labels":{},"parent":null}}`,
+		Fields: map[string]string{"path": "/b", "status": "404", "method": "GET", "timing": "", "labels.k": "1",
+			"parent.path": "/", "parent.status": "0", "parent.method": "GET", "parent.timing": "", "parent.parent": ""},
+	}
+)
+
+func TestAvroDecode(t *testing.T) {
+	f, err := LoadAvroSchema("testdata/request.avsc")
+	testutil.FatalIfErr(t, err)
+	d := f.NewDecoder(nil, 0)
+	for _, tc := range []struct {
+		name     string
+		b        string
+		expected []Record
+		n        int
+	}{
+		{"record", request1 + request2, []Record{record1}, len(request1)},
+		{"recursive", request2, []Record{record2}, len(request2)},
+		{"truncated", request1[:10], nil, 0},
+		{"empty", "", nil, 0},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			records, n, err := d.Decode([]byte(tc.b))
+			testutil.FatalIfErr(t, err)
+			testutil.ExpectNoDiff(t, tc.expected, records)
+			if n != tc.n {
+				t.Errorf("n: expected %d, received %d", tc.n, n)
+			}
+		})
+	}
+	// An enum symbol out of range.
+	if _, _, err := d.Decode([]byte("\x04/a\x90\x03\x04")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestParseAvroSchemaErrors(t *testing.T) {
+	for _, s := range []string{
+		`"nothing"`,
+		`{"type": "record", "fields": []}`,
+		`{"type": "record", "name": "r", "fields": [{"name": "a", "type": "Other"}]}`,
+		`{"type": "fixed", "name": "f", "size": -1}`,
+		`{"type": "enum", "name": "e", "symbols": [1]}`,
+		`{"type": "array"}`,
+		`[`,
+	} {
+		if _, err := parseAvroSchema([]byte(s)); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestParseAvroSchemaNames(t *testing.T) {
+	s, err := parseAvroSchema([]byte(`{"type": "record", "name": "a.R", "fields": [
+		{"name": "x", "type": {"type": "fixed", "name": "F", "size": 2}},
+		{"name": "y", "type": "a.F"},
+		{"name": "z", "type": {"type": "long", "logicalType": "timestamp-millis"}}
+	]}`))
+	testutil.FatalIfErr(t, err)
+	if s.fields[0].schema != s.fields[1].schema || s.fields[0].schema.name != "a.F" || s.fields[2].schema.typ != "long" {
+		t.Errorf("unexpected schema %+v", s)
+	}
+}
+
+func avroLong(v int64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutVarint(b, v)]
+}
+
+func avroString(s string) []byte {
+	return append(avroLong(int64(len(s))), s...)
+}
+
+var testSync = []byte("0123456789abcdef")
+
+// avroFile returns the header of an object container file of
+// testdata/request.avsc written with codec.
+func avroFile(t *testing.T, codec string) []byte {
+	schema, err := ioutil.ReadFile("testdata/request.avsc")
+	testutil.FatalIfErr(t, err)
+	b := []byte(avroMagic)
+	b = append(b, avroLong(2)...)
+	b = append(b, avroString("avro.schema")...)
+	b = append(b, avroString(string(schema))...)
+	b = append(b, avroString("avro.codec")...)
+	b = append(b, avroString(codec)...)
+	b = append(b, 0)
+	return append(b, testSync...)
+}
+
+// avroBlock returns a block of count records, with data as their encoding.
+func avroBlock(count int64, data string) []byte {
+	b := append(avroLong(count), avroLong(int64(len(data)))...)
+	b = append(b, data...)
+	return append(b, testSync...)
+}
+
+func TestAvroFileDecode(t *testing.T) {
+	header := avroFile(t, "null")
+	block := avroBlock(2, request1+request2)
+	d := AvroFile.NewDecoder(nil, 0)
+
+	// The header holds no records.
+	records, n, err := d.Decode(header[:len(header)-1])
+	testutil.FatalIfErr(t, err)
+	if records != nil || n != 0 {
+		t.Errorf("truncated header: received %v, %d", records, n)
+	}
+	records, n, err = d.Decode(append(header, block[:5]...))
+	testutil.FatalIfErr(t, err)
+	if records != nil || n != len(header) {
+		t.Errorf("header: received %v, %d", records, n)
+	}
+
+	records, n, err = d.Decode(block[:len(block)-1])
+	testutil.FatalIfErr(t, err)
+	if records != nil || n != 0 {
+		t.Errorf("truncated block: received %v, %d", records, n)
+	}
+	records, n, err = d.Decode(block)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, []Record{record1, record2}, records)
+	if n != len(block) {
+		t.Errorf("block: expected %d, received %d", len(block), n)
+	}
+
+	// A damaged block is skipped to the next sync marker.
+	damaged := append(avroBlock(1, request1[:5]), block...)
+	_, n, err = d.Decode(damaged)
+	if err == nil || n != len(damaged)-len(block) {
+		t.Errorf("damaged block: received %d, %v", n, err)
+	}
+}
+
+func TestAvroFileDecodeDeflate(t *testing.T) {
+	var data bytes.Buffer
+	w, err := flate.NewWriter(&data, flate.BestCompression)
+	testutil.FatalIfErr(t, err)
+	_, err = w.Write([]byte(request1))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, w.Close())
+	header := avroFile(t, "deflate")
+	block := avroBlock(1, data.String())
+
+	// Read from after the header, which is read from the start of the file.
+	file := bytes.NewReader(append(header, block...))
+	d := AvroFile.NewDecoder(file, int64(len(header)))
+	records, n, err := d.Decode(block)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, []Record{record1}, records)
+	if n != len(block) {
+		t.Errorf("block: expected %d, received %d", len(block), n)
+	}
+}
+
+func TestAvroFileDecodeErrors(t *testing.T) {
+	for name, header := range map[string][]byte{
+		"not avro": []byte("line of text\n"),
+		"codec":    avroFile(t, "snappy"),
+	} {
+		d := AvroFile.NewDecoder(nil, 0)
+		if _, _, err := d.Decode(header); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		// The file stays undecodable.
+		if _, _, err := d.Decode(avroBlock(1, request1)); err == nil {
+			t.Errorf("%s: expected an error after the header", name)
+		}
+	}
+	d := AvroFile.NewDecoder(nil, 0)
+	_, _, err := d.Decode(avroFile(t, "null"))
+	testutil.FatalIfErr(t, err)
+	for name, block := range map[string][]byte{
+		"empty block":             avroBlock(0, ""),
+		"more records than bytes": avroBlock(1<<62, request1),
+	} {
+		if _, n, err := d.Decode(block); err == nil || n != len(block) {
+			t.Errorf("%s: received %d, %v", name, n, err)
+		}
+	}
+	if _, _, err := AvroFile.NewDecoder(nil, 10).Decode(avroBlock(1, request1)); err == nil {
+		t.Error("expected an error reading a header without the file")
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package record
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// AvroFile is the format of Avro object container files, which start with
+// the schema of their records.  Blocks compressed with the null and deflate
+// codecs can be read.
+var AvroFile Format = avroFileFormat{}
+
+// avroMagic starts every object container file.
+const avroMagic = "Obj\x01"
+
+// avroSyncSize is the length of the marker that ends each block.
+const avroSyncSize = 16
+
+type avroFileFormat struct{}
+
+// NewDecoder returns a decoder of the object container file log.  A file
+// read from part way through has its header read from the start of log.
+func (avroFileFormat) NewDecoder(log io.ReaderAt, offset int64) Decoder {
+	d := &avroFileDecoder{}
+	if offset > 0 {
+		d.err = d.readHeader(log)
+	}
+	return d
+}
+
+// avroFileDecoder decodes the header of a file, and then its blocks.
+type avroFileDecoder struct {
+	schema *avroSchema // The schema of the records, or nil until the header is read.
+	codec  string
+	sync   []byte
+	err    error // Why the file can't be decoded, if its header is invalid.
+}
+
+func (d *avroFileDecoder) Decode(b []byte) ([]Record, int, error) {
+	if d.err != nil {
+		return nil, 0, d.err
+	}
+	if d.schema == nil {
+		n, err := d.header(b)
+		if err == errTruncated && len(b) <= MaxSize {
+			return nil, 0, nil
+		}
+		if err != nil {
+			d.err = errors.Wrap(err, "invalid Avro file header")
+			return nil, 0, d.err
+		}
+		return nil, n, nil
+	}
+	return d.block(b)
+}
+
+// readHeader reads the header from the start of log.
+func (d *avroFileDecoder) readHeader(log io.ReaderAt) error {
+	if log == nil {
+		return errors.New("can't read the Avro file header of a log that isn't a file")
+	}
+	for size := 4096; ; size *= 2 {
+		b := make([]byte, size)
+		n, err := log.ReadAt(b, 0)
+		if err != nil && err != io.EOF {
+			return errors.Wrap(err, "reading the Avro file header")
+		}
+		_, err = d.header(b[:n])
+		if err != errTruncated {
+			return errors.Wrap(err, "invalid Avro file header")
+		}
+		if n < size || size > MaxSize {
+			return errors.New("truncated Avro file header")
+		}
+	}
+}
+
+// header reads a file header from b, and returns its length.
+func (d *avroFileDecoder) header(b []byte) (int, error) {
+	r := &reader{b: b}
+	magic, err := r.next(uint64(len(avroMagic)))
+	if err != nil {
+		return 0, err
+	}
+	if string(magic) != avroMagic {
+		return 0, errors.New("not an Avro object container file")
+	}
+	meta := make(map[string]string)
+	err = r.avroBlocks(func() error {
+		k, err := r.avroBytes()
+		if err != nil {
+			return err
+		}
+		v, err := r.avroBytes()
+		meta[string(k)] = string(v)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	sync, err := r.next(avroSyncSize)
+	if err != nil {
+		return 0, err
+	}
+	schema, err := parseAvroSchema([]byte(meta["avro.schema"]))
+	if err != nil {
+		return 0, err
+	}
+	codec := meta["avro.codec"]
+	switch codec {
+	case "", "null", "deflate":
+	default:
+		return 0, errors.Errorf("unsupported codec %q", codec)
+	}
+	d.schema, d.codec, d.sync = schema, codec, append([]byte(nil), sync...)
+	return len(b) - len(r.b), nil
+}
+
+// block decodes the records of the block at the start of b.  A block that
+// can't be read is skipped up to the next sync marker.
+func (d *avroFileDecoder) block(b []byte) ([]Record, int, error) {
+	if len(b) == 0 {
+		return nil, 0, nil
+	}
+	r := &reader{b: b}
+	count, err := r.long()
+	var size int64
+	if err == nil {
+		size, err = r.long()
+	}
+	// Every block holds a record, and every record takes a byte, but for the
+	// records of a schema with no values to match, which are of no use to a
+	// program.  Otherwise a block of a few bytes could hold any number of
+	// records, and take forever to decode.
+	if err == nil && (count < 1 || count > size || size > MaxSize) {
+		err = errors.Errorf("invalid block of %d records in %d bytes", count, size)
+	}
+	var data, sync []byte
+	if err == nil {
+		data, err = r.next(uint64(size))
+	}
+	if err == nil {
+		sync, err = r.next(avroSyncSize)
+	}
+	if err == errTruncated {
+		return nil, 0, nil
+	}
+	if err == nil && !bytes.Equal(sync, d.sync) {
+		err = errors.New("block not ended by the sync marker")
+	}
+	if err != nil {
+		return nil, d.resync(b), errors.Wrap(err, "invalid Avro block")
+	}
+	n := len(b) - len(r.b)
+	if d.codec == "deflate" {
+		if data, err = inflate(data); err != nil {
+			return nil, n, errors.Wrap(err, "invalid Avro block")
+		}
+	}
+	var records []Record
+	dr := &reader{b: data}
+	for i := int64(0); i < count; i++ {
+		v, err := dr.avro(d.schema, 0)
+		if err != nil {
+			return nil, n, errors.Wrapf(err, "invalid Avro record %d of block", i)
+		}
+		records = append(records, newRecord(v))
+	}
+	return records, n, nil
+}
+
+// resync returns the length of b up to the end of the next sync marker, or
+// 0 if b doesn't hold one.
+func (d *avroFileDecoder) resync(b []byte) int {
+	if i := bytes.Index(b[1:], d.sync); i >= 0 {
+		return 1 + i + len(d.sync)
+	}
+	return 0
+}
+
+// inflate decompresses the deflate codec's block data b.
+func inflate(b []byte) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(b)), MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxSize {
+		return nil, errors.Errorf("block inflates to over %d bytes", MaxSize)
+	}
+	return data, nil
+}
@@ -0,0 +1,243 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package record
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Msgpack is the format of msgpack values written one after another, like
+// the logs and forwarded streams of fluentd.  A value that is a map has
+// fields named by its keys.
+var Msgpack Format = msgpackFormat{}
+
+// maxDepth is the deepest that values may be nested in a record.
+const maxDepth = 100
+
+// msgpackTimestamp is the extension type of msgpack timestamps.
+const msgpackTimestamp = -1
+
+var errTruncated = errors.New("truncated record")
+
+// reader reads the encoding of a record in turn.
+type reader struct {
+	b []byte
+}
+
+// next returns the next n bytes.
+func (r *reader) next(n uint64) ([]byte, error) {
+	if n > uint64(len(r.b)) {
+		return nil, errTruncated
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes.
+func (r *reader) uint(size int) (uint64, error) {
+	b, err := r.next(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+type msgpackFormat struct{}
+
+func (m msgpackFormat) NewDecoder(io.ReaderAt, int64) Decoder {
+	return m
+}
+
+func (msgpackFormat) Decode(b []byte) ([]Record, int, error) {
+	if len(b) == 0 {
+		return nil, 0, nil
+	}
+	r := &reader{b: b}
+	v, err := r.msgpack(0)
+	if err == errTruncated && len(b) <= MaxSize {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "invalid msgpack")
+	}
+	return []Record{newRecord(v)}, len(b) - len(r.b), nil
+}
+
+// msgpack reads one value, depth values deep.
+func (r *reader) msgpack(depth int) (value, error) {
+	if depth > maxDepth {
+		return nil, errors.Errorf("values nested more than %d deep", maxDepth)
+	}
+	t, err := r.uint(1)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t <= 0x7f:
+		return int64(t), nil
+	case t <= 0x8f:
+		return r.msgpackMap(t&0x0f, depth)
+	case t <= 0x9f:
+		return r.msgpackArray(t&0x0f, depth)
+	case t <= 0xbf:
+		return r.msgpackString(t & 0x1f)
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	}
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		// Binary data is given as a string.
+		n, err := r.uint(msgpackSize(t))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackString(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := r.uint(msgpackSize(t))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackExt(n)
+	case 0xca:
+		v, err := r.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := r.uint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := r.uint(1 << (t - 0xcc))
+		if v > math.MaxInt64 {
+			return v, err
+		}
+		return int64(v), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (t - 0xd0)
+		v, err := r.uint(size)
+		// Sign extend from the top bit of the value read.
+		shift := uint(64 - 8*size)
+		return int64(v<<shift) >> shift, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return r.msgpackExt(1 << (t - 0xd4))
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackMap(n, depth)
+	}
+	return nil, errors.Errorf("invalid type byte %#x", t)
+}
+
+// msgpackSize returns the size of the length that follows the type byte t
+// of a string, binary data, or extension.
+func msgpackSize(t uint64) int {
+	switch t {
+	case 0xc4, 0xc7, 0xd9:
+		return 1
+	case 0xc5, 0xc8, 0xda:
+		return 2
+	}
+	return 4
+}
+
+func (r *reader) msgpackString(n uint64) (value, error) {
+	if n > MaxSize {
+		return nil, errors.Errorf("string of %d bytes", n)
+	}
+	b, err := r.next(n)
+	return string(b), err
+}
+
+// msgpackExt reads the type and n bytes of data of an extension.  Timestamps
+// are given in RFC 3339 format, and other extensions as hex.
+func (r *reader) msgpackExt(n uint64) (value, error) {
+	if n > MaxSize {
+		return nil, errors.Errorf("extension of %d bytes", n)
+	}
+	t, err := r.uint(1)
+	if err != nil {
+		return nil, err
+	}
+	b, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(t) != msgpackTimestamp {
+		return hex.EncodeToString(b), nil
+	}
+	var sec, nsec int64
+	switch len(b) {
+	case 4:
+		sec = int64(binary.BigEndian.Uint32(b))
+	case 8:
+		v := binary.BigEndian.Uint64(b)
+		sec, nsec = int64(v&(1<<34-1)), int64(v>>34)
+	case 12:
+		nsec, sec = int64(binary.BigEndian.Uint32(b)), int64(binary.BigEndian.Uint64(b[4:]))
+	default:
+		return nil, errors.Errorf("timestamp of %d bytes", len(b))
+	}
+	return time.Unix(sec, nsec).UTC().Format(time.RFC3339Nano), nil
+}
+
+// msgpackArray reads the n values of an array.  Each value takes at least a
+// byte, so a longer array than the rest of the record is truncated.
+func (r *reader) msgpackArray(n uint64, depth int) (value, error) {
+	if n > uint64(len(r.b)) {
+		return nil, errTruncated
+	}
+	a := make([]value, 0, n)
+	for i := uint64(0); i < n; i++ {
+		v, err := r.msgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+// msgpackMap reads the n pairs of a map.  Keys that aren't strings are
+// named by their text.
+func (r *reader) msgpackMap(n uint64, depth int) (value, error) {
+	if 2*n > uint64(len(r.b)) {
+		return nil, errTruncated
+	}
+	o := &object{}
+	for i := uint64(0); i < n; i++ {
+		k, err := r.msgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := r.msgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		o.add(key(k), v)
+	}
+	return o, nil
+}
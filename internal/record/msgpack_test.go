@@ -0,0 +1,91 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package record
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestMsgpackDecode(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		b        string
+		expected []Record
+		n        int
+	}{
+		{
+			"map",
+			"\x84\xa4path\xa2/a\xa6status\xcc\xc8\xa4tags\x92\xa1x\xa1y\xa6timing\x81\xa7latency\xcb\x3f\xe0\x00\x00\x00\x00\x00\x00",
+			[]Record{{
+				Text:   `{"path":"/a","status":200,"tags":["x","y"],"timing":{"latency":0.5}}`,
+				Fields: map[string]string{"path": "/a", "status": "200", "tags": "x,y", "timing.latency": "0.5"},
+			}},
+			53,
+		},
+		{
+			"first of two",
+			"\x81\xa1a\x01\x81\xa1a\x02",
+			[]Record{{Text: `{"a":1}`, Fields: map[string]string{"a": "1"}}},
+			4,
+		},
+		{
+			"array of maps",
+			"\x81\xa1r\x92\x81\xa1a\x01\x81\xa1a\xc0",
+			[]Record{{Text: `{"r":[{"a":1},{"a":null}]}`, Fields: map[string]string{"r.a": "1,"}}},
+			12,
+		},
+		{
+			"integers",
+			"\x85\xa1a\xff\xa1b\xd0\x80\xa1c\xd1\xff\x00\xa1d\xcf\xff\xff\xff\xff\xff\xff\xff\xff\x01\xc3",
+			[]Record{{
+				Text:   `{"a":-1,"b":-128,"c":-256,"d":18446744073709551615,"1":true}`,
+				Fields: map[string]string{"a": "-1", "b": "-128", "c": "-256", "d": "18446744073709551615", "1": "true"},
+			}},
+			26,
+		},
+		{
+			"timestamp and bin",
+			"\x82\xa2ts\xd6\xff\x00\x00\x00\x3c\xa3bin\xc4\x02<>",
+			[]Record{{
+				Text:   `{"ts":"1970-01-01T00:01:00Z","bin":"<>"}`,
+				Fields: map[string]string{"ts": "1970-01-01T00:01:00Z", "bin": "<>"},
+			}},
+			18,
+		},
+		{
+			"not a map",
+			"\x92\x01\xa1x",
+			[]Record{{Text: `[1,"x"]`, Fields: map[string]string{}}},
+			4,
+		},
+		{"truncated", "\x82\xa1a\x01\xa1b", nil, 0},
+		{"truncated string", "\xd9\x10abc", nil, 0},
+		{"empty", "", nil, 0},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			records, n, err := Msgpack.NewDecoder(nil, 0).Decode([]byte(tc.b))
+			testutil.FatalIfErr(t, err)
+			testutil.ExpectNoDiff(t, tc.expected, records)
+			if n != tc.n {
+				t.Errorf("n: expected %d, received %d", tc.n, n)
+			}
+		})
+	}
+}
+
+func TestMsgpackDecodeErrors(t *testing.T) {
+	for _, b := range []string{
+		"\xc1",
+		"\x81\xa1a\xd5\xff\x00\x00",
+		strings.Repeat("\x91", maxDepth+1) + "\x01",
+	} {
+		if _, _, err := Msgpack.NewDecoder(nil, 0).Decode([]byte(b)); err == nil {
+			t.Errorf("%q: expected an error", b)
+		}
+	}
+}
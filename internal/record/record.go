@@ -0,0 +1,105 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package record decodes logs made of records with fields: binary records of
+// length-prefixed protocol buffers, Avro, and msgpack, and lines of JSON,
+// logfmt, and CSV.  Each record is decoded into its text, for programs to
+// match, and its fields by path, for the field builtin.
+package record
+
+import (
+	"io"
+	"strings"
+
+	"github.com/google/mtail/internal/protorecord"
+	"github.com/pkg/errors"
+)
+
+// MaxSize is the largest record accepted, in bytes.  A larger one is taken
+// to mean the log is corrupt.
+const MaxSize = protorecord.MaxSize
+
+// Record is one decoded record.
+type Record struct {
+	Text   string
+	Fields map[string]string
+}
+
+// A Format is a type of record that logs are made of.
+type Format interface {
+	// NewDecoder returns a decoder of one log, read from offset.  A format
+	// whose logs start with a header reads it from log, which is nil if
+	// the log isn't a file.
+	NewDecoder(log io.ReaderAt, offset int64) Decoder
+}
+
+// A Decoder decodes the records of one log in turn.
+type Decoder interface {
+	// Decode decodes the records at the start of b, returning them and the
+	// length of b they took up, which is 0 if b doesn't hold a whole record
+	// yet.  If the start of b can't be decoded, err is set and n is how much
+	// of b to skip, or 0 if none of it can be read.
+	Decode(b []byte) (records []Record, n int, err error)
+}
+
+// Parse returns the format described by s: "json", "logfmt", "csv", or
+// "plain" for lines of text; "auto" to detect which from each log;
+// "msgpack"; "avro" for Avro object container files; "avro:schema" for Avro
+// records written one after another with the JSON schema in the file schema;
+// or "descriptors:message" for protocol buffer records of the message type
+// named from the descriptor set in the file descriptors.
+func Parse(s string) (Format, error) {
+	switch {
+	case s == "json":
+		return JSON, nil
+	case s == "logfmt":
+		return Logfmt, nil
+	case s == "csv":
+		return CSV, nil
+	case s == "plain":
+		return Plain, nil
+	case s == "auto":
+		return Auto, nil
+	case s == "msgpack":
+		return Msgpack, nil
+	case s == "avro":
+		return AvroFile, nil
+	case strings.HasPrefix(s, "avro:"):
+		return LoadAvroSchema(s[len("avro:"):])
+	}
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return nil, errors.Errorf("unknown record format %q, expecting json, logfmt, csv, plain, auto, msgpack, avro, avro:schema, or descriptors:message", s)
+	}
+	m, err := protorecord.Load(s[:i], s[i+1:])
+	if err != nil {
+		return nil, err
+	}
+	return Proto(m), nil
+}
+
+// Proto returns the format of length-prefixed protocol buffer records of the
+// message type m.
+func Proto(m *protorecord.Message) Format {
+	return protoFormat{m}
+}
+
+type protoFormat struct {
+	m *protorecord.Message
+}
+
+func (p protoFormat) NewDecoder(io.ReaderAt, int64) Decoder {
+	return p
+}
+
+func (p protoFormat) Decode(b []byte) ([]Record, int, error) {
+	r, n, err := protorecord.Next(b)
+	if err != nil || n == 0 {
+		return nil, 0, err
+	}
+	text, fields, err := p.m.Decode(r)
+	if err != nil {
+		return nil, n, err
+	}
+	return []Record{{Text: text, Fields: fields}}, n, nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package record
+
+import (
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{"json", "logfmt", "csv", "plain", "auto", "msgpack", "avro", "avro:testdata/request.avsc", "../protorecord/testdata/request.pb:test.Request"} {
+		if _, err := Parse(s); err != nil {
+			t.Errorf("%s: %s", s, err)
+		}
+	}
+	for _, s := range []string{"xml", "avro:testdata/missing.avsc", "../protorecord/testdata/request.pb:test.Missing", "request.pb:"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestProtoDecode(t *testing.T) {
+	f, err := Parse("../protorecord/testdata/request.pb:test.Request")
+	testutil.FatalIfErr(t, err)
+	d := f.NewDecoder(nil, 0)
+	// A record of path: "/a" status: 200, and the start of another.
+	records, n, err := d.Decode([]byte("\x07\x0a\x02/a\x10\xc8\x01\x05"))
+	testutil.FatalIfErr(t, err)
+	expected := []Record{{Text: `path: "/a" status: 200`, Fields: map[string]string{"path": "/a", "status": "200"}}}
+	testutil.ExpectNoDiff(t, expected, records)
+	if n != 8 {
+		t.Errorf("n: expected 8, received %d", n)
+	}
+	records, n, err = d.Decode([]byte("\x05"))
+	if records != nil || n != 0 || err != nil {
+		t.Errorf("truncated: received %v, %d, %v", records, n, err)
+	}
+}
@@ -0,0 +1,383 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package record
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A LineDecoder decodes the lines of a log of text.  The last line of a log
+// can be decoded without its newline, before the log is closed or truncated.
+type LineDecoder interface {
+	Decoder
+	DecodeLine(line string) Record
+}
+
+// Lines reports whether the records of f are lines of text, so that a log of
+// them can be read on from the start of any line.
+func Lines(f Format) bool {
+	switch f.(type) {
+	case *lineFormat, *csvFormat, autoFormat:
+		return true
+	}
+	return false
+}
+
+// The formats of lines of text.  Each line's text is the line itself, and a
+// line that can't be read in the format has no fields.
+var (
+	// JSON is the format of lines that are each a JSON value.  An object has
+	// fields named by its keys, with the values of an array separated by
+	// commas.
+	JSON Format = &lineFormat{parseJSON}
+	// Logfmt is the format of lines of key=value pairs, separated by spaces.
+	// A value containing spaces is quoted.
+	Logfmt Format = &lineFormat{parseLogfmt}
+	// Plain is the format of lines of text with no fields.
+	Plain Format = &lineFormat{nil}
+	// CSV is the format of lines of comma-separated values, with fields
+	// named by the first line of the log.
+	CSV Format = &csvFormat{','}
+	// Auto is the format detected from the first lines of each log.
+	Auto Format = autoFormat{}
+)
+
+// sampleLines is the most lines looked at to detect the format of a log,
+// and sampleSize the most bytes read from the start of a file to find them.
+const (
+	sampleLines = 10
+	sampleSize  = 64 << 10
+)
+
+// csvDelimiters are the delimiters that are tried when detecting the format
+// of a log.
+var csvDelimiters = []rune{',', '\t', ';', '|'}
+
+// nextLine returns the first whole line of b, without its newline, and the
+// length of b it took up; or 0 if b doesn't hold one yet.
+func nextLine(b []byte) (string, int) {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return "", 0
+	}
+	return strings.ToValidUTF8(string(b[:i]), "\ufffd"), i + 1
+}
+
+// lineFormat reads the fields of each line with parse, or gives lines no
+// fields if parse is nil.
+type lineFormat struct {
+	parse func(line string) (*object, error)
+}
+
+func (f *lineFormat) NewDecoder(io.ReaderAt, int64) Decoder {
+	return f
+}
+
+func (f *lineFormat) Decode(b []byte) ([]Record, int, error) {
+	line, n := nextLine(b)
+	if n == 0 {
+		return nil, 0, nil
+	}
+	return []Record{f.DecodeLine(line)}, n, nil
+}
+
+func (f *lineFormat) DecodeLine(line string) Record {
+	if f.parse == nil {
+		return Record{Text: line}
+	}
+	fields := make(map[string]string)
+	if o, err := f.parse(line); err == nil && o != nil {
+		flatten(fields, o, "", false)
+	}
+	return Record{Text: line, Fields: fields}
+}
+
+// parseJSON returns the object on line, or nil if it holds another value.
+func parseJSON(line string) (*object, error) {
+	d := json.NewDecoder(strings.NewReader(line))
+	d.UseNumber()
+	var j interface{}
+	if err := d.Decode(&j); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("more than one JSON value")
+	}
+	o, _ := jsonValue(j).(*object)
+	return o, nil
+}
+
+// jsonValue converts the decoded JSON j to a value.  Numbers are kept as they
+// were written.
+func jsonValue(j interface{}) value {
+	switch j := j.(type) {
+	case map[string]interface{}:
+		o := &object{}
+		for k, v := range j {
+			o.add(k, jsonValue(v))
+		}
+		return o
+	case []interface{}:
+		a := make([]value, 0, len(j))
+		for _, v := range j {
+			a = append(a, jsonValue(v))
+		}
+		return a
+	case json.Number:
+		return string(j)
+	}
+	return j
+}
+
+// parseLogfmt returns the key=value pairs on line.  A key without a value is
+// an error.
+func parseLogfmt(line string) (*object, error) {
+	o := &object{}
+	s := strings.TrimSpace(line)
+	for s != "" {
+		i := strings.IndexAny(s, "= \t\"")
+		if i <= 0 || s[i] != '=' {
+			return nil, errors.Errorf("not a key=value pair: %q", s)
+		}
+		k := s[:i]
+		s = s[i+1:]
+		var v string
+		if strings.HasPrefix(s, `"`) {
+			end := quoteEnd(s)
+			if end < 0 {
+				return nil, errors.Errorf("unterminated quote: %q", s)
+			}
+			var err error
+			if v, err = strconv.Unquote(s[:end]); err != nil {
+				return nil, errors.Wrapf(err, "value of %s", k)
+			}
+			s = s[end:]
+			if s != "" && s[0] != ' ' && s[0] != '\t' {
+				return nil, errors.Errorf("text after the quoted value of %s", k)
+			}
+		} else if i := strings.IndexAny(s, " \t"); i >= 0 {
+			v, s = s[:i], s[i:]
+		} else {
+			v, s = s, ""
+		}
+		o.add(k, v)
+		s = strings.TrimLeft(s, " \t")
+	}
+	if len(o.keys) == 0 {
+		return nil, errors.New("no key=value pairs")
+	}
+	return o, nil
+}
+
+// quoteEnd returns the length of the quoted string at the start of s, or -1
+// if there is no closing quote.
+func quoteEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// splitCSV splits line into its values separated by delimiter.
+func splitCSV(line string, delimiter rune) ([]string, error) {
+	r := csv.NewReader(strings.NewReader(line))
+	r.Comma = delimiter
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1
+	return r.Read()
+}
+
+// csvFormat reads lines of values separated by delimiter, named by the
+// header on the first line of the log.
+type csvFormat struct {
+	delimiter rune
+}
+
+// NewDecoder returns a decoder of a log with a header.  A file read from
+// part way through has its header read from the start of log.
+func (f *csvFormat) NewDecoder(log io.ReaderAt, offset int64) Decoder {
+	d := &csvDecoder{delimiter: f.delimiter}
+	if offset > 0 && log != nil {
+		if lines := readSample(log); len(lines) > 0 {
+			d.setHeader(lines[0])
+		}
+	}
+	return d
+}
+
+type csvDecoder struct {
+	delimiter rune
+	header    []string // The column names, or nil until the header is read.
+}
+
+func (d *csvDecoder) setHeader(line string) {
+	header, err := splitCSV(strings.TrimPrefix(line, "\ufeff"), d.delimiter)
+	if err != nil || len(header) == 0 {
+		header = []string{}
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	d.header = header
+}
+
+func (d *csvDecoder) Decode(b []byte) ([]Record, int, error) {
+	line, n := nextLine(b)
+	if n == 0 {
+		return nil, 0, nil
+	}
+	if d.header == nil {
+		d.setHeader(line)
+		return nil, n, nil
+	}
+	return []Record{d.DecodeLine(line)}, n, nil
+}
+
+func (d *csvDecoder) DecodeLine(line string) Record {
+	fields := make(map[string]string)
+	values, err := splitCSV(line, d.delimiter)
+	if err == nil {
+		for i, v := range values {
+			if i < len(d.header) {
+				if _, ok := fields[d.header[i]]; !ok {
+					fields[d.header[i]] = v
+				}
+			}
+		}
+	}
+	return Record{Text: line, Fields: fields}
+}
+
+// readSample returns the first whole lines at the start of log.
+func readSample(log io.ReaderAt) []string {
+	b := make([]byte, sampleSize)
+	n, err := log.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return nil
+	}
+	return sample(b[:n])
+}
+
+// sample returns the first whole lines of b, leaving out empty ones.
+func sample(b []byte) []string {
+	var lines []string
+	for len(lines) < sampleLines {
+		line, n := nextLine(b)
+		if n == 0 {
+			break
+		}
+		b = b[n:]
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Detect returns the format of the sample of lines: JSON if each is a JSON
+// object, logfmt if each is key=value pairs, CSV if there are at least two
+// and each has the same number of values, more than one, separated by one of
+// the delimiters, or else plain text.
+func Detect(lines []string) Format {
+	if len(lines) == 0 {
+		return Plain
+	}
+	if all(lines, func(line string) bool {
+		o, err := parseJSON(line)
+		return err == nil && o != nil
+	}) {
+		return JSON
+	}
+	if all(lines, func(line string) bool {
+		_, err := parseLogfmt(line)
+		return err == nil
+	}) {
+		return Logfmt
+	}
+	if len(lines) > 1 {
+		for _, d := range csvDelimiters {
+			columns := -1
+			if all(lines, func(line string) bool {
+				values, err := splitCSV(line, d)
+				if err != nil || len(values) < 2 || (columns >= 0 && len(values) != columns) {
+					return false
+				}
+				columns = len(values)
+				return true
+			}) {
+				return &csvFormat{d}
+			}
+		}
+	}
+	return Plain
+}
+
+func all(lines []string, f func(string) bool) bool {
+	for _, line := range lines {
+		if !f(line) {
+			return false
+		}
+	}
+	return true
+}
+
+type autoFormat struct{}
+
+// NewDecoder returns a decoder that detects the format from the first lines
+// of log, if it is a file that has any yet, or else of the first read.
+func (autoFormat) NewDecoder(log io.ReaderAt, offset int64) Decoder {
+	return &autoDecoder{log: log, offset: offset}
+}
+
+type autoDecoder struct {
+	log    io.ReaderAt
+	offset int64
+	d      Decoder // The decoder of the detected format, or nil until then.
+}
+
+// detect chooses the decoder from the first lines of the file, or else of b.
+func (a *autoDecoder) detect(b []byte) {
+	var lines []string
+	if a.log != nil {
+		lines = readSample(a.log)
+	}
+	if len(lines) == 0 {
+		lines = sample(b)
+	}
+	if len(lines) == 0 {
+		return
+	}
+	a.d = Detect(lines).NewDecoder(a.log, a.offset)
+}
+
+func (a *autoDecoder) Decode(b []byte) ([]Record, int, error) {
+	if a.d == nil {
+		if a.detect(b); a.d == nil {
+			return nil, 0, nil
+		}
+	}
+	return a.d.Decode(b)
+}
+
+func (a *autoDecoder) DecodeLine(line string) Record {
+	if a.d == nil {
+		a.d = Detect([]string{line}).NewDecoder(a.log, a.offset)
+	}
+	if d, ok := a.d.(LineDecoder); ok {
+		return d.DecodeLine(line)
+	}
+	return Record{Text: line}
+}
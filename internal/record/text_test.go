@@ -0,0 +1,148 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package record
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestLineDecode(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		f        Format
+		b        string
+		expected []Record
+		n        int
+	}{
+		{"json", JSON, "{\"path\": \"/a\", \"status\": 200, \"timing\": {\"latency\": 0.5}, \"tags\": [\"x\", \"y\"], \"ok\": true, \"err\": null}\nnext",
+			[]Record{{
+				Text:   `{"path": "/a", "status": 200, "timing": {"latency": 0.5}, "tags": ["x", "y"], "ok": true, "err": null}`,
+				Fields: map[string]string{"path": "/a", "status": "200", "timing.latency": "0.5", "tags": "x,y", "ok": "true", "err": ""},
+			}}, 103},
+		{"json not an object", JSON, "[1, 2]\n", []Record{{Text: "[1, 2]", Fields: map[string]string{}}}, 7},
+		{"json invalid", JSON, "{\"a\": \n", []Record{{Text: `{"a": `, Fields: map[string]string{}}}, 7},
+		{"logfmt", Logfmt, "level=info msg=\"request done\" path=/a empty= status=200\n",
+			[]Record{{
+				Text:   `level=info msg="request done" path=/a empty= status=200`,
+				Fields: map[string]string{"level": "info", "msg": "request done", "path": "/a", "empty": "", "status": "200"},
+			}}, 56},
+		{"logfmt invalid", Logfmt, "plain text\n", []Record{{Text: "plain text", Fields: map[string]string{}}}, 11},
+		{"plain", Plain, "plain text\n", []Record{{Text: "plain text"}}, 11},
+		{"invalid utf8", Plain, "a\xffb\n", []Record{{Text: "a\ufffdb"}}, 4},
+		{"incomplete", JSON, `{"a": 1}`, nil, 0},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			records, n, err := tc.f.NewDecoder(nil, 0).Decode([]byte(tc.b))
+			testutil.FatalIfErr(t, err)
+			testutil.ExpectNoDiff(t, tc.expected, records)
+			if n != tc.n {
+				t.Errorf("n: expected %d, received %d", tc.n, n)
+			}
+		})
+	}
+}
+
+func TestParseLogfmt(t *testing.T) {
+	o, err := parseLogfmt(`a=1  b="x \"y\" z"	c=`)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, []string{"a", "b", "c"}, o.keys)
+	testutil.ExpectNoDiff(t, []value{"1", `x "y" z`, ""}, o.values)
+	for _, s := range []string{"", "a", "a=1 b", `a="1`, `a="1"b`, "=1", `"a"=1`} {
+		if _, err := parseLogfmt(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+// decodeAll decodes the records on the lines of b in turn.
+func decodeAll(t *testing.T, d Decoder, b string) []Record {
+	t.Helper()
+	var records []Record
+	for b != "" {
+		r, n, err := d.Decode([]byte(b))
+		testutil.FatalIfErr(t, err)
+		if n == 0 {
+			break
+		}
+		records = append(records, r...)
+		b = b[n:]
+	}
+	return records
+}
+
+func TestCSVDecode(t *testing.T) {
+	log := "\ufeffuser, status\nalice,200\n\"bob, jr\",404,extra\n"
+	expected := []Record{
+		{Text: "alice,200", Fields: map[string]string{"user": "alice", "status": "200"}},
+		{Text: `"bob, jr",404,extra`, Fields: map[string]string{"user": "bob, jr", "status": "404"}},
+	}
+	testutil.ExpectNoDiff(t, expected, decodeAll(t, CSV.NewDecoder(nil, 0), log))
+
+	// Read from part way through, with the header at the start of the file.
+	header := len("\ufeffuser, status\n")
+	testutil.ExpectNoDiff(t, expected, decodeAll(t, CSV.NewDecoder(strings.NewReader(log), int64(header)), log[header:]))
+}
+
+func TestDetect(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		lines    []string
+		expected map[string]string // The fields of the first record, or nil for plain text.
+	}{
+		{"json", []string{`{"a": 1}`, `{"a": 2}`}, map[string]string{"a": "1"}},
+		{"logfmt", []string{"a=1 b=x", "a=2"}, map[string]string{"a": "1", "b": "x"}},
+		{"csv", []string{"a,b", "1,x", "2,\"y,z\""}, map[string]string{"a": "1", "b": "x"}},
+		{"tsv", []string{"a\tb", "1\tx"}, map[string]string{"a": "1", "b": "x"}},
+		{"semicolons", []string{"a;b", "1;x"}, map[string]string{"a": "1", "b": "x"}},
+		{"uneven", []string{"a,b", "1,x,y"}, nil},
+		{"one line of csv", []string{"a,b"}, nil},
+		{"some json", []string{`{"a": 1}`, "not json"}, nil},
+		{"plain", []string{"GET /a 200", "GET /b 404"}, nil},
+		{"empty", nil, nil},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			f := Detect(tc.lines)
+			if tc.expected == nil {
+				if f != Plain {
+					t.Errorf("expected plain, received %#v", f)
+				}
+				return
+			}
+			records := decodeAll(t, f.NewDecoder(nil, 0), strings.Join(tc.lines, "\n")+"\n")
+			if len(records) == 0 {
+				t.Fatal("no records")
+			}
+			testutil.ExpectNoDiff(t, tc.expected, records[0].Fields)
+		})
+	}
+}
+
+func TestAutoDecode(t *testing.T) {
+	log := "a=1\na=2\n"
+	// Detected from the start of the file when read part way through.
+	d := Auto.NewDecoder(strings.NewReader(log), 4)
+	records := decodeAll(t, d, log[4:])
+	testutil.ExpectNoDiff(t, []Record{{Text: "a=2", Fields: map[string]string{"a": "2"}}}, records)
+
+	// Detected from what's read of a new log, without waiting for more
+	// lines.
+	d = Auto.NewDecoder(strings.NewReader(""), 0)
+	records = decodeAll(t, d, "{\"a\": 1}\n{\"a\"")
+	testutil.ExpectNoDiff(t, []Record{{Text: `{"a": 1}`, Fields: map[string]string{"a": "1"}}}, records)
+	ld, ok := d.(LineDecoder)
+	if !ok {
+		t.Fatal("auto decoder isn't a LineDecoder")
+	}
+	testutil.ExpectNoDiff(t, Record{Text: `{"a": 2}`, Fields: map[string]string{"a": "2"}}, ld.DecodeLine(`{"a": 2}`))
+
+	// Nothing is decoded until there's a whole line.
+	if records, n, err := Auto.NewDecoder(nil, 0).Decode([]byte("a=1")); records != nil || n != 0 || err != nil {
+		t.Errorf("received %v, %d, %v", records, n, err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package record
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A value is one decoded datum: nil, a bool, int64, uint64, float64, string,
+// a []value, or an *object.
+type value interface{}
+
+// object is a map or record, with its keys in the order they were read.
+type object struct {
+	keys   []string
+	values []value
+}
+
+func (o *object) add(key string, v value) {
+	o.keys = append(o.keys, key)
+	o.values = append(o.values, v)
+}
+
+// newRecord returns the record of the decoded datum v.  Its text is v in
+// JSON, and its fields are the values of a top level object by their path,
+// like "request.path", with the values in arrays separated by commas.
+func newRecord(v value) Record {
+	var text strings.Builder
+	writeJSON(&text, v)
+	fields := make(map[string]string)
+	if o, ok := v.(*object); ok {
+		flatten(fields, o, "", false)
+	}
+	return Record{Text: text.String(), Fields: fields}
+}
+
+// flatten adds the fields of v, whose path is path, to fields.  repeated is
+// set inside arrays.
+func flatten(fields map[string]string, v value, path string, repeated bool) {
+	switch v := v.(type) {
+	case *object:
+		if path != "" {
+			path += "."
+		}
+		for i, k := range v.keys {
+			flatten(fields, v.values[i], path+k, repeated)
+		}
+	case []value:
+		for _, e := range v {
+			flatten(fields, e, path, true)
+		}
+	default:
+		s := scalar(v)
+		if old, ok := fields[path]; ok && repeated {
+			s = old + "," + s
+		}
+		fields[path] = s
+	}
+}
+
+// scalar formats a value that isn't an object or array, with strings not
+// quoted, and null as the empty string.
+func scalar(v value) string {
+	switch v := v.(type) {
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return v
+	}
+	return ""
+}
+
+// key returns the name of the map key k.
+func key(k value) string {
+	switch k.(type) {
+	case *object, []value:
+		var b strings.Builder
+		writeJSON(&b, k)
+		return b.String()
+	}
+	return scalar(k)
+}
+
+// writeJSON writes v to b in JSON.  Floats that JSON can't hold, like NaN,
+// are written as strings.
+func writeJSON(b *strings.Builder, v value) {
+	switch v := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case *object:
+		b.WriteByte('{')
+		for i, k := range v.keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeString(b, k)
+			b.WriteByte(':')
+			writeJSON(b, v.values[i])
+		}
+		b.WriteByte('}')
+	case []value:
+		b.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSON(b, e)
+		}
+		b.WriteByte(']')
+	case string:
+		writeString(b, v)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			writeString(b, scalar(v))
+			return
+		}
+		b.WriteString(scalar(v))
+	default:
+		b.WriteString(scalar(v))
+	}
+}
+
+// writeString writes s to b as a JSON string, without escaping the
+// characters special to HTML as json.Marshal does.
+func writeString(b *strings.Builder, s string) {
+	var j bytes.Buffer
+	e := json.NewEncoder(&j)
+	e.SetEscapeHTML(false)
+	// Encoding a string can't fail.
+	_ = e.Encode(s)
+	b.Write(bytes.TrimSuffix(j.Bytes(), []byte("\n")))
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package secret provides the credentials that mtail authenticates to
+// collectors and webhooks with.  Secrets are read from files, or from the
+// environment, but never taken from flags, which any user can see in ps.  A
+// secret read from a file is reread when the file changes, so credentials can
+// be rotated without restarting mtail.
+package secret
+
+import (
+	"expvar"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/pkg/errors"
+)
+
+var (
+	// reloads counts the times each secret was reread after its file changed.
+	reloads = expvar.NewMap("secret_reloads_total")
+	// reloadErrors counts the failures to reread each secret.
+	reloadErrors = expvar.NewMap("secret_reload_errors_total")
+)
+
+// EnvPrefix prefixes the upper-cased name of a secret to make the name of the
+// environment variable it is read from when it has no file.
+const EnvPrefix = "MTAIL_"
+
+// checkInterval is the least time between checks of a secret's file for
+// changes.
+const checkInterval = time.Second
+
+// Secret is a credential read from a file or the environment.
+type Secret struct {
+	name string
+	path string // The file the secret is read from, or empty if from the environment.
+
+	mu      sync.Mutex
+	value   string
+	modTime time.Time // The modification time of the file when last read.
+	size    int64     // The size of the file when last read.
+	checked time.Time // When the file was last checked for changes.
+
+	now func() time.Time // for testing
+}
+
+// New returns the secret called name, read from the file at path, or if path
+// is empty, from the environment variable made by EnvPrefix and the name in
+// upper case.  A trailing newline is removed from a file.  New returns nil if
+// neither the file nor the variable is given, and an error if the file can't
+// be read.
+func New(name, path string) (*Secret, error) {
+	s := &Secret{name: name, path: path, now: time.Now}
+	if path == "" {
+		v, ok := os.LookupEnv(EnvPrefix + strings.ToUpper(name))
+		if !ok {
+			return nil, nil
+		}
+		s.value = v
+		return s, nil
+	}
+	if _, err := s.load(); err != nil {
+		return nil, errors.Wrapf(err, "reading %s", name)
+	}
+	s.checked = s.now()
+	return s, nil
+}
+
+// Value returns the secret.  If its file has changed since it was last read,
+// at most once per checkInterval, it is reread; if that fails, the last value
+// read is returned, so that a secret being replaced is never lost.
+func (s *Secret) Value() string {
+	if s.path == "" {
+		return s.value
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.Sub(s.checked) < checkInterval {
+		return s.value
+	}
+	s.checked = now
+	changed, err := s.load()
+	switch {
+	case err != nil:
+		reloadErrors.Add(s.name, 1)
+		logging.Warningf("Failed to reread %s, still using the last value read: %s", s.name, err)
+	case changed:
+		reloads.Add(s.name, 1)
+		logging.Infof("Reread %s from %s", s.name, s.path)
+	}
+	return s.value
+}
+
+// load reads the secret from its file, if the file has changed since it was
+// last read, and reports whether it had.  The file is found by name each
+// time, so replacing it, or the symlink to it, is seen as a change.
+func (s *Secret) load() (bool, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	if fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return false, nil
+	}
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.value = strings.TrimRight(string(b), "\r\n")
+	s.modTime, s.size = fi.ModTime(), fi.Size()
+	return true, nil
+}
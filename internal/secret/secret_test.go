@@ -0,0 +1,60 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package secret
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestSecretFile(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	path := filepath.Join(tmpDir, "password")
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte("hunter2\n"), 0600))
+
+	s, err := New("test_password", path)
+	testutil.FatalIfErr(t, err)
+	now := time.Unix(37, 0)
+	s.now = func() time.Time { return now }
+	s.checked = now
+	testutil.ExpectNoDiff(t, "hunter2", s.Value())
+
+	// Rotated by replacing the file, as a secret store does.
+	rotated := filepath.Join(tmpDir, "password.new")
+	testutil.FatalIfErr(t, ioutil.WriteFile(rotated, []byte("correct horse\r\n"), 0600))
+	testutil.FatalIfErr(t, os.Rename(rotated, path))
+	now = now.Add(checkInterval)
+	testutil.ExpectNoDiff(t, "correct horse", s.Value())
+
+	// While the file is gone, the last value read is kept.
+	testutil.FatalIfErr(t, os.Remove(path))
+	now = now.Add(checkInterval)
+	testutil.ExpectNoDiff(t, "correct horse", s.Value())
+}
+
+func TestSecretEnv(t *testing.T) {
+	s, err := New("test_token", "")
+	testutil.FatalIfErr(t, err)
+	if s != nil {
+		t.Errorf("expected no secret without a file or %sTEST_TOKEN, received %q", EnvPrefix, s.Value())
+	}
+
+	defer os.Unsetenv(EnvPrefix + "TEST_TOKEN")
+	testutil.FatalIfErr(t, os.Setenv(EnvPrefix+"TEST_TOKEN", "s3cr3t"))
+	s, err = New("test_token", "")
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "s3cr3t", s.Value())
+}
+
+func TestSecretMissingFile(t *testing.T) {
+	if _, err := New("test_password", "/nonexistent/password"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
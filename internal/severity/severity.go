@@ -0,0 +1,242 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package severity counts the lines of each log by the severity they were
+// logged at, recognised from the tokens common log formats write it with,
+// so that the volume of errors in a log can be watched without a program.
+package severity
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/logline"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Unknown is the severity of a line with no severity that can be recognised.
+const Unknown = "unknown"
+
+// scanTokens is how many tokens at the start of a line are looked at for a
+// severity.
+const scanTokens = 8
+
+// names maps the tokens that severities are written as, in lower case, to
+// their names.
+var names = map[string]string{
+	"trace":       "trace",
+	"debug":       "debug",
+	"dbg":         "debug",
+	"info":        "info",
+	"information": "info",
+	"notice":      "notice",
+	"warn":        "warning",
+	"warning":     "warning",
+	"err":         "error",
+	"error":       "error",
+	"crit":        "critical",
+	"critical":    "critical",
+	"alert":       "alert",
+	"emerg":       "emergency",
+	"emergency":   "emergency",
+	"panic":       "emergency",
+	"fatal":       "fatal",
+}
+
+// syslogSeverities are the names of the syslog severities, by number.
+var syslogSeverities = [8]string{"emergency", "alert", "critical", "error", "warning", "notice", "info", "debug"}
+
+// glogSeverities are the names of the severities of glog's line prefix.
+var glogSeverities = map[byte]string{'I': "info", 'W': "warning", 'E': "error", 'F': "fatal"}
+
+// fieldNames are the record fields and key=value keys that hold a severity.
+var fieldNames = []string{"level", "severity", "lvl", "loglevel"}
+
+// Parse returns the severity of the log line ll, or Unknown.  It is taken from
+// the first of:
+//
+//   - a level or severity field of a structured record;
+//   - a syslog priority, like <11>, starting the line;
+//   - a glog prefix, like E0102, starting the line;
+//   - a level=, severity=, lvl= or loglevel= key among the first tokens;
+//   - a severity name, like ERROR, [warn], or [core:error], among the first
+//     tokens.
+func Parse(ll *logline.LogLine) string {
+	for _, f := range fieldNames {
+		if s, ok := names[strings.ToLower(ll.Fields[f])]; ok {
+			return s
+		}
+	}
+	line := ll.Line
+	if s, ok := syslogPriority(line); ok {
+		return s
+	}
+	if s, ok := glogPrefix(line); ok {
+		return s
+	}
+	tokens := strings.Fields(line)
+	if len(tokens) > scanTokens {
+		tokens = tokens[:scanTokens]
+	}
+	for _, t := range tokens {
+		i := strings.IndexByte(t, '=')
+		if i <= 0 {
+			continue
+		}
+		key := strings.ToLower(t[:i])
+		for _, f := range fieldNames {
+			if key == f {
+				if s, ok := names[strings.ToLower(strings.Trim(t[i+1:], `"'`))]; ok {
+					return s
+				}
+			}
+		}
+	}
+	for _, t := range tokens {
+		t = strings.Trim(t, `[]()<>{}|:,;"'-`)
+		if i := strings.LastIndexByte(t, ':'); i >= 0 {
+			t = t[i+1:]
+		}
+		if s, ok := names[strings.ToLower(t)]; ok {
+			return s
+		}
+	}
+	return Unknown
+}
+
+// syslogPriority returns the severity of the syslog priority, such as <11>,
+// that starts line.
+func syslogPriority(line string) (string, bool) {
+	if !strings.HasPrefix(line, "<") {
+		return "", false
+	}
+	end := strings.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		return "", false
+	}
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return "", false
+	}
+	return syslogSeverities[pri%8], true
+}
+
+// glogPrefix returns the severity of the glog prefix, such as E0102 15:04:05,
+// that starts line.
+func glogPrefix(line string) (string, bool) {
+	if len(line) < 6 || line[5] != ' ' {
+		return "", false
+	}
+	s, ok := glogSeverities[line[0]]
+	if !ok {
+		return "", false
+	}
+	for i := 1; i < 5; i++ {
+		if line[i] < '0' || line[i] > '9' {
+			return "", false
+		}
+	}
+	return s, true
+}
+
+var linesDesc = prometheus.NewDesc(
+	"mtail_log_lines_by_severity_total",
+	"number of lines read from each log file, by the severity they were logged at",
+	[]string{"logfile", "severity"}, nil)
+
+// staleAfter is how long the count of a log's lines of a severity is kept
+// after the last of them, as long as the Tailer keeps a log that isn't read.
+const staleAfter = 24 * time.Hour
+
+// maxCounts limits the counts kept, so that many logs coming and going don't
+// grow them without bound.  Past it the oldest count is forgotten.
+const maxCounts = 10000
+
+type key struct {
+	logfile, severity string
+}
+
+// count is the number of lines of a log of a severity.
+type count struct {
+	n    uint64
+	last time.Time // When the last line was counted.
+}
+
+// Counter counts the lines of each log by severity, passing them on to
+// another processor.
+type Counter struct {
+	llp   logline.Processor
+	clock clock.Clock // Tells when lines are counted, for expiring old counts.
+
+	mu     sync.Mutex
+	counts map[key]*count
+}
+
+// NewCounter returns a Counter that passes lines on to llp.
+func NewCounter(llp logline.Processor) *Counter {
+	return &Counter{llp: llp, clock: clock.Real, counts: make(map[key]*count)}
+}
+
+// ProcessLogLine satisfies the logline.Processor interface.
+func (c *Counter) ProcessLogLine(ctx context.Context, ll *logline.LogLine) {
+	k := key{ll.Filename, Parse(ll)}
+	now := c.clock.Now()
+	c.mu.Lock()
+	n, ok := c.counts[k]
+	if !ok {
+		if len(c.counts) >= maxCounts {
+			c.expire(now)
+		}
+		n = &count{}
+		c.counts[k] = n
+	}
+	n.n++
+	n.last = now
+	c.mu.Unlock()
+	c.llp.ProcessLogLine(ctx, ll)
+}
+
+// expire forgets the counts last added to over staleAfter before now, and
+// then the oldest if there are still maxCounts.  c.mu must be held.
+func (c *Counter) expire(now time.Time) {
+	c.expireStale(now)
+	if len(c.counts) >= maxCounts {
+		var oldest key
+		var last time.Time
+		for k, n := range c.counts {
+			if last.IsZero() || n.last.Before(last) {
+				oldest, last = k, n.last
+			}
+		}
+		delete(c.counts, oldest)
+	}
+}
+
+// expireStale forgets the counts last added to over staleAfter before now.
+// c.mu must be held.
+func (c *Counter) expireStale(now time.Time) {
+	for k, n := range c.counts {
+		if now.Sub(n.last) > staleAfter {
+			delete(c.counts, k)
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Counter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- linesDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Counter) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireStale(c.clock.Now())
+	for k, n := range c.counts {
+		ch <- prometheus.MustNewConstMetric(linesDesc, prometheus.CounterValue, float64(n.n), k.logfile, k.severity)
+	}
+}
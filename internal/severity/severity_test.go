@@ -0,0 +1,106 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package severity
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{"2020-01-02 15:04:05,123 ERROR [main] connection refused", "error"},
+		{"2020-01-02 15:04:05,123 - app.db - WARNING - slow query", "warning"},
+		{"2020/01/02 15:04:05 [crit] 123#0: *1 open() failed", "critical"},
+		{"[Thu Jan 02 15:04:05 2020] [core:notice] [pid 1] started", "notice"},
+		{`time="2020-01-02T15:04:05Z" level=debug msg="tick"`, "debug"},
+		{`ts=2020-01-02T15:04:05Z lvl="WARN" msg=x`, "warning"},
+		{"<11>Jan  2 15:04:05 host app: failed", "error"},
+		{"<165>1 2020-01-02T15:04:05Z host app - - - hello", "notice"},
+		{"E0102 15:04:05.123456    1 main.go:10] boom", "error"},
+		{"I0102 15:04:05.123456    1 main.go:10] ok", "info"},
+		{"FATAL: out of memory", "fatal"},
+		{"GET /index.html 200", Unknown},
+		{"one two three four five six seven eight error", Unknown},
+		{"", Unknown},
+	} {
+		if s := Parse(&logline.LogLine{Line: tc.line}); s != tc.expected {
+			t.Errorf("%q: expected %s, received %s", tc.line, tc.expected, s)
+		}
+	}
+	// A record's level field comes first.
+	ll := &logline.LogLine{Line: "ERROR in the text", Fields: map[string]string{"level": "Info"}}
+	testutil.ExpectNoDiff(t, "info", Parse(ll))
+}
+
+type stubProcessor struct {
+	lines []string
+}
+
+func (s *stubProcessor) ProcessLogLine(ctx context.Context, ll *logline.LogLine) {
+	s.lines = append(s.lines, ll.Line)
+}
+
+func TestCounter(t *testing.T) {
+	llp := &stubProcessor{}
+	c := NewCounter(llp)
+	ctx := context.Background()
+	for _, l := range []struct{ filename, line string }{
+		{"a.log", "ERROR one"},
+		{"a.log", "ERROR two"},
+		{"a.log", "hello"},
+		{"b.log", "level=info"},
+	} {
+		c.ProcessLogLine(ctx, logline.New(ctx, l.filename, l.line))
+	}
+	testutil.ExpectNoDiff(t, []string{"ERROR one", "ERROR two", "hello", "level=info"}, llp.lines)
+
+	expected := `
+# HELP mtail_log_lines_by_severity_total number of lines read from each log file, by the severity they were logged at
+# TYPE mtail_log_lines_by_severity_total counter
+mtail_log_lines_by_severity_total{logfile="a.log",severity="error"} 2
+mtail_log_lines_by_severity_total{logfile="a.log",severity="unknown"} 1
+mtail_log_lines_by_severity_total{logfile="b.log",severity="info"} 1
+`
+	testutil.FatalIfErr(t, promtest.CollectAndCompare(c, strings.NewReader(expected)))
+}
+
+func TestCounterExpiry(t *testing.T) {
+	c := NewCounter(&stubProcessor{})
+	clk := clock.NewFake(time.Unix(0, 0))
+	c.clock = clk
+	ctx := context.Background()
+	c.ProcessLogLine(ctx, logline.New(ctx, "old.log", "ERROR"))
+	clk.Advance(staleAfter / 2)
+	c.ProcessLogLine(ctx, logline.New(ctx, "new.log", "ERROR"))
+	clk.Advance(staleAfter/2 + time.Second)
+
+	// The count of a log not read for a day is forgotten.
+	expected := `
+# HELP mtail_log_lines_by_severity_total number of lines read from each log file, by the severity they were logged at
+# TYPE mtail_log_lines_by_severity_total counter
+mtail_log_lines_by_severity_total{logfile="new.log",severity="error"} 1
+`
+	testutil.FatalIfErr(t, promtest.CollectAndCompare(c, strings.NewReader(expected)))
+
+	// Past the limit, the oldest count is forgotten.
+	for i := 0; i < maxCounts; i++ {
+		c.ProcessLogLine(ctx, logline.New(ctx, fmt.Sprintf("%d.log", i), "ERROR"))
+	}
+	testutil.ExpectNoDiff(t, maxCounts, len(c.counts))
+	if _, ok := c.counts[key{"new.log", "error"}]; ok {
+		t.Error("oldest count not forgotten")
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/logline"
+	"github.com/pkg/errors"
+)
+
+// BackfillOrder configures the order Backfill reads the lines of several
+// logs in.  Without a Timestamp, each log is read in turn, oldest first by
+// rotation.  With one, the lines of all the logs are interleaved in the
+// order of their timestamps.
+type BackfillOrder struct {
+	Timestamp *regexp.Regexp // The first capture group is the timestamp of a line.
+	Layout    string         // The Go time layout of the timestamps; RFC 3339 if empty.
+	Location  *time.Location // The timezone of timestamps that don't name one, unless the log has its own; UTC if nil.
+}
+
+// Backfill reads the logs matching the glob patterns once from the start,
+// in the order they were written, so that metrics over intervals of log
+// time come out as they did when the logs were written.  Logs compressed
+// with gzip, with the extension .gz, are decompressed.  Logs of binary
+// records can't be read this way.
+func (t *Tailer) Backfill(patterns []string, order BackfillOrder) error {
+	if order.Timestamp != nil && order.Timestamp.NumSubexp() < 1 {
+		return errors.Errorf("timestamp pattern %q has no capture group", order.Timestamp)
+	}
+	if order.Layout == "" {
+		order.Layout = time.RFC3339
+	}
+	if order.Location == nil {
+		order.Location = time.UTC
+	}
+	pathnames, err := t.backfillPaths(patterns)
+	if err != nil {
+		return err
+	}
+	var sources []*backfillSource
+	defer func() {
+		for _, s := range sources {
+			s.f.Close()
+		}
+	}()
+	for _, pathname := range pathnames {
+		s, err := t.openBackfillSource(pathname, order)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, s)
+		if err := s.advance(); err != nil {
+			return err
+		}
+	}
+	for {
+		if err := t.ctx.Err(); err != nil {
+			return err
+		}
+		s := nextBackfillSource(sources, order.Timestamp != nil)
+		if s == nil {
+			return nil
+		}
+		s.send(t.ctx)
+		if err := s.advance(); err != nil {
+			return err
+		}
+	}
+}
+
+// backfillPaths returns the pathnames of the logs matching patterns that
+// aren't ignored, in rotation order.
+func (t *Tailer) backfillPaths(patterns []string) ([]string, error) {
+	seen := make(map[string]struct{})
+	var pathnames []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, errors.Wrapf(ErrNoMatches, "pattern %q", pattern)
+		}
+		for _, pathname := range matches {
+			absPath, err := filepath.Abs(pathname)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := seen[absPath]; ok {
+				continue
+			}
+			seen[absPath] = struct{}{}
+			fi, err := os.Stat(absPath)
+			if err != nil {
+				return nil, err
+			}
+			if fi.IsDir() {
+				continue
+			}
+			if t.ignoreRegexPattern != nil && t.ignoreRegexPattern.MatchString(fi.Name()) {
+				continue
+			}
+			if t.recordFormatFor(absPath) != nil {
+				return nil, errors.Errorf("%s: logs of binary records can't be backfilled in order", pathname)
+			}
+			if !strings.HasSuffix(pathname, ".gz") && isBinary(absPath, fi) {
+				t.skipBinary(absPath)
+				continue
+			}
+			pathnames = append(pathnames, pathname)
+		}
+	}
+	sortByRotation(pathnames)
+	return pathnames, nil
+}
+
+// rotationSuffix matches the suffix added to the name of a rotated log: a
+// rotation number, or a date.
+var rotationSuffix = regexp.MustCompile(`^(.+)[.-](\d+)$`)
+
+// rotation returns the name of the log that the log at pathname was rotated
+// from, and where it comes in the order of the logs rotated from it.  Logs
+// named by date, like app.log-20201101, come first in date order, then logs
+// numbered by rotation, like app.log.2.gz then app.log.1, and then the log
+// itself, which is the newest.
+func rotation(pathname string) (base string, kind int, index string) {
+	base = strings.TrimSuffix(pathname, ".gz")
+	m := rotationSuffix.FindStringSubmatch(base)
+	if m == nil {
+		return base, 2, ""
+	}
+	if len(m[2]) >= 8 {
+		return m[1], 0, m[2]
+	}
+	return m[1], 1, m[2]
+}
+
+// sortByRotation sorts pathnames oldest first by rotation, and otherwise by
+// name.
+func sortByRotation(pathnames []string) {
+	sort.SliceStable(pathnames, func(i, j int) bool {
+		bi, ki, ii := rotation(pathnames[i])
+		bj, kj, ij := rotation(pathnames[j])
+		switch {
+		case bi != bj:
+			return bi < bj
+		case ki != kj:
+			return ki < kj
+		case ki == 1:
+			// Higher rotation numbers are older.
+			ni, _ := strconv.Atoi(ii)
+			nj, _ := strconv.Atoi(ij)
+			return ni > nj
+		default:
+			return ii < ij
+		}
+	})
+}
+
+// backfillSource is a log being read by Backfill.
+type backfillSource struct {
+	name   string
+	f      *os.File
+	r      *bufio.Reader
+	llp    logline.Processor
+	order  BackfillOrder
+	loc    *time.Location // The timezone to parse timestamps in.
+	line   string         // The next line to send.
+	width  int            // The bytes of the next line, with its newline.
+	time   time.Time      // The timestamp of the next line, or of the last line before it that had one.
+	offset int64          // The offset of the next line in the uncompressed log.
+	number int64          // The number of the next line.
+	done   bool
+}
+
+// openBackfillSource opens the log at pathname for Backfill, sending its
+// lines to the tailer's processor as openLogPath would.
+func (t *Tailer) openBackfillSource(pathname string, order BackfillOrder) (*backfillSource, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = f
+	if strings.HasSuffix(pathname, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrapf(err, "reading %s", pathname)
+		}
+		r = gz
+	}
+	s := &backfillSource{name: pathname, f: f, r: bufio.NewReader(r), llp: t.llp, order: order, loc: order.Location}
+	if t.dedup != nil {
+		s.llp = newDedupProcessor(s.llp, t.clock, t.dedup)
+	}
+	if loc := t.locationFor(pathname); loc != nil {
+		s.llp = &locatedProcessor{s.llp, loc}
+		s.loc = loc
+	}
+	logging.Infof("Backfilling %s", pathname)
+	logCount.Add(1)
+	return s, nil
+}
+
+// advance reads the next line from the source, and its timestamp if the
+// order has a timestamp pattern.
+func (s *backfillSource) advance() error {
+	s.offset += int64(s.width)
+	line, err := s.r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		s.done = true
+		return errors.Wrapf(err, "reading %s", s.name)
+	}
+	if line == "" {
+		s.done = true
+		return nil
+	}
+	s.width = len(line)
+	s.line = strings.TrimSuffix(line, "\n")
+	s.number++
+	if s.order.Timestamp == nil {
+		return nil
+	}
+	if m := s.order.Timestamp.FindStringSubmatch(s.line); m != nil {
+		if ts, err := time.ParseInLocation(s.order.Layout, m[1], s.loc); err == nil {
+			s.time = ts
+		}
+	}
+	return nil
+}
+
+// send sends the next line of the source off for processing.
+func (s *backfillSource) send(ctx context.Context) {
+	ll := logline.New(ctx, s.name, s.line)
+	ll.Offset, ll.Number = s.offset, s.number
+	ll.IngestTime = time.Now()
+	s.llp.ProcessLogLine(ctx, ll)
+	lineCount.Add(s.name, 1)
+	byteCount.Add(s.name, int64(s.width))
+}
+
+// nextBackfillSource returns the source with the next line to send, or nil
+// when every source is done.  By timestamp, this is the source with the
+// earliest, with ties going to the older log; otherwise it's the oldest log
+// not yet done.
+func nextBackfillSource(sources []*backfillSource, byTimestamp bool) *backfillSource {
+	var next *backfillSource
+	for _, s := range sources {
+		if s.done {
+			continue
+		}
+		if !byTimestamp {
+			return s
+		}
+		if next == nil || s.time.Before(next.time) {
+			next = s
+		}
+	}
+	return next
+}
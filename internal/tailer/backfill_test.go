@@ -0,0 +1,109 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"compress/gzip"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestSortByRotation(t *testing.T) {
+	pathnames := []string{
+		"app.log",
+		"app.log.1",
+		"app.log.10.gz",
+		"app.log.2.gz",
+		"other.log",
+		"app.log-20201102",
+		"app.log-20201101.gz",
+	}
+	sortByRotation(pathnames)
+	expected := []string{
+		"app.log-20201101.gz",
+		"app.log-20201102",
+		"app.log.10.gz",
+		"app.log.2.gz",
+		"app.log.1",
+		"app.log",
+		"other.log",
+	}
+	testutil.ExpectNoDiff(t, expected, pathnames)
+}
+
+// writeBackfillLog writes the lines to the log at pathname, compressed if it
+// ends in .gz.
+func writeBackfillLog(t *testing.T, pathname string, lines string) {
+	t.Helper()
+	f := testutil.TestOpenFile(t, pathname)
+	defer f.Close()
+	if filepath.Ext(pathname) != ".gz" {
+		testutil.WriteString(t, f, lines)
+		return
+	}
+	gz := gzip.NewWriter(f)
+	_, err := gz.Write([]byte(lines))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, gz.Close())
+}
+
+func TestBackfill(t *testing.T) {
+	ta, llp, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	writeBackfillLog(t, filepath.Join(dir, "app.log.2.gz"), "2020-11-01T00:00:00Z first\n2020-11-01T00:00:02Z third\n")
+	writeBackfillLog(t, filepath.Join(dir, "app.log.1"), "2020-11-01T00:00:04Z fifth\n")
+	writeBackfillLog(t, filepath.Join(dir, "app.log"), "2020-11-01T00:00:06Z seventh\nno timestamp")
+	writeBackfillLog(t, filepath.Join(dir, "other.log"), "2020-11-01T00:00:01Z second\n2020-11-01T00:00:05Z sixth\n")
+	writeBackfillLog(t, filepath.Join(dir, "other.log.1"), "2020-11-01T00:00:03Z fourth\n")
+	patterns := []string{filepath.Join(dir, "app.log*"), filepath.Join(dir, "other.log*")}
+
+	for _, tc := range []struct {
+		name     string
+		order    BackfillOrder
+		expected []string
+	}{
+		{
+			"rotation",
+			BackfillOrder{},
+			[]string{"first", "third", "fifth", "seventh", "no timestamp", "fourth", "second", "sixth"},
+		},
+		{
+			"timestamp",
+			BackfillOrder{Timestamp: regexp.MustCompile(`^(\S+Z) `)},
+			[]string{"first", "second", "third", "fourth", "fifth", "sixth", "seventh", "no timestamp"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			llp.result = nil
+			llp.Add(len(tc.expected))
+			testutil.FatalIfErr(t, ta.Backfill(patterns, tc.order))
+			llp.Wait()
+			var received []string
+			for _, ll := range llp.result {
+				received = append(received, regexp.MustCompile(`^\S+Z `).ReplaceAllString(ll.Line, ""))
+			}
+			testutil.ExpectNoDiff(t, tc.expected, received)
+		})
+	}
+
+	// The offsets and numbers of the lines are those in the uncompressed log.
+	last := llp.result[len(llp.result)-1]
+	testutil.ExpectNoDiff(t, &logline.LogLine{Filename: filepath.Join(dir, "app.log"), Line: "no timestamp", Offset: 29, Number: 2}, last, testutil.IgnoreFields(logline.LogLine{}, "Context", "IngestTime"))
+}
+
+func TestBackfillNoMatches(t *testing.T) {
+	ta, _, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	if err := ta.Backfill([]string{filepath.Join(dir, "*.log")}, BackfillOrder{}); err == nil {
+		t.Error("expected an error backfilling no logs")
+	}
+}
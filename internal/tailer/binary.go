@@ -0,0 +1,77 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/mtail/internal/logging"
+)
+
+var (
+	// binaryLogsSkipped counts the files matching a log pattern that are
+	// not tailed because they look binary.
+	binaryLogsSkipped = expvar.NewInt("log_binary_skipped_total")
+)
+
+// binaryExtensions are the extensions of files that are never text logs,
+// but that log globs often match: journals, databases, and compressed
+// rotated logs.
+var binaryExtensions = map[string]bool{
+	".journal": true,
+	".db":      true,
+	".sqlite":  true,
+	".gz":      true,
+	".bz2":     true,
+	".xz":      true,
+	".zst":     true,
+	".zip":     true,
+}
+
+// sniffLen is how much of a file is read to decide whether it's binary.
+const sniffLen = 512
+
+// isBinary reports whether the regular file at pathname looks binary,
+// because of its extension or NUL bytes in its first block.  Files that
+// can't be read are left for opening to report.
+func isBinary(pathname string, fi os.FileInfo) bool {
+	if !fi.Mode().IsRegular() {
+		return false
+	}
+	if binaryExtensions[strings.ToLower(filepath.Ext(pathname))] {
+		return true
+	}
+	f, err := os.Open(pathname)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false
+	}
+	return bytes.IndexByte(buf[:n], 0) >= 0
+}
+
+// skipBinary records that pathname is not tailed because it looks binary,
+// warning the first time.
+func (t *Tailer) skipBinary(pathname string) {
+	t.binarySkippedMu.Lock()
+	defer t.binarySkippedMu.Unlock()
+	if _, ok := t.binarySkipped[pathname]; ok {
+		return
+	}
+	if t.binarySkipped == nil {
+		t.binarySkipped = make(map[string]struct{})
+	}
+	t.binarySkipped[pathname] = struct{}{}
+	binaryLogsSkipped.Add(1)
+	logging.Warningf("Not tailing %s as it looks like a binary file", pathname)
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/pkg/errors"
+)
+
+var (
+	// logIdleCloses counts the idle log files closed to stay within the
+	// open file budget.
+	logIdleCloses = expvar.NewInt("log_idle_closes_total")
+	// logFilesOpen records the number of log files holding a file
+	// descriptor, when there is an open file budget.
+	logFilesOpen = expvar.NewInt("log_files_open")
+)
+
+// MaxOpenFiles sets how many regular log files the Tailer keeps open at
+// once.  Beyond that, the least recently read are closed, and reopened at
+// the same offset when the watcher next reports a change to them.
+type MaxOpenFiles int
+
+func (opt MaxOpenFiles) apply(t *Tailer) error {
+	if opt < 0 {
+		return errors.Errorf("max open files must not be negative: %d", opt)
+	}
+	if opt == 0 {
+		t.budget = nil
+		return nil
+	}
+	t.budget = newFdBudget(int(opt))
+	return nil
+}
+
+// fdBudget tracks the open regular log files in order of use, so the least
+// recently used can be closed when there are too many.
+type fdBudget struct {
+	max int
+
+	mu    sync.Mutex // protects lru and elems
+	lru   *list.List // Open files, most recently used at the front.
+	elems map[*File]*list.Element
+}
+
+func newFdBudget(max int) *fdBudget {
+	return &fdBudget{max: max, lru: list.New(), elems: make(map[*File]*list.Element)}
+}
+
+// touch records that f is open and was just used.  It is safe to call on a
+// nil fdBudget.
+func (b *fdBudget) touch(f *File) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e, ok := b.elems[f]; ok {
+		b.lru.MoveToFront(e)
+		return
+	}
+	b.elems[f] = b.lru.PushFront(f)
+	logFilesOpen.Add(1)
+}
+
+// remove records that f has been closed.  It is safe to call on a nil
+// fdBudget.
+func (b *fdBudget) remove(f *File) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e, ok := b.elems[f]; ok {
+		b.lru.Remove(e)
+		delete(b.elems, f)
+		logFilesOpen.Add(-1)
+	}
+}
+
+// enforce closes the least recently used files beyond the budget.  It must
+// not be called while any File is locked.
+func (b *fdBudget) enforce() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	var victims []*File
+	for e := b.lru.Back(); e != nil && b.lru.Len()-len(victims) > b.max; e = e.Prev() {
+		victims = append(victims, e.Value.(*File))
+	}
+	b.mu.Unlock()
+	for _, f := range victims {
+		if err := f.park(); err != nil {
+			logging.Info(err)
+			continue
+		}
+		logIdleCloses.Add(1)
+	}
+}
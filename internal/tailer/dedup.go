@@ -0,0 +1,108 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/logline"
+	"github.com/pkg/errors"
+)
+
+var (
+	// linesDeduplicated counts the lines per log that were dropped as
+	// repeats of a recent line.
+	linesDeduplicated = expvar.NewMap("log_lines_deduplicated_total")
+)
+
+// Dedup drops each line that exactly repeats one of the last count distinct
+// lines passed on from its log, if it was passed on within window.  With no
+// window, a line is remembered for as long as it is among the last count;
+// with no count, only the last line is remembered.
+func Dedup(window time.Duration, count int) Option {
+	return dedupOption{window, count}
+}
+
+type dedupOption struct {
+	window time.Duration
+	lines  int
+}
+
+func (opt dedupOption) apply(t *Tailer) error {
+	if opt.window < 0 || opt.lines < 0 {
+		return errors.Errorf("dedup window %s and count %d must not be negative", opt.window, opt.lines)
+	}
+	if opt.lines == 0 {
+		opt.lines = 1
+	}
+	t.dedup = &opt
+	return nil
+}
+
+// newDedupProcessor returns a processor that drops repeated lines from one log
+// before passing the rest on to llp.
+func newDedupProcessor(llp logline.Processor, clock clock.Clock, opt *dedupOption) *dedupProcessor {
+	return &dedupProcessor{
+		llp:    llp,
+		clock:  clock,
+		window: opt.window,
+		lines:  opt.lines,
+		passed: make(map[string]time.Time, opt.lines),
+	}
+}
+
+type dedupProcessor struct {
+	llp    logline.Processor
+	clock  clock.Clock
+	window time.Duration // How long a line is remembered after it is passed on, or zero for no limit.
+	lines  int           // The most distinct lines remembered.
+
+	mu     sync.Mutex
+	passed map[string]time.Time // The time each remembered line was passed on.
+	order  []string             // The remembered lines, oldest first.
+}
+
+func (p *dedupProcessor) ProcessLogLine(ctx context.Context, ll *logline.LogLine) {
+	if p.repeated(ll.Line) {
+		linesDeduplicated.Add(ll.Filename, 1)
+		return
+	}
+	p.llp.ProcessLogLine(ctx, ll)
+}
+
+// repeated returns whether line is a repeat of a remembered one, and
+// remembers it if not.  A line repeated after its window has passed is
+// passed on again, starting a new window, so a storm of repeats is still
+// seen once a window.
+func (p *dedupProcessor) repeated(line string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.clock.Now()
+	if t, ok := p.passed[line]; ok {
+		if p.window <= 0 || now.Sub(t) < p.window {
+			return true
+		}
+		p.forget(line)
+	}
+	if len(p.order) >= p.lines {
+		p.forget(p.order[0])
+	}
+	p.passed[line] = now
+	p.order = append(p.order, line)
+	return false
+}
+
+func (p *dedupProcessor) forget(line string) {
+	delete(p.passed, line)
+	for i, l := range p.order {
+		if l == line {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			return
+		}
+	}
+}
@@ -9,11 +9,13 @@ import (
 	"expvar"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unicode/utf8"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/logline"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
@@ -28,6 +30,8 @@ var (
 	logTruncs = expvar.NewMap("log_truncates_total")
 	// lineCount counts the numbre of lines read per log file
 	lineCount = expvar.NewMap("log_lines_total")
+	// byteCount counts the number of bytes read per log file
+	byteCount = expvar.NewMap("log_bytes_total")
 )
 
 // defaultReadTimeout is used to unblock reads from named pipes.  It is set on
@@ -37,13 +41,24 @@ const defaultReadTimeout = 50 * time.Millisecond
 // File provides an abstraction over files and named pipes being tailed
 // by `mtail`.
 type File struct {
-	name     string    // Given name for the file (possibly relative, used for display)
-	pathname string    // Full absolute path of the file used internally
-	lastRead time.Time // time of the last read received on this handle
-	regular  bool      // Remember if this is a regular file (or a pipe)
+	lastRead int64  // time of the last read received on this handle, in nanoseconds since the epoch; accessed atomically, so first for 64-bit alignment
+	skipTo   int64  // offset set by SkipBacklog to skip ahead to at the next read, or zero; accessed atomically
+	paused   int32  // nonzero while paused by PauseLogs; accessed atomically
+	name     string // Given name for the file (possibly relative, used for display)
+	pathname string // Full absolute path of the file used internally
+	regular  bool   // Remember if this is a regular file (or a pipe)
 	file     *os.File
 	partial  *bytes.Buffer
 	llp      logline.Processor // processor to receive LogLines
+	pos      linePosition      // position of the line being read
+	records  *records          // decoder of the binary records the file is made of, or nil if it is text
+	readTime time.Time         // time of the read in progress
+	skipLine bool              // set to drop the rest of the line skipped into by skipAhead
+
+	mu       sync.Mutex  // protects file and the parked state while reading
+	budget   *fdBudget   // Open file budget this file is counted in, if any.
+	parkedAt int64       // Offset the file was closed at by park.
+	parkedFi os.FileInfo // Identity of the file closed by park; nil if open.
 }
 
 // NewFile returns a new File named by the given pathname.  `seenBefore` indicates
@@ -52,7 +67,7 @@ type File struct {
 // should be tailed from offset 0, not EOF; the latter is true for rotated
 // files and for files opened when mtail is in oneshot mode.
 func NewFile(pathname, absPath string, llp logline.Processor, seekToStart bool) (*File, error) {
-	glog.V(2).Infof("file.New(%s, %v)", pathname, seekToStart)
+	logging.V(2).Infof("file.New(%s, %v)", pathname, seekToStart)
 	f, err := open(absPath, false)
 	if err != nil {
 		return nil, err
@@ -64,6 +79,7 @@ func NewFile(pathname, absPath string, llp logline.Processor, seekToStart bool)
 		return nil, errors.Wrapf(err, "Failed to stat %q", absPath)
 	}
 	regular := false
+	var start int64
 	switch m := fi.Mode(); {
 	case m.IsRegular():
 		regular = true
@@ -71,7 +87,7 @@ func NewFile(pathname, absPath string, llp logline.Processor, seekToStart bool)
 		if seekToStart {
 			seekWhence = io.SeekCurrent
 		}
-		if _, err := f.Seek(0, seekWhence); err != nil {
+		if start, err = f.Seek(0, seekWhence); err != nil {
 			return nil, errors.Wrapf(err, "Seek failed on %q", absPath)
 		}
 		// Named pipes are the same as far as we're concerned, but we can't seek them.
@@ -80,7 +96,7 @@ func NewFile(pathname, absPath string, llp logline.Processor, seekToStart bool)
 	default:
 		return nil, errors.Errorf("Can't open files with mode %v: %s", m&os.ModeType, absPath)
 	}
-	return &File{pathname, absPath, time.Now(), regular, f, bytes.NewBufferString(""), llp}, nil
+	return &File{name: pathname, pathname: absPath, lastRead: time.Now().UnixNano(), regular: regular, file: f, partial: bytes.NewBufferString(""), llp: llp, pos: linePosition{start: start}}, nil
 }
 
 func open(pathname string, seenBefore bool) (*os.File, error) {
@@ -98,7 +114,7 @@ Retry:
 	// TODO(jaq): Can we avoid the NONBLOCK open on fifos with a goroutine per file?
 	f, err := os.OpenFile(pathname, os.O_RDONLY|syscall.O_NONBLOCK, 0600)
 	if err != nil {
-		glog.V(2).Infof("Open failed with %v", err)
+		logging.V(2).Infof("Open failed with %v", err)
 		logErrors.Add(pathname, 1)
 		if shouldRetry() {
 			retries--
@@ -108,10 +124,10 @@ Retry:
 		}
 	}
 	if err != nil {
-		glog.Infof("open failed all retries, last error was %v", err)
+		logging.Infof("open failed all retries, last error was %v", err)
 		return nil, err
 	}
-	glog.V(2).Infof("open succeeded %s", pathname)
+	logging.V(2).Infof("open succeeded %s", pathname)
 	return f, nil
 }
 
@@ -119,9 +135,23 @@ Retry:
 func (f *File) Follow(ctx context.Context) error {
 	ctx, span := trace.StartSpan(ctx, "file.Follow")
 	defer span.End()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.parkedFi != nil {
+		// Reopening detects rotation while parked.
+		if err := f.unpark(); err != nil {
+			if os.IsNotExist(err) {
+				logging.Infof("Reopen failed on %q: %s", f.Pathname(), err)
+				return nil
+			}
+			return err
+		}
+		return f.read(ctx)
+	}
+	f.budget.touch(f)
 	s1, err := f.file.Stat()
 	if err != nil {
-		glog.V(1).Infof("Stat failed on %q: %s", f.name, err)
+		logging.V(1).Infof("Stat failed on %q: %s", f.name, err)
 		// We have a fd but it's invalid, handle as a rotation (delete/create)
 		err := f.doRotation(ctx)
 		if err != nil {
@@ -130,31 +160,31 @@ func (f *File) Follow(ctx context.Context) error {
 	}
 	s2, err := os.Stat(f.pathname)
 	if err != nil {
-		glog.Infof("Stat failed on %q: %s", f.Pathname(), err)
+		logging.Infof("Stat failed on %q: %s", f.Pathname(), err)
 		return nil
 	}
 	if !os.SameFile(s1, s2) {
-		glog.V(1).Infof("New inode detected for %s, treating as rotation", f.Pathname())
+		logging.V(1).Infof("New inode detected for %s, treating as rotation", f.Pathname())
 		err = f.doRotation(ctx)
 		if err != nil {
 			return err
 		}
 	} else {
-		glog.V(1).Infof("Path %s already being watched, and inode not changed.",
+		logging.V(1).Infof("Path %s already being watched, and inode not changed.",
 			f.Pathname())
 	}
 
-	glog.V(2).Info("doing the normal read")
-	return f.Read(ctx)
+	logging.V(2).Info("doing the normal read")
+	return f.read(ctx)
 }
 
 // doRotation reads the remaining content of the currently opened file, then reopens the new one.
 func (f *File) doRotation(ctx context.Context) error {
 	ctx, span := trace.StartSpan(ctx, "file.doRotation")
 	defer span.End()
-	glog.V(2).Info("doing the rotation flush read")
-	if err := f.Read(ctx); err != nil {
-		glog.Info(err)
+	logging.V(2).Info("doing the rotation flush read")
+	if err := f.read(ctx); err != nil {
+		logging.Info(err)
 	}
 	logRotations.Add(f.name, 1)
 	newFile, err := open(f.pathname, true /*seenBefore*/)
@@ -162,6 +192,10 @@ func (f *File) doRotation(ctx context.Context) error {
 		return err
 	}
 	f.file = newFile
+	f.pos.reset(0)
+	f.records.reset()
+	atomic.StoreInt64(&f.skipTo, 0)
+	f.skipLine = false
 	return nil
 }
 
@@ -172,30 +206,50 @@ func (f *File) doRotation(ctx context.Context) error {
 func (f *File) Read(ctx context.Context) error {
 	ctx, span := trace.StartSpan(ctx, "file.Read")
 	defer span.End()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.parkedFi != nil {
+		if err := f.unpark(); err != nil {
+			return err
+		}
+	} else {
+		f.budget.touch(f)
+	}
+	return f.read(ctx)
+}
+
+// read implements Read with f.mu held.
+func (f *File) read(ctx context.Context) error {
 	b := make([]byte, 0, 4096)
 	totalBytes := 0
 	// TODO(jaq): Set the deadline based on ctx.
 	for {
+		if f.isPaused() {
+			return nil
+		}
+		if f.regular && f.records.lines() {
+			f.skipAhead()
+		}
 		if err := f.file.SetReadDeadline(time.Now().Add(defaultReadTimeout)); err != nil {
-			glog.V(3).Infof("%s: %s", f.name, err)
+			logging.V(3).Infof("%s: %s", f.name, err)
 		}
 		n, err := f.file.Read(b[:cap(b)])
-		glog.V(2).Infof("Read count %v err %v", n, err)
+		logging.V(2).Infof("Read count %v err %v", n, err)
 		totalBytes += n
 		b = b[:n]
 
-		glog.V(3).Infof("Error: %T", err)
+		logging.V(3).Infof("Error: %T", err)
 		if err != nil {
-			glog.V(3).Infof("Err: %s", err)
+			logging.V(3).Infof("Err: %s", err)
 		}
 
 		// If this time we've read no bytes at all and then hit an EOF, and
 		// we're a regular file, check for truncation.
 		if err == io.EOF && totalBytes == 0 && f.regular {
-			glog.V(2).Info("EOF and read no bytes, suspected truncation.")
+			logging.V(2).Info("EOF and read no bytes, suspected truncation.")
 			truncated, terr := f.checkForTruncate(ctx)
 			if terr != nil {
-				glog.Infof("checkForTruncate returned with error '%v'", terr)
+				logging.Infof("checkForTruncate returned with error '%v'", terr)
 			}
 			if truncated {
 				// Try again: offset was greater than filesize and now we've seeked to start.
@@ -207,17 +261,37 @@ func (f *File) Read(ctx context.Context) error {
 			return io.EOF
 		}
 
-		var (
-			rune  rune
-			width int
-		)
-		for i := 0; i < len(b) && i < n; i += width {
-			rune, width = utf8.DecodeRune(b[i:])
-			switch {
-			case rune != '\n':
-				f.partial.WriteRune(rune)
-			default:
-				f.sendLine(ctx)
+		if n > 0 {
+			f.readTime = time.Now()
+			byteCount.Add(f.name, int64(n))
+			f.markWritten(int64(n))
+		}
+		if f.records != nil {
+			if f.skipLine {
+				b = f.skipRecordLine(b)
+			}
+			f.partial.Write(b)
+			f.sendRecords(ctx)
+		} else {
+			var (
+				rune  rune
+				width int
+			)
+			for i := 0; i < len(b) && i < n; i += width {
+				rune, width = utf8.DecodeRune(b[i:])
+				switch {
+				case rune != '\n':
+					f.partial.WriteRune(rune)
+					f.pos.read(width)
+				case f.skipLine:
+					logBytesShed.Add(f.name, int64(f.partial.Len()+width))
+					f.pos.read(width)
+					f.pos.skip()
+					f.partial.Reset()
+					f.skipLine = false
+				default:
+					f.sendLine(ctx, width)
+				}
 			}
 		}
 
@@ -225,22 +299,52 @@ func (f *File) Read(ctx context.Context) error {
 		if err != nil {
 			// Update the last read time if we were able to read anything.
 			if totalBytes > 0 {
-				glog.V(2).Infof("Read %d bytes this time, updating lastRead", totalBytes)
-				f.lastRead = time.Now()
+				logging.V(2).Infof("Read %d bytes this time, updating lastRead", totalBytes)
+				atomic.StoreInt64(&f.lastRead, time.Now().UnixNano())
 			}
-			glog.V(2).Infof("Done with read: %s", err)
+			logging.V(2).Infof("Done with read: %s", err)
 			return err
 		}
 	}
 }
 
-// sendLine sends the contents of the partial buffer off for processing.
-func (f *File) sendLine(ctx context.Context) {
+// markWritten records the size and modification time of a regular file
+// after a read of n bytes, so the lines read are known to have been written
+// by then.
+func (f *File) markWritten(n int64) {
+	if !f.regular {
+		return
+	}
+	// The n bytes just read follow those of the current line, or of the
+	// records not yet decoded.  While they're within the size last seen there
+	// is nothing new to learn of when they were written, so the file isn't
+	// stat'd for each read of a backlog.
+	readTo := f.pos.start + f.pos.pending + n
+	if f.records != nil {
+		readTo += int64(f.partial.Len())
+	}
+	if f.pos.writtenTo(readTo) {
+		return
+	}
+	fi, err := f.file.Stat()
+	if err != nil {
+		logging.V(2).Infof("%s: %s", f.name, err)
+		return
+	}
+	f.pos.written(fi.Size(), fi.ModTime())
+}
+
+// sendLine sends the contents of the partial buffer off for processing,
+// ended by a newline of width bytes.
+func (f *File) sendLine(ctx context.Context, width int) {
 	ctx, span := trace.StartSpan(ctx, "file.sendLine")
 	defer span.End()
-	f.llp.ProcessLogLine(ctx, logline.New(ctx, f.name, f.partial.String()))
+	ll := logline.New(ctx, f.name, f.partial.String())
+	f.pos.end(ll, width)
+	ll.IngestTime = f.readTime
+	f.llp.ProcessLogLine(ctx, ll)
 	lineCount.Add(f.name, 1)
-	glog.V(2).Info("Line sent")
+	logging.V(2).Info("Line sent")
 	// reset partial accumulator
 	f.partial.Reset()
 }
@@ -252,7 +356,7 @@ func (f *File) checkForTruncate(ctx context.Context) (bool, error) {
 	ctx, span := trace.StartSpan(ctx, "file.checkForTruncate")
 	defer span.End()
 	currentOffset, err := f.file.Seek(0, io.SeekCurrent)
-	glog.V(2).Infof("current seek position at %d", currentOffset)
+	logging.V(2).Infof("current seek position at %d", currentOffset)
 	if err != nil {
 		return false, err
 	}
@@ -262,39 +366,104 @@ func (f *File) checkForTruncate(ctx context.Context) (bool, error) {
 		return false, err
 	}
 
-	glog.V(2).Infof("File size is %d", fi.Size())
+	logging.V(2).Infof("File size is %d", fi.Size())
 	if currentOffset == 0 || fi.Size() >= currentOffset {
-		glog.V(2).Info("no truncate appears to have occurred")
+		logging.V(2).Info("no truncate appears to have occurred")
 		return false, nil
 	}
 
 	// We're about to lose all data because of the truncate so if there's
 	// anything in the buffer, send it out.
-	if f.partial.Len() > 0 {
-		f.sendLine(ctx)
-	}
+	f.flushPartial(ctx)
 
 	p, serr := f.file.Seek(0, io.SeekStart)
-	glog.V(2).Infof("Probably truncated.  Seeked to %d: %v", p, serr)
+	f.pos.reset(0)
+	f.records.reset()
+	atomic.StoreInt64(&f.skipTo, 0)
+	f.skipLine = false
+	logging.V(2).Infof("Probably truncated.  Seeked to %d: %v", p, serr)
 	logTruncs.Add(f.name, 1)
 	return true, serr
 }
 
 func (f *File) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.parkedFi != nil {
+		return os.Stat(f.pathname)
+	}
 	return f.file.Stat()
 }
 
 func (f *File) Close(ctx context.Context) error {
 	ctx, span := trace.StartSpan(ctx, "file.Close")
 	defer span.End()
-	if f.partial.Len() > 0 {
-		f.sendLine(ctx)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flushPartial(ctx)
+	if f.parkedFi != nil {
+		return nil
+	}
+	f.budget.remove(f)
+	return f.file.Close()
+}
+
+// park closes the descriptor of a regular file to save it for busier
+// files, remembering the offset to reopen it at.  Any partial line is kept.
+func (f *File) park() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.parkedFi != nil || !f.regular {
+		return nil
+	}
+	pos, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.Wrapf(err, "Seek failed on %q", f.pathname)
+	}
+	fi, err := f.file.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to stat %q", f.pathname)
 	}
+	f.budget.remove(f)
+	f.parkedAt, f.parkedFi = pos, fi
+	logging.V(1).Infof("Closing idle log %s at offset %d", f.pathname, pos)
 	return f.file.Close()
 }
 
+// unpark reopens a file closed by park at the offset it was closed at, or
+// from the start if the pathname now names a different file.  Lines
+// written to the old file after it was closed are lost.  f.mu must be held.
+func (f *File) unpark() error {
+	file, err := open(f.pathname, false)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "Failed to stat %q", f.pathname)
+	}
+	if os.SameFile(fi, f.parkedFi) {
+		// Truncation while closed is found by the next read.
+		if _, err := file.Seek(f.parkedAt, io.SeekStart); err != nil {
+			file.Close()
+			return errors.Wrapf(err, "Seek failed on %q", f.pathname)
+		}
+	} else {
+		logging.V(1).Infof("New inode detected for %s while closed, treating as rotation", f.pathname)
+		logRotations.Add(f.name, 1)
+		f.pos.reset(0)
+		f.records.reset()
+	}
+	logging.V(1).Infof("Reopened idle log %s", f.pathname)
+	f.file = file
+	f.parkedFi = nil
+	f.budget.touch(f)
+	return nil
+}
+
 func (f *File) LastReadTime() time.Time {
-	return f.lastRead
+	return time.Unix(0, atomic.LoadInt64(&f.lastRead))
 }
 
 func (f *File) Pathname() string {
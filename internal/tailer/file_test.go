@@ -11,8 +11,10 @@ import (
 	"path"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/record"
 	"github.com/google/mtail/internal/testutil"
 	"golang.org/x/sys/unix"
 )
@@ -66,9 +68,9 @@ func TestReadPartial(t *testing.T) {
 	}
 	llp.Wait()
 	expected := []*logline.LogLine{
-		{context.TODO(), logfile, "ohi"},
+		{Context: context.TODO(), Filename: logfile, Line: "ohi"},
 	}
-	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "Offset", "Number", "IngestTime", "WriteTime"))
 }
 
 func TestOpenRetries(t *testing.T) {
@@ -140,7 +142,154 @@ func TestOpenSocket(t *testing.T) {
 		t.Errorf("partial line not empty: %q", f.partial)
 	}
 	expected := []*logline.LogLine{
-		{context.TODO(), logsock, "adf"},
+		{Context: context.TODO(), Filename: logsock, Line: "adf"},
+	}
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "Offset", "Number", "IngestTime", "WriteTime"))
+}
+
+func TestSocketRecords(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	llp := NewStubProcessor()
+	logsock := filepath.Join(tmpDir, "sock")
+	s, err := NewSocket(logsock, logsock, llp)
+	testutil.FatalIfErr(t, err)
+	s.records = newRecords(record.Msgpack)
+
+	l, err := net.DialUnix("unixgram", nil, &net.UnixAddr{logsock, "unixgram"})
+	testutil.FatalIfErr(t, err)
+	// The maps {"a": 1} and {"a": 2}, the first split across datagrams.
+	for _, b := range []string{"\x81\xa1a", "\x01\x81\xa1a\x02"} {
+		_, err = l.Write([]byte(b))
+		testutil.FatalIfErr(t, err)
+	}
+	llp.Add(2)
+
+	testutil.FatalIfErr(t, s.Read(context.Background()))
+	llp.Wait()
+	expected := []*logline.LogLine{
+		{Filename: logsock, Line: `{"a":1}`, Fields: map[string]string{"a": "1"}, Offset: 0, Number: 1},
+		{Filename: logsock, Line: `{"a":2}`, Fields: map[string]string{"a": "2"}, Offset: 4, Number: 2},
+	}
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "IngestTime", "WriteTime"))
+}
+
+func TestReadLinePositions(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := path.Join(tmpDir, "t")
+	llp := NewStubProcessor()
+	fd := testutil.TestOpenFile(t, logfile)
+	defer fd.Close()
+	testutil.WriteString(t, fd, "ab\n")
+	// Opened at the end, so offsets continue from there.
+	f, err := NewFile(logfile, logfile, llp, false)
+	testutil.FatalIfErr(t, err)
+
+	llp.Add(3)
+	testutil.WriteString(t, fd, "cd\néf\n\ng")
+	if err := f.Read(context.Background()); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	llp.Wait()
+
+	// Truncation sends the partial line and starts counting again.
+	llp.Add(2)
+	testutil.FatalIfErr(t, fd.Truncate(0))
+	_, err = fd.Seek(0, 0)
+	testutil.FatalIfErr(t, err)
+	testutil.WriteString(t, fd, "xy\n")
+	if err := f.Read(context.Background()); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	llp.Wait()
+
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "cd", Offset: 3, Number: 1},
+		{Filename: logfile, Line: "éf", Offset: 6, Number: 2},
+		{Filename: logfile, Line: "", Offset: 10, Number: 3},
+		{Filename: logfile, Line: "g", Offset: 11, Number: 4},
+		{Filename: logfile, Line: "xy", Offset: 0, Number: 1},
+	}
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "IngestTime", "WriteTime"))
+}
+
+func TestReadIngestTime(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := path.Join(tmpDir, "t")
+	llp := NewStubProcessor()
+	fd := testutil.TestOpenFile(t, logfile)
+	defer fd.Close()
+	f, err := NewFile(logfile, logfile, llp, false)
+	testutil.FatalIfErr(t, err)
+
+	llp.Add(1)
+	testutil.WriteString(t, fd, "a\n")
+	before := time.Now()
+	if err := f.Read(context.Background()); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	after := time.Now()
+	llp.Wait()
+
+	if got := llp.result[0].IngestTime; got.Before(before) || got.After(after) {
+		t.Errorf("ingest time %s not between %s and %s", got, before, after)
+	}
+}
+
+func TestReadWriteTime(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := path.Join(tmpDir, "t")
+	llp := NewStubProcessor()
+	fd := testutil.TestOpenFile(t, logfile)
+	defer fd.Close()
+	f, err := NewFile(logfile, logfile, llp, false)
+	testutil.FatalIfErr(t, err)
+
+	llp.Add(1)
+	testutil.WriteString(t, fd, "a\n")
+	hourAgo := time.Now().Add(-time.Hour).Truncate(time.Second)
+	testutil.FatalIfErr(t, os.Chtimes(logfile, hourAgo, hourAgo))
+	if err := f.Read(context.Background()); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	llp.Wait()
+
+	if got := llp.result[0].WriteTime; !got.Equal(hourAgo) {
+		t.Errorf("write time %s, expected the modification time %s", got, hourAgo)
+	}
+}
+
+func TestLinePositionWriteTime(t *testing.T) {
+	t1 := time.Unix(100, 0)
+	t2 := time.Unix(200, 0)
+	p := linePosition{}
+	p.written(4, t1)
+	p.written(4, t2) // No further writes.
+	p.written(8, t2)
+	var got []time.Time
+	for i := 0; i < 5; i++ {
+		ll := &logline.LogLine{}
+		p.read(1)
+		p.end(ll, 1)
+		got = append(got, ll.WriteTime)
+	}
+	// Lines ending past the last write seen have no write time.
+	testutil.ExpectNoDiff(t, []time.Time{t1, t1, t2, t2, {}}, got)
+
+	p = linePosition{}
+	if p.writtenTo(0) {
+		t.Error("log with no writes seen is written")
+	}
+	p.written(8, t1)
+	if !p.writtenTo(8) || p.writtenTo(9) {
+		t.Error("log written to the wrong size")
 	}
-	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 }
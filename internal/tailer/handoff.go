@@ -0,0 +1,133 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"io"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/pkg/errors"
+)
+
+// LogOffset records how far a log file has been read, so that another mtail
+// process can resume reading it from the same place.
+type LogOffset struct {
+	Pathname string `json:"pathname"`
+	Offset   int64  `json:"offset"`
+	Dev      uint64 `json:"dev"` // Device and inode identify the file, as the pathname may have been rotated since.
+	Ino      uint64 `json:"ino"`
+}
+
+// ResumeOffsets sets the offsets to resume reading log files from, when they
+// are first opened, instead of their end.
+type ResumeOffsets []LogOffset
+
+func (opt ResumeOffsets) apply(t *Tailer) error {
+	t.resume = make(map[string]LogOffset, len(opt))
+	for _, o := range opt {
+		t.resume[o.Pathname] = o
+	}
+	return nil
+}
+
+// Suspend stops the Tailer reading logs, so that the offsets remain valid
+// while they are handed to another process.  Reading starts again when the
+// returned function is called.  Events processed while the Tailer is
+// suspended are dropped once it is closed.
+func (t *Tailer) Suspend() (resume func()) {
+	t.suspend <- struct{}{}
+	return t.unsuspend
+}
+
+// unsuspend gives up the token taken to read logs or to suspend the Tailer.
+func (t *Tailer) unsuspend() {
+	<-t.suspend
+}
+
+// Offsets returns the offsets the Tailer has read up to in each regular file.
+// The Tailer should be suspended first.
+func (t *Tailer) Offsets() []LogOffset {
+	t.handlesMu.RLock()
+	defer t.handlesMu.RUnlock()
+	var r []LogOffset
+	for _, l := range t.handles {
+		f, ok := l.(*File)
+		if !ok || !f.regular {
+			continue
+		}
+		o, err := f.offset()
+		if err != nil {
+			logging.Info(err)
+			continue
+		}
+		r = append(r, o)
+	}
+	return r
+}
+
+// resumeLog moves a newly opened log to the offset it was handed over at, if
+// there is one, and returns true if it did.
+func (t *Tailer) resumeLog(l Log) bool {
+	if t.resume == nil {
+		return false
+	}
+	o, ok := t.resume[l.Pathname()]
+	if !ok {
+		return false
+	}
+	delete(t.resume, l.Pathname())
+	f, ok := l.(*File)
+	if !ok || !f.regular {
+		return false
+	}
+	if err := f.resumeAt(o); err != nil {
+		logging.Infof("Not resuming %s: %s", l.Pathname(), err)
+		return false
+	}
+	return true
+}
+
+// offset returns the position in the file of the first byte not yet sent as
+// part of a line.
+func (f *File) offset() (LogOffset, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.parkedFi != nil {
+		o := LogOffset{Pathname: f.pathname, Offset: f.parkedAt - int64(f.partial.Len())}
+		o.Dev, o.Ino = fileID(f.parkedFi)
+		return o, nil
+	}
+	pos, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return LogOffset{}, errors.Wrapf(err, "Seek failed on %q", f.pathname)
+	}
+	fi, err := f.file.Stat()
+	if err != nil {
+		return LogOffset{}, errors.Wrapf(err, "Failed to stat %q", f.pathname)
+	}
+	o := LogOffset{Pathname: f.pathname, Offset: pos - int64(f.partial.Len())}
+	o.Dev, o.Ino = fileID(fi)
+	return o, nil
+}
+
+// resumeAt seeks the file to the offset o, if o describes this same file and
+// it has not since been truncated.
+func (f *File) resumeAt(o LogOffset) error {
+	fi, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	if dev, ino := fileID(fi); dev != o.Dev || ino != o.Ino {
+		return errors.Errorf("file has been replaced since offset was recorded")
+	}
+	if fi.Size() < o.Offset {
+		return errors.Errorf("file has been truncated since offset was recorded")
+	}
+	if _, err := f.file.Seek(o.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	f.pos.reset(o.Offset)
+	logging.Infof("Resuming %s at offset %d", f.pathname, o.Offset)
+	return nil
+}
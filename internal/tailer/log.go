@@ -10,7 +10,7 @@ import (
 	"path/filepath"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 
 	"github.com/google/mtail/internal/logline"
 )
@@ -25,12 +25,76 @@ type Log interface {
 	Pathname() string             // Return the filesystem full pathname of the log source.
 }
 
+// linePosition tracks the offset and number of the line being read from a
+// log, and when it was written, for its LogLine.
+type linePosition struct {
+	start   int64       // Offset of the start of the current line.
+	pending int64       // Bytes of the current line read so far.
+	number  int64       // Lines completed.
+	writes  []writeMark // Sizes the log had been written up to past the current line, oldest first.
+}
+
+// writeMark records that a log had been written up to size by its
+// modification time.
+type writeMark struct {
+	size int64
+	time time.Time
+}
+
+// read records width more bytes of the current line.
+func (p *linePosition) read(width int) {
+	p.pending += int64(width)
+}
+
+// end completes the current line, whose newline is width bytes, setting its
+// offset and number in ll.
+func (p *linePosition) end(ll *logline.LogLine, width int) {
+	p.number++
+	ll.Offset, ll.Number = p.start, p.number
+	p.start += p.pending + int64(width)
+	p.pending = 0
+	// The line was written by the time the log was first seen to be
+	// written past its end.
+	for len(p.writes) > 0 && p.writes[0].size < p.start {
+		p.writes = p.writes[1:]
+	}
+	if len(p.writes) > 0 {
+		ll.WriteTime = p.writes[0].time
+	}
+}
+
+// written records that the log had been written up to size by t.
+func (p *linePosition) written(size int64, t time.Time) {
+	if n := len(p.writes); n > 0 && p.writes[n-1].size >= size {
+		return
+	}
+	p.writes = append(p.writes, writeMark{size, t})
+}
+
+// writtenTo reports whether the log is already known to have been written up
+// to offset.
+func (p *linePosition) writtenTo(offset int64) bool {
+	n := len(p.writes)
+	return n > 0 && p.writes[n-1].size >= offset
+}
+
+// skip passes over the bytes read so far, which aren't part of a line.
+func (p *linePosition) skip() {
+	p.start += p.pending
+	p.pending = 0
+}
+
+// reset starts counting again from the start of a line at offset.
+func (p *linePosition) reset(offset int64) {
+	*p = linePosition{start: offset}
+}
+
 // NewLog returns an implementation of the Log interface that handles the given
 // pathname.  `llp' is a logline.Processor that receives the bytes when read by
 // Read().  `seekToStart' indicates that the log should be read from the
 // beginning if possible, for files opened when in OneShot mode.
 func NewLog(pathname string, llp logline.Processor, seekToStart bool) (Log, error) {
-	glog.V(2).Infof("tailer.NewLog(%s, %v)", pathname, seekToStart)
+	logging.V(2).Infof("tailer.NewLog(%s, %v)", pathname, seekToStart)
 	absPath, err := filepath.Abs(pathname)
 	if err != nil {
 		return nil, err
@@ -44,7 +108,7 @@ func NewLog(pathname string, llp logline.Processor, seekToStart bool) (Log, erro
 		return NewFile(pathname, absPath, llp, seekToStart)
 	case m&os.ModeType == os.ModeSocket:
 		if seekToStart {
-			glog.V(2).Infof("ignoring seekToStart=%v as %q is a socket", seekToStart, absPath)
+			logging.V(2).Infof("ignoring seekToStart=%v as %q is a socket", seekToStart, absPath)
 		}
 		return NewSocket(pathname, absPath, llp)
 	default:
@@ -0,0 +1,107 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// logLineRateDesc and logByteRateDesc describe how fast each log is growing,
+// so that noisy services can be found without writing a program for them.
+var (
+	logLineRateDesc = prometheus.NewDesc(
+		"mtail_log_lines_per_second",
+		"number of lines read per second from each log file, over the last log rate interval",
+		[]string{"logfile"}, nil)
+	logByteRateDesc = prometheus.NewDesc(
+		"mtail_log_bytes_per_second",
+		"number of bytes read per second from each log file, over the last log rate interval",
+		[]string{"logfile"}, nil)
+)
+
+// LogRateInterval sets how often the rates of lines and bytes read from each
+// log are measured.
+type LogRateInterval time.Duration
+
+func (opt LogRateInterval) apply(t *Tailer) error {
+	t.rateInterval = time.Duration(opt)
+	return nil
+}
+
+// rateSample is the count of lines and bytes read from a log at a time.
+type rateSample struct {
+	time         time.Time
+	lines, bytes int64
+}
+
+// logRate is how fast a log was read between two samples.
+type logRate struct {
+	lines, bytes float64
+}
+
+// sampleRates measures the rate each log has been read at since the last
+// sample.  A log is given a rate from its second sample on.
+func (t *Tailer) sampleRates() {
+	now := t.clock.Now()
+	names := make(map[string]struct{})
+	t.handlesMu.RLock()
+	for _, l := range t.handles {
+		names[l.Name()] = struct{}{}
+	}
+	t.handlesMu.RUnlock()
+
+	t.ratesMu.Lock()
+	defer t.ratesMu.Unlock()
+	samples := make(map[string]rateSample, len(names))
+	rates := make(map[string]logRate, len(names))
+	for name := range names {
+		s := rateSample{now, counter(lineCount, name), counter(byteCount, name)}
+		samples[name] = s
+		last, ok := t.rateSamples[name]
+		if !ok || !now.After(last.time) {
+			continue
+		}
+		elapsed := now.Sub(last.time).Seconds()
+		rates[name] = logRate{float64(s.lines-last.lines) / elapsed, float64(s.bytes-last.bytes) / elapsed}
+	}
+	t.rateSamples, t.rates = samples, rates
+}
+
+// collectRates reports the last rates measured of each log being tailed.
+func (t *Tailer) collectRates(c chan<- prometheus.Metric) {
+	t.ratesMu.Lock()
+	defer t.ratesMu.Unlock()
+	for name, r := range t.rates {
+		c <- prometheus.MustNewConstMetric(logLineRateDesc, prometheus.GaugeValue, r.lines, name)
+		c <- prometheus.MustNewConstMetric(logByteRateDesc, prometheus.GaugeValue, r.bytes, name)
+	}
+}
+
+// StartRateLoop runs a permanent goroutine to measure the rate each log is
+// read at every duration.
+func (t *Tailer) StartRateLoop(duration time.Duration) {
+	if duration <= 0 {
+		logging.Info("Log rate measurement disabled")
+		return
+	}
+	ticker := t.clock.NewTicker(duration)
+	t.sampleRates()
+	t.loops.Add(1)
+	go func() {
+		defer t.loops.Done()
+		logging.Infof("Starting log rate loop every %s", duration.String())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.ctx.Done():
+				return
+			case <-ticker.C():
+				t.sampleRates()
+			}
+		}
+	}()
+}
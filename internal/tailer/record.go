@@ -0,0 +1,215 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"io"
+	"path/filepath"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/record"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+var (
+	// recordErrors counts the records per log that couldn't be decoded.
+	recordErrors = expvar.NewMap("log_record_errors_total")
+)
+
+// RecordFormats sets the format of the binary records that the logs matching
+// each glob pattern are made of, instead of lines of text.
+type RecordFormats map[string]record.Format
+
+func (opt RecordFormats) apply(t *Tailer) error {
+	for pattern, f := range opt {
+		if f == nil {
+			return errors.Errorf("no record format for %q", pattern)
+		}
+		absPath, err := filepath.Abs(pattern)
+		if err != nil {
+			return err
+		}
+		t.globPatternsMu.Lock()
+		if t.recordFormats == nil {
+			t.recordFormats = make(map[string]record.Format)
+		}
+		t.recordFormats[absPath] = f
+		t.globPatternsMu.Unlock()
+	}
+	return nil
+}
+
+// recordFormatFor returns the record format of the longest pattern that
+// matches pathname, or nil if none do and the log is text.
+func (t *Tailer) recordFormatFor(pathname string) record.Format {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return nil
+	}
+	t.globPatternsMu.RLock()
+	defer t.globPatternsMu.RUnlock()
+	var (
+		r       record.Format
+		longest string
+	)
+	for pattern, f := range t.recordFormats {
+		if len(pattern) < len(longest) || (len(pattern) == len(longest) && pattern > longest) {
+			continue
+		}
+		matched, err := filepath.Match(pattern, absPath)
+		if err != nil {
+			logging.V(1).Info(err)
+			continue
+		}
+		if matched {
+			r, longest = f, pattern
+		}
+	}
+	return r
+}
+
+// newRecords returns the records of a log in format f, or nil if f is nil and
+// the log is text.
+func newRecords(f record.Format) *records {
+	if f == nil {
+		return nil
+	}
+	return &records{format: f}
+}
+
+// records decodes the binary records that a log is made of.
+type records struct {
+	format  record.Format
+	decoder record.Decoder // Made at the first read, and again after the log is rotated or truncated.
+}
+
+// lines reports whether the records are lines of text, which can be skipped
+// to shed load.  It is true of a nil records, for a text log.
+func (r *records) lines() bool {
+	return r == nil || record.Lines(r.format)
+}
+
+// reset starts decoding again from the start of a new log.  It is safe to
+// call on a nil records, for a text log.
+func (r *records) reset() {
+	if r != nil {
+		r.decoder = nil
+	}
+}
+
+// send sends each whole record in the partial buffer of the log name off to
+// process, keeping any incomplete one for the next read.  log is the file
+// being read, if it is one, for formats with a header.  Records that can't
+// be decoded are counted and skipped.  When the decoder can't find where
+// the next record starts, the buffer is dropped.
+func (r *records) send(ctx context.Context, name string, log io.ReaderAt, partial *bytes.Buffer, pos *linePosition, process func(*logline.LogLine)) {
+	ctx, span := trace.StartSpan(ctx, "records.send")
+	defer span.End()
+	if r.decoder == nil {
+		r.decoder = r.format.NewDecoder(log, pos.start)
+	}
+	for partial.Len() > 0 {
+		lines, n, err := r.decoder.Decode(partial.Bytes())
+		if err != nil {
+			if n == 0 {
+				logging.Warningf("%s: %s at offset %d; skipping %d bytes", name, err, pos.start, partial.Len())
+				n = partial.Len()
+			} else {
+				logging.V(1).Infof("%s: record at offset %d: %s", name, pos.start, err)
+			}
+			recordErrors.Add(name, 1)
+			pos.read(n)
+			partial.Next(n)
+			pos.end(&logline.LogLine{}, 0)
+			continue
+		}
+		if n == 0 {
+			return
+		}
+		partial.Next(n)
+		if len(lines) == 0 {
+			// A header, or a block of no records.
+			pos.read(n)
+			pos.skip()
+			continue
+		}
+		// The records of one block all start at its offset, which moves on
+		// past the block after the last of them.
+		for i, l := range lines {
+			ll := logline.New(ctx, name, l.Text)
+			ll.Fields = l.Fields
+			if i == len(lines)-1 {
+				pos.read(n)
+			}
+			pos.end(ll, 0)
+			process(ll)
+			lineCount.Add(name, 1)
+		}
+	}
+}
+
+// flush sends the last line in the partial buffer of the log name off to
+// process, if the log is of lines of text.  An incomplete binary record
+// can't be decoded, so is dropped.
+func (r *records) flush(ctx context.Context, name string, partial *bytes.Buffer, pos *linePosition, process func(*logline.LogLine)) {
+	if d, ok := r.decoder.(record.LineDecoder); ok {
+		l := d.DecodeLine(partial.String())
+		ll := logline.New(ctx, name, l.Text)
+		ll.Fields = l.Fields
+		pos.read(partial.Len())
+		pos.end(ll, 0)
+		process(ll)
+		lineCount.Add(name, 1)
+	} else {
+		logging.V(1).Infof("%s: dropping %d bytes of an incomplete record", name, partial.Len())
+		recordErrors.Add(name, 1)
+	}
+	partial.Reset()
+}
+
+// sendRecords sends each whole record in the partial buffer off for
+// processing.
+func (f *File) sendRecords(ctx context.Context) {
+	f.records.send(ctx, f.name, f.file, f.partial, &f.pos, f.processRecord(ctx))
+}
+
+// processRecord returns the function that sends a record off for processing.
+func (f *File) processRecord(ctx context.Context) func(*logline.LogLine) {
+	return func(ll *logline.LogLine) {
+		ll.IngestTime = f.readTime
+		f.llp.ProcessLogLine(ctx, ll)
+	}
+}
+
+// flushPartial sends the partial line off for processing, before the rest
+// of it is lost.  A partial binary record can't be decoded, so is dropped.
+func (f *File) flushPartial(ctx context.Context) {
+	if f.partial.Len() == 0 {
+		return
+	}
+	if f.records != nil {
+		f.records.flush(ctx, f.name, f.partial, &f.pos, f.processRecord(ctx))
+		return
+	}
+	f.sendLine(ctx, 0)
+}
+
+// sendRecords sends each whole record in the partial buffer off for
+// processing.  Records may be split across datagrams.
+func (s *Socket) sendRecords(ctx context.Context) {
+	s.records.send(ctx, s.name, nil, s.partial, &s.pos, s.processRecord(ctx))
+}
+
+// processRecord returns the function that sends a record off for processing.
+func (s *Socket) processRecord(ctx context.Context) func(*logline.LogLine) {
+	return func(ll *logline.LogLine) {
+		ll.IngestTime = s.readTime
+		s.llp.ProcessLogLine(ctx, ll)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/google/mtail/internal/logging"
+)
+
+var (
+	// logBytesShed counts the bytes of each log skipped unread to shed load.
+	logBytesShed = expvar.NewMap("log_bytes_shed_total")
+	// logsPaused records the number of logs not being read to shed load.
+	logsPaused = expvar.NewInt("logs_paused")
+)
+
+// PauseLogs stops the Tailer reading the logs matching any of the glob
+// patterns, including any read in progress and those opened later, until
+// ResumeLogs is called.
+func (t *Tailer) PauseLogs(patterns []string) {
+	t.handlesMu.Lock()
+	defer t.handlesMu.Unlock()
+	t.pausePatterns = patterns
+	for pathname, l := range t.handles {
+		t.pauseIfMatched(pathname, l)
+	}
+}
+
+// pauseIfMatched pauses the log l at pathname if it matches the patterns
+// given to PauseLogs.  t.handlesMu must be held.
+func (t *Tailer) pauseIfMatched(pathname string, l Log) {
+	f, ok := l.(*File)
+	if !ok || !matchesAny(t.pausePatterns, pathname) {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&f.paused, 0, 1) {
+		logsPaused.Add(1)
+		logging.Infof("Pausing %s to shed load", pathname)
+	}
+}
+
+// unpause stops counting the log l as paused, as it's no longer tailed.
+func unpause(l Log) {
+	if f, ok := l.(*File); ok && atomic.CompareAndSwapInt32(&f.paused, 1, 0) {
+		logsPaused.Add(-1)
+	}
+}
+
+// ResumeLogs reads the logs paused by PauseLogs from where they stopped, and
+// follows them again.
+func (t *Tailer) ResumeLogs() {
+	t.suspend <- struct{}{}
+	defer t.unsuspend()
+	t.handlesMu.Lock()
+	t.pausePatterns = nil
+	var resumed []*File
+	for _, l := range t.handles {
+		if f, ok := l.(*File); ok && atomic.CompareAndSwapInt32(&f.paused, 1, 0) {
+			logsPaused.Add(-1)
+			resumed = append(resumed, f)
+		}
+	}
+	t.handlesMu.Unlock()
+	for _, f := range resumed {
+		logging.Infof("Resuming %s", f.Pathname())
+		t.doFollow(t.ctx, f)
+	}
+}
+
+// SkipBacklog drops what has been written but not yet read of each regular
+// log of text, or of records that are lines of text, so the next read of each starts from where its end is now.  The
+// line the end falls in is dropped too.
+func (t *Tailer) SkipBacklog() {
+	t.handlesMu.RLock()
+	defer t.handlesMu.RUnlock()
+	for _, l := range t.handles {
+		f, ok := l.(*File)
+		if !ok || !f.regular || !f.records.lines() {
+			continue
+		}
+		fi, err := os.Stat(f.pathname)
+		if err != nil {
+			continue
+		}
+		atomic.StoreInt64(&f.skipTo, fi.Size())
+	}
+}
+
+// matchesAny reports whether pathname matches any of the glob patterns.
+func matchesAny(patterns []string, pathname string) bool {
+	for _, p := range patterns {
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+		if ok, err := filepath.Match(p, pathname); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isPaused reports whether the file is paused by PauseLogs.
+func (f *File) isPaused() bool {
+	return atomic.LoadInt32(&f.paused) != 0
+}
+
+// skipAhead moves the read offset of the file forward to the offset set by
+// SkipBacklog, if there is one, dropping the partial line read so far and
+// the bytes skipped, and the rest of the line skipped into unless the skip
+// ends at a newline.  f.mu must be held.
+func (f *File) skipAhead() {
+	to := atomic.SwapInt64(&f.skipTo, 0)
+	if to == 0 {
+		return
+	}
+	pos, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil || to <= pos {
+		return
+	}
+	if fi, err := f.file.Stat(); err != nil || fi.Size() < to {
+		// Truncated since; the next read finds out.
+		return
+	}
+	last := make([]byte, 1)
+	_, err = f.file.ReadAt(last, to-1)
+	atLineStart := err == nil && last[0] == '\n'
+	if _, err := f.file.Seek(to, io.SeekStart); err != nil {
+		logging.Infof("Seek failed on %q: %s", f.pathname, err)
+		return
+	}
+	logging.Infof("Skipped %d unread bytes of %s to shed load", to-pos, f.pathname)
+	logBytesShed.Add(f.name, to-pos+int64(f.partial.Len()))
+	f.partial.Reset()
+	f.pos = linePosition{start: to, number: f.pos.number}
+	f.skipLine = !atLineStart
+}
+
+// skipRecordLine drops the rest of the line skipped into by skipAhead from
+// the start of b, read from a log of records that are lines of text, and
+// returns what follows it.  f.mu must be held.
+func (f *File) skipRecordLine(b []byte) []byte {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		logBytesShed.Add(f.name, int64(len(b)))
+		f.pos.read(len(b))
+		return nil
+	}
+	logBytesShed.Add(f.name, int64(i+1))
+	f.pos.read(i + 1)
+	f.pos.skip()
+	f.skipLine = false
+	return b[i+1:]
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// logSilenceDesc describes the time since each log was last read, so that a
+// log that has stopped growing, such as that of a crashed service, can be
+// alerted on like any other metric.
+var logSilenceDesc = prometheus.NewDesc(
+	"mtail_log_seconds_since_last_read",
+	"number of seconds since bytes were last read from each log file, or since it was opened if never",
+	[]string{"logfile"}, nil)
+
+// Describe implements prometheus.Collector.
+func (t *Tailer) Describe(c chan<- *prometheus.Desc) {
+	c <- logSilenceDesc
+	c <- logLineRateDesc
+	c <- logByteRateDesc
+}
+
+// Collect implements prometheus.Collector, reporting the silence and the rate
+// of reading of each log being tailed.  Logs opened by more than one path
+// with the same name report the most recent read of any of them.
+func (t *Tailer) Collect(c chan<- prometheus.Metric) {
+	now := t.clock.Now()
+	last := make(map[string]time.Time)
+	t.handlesMu.RLock()
+	for _, l := range t.handles {
+		if r := l.LastReadTime(); r.After(last[l.Name()]) {
+			last[l.Name()] = r
+		}
+	}
+	t.handlesMu.RUnlock()
+	for name, r := range last {
+		c <- prometheus.MustNewConstMetric(logSilenceDesc, prometheus.GaugeValue, now.Sub(r).Seconds(), name)
+	}
+	t.collectRates(c)
+}
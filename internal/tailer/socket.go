@@ -7,37 +7,41 @@ import (
 	"bytes"
 	"context"
 	"net"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/logline"
 	"go.opencensus.io/trace"
 )
 
 // Socket provides an abstraction over unix sockets being tailed by `mtail'.
 type Socket struct {
+	lastRead int64 // nanoseconds since the epoch; accessed atomically, so first for 64-bit alignment
 	name     string
 	pathname string
-	lastRead time.Time
 	sock     net.Conn
 	partial  *bytes.Buffer
 	llp      logline.Processor
+	pos      linePosition
+	records  *records // decoder of the binary records the socket is sent, or nil if it is text
+	readTime time.Time
 }
 
 // NewSocket returns a new Socket named by the given pathname.
 // `llp' is a logline Processor that receivres the bytes when read by Read().
 func NewSocket(pathname, absPath string, llp logline.Processor) (*Socket, error) {
-	glog.V(2).Infof("tailer.NewSocket(%s)", absPath)
+	logging.V(2).Infof("tailer.NewSocket(%s)", absPath)
 	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{absPath, "unixgram"})
 	if err != nil {
 		return nil, err
 	}
-	return &Socket{pathname, absPath, time.Now(), c, bytes.NewBufferString(""), llp}, nil
+	return &Socket{name: pathname, pathname: absPath, lastRead: time.Now().UnixNano(), sock: c, partial: bytes.NewBufferString(""), llp: llp}, nil
 }
 
 func (s *Socket) LastReadTime() time.Time {
-	return s.lastRead
+	return time.Unix(0, atomic.LoadInt64(&s.lastRead))
 }
 
 func (s *Socket) Name() string {
@@ -52,7 +56,11 @@ func (s *Socket) Close(ctx context.Context) error {
 	ctx, span := trace.StartSpan(ctx, "Socket.Close")
 	defer span.End()
 	if s.partial.Len() > 0 {
-		s.sendLine(ctx)
+		if s.records != nil {
+			s.records.flush(ctx, s.name, s.partial, &s.pos, s.processRecord(ctx))
+		} else {
+			s.sendLine(ctx, 0)
+		}
 	}
 	return s.sock.Close()
 }
@@ -65,46 +73,61 @@ func (s *Socket) Read(ctx context.Context) error {
 	totalBytes := 0
 	for {
 		if err := s.sock.SetReadDeadline(time.Now().Add(1 * time.Second)); err != nil {
-			glog.V(2).Infof("%s: %s", s.pathname, err)
+			logging.V(2).Infof("%s: %s", s.pathname, err)
 		}
 		n, err := s.sock.Read(b[:cap(b)])
-		glog.V(2).Infof("read count %v err %v", n, err)
+		logging.V(2).Infof("read count %v err %v", n, err)
 		totalBytes += n
 		b = b[:n]
 
 		if err, ok := err.(net.Error); ok && err.Timeout() {
-			glog.Info("timeout, returning")
+			logging.Info("timeout, returning")
 			return nil
 		}
 
-		var (
-			rune  rune
-			width int
-		)
-		for i := 0; i < len(b) && i < n; i += width {
-			rune, width = utf8.DecodeRune(b[i:])
-			switch {
-			case rune != '\n':
-				s.partial.WriteRune(rune)
-			default:
-				glog.Infof("sendline")
-				s.sendLine(ctx)
+		if n > 0 {
+			s.readTime = time.Now()
+			byteCount.Add(s.name, int64(n))
+		}
+		if s.records != nil {
+			s.partial.Write(b)
+			s.sendRecords(ctx)
+		} else {
+			var (
+				rune  rune
+				width int
+			)
+			for i := 0; i < len(b) && i < n; i += width {
+				rune, width = utf8.DecodeRune(b[i:])
+				switch {
+				case rune != '\n':
+					s.partial.WriteRune(rune)
+					s.pos.read(width)
+				default:
+					logging.Infof("sendline")
+					s.sendLine(ctx, width)
+				}
 			}
 		}
 		if err != nil {
 			if totalBytes > 0 {
-				s.lastRead = time.Now()
+				atomic.StoreInt64(&s.lastRead, time.Now().UnixNano())
 			}
 			return err
 		}
 	}
 }
 
-func (s *Socket) sendLine(ctx context.Context) {
+// sendLine sends the contents of the partial buffer off for processing,
+// ended by a newline of width bytes.
+func (s *Socket) sendLine(ctx context.Context, width int) {
 	ctx, span := trace.StartSpan(ctx, "Socket.sendLine")
 	defer span.End()
-	glog.Infof("Sending a line %q", s.partial.String())
-	s.llp.ProcessLogLine(ctx, logline.New(ctx, s.name, s.partial.String()))
+	logging.Infof("Sending a line %q", s.partial.String())
+	ll := logline.New(ctx, s.name, s.partial.String())
+	s.pos.end(ll, width)
+	ll.IngestTime = s.readTime
+	s.llp.ProcessLogLine(ctx, ll)
 	lineCount.Add(s.name, 1)
 	s.partial.Reset()
 }
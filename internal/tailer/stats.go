@@ -0,0 +1,113 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+)
+
+// LogStats describes the state of a log being tailed.
+type LogStats struct {
+	Name     string `json:"name"`     // The name the log was given by.
+	Pathname string `json:"pathname"` // The absolute pathname of the log.
+	Type     string `json:"type"`     // One of file, pipe, or socket.
+	Open     bool   `json:"open"`     // False if closed to stay within the open file budget.
+
+	Offset int64  `json:"offset"` // How far the file has been read.
+	Size   int64  `json:"size"`   // The size of the file.
+	Dev    uint64 `json:"dev"`    // The device and inode of the file being read.
+	Ino    uint64 `json:"ino"`
+
+	Lines       int64     `json:"lines"`
+	Bytes       int64     `json:"bytes"`
+	Rotations   int64     `json:"rotations"`
+	Truncations int64     `json:"truncations"`
+	ReadErrors  int64     `json:"read_errors"`
+	LastRead    time.Time `json:"last_read"`
+}
+
+// counter returns the value of key in m, or zero.
+func counter(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// Stats returns the state of each log being tailed, ordered by name.
+func (t *Tailer) Stats() []LogStats {
+	t.handlesMu.RLock()
+	r := make([]LogStats, 0, len(t.handles))
+	for _, l := range t.handles {
+		s := LogStats{Name: l.Name(), Pathname: l.Pathname(), Type: "socket", Open: true, LastRead: l.LastReadTime()}
+		if f, ok := l.(*File); ok {
+			f.stats(&s)
+		}
+		s.Lines = counter(lineCount, s.Name)
+		s.Bytes = counter(byteCount, s.Name)
+		s.Rotations = counter(logRotations, s.Name)
+		s.Truncations = counter(logTruncs, s.Name)
+		// Errors opening a log are counted by its pathname.
+		s.ReadErrors = counter(logErrors, s.Pathname)
+		if s.Name != s.Pathname {
+			s.ReadErrors += counter(logErrors, s.Name)
+		}
+		r = append(r, s)
+	}
+	t.handlesMu.RUnlock()
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
+// stats fills in the state of the file in s.
+func (f *File) stats(s *LogStats) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s.Type = "pipe"
+	if f.regular {
+		s.Type = "file"
+	}
+	var (
+		fi  os.FileInfo
+		err error
+	)
+	if f.parkedFi != nil {
+		s.Open = false
+		s.Offset = f.parkedAt
+		fi = f.parkedFi
+	} else {
+		if f.regular {
+			if s.Offset, err = f.file.Seek(0, io.SeekCurrent); err != nil {
+				logging.V(1).Infof("Seek failed on %q: %s", f.pathname, err)
+			}
+		}
+		if fi, err = f.file.Stat(); err != nil {
+			logging.V(1).Infof("Failed to stat %q: %s", f.pathname, err)
+			return
+		}
+	}
+	s.Size = fi.Size()
+	s.Dev, s.Ino = fileID(fi)
+}
+
+// StatsHandler serves the state of each log being tailed as JSON.
+func (t *Tailer) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.MarshalIndent(t.Stats(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		logging.Warning(err)
+	}
+}
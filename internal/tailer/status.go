@@ -4,7 +4,6 @@
 package tailer
 
 import (
-	"expvar"
 	"html/template"
 	"io"
 )
@@ -21,18 +20,30 @@ const tailerTemplate = `
 <table border=1>
 <tr>
 <th>pathname</th>
+<th>type</th>
+<th>offset</th>
+<th>size</th>
+<th>inode</th>
 <th>errors</th>
 <th>rotations</th>
 <th>truncations</th>
 <th>lines read</th>
+<th>bytes read</th>
+<th>last read</th>
 </tr>
-{{range $name, $val := $.Handles}}
+{{range $.Logs}}
 <tr>
-<td><pre>{{$name}}</pre></td>
-<td>{{index $.Errors $name}}</td>
-<td>{{index $.Rotations $name}}</td>
-<td>{{index $.Truncs $name}}</td>
-<td>{{index $.Lines $name}}</td>
+<td><pre>{{.Name}}</pre></td>
+<td>{{.Type}}{{if not .Open}} (closed){{end}}</td>
+<td>{{.Offset}}</td>
+<td>{{.Size}}</td>
+<td>{{.Ino}}</td>
+<td>{{.ReadErrors}}</td>
+<td>{{.Rotations}}</td>
+<td>{{.Truncations}}</td>
+<td>{{.Lines}}</td>
+<td>{{.Bytes}}</td>
+<td>{{.LastRead}}</td>
 </tr>
 {{end}}
 </table>
@@ -45,37 +56,15 @@ func (t *Tailer) WriteStatusHTML(w io.Writer) error {
 	if err != nil {
 		return err
 	}
-	t.handlesMu.RLock()
-	defer t.handlesMu.RUnlock()
+	logs := t.Stats()
 	t.globPatternsMu.RLock()
 	defer t.globPatternsMu.RUnlock()
 	data := struct {
-		Handles   map[string]Log
-		Patterns  map[string]struct{}
-		Rotations map[string]string
-		Lines     map[string]string
-		Errors    map[string]string
-		Truncs    map[string]string
+		Logs     []LogStats
+		Patterns map[string]struct{}
 	}{
-		t.handles,
+		logs,
 		t.globPatterns,
-		make(map[string]string),
-		make(map[string]string),
-		make(map[string]string),
-		make(map[string]string),
-	}
-	for _, pair := range []struct {
-		v *expvar.Map
-		m map[string]string
-	}{
-		{logErrors, data.Errors},
-		{logRotations, data.Rotations},
-		{logTruncs, data.Truncs},
-		{lineCount, data.Lines},
-	} {
-		pair.v.Do(func(kv expvar.KeyValue) {
-			pair.m[kv.Key] = kv.Value.String()
-		})
 	}
 	return tpl.Execute(w, data)
 }
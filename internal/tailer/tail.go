@@ -19,15 +19,19 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/health"
 	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/record"
 	"github.com/google/mtail/internal/watcher"
 )
 
@@ -40,20 +44,48 @@ var (
 // lines from files. It also handles new log file creation events and log
 // rotations.
 type Tailer struct {
+	health health.Activity // records each file event processed, and kept first so it is 64-bit aligned
+
 	w   watcher.Watcher
-	ctx context.Context
 	llp logline.Processor
 
-	handlesMu sync.RWMutex   // protects `handles'
-	handles   map[string]Log // Log handles for each pathname.
+	ctx    context.Context    // Cancelled to stop the Tailer.
+	cancel context.CancelFunc // Cancels ctx.
+	loops  sync.WaitGroup     // The running gc and log pattern poll loops.
+
+	clock               clock.Clock   // Times the loops, and tells when logs are stale.
+	gcInterval          time.Duration // Time between stale log gc runs, if positive.
+	patternPollInterval time.Duration // Time between log pattern polls, if positive.
+	rateInterval        time.Duration // Time between measurements of the rates logs are read at, if positive.
+
+	handlesMu     sync.RWMutex   // protects `handles' and `pausePatterns'
+	handles       map[string]Log // Log handles for each pathname.
+	pausePatterns []string       // glob patterns of the logs paused by PauseLogs, including those opened since
 
 	globPatternsMu     sync.RWMutex        // protects `globPatterns'
 	globPatterns       map[string]struct{} // glob patterns to match newly created logs in dir paths against
 	ignoreRegexPattern *regexp.Regexp
+	pollIntervals      map[string]time.Duration  // poll intervals for paths matching glob patterns, protected by globPatternsMu
+	locations          map[string]*time.Location // timezones for paths matching glob patterns, protected by globPatternsMu
+	recordFormats      map[string]record.Format  // binary record formats for paths matching glob patterns, protected by globPatternsMu
+
+	budget *fdBudget // limits the open regular files, if set
+
+	dedup *dedupOption // drops repeated lines from each log, if set
+
+	ratesMu     sync.Mutex            // protects `rateSamples' and `rates'
+	rateSamples map[string]rateSample // the last sample of each log's lines and bytes read
+	rates       map[string]logRate    // the rate each log was read at up to the last sample
+
+	binarySkippedMu sync.Mutex          // protects `binarySkipped'
+	binarySkipped   map[string]struct{} // pathnames not tailed because they look binary
 
 	oneShot bool
 
 	pollMu sync.Mutex // protects Poll()
+
+	suspend chan struct{}        // holds a token while reading logs, or while suspended
+	resume  map[string]LogOffset // offsets to resume logs from when first opened
 }
 
 // Option configures a new Tailer.
@@ -96,7 +128,7 @@ func (opt IgnoreRegex) apply(t *Tailer) error {
 type StaleLogGcTickInterval time.Duration
 
 func (opt StaleLogGcTickInterval) apply(t *Tailer) error {
-	t.StartGcLoop(time.Duration(opt))
+	t.gcInterval = time.Duration(opt)
 	return nil
 }
 
@@ -104,25 +136,76 @@ func (opt StaleLogGcTickInterval) apply(t *Tailer) error {
 type LogPatternPollTickInterval time.Duration
 
 func (opt LogPatternPollTickInterval) apply(t *Tailer) error {
-	t.StartLogPatternPollLoop(time.Duration(opt))
+	t.patternPollInterval = time.Duration(opt)
 	return nil
 }
 
-// New creates a new Tailer.
+// Clock sets the clock the tailer's loops run by, instead of the system clock.
+func Clock(c clock.Clock) Option {
+	return clockOption{c}
+}
+
+type clockOption struct {
+	c clock.Clock
+}
+
+func (opt clockOption) apply(t *Tailer) error {
+	t.clock = opt.c
+	return nil
+}
+
+// PollIntervals sets how often the watcher polls the logs matching each glob
+// pattern, overriding its poll interval.
+type PollIntervals map[string]time.Duration
+
+func (opt PollIntervals) apply(t *Tailer) error {
+	for pattern, interval := range opt {
+		if interval <= 0 {
+			return errors.Errorf("poll interval for %q must be positive", pattern)
+		}
+		absPath, err := filepath.Abs(pattern)
+		if err != nil {
+			return err
+		}
+		t.globPatternsMu.Lock()
+		if t.pollIntervals == nil {
+			t.pollIntervals = make(map[string]time.Duration)
+		}
+		t.pollIntervals[absPath] = interval
+		t.globPatternsMu.Unlock()
+	}
+	return nil
+}
+
+// New creates a new Tailer.  The Tailer stops when ctx is cancelled, or when
+// closed.
 func New(ctx context.Context, llp logline.Processor, w watcher.Watcher, options ...Option) (*Tailer, error) {
 	if w == nil {
 		return nil, errors.New("can't create tailer without W")
 	}
 	t := &Tailer{
-		ctx:          ctx,
 		w:            w,
 		llp:          llp,
 		handles:      make(map[string]Log),
 		globPatterns: make(map[string]struct{}),
+		clock:        clock.Real,
+		suspend:      make(chan struct{}, 1),
 	}
+	t.ctx, t.cancel = context.WithCancel(ctx)
 	if err := t.SetOption(options...); err != nil {
+		t.cancel()
 		return nil, err
 	}
+	// The loops start once every option, including the clock, is set.
+	if t.gcInterval > 0 {
+		t.StartGcLoop(t.gcInterval)
+	}
+	if t.patternPollInterval > 0 {
+		t.StartLogPatternPollLoop(t.patternPollInterval)
+	}
+	if t.rateInterval > 0 {
+		t.StartRateLoop(t.rateInterval)
+	}
 	return t, nil
 }
 
@@ -144,7 +227,11 @@ func (t *Tailer) setHandle(pathname string, f Log) error {
 	}
 	t.handlesMu.Lock()
 	defer t.handlesMu.Unlock()
+	if old, ok := t.handles[absPath]; ok && old != f {
+		unpause(old)
+	}
 	t.handles[absPath] = f
+	t.pauseIfMatched(absPath, f)
 	return nil
 }
 
@@ -152,7 +239,7 @@ func (t *Tailer) setHandle(pathname string, f Log) error {
 func (t *Tailer) handleForPath(pathname string) (Log, bool) {
 	absPath, err := filepath.Abs(pathname)
 	if err != nil {
-		glog.V(2).Infof("Couldn't resolve path %q: %s", pathname, err)
+		logging.V(2).Infof("Couldn't resolve path %q: %s", pathname, err)
 		return nil, false
 	}
 	t.handlesMu.Lock()
@@ -170,16 +257,106 @@ func (t *Tailer) hasHandle(pathname string) bool {
 func (t *Tailer) AddPattern(pattern string) error {
 	absPath, err := filepath.Abs(pattern)
 	if err != nil {
-		glog.V(2).Infof("Couldn't canonicalize path %q: %s", pattern, err)
+		logging.V(2).Infof("Couldn't canonicalize path %q: %s", pattern, err)
 		return err
 	}
-	glog.V(2).Infof("AddPattern: %s", absPath)
+	logging.V(2).Infof("AddPattern: %s", absPath)
 	t.globPatternsMu.Lock()
 	t.globPatterns[absPath] = struct{}{}
 	t.globPatternsMu.Unlock()
 	return nil
 }
 
+// ErrNoMatches is returned by TailPattern when no file matches the pattern
+// yet.  The pattern is still tailed, so matching files are picked up when
+// they are created.
+var ErrNoMatches = errors.New("no matches")
+
+// RemovePattern stops tailing the logs matched by a pattern added by
+// AddPattern or TailPattern, unless they match another pattern, and removes
+// the watches on their directories that nothing else needs.
+func (t *Tailer) RemovePattern(pattern string) error {
+	absPath, err := filepath.Abs(pattern)
+	if err != nil {
+		return err
+	}
+	t.globPatternsMu.Lock()
+	if _, ok := t.globPatterns[absPath]; !ok {
+		t.globPatternsMu.Unlock()
+		return errors.Errorf("not tailing pattern %q", pattern)
+	}
+	delete(t.globPatterns, absPath)
+	remaining := make([]string, 0, len(t.globPatterns))
+	for p := range t.globPatterns {
+		remaining = append(remaining, p)
+	}
+	t.globPatternsMu.Unlock()
+	logging.V(1).Infof("RemovePattern: %s", absPath)
+
+	matchesAny := func(pathname string) bool {
+		for _, p := range remaining {
+			if matched, _ := filepath.Match(p, pathname); matched {
+				return true
+			}
+		}
+		return false
+	}
+	var removed []string
+	dirs := map[string]struct{}{t.watchedDirname(absPath): {}}
+	needed := make(map[string]struct{})
+	t.handlesMu.RLock()
+	for pathname := range t.handles {
+		if matched, _ := filepath.Match(absPath, pathname); matched && !matchesAny(pathname) {
+			removed = append(removed, pathname)
+			dirs[filepath.Dir(pathname)] = struct{}{}
+		} else {
+			needed[filepath.Dir(pathname)] = struct{}{}
+		}
+	}
+	t.handlesMu.RUnlock()
+	for _, p := range remaining {
+		needed[t.watchedDirname(p)] = struct{}{}
+	}
+	for _, pathname := range removed {
+		if err := t.UnTailPath(pathname); err != nil {
+			logging.Info(err)
+		}
+	}
+	for d := range dirs {
+		if _, ok := needed[d]; ok {
+			continue
+		}
+		if err := t.w.Unobserve(d, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Patterns returns the glob patterns being tailed, in order.
+func (t *Tailer) Patterns() []string {
+	t.globPatternsMu.RLock()
+	defer t.globPatternsMu.RUnlock()
+	r := make([]string, 0, len(t.globPatterns))
+	for p := range t.globPatterns {
+		r = append(r, p)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// Logs returns the pathnames of the logs being tailed, in order.
+func (t *Tailer) Logs() []string {
+	t.handlesMu.RLock()
+	defer t.handlesMu.RUnlock()
+	r := make([]string, 0, len(t.handles))
+	for p := range t.handles {
+		r = append(r, p)
+	}
+	sort.Strings(r)
+	return r
+}
+
 // TailPattern registers a pattern to be tailed.  If pattern is a plain
 // file then it is watched for updates and opened.  If pattern is a glob, then
 // all paths that match the glob are opened and watched, and the directories
@@ -197,10 +374,10 @@ func (t *Tailer) TailPattern(pattern string) error {
 	if err != nil {
 		return err
 	}
-	glog.V(1).Infof("glob matches: %v", matches)
+	logging.V(1).Infof("glob matches: %v", matches)
 	// Error if there are no matches, but if they show up later, they'll get picked up by the directory watch set above.
 	if len(matches) == 0 {
-		return errors.Errorf("No matches for pattern %q", pattern)
+		return errors.Wrapf(ErrNoMatches, "pattern %q", pattern)
 	}
 	for _, pathname := range matches {
 		ignore, err := t.Ignore(pathname)
@@ -229,20 +406,27 @@ func (t *Tailer) Ignore(pathname string) (bool, error) {
 	}
 	if fi.Mode().IsDir() {
 		// do directory stuff
-		glog.V(2).Infof("ignore path %q because it is a folder", pathname)
+		logging.V(2).Infof("ignore path %q because it is a folder", pathname)
 		return true, nil
 	}
-	return t.ignoreRegexPattern != nil && t.ignoreRegexPattern.MatchString(fi.Name()), nil
+	if t.ignoreRegexPattern != nil && t.ignoreRegexPattern.MatchString(fi.Name()) {
+		return true, nil
+	}
+	if t.recordFormatFor(absPath) == nil && isBinary(absPath, fi) {
+		t.skipBinary(absPath)
+		return true, nil
+	}
+	return false, nil
 }
 
 func (t *Tailer) SetIgnorePattern(pattern string) error {
 	if len(pattern) == 0 {
 		return nil
 	}
-	glog.V(2).Infof("Set filename ignore regex pattern %q", pattern)
+	logging.V(2).Infof("Set filename ignore regex pattern %q", pattern)
 	ignoreRegexPattern, err := regexp.Compile(pattern)
 	if err != nil {
-		glog.V(2).Infof("Couldn't compile regex %q: %s", pattern, err)
+		logging.V(2).Infof("Couldn't compile regex %q: %s", pattern, err)
 		fmt.Println(fmt.Sprintf("error: %v", err))
 		return err
 	}
@@ -253,16 +437,41 @@ func (t *Tailer) SetIgnorePattern(pattern string) error {
 // TailPath registers a filesystem pathname to be tailed.
 func (t *Tailer) TailPath(pathname string) error {
 	if t.hasHandle(pathname) {
-		glog.V(2).Infof("already watching %q", pathname)
+		logging.V(2).Infof("already watching %q", pathname)
 		return nil
 	}
-	if err := t.w.Observe(pathname, t); err != nil {
+	if err := t.observe(pathname); err != nil {
 		return err
 	}
 	// New file at start of program, seek to EOF.
 	return t.openLogPath(pathname, false)
 }
 
+// UnTailPath stops tailing a log, closing it and removing its watch.
+func (t *Tailer) UnTailPath(pathname string) error {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return err
+	}
+	// Wait for any read of the log in progress.
+	t.suspend <- struct{}{}
+	defer t.unsuspend()
+	t.handlesMu.Lock()
+	fd, ok := t.handles[absPath]
+	delete(t.handles, absPath)
+	t.handlesMu.Unlock()
+	if !ok {
+		return errors.Errorf("not tailing %q", pathname)
+	}
+	unpause(fd)
+	if err := t.w.Unobserve(fd.Pathname(), t); err != nil {
+		logging.Info(err)
+	}
+	logging.Infof("No longer tailing %s", fd.Pathname())
+	logCount.Add(-1)
+	return fd.Close(t.ctx)
+}
+
 // ProcessFileEvent is dispatched when an Event is received, causing the tailer
 // to read all available bytes from an already-opened file and send each log
 // line to the logline.Processor.  Because we handle rotations and truncates when
@@ -271,9 +480,23 @@ func (t *Tailer) TailPath(pathname string) error {
 func (t *Tailer) ProcessFileEvent(ctx context.Context, event watcher.Event) {
 	ctx, span := trace.StartSpan(ctx, "Tailer.ProcessFileEvent")
 	defer span.End()
+	// Events may still be sent while the watcher shuts down.
+	if t.ctx.Err() != nil {
+		return
+	}
+	t.health.Start()
+	defer t.health.Done()
+	// A Tailer suspended for a handoff is closed rather than resumed, so
+	// don't wait on it past then.
+	select {
+	case t.suspend <- struct{}{}:
+		defer t.unsuspend()
+	case <-t.ctx.Done():
+		return
+	}
 	fd, ok := t.handleForPath(event.Pathname)
 	if !ok {
-		glog.V(1).Infof("No file handle found for %q, but is being watched", event.Pathname)
+		logging.V(1).Infof("No file handle found for %q, but is being watched", event.Pathname)
 		// We want to open files we have watches on in case the file was
 		// unreadable before now; but we have to copmare against the glob to be
 		// sure we don't just add all the files in a watched directory as they
@@ -283,36 +506,97 @@ func (t *Tailer) ProcessFileEvent(ctx context.Context, event watcher.Event) {
 		if !ok {
 			// This usually happens when a non-watched file in the same directory as a watched file gets updated.
 			// TODO(jaq): add a unit test for this.
-			glog.V(2).Infof("Internal error finding file handle for %q after create", event.Pathname)
+			logging.V(2).Infof("Internal error finding file handle for %q after create", event.Pathname)
 			return
 		}
 	}
-	doFollow(ctx, fd)
+	if f, ok := fd.(*File); ok && f.isPaused() {
+		logging.V(2).Infof("Not reading %s while paused", event.Pathname)
+		return
+	}
+	t.doFollow(ctx, fd)
+	t.budget.enforce()
 }
 
 // doFollow performs the Follow on an existing file descriptor, logging any errors
-func doFollow(ctx context.Context, fd Log) {
+func (t *Tailer) doFollow(ctx context.Context, fd Log) {
 	err := fd.Follow(ctx)
 	if err != nil && err != io.EOF {
-		glog.Info(err)
+		t.health.Error()
+		logging.Info(err)
 	}
 }
 
 // watchDirname adds the directory containing a path to be watched.
 func (t *Tailer) watchDirname(pathname string) error {
-	glog.V(3).Infof("watchDirname: %s", pathname)
+	logging.V(3).Infof("watchDirname: %s", pathname)
 	absPath, err := filepath.Abs(pathname)
 	if err != nil {
 		return err
 	}
+	d := t.watchedDirname(absPath)
+	if d == "/" {
+		logging.Infof("at root after recursing, won't observe %s", absPath)
+		return nil
+	}
+	return t.observe(d)
+}
+
+// watchedDirname returns the directory watched for an absolute pathname or
+// pattern: the nearest ancestor without glob metacharacters.
+func (t *Tailer) watchedDirname(absPath string) string {
 	d := filepath.Dir(absPath)
 	for ; t.HasMeta(d); d = filepath.Dir(d) {
 	}
-	if d == "/" {
-		glog.Infof("at root after recursing, won't observe %s", absPath)
+	return d
+}
+
+// observe asks the watcher to observe pathname, at the poll interval of any
+// patterns it matches.
+func (t *Tailer) observe(pathname string) error {
+	if err := t.w.Observe(pathname, t); err != nil {
+		return err
+	}
+	interval := t.pollIntervalFor(pathname)
+	if interval == 0 {
+		return nil
+	}
+	s, ok := t.w.(watcher.PollIntervalSetter)
+	if !ok {
+		logging.V(1).Infof("Watcher can't change the poll interval of %s", pathname)
 		return nil
 	}
-	return t.w.Observe(d, t)
+	if err := s.SetPollInterval(pathname, interval); err != nil {
+		logging.Info(err)
+	}
+	return nil
+}
+
+// pollIntervalFor returns the shortest poll interval of the patterns that
+// match pathname, or that pathname is the watched directory of, or zero if
+// there are none.
+func (t *Tailer) pollIntervalFor(pathname string) time.Duration {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return 0
+	}
+	t.globPatternsMu.RLock()
+	defer t.globPatternsMu.RUnlock()
+	var r time.Duration
+	for pattern, interval := range t.pollIntervals {
+		if r != 0 && interval >= r {
+			continue
+		}
+		matched, err := filepath.Match(pattern, absPath)
+		if err != nil {
+			logging.V(1).Info(err)
+			continue
+		}
+		if matched || t.watchedDirname(pattern) == absPath {
+			r = interval
+		}
+	}
+	return r
 }
 
 func (t *Tailer) HasMeta(path string) bool {
@@ -325,22 +609,40 @@ func (t *Tailer) HasMeta(path string) bool {
 
 // openLogPath opens a log file named by pathname.
 func (t *Tailer) openLogPath(pathname string, seekToStart bool) error {
-	glog.V(2).Infof("openlogPath %s %v", pathname, seekToStart)
+	logging.V(2).Infof("openlogPath %s %v", pathname, seekToStart)
 	if err := t.watchDirname(pathname); err != nil {
 		return err
 	}
-	f, err := NewLog(pathname, t.llp, seekToStart || t.oneShot)
+	llp := t.llp
+	if t.dedup != nil {
+		llp = newDedupProcessor(llp, t.clock, t.dedup)
+	}
+	if loc := t.locationFor(pathname); loc != nil {
+		llp = &locatedProcessor{llp, loc}
+	}
+	f, err := NewLog(pathname, llp, seekToStart || t.oneShot)
 	if err != nil {
 		// Doesn't exist yet. We're watching the directory, so we'll pick it up
 		// again on create; return successfully.
 		if os.IsNotExist(err) {
-			glog.V(1).Infof("pathname %q doesn't exist (yet?)", pathname)
+			logging.V(1).Infof("pathname %q doesn't exist (yet?)", pathname)
 			return nil
 		}
 		return err
 	}
-	glog.V(2).Infof("Adding a file watch on %q", f.Pathname())
-	if err := t.w.Observe(f.Pathname(), t); err != nil {
+	if s, ok := f.(*Socket); ok {
+		s.records = newRecords(t.recordFormatFor(pathname))
+	}
+	if lf, ok := f.(*File); ok {
+		lf.records = newRecords(t.recordFormatFor(pathname))
+		if lf.regular && t.budget != nil {
+			lf.budget = t.budget
+			t.budget.touch(lf)
+		}
+	}
+	resumed := t.resumeLog(f)
+	logging.V(2).Infof("Adding a file watch on %q", f.Pathname())
+	if err := t.observe(f.Pathname()); err != nil {
 		return err
 	}
 	if err := t.setHandle(pathname, f); err != nil {
@@ -351,13 +653,20 @@ func (t *Tailer) openLogPath(pathname string, seekToStart bool) error {
 	// don't have EOFs and files that update continuously can block Read from
 	// termination.
 	if t.oneShot {
-		glog.V(2).Infof("Starting oneshot read at startup of %q", f.Pathname())
+		logging.V(2).Infof("Starting oneshot read at startup of %q", f.Pathname())
+		if err := f.Read(t.ctx); err != nil && err != io.EOF {
+			return err
+		}
+	} else if resumed {
+		// Catch up on lines written during the handoff, which won't be
+		// announced by the watcher if the file doesn't change again.
 		if err := f.Read(t.ctx); err != nil && err != io.EOF {
 			return err
 		}
 	}
-	glog.Infof("Tailing %s", f.Pathname())
+	logging.Infof("Tailing %s", f.Pathname())
 	logCount.Add(1)
+	t.budget.enforce()
 	return nil
 }
 
@@ -371,36 +680,39 @@ func (t *Tailer) handleCreateGlob(ctx context.Context, pathname string) {
 	for pattern := range t.globPatterns {
 		matched, err := filepath.Match(pattern, pathname)
 		if err != nil {
-			glog.Warningf("Unexpected bad pattern %q not detected earlier", pattern)
+			logging.Warningf("Unexpected bad pattern %q not detected earlier", pattern)
 			continue
 		}
 		if !matched {
-			glog.V(2).Infof("%q did not match pattern %q", pathname, pattern)
+			logging.V(2).Infof("%q did not match pattern %q", pathname, pattern)
 			continue
 		}
 		ignore, err := t.Ignore(pathname)
 		if err != nil {
-			glog.Warningf("Unexpected bad pathname %q", pathname)
+			logging.Warningf("Unexpected bad pathname %q", pathname)
 			continue
 		}
 		if ignore {
-			glog.V(2).Infof("%q is ignored", pathname)
+			logging.V(2).Infof("%q is ignored", pathname)
 			continue
 		}
-		glog.V(1).Infof("New file %q matched existing glob %q", pathname, pattern)
+		logging.V(1).Infof("New file %q matched existing glob %q", pathname, pattern)
 		// If this file was just created, read from the start of the file.
 		if err := t.openLogPath(pathname, true); err != nil {
-			glog.Infof("Failed to tail new file %q: %s", pathname, err)
+			logging.Infof("Failed to tail new file %q: %s", pathname, err)
 			continue
 		}
-		glog.V(2).Infof("started tailing %q", pathname)
+		logging.V(2).Infof("started tailing %q", pathname)
 		return
 	}
-	glog.V(2).Infof("did not start tailing %q", pathname)
+	logging.V(2).Infof("did not start tailing %q", pathname)
 }
 
-// Close signals termination to the watcher.
+// Close stops the Tailer's loops, waiting for them to finish, and signals
+// termination to the watcher.
 func (t *Tailer) Close() error {
+	t.cancel()
+	t.loops.Wait()
 	if err := t.w.Close(); err != nil {
 		return err
 	}
@@ -412,13 +724,14 @@ func (t *Tailer) Gc() error {
 	t.handlesMu.Lock()
 	defer t.handlesMu.Unlock()
 	for k, v := range t.handles {
-		if time.Since(v.LastReadTime()) > (time.Hour * 24) {
+		if t.clock.Now().Sub(v.LastReadTime()) > (time.Hour * 24) {
 			if err := t.w.Unobserve(v.Pathname(), t); err != nil {
-				glog.Info(err)
+				logging.Info(err)
 			}
 			if err := v.Close(t.ctx); err != nil {
-				glog.Info(err)
+				logging.Info(err)
 			}
+			unpause(v)
 			delete(t.handles, k)
 		}
 	}
@@ -428,20 +741,24 @@ func (t *Tailer) Gc() error {
 // StartExpiryLoop runs a permanent goroutine to expire metrics every duration.
 func (t *Tailer) StartGcLoop(duration time.Duration) {
 	if duration <= 0 {
-		glog.Info("Log handle expiration disabled")
+		logging.Info("Log handle expiration disabled")
 		return
 	}
+	// The ticker is made before the loop starts, so the loop can't miss the
+	// first tick.
+	ticker := t.clock.NewTicker(duration)
+	t.loops.Add(1)
 	go func() {
-		glog.Infof("Starting log handle expiry loop every %s", duration.String())
-		ticker := time.NewTicker(duration)
+		defer t.loops.Done()
+		logging.Infof("Starting log handle expiry loop every %s", duration.String())
 		defer ticker.Stop()
 		for {
 			select {
 			case <-t.ctx.Done():
 				return
-			case <-ticker.C:
+			case <-ticker.C():
 				if err := t.Gc(); err != nil {
-					glog.Info(err)
+					logging.Info(err)
 				}
 			}
 		}
@@ -451,20 +768,23 @@ func (t *Tailer) StartGcLoop(duration time.Duration) {
 // StartLogPatternPollLoop runs a permanent goroutine to poll for new log files.
 func (t *Tailer) StartLogPatternPollLoop(duration time.Duration) {
 	if duration <= 0 {
-		glog.Info("Log pattern polling disabled")
+		logging.Info("Log pattern polling disabled")
 		return
 	}
+	ticker := t.clock.NewTicker(duration)
+	t.loops.Add(1)
 	go func() {
-		glog.Infof("Starting log pattern poll loop every %s", duration.String())
-		ticker := time.NewTicker(duration)
+		defer t.loops.Done()
+		logging.Infof("Starting log pattern poll loop every %s", duration.String())
 		defer ticker.Stop()
 		for {
 			select {
 			case <-t.ctx.Done():
 				return
-			case <-ticker.C:
+			case <-ticker.C():
 				if err := t.PollLogPatterns(); err != nil {
-					glog.Info(err)
+					t.health.Error()
+					logging.Info(err)
 				}
 			}
 		}
@@ -479,7 +799,7 @@ func (t *Tailer) PollLogPatterns() error {
 		if err != nil {
 			return err
 		}
-		glog.V(1).Infof("glob matches: %v", matches)
+		logging.V(1).Infof("glob matches: %v", matches)
 		for _, pathname := range matches {
 			ignore, err := t.Ignore(pathname)
 			if err != nil {
@@ -510,3 +830,14 @@ func (t *Tailer) Poll() {
 	defer t.pollMu.Unlock()
 	t.PollLogPatterns()
 }
+
+// Health reports when the Tailer last finished processing a file event, and
+// whether it is stuck in one.
+func (t *Tailer) Health() health.Status {
+	s := t.health.Status("tailer")
+	s.Critical = true
+	t.handlesMu.RLock()
+	s.Message = fmt.Sprintf("%d logs tailed", len(t.handles))
+	t.handlesMu.RUnlock()
+	return s
+}
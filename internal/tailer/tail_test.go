@@ -5,15 +5,27 @@ package tailer
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/protorecord"
+	"github.com/google/mtail/internal/record"
 	"github.com/google/mtail/internal/testutil"
 	"github.com/google/mtail/internal/watcher"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func makeTestTail(t *testing.T) (*Tailer, *stubProcessor, *watcher.FakeWatcher, string, func()) {
@@ -65,12 +77,12 @@ func TestHandleLogUpdate(t *testing.T) {
 	}
 
 	expected := []*logline.LogLine{
-		{context.Background(), logfile, "a"},
-		{context.Background(), logfile, "b"},
-		{context.Background(), logfile, "c"},
-		{context.Background(), logfile, "d"},
+		{Context: context.Background(), Filename: logfile, Line: "a"},
+		{Context: context.Background(), Filename: logfile, Line: "b"},
+		{Context: context.Background(), Filename: logfile, Line: "c"},
+		{Context: context.Background(), Filename: logfile, Line: "d"},
 	}
-	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "Offset", "Number", "IngestTime", "WriteTime"))
 }
 
 // TestHandleLogTruncate writes to a file, waits for those
@@ -110,13 +122,13 @@ func TestHandleLogTruncate(t *testing.T) {
 	}
 
 	expected := []*logline.LogLine{
-		{context.Background(), logfile, "a"},
-		{context.Background(), logfile, "b"},
-		{context.Background(), logfile, "c"},
-		{context.Background(), logfile, "d"},
-		{context.Background(), logfile, "e"},
+		{Context: context.Background(), Filename: logfile, Line: "a"},
+		{Context: context.Background(), Filename: logfile, Line: "b"},
+		{Context: context.Background(), Filename: logfile, Line: "c"},
+		{Context: context.Background(), Filename: logfile, Line: "d"},
+		{Context: context.Background(), Filename: logfile, Line: "e"},
 	}
-	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "Offset", "Number", "IngestTime", "WriteTime"))
 }
 
 func TestHandleLogUpdatePartialLine(t *testing.T) {
@@ -151,9 +163,9 @@ func TestHandleLogUpdatePartialLine(t *testing.T) {
 	w.Close()
 
 	expected := []*logline.LogLine{
-		{context.Background(), logfile, "ab"},
+		{Context: context.Background(), Filename: logfile, Line: "ab"},
 	}
-	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "Offset", "Number", "IngestTime", "WriteTime"))
 }
 
 func TestTailerOpenRetries(t *testing.T) {
@@ -175,21 +187,21 @@ func TestTailerOpenRetries(t *testing.T) {
 		t.Fatalf("Expected a permission denied error here: %s", err)
 	}
 	//w.InjectUpdate(logfile)
-	glog.Info("remove")
+	logging.Info("remove")
 	if err := os.Remove(logfile); err != nil {
 		t.Fatal(err)
 	}
 	w.InjectDelete(logfile)
-	glog.Info("openfile")
+	logging.Info("openfile")
 	f, err := os.OpenFile(logfile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0)
 	testutil.FatalIfErr(t, err)
 	w.InjectCreate(logfile)
-	glog.Info("chmod")
+	logging.Info("chmod")
 	if err := os.Chmod(logfile, 0666); err != nil {
 		t.Fatal(err)
 	}
 	w.InjectUpdate(logfile)
-	glog.Info("write string")
+	logging.Info("write string")
 	testutil.WriteString(t, f, "\n")
 	w.InjectUpdate(logfile)
 
@@ -236,7 +248,7 @@ func TestHandleLogRotate(t *testing.T) {
 	}
 	llp.Add(2)
 	testutil.WriteString(t, f, "1\n")
-	glog.V(2).Info("update")
+	logging.V(2).Info("update")
 	w.InjectUpdate(logfile)
 	if err := f.Close(); err != nil {
 		t.Fatal(err)
@@ -244,24 +256,24 @@ func TestHandleLogRotate(t *testing.T) {
 	if err := os.Rename(logfile, logfile+".1"); err != nil {
 		t.Fatal(err)
 	}
-	glog.V(2).Info("delete")
+	logging.V(2).Info("delete")
 	w.InjectDelete(logfile)
 	w.InjectCreate(logfile + ".1")
 	f = testutil.TestOpenFile(t, logfile)
-	glog.V(2).Info("create")
+	logging.V(2).Info("create")
 	w.InjectCreate(logfile)
 	testutil.WriteString(t, f, "2\n")
-	glog.V(2).Info("update")
+	logging.V(2).Info("update")
 	w.InjectUpdate(logfile)
 
 	llp.Wait()
 	w.Close()
 
 	expected := []*logline.LogLine{
-		{context.Background(), logfile, "1"},
-		{context.Background(), logfile, "2"},
+		{Context: context.Background(), Filename: logfile, Line: "1"},
+		{Context: context.Background(), Filename: logfile, Line: "2"},
 	}
-	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "Offset", "Number", "IngestTime", "WriteTime"))
 }
 
 func TestHandleLogRotateSignalsWrong(t *testing.T) {
@@ -275,7 +287,7 @@ func TestHandleLogRotateSignalsWrong(t *testing.T) {
 	}
 	llp.Add(2)
 	testutil.WriteString(t, f, "1\n")
-	glog.V(2).Info("update")
+	logging.V(2).Info("update")
 	w.InjectUpdate(logfile)
 	if err := f.Close(); err != nil {
 		t.Fatal(err)
@@ -285,24 +297,81 @@ func TestHandleLogRotateSignalsWrong(t *testing.T) {
 	}
 	// No delete signal yet
 	f = testutil.TestOpenFile(t, logfile)
-	glog.V(2).Info("create")
+	logging.V(2).Info("create")
 	w.InjectCreate(logfile)
 
-	glog.V(2).Info("delete")
+	logging.V(2).Info("delete")
 	w.InjectDelete(logfile)
 
 	testutil.WriteString(t, f, "2\n")
-	glog.V(2).Info("update")
+	logging.V(2).Info("update")
 	w.InjectUpdate(logfile)
 
 	llp.Wait()
 	w.Close()
 
 	expected := []*logline.LogLine{
-		{context.Background(), logfile, "1"},
-		{context.Background(), logfile, "2"},
+		{Context: context.Background(), Filename: logfile, Line: "1"},
+		{Context: context.Background(), Filename: logfile, Line: "2"},
+	}
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "Offset", "Number", "IngestTime", "WriteTime"))
+}
+
+func TestHandleLogRotateEventsReordered(t *testing.T) {
+	ta, llp, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	llp.Add(2)
+	testutil.WriteString(t, f, "1\n")
+	w.InjectUpdate(logfile)
+	testutil.FatalIfErr(t, f.Close())
+
+	w.Hold()
+	testutil.FatalIfErr(t, os.Rename(logfile, logfile+".1"))
+	w.InjectDelete(logfile)
+	f = testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	w.InjectCreate(logfile)
+	testutil.WriteString(t, f, "2\n")
+	w.InjectUpdate(logfile)
+	// The update of the new log arrives before its create and the delete of
+	// the old.
+	testutil.FatalIfErr(t, w.Release(2, 1, 0))
+
+	llp.Wait()
+	w.Close()
+
+	expected := []*logline.LogLine{
+		{Context: context.Background(), Filename: logfile, Line: "1"},
+		{Context: context.Background(), Filename: logfile, Line: "2"},
+	}
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "Offset", "Number", "IngestTime", "WriteTime"))
+}
+
+func TestTailPathObserveError(t *testing.T) {
+	ta, _, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	w.FailObserve(logfile, 1, errors.New("no more watches"))
+	if err := ta.TailPath(logfile); err == nil {
+		t.Error("expected an error when the watch can't be added")
+	}
+	if _, ok := ta.handles[logfile]; ok {
+		t.Errorf("tailing %s without a watch", logfile)
+	}
+
+	// The failure was transient, so trying again succeeds.
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	testutil.ExpectNoDiff(t, []string{dir, logfile}, w.Watches())
+	if _, ok := ta.handles[logfile]; !ok {
+		t.Errorf("path not found in files map: %+#v", ta.handles)
 	}
-	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 }
 
 func TestTailExpireStaleHandles(t *testing.T) {
@@ -338,7 +407,7 @@ func TestTailExpireStaleHandles(t *testing.T) {
 	}
 	ta.handlesMu.RUnlock()
 	ta.handlesMu.Lock()
-	ta.handles[log1].(*File).lastRead = time.Now().Add(-time.Hour*24 + time.Minute)
+	ta.handles[log1].(*File).lastRead = time.Now().Add(-time.Hour*24 + time.Minute).UnixNano()
 	ta.handlesMu.Unlock()
 	if err := ta.Gc(); err != nil {
 		t.Fatal(err)
@@ -349,7 +418,7 @@ func TestTailExpireStaleHandles(t *testing.T) {
 	}
 	ta.handlesMu.RUnlock()
 	ta.handlesMu.Lock()
-	ta.handles[log1].(*File).lastRead = time.Now().Add(-time.Hour*24 - time.Minute)
+	ta.handles[log1].(*File).lastRead = time.Now().Add(-time.Hour*24 - time.Minute).UnixNano()
 	ta.handlesMu.Unlock()
 	if err := ta.Gc(); err != nil {
 		t.Fatal(err)
@@ -359,5 +428,678 @@ func TestTailExpireStaleHandles(t *testing.T) {
 		t.Errorf("expecting 1 handles, got %v", ta.handles)
 	}
 	ta.handlesMu.RUnlock()
-	glog.Info("good")
+	logging.Info("good")
+}
+
+func TestResumeOffsets(t *testing.T) {
+	ta, llp, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	llp.Add(2)
+	testutil.WriteString(t, f, "a\nb\npart")
+	w.InjectUpdate(logfile)
+	llp.Wait()
+
+	resume := ta.Suspend()
+	offsets := ta.Offsets()
+	resume()
+	testutil.FatalIfErr(t, w.Close())
+	if len(offsets) != 1 || offsets[0].Offset != 4 {
+		t.Fatalf("expected offset 4 before the partial line, received %+v", offsets)
+	}
+
+	// Lines written during the handoff are read by the new tailer.
+	testutil.WriteString(t, f, "ial\nc\n")
+
+	w2 := watcher.NewFakeWatcher()
+	defer w2.Close()
+	llp2 := NewStubProcessor()
+	ta2, err := New(context.Background(), llp2, w2, ResumeOffsets(offsets))
+	testutil.FatalIfErr(t, err)
+	llp2.Add(2)
+	testutil.FatalIfErr(t, ta2.TailPath(logfile))
+	llp2.Wait()
+
+	expected := []*logline.LogLine{
+		{Context: context.Background(), Filename: logfile, Line: "partial"},
+		{Context: context.Background(), Filename: logfile, Line: "c"},
+	}
+	testutil.ExpectNoDiff(t, expected, llp2.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "Offset", "Number", "IngestTime", "WriteTime"))
+}
+
+func TestCloseWhileSuspended(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	c := clock.NewFake(time.Now())
+	w, err := watcher.NewLogWatcher(context.Background(), time.Second, watcher.Clock(c))
+	testutil.FatalIfErr(t, err)
+	c.BlockUntil(1)
+	ta, err := New(context.Background(), NewStubProcessor(), w)
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	// After a handoff the Tailer is closed without being resumed, while a
+	// poll of the log may be waiting for it.
+	ta.Suspend()
+	testutil.WriteString(t, f, "a\n")
+	c.Advance(time.Second)
+	ok, err := testutil.DoOrTimeout(func() (bool, error) {
+		return !ta.Health().BusySince.IsZero(), nil
+	}, 5*time.Second, time.Millisecond)
+	testutil.FatalIfErr(t, err)
+	if !ok {
+		t.Fatal("log not polled")
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- ta.Close()
+	}()
+	select {
+	case err := <-done:
+		testutil.FatalIfErr(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't return while suspended")
+	}
+}
+
+func TestTailPollIntervals(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	ta, err := New(context.Background(), NewStubProcessor(), w, PollIntervals{
+		filepath.Join(tmpDir, "access*"): 100 * time.Millisecond,
+		filepath.Join(tmpDir, "*.log"):   10 * time.Second,
+	})
+	testutil.FatalIfErr(t, err)
+
+	access := filepath.Join(tmpDir, "access.log")
+	batch := filepath.Join(tmpDir, "batch.log")
+	other := filepath.Join(tmpDir, "other")
+	for _, p := range []string{access, batch, other} {
+		f := testutil.TestOpenFile(t, p)
+		defer f.Close()
+		testutil.FatalIfErr(t, ta.TailPath(p))
+	}
+	for name, expected := range map[string]time.Duration{
+		access: 100 * time.Millisecond,
+		batch:  10 * time.Second,
+		other:  0,
+		// The directory is polled for new logs as often as any of them.
+		tmpDir: 100 * time.Millisecond,
+	} {
+		if got := w.PollInterval(name); got != expected {
+			t.Errorf("%s: expected poll interval %s, received %s", name, expected, got)
+		}
+	}
+}
+
+func TestTailTimezones(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	testutil.FatalIfErr(t, err)
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	testutil.FatalIfErr(t, err)
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	llp := NewStubProcessor()
+	ta, err := New(context.Background(), llp, w, Timezones{
+		filepath.Join(tmpDir, "*.log"):    berlin,
+		filepath.Join(tmpDir, "app*.log"): tokyo,
+	})
+	testutil.FatalIfErr(t, err)
+
+	app := filepath.Join(tmpDir, "app.log")
+	other := filepath.Join(tmpDir, "other.log")
+	plain := filepath.Join(tmpDir, "plain")
+	for _, p := range []string{app, other, plain} {
+		f := testutil.TestOpenFile(t, p)
+		defer f.Close()
+		testutil.FatalIfErr(t, ta.TailPath(p))
+		llp.Add(1)
+		testutil.WriteString(t, f, "line\n")
+		w.InjectUpdate(p)
+		llp.Wait()
+	}
+	expected := []*logline.LogLine{
+		{Filename: app, Line: "line", Location: tokyo},
+		{Filename: other, Line: "line", Location: berlin},
+		{Filename: plain, Line: "line"},
+	}
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "Offset", "Number", "IngestTime", "WriteTime"), testutil.Comparer(func(a, b *time.Location) bool { return a == b }))
+}
+
+func TestTailRecords(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	m, err := protorecord.Load("../protorecord/testdata/request.pb", "test.Request")
+	testutil.FatalIfErr(t, err)
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	llp := NewStubProcessor()
+	ta, err := New(context.Background(), llp, w, RecordFormats{filepath.Join(tmpDir, "*.pb"): record.Proto(m)})
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(tmpDir, "requests.pb")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(tmpDir, "*.pb")))
+	testutil.ExpectNoDiff(t, []string{logfile}, ta.Logs())
+
+	before := recordErrors.Get(logfile)
+	llp.Add(2)
+	// Records of path: "/a" status: 200, an undecodable one, and path: "/b\n",
+	// split across two writes.
+	testutil.WriteString(t, f, "\x07\x0a\x02/a\x10\xc8\x01\x01\xff\x05\x0a\x03/b")
+	w.InjectUpdate(logfile)
+	testutil.WriteString(t, f, "\n")
+	w.InjectUpdate(logfile)
+	llp.Wait()
+
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: `path: "/a" status: 200`, Fields: map[string]string{"path": "/a", "status": "200"}, Offset: 0, Number: 1},
+		{Filename: logfile, Line: `path: "/b\n"`, Fields: map[string]string{"path": "/b\n"}, Offset: 10, Number: 3},
+	}
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "IngestTime", "WriteTime"))
+	if before != nil || recordErrors.Get(logfile).String() != "1" {
+		t.Errorf("record errors: expected 1, received %v", recordErrors.Get(logfile))
+	}
+}
+
+// avroLong encodes v as an Avro long.
+func avroLong(v int64) string {
+	b := make([]byte, binary.MaxVarintLen64)
+	return string(b[:binary.PutVarint(b, v)])
+}
+
+func TestTailAvroFile(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	llp := NewStubProcessor()
+	ta, err := New(context.Background(), llp, w, RecordFormats{filepath.Join(tmpDir, "*.avro"): record.AvroFile})
+	testutil.FatalIfErr(t, err)
+
+	// The log already has its header when it's opened at the end, so the
+	// header is read from the start of the file.
+	schema := `{"type": "record", "name": "r", "fields": [{"name": "a", "type": "long"}]}`
+	sync := "0123456789abcdef"
+	header := "Obj\x01" + avroLong(1) + avroLong(11) + "avro.schema" + avroLong(int64(len(schema))) + schema + avroLong(0) + sync
+	logfile := filepath.Join(tmpDir, "requests.avro")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, header)
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(tmpDir, "*.avro")))
+
+	llp.Add(2)
+	// A block of the records {"a": 1} and {"a": 2}.
+	testutil.WriteString(t, f, avroLong(2)+avroLong(2)+avroLong(1)+avroLong(2)+sync)
+	w.InjectUpdate(logfile)
+	llp.Wait()
+
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: `{"a":1}`, Fields: map[string]string{"a": "1"}, Offset: int64(len(header)), Number: 1},
+		{Filename: logfile, Line: `{"a":2}`, Fields: map[string]string{"a": "2"}, Offset: int64(len(header)), Number: 2},
+	}
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "IngestTime", "WriteTime"))
+}
+
+func TestTailAutoFormat(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	llp := NewStubProcessor()
+	ta, err := New(context.Background(), llp, w, RecordFormats{filepath.Join(tmpDir, "*"): record.Auto})
+	testutil.FatalIfErr(t, err)
+
+	// The log's format is detected from the lines already in it when it's
+	// opened at the end.
+	logfile := filepath.Join(tmpDir, "app.log")
+	f := testutil.TestOpenFile(t, logfile)
+	testutil.WriteString(t, f, "level=info status=200\n")
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(tmpDir, "*")))
+
+	llp.Add(2)
+	testutil.WriteString(t, f, "level=warn status=404\nlevel=error")
+	w.InjectUpdate(logfile)
+	// The last line is sent without its newline when the log is closed.
+	testutil.FatalIfErr(t, f.Close())
+	testutil.FatalIfErr(t, ta.UnTailPath(logfile))
+	llp.Wait()
+
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "level=warn status=404", Fields: map[string]string{"level": "warn", "status": "404"}, Offset: 22, Number: 1},
+		{Filename: logfile, Line: "level=error", Fields: map[string]string{"level": "error"}, Offset: 44, Number: 2},
+	}
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "IngestTime", "WriteTime"))
+}
+
+func TestTailDedup(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	llp := NewStubProcessor()
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	ta, err := New(context.Background(), llp, w, Clock(clk), Dedup(time.Minute, 2))
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	// Only the last two distinct lines are remembered, so a is forgotten
+	// after c.
+	llp.Add(4)
+	testutil.WriteString(t, f, "a\na\nb\nc\na\n")
+	w.InjectUpdate(logfile)
+	llp.Wait()
+	// Lines are passed on again once their window has passed.
+	clk.Advance(2 * time.Minute)
+	llp.Add(2)
+	testutil.WriteString(t, f, "a\na\nc\n")
+	w.InjectUpdate(logfile)
+	llp.Wait()
+
+	var lines []string
+	for _, ll := range llp.result {
+		lines = append(lines, ll.Line)
+	}
+	testutil.ExpectNoDiff(t, []string{"a", "b", "c", "a", "a", "c"}, lines)
+	testutil.ExpectNoDiff(t, "2", linesDeduplicated.Get(logfile).String())
+}
+
+func TestRemovePattern(t *testing.T) {
+	ta, _, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	for _, d := range []string{"a", "b"} {
+		testutil.FatalIfErr(t, os.Mkdir(filepath.Join(dir, d), 0700))
+	}
+	x := filepath.Join(dir, "a", "x.log")
+	z := filepath.Join(dir, "a", "z.log")
+	y := filepath.Join(dir, "b", "y.log")
+	for _, p := range []string{x, y, z} {
+		f := testutil.TestOpenFile(t, p)
+		defer f.Close()
+	}
+	aLogs := filepath.Join(dir, "a", "*.log")
+	aX := filepath.Join(dir, "a", "x*")
+	bLogs := filepath.Join(dir, "b", "*.log")
+	for _, p := range []string{aLogs, aX, bLogs} {
+		testutil.FatalIfErr(t, ta.TailPattern(p))
+	}
+	testutil.ExpectNoDiff(t, []string{x, z, y}, ta.Logs())
+
+	// x.log still matches a/x*, so only z.log is closed.
+	testutil.FatalIfErr(t, ta.RemovePattern(aLogs))
+	testutil.ExpectNoDiff(t, []string{x, y}, ta.Logs())
+	if w.IsWatching(z) || !w.IsWatching(x) || !w.IsWatching(filepath.Join(dir, "a")) {
+		t.Error("unexpected watches after removing a/*.log")
+	}
+
+	testutil.FatalIfErr(t, ta.RemovePattern(bLogs))
+	testutil.ExpectNoDiff(t, []string{x}, ta.Logs())
+	testutil.ExpectNoDiff(t, []string{aX}, ta.Patterns())
+	if w.IsWatching(y) || w.IsWatching(filepath.Join(dir, "b")) {
+		t.Error("still watching b after removing b/*.log")
+	}
+
+	if err := ta.RemovePattern(bLogs); err == nil {
+		t.Error("expected an error removing a pattern twice")
+	}
+	if err := ta.UnTailPath(y); err == nil {
+		t.Error("expected an error untailing a closed log")
+	}
+	testutil.FatalIfErr(t, ta.UnTailPath(x))
+	testutil.ExpectNoDiff(t, []string{}, ta.Logs())
+}
+
+func TestTailPatternSkipsBinary(t *testing.T) {
+	ta, _, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	logs := map[string]string{
+		"text.log":       "line 1\nline 2\n",
+		"empty.log":      "",
+		"nul.log":        "line 1\n\x00\x00\x00\x00",
+		"system.journal": "LPKSHHRH",
+		"old.log.1.GZ":   "\x1f\x8b",
+		"late-nul.log":   strings.Repeat("x", sniffLen) + "\x00",
+	}
+	for name, contents := range logs {
+		testutil.FatalIfErr(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600))
+	}
+	before := binaryLogsSkipped.Value()
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(dir, "*")))
+	expected := []string{filepath.Join(dir, "empty.log"), filepath.Join(dir, "late-nul.log"), filepath.Join(dir, "text.log")}
+	testutil.ExpectNoDiff(t, expected, ta.Logs())
+	if got := binaryLogsSkipped.Value() - before; got != 3 {
+		t.Errorf("skipped: expected 3, received %d", got)
+	}
+	// Skipped files are only counted once.
+	testutil.FatalIfErr(t, ta.PollLogPatterns())
+	if got := binaryLogsSkipped.Value() - before; got != 3 {
+		t.Errorf("skipped after poll: expected 3, received %d", got)
+	}
+}
+
+func TestTailMaxOpenFiles(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	llp := NewStubProcessor()
+	ta, err := New(context.Background(), llp, w, MaxOpenFiles(2))
+	testutil.FatalIfErr(t, err)
+
+	var logs []string
+	files := make(map[string]*os.File)
+	for _, name := range []string{"a", "b", "c"} {
+		p := filepath.Join(tmpDir, name)
+		f := testutil.TestOpenFile(t, p)
+		defer f.Close()
+		logs = append(logs, p)
+		files[p] = f
+		testutil.FatalIfErr(t, ta.TailPath(p))
+	}
+	parked := func() []string {
+		var r []string
+		for _, p := range logs {
+			l, _ := ta.handleForPath(p)
+			if l.(*File).parkedFi != nil {
+				r = append(r, p)
+			}
+		}
+		return r
+	}
+	// a is the least recently used.
+	testutil.ExpectNoDiff(t, logs[:1], parked())
+
+	// Writing to a reopens it at the same offset, closing b instead.
+	llp.Add(2)
+	testutil.WriteString(t, files[logs[0]], "1\n")
+	w.InjectUpdate(logs[0])
+	testutil.ExpectNoDiff(t, logs[1:2], parked())
+	testutil.WriteString(t, files[logs[0]], "2\n")
+	w.InjectUpdate(logs[0])
+	llp.Wait()
+
+	// b is replaced while closed, so the new file is read from the start.
+	testutil.FatalIfErr(t, os.Rename(logs[1], logs[1]+".1"))
+	b := testutil.TestOpenFile(t, logs[1])
+	defer b.Close()
+	llp.Add(1)
+	testutil.WriteString(t, b, "3\n")
+	w.InjectUpdate(logs[1])
+	llp.Wait()
+
+	expected := []*logline.LogLine{
+		{Context: context.Background(), Filename: logs[0], Line: "1"},
+		{Context: context.Background(), Filename: logs[0], Line: "2"},
+		{Context: context.Background(), Filename: logs[1], Line: "3"},
+	}
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "Offset", "Number", "IngestTime", "WriteTime"))
+	if n := len(parked()); n != 1 {
+		t.Errorf("expected 1 closed file, received %d", n)
+	}
+}
+
+func TestTailSilence(t *testing.T) {
+	ta, _, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	ta.handlesMu.Lock()
+	atomic.StoreInt64(&ta.handles[logfile].(*File).lastRead, time.Now().Add(-time.Hour).UnixNano())
+	ta.handlesMu.Unlock()
+	if s := promtest.ToFloat64(ta); s < 3600 || s > 3700 {
+		t.Errorf("seconds since last read %v, expected about an hour", s)
+	}
+}
+
+func TestTailRates(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	llp := NewStubProcessor()
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	ta, err := New(context.Background(), llp, w, Clock(clk))
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	// A log has no rate until its second sample.
+	ta.sampleRates()
+	if n := promtest.CollectAndCount(ta); n != 1 {
+		t.Errorf("expected only the silence metric before a rate is measured, received %d metrics", n)
+	}
+
+	llp.Add(4)
+	testutil.WriteString(t, f, "a\nb\nc\nd\n")
+	w.InjectUpdate(logfile)
+	llp.Wait()
+	clk.Advance(2 * time.Second)
+	ta.sampleRates()
+
+	expected := `
+# HELP mtail_log_bytes_per_second number of bytes read per second from each log file, over the last log rate interval
+# TYPE mtail_log_bytes_per_second gauge
+mtail_log_bytes_per_second{logfile="` + logfile + `"} 4
+# HELP mtail_log_lines_per_second number of lines read per second from each log file, over the last log rate interval
+# TYPE mtail_log_lines_per_second gauge
+mtail_log_lines_per_second{logfile="` + logfile + `"} 2
+`
+	testutil.FatalIfErr(t, promtest.CollectAndCompare(ta, strings.NewReader(expected), "mtail_log_lines_per_second", "mtail_log_bytes_per_second"))
+}
+
+func TestTailStats(t *testing.T) {
+	ta, llp, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	llp.Add(2)
+	testutil.WriteString(t, f, "a\nb\nc")
+	w.InjectUpdate(logfile)
+	llp.Wait()
+
+	stats := ta.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("expected stats of one log, not %v", stats)
+	}
+	s := stats[0]
+	fi, err := os.Stat(logfile)
+	testutil.FatalIfErr(t, err)
+	dev, ino := fileID(fi)
+	expected := LogStats{Name: logfile, Pathname: logfile, Type: "file", Open: true, Offset: 5, Size: 5, Dev: dev, Ino: ino, Lines: 2, Bytes: 5}
+	testutil.ExpectNoDiff(t, expected, s, testutil.IgnoreFields(LogStats{}, "LastRead"))
+	if time.Since(s.LastRead) > time.Minute {
+		t.Errorf("last read %s, expected just now", s.LastRead)
+	}
+
+	rec := httptest.NewRecorder()
+	ta.StatsHandler(rec, httptest.NewRequest(http.MethodGet, "/logs/stats", nil))
+	var served []LogStats
+	testutil.FatalIfErr(t, json.Unmarshal(rec.Body.Bytes(), &served))
+	testutil.ExpectNoDiff(t, stats, served, testutil.IgnoreFields(LogStats{}, "LastRead"))
+}
+
+func TestTailContextCancel(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	w := watcher.NewFakeWatcher()
+	llp := NewStubProcessor()
+	ctx, cancel := context.WithCancel(context.Background())
+	ta, err := New(ctx, llp, w, StaleLogGcTickInterval(time.Hour), LogPatternPollTickInterval(time.Hour))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	cancel()
+	// Close waits for the gc and poll loops, which have stopped.
+	testutil.FatalIfErr(t, ta.Close())
+
+	// Lines are no longer read once the Tailer has stopped.
+	testutil.WriteString(t, f, "a\n")
+	ta.ProcessFileEvent(context.Background(), watcher.Event{Op: watcher.Update, Pathname: logfile})
+	if len(llp.result) != 0 {
+		t.Errorf("lines read after cancel: %v", llp.result)
+	}
+}
+
+func TestTailGcLoop(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	c := clock.NewFake(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ta, err := New(ctx, NewStubProcessor(), watcher.NewFakeWatcher(), StaleLogGcTickInterval(time.Hour), Clock(c))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	// More than a day without reads makes the log stale, and the next gc
+	// removes it.
+	c.Advance(25 * time.Hour)
+	ok, err := testutil.DoOrTimeout(func() (bool, error) {
+		return len(ta.Logs()) == 0, nil
+	}, 5*time.Second, time.Millisecond)
+	testutil.FatalIfErr(t, err)
+	if !ok {
+		t.Errorf("stale log not removed: %v", ta.Logs())
+	}
+	testutil.FatalIfErr(t, ta.Close())
+}
+
+func TestShedLoad(t *testing.T) {
+	ta, llp, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	high := filepath.Join(dir, "high.log")
+	low := filepath.Join(dir, "low.log")
+	fh := testutil.TestOpenFile(t, high)
+	fl := testutil.TestOpenFile(t, low)
+	testutil.FatalIfErr(t, ta.TailPath(high))
+	testutil.FatalIfErr(t, ta.TailPath(low))
+
+	// A paused log isn't read until resumed.
+	ta.PauseLogs([]string{filepath.Join(dir, "low*")})
+	// So is one opened after the pause.
+	low2 := filepath.Join(dir, "low2.log")
+	testutil.TestOpenFile(t, low2).Close()
+	testutil.FatalIfErr(t, ta.TailPath(low2))
+	if fd, ok := ta.handleForPath(low2); !ok || !fd.(*File).isPaused() {
+		t.Errorf("log opened after the pause isn't paused")
+	}
+	testutil.ExpectNoDiff(t, int64(2), logsPaused.Value())
+	llp.Add(1)
+	testutil.WriteString(t, fh, "a\n")
+	testutil.WriteString(t, fl, "b\n")
+	w.InjectUpdate(high)
+	w.InjectUpdate(low)
+	llp.Wait()
+	llp.Add(1)
+	ta.ResumeLogs()
+	llp.Wait()
+	testutil.ExpectNoDiff(t, int64(0), logsPaused.Value())
+
+	// Skipping the backlog drops what has been written so far, with the
+	// rest of the line that ends in.
+	shed := counter(logBytesShed, high)
+	testutil.WriteString(t, fh, "c\npart")
+	ta.SkipBacklog()
+	llp.Add(1)
+	testutil.WriteString(t, fh, "ial\nd\n")
+	w.InjectUpdate(high)
+	llp.Wait()
+
+	var lines []string
+	for _, ll := range llp.result {
+		lines = append(lines, ll.Line)
+	}
+	testutil.ExpectNoDiff(t, []string{"a", "b", "d"}, lines)
+	testutil.ExpectNoDiff(t, shed+int64(len("c\npartial\n")), counter(logBytesShed, high))
+
+	// A backlog that ends with a newline leaves the next line whole.
+	shed = counter(logBytesShed, high)
+	testutil.WriteString(t, fh, "e\n")
+	ta.SkipBacklog()
+	llp.Add(1)
+	testutil.WriteString(t, fh, "f\n")
+	w.InjectUpdate(high)
+	llp.Wait()
+
+	lines = nil
+	for _, ll := range llp.result {
+		lines = append(lines, ll.Line)
+	}
+	testutil.ExpectNoDiff(t, []string{"a", "b", "d", "f"}, lines)
+	testutil.ExpectNoDiff(t, shed+int64(len("e\n")), counter(logBytesShed, high))
+}
+
+func TestSkipBacklogRecords(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	llp := NewStubProcessor()
+	ta, err := New(context.Background(), llp, w, RecordFormats{filepath.Join(tmpDir, "*"): record.Logfmt})
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(tmpDir, "app.log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	// A log of records that are lines is skipped like a text log, to the
+	// line after the end.
+	shed := counter(logBytesShed, logfile)
+	testutil.WriteString(t, f, "a=1\nb=")
+	ta.SkipBacklog()
+	llp.Add(1)
+	testutil.WriteString(t, f, "2\nc=3\n")
+	w.InjectUpdate(logfile)
+	llp.Wait()
+
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "c=3", Fields: map[string]string{"c": "3"}, Offset: 8, Number: 1},
+	}
+	testutil.ExpectNoDiff(t, expected, llp.result, testutil.IgnoreFields(logline.LogLine{}, "Context", "IngestTime", "WriteTime"))
+	testutil.ExpectNoDiff(t, shed+int64(len("a=1\nb=2\n")), counter(logBytesShed, logfile))
+	testutil.FatalIfErr(t, ta.Close())
 }
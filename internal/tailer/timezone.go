@@ -0,0 +1,78 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/logline"
+	"github.com/pkg/errors"
+)
+
+// Timezones sets the timezone of timestamps that don't name one in the logs
+// matching each glob pattern, instead of the timezone the programs use.
+type Timezones map[string]*time.Location
+
+func (opt Timezones) apply(t *Tailer) error {
+	for pattern, loc := range opt {
+		if loc == nil {
+			return errors.Errorf("no timezone for %q", pattern)
+		}
+		absPath, err := filepath.Abs(pattern)
+		if err != nil {
+			return err
+		}
+		t.globPatternsMu.Lock()
+		if t.locations == nil {
+			t.locations = make(map[string]*time.Location)
+		}
+		t.locations[absPath] = loc
+		t.globPatternsMu.Unlock()
+	}
+	return nil
+}
+
+// locationFor returns the timezone of the longest pattern that matches
+// pathname, or nil if none do.
+func (t *Tailer) locationFor(pathname string) *time.Location {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return nil
+	}
+	t.globPatternsMu.RLock()
+	defer t.globPatternsMu.RUnlock()
+	var (
+		r       *time.Location
+		longest string
+	)
+	for pattern, loc := range t.locations {
+		if len(pattern) < len(longest) || (len(pattern) == len(longest) && pattern > longest) {
+			continue
+		}
+		matched, err := filepath.Match(pattern, absPath)
+		if err != nil {
+			logging.V(1).Info(err)
+			continue
+		}
+		if matched {
+			r, longest = loc, pattern
+		}
+	}
+	return r
+}
+
+// locatedProcessor sets the timezone of each line from a log before passing
+// it on.
+type locatedProcessor struct {
+	llp logline.Processor
+	loc *time.Location
+}
+
+func (p *locatedProcessor) ProcessLogLine(ctx context.Context, ll *logline.LogLine) {
+	ll.Location = p.loc
+	p.llp.ProcessLogLine(ctx, ll)
+}
@@ -32,6 +32,12 @@ func SortSlices(lessFunc interface{}) cmp.Option {
 	return cmpopts.SortSlices(lessFunc)
 }
 
+// Comparer returns an option that compares values of a type with f, a
+// func(T, T) bool, in place of comparing them field by field.
+func Comparer(f interface{}) cmp.Option {
+	return cmp.Comparer(f)
+}
+
 // ExpectNoDiff tests to see if the two interfaces have no diff.
 // If there is no diff, the retrun value is true.
 // If there is a diff, it is logged to tb and an error is flagged, and the return value is false.
@@ -4,13 +4,13 @@ import (
 	"io"
 	"testing"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 )
 
 func WriteString(tb testing.TB, f io.StringWriter, str string) int {
 	tb.Helper()
 	n, err := f.WriteString(str)
 	FatalIfErr(tb, err)
-	glog.Infof("Wrote %d bytes", n)
+	logging.Infof("Wrote %d bytes", n)
 	return n
 }
@@ -3,7 +3,7 @@ package testutil
 import (
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 )
 
 func DoOrTimeout(do func() (bool, error), deadline, interval time.Duration) (bool, error) {
@@ -15,9 +15,9 @@ func DoOrTimeout(do func() (bool, error), deadline, interval time.Duration) (boo
 		case <-timeout:
 			return false, nil
 		case <-ticker.C:
-			glog.V(2).Infof("tick")
+			logging.V(2).Infof("tick")
 			ok, err := do()
-			glog.V(2).Infof("ok, err: %v %v", ok, err)
+			logging.V(2).Infof("ok, err: %v %v", ok, err)
 			if err != nil {
 				return false, err
 			}
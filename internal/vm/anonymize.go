@@ -0,0 +1,49 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+)
+
+// redactions are the patterns of personal data replaced by the redact
+// builtin, and what they are replaced with, in the order they are applied.
+// IPv6 addresses must be in full or have hex digits on both sides of a
+// "::", so that clock times and names like "Foo::Bar" are left alone.
+// Numbers are nine or more digits, or groups of digits split by spaces or
+// dashes as phone and card numbers are, but not as dates are.
+var redactions = []struct {
+	re          *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[email]"},
+	{regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`), "[ip]"},
+	{regexp.MustCompile(`(?i)\b(?:(?:[0-9a-f]{1,4}:){7}[0-9a-f]{1,4}|(?:[0-9a-f]{1,4}:){1,6}(?::[0-9a-f]{1,4}){1,6})\b`), "[ip]"},
+	{regexp.MustCompile(`\b(?:\d{9,}|\d{2,4}(?:[ -]\d{3,4}){2,4})\b`), "[number]"},
+}
+
+// redact returns s with the email addresses, IP addresses, and long numbers,
+// like phone and card numbers, replaced.
+func redact(s string) string {
+	for _, r := range redactions {
+		s = r.re.ReplaceAllString(s, r.replacement)
+	}
+	return s
+}
+
+// sha256Hex returns the hex encoded SHA-256 hash of s.
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// hmacHex returns the hex encoded HMAC-SHA256 of s with key.
+func hmacHex(key []byte, s string) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return hex.EncodeToString(m.Sum(nil))
+}
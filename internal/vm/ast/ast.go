@@ -210,8 +210,13 @@ type VarDecl struct {
 	Keys         []string
 	Buckets      []float64
 	Kind         metrics.Kind
+	Limit        int           // The most label values kept by a topk metric.
+	Window       time.Duration // How often a distinct metric is emptied.
+	Reset        time.Duration // How often the metric is reset to zero.
 	ExportedName string
 	Symbol       *symbol.Symbol
+
+	Timestamp metrics.TimestampExport // Whether to export the timestamp of the metric.
 }
 
 func (n *VarDecl) Pos() *position.Position {
@@ -308,12 +313,30 @@ func (n *PatternFragment) Type() types.Type {
 	return types.Pattern
 }
 
+// ExternConst declares a named string constant whose value is not in the
+// program, but supplied to the compiler when the program is compiled.
+type ExternConst struct {
+	Id     Node
+	Symbol *symbol.Symbol
+	Value  string // The value supplied, once checked.
+}
+
+func (n *ExternConst) Pos() *position.Position {
+	return n.Id.Pos()
+}
+
+func (n *ExternConst) Type() types.Type {
+	return types.String
+}
+
 type DecoDecl struct {
 	P      position.Position
 	Name   string
+	Params []string // Names of the parameters bound by each instantiation, if any.
 	Block  Node
 	Symbol *symbol.Symbol
 	Scope  *symbol.Scope // The declaration creates its own scope, as a zygote to be instantiated later.
+	Module string        // Name of the library module the declaration was imported from, if any.
 }
 
 func (n *DecoDecl) Pos() *position.Position {
@@ -330,6 +353,7 @@ func (n *DecoDecl) Type() types.Type {
 type DecoStmt struct {
 	P     position.Position
 	Name  string
+	Args  Node // Optional ExprList of literal arguments bound to the declaration's parameters.
 	Block Node
 	Decl  *DecoDecl     // Pointer to the declaration of the decorator this statement invokes.
 	Scope *symbol.Scope // Instantiated with a copy of the Def's Scope.
@@ -417,6 +441,57 @@ func (n *Error) Type() types.Type {
 	return types.Error
 }
 
+// PragmaStmt is a compiler directive that changes the behaviour of the whole program.
+type PragmaStmt struct {
+	P     position.Position
+	Name  string
+	Value string // Optional argument to the pragma.
+}
+
+func (n *PragmaStmt) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *PragmaStmt) Type() types.Type {
+	return types.None
+}
+
+// FilterStmt restricts the logs a program processes to those whose Subject
+// matches, or with Negate doesn't match, the pattern.
+type FilterStmt struct {
+	P       position.Position
+	Subject string // What the pattern is matched against; only "filename".
+	Negate  bool
+	Pattern Node
+	Regexp  string // if not empty, the fully defined pattern after typecheck
+}
+
+func (n *FilterStmt) Pos() *position.Position {
+	return MergePosition(&n.P, n.Pattern.Pos())
+}
+
+func (n *FilterStmt) Type() types.Type {
+	return types.None
+}
+
+// SampleStmt runs its block for one in Rate of the times it is reached, so
+// that a program can keep up with logs too busy to process every line.
+type SampleStmt struct {
+	P     position.Position
+	Mode  string // Optional mode, "random" to choose the lines at random.
+	Num   int64  // The numerator of the sample rate, which must be 1.
+	Rate  int64
+	Block Node
+}
+
+func (n *SampleStmt) Pos() *position.Position {
+	return MergePosition(&n.P, n.Block.Pos())
+}
+
+func (n *SampleStmt) Type() types.Type {
+	return types.None
+}
+
 type StopStmt struct {
 	P position.Position
 }
@@ -0,0 +1,86 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package ast
+
+import (
+	"fmt"
+)
+
+// Copy returns a deep copy of the AST rooted at node.  Symbol table
+// annotations and types are not copied, so Copy is only meaningful on a tree
+// that has not yet been checked.
+func Copy(node Node) Node {
+	if node == nil {
+		return nil
+	}
+	switch n := node.(type) {
+	case *StmtList:
+		return &StmtList{Children: copynodelist(n.Children)}
+	case *ExprList:
+		return &ExprList{Children: copynodelist(n.Children)}
+	case *CondStmt:
+		return &CondStmt{Cond: Copy(n.Cond), Truth: Copy(n.Truth), Else: Copy(n.Else)}
+	case *IdTerm:
+		return &IdTerm{P: n.P, Name: n.Name, Lvalue: n.Lvalue}
+	case *CaprefTerm:
+		return &CaprefTerm{P: n.P, Name: n.Name, IsNamed: n.IsNamed}
+	case *BuiltinExpr:
+		return &BuiltinExpr{P: n.P, Name: n.Name, Args: Copy(n.Args)}
+	case *BinaryExpr:
+		return &BinaryExpr{Lhs: Copy(n.Lhs), Rhs: Copy(n.Rhs), Op: n.Op}
+	case *UnaryExpr:
+		return &UnaryExpr{P: n.P, Expr: Copy(n.Expr), Op: n.Op}
+	case *IndexedExpr:
+		return &IndexedExpr{Lhs: Copy(n.Lhs), Index: Copy(n.Index)}
+	case *VarDecl:
+		return &VarDecl{P: n.P, Name: n.Name, Hidden: n.Hidden, Keys: n.Keys, Buckets: n.Buckets, Kind: n.Kind, Limit: n.Limit, Window: n.Window, Reset: n.Reset, ExportedName: n.ExportedName, Timestamp: n.Timestamp}
+	case *StringLit:
+		return &StringLit{P: n.P, Text: n.Text}
+	case *IntLit:
+		return &IntLit{P: n.P, I: n.I}
+	case *FloatLit:
+		return &FloatLit{P: n.P, F: n.F}
+	case *PatternExpr:
+		return &PatternExpr{Expr: Copy(n.Expr)}
+	case *PatternLit:
+		return &PatternLit{P: n.P, Pattern: n.Pattern}
+	case *PatternFragment:
+		return &PatternFragment{Id: Copy(n.Id), Expr: Copy(n.Expr)}
+	case *DecoDecl:
+		return &DecoDecl{P: n.P, Name: n.Name, Params: n.Params, Block: Copy(n.Block), Module: n.Module}
+	case *DecoStmt:
+		return &DecoStmt{P: n.P, Name: n.Name, Args: Copy(n.Args), Block: Copy(n.Block)}
+	case *SampleStmt:
+		return &SampleStmt{P: n.P, Mode: n.Mode, Num: n.Num, Rate: n.Rate, Block: Copy(n.Block)}
+	case *FilterStmt:
+		return &FilterStmt{P: n.P, Subject: n.Subject, Negate: n.Negate, Pattern: Copy(n.Pattern), Regexp: n.Regexp}
+	case *NextStmt:
+		return &NextStmt{P: n.P}
+	case *OtherwiseStmt:
+		return &OtherwiseStmt{P: n.P}
+	case *DelStmt:
+		return &DelStmt{P: n.P, N: Copy(n.N), Expiry: n.Expiry}
+	case *ConvExpr:
+		return &ConvExpr{N: Copy(n.N)}
+	case *Error:
+		return &Error{P: n.P, Spelling: n.Spelling}
+	case *StopStmt:
+		return &StopStmt{P: n.P}
+	case *PragmaStmt:
+		return &PragmaStmt{P: n.P, Name: n.Name, Value: n.Value}
+	case *ExternConst:
+		return &ExternConst{Id: Copy(n.Id), Value: n.Value}
+	default:
+		panic(fmt.Sprintf("Copy: unexpected node type %T: %v", n, n))
+	}
+}
+
+// copynodelist is a helper that copies each node in a list
+func copynodelist(list []Node) []Node {
+	r := make([]Node, 0, len(list))
+	for _, x := range list {
+		r = append(r, Copy(x))
+	}
+	return r
+}
@@ -6,7 +6,7 @@ package ast
 import (
 	"fmt"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 )
 
 // Visitor VisitBefore method is invoked for each node encountered by Walk.
@@ -29,7 +29,7 @@ func walknodelist(v Visitor, list []Node) []Node {
 // Walk traverses (walks) an AST node with the provided Visitor v.
 func Walk(v Visitor, node Node) Node {
 
-	glog.V(2).Infof("About to VisitBefore node at %s", node.Pos())
+	logging.V(2).Infof("About to VisitBefore node at %s", node.Pos())
 	// Returning nil from VisitBefore signals to Walk that the Visitor has
 	// handled the children of this node.  VisitAfter will not be called.
 	if v, node = v.VisitBefore(node); v == nil {
@@ -73,6 +73,12 @@ func Walk(v Visitor, node Node) Node {
 	case *DecoStmt:
 		n.Block = Walk(v, n.Block)
 
+	case *SampleStmt:
+		n.Block = Walk(v, n.Block)
+
+	case *FilterStmt:
+		n.Pattern = Walk(v, n.Pattern)
+
 	case *ConvExpr:
 		n.N = Walk(v, n.N)
 
@@ -82,14 +88,14 @@ func Walk(v Visitor, node Node) Node {
 	case *PatternFragment:
 		n.Expr = Walk(v, n.Expr)
 
-	case *IdTerm, *CaprefTerm, *VarDecl, *StringLit, *IntLit, *FloatLit, *PatternLit, *NextStmt, *OtherwiseStmt, *DelStmt, *StopStmt:
+	case *IdTerm, *CaprefTerm, *VarDecl, *StringLit, *IntLit, *FloatLit, *PatternLit, *NextStmt, *OtherwiseStmt, *DelStmt, *StopStmt, *PragmaStmt, *ExternConst:
 		// These nodes are terminals, thus have no children to walk.
 
 	default:
 		panic(fmt.Sprintf("Walk: unexpected node type %T: %v", n, n))
 	}
 
-	glog.V(2).Infof("About to VisitAfter node at %s", node.Pos())
+	logging.V(2).Infof("About to VisitAfter node at %s", node.Pos())
 	node = v.VisitAfter(node)
 	return node
 }
@@ -0,0 +1,74 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/google/mtail/internal/vm/code"
+	"github.com/google/mtail/internal/vm/parser"
+)
+
+// instrJSON is an instruction of a program's bytecode, as encoded in JSON.
+type instrJSON struct {
+	PC      int         `json:"pc"`
+	Op      string      `json:"op"`
+	Operand interface{} `json:"operand"`
+	Line    int         `json:"line"` // The source line, counted from one.
+}
+
+// WriteASTJSON writes the program's syntax tree and bytecode to w as a JSON
+// object.
+func (v *VM) WriteASTJSON(w io.Writer) error {
+	r := struct {
+		Name     string           `json:"name"`
+		AST      *parser.TreeNode `json:"ast"`
+		Bytecode []instrJSON      `json:"bytecode"`
+	}{Name: v.name, Bytecode: make([]instrJSON, 0, len(v.prog))}
+	if v.ast != nil {
+		r.AST = parser.Tree(v.ast)
+	}
+	for pc, i := range v.prog {
+		r.Bytecode = append(r.Bytecode, instrJSON{pc, i.Opcode.String(), i.Operand, i.SourceLine + 1})
+	}
+	return json.NewEncoder(w).Encode(r)
+}
+
+// WriteDot writes the program's syntax tree and bytecode to w as a graphviz
+// graph, with a cluster for each.  The bytecode is drawn as its control flow,
+// with the jumps taken dashed.
+func (v *VM) WriteDot(w io.Writer) error {
+	fmt.Fprintf(w, "digraph %s {\n", parser.DotQuote(v.name))
+	if v.ast != nil {
+		fmt.Fprintf(w, "subgraph cluster_ast {\nlabel=\"AST\"\n")
+		parser.WriteDot(w, v.ast, "ast_")
+		fmt.Fprintf(w, "}\n")
+	}
+	fmt.Fprintf(w, "subgraph cluster_bytecode {\nlabel=\"Bytecode\"\nnode [shape=box fontname=monospace]\n")
+	for pc, i := range v.prog {
+		label := fmt.Sprintf("%d: %s", pc, i.Opcode)
+		if i.Operand != nil {
+			label += fmt.Sprintf(" %v", i.Operand)
+		}
+		fmt.Fprintf(w, "pc%d [label=%s xlabel=\"line %d\"]\n", pc, parser.DotQuote(label), i.SourceLine+1)
+	}
+	// Jumps past the last instruction, and falling off it, end the program.
+	fmt.Fprintf(w, "pc%d [label=\"end\" shape=oval]\n", len(v.prog))
+	for pc, i := range v.prog {
+		switch i.Opcode {
+		case code.Jmp, code.Jm, code.Jnm:
+			fmt.Fprintf(w, "pc%d -> pc%v [style=dashed]\n", pc, i.Operand)
+			if i.Opcode == code.Jmp {
+				continue
+			}
+		case code.Stop:
+			continue
+		}
+		fmt.Fprintf(w, "pc%d -> pc%d\n", pc, pc+1)
+	}
+	_, err := fmt.Fprintf(w, "}\n}\n")
+	return err
+}
@@ -0,0 +1,27 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import "expvar"
+
+// progBacktrackingStepLimits counts the matches of patterns compiled by the
+// backtracking engine that gave up, per program.
+var progBacktrackingStepLimits = expvar.NewMap("prog_backtracking_step_limits_total")
+
+// match returns the match of the index'th regular expression constant in s
+// and its capture groups, or nil if it doesn't match.  A backtracking match
+// that gives up is a runtime error, and doesn't match.
+func (v *VM) match(index int, s string) []string {
+	re, ok := v.backtracking[index]
+	if !ok {
+		return v.re[index].FindStringSubmatch(s)
+	}
+	m, err := re.FindStringSubmatch(s)
+	if err != nil {
+		progBacktrackingStepLimits.Add(v.name, 1)
+		v.errorf("/%s/: %s", re, err)
+		return nil
+	}
+	return m
+}
@@ -0,0 +1,427 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/vm/code"
+	"github.com/google/mtail/internal/vm/codegen"
+	"github.com/google/mtail/internal/vm/object"
+	"github.com/google/mtail/internal/vm/pcre"
+	"github.com/pkg/errors"
+)
+
+// bundleExt is the extension of a bundle of precompiled programs.
+const bundleExt = ".mtailc"
+
+// bundleMagic begins every bundle, and is followed by the gob encoding of
+// the bundle.
+const bundleMagic = "mtail bundle\n"
+
+// bundleFormat is the version of the encoding of bundles, changed whenever
+// an older mtail couldn't read the new encoding.
+const bundleFormat = 1
+
+func init() {
+	// The operands of instructions that aren't registered by gob itself.
+	gob.Register(time.Duration(0))
+}
+
+// bundle is a set of programs compiled in advance, so that they can be loaded
+// without compiling them again.
+type bundle struct {
+	Format   int
+	Opcodes  []string // The names of the opcodes used, which the instructions refer to by index.
+	Programs []bundledProgram
+}
+
+// bundledProgram is the compiled object of a program, with the source and
+// manifest it was compiled with.  The regular expressions are kept as their
+// patterns, and the metrics as their declarations.
+type bundledProgram struct {
+	Name     string
+	Source   []byte
+	Manifest Manifest
+
+	Program      []bundledInstr
+	Strings      []string
+	Regexps      []string       // The patterns of the regular expressions, empty where they are backtracking.
+	Backtracking map[int]string // The patterns, without the marker, of the backtracking regular expressions, by index in Regexps.
+	Metrics      []bundledMetric
+	Filters      []bundledFilter
+
+	Strict             bool
+	Syntax             string
+	DecimalSeparator   string
+	ThousandsSeparator string
+	CSVDelimiter       string
+	CSVQuote           string
+	CSVHeader          bool
+	Samples            []object.Sample
+	Conditions         []int
+}
+
+type bundledInstr struct {
+	Opcode     int // The index of the opcode's name in the bundle.
+	Operand    interface{}
+	SourceLine int
+}
+
+// bundledMetric is the declaration of a metric, from which it is created
+// afresh as when the program is compiled.
+type bundledMetric struct {
+	Name      string
+	Program   string
+	Kind      metrics.Kind
+	Type      metrics.Type
+	Hidden    bool
+	Keys      []string
+	Source    string
+	Buckets   []datum.Range
+	Limit     int
+	Window    time.Duration
+	Reset     time.Duration
+	Timestamp metrics.TimestampExport
+}
+
+type bundledFilter struct {
+	Regexp string
+	Negate bool
+}
+
+// WriteBundle compiles the programs at programPaths, with their manifests,
+// and writes them to w as a bundle that a Loader can load in place of them.
+// No bundle is written unless every program compiles, and the errors of all
+// those that don't are returned.
+func WriteBundle(w io.Writer, programPaths []string) error {
+	b := bundle{Format: bundleFormat}
+	opcodes := make(map[code.Opcode]int)
+	seen := make(map[string]string)
+	var failed []string
+	for _, programPath := range programPaths {
+		name := filepath.Base(programPath)
+		if other, ok := seen[name]; ok {
+			failed = append(failed, errors.Errorf("%s: program of the same name as %s", programPath, other).Error())
+			continue
+		}
+		seen[name] = programPath
+		p, err := compileBundledProgram(name, programPath, opcodes)
+		if err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		b.Programs = append(b.Programs, p)
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("%d programs failed to compile:\n%s", len(failed), strings.Join(failed, "\n"))
+	}
+	b.Opcodes = make([]string, len(opcodes))
+	for o, i := range opcodes {
+		b.Opcodes[i] = o.String()
+	}
+	if _, err := io.WriteString(w, bundleMagic); err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(&b)
+}
+
+// compileBundledProgram compiles the program called name at programPath for
+// a bundle, adding the opcodes it uses to opcodes.
+func compileBundledProgram(name, programPath string, opcodes map[code.Opcode]int) (bundledProgram, error) {
+	src, err := ioutil.ReadFile(programPath)
+	if err != nil {
+		return bundledProgram{}, err
+	}
+	sidecar, ok, err := readSidecarManifest(programPath)
+	if err != nil {
+		return bundledProgram{}, err
+	}
+	var m *Manifest
+	if ok {
+		m = &sidecar
+	}
+	manifest, err := programManifest(src, m)
+	if err != nil {
+		return bundledProgram{}, errors.Wrapf(err, "invalid manifest for %s", name)
+	}
+	v, err := Compile(name, bytes.NewReader(src), CompileOptions{})
+	if err != nil {
+		return bundledProgram{}, errors.Errorf("compile failed for %s:\n%s", name, err)
+	}
+	defer v.release()
+	obj := v.obj
+	p := bundledProgram{
+		Name:               name,
+		Source:             src,
+		Manifest:           manifest,
+		Strings:            obj.Strings,
+		Strict:             obj.Strict,
+		Syntax:             obj.Syntax,
+		DecimalSeparator:   obj.DecimalSeparator,
+		ThousandsSeparator: obj.ThousandsSeparator,
+		CSVDelimiter:       obj.CSVDelimiter,
+		CSVQuote:           obj.CSVQuote,
+		CSVHeader:          obj.CSVHeader,
+		Samples:            obj.Samples,
+		Conditions:         obj.Conditions,
+	}
+	for _, i := range obj.Program {
+		if _, ok := opcodes[i.Opcode]; !ok {
+			opcodes[i.Opcode] = len(opcodes)
+		}
+		p.Program = append(p.Program, bundledInstr{opcodes[i.Opcode], i.Operand, i.SourceLine})
+	}
+	for i, re := range obj.Regexps {
+		if re == nil {
+			if p.Backtracking == nil {
+				p.Backtracking = make(map[int]string)
+			}
+			p.Backtracking[i] = obj.Backtracking[i].String()
+			p.Regexps = append(p.Regexps, "")
+			continue
+		}
+		p.Regexps = append(p.Regexps, re.String())
+	}
+	for _, m := range obj.Metrics {
+		p.Metrics = append(p.Metrics, bundledMetric{
+			Name:      m.Name,
+			Program:   m.Program,
+			Kind:      m.Kind,
+			Type:      m.Type,
+			Hidden:    m.Hidden,
+			Keys:      m.Keys,
+			Source:    m.Source,
+			Buckets:   m.Buckets,
+			Limit:     m.Limit,
+			Window:    m.Window,
+			Reset:     m.Reset,
+			Timestamp: m.Timestamp,
+		})
+	}
+	for _, f := range obj.Filters {
+		p.Filters = append(p.Filters, bundledFilter{f.Regexp.String(), f.Negate})
+	}
+	return p, nil
+}
+
+// readBundle decodes the bundle in data, and returns the current opcodes of
+// the names it refers to.
+func readBundle(data []byte) (*bundle, []code.Opcode, error) {
+	if !bytes.HasPrefix(data, []byte(bundleMagic)) {
+		return nil, nil, errors.New("not a bundle of mtail programs")
+	}
+	var b bundle
+	if err := gob.NewDecoder(bytes.NewReader(data[len(bundleMagic):])).Decode(&b); err != nil {
+		return nil, nil, errors.Wrap(err, "decoding bundle")
+	}
+	if b.Format != bundleFormat {
+		return nil, nil, errors.Errorf("bundle format %d isn't supported by this mtail, which reads format %d; compile the programs again with this version", b.Format, bundleFormat)
+	}
+	opcodes := make([]code.Opcode, len(b.Opcodes))
+	for i, name := range b.Opcodes {
+		o, ok := code.ParseOpcode(name)
+		if !ok {
+			return nil, nil, errors.Errorf("bundle uses the instruction %q, which this mtail doesn't have; compile the programs again with this version", name)
+		}
+		opcodes[i] = o
+	}
+	return &b, opcodes, nil
+}
+
+// object returns the object the bundled program was compiled to, sharing its
+// regular expressions with the programs already loaded.
+func (p *bundledProgram) object(opcodes []code.Opcode) (obj *object.Object, err error) {
+	obj = &object.Object{
+		Strings:            p.Strings,
+		Strict:             p.Strict,
+		Syntax:             p.Syntax,
+		DecimalSeparator:   p.DecimalSeparator,
+		ThousandsSeparator: p.ThousandsSeparator,
+		CSVDelimiter:       p.CSVDelimiter,
+		CSVQuote:           p.CSVQuote,
+		CSVHeader:          p.CSVHeader,
+		Samples:            p.Samples,
+		Conditions:         p.Conditions,
+	}
+	defer func() {
+		if err != nil {
+			codegen.Release(obj)
+		}
+	}()
+	for _, i := range p.Program {
+		if i.Opcode < 0 || i.Opcode >= len(opcodes) {
+			return nil, errors.Errorf("%s: instruction with unknown opcode %d", p.Name, i.Opcode)
+		}
+		obj.Program = append(obj.Program, code.Instr{Opcode: opcodes[i.Opcode], Operand: i.Operand, SourceLine: i.SourceLine})
+	}
+	for i, pattern := range p.Regexps {
+		if bt, ok := p.Backtracking[i]; ok {
+			re, err := codegen.CompileBacktracking(bt)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s", p.Name)
+			}
+			if obj.Backtracking == nil {
+				obj.Backtracking = make(map[int]*pcre.Regexp)
+			}
+			obj.Backtracking[i] = re
+			obj.Regexps = append(obj.Regexps, nil)
+			continue
+		}
+		re, err := codegen.CompileRegexp(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s", p.Name)
+		}
+		obj.Regexps = append(obj.Regexps, re)
+	}
+	for _, f := range p.Filters {
+		re, err := codegen.CompileRegexp(f.Regexp)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s", p.Name)
+		}
+		obj.Filters = append(obj.Filters, object.Filter{Regexp: re, Negate: f.Negate})
+	}
+	for _, bm := range p.Metrics {
+		m, err := bm.metric()
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s", p.Name)
+		}
+		obj.Metrics = append(obj.Metrics, m)
+	}
+	return obj, nil
+}
+
+// metric creates the declared metric, with the storage of scalar counters
+// and histograms allocated, and counters zeroed, as the code generator does.
+func (bm *bundledMetric) metric() (*metrics.Metric, error) {
+	m := metrics.NewMetric(bm.Name, bm.Program, bm.Kind, bm.Type, bm.Keys...)
+	m.SetSource(bm.Source)
+	m.Buckets = bm.Buckets
+	m.Hidden = bm.Hidden
+	m.Timestamp = bm.Timestamp
+	m.Limit = bm.Limit
+	m.Window = bm.Window
+	m.Reset = bm.Reset
+	if len(bm.Keys) > 0 || (bm.Kind != metrics.Counter && bm.Kind != metrics.Histogram) {
+		return m, nil
+	}
+	d, err := m.GetDatum()
+	if err != nil {
+		return nil, err
+	}
+	if bm.Kind == metrics.Counter {
+		switch bm.Type {
+		case metrics.Int:
+			datum.SetInt(d, 0, time.Unix(0, 0))
+		case metrics.Float:
+			datum.SetFloat(d, 0, time.Unix(0, 0))
+		}
+	}
+	return m, nil
+}
+
+// openBundle reads the bundle at bundlePath, mapping it into memory rather
+// than copying it where the platform allows.
+func openBundle(bundlePath string) (*bundle, []code.Opcode, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	data, unmap, err := mapBundle(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Decoding copies everything out of the mapping.
+	defer func() {
+		if err := unmap(); err != nil {
+			logging.Warning(err)
+		}
+	}()
+	return readBundle(data)
+}
+
+// loadBundle loads or reloads the programs in the bundle at bundlePath,
+// returning the errors loading them, or the error reading the bundle.
+// Programs loaded before from the bundle that it no longer has are unloaded.
+func (l *Loader) loadBundle(bundlePath string) (loadErr, err error) {
+	bundleName := filepath.Base(bundlePath)
+	b, opcodes, err := openBundle(bundlePath)
+	if err != nil {
+		ProgLoadErrors.Add(bundleName, 1)
+		return nil, errors.Wrapf(err, "Failed to read bundle %q", bundlePath)
+	}
+	logging.Infof("Loading %d programs from bundle %s", len(b.Programs), bundleName)
+
+	present := make(map[string]struct{}, len(b.Programs))
+	for _, p := range b.Programs {
+		present[p.Name] = struct{}{}
+	}
+	l.handleMu.RLock()
+	var gone []string
+	for name, from := range l.bundled {
+		if _, ok := present[name]; from == bundleName && !ok {
+			gone = append(gone, name)
+		}
+	}
+	l.handleMu.RUnlock()
+	sort.Strings(gone)
+	for _, name := range gone {
+		l.UnloadProgram(name)
+	}
+
+	var failed []string
+	l.programErrorMu.Lock()
+	defer l.programErrorMu.Unlock()
+	for i := range b.Programs {
+		p := &b.Programs[i]
+		err := l.loadBundledProgram(bundleName, p, opcodes)
+		l.programErrors[p.Name] = err
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "\n")), nil
+	}
+	return nil, nil
+}
+
+// loadBundledProgram starts the program p from the bundle called bundleName.
+func (l *Loader) loadBundledProgram(bundleName string, p *bundledProgram, opcodes []code.Opcode) error {
+	obj, err := p.object(opcodes)
+	if err != nil {
+		ProgLoadErrors.Add(p.Name, 1)
+		return errors.Wrapf(err, "loading %s from bundle %s", p.Name, bundleName)
+	}
+	v := New(p.Name, obj, l.syslogUseCurrentYear, l.overrideLocation)
+	return l.run(p.Name, v, p.Source, p.Manifest, bundleName)
+}
+
+// unloadBundle unloads the programs loaded from the bundle called bundleName.
+func (l *Loader) unloadBundle(bundleName string) {
+	l.handleMu.RLock()
+	var names []string
+	for name, from := range l.bundled {
+		if from == bundleName {
+			names = append(names, name)
+		}
+	}
+	l.handleMu.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		l.UnloadProgram(name)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/vm/code"
+)
+
+var bundleTestPrograms = map[string]string{
+	"requests.mtail": `# mtail:version 1.2
+syntax = "v2"
+filter filename =~ /access/
+counter requests_total
+counter requests by code
+histogram latency buckets 1, 2, 4
+text last_path
+/^GET (\S+) (\d+) (\d+)$/ {
+  requests_total++
+  requests[$2]++
+  latency = $3
+  last_path = $1
+  $2 == "500" {
+    del requests["500"] after 1h
+  }
+}
+`,
+	"pcre.mtail": `counter repeated
+/(*PCRE)(\w)\1/ {
+  repeated++
+}
+`,
+}
+
+// writeBundleTestPrograms writes the bundle test programs into dir, and
+// returns their paths.
+func writeBundleTestPrograms(t *testing.T, dir string) []string {
+	t.Helper()
+	var paths []string
+	for name, src := range bundleTestPrograms {
+		pathname := filepath.Join(dir, name)
+		f := testutil.TestOpenFile(t, pathname)
+		testutil.WriteString(t, f, src)
+		testutil.FatalIfErr(t, f.Close())
+		paths = append(paths, pathname)
+	}
+	return paths
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	paths := writeBundleTestPrograms(t, tmpDir)
+
+	var buf bytes.Buffer
+	testutil.FatalIfErr(t, WriteBundle(&buf, paths))
+	b, opcodes, err := readBundle(buf.Bytes())
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, 2, len(b.Programs))
+
+	for _, p := range b.Programs {
+		p := p
+		t.Run(p.Name, func(t *testing.T) {
+			obj, err := p.object(opcodes)
+			testutil.FatalIfErr(t, err)
+			v, err := Compile(p.Name, strings.NewReader(bundleTestPrograms[p.Name]), CompileOptions{})
+			testutil.FatalIfErr(t, err)
+			defer v.release()
+			defer New(p.Name, obj, false, nil).release()
+
+			testutil.ExpectNoDiff(t, v.obj.Program, obj.Program, testutil.AllowUnexported(code.Instr{}))
+			testutil.ExpectNoDiff(t, v.obj.Strings, obj.Strings)
+			testutil.ExpectNoDiff(t, len(v.obj.Regexps), len(obj.Regexps))
+			for i, re := range v.obj.Regexps {
+				// The regular expressions are shared with the compiled program.
+				if re != obj.Regexps[i] || v.obj.Backtracking[i] != obj.Backtracking[i] {
+					t.Errorf("regexp %d not shared with the compiled program", i)
+				}
+			}
+			testutil.ExpectNoDiff(t, len(v.obj.Metrics), len(obj.Metrics))
+			for i, m := range v.obj.Metrics {
+				testutil.ExpectNoDiff(t, m, obj.Metrics[i], testutil.IgnoreUnexported(sync.RWMutex{}))
+			}
+		})
+	}
+}
+
+func TestLoadBundle(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	paths := writeBundleTestPrograms(t, tmpDir)
+	progDir := filepath.Join(tmpDir, "progs")
+	testutil.FatalIfErr(t, os.Mkdir(progDir, 0700))
+	bundlePath := filepath.Join(progDir, "all.mtailc")
+	f := testutil.TestOpenFile(t, bundlePath)
+	testutil.FatalIfErr(t, WriteBundle(f, paths))
+	testutil.FatalIfErr(t, f.Close())
+
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, progDir, store, ErrorsAbort())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+
+	for _, line := range []string{"GET /a 200 3", "GET /b 500 1", "aa"} {
+		l.ProcessLogLine(ctx, logline.New(ctx, "/var/log/access.log", line))
+	}
+	for name, expected := range map[string]string{"requests_total": "2", "repeated": "3", "last_path": "/b"} {
+		d, err := store.Metrics[name][0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		testutil.ExpectNoDiff(t, expected, d.ValueString())
+	}
+	status := l.ProgramStatuses()
+	testutil.ExpectNoDiff(t, 2, len(status))
+	testutil.ExpectNoDiff(t, "1.2", status[1].Version)
+
+	// Reloading keeps the bundled programs, and they go with the bundle.
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+	testutil.ExpectNoDiff(t, 2, len(l.ProgramStatuses()))
+	testutil.FatalIfErr(t, os.Remove(bundlePath))
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+	testutil.ExpectNoDiff(t, 0, len(l.ProgramStatuses()))
+}
+
+func TestWriteBundleErrors(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	bad := filepath.Join(tmpDir, "bad.mtail")
+	f := testutil.TestOpenFile(t, bad)
+	testutil.WriteString(t, f, "counter a\n/(/ {\n  a++\n}\n")
+	testutil.FatalIfErr(t, f.Close())
+	var buf bytes.Buffer
+	if err := WriteBundle(&buf, []string{bad}); err == nil {
+		t.Error("expected an error bundling a program that doesn't compile")
+	}
+	testutil.ExpectNoDiff(t, 0, buf.Len())
+}
+
+func TestReadBundleErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+	}{
+		{"not a bundle", "counter a\n"},
+		{"truncated", bundleMagic + "\x01"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := readBundle([]byte(tc.data)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
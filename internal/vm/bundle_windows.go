@@ -0,0 +1,19 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// mapBundle reads the contents of the bundle f, as they aren't mapped into
+// memory on Windows, and returns them with a function that does nothing.
+func mapBundle(f *os.File) ([]byte, func() error, error) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
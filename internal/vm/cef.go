@@ -0,0 +1,192 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The names of the header fields of CEF and LEEF events, in order.  The
+// extension or attribute fields are named by their keys.
+var (
+	cefHeader  = []string{"version", "deviceVendor", "deviceProduct", "deviceVersion", "deviceEventClassId", "name", "severity"}
+	leefHeader = []string{"version", "vendor", "product", "productVersion", "eventId"}
+)
+
+// securityEvent memoizes the fields of the event last decoded by the cef or
+// leef builtins, as a program usually reads several fields of each.
+type securityEvent struct {
+	format string // "CEF" or "LEEF".
+	text   string
+	fields map[string]string
+}
+
+// eventField returns the field called name of the event in the CEF or LEEF
+// format in s, or the empty string if there is no such field.  The event may
+// follow other text, like a syslog header.
+func (v *VM) eventField(format, s, name string) (string, error) {
+	e := v.lastEvent
+	if e == nil || e.format != format || e.text != s {
+		var fields map[string]string
+		var err error
+		if format == "CEF" {
+			fields, err = parseCEF(s)
+		} else {
+			fields, err = parseLEEF(s)
+		}
+		if err != nil {
+			return "", err
+		}
+		e = &securityEvent{format: format, text: s, fields: fields}
+		v.lastEvent = e
+	}
+	return e.fields[name], nil
+}
+
+// splitHeader splits the first n fields, separated by unescaped pipes, off the
+// event s after its prefix, and returns them unescaped with the rest of s.
+func splitHeader(format, s string, n int) ([]string, string, error) {
+	start := strings.Index(s, format+":")
+	if start < 0 {
+		return nil, "", errors.Errorf("no %s event in %q", format, s)
+	}
+	s = s[start+len(format)+1:]
+	var fields []string
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && (s[i+1] == '|' || s[i+1] == '\\'):
+			i++
+			b.WriteByte(s[i])
+		case s[i] == '|':
+			fields = append(fields, b.String())
+			b.Reset()
+			if len(fields) == n {
+				return fields, s[i+1:], nil
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return nil, "", errors.Errorf("%s event has %d of its %d header fields: %q", format, len(fields), n, s)
+}
+
+// parseCEF returns the fields of the ArcSight Common Event Format event in s.
+// The extension is a list of key=value pairs separated by spaces, where values
+// may contain spaces and escape = and backslash, and newlines as \n or \r.
+func parseCEF(s string) (map[string]string, error) {
+	header, ext, err := splitHeader("CEF", s, len(cefHeader))
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string)
+	// Each unescaped = ends a key, which starts after the last space before it.
+	var keys []int // Offsets of the starts of the keys, and after them their =.
+	for i := 0; i < len(ext); i++ {
+		switch ext[i] {
+		case '\\':
+			i++
+		case '=':
+			k := strings.LastIndexByte(ext[:i], ' ') + 1
+			if k < i {
+				keys = append(keys, k, i)
+			}
+		}
+	}
+	for j := 0; j < len(keys); j += 2 {
+		end := len(ext)
+		if j+2 < len(keys) {
+			end = keys[j+2]
+		}
+		fields[ext[keys[j]:keys[j+1]]] = unescapeCEF(strings.TrimRight(ext[keys[j+1]+1:end], " "))
+	}
+	for i, name := range cefHeader {
+		fields[name] = header[i]
+	}
+	fields["version"] = strings.TrimSpace(fields["version"])
+	return fields, nil
+}
+
+// unescapeCEF returns the CEF extension value s unescaped.
+func unescapeCEF(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// parseLEEF returns the fields of the IBM QRadar Log Event Extended Format
+// event in s.  The attributes are key=value pairs separated by tabs, or in
+// LEEF 2.0 by the delimiter given after the header, as a character or its hex
+// code like x5E.
+func parseLEEF(s string) (map[string]string, error) {
+	header, attrs, err := splitHeader("LEEF", s, len(leefHeader))
+	if err != nil {
+		return nil, err
+	}
+	delim := "\t"
+	if strings.HasPrefix(strings.TrimSpace(header[0]), "2") {
+		i := strings.IndexByte(attrs, '|')
+		if i < 0 {
+			return nil, errors.Errorf("LEEF 2.0 event has no attribute delimiter: %q", s)
+		}
+		delim, err = leefDelimiter(attrs[:i])
+		if err != nil {
+			return nil, err
+		}
+		attrs = attrs[i+1:]
+	}
+	fields := make(map[string]string)
+	for _, attr := range strings.Split(attrs, delim) {
+		i := strings.IndexByte(attr, '=')
+		if i <= 0 {
+			continue
+		}
+		fields[strings.TrimSpace(attr[:i])] = attr[i+1:]
+	}
+	for i, name := range leefHeader {
+		fields[name] = header[i]
+	}
+	fields["version"] = strings.TrimSpace(fields["version"])
+	return fields, nil
+}
+
+// leefDelimiter returns the attribute delimiter written d in a LEEF 2.0
+// header.  An empty delimiter is a tab.
+func leefDelimiter(d string) (string, error) {
+	switch {
+	case d == "":
+		return "\t", nil
+	case len(d) == 1:
+		return d, nil
+	}
+	hex := strings.TrimPrefix(strings.ToLower(d), "0")
+	if !strings.HasPrefix(hex, "x") {
+		return "", errors.Errorf("invalid LEEF attribute delimiter %q", d)
+	}
+	n, err := strconv.ParseUint(hex[1:], 16, 8)
+	if err != nil {
+		return "", errors.Errorf("invalid LEEF attribute delimiter %q", d)
+	}
+	return string(rune(n)), nil
+}
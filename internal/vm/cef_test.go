@@ -0,0 +1,107 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestParseCEF(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected map[string]string
+	}{
+		{`Oct 14 12:00:01 fw1 CEF:0|Acme|Fire\|wall|1.0|100|Port scan|7|src=10.0.0.1 msg=saw a\=b and c\\d\nend act=blocked`,
+			map[string]string{
+				"version":            "0",
+				"deviceVendor":       "Acme",
+				"deviceProduct":      "Fire|wall",
+				"deviceVersion":      "1.0",
+				"deviceEventClassId": "100",
+				"name":               "Port scan",
+				"severity":           "7",
+				"src":                "10.0.0.1",
+				"msg":                "saw a=b and c\\d\nend",
+				"act":                "blocked",
+			}},
+		{`CEF:1|a|b|c|d|e|Low|`,
+			map[string]string{
+				"version":            "1",
+				"deviceVendor":       "a",
+				"deviceProduct":      "b",
+				"deviceVersion":      "c",
+				"deviceEventClassId": "d",
+				"name":               "e",
+				"severity":           "Low",
+			}},
+	} {
+		got, err := parseCEF(tc.input)
+		testutil.FatalIfErr(t, err)
+		testutil.ExpectNoDiff(t, tc.expected, got)
+	}
+}
+
+func TestParseLEEF(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected map[string]string
+	}{
+		{"LEEF:1.0|Acme|IDS|2.1|login|usrName=bob\tsrc=10.0.0.1\tmsg=a=b",
+			map[string]string{
+				"version":        "1.0",
+				"vendor":         "Acme",
+				"product":        "IDS",
+				"productVersion": "2.1",
+				"eventId":        "login",
+				"usrName":        "bob",
+				"src":            "10.0.0.1",
+				"msg":            "a=b",
+			}},
+		{"LEEF:2.0|Acme|IDS|2.1|login|^|usrName=bob^sev=5",
+			map[string]string{
+				"version":        "2.0",
+				"vendor":         "Acme",
+				"product":        "IDS",
+				"productVersion": "2.1",
+				"eventId":        "login",
+				"usrName":        "bob",
+				"sev":            "5",
+			}},
+		{"LEEF:2.0|Acme|IDS|2.1|login|0x7C|usrName=bob|sev=5",
+			map[string]string{
+				"version":        "2.0",
+				"vendor":         "Acme",
+				"product":        "IDS",
+				"productVersion": "2.1",
+				"eventId":        "login",
+				"usrName":        "bob",
+				"sev":            "5",
+			}},
+	} {
+		got, err := parseLEEF(tc.input)
+		testutil.FatalIfErr(t, err)
+		testutil.ExpectNoDiff(t, tc.expected, got)
+	}
+}
+
+func TestParseSecurityEventErrors(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		parse    func(string) (map[string]string, error)
+		expected string
+	}{
+		{"a plain log line", parseCEF, `no CEF event in "a plain log line"`},
+		{"CEF:0|Acme|Firewall", parseCEF, `CEF event has 2 of its 7 header fields: "0|Acme|Firewall"`},
+		{"LEEF:2.0|Acme|IDS|2.1|login|xZZ|a=b", parseLEEF, `invalid LEEF attribute delimiter "xZZ"`},
+	} {
+		_, err := tc.parse(tc.input)
+		if err == nil {
+			t.Errorf("%q: expected an error", tc.input)
+			continue
+		}
+		testutil.ExpectNoDiff(t, tc.expected, err.Error())
+	}
+}
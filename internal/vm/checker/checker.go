@@ -5,15 +5,19 @@ package checker
 
 import (
 	"fmt"
+	"regexp"
 	"regexp/syntax"
 	"strings"
 	"time"
+	"unicode/utf8"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/vm/ast"
 	"github.com/google/mtail/internal/vm/errors"
+	"github.com/google/mtail/internal/vm/grok"
 	"github.com/google/mtail/internal/vm/parser"
+	"github.com/google/mtail/internal/vm/pcre"
 	"github.com/google/mtail/internal/vm/symbol"
 	"github.com/google/mtail/internal/vm/types"
 )
@@ -25,20 +29,44 @@ type checker struct {
 	scope *symbol.Scope // the current scope
 
 	decoScopes []*symbol.Scope // A stack of scopes used for resolving symbols in decorated nodes
+	decoInsts  []*ast.DecoDecl // A stack of decorator templates being instantiated
 
 	errors errors.ErrorList
 
 	depth   int
 	tooDeep bool
+
+	separators map[string]string // The number separators set by pragmas, by pragma name.
+	csvChars   map[string]string // The csv delimiter and quote, by pragma name, once either is set.
+
+	regexPragmas map[string]bool // The pragmas that change how regular expressions are compiled.
+
+	grok    grok.Library // The grok patterns, once a pattern has referred to one.
+	grokErr error        // The error loading the grok patterns, if any.
+
+	externConsts map[string]string // The values of the extern consts given to the checker, by name.
+
+	summaries  map[*symbol.Symbol]metrics.Kind // The metrics that summarise the values assigned to them, by symbol.
+	summaryIds []*ast.IdTerm                   // The uses of those metrics, which must be assigned to by the end.
 }
 
 // Check performs a semantic check of the astNode, and returns a potentially
 // modified astNode and either a list of errors found, or nil if the program is
 // semantically valid.  At the completion of Check, the symbol table and type
 // annotation are also complete.
-func Check(node ast.Node) (ast.Node, error) {
-	c := &checker{}
+func Check(node ast.Node, options ...Option) (ast.Node, error) {
+	c := &checker{regexPragmas: findRegexPragmas(node), summaries: make(map[*symbol.Symbol]metrics.Kind)}
+	for _, option := range options {
+		option(c)
+	}
 	node = ast.Walk(c, node)
+	// Whether a metric is assigned to is only known once the expression
+	// around it has been checked.
+	for _, id := range c.summaryIds {
+		if !id.Lvalue {
+			c.errors.Add(id.Pos(), fmt.Sprintf("Can't read the value of %s metric `%s'.", c.summaryKind(id), id.Name))
+		}
+	}
 	if len(c.errors) > 0 {
 		return node, c.errors
 	}
@@ -61,13 +89,13 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.StmtList:
 		n.Scope = symbol.NewScope(c.scope)
 		c.scope = n.Scope
-		glog.V(2).Infof("Created new scope %v in stmtlist", n.Scope)
+		logging.V(2).Infof("Created new scope %v in stmtlist", n.Scope)
 		return c, n
 
 	case *ast.CondStmt:
 		n.Scope = symbol.NewScope(c.scope)
 		c.scope = n.Scope
-		glog.V(2).Infof("Created new scope %v in condstmt", n.Scope)
+		logging.V(2).Infof("Created new scope %v in condstmt", n.Scope)
 		return c, n
 
 	case *ast.CaprefTerm:
@@ -84,7 +112,7 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 				c.depth--
 				return nil, n
 			}
-			glog.V(2).Infof("Found %q as %v in scope %v", n.Name, sym, c.scope)
+			logging.V(2).Infof("Found %q as %v in scope %v", n.Name, sym, c.scope)
 			sym.Used = true
 			n.Symbol = sym
 		}
@@ -99,7 +127,7 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		}
 		var rType types.Type
 		switch n.Kind {
-		case metrics.Counter, metrics.Gauge, metrics.Timer, metrics.Histogram:
+		case metrics.Counter, metrics.Gauge, metrics.Timer, metrics.Histogram, metrics.TopK, metrics.Distinct, metrics.Min, metrics.Max, metrics.Avg:
 			// TODO(jaq): This should be a numeric type, unless we want to
 			// enforce more specific rules like "Counter can only be Int."
 			rType = types.NewVariable()
@@ -115,6 +143,32 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			c.depth--
 			return nil, n
 		}
+		if n.Window > 0 && n.Kind != metrics.Distinct {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Can't specify a window for non-distinct metric `%s'.", n.Name))
+			c.depth--
+			return nil, n
+		}
+		if n.Reset > 0 {
+			switch n.Kind {
+			case metrics.Counter, metrics.Gauge, metrics.Timer, metrics.Histogram, metrics.Min, metrics.Max, metrics.Avg:
+			default:
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't reset a %s metric `%s'.", strings.ToLower(n.Kind.String()), n.Name))
+				c.depth--
+				return nil, n
+			}
+		}
+		switch n.Kind {
+		case metrics.Distinct, metrics.Min, metrics.Max, metrics.Avg:
+			c.summaries[n.Symbol] = n.Kind
+		}
+		if n.Kind == metrics.TopK {
+			if n.Limit <= 0 {
+				c.errors.Add(n.Pos(), fmt.Sprintf("A topk metric must keep at least one value, not %d, in `%s'.", n.Limit, n.Name))
+			}
+			if len(n.Keys) == 0 {
+				c.errors.Add(n.Pos(), fmt.Sprintf("A topk metric needs keys to count the values of, in `%s'.", n.Name))
+			}
+		}
 		if len(n.Keys) > 0 {
 			// One type per key
 			keyTypes := make([]types.Type, 0, len(n.Keys))
@@ -132,11 +186,18 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.IdTerm:
 		if n.Symbol == nil {
 			if sym := c.scope.Lookup(n.Name, symbol.VarSymbol); sym != nil {
-				glog.V(2).Infof("found varsymbol sym %v", sym)
+				logging.V(2).Infof("found varsymbol sym %v", sym)
 				sym.Used = true
 				n.Symbol = sym
+				if _, ok := c.summaries[sym]; ok {
+					c.summaryIds = append(c.summaryIds, n)
+				}
 			} else if sym := c.scope.Lookup(n.Name, symbol.PatternSymbol); sym != nil {
-				glog.V(2).Infof("Found patternsymbol Sym %v", sym)
+				logging.V(2).Infof("Found patternsymbol Sym %v", sym)
+				sym.Used = true
+				n.Symbol = sym
+			} else if sym := c.scope.Lookup(n.Name, symbol.ExternSymbol); sym != nil {
+				logging.V(2).Infof("Found externsymbol Sym %v", sym)
 				sym.Used = true
 				n.Symbol = sym
 			} else {
@@ -162,6 +223,14 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			c.depth--
 			return nil, n
 		}
+		// Decorators loaded from a library module are not required to be used.
+		n.Symbol.Used = n.Module != ""
+		if len(n.Params) > 0 {
+			// A parameterised decorator is a template; its block is checked
+			// each time it is instantiated with arguments.
+			c.depth--
+			return nil, n
+		}
 		// Append a scope placeholder for the recursion into the block.  It has no parent, it'll be cloned when the decorator is instantiated.
 		c.decoScopes = append(c.decoScopes, symbol.NewScope(nil))
 		return c, n
@@ -180,17 +249,37 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			c.depth--
 			return nil, n
 		}
-		// Create a new scope for the decorator instantiation.
-		n.Scope = symbol.NewScope(c.scope)
-
 		if n.Decl == nil {
-			glog.V(2).Infof("No DecoDecl on DecoStmt: %v", n)
+			logging.V(2).Infof("No DecoDecl on DecoStmt: %v", n)
 			c.errors.Add(n.Pos(), fmt.Sprintf("Internal error: no declaration for decorator: %#v", n))
 			c.depth--
 			return nil, n
 		}
+		var args []ast.Node
+		if n.Args != nil {
+			args = n.Args.(*ast.ExprList).Children
+		}
+		if len(args) != len(n.Decl.Params) {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Decorator `@%s' takes %d arguments, but %d were given.", n.Name, len(n.Decl.Params), len(args)))
+			c.depth--
+			return nil, n
+		}
+		if len(args) > 0 {
+			for _, d := range c.decoInsts {
+				if d == n.Decl {
+					c.errors.Add(n.Pos(), fmt.Sprintf("Decorator `@%s' is not completely defined yet.\n\tTry removing @%s from here.", n.Name, n.Name))
+					c.depth--
+					return nil, n
+				}
+			}
+			n.Decl = c.instantiateDecorator(n.Decl, args)
+		}
+
+		// Create a new scope for the decorator instantiation.
+		n.Scope = symbol.NewScope(c.scope)
+
 		if n.Decl.Scope == nil {
-			glog.V(2).Infof("No Scope on DecoDecl: %#v", n.Decl)
+			logging.V(2).Infof("No Scope on DecoDecl: %#v", n.Decl)
 			c.errors.Add(n.Pos(), fmt.Sprintf("Decorator `@%s' is not completely defined yet.\n\tTry removing @%s from here.", n.Name, n.Name))
 			c.depth--
 			return nil, n
@@ -218,13 +307,149 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		n.Symbol.Type = types.Pattern
 		return c, n
 
+	case *ast.ExternConst:
+		id, ok := n.Id.(*ast.IdTerm)
+		if !ok {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Internal error: no identifier attached to extern const %#v", n))
+			c.depth--
+			return nil, n
+		}
+		if c.scope.Parent != nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Extern const `%s' must be declared at the top level of the program.", id.Name))
+			c.depth--
+			return nil, n
+		}
+		n.Symbol = symbol.NewSymbol(id.Name, symbol.ExternSymbol, id.Pos())
+		if alt := c.scope.Insert(n.Symbol); alt != nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of extern const `%s' previously declared at %s", id.Name, alt.Pos))
+			c.depth--
+			return nil, n
+		}
+		n.Symbol.Binding = n
+		n.Symbol.Type = types.String
+		v, ok := c.externValue(id.Name)
+		if !ok {
+			c.errors.Add(n.Pos(), fmt.Sprintf("No value given for extern const `%s'.\n\tTry running mtail with --extern_consts %s=..., or with %s%s set in its environment.", id.Name, id.Name, externEnvPrefix, id.Name))
+		}
+		n.Value = v
+		c.depth--
+		return nil, n
+
 	case *ast.DelStmt:
 		n.N = ast.Walk(c, n.N)
 		return c, n
+
+	case *ast.PragmaStmt:
+		if c.scope.Parent != nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Pragma `%s' must be at the top level of the program.", n.Name))
+			return c, n
+		}
+		switch n.Name {
+		case "strict", "case_insensitive", "unicode_classes", "csv_header":
+			if n.Value != "" {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Pragma `%s' takes no value, but got %q.", n.Name, n.Value))
+			}
+		case "decimal_separator", "thousands_separator":
+			c.checkSeparator(n)
+		case "csv_delimiter", "csv_quote":
+			c.checkCSVPragma(n)
+		case "syntax":
+			// The version is checked by the parser, which depends on it.
+		default:
+			c.errors.Add(n.Pos(), fmt.Sprintf("Unknown pragma `%s'.", n.Name))
+		}
+		return c, n
+
+	case *ast.SampleStmt:
+		if n.Mode != "" && n.Mode != "random" {
+			c.errors.Add(&n.P, fmt.Sprintf("Unknown sample mode `%s', expecting `random'.", n.Mode))
+		}
+		if n.Num != 1 || n.Rate < 1 {
+			c.errors.Add(&n.P, fmt.Sprintf("Sample rate must be 1/N for a positive N, but got %d/%d.", n.Num, n.Rate))
+		}
+		return c, n
+
+	case *ast.FilterStmt:
+		if c.scope.Parent != nil {
+			c.errors.Add(n.Pos(), "Filter must be at the top level of the program.")
+			return c, n
+		}
+		if n.Subject != "filename" {
+			c.errors.Add(&n.P, fmt.Sprintf("Can't filter on `%s', expecting `filename'.", n.Subject))
+			return c, n
+		}
+		return c, n
 	}
 	return c, node
 }
 
+// instantiateDecorator binds the arguments to the parameters of the
+// decorator template decl, and checks the resulting block as if it were a
+// normal decorator definition.  The returned declaration is private to the
+// decoration statement that instantiated it.
+func (c *checker) instantiateDecorator(decl *ast.DecoDecl, args []ast.Node) *ast.DecoDecl {
+	b := &paramBinder{args: make(map[string]ast.Node, len(args))}
+	for i, p := range decl.Params {
+		b.args[p] = args[i]
+	}
+	inst := &ast.DecoDecl{P: decl.P, Name: decl.Name, Symbol: decl.Symbol, Module: decl.Module}
+	inst.Block = ast.Walk(b, ast.Copy(decl.Block))
+
+	c.decoInsts = append(c.decoInsts, decl)
+	c.decoScopes = append(c.decoScopes, symbol.NewScope(nil))
+	inst.Block = ast.Walk(c, inst.Block)
+	c.decoInsts = c.decoInsts[:len(c.decoInsts)-1]
+	last := len(c.decoScopes) - 1
+	decoScope := c.decoScopes[last]
+	if len(decoScope.Symbols) == 0 {
+		c.errors.Add(inst.Pos(), fmt.Sprintf("No symbols found in decorator `@%s'.\n\tTry adding a `next' statement inside the `{}' block.", inst.Name))
+	}
+	inst.Scope = decoScope
+	c.decoScopes = c.decoScopes[:last]
+	return inst
+}
+
+// paramBinder replaces references to decorator parameters with copies of the
+// literal arguments they are bound to.
+type paramBinder struct {
+	args map[string]ast.Node
+}
+
+func (b *paramBinder) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
+	switch n := node.(type) {
+	case *ast.IndexedExpr:
+		// A bare identifier in an expression is parsed as an unindexed expression.
+		if id, ok := n.Lhs.(*ast.IdTerm); ok && len(n.Index.(*ast.ExprList).Children) == 0 {
+			if arg, ok := b.args[id.Name]; ok {
+				return nil, ast.Copy(arg)
+			}
+		}
+	case *ast.IdTerm:
+		if arg, ok := b.args[n.Name]; ok {
+			return nil, ast.Copy(arg)
+		}
+	}
+	return b, node
+}
+
+func (b *paramBinder) VisitAfter(node ast.Node) ast.Node {
+	return node
+}
+
+// summaryKind returns the kind of the metric named by id, with its article,
+// if the metric summarises the values assigned to it and so can only be
+// assigned to, or the empty string otherwise.
+func (c *checker) summaryKind(id *ast.IdTerm) string {
+	k, ok := c.summaries[id.Symbol]
+	if !ok {
+		return ""
+	}
+	if k == metrics.Avg {
+		return "an avg"
+	}
+	return "a " + strings.ToLower(k.String())
+}
+
 // checkSymbolUsage emits errors if any eligible symbols in the current scope
 // are not marked as used.
 func (c *checker) checkSymbolUsage() {
@@ -238,7 +463,7 @@ func (c *checker) checkSymbolUsage() {
 					// Don't warn about the zeroth capture group; it's not user-defined.
 					continue
 				}
-				glog.Infof("declaration of capture group reference `%s' at %s appears to be unused", sym.Name, sym.Pos)
+				logging.Infof("declaration of capture group reference `%s' at %s appears to be unused", sym.Name, sym.Pos)
 				continue
 			}
 			c.errors.Add(sym.Pos, fmt.Sprintf("Declaration of %s `%s' here is never used.", sym.Kind, sym.Name))
@@ -409,20 +634,20 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				conv := &ast.ConvExpr{N: n.Lhs}
 				conv.SetType(t)
 				n.Lhs = conv
-				glog.V(2).Infof("Emitting convnode %#v on %#v", conv, n)
+				logging.V(2).Infof("Emitting convnode %#v on %#v", conv, n)
 			}
 			if !types.Equals(t, rT) {
 				conv := &ast.ConvExpr{N: n.Rhs}
 				conv.SetType(t)
 				n.Rhs = conv
-				glog.V(2).Infof("Emitting convnode %+v", conv)
+				logging.V(2).Infof("Emitting convnode %+v", conv)
 			}
 
 		case parser.ASSIGN, parser.ADD_ASSIGN:
 			// O ⊢ e1 : Tl, O ⊢ e2 : Tr
 			// Tr <= Tl
 			// ⇒ O ⊢ e : Tl
-			glog.V(2).Infof("lt %q, rt %q", lT, rT)
+			logging.V(2).Infof("lt %q, rt %q", lT, rT)
 			rType = lT
 			// TODO(jaq): the rT <= lT relationship is not correctly encoded here.
 			t := types.LeastUpperBound(lT, rT)
@@ -433,17 +658,24 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				n.SetType(types.Error)
 				return n
 			}
+			var id *ast.IdTerm
 			switch v := n.Lhs.(type) {
 			case *ast.IdTerm:
-				v.Lvalue = true
+				id = v
 			case *ast.IndexedExpr:
-				v.Lhs.(*ast.IdTerm).Lvalue = true
+				id = v.Lhs.(*ast.IdTerm)
 			default:
-				glog.V(2).Infof("The lhs is a %T %v", n.Lhs, n.Lhs)
+				logging.V(2).Infof("The lhs is a %T %v", n.Lhs, n.Lhs)
 				c.errors.Add(n.Lhs.Pos(), "Can't assign to this expression on the left.")
 				n.SetType(types.Error)
 				return n
 			}
+			id.Lvalue = true
+			if k := c.summaryKind(id); n.Op == parser.ADD_ASSIGN && k != "" {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't add to %s metric `%s'.\n\tTry assigning each value to it with `='.", k, id.Name))
+				n.SetType(types.Error)
+				return n
+			}
 
 		case parser.CONCAT:
 			rType = types.Pattern
@@ -498,17 +730,28 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 			n.SetType(rType)
 		case parser.INC, parser.DEC:
 			// First check what sort of expression it is
+			var id *ast.IdTerm
 			switch v := n.Expr.(type) {
 			case *ast.IdTerm:
-				v.Lvalue = true
+				id = v
 			case *ast.IndexedExpr:
-				v.Lhs.(*ast.IdTerm).Lvalue = true
+				id = v.Lhs.(*ast.IdTerm)
 			default:
-				glog.V(2).Infof("the expr is a %T %v", n.Expr, n.Expr)
+				logging.V(2).Infof("the expr is a %T %v", n.Expr, n.Expr)
 				c.errors.Add(n.Expr.Pos(), "Expecting a variable here.")
 				n.SetType(types.Error)
 				return n
 			}
+			id.Lvalue = true
+			if k := c.summaryKind(id); k != "" {
+				verb := "increment"
+				if n.Op == parser.DEC {
+					verb = "decrement"
+				}
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't %s %s metric `%s'.\n\tTry assigning each value to it with `='.", verb, k, id.Name))
+				n.SetType(types.Error)
+				return n
+			}
 			rType := types.Int
 			err := types.Unify(rType, t)
 			if err != nil {
@@ -522,7 +765,7 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				n.SetType(types.Error)
 				return n
 			}
-			glog.V(2).Infof("Return type is %v", rType)
+			logging.V(2).Infof("Return type is %v", rType)
 			n.SetType(rType)
 
 		default:
@@ -577,12 +820,23 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				return ast.Walk(c, &ast.PatternExpr{Expr: v})
 			}
 
+			if v.Symbol.Kind == symbol.ExternSymbol {
+				if len(argTypes) > 0 {
+					c.errors.Add(n.Pos(), fmt.Sprintf("Index taken on unindexable expression"))
+					n.SetType(types.Error)
+					return n
+				}
+				// The value of an extern const is known now, so the constant
+				// is replaced by it.
+				return &ast.StringLit{P: v.P, Text: v.Symbol.Binding.(*ast.ExternConst).Value}
+			}
+
 			if t, ok := v.Type().(*types.Operator); ok && types.IsDimension(t) {
-				glog.V(1).Infof("Our idNode is a dimension type")
+				logging.V(1).Infof("Our idNode is a dimension type")
 				// TODO: should this call n.SetType like below?
 			} else {
 				if len(argTypes) > 0 {
-					glog.V(1).Infof("Our idNode is not a dimension type")
+					logging.V(1).Infof("Our idNode is not a dimension type")
 					n.SetType(types.Error)
 					c.errors.Add(n.Pos(), fmt.Sprintf("Index taken on unindexable expression"))
 				} else {
@@ -637,6 +891,14 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 
 		fn := types.Function(typs...)
 		fresh := types.FreshType(types.Builtins[n.Name])
+		if n.Name == "exec" && len(typs) > 2 {
+			// exec takes the command name and any number of string arguments.
+			args := make([]types.Type, 0, len(typs))
+			for range typs[1:] {
+				args = append(args, types.String)
+			}
+			fresh = types.Function(append(args, types.None)...)
+		}
 		err := types.Unify(fresh, fn)
 		if err != nil {
 			c.errors.Add(n.Pos(), fmt.Sprintf("call to `%s': %s", n.Name, err))
@@ -661,10 +923,10 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				// won't parse themselves.  Zulu Timezones in the layout need
 				// to be converted to offset in the parsed time.
 				timeStr := strings.Replace(strings.Replace(f.Text, "_", "", -1), "Z", "+", -1)
-				glog.V(2).Infof("time_str is %q", timeStr)
+				logging.V(2).Infof("time_str is %q", timeStr)
 				_, err := time.Parse(f.Text, timeStr)
 				if err != nil {
-					glog.Infof("time.Parse(%q, %q) failed: %s", f.Text, timeStr, err)
+					logging.Infof("time.Parse(%q, %q) failed: %s", f.Text, timeStr, err)
 					c.errors.Add(f.Pos(), fmt.Sprintf("invalid time format string %q\n\tRefer to the documentation at https://golang.org/pkg/time/#pkg-constants for advice.", f.Text))
 					n.SetType(types.Error)
 					return n
@@ -674,6 +936,15 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				return n
 			}
 
+		case "exec":
+			// The command must be known at compile time, so that a program
+			// can't be made to run a different one by its log.
+			if _, ok := n.Args.(*ast.ExprList).Children[0].(*ast.StringLit); !ok {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), "Expecting a string literal command name for argument 1 of exec().")
+				n.SetType(types.Error)
+				return n
+			}
+
 		case "tolower":
 			if !types.Equals(fn.Args[0], types.String) {
 				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), fmt.Sprintf("Expecting a String for argument 1 of tolower(), not %v.", fn.Args[0]))
@@ -691,7 +962,58 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 			return n
 		}
 		n.Pattern = pe.pattern.String()
-		c.checkRegex(n.Pattern, n)
+		// The limit is on the pattern as written, as grok patterns from the
+		// library expand to long ones.
+		if plen := len(n.Pattern); plen > kMaxRegexpLen {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Exceeded maximum regular expression pattern length of %d bytes with %d.\n\tExcessively long patterns are likely to cause compilation and runtime performance problems.", kMaxRegexpLen, plen))
+			return n
+		}
+		var fieldTypes map[string]types.Type
+		if strings.Contains(n.Pattern, "%{") {
+			lib, err := c.grokLibrary()
+			if err != nil {
+				c.errors.Add(n.Pos(), err.Error())
+				return n
+			}
+			n.Pattern, fieldTypes, err = lib.Expand(n.Pattern)
+			if err != nil {
+				c.errors.Add(n.Pos(), err.Error())
+				return n
+			}
+		}
+		if c.regexPragmas["unicode_classes"] {
+			p, bad := unicodeClasses(n.Pattern)
+			if bad != "" {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't make the negated class `%s' match Unicode characters inside a character class.\n\tTry writing the class out with `\\P{...}' categories.", bad))
+				return n
+			}
+			n.Pattern = p
+		}
+		if c.regexPragmas["case_insensitive"] {
+			if p, ok := pcre.Selected(n.Pattern); ok {
+				n.Pattern = pcre.Marker + "(?i)" + p
+			} else {
+				n.Pattern = "(?i)" + n.Pattern
+			}
+		}
+		c.checkRegex(n.Pattern, n, fieldTypes)
+		return n
+
+	case *ast.FilterStmt:
+		pe := &patternEvaluator{scope: c.scope, errors: &c.errors}
+		n.Pattern = ast.Walk(pe, n.Pattern)
+		if pe.pattern.String() == "" {
+			return n
+		}
+		n.Regexp = pe.pattern.String()
+		if c.regexPragmas["case_insensitive"] {
+			n.Regexp = "(?i)" + n.Regexp
+		}
+		// Filters are matched by the loader, which only uses Go regular
+		// expressions.
+		if _, err := regexp.Compile(n.Regexp); err != nil {
+			c.errors.Add(n.Pos(), err.Error())
+		}
 		return n
 
 	case *ast.PatternFragment:
@@ -719,43 +1041,77 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 	return node
 }
 
+// grokLibrary returns the grok patterns, loading them the first time they're
+// needed.
+func (c *checker) grokLibrary() (grok.Library, error) {
+	if c.grok == nil && c.grokErr == nil {
+		c.grok, c.grokErr = grok.Load()
+	}
+	return c.grok, c.grokErr
+}
+
 // checkRegex is a helper method to compile and check a regular expression, and
-// to generate its capture groups as symbols.
-func (c *checker) checkRegex(pattern string, n ast.Node) {
-	plen := len(pattern)
-	if plen > kMaxRegexpLen {
-		c.errors.Add(n.Pos(), fmt.Sprintf("Exceeded maximum regular expression pattern length of %d bytes with %d.\n\tExcessively long patterns are likely to cause compilation and runtime performance problems.", kMaxRegexpLen, plen))
+// to generate its capture groups as symbols.  The types of named capture
+// groups in fieldTypes override those inferred from the pattern.
+func (c *checker) checkRegex(pattern string, n ast.Node, fieldTypes map[string]types.Type) {
+	var capNames []string
+	var capType func(int) types.Type
+	if p, ok := pcre.Selected(pattern); ok {
+		re, err := pcre.Compile(p)
+		if err != nil {
+			c.errors.Add(n.Pos(), err.Error())
+			return
+		}
+		capNames = re.SubexpNames()
+		capType = func(i int) types.Type { return backtrackingCaprefType(re, i) }
+	} else if reAst, err := syntax.Parse(pattern, syntax.Perl); err == nil {
+		capNames = reAst.CapNames()
+		capType = func(i int) types.Type { return types.InferCaprefType(reAst, i) }
+	} else {
+		c.errors.Add(n.Pos(), err.Error())
 		return
 	}
-	if reAst, err := syntax.Parse(pattern, syntax.Perl); err == nil {
-		// We reserve the names of the capturing groups as declarations
-		// of those symbols, so that future CAPREF tokens parsed can
-		// retrieve their value.  By recording them in the symbol table, we
-		// can warn the user about unknown capture group references.
-		for i, capref := range reAst.CapNames() {
-			sym := symbol.NewSymbol(fmt.Sprintf("%d", i), symbol.CaprefSymbol, n.Pos())
-			sym.Type = types.InferCaprefType(reAst, i)
-			sym.Binding = n
-			sym.Addr = i
-			if alt := c.scope.Insert(sym); alt != nil {
+	// We reserve the names of the capturing groups as declarations
+	// of those symbols, so that future CAPREF tokens parsed can
+	// retrieve their value.  By recording them in the symbol table, we
+	// can warn the user about unknown capture group references.
+	for i, capref := range capNames {
+		sym := symbol.NewSymbol(fmt.Sprintf("%d", i), symbol.CaprefSymbol, n.Pos())
+		sym.Type = capType(i)
+		if t, ok := fieldTypes[capref]; ok && capref != "" {
+			sym.Type = t
+		}
+		sym.Binding = n
+		sym.Addr = i
+		if alt := c.scope.Insert(sym); alt != nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of capture group `%s' previously declared at %s", sym.Name, alt.Pos))
+			// No return, let this loop collect all errors
+		}
+		if capref != "" {
+			sym.Name = capref
+			if alt := c.scope.InsertAlias(sym, capref); alt != nil {
 				c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of capture group `%s' previously declared at %s", sym.Name, alt.Pos))
 				// No return, let this loop collect all errors
 			}
-			if capref != "" {
-				sym.Name = capref
-				if alt := c.scope.InsertAlias(sym, capref); alt != nil {
-					c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of capture group `%s' previously declared at %s", sym.Name, alt.Pos))
-					// No return, let this loop collect all errors
-				}
-			}
-			glog.V(2).Infof("Added capref %v to scope %v", sym, c.scope)
 		}
-	} else {
-		c.errors.Add(n.Pos(), err.Error())
-		return
+		logging.V(2).Infof("Added capref %v to scope %v", sym, c.scope)
 	}
 }
 
+// backtrackingCaprefType infers the type of the i'th capture group of a
+// pattern for the backtracking engine from the group, if RE2 can parse it, and
+// is otherwise String.
+func backtrackingCaprefType(re *pcre.Regexp, i int) types.Type {
+	if i == 0 {
+		return types.None
+	}
+	group, err := syntax.Parse("("+re.SubexpSource(i)+")", syntax.Perl)
+	if err != nil {
+		return types.String
+	}
+	return types.InferCaprefType(group, 1)
+}
+
 // patternEvaluator is a helper that performs concatenation of pattern
 // fragments so that they can be compiled as whole regular expression patterns.
 type patternEvaluator struct {
@@ -780,6 +1136,10 @@ func (p *patternEvaluator) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		if v.Symbol == nil {
 			return nil, n
 		}
+		if ec, ok := v.Symbol.Binding.(*ast.ExternConst); ok {
+			p.pattern.WriteString(ec.Value)
+			return p, v
+		}
 		pf, ok := v.Symbol.Binding.(*ast.PatternFragment)
 		if !ok {
 			p.errors.Add(v.Pos(), fmt.Sprintf("Can't append %s `%s' to this pattern.\n\tTry using a `const'-defined pattern fragment.", v.Symbol.Kind, v.Symbol.Name))
@@ -806,3 +1166,192 @@ func (p *patternEvaluator) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 func (p *patternEvaluator) VisitAfter(n ast.Node) ast.Node {
 	return n
 }
+
+// checkSeparator checks that a number separator pragma names one character
+// that can't be part of a number, and that the decimal and thousands
+// separators differ.
+func (c *checker) checkSeparator(n *ast.PragmaStmt) {
+	if utf8.RuneCountInString(n.Value) != 1 || strings.ContainsAny(n.Value, "0123456789+-eE") {
+		c.errors.Add(n.Pos(), fmt.Sprintf("Pragma `%s' takes one character that is not a digit, sign, or exponent, but got %q.", n.Name, n.Value))
+		return
+	}
+	if c.separators == nil {
+		c.separators = make(map[string]string)
+	}
+	c.separators[n.Name] = n.Value
+	if c.separators["decimal_separator"] == c.separators["thousands_separator"] {
+		c.errors.Add(n.Pos(), fmt.Sprintf("The decimal and thousands separators are both %q.", n.Value))
+	}
+}
+
+// checkCSVPragma checks that a csv pragma names one character, or a tab as
+// \t, and that the delimiter and quote differ.
+func (c *checker) checkCSVPragma(n *ast.PragmaStmt) {
+	v := n.Value
+	if v == `\t` {
+		v = "\t"
+	}
+	if utf8.RuneCountInString(v) != 1 {
+		c.errors.Add(n.Pos(), fmt.Sprintf("Pragma `%s' takes one character, or \\t for a tab, but got %q.", n.Name, n.Value))
+		return
+	}
+	if c.csvChars == nil {
+		c.csvChars = map[string]string{"csv_delimiter": ",", "csv_quote": `"`}
+	}
+	c.csvChars[n.Name] = v
+	if c.csvChars["csv_delimiter"] == c.csvChars["csv_quote"] {
+		c.errors.Add(n.Pos(), fmt.Sprintf("The csv delimiter and quote are both %q.", n.Value))
+	}
+}
+
+// findRegexPragmas returns the pragmas of the program n that change how its
+// regular expressions are compiled, which are found before the program is
+// checked so that they also apply to the patterns that come before them.
+func findRegexPragmas(n ast.Node) map[string]bool {
+	r := make(map[string]bool)
+	if l, ok := n.(*ast.StmtList); ok {
+		for _, s := range l.Children {
+			if p, ok := s.(*ast.PragmaStmt); ok && (p.Name == "case_insensitive" || p.Name == "unicode_classes") {
+				r[p.Name] = true
+			}
+		}
+	}
+	return r
+}
+
+// unicodeClass is the Unicode equivalent of one of the character classes
+// that RE2 matches against ASCII only: the characters in any of the Unicode
+// categories props, or in extra.
+type unicodeClass struct {
+	props []string
+	extra string
+}
+
+var (
+	unicodeWord  = unicodeClass{props: []string{"L", "M", "N", "Pc"}}
+	unicodeSpace = unicodeClass{props: []string{"Z"}, extra: `\t\n\v\f\r\x{85}`}
+)
+
+// perlClasses are the Perl character classes made Unicode aware, and whether
+// each is negated.  \d is left alone, so that captured digits can still be
+// converted to numbers.
+var perlClasses = map[byte]struct {
+	class   unicodeClass
+	negated bool
+}{
+	'w': {unicodeWord, false},
+	'W': {unicodeWord, true},
+	's': {unicodeSpace, false},
+	'S': {unicodeSpace, true},
+}
+
+// posixClasses are the POSIX character classes made Unicode aware.
+var posixClasses = map[string]unicodeClass{
+	"alpha": {props: []string{"L"}},
+	"alnum": {props: []string{"L", "N"}},
+	"lower": {props: []string{"Ll"}},
+	"upper": {props: []string{"Lu"}},
+	"punct": {props: []string{"P"}},
+	"space": unicodeSpace,
+	"word":  unicodeWord,
+}
+
+// pattern returns the regular expression matching the class, or its
+// negation, either on its own or inside a character class.  A negated class
+// of more than one category can't be written inside a character class.
+func (u unicodeClass) pattern(negated, inClass bool) (string, bool) {
+	if inClass && negated {
+		if len(u.props) != 1 || u.extra != "" {
+			return "", false
+		}
+		return `\P{` + u.props[0] + "}", true
+	}
+	var b strings.Builder
+	for _, p := range u.props {
+		b.WriteString(`\p{` + p + "}")
+	}
+	b.WriteString(u.extra)
+	if inClass {
+		return b.String(), true
+	}
+	if negated {
+		return "[^" + b.String() + "]", true
+	}
+	return "[" + b.String() + "]", true
+}
+
+// unicodeClasses rewrites the Perl and POSIX character classes in pattern to
+// match Unicode letters, marks, digits, punctuation, and spaces, rather than
+// only ASCII ones.  If a class can't be rewritten it is returned as bad.
+func unicodeClasses(pattern string) (rewritten, bad string) {
+	var b strings.Builder
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch {
+		case ch == '\\' && i+1 < len(pattern):
+			e := pattern[i+1]
+			if e == 'Q' {
+				// Quoted text is copied as it is, up to the \E.
+				end := strings.Index(pattern[i:], `\E`)
+				if end < 0 {
+					b.WriteString(pattern[i:])
+					return b.String(), ""
+				}
+				b.WriteString(pattern[i : i+end+2])
+				i += end + 1
+				continue
+			}
+			pc, ok := perlClasses[e]
+			if !ok {
+				b.WriteString(pattern[i : i+2])
+				i++
+				continue
+			}
+			s, ok := pc.class.pattern(pc.negated, inClass)
+			if !ok {
+				return "", pattern[i : i+2]
+			}
+			b.WriteString(s)
+			i++
+		case ch == '[' && !inClass:
+			inClass = true
+			b.WriteByte(ch)
+			// A ] straight after the [ or [^ is part of the class.
+			if i+1 < len(pattern) && pattern[i+1] == '^' {
+				b.WriteByte('^')
+				i++
+			}
+			if i+1 < len(pattern) && pattern[i+1] == ']' {
+				b.WriteByte(']')
+				i++
+			}
+		case ch == '[' && inClass && strings.HasPrefix(pattern[i:], "[:"):
+			end := strings.Index(pattern[i:], ":]")
+			if end < 0 {
+				b.WriteByte(ch)
+				continue
+			}
+			name := pattern[i+2 : i+end]
+			negated := strings.HasPrefix(name, "^")
+			u, ok := posixClasses[strings.TrimPrefix(name, "^")]
+			if !ok {
+				b.WriteString(pattern[i : i+end+2])
+				i += end + 1
+				continue
+			}
+			s, ok := u.pattern(negated, true)
+			if !ok {
+				return "", pattern[i : i+end+2]
+			}
+			b.WriteString(s)
+			i += end + 1
+		case ch == ']' && inClass:
+			inClass = false
+			b.WriteByte(ch)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String(), ""
+}
@@ -5,6 +5,7 @@ package checker_test
 
 import (
 	"flag"
+	"os"
 	"strings"
 	"testing"
 
@@ -171,6 +172,89 @@ foo = $1
 }`,
 		[]string{"counter with buckets:1:9-11: Can't specify buckets for non-histogram metric `foo'."}},
 
+	{"counter with window",
+		`syntax = "v2"
+counter foo window 1h
+/(\d)/ {
+foo = $1
+}`,
+		[]string{"counter with window:2:9-11: Can't specify a window for non-distinct metric `foo'."}},
+
+	{"text with reset",
+		`syntax = "v2"
+text foo reset every 1h
+/(.*)/ {
+foo = $1
+}`,
+		[]string{"text with reset:2:6-8: Can't reset a text metric `foo'."}},
+
+	{"topk without keys",
+		`syntax = "v2"
+topk 10 foo
+/x/ {
+  foo++
+}
+`,
+		[]string{"topk without keys:2:9-11: A topk metric needs keys to count the values of, in `foo'."}},
+
+	{"topk keeping nothing",
+		`syntax = "v2"
+topk 0 foo by a
+/(.*)/ {
+  foo[$1]++
+}
+`,
+		[]string{"topk keeping nothing:2:8-10: A topk metric must keep at least one value, not 0, in `foo'."}},
+
+	{"increment max",
+		`syntax = "v2"
+max foo by a
+/(.*)/ {
+  foo[$1]++
+}
+`,
+		[]string{"increment max:4:3-11: Can't increment a max metric `foo'.", "\tTry assigning each value to it with `='."}},
+
+	{"add to avg",
+		`syntax = "v2"
+avg foo
+/(\d+)/ {
+  foo += $1
+}
+`,
+		[]string{"add to avg:4:3-11: Can't add to an avg metric `foo'.", "\tTry assigning each value to it with `='."}},
+
+	{"read min",
+		`syntax = "v2"
+min foo
+counter bar
+/(\d+)/ {
+  foo = $1
+  bar = foo
+}
+`,
+		[]string{"read min:6:9-11: Can't read the value of a min metric `foo'."}},
+
+	{"increment distinct",
+		`syntax = "v2"
+distinct users
+/user=(\S+)/ {
+  users++
+}
+`,
+		[]string{"increment distinct:4:3-9: Can't increment a distinct metric `users'.", "\tTry assigning each value to it with `='."}},
+
+	{"read distinct",
+		`syntax = "v2"
+distinct users
+/user=(\S+)/ {
+  users = $1
+  users > 10 {
+  }
+}
+`,
+		[]string{"read distinct:5:3-7: Can't read the value of a distinct metric `users'."}},
+
 	{"next outside of decorator",
 		`def x{
 next
@@ -187,6 +271,103 @@ next
 }`,
 		[]string{"use decorator in decorator:2:1-2: Decorator `@x' is not completely defined yet.", "\tTry removing @x from here.", "use decorator in decorator:2:1-2: No symbols found in decorator `@x'.", "\tTry adding a `next' statement inside the `{}' block."}},
 
+	{"decorator argument count",
+		`def x(a) {
+/a/ + a {
+next
+}
+}
+@x {
+}`,
+		[]string{"decorator argument count:6:1-2: Decorator `@x' takes 1 arguments, but 0 were given."}},
+
+	{"use parameterised decorator in itself",
+		`def x(a) {
+/a/ + a {
+@x(/b/) {}
+next
+}
+}
+@x(/c/) {
+}`,
+		[]string{"use parameterised decorator in itself:3:4: Decorator `@x' is not completely defined yet.", "\tTry removing @x from here."}},
+
+	{"unknown pragma",
+		"syntax = \"v2\"\npragma nope\n",
+		[]string{"unknown pragma:2:1-6: Unknown pragma `nope'."}},
+
+	{"pragma not at top level",
+		`syntax = "v2"
+// {
+pragma strict
+}`,
+		[]string{"pragma not at top level:3:1-6: Pragma `strict' must be at the top level of the program."}},
+
+	{"strict pragma with value",
+		"syntax = \"v2\"\npragma strict \"yes\"\n",
+		[]string{"strict pragma with value:2:1-6: Pragma `strict' takes no value, but got \"yes\"."}},
+
+	{"separator pragma without value",
+		"syntax = \"v2\"\npragma decimal_separator\n",
+		[]string{"separator pragma without value:2:1-6: Pragma `decimal_separator' takes one character that is not a digit, sign, or exponent, but got \"\"."}},
+
+	{"digit separator pragma",
+		"syntax = \"v2\"\npragma thousands_separator \"0\"\n",
+		[]string{"digit separator pragma:2:1-6: Pragma `thousands_separator' takes one character that is not a digit, sign, or exponent, but got \"0\"."}},
+
+	{"same separators",
+		"syntax = \"v2\"\npragma decimal_separator \",\"\npragma thousands_separator \",\"\n",
+		[]string{"same separators:3:1-6: The decimal and thousands separators are both \",\"."}},
+
+	{"long csv delimiter",
+		"syntax = \"v2\"\npragma csv_delimiter \"||\"\n",
+		[]string{"long csv delimiter:2:1-6: Pragma `csv_delimiter' takes one character, or \\t for a tab, but got \"||\"."}},
+
+	{"csv quote is delimiter",
+		"syntax = \"v2\"\npragma csv_quote \",\"\n",
+		[]string{"csv quote is delimiter:2:1-6: The csv delimiter and quote are both \",\"."}},
+
+	{"case insensitive pragma with value",
+		"syntax = \"v2\"\npragma case_insensitive \"yes\"\n",
+		[]string{"case insensitive pragma with value:2:1-6: Pragma `case_insensitive' takes no value, but got \"yes\"."}},
+
+	{"negated unicode class in class",
+		"syntax = \"v2\"\npragma unicode_classes\n/[\\W.]/ {}\n",
+		[]string{"negated unicode class in class:3:1-7: Can't make the negated class `\\W' match Unicode characters inside a character class.",
+			"\tTry writing the class out with `\\P{...}' categories."}},
+
+	{"invalid backtracking backreference",
+		"/(*PCRE)(a)\\2/ {}\n",
+		[]string{"invalid backtracking backreference:1:1-14: error parsing regexp: invalid backreference: `\\2`"}},
+
+	{"unknown grok pattern",
+		"/%{NOSUCHPATTERN:x}/ {}\n",
+		[]string{"unknown grok pattern:1:1-20: unknown grok pattern \"NOSUCHPATTERN\""}},
+
+	{"sample rate not one in n",
+		"syntax = \"v2\"\ncounter a\nsample 2/10 {\na++\n}\n",
+		[]string{"sample rate not one in n:3:1-6: Sample rate must be 1/N for a positive N, but got 2/10."}},
+
+	{"sample rate of zero",
+		"syntax = \"v2\"\ncounter a\nsample 1/0 {\na++\n}\n",
+		[]string{"sample rate of zero:3:1-6: Sample rate must be 1/N for a positive N, but got 1/0."}},
+
+	{"unknown sample mode",
+		"syntax = \"v2\"\ncounter a\nsample often 1/10 {\na++\n}\n",
+		[]string{"unknown sample mode:3:1-6: Unknown sample mode `often', expecting `random'."}},
+
+	{"filter not at top level",
+		"syntax = \"v2\"\n/x/ {\nfilter filename =~ /nginx/\n}\n",
+		[]string{"filter not at top level:3:1-26: Filter must be at the top level of the program."}},
+
+	{"filter unknown subject",
+		"syntax = \"v2\"\nfilter hostname =~ /web/\n",
+		[]string{"filter unknown subject:2:1-6: Can't filter on `hostname', expecting `filename'."}},
+
+	{"filter invalid regex",
+		"syntax = \"v2\"\nfilter filename =~ /(nginx/\n",
+		[]string{"filter invalid regex:2:1-27: error parsing regexp: missing closing ): `(nginx`"}},
+
 	{"delete incorrect object",
 		`/(.*)/ {
 del $0
@@ -242,6 +423,13 @@ l++=l
 		`tolower(2)
 `, []string{"tolower non string:1:9: Expecting a String for argument 1 of tolower(), not Int."}},
 
+	{"exec non literal command",
+		`syntax = "v2"
+/(.*)/ {
+  exec($1)
+}
+`, []string{"exec non literal command:3:8-9: Expecting a string literal command name for argument 1 of exec()."}},
+
 	{"dec non var",
 		`strptime("", "")--
 `, []string{"dec non var:1:16: Expecting a variable here."}},
@@ -421,6 +609,143 @@ def decorator {
     a++
   }
 }
+`},
+	{"parameterised decorator", `
+counter a
+def decorator(prefix, layout) {
+  /^/ + prefix + /(?P<rest>.*)/ {
+    strptime($date, layout)
+    next
+  }
+}
+@decorator(/(?P<date>\d+) /, "2006") {
+  $rest == "A" {
+    a++
+  }
+}
+`},
+	{"strict pragma", `syntax = "v2"
+pragma strict
+counter a
+/(\d+)/ {
+  a += $1
+}
+`},
+	{"url builtins", `syntax = "v2"
+counter requests by host, path, page
+/GET (\S+)/ {
+  requests[urlhost($1)][normpath(urlpath($1))][urlquery($1, "page")]++
+}
+`},
+	{"security event builtins", `syntax = "v2"
+counter events by vendor, action
+/(CEF:.*)/ {
+  events[cef($1, "deviceVendor")][cef($1, "act")]++
+}
+/(LEEF:.*)/ {
+  events[leef($1, "vendor")][leef($1, "action")]++
+}
+`},
+	{"csv builtins", `syntax = "v2"
+pragma csv_delimiter "\t"
+pragma csv_quote "'"
+pragma csv_header
+counter requests by user, status
+/./ {
+  requests[csv("user")][csvcol(3)]++
+}
+`},
+	{"field builtin", `syntax = "v2"
+counter requests by path
+/status: 5/ {
+  requests[field("request.path")]++
+}
+`},
+	{"w3c builtin", `syntax = "v2"
+counter requests by path, status
+/^[^#]/ {
+  requests[w3c("cs-uri-stem")][w3c("sc-status")]++
+}
+`},
+	{"geoip builtins", `syntax = "v2"
+counter requests by country, asn
+/^(\S+) / {
+  requests[geoip_country($1)][geoip_asn($1)]++
+}
+`},
+	{"anonymizing builtins", `syntax = "v2"
+counter logins by user
+text last_error
+/user (\S+) logged in/ {
+  logins[hmac($1)]++
+}
+/error: (.*)/ {
+  last_error = redact($1)
+}
+/token (\S+)/ {
+  last_error = sha256($1)
+}
+`},
+	{"sample", `syntax = "v2"
+counter a
+/x/ {
+  sample random 1/100 {
+    a++
+  }
+}
+`},
+	{"filter", `syntax = "v2"
+const LOG /access/
+filter filename =~ /nginx/ + LOG
+filter filename !~ /\.gz$/
+counter a
+/x/ {
+  a++
+}
+`},
+	{"separator pragmas", `syntax = "v2"
+pragma decimal_separator ","
+pragma thousands_separator "."
+counter a
+gauge b
+/([\d.]+) ([\d.,]+)/ {
+  a += parseint($1)
+  b = parsefloat($2)
+}
+`},
+	{"regex pragmas", `syntax = "v2"
+counter a
+/^(?P<user>\w+) (\d+)/ {
+  a += $2
+}
+pragma case_insensitive
+pragma unicode_classes
+`},
+	{"backtracking pattern", `syntax = "v2"
+counter a
+/(*PCRE)^(?P<word>\w+) \k<word> (\d+)/ {
+  a += $2
+}
+pragma case_insensitive
+`},
+	{"grok patterns", `
+counter bytes_total by verb
+/^%{COMBINEDAPACHELOG}$/ {
+  bytes_total[$verb] += $bytes
+}
+/%{IP:client} %{NUMBER:ms:int}ms/ {
+  bytes_total[$client] += $ms
+}
+`},
+	{"imported decorators", `syntax = "v2"
+import "apache"
+import "apache"
+counter a
+@apache_common {
+  $status_code == 200 {
+    a++
+  }
+}
 `},
 	{"concat with add_assign", `
 text foo
@@ -446,6 +771,11 @@ histogram foo buckets 1, 2, 3
   foo = $1
 }`},
 
+	{"exec with arguments", `syntax = "v2"
+/(?P<svc>\w+) wedged/ {
+  exec("restart", $svc, "now")
+}`},
+
 	{"match a pattern in cond", `
 const N /n/
 N {
@@ -519,3 +849,98 @@ func TestCheckTypeExpressions(t *testing.T) {
 		})
 	}
 }
+
+func TestUnicodeClasses(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, expected, bad string
+	}{
+		{`\w+ \S`, `[\p{L}\p{M}\p{N}\p{Pc}]+ [^\p{Z}\t\n\v\f\r\x{85}]`, ""},
+		{`[\w.-]\d`, `[\p{L}\p{M}\p{N}\p{Pc}.-]\d`, ""},
+		{`[^\s[:alpha:]]`, `[^\p{Z}\t\n\v\f\r\x{85}\p{L}]`, ""},
+		{`[[:^upper:][:digit:]]`, `[\P{Lu}[:digit:]]`, ""},
+		{`[]\w]\\w`, `[]\p{L}\p{M}\p{N}\p{Pc}]\\w`, ""},
+		{`\Q\w[\E\w`, `\Q\w[\E[\p{L}\p{M}\p{N}\p{Pc}]`, ""},
+		{`\pL\x{41}`, `\pL\x{41}`, ""},
+		{`[\S]`, "", `\S`},
+		{`[[:^word:]]`, "", `[:^word:]`},
+	} {
+		n, err := parser.Parse(tc.pattern, strings.NewReader("syntax = \"v2\"\npragma unicode_classes\n/"+tc.pattern+"/ {}\n"))
+		testutil.FatalIfErr(t, err)
+		n, err = checker.Check(n)
+		if tc.bad != "" {
+			if err == nil || !strings.Contains(err.Error(), "`"+tc.bad+"'") {
+				t.Errorf("%q: expected an error about %q, received %v", tc.pattern, tc.bad, err)
+			}
+			continue
+		}
+		testutil.FatalIfErr(t, err)
+		got := n.(*ast.StmtList).Children[2].(*ast.CondStmt).Cond.(*ast.PatternExpr).Pattern
+		testutil.ExpectNoDiff(t, tc.expected, got)
+	}
+}
+
+func TestExternConsts(t *testing.T) {
+	externs := checker.ExternConsts(map[string]string{"DATACENTER": "us-east1", "ROLE": "frontend"})
+	os.Setenv("MTAIL_RACK", "r12")
+	defer os.Unsetenv("MTAIL_RACK")
+
+	for _, tc := range []struct {
+		name    string
+		program string
+		errors  []string
+	}{
+		{"given and environment",
+			`syntax = "v2"
+extern const DATACENTER
+extern const ROLE
+extern const RACK
+counter requests by dc, role
+/(?P<rack>\w+)/ {
+  $rack == RACK {
+    requests[DATACENTER][ROLE]++
+  }
+}
+`, nil},
+		{"in a pattern",
+			`syntax = "v2"
+extern const DATACENTER
+counter requests
+/host=/ + DATACENTER {
+  requests++
+}
+`, nil},
+		{"not given",
+			`syntax = "v2"
+extern const ZONE
+counter requests by zone
+/x/ {
+  requests[ZONE]++
+}
+`, []string{"not given:2:14-17: No value given for extern const `ZONE'.", "\tTry running mtail with --extern_consts ZONE=..., or with MTAIL_ZONE set in its environment."}},
+		{"not used",
+			`syntax = "v2"
+extern const DATACENTER
+`, []string{"not used:2:14-23: Declaration of extern const `DATACENTER' here is never used."}},
+		{"not top level",
+			`syntax = "v2"
+/x/ {
+  extern const DATACENTER
+}
+`, []string{"not top level:3:16-25: Extern const `DATACENTER' must be declared at the top level of the program."}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := parser.Parse(tc.name, strings.NewReader(tc.program))
+			testutil.FatalIfErr(t, err)
+			_, err = checker.Check(n, externs)
+			if tc.errors == nil {
+				testutil.FatalIfErr(t, err)
+				return
+			}
+			if err == nil {
+				t.Fatal("check didn't fail")
+			}
+			testutil.ExpectNoDiff(t, tc.errors, strings.Split(err.Error(), "\n"))
+		})
+	}
+}
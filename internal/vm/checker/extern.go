@@ -0,0 +1,33 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package checker
+
+import (
+	"os"
+)
+
+// externEnvPrefix prefixes the name of an extern const to make the name of the
+// environment variable it may be set in.
+const externEnvPrefix = "MTAIL_"
+
+// Option configures how Check checks a program.
+type Option func(*checker)
+
+// ExternConsts gives the values of the extern consts declared by the
+// program, by name.  Those not given are read from the environment.
+func ExternConsts(values map[string]string) Option {
+	return func(c *checker) {
+		c.externConsts = values
+	}
+}
+
+// externValue returns the value of the extern const called name, from the
+// values given to the checker, or the environment, in that order, and whether
+// it was found.
+func (c *checker) externValue(name string) (string, bool) {
+	if v, ok := c.externConsts[name]; ok {
+		return v, true
+	}
+	return os.LookupEnv(externEnvPrefix + name)
+}
@@ -48,6 +48,8 @@ const (
 	Cat                      // string concatenation
 	Setmatched               // Set "matched" flag
 	Otherwise                // Only match if "matched" flag is false.
+	Sample                   // Push whether the block of the operandth sample statement runs this time.
+	Condmatch                // Count a match of the operandth instrumented condition.
 	Del                      // Pop `operand` keys and metric off stack, and remove the datum at metric[key,...] from memory
 	Expire                   // Set the expiry duration of a datum, perfoming the same as del but after the expiry time passes.
 
@@ -60,7 +62,35 @@ const (
 	Fpow
 	Fset // Floating point assignment
 
-	Getfilename // Push input.Filename onto the stack.
+	Getfilename   // Push input.Filename onto the stack.
+	Getlinenumber // Push input.Number onto the stack.
+	Getlineoffset // Push input.Offset onto the stack.
+	Getingesttime // Push input.IngestTime onto the stack.
+
+	Urlhost  // Pop a URL off the stack, and push its host.
+	Urlpath  // Pop a URL off the stack, and push its path.
+	Urlquery // Pop a parameter name and a URL off the stack, and push the parameter's value in the URL's query.
+	Normpath // Pop a URL path off the stack, and push it with its IDs replaced.
+	Uaclass  // Pop a user agent off the stack, and push the class of client that sent it.
+
+	Cef  // Pop a field name and a CEF event off the stack, and push the field's value.
+	Leef // Pop a field name and a LEEF event off the stack, and push the field's value.
+	W3c  // Pop a field name off the stack, and push its value in the input line of a W3C extended log.
+
+	Csv    // Pop a column name off the stack, and push its value in the input line.
+	Csvcol // Pop a column number off the stack, and push its value in the input line.
+
+	Field // Pop a field path off the stack, and push its value in the input record.
+
+	Geoipcountry // Pop an IP address off the stack, and push its country.
+	Geoipasn     // Pop an IP address off the stack, and push its autonomous system number.
+
+	Sha256 // Pop a string off the stack, and push its SHA-256 hash.
+	Hmac   // Pop a string off the stack, and push its HMAC-SHA256 with the program's key.
+	Redact // Pop a string off the stack, and push it with personal data replaced.
+
+	Alert // Pop a message off the stack, and raise it as an alert.
+	Exec  // Pop `operand` strings off the stack, and run the command named by the first with the rest as arguments.
 
 	// Conversions
 	I2f // int to float
@@ -69,6 +99,11 @@ const (
 	I2s // int to string
 	F2s // float to string
 
+	Parseint   // string to int, with the program's number separators
+	Parsefloat // string to float, with the program's number separators
+	Parsedur   // duration string to float seconds
+	Parsesize  // size string to float bytes
+
 	// Typed comparisons, behave the same as cmp but do no conversion.
 	Icmp // integer compare
 	Fcmp // floating point compare
@@ -78,64 +113,104 @@ const (
 )
 
 var opNames = map[Opcode]string{
-	Stop:        "stop",
-	Match:       "match",
-	Smatch:      "smatch",
-	Cmp:         "cmp",
-	Jnm:         "jnm",
-	Jm:          "jm",
-	Jmp:         "jmp",
-	Inc:         "inc",
-	Strptime:    "strptime",
-	Timestamp:   "timestamp",
-	Settime:     "settime",
-	Push:        "push",
-	Capref:      "capref",
-	Str:         "str",
-	Sset:        "sset",
-	Iset:        "iset",
-	Iadd:        "iadd",
-	Isub:        "isub",
-	Imul:        "imul",
-	Idiv:        "idiv",
-	Imod:        "imod",
-	Ipow:        "ipow",
-	Shl:         "shl",
-	Shr:         "shr",
-	And:         "and",
-	Or:          "or",
-	Xor:         "xor",
-	Not:         "not",
-	Neg:         "neg",
-	Mload:       "mload",
-	Dload:       "dload",
-	Iget:        "iget",
-	Fget:        "fget",
-	Sget:        "sget",
-	Tolower:     "tolower",
-	Length:      "length",
-	Cat:         "cat",
-	Setmatched:  "setmatched",
-	Otherwise:   "otherwise",
-	Del:         "del",
-	Fadd:        "fadd",
-	Fsub:        "fsub",
-	Fmul:        "fmul",
-	Fdiv:        "fdiv",
-	Fmod:        "fmod",
-	Fpow:        "fpow",
-	Fset:        "fset",
-	Getfilename: "getfilename",
-	I2f:         "i2f",
-	S2i:         "s2i",
-	S2f:         "s2f",
-	I2s:         "i2s",
-	F2s:         "f2s",
-	Icmp:        "icmp",
-	Fcmp:        "fcmp",
-	Scmp:        "scmp",
+	Stop:          "stop",
+	Match:         "match",
+	Smatch:        "smatch",
+	Cmp:           "cmp",
+	Jnm:           "jnm",
+	Jm:            "jm",
+	Jmp:           "jmp",
+	Inc:           "inc",
+	Dec:           "dec",
+	Strptime:      "strptime",
+	Timestamp:     "timestamp",
+	Settime:       "settime",
+	Push:          "push",
+	Capref:        "capref",
+	Str:           "str",
+	Sset:          "sset",
+	Iset:          "iset",
+	Iadd:          "iadd",
+	Isub:          "isub",
+	Imul:          "imul",
+	Idiv:          "idiv",
+	Imod:          "imod",
+	Ipow:          "ipow",
+	Shl:           "shl",
+	Shr:           "shr",
+	And:           "and",
+	Or:            "or",
+	Xor:           "xor",
+	Not:           "not",
+	Neg:           "neg",
+	Mload:         "mload",
+	Dload:         "dload",
+	Iget:          "iget",
+	Fget:          "fget",
+	Sget:          "sget",
+	Tolower:       "tolower",
+	Length:        "length",
+	Cat:           "cat",
+	Setmatched:    "setmatched",
+	Otherwise:     "otherwise",
+	Sample:        "sample",
+	Condmatch:     "condmatch",
+	Del:           "del",
+	Expire:        "expire",
+	Fadd:          "fadd",
+	Fsub:          "fsub",
+	Fmul:          "fmul",
+	Fdiv:          "fdiv",
+	Fmod:          "fmod",
+	Fpow:          "fpow",
+	Fset:          "fset",
+	Getfilename:   "getfilename",
+	Getlinenumber: "getlinenumber",
+	Getlineoffset: "getlineoffset",
+	Getingesttime: "getingesttime",
+	Urlhost:       "urlhost",
+	Urlpath:       "urlpath",
+	Urlquery:      "urlquery",
+	Normpath:      "normpath",
+	Uaclass:       "uaclass",
+	Cef:           "cef",
+	Leef:          "leef",
+	W3c:           "w3c",
+	Csv:           "csv",
+	Csvcol:        "csvcol",
+	Field:         "field",
+	Geoipcountry:  "geoip_country",
+	Geoipasn:      "geoip_asn",
+	Sha256:        "sha256",
+	Hmac:          "hmac",
+	Redact:        "redact",
+	Alert:         "alert",
+	Exec:          "exec",
+	I2f:           "i2f",
+	S2i:           "s2i",
+	S2f:           "s2f",
+	I2s:           "i2s",
+	F2s:           "f2s",
+	Parseint:      "parseint",
+	Parsefloat:    "parsefloat",
+	Parsedur:      "parsedur",
+	Parsesize:     "parsesize",
+	Icmp:          "icmp",
+	Fcmp:          "fcmp",
+	Scmp:          "scmp",
 }
 
 func (o Opcode) String() string {
 	return opNames[o]
 }
+
+// ParseOpcode returns the opcode named name, as by its String method, and
+// whether there is one.
+func ParseOpcode(name string) (Opcode, bool) {
+	for o, n := range opNames {
+		if n == name {
+			return o, true
+		}
+	}
+	return Bad, false
+}
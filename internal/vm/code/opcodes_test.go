@@ -12,3 +12,17 @@ func TestOpcodeHasString(t *testing.T) {
 		}
 	}
 }
+
+func TestParseOpcode(t *testing.T) {
+	for o := Bad; o < lastOpcode; o++ {
+		if o.String() == "" {
+			continue
+		}
+		if p, ok := ParseOpcode(o.String()); !ok || p != o {
+			t.Errorf("ParseOpcode(%q) = %v, %v; expected %v", o.String(), p, ok, o)
+		}
+	}
+	if _, ok := ParseOpcode("nosuchop"); ok {
+		t.Error("expected no opcode named nosuchop")
+	}
+}
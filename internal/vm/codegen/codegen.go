@@ -6,10 +6,9 @@ package codegen
 import (
 	"fmt"
 	"math"
-	"regexp"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/vm/ast"
@@ -17,6 +16,7 @@ import (
 	"github.com/google/mtail/internal/vm/errors"
 	"github.com/google/mtail/internal/vm/object"
 	"github.com/google/mtail/internal/vm/parser"
+	"github.com/google/mtail/internal/vm/pcre"
 	"github.com/google/mtail/internal/vm/position"
 	"github.com/google/mtail/internal/vm/symbol"
 	"github.com/google/mtail/internal/vm/types"
@@ -31,14 +31,34 @@ type codegen struct {
 
 	l     []int           // Label table for recording jump destinations.
 	decos []*ast.DecoStmt // Decorator stack to unwind when entering decorated blocks.
+
+	scale int64 // The product of the rates of the enclosing sample statements, by which increments are multiplied.
+
+	instrumentConditions bool // Count the matches of each top-level condition.
+	condDepth            int  // The number of conditions enclosing the current node.
+}
+
+// Option configures how CodeGen compiles a program.
+type Option func(*codegen)
+
+// InstrumentConditions makes each top-level condition count its matches.
+func InstrumentConditions() Option {
+	return func(c *codegen) {
+		c.instrumentConditions = true
+	}
 }
 
 // CodeGen is the function that compiles the program to bytecode and data.
-func CodeGen(name string, n ast.Node) (*object.Object, error) {
+func CodeGen(name string, n ast.Node, options ...Option) (*object.Object, error) {
 	c := &codegen{name: name}
+	for _, option := range options {
+		option(c)
+	}
+	c.obj.Syntax = parser.DefaultSyntax
 	_ = ast.Walk(c, n)
 	c.writeJumps()
 	if len(c.errors) > 0 {
+		Release(&c.obj)
 		return nil, c.errors
 	}
 	return &c.obj, nil
@@ -53,6 +73,19 @@ func (c *codegen) emit(n ast.Node, opcode code.Opcode, operand interface{}) {
 	c.obj.Program = append(c.obj.Program, code.Instr{opcode, operand, n.Pos().Line})
 }
 
+// scaled returns the scale of increments inside a sample statement of the
+// given rate, stopping at the largest int64 rather than overflowing.
+func (c *codegen) scaled(rate int64) int64 {
+	scale := c.scale
+	if scale < 1 {
+		scale = 1
+	}
+	if rate > math.MaxInt64/scale {
+		return math.MaxInt64
+	}
+	return scale * rate
+}
+
 // newLabel creates a new label to jump to
 func (c *codegen) newLabel() (l int) {
 	l = len(c.l)
@@ -89,6 +122,11 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		}
 		var dtyp metrics.Type
 		switch {
+		case n.Kind == metrics.Distinct:
+			// A distinct metric counts values of any type.
+			dtyp = metrics.Sketch
+		case n.Kind == metrics.Min || n.Kind == metrics.Max || n.Kind == metrics.Avg:
+			dtyp = metrics.Aggregate
 		case types.Equals(types.Float, t):
 			dtyp = metrics.Float
 		case types.Equals(types.String, t):
@@ -97,7 +135,7 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			dtyp = metrics.Buckets
 		default:
 			if !types.IsComplete(t) {
-				glog.Infof("Incomplete type %v for %#v", t, n)
+				logging.Infof("Incomplete type %v for %#v", t, n)
 			}
 			dtyp = metrics.Int
 		}
@@ -161,6 +199,10 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		}
 
 		m.Hidden = n.Hidden
+		m.Timestamp = n.Timestamp
+		m.Limit = n.Limit
+		m.Window = n.Window
+		m.Reset = n.Reset
 		n.Symbol.Binding = m
 		n.Symbol.Addr = len(c.obj.Metrics)
 		c.obj.Metrics = append(c.obj.Metrics, m)
@@ -172,10 +214,16 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		if n.Cond != nil {
 			n.Cond = ast.Walk(c, n.Cond)
 			c.emit(n, code.Jnm, lElse)
+			if c.instrumentConditions && c.condDepth == 0 {
+				c.obj.Conditions = append(c.obj.Conditions, n.Cond.Pos().Line)
+				c.emit(n, code.Condmatch, len(c.obj.Conditions)-1)
+			}
 		}
 		// Set matched flag false for children.
 		c.emit(n, code.Setmatched, false)
+		c.condDepth++
 		n.Truth = ast.Walk(c, n.Truth)
+		c.condDepth--
 		// Re-set matched flag to true for rest of current block.
 		c.emit(n, code.Setmatched, true)
 		if n.Else != nil {
@@ -189,12 +237,25 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		return nil, n
 
 	case *ast.PatternExpr:
-		re, err := regexp.Compile(n.Pattern)
-		if err != nil {
-			c.errorf(n.Pos(), "%s", err)
-			return nil, n
+		if p, ok := pcre.Selected(n.Pattern); ok {
+			re, err := CompileBacktracking(p)
+			if err != nil {
+				c.errorf(n.Pos(), "%s", err)
+				return nil, n
+			}
+			if c.obj.Backtracking == nil {
+				c.obj.Backtracking = make(map[int]*pcre.Regexp)
+			}
+			c.obj.Backtracking[len(c.obj.Regexps)] = re
+			c.obj.Regexps = append(c.obj.Regexps, nil)
+		} else {
+			re, err := CompileRegexp(n.Pattern)
+			if err != nil {
+				c.errorf(n.Pos(), "%s", err)
+				return nil, n
+			}
+			c.obj.Regexps = append(c.obj.Regexps, re)
 		}
-		c.obj.Regexps = append(c.obj.Regexps, re)
 		// Store the location of this regular expression in the patternNode
 		n.Index = len(c.obj.Regexps) - 1
 		c.emit(n, code.Match, n.Index)
@@ -213,6 +274,24 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.StopStmt:
 		c.emit(n, code.Stop, nil)
 
+	case *ast.PragmaStmt:
+		switch n.Name {
+		case "strict":
+			c.obj.Strict = true
+		case "decimal_separator":
+			c.obj.DecimalSeparator = n.Value
+		case "thousands_separator":
+			c.obj.ThousandsSeparator = n.Value
+		case "csv_delimiter":
+			c.obj.CSVDelimiter = csvChar(n.Value)
+		case "csv_quote":
+			c.obj.CSVQuote = csvChar(n.Value)
+		case "csv_header":
+			c.obj.CSVHeader = true
+		case "syntax":
+			c.obj.Syntax = n.Value
+		}
+
 	case *ast.IdTerm:
 		if n.Symbol == nil || n.Symbol.Kind != symbol.VarSymbol {
 			break
@@ -290,10 +369,33 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		// then iterate over the decorator's nodes
 		ast.Walk(c, n.Decl.Block)
 		if len(c.decos) > decoLen {
-			glog.V(1).Info("Too many blocks on stack, was there no `next' in the last one?")
+			logging.V(1).Info("Too many blocks on stack, was there no `next' in the last one?")
 		}
 		return nil, n
 
+	case *ast.SampleStmt:
+		c.obj.Samples = append(c.obj.Samples, object.Sample{Rate: n.Rate, Random: n.Mode == "random", Line: n.P.Line})
+		lEnd := c.newLabel()
+		c.emit(n, code.Sample, len(c.obj.Samples)-1)
+		c.emit(n, code.Jnm, lEnd)
+		scale := c.scale
+		c.scale = c.scaled(n.Rate)
+		ast.Walk(c, n.Block)
+		c.scale = scale
+		c.setLabel(lEnd)
+		return nil, n
+
+	case *ast.FilterStmt:
+		// Filters are applied by the loader before any line reaches the
+		// program, so they emit no code.
+		re, err := CompileRegexp(n.Regexp)
+		if err != nil {
+			c.errorf(n.Pos(), "%s", err)
+			return nil, n
+		}
+		c.obj.Filters = append(c.obj.Filters, object.Filter{Regexp: re, Negate: n.Negate})
+		return nil, n
+
 	case *ast.NextStmt:
 		// Visit the 'next' block on the decorated block stack
 		top := len(c.decos) - 1
@@ -394,14 +496,48 @@ func getOpcodeForType(op int, opT types.Type) (code.Opcode, error) {
 	return -1, errors.Errorf("no opcode for type %s in op %v", opT, op)
 }
 
+// csvChar returns the character written s in a csv pragma, where a tab may be
+// written as an escape.
+func csvChar(s string) string {
+	if s == `\t` {
+		return "\t"
+	}
+	return s
+}
+
 var builtin = map[string]code.Opcode{
-	"getfilename": code.Getfilename,
-	"len":         code.Length,
-	"settime":     code.Settime,
-	"strptime":    code.Strptime,
-	"strtol":      code.S2i,
-	"timestamp":   code.Timestamp,
-	"tolower":     code.Tolower,
+	"alert":         code.Alert,
+	"cef":           code.Cef,
+	"csv":           code.Csv,
+	"csvcol":        code.Csvcol,
+	"exec":          code.Exec,
+	"field":         code.Field,
+	"geoip_asn":     code.Geoipasn,
+	"geoip_country": code.Geoipcountry,
+	"getfilename":   code.Getfilename,
+	"getingesttime": code.Getingesttime,
+	"getlinenumber": code.Getlinenumber,
+	"getlineoffset": code.Getlineoffset,
+	"hmac":          code.Hmac,
+	"leef":          code.Leef,
+	"len":           code.Length,
+	"normpath":      code.Normpath,
+	"parsedur":      code.Parsedur,
+	"parsefloat":    code.Parsefloat,
+	"parseint":      code.Parseint,
+	"parsesize":     code.Parsesize,
+	"redact":        code.Redact,
+	"settime":       code.Settime,
+	"sha256":        code.Sha256,
+	"strptime":      code.Strptime,
+	"strtol":        code.S2i,
+	"timestamp":     code.Timestamp,
+	"tolower":       code.Tolower,
+	"uaclass":       code.Uaclass,
+	"urlhost":       code.Urlhost,
+	"urlpath":       code.Urlpath,
+	"urlquery":      code.Urlquery,
+	"w3c":           code.W3c,
 }
 
 func (c *codegen) VisitAfter(node ast.Node) ast.Node {
@@ -432,8 +568,18 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 	case *ast.UnaryExpr:
 		switch n.Op {
 		case parser.INC:
+			if c.scale > 1 {
+				c.emit(n, code.Push, c.scale)
+				c.emit(n, code.Inc, 0)
+				break
+			}
 			c.emit(n, code.Inc, nil)
 		case parser.DEC:
+			if c.scale > 1 {
+				c.emit(n, code.Push, c.scale)
+				c.emit(n, code.Dec, 0)
+				break
+			}
 			c.emit(n, code.Dec, nil)
 		case parser.NOT:
 			c.emit(n, code.Neg, nil)
@@ -489,9 +635,17 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 			// When operand is not nil, inc pops the delta from the stack.
 			switch {
 			case types.Equals(n.Type(), types.Int):
+				if c.scale > 1 {
+					c.emit(n, code.Push, c.scale)
+					c.emit(n, code.Imul, nil)
+				}
 				c.emit(n, code.Inc, 0)
 			case types.Equals(n.Type(), types.Float), types.Equals(n.Type(), types.String):
 				// Already walked the lhs and rhs of this expression
+				if c.scale > 1 && types.Equals(n.Type(), types.Float) {
+					c.emit(n, code.Push, float64(c.scale))
+					c.emit(n, code.Fmul, nil)
+				}
 				opcode, err := getOpcodeForType(parser.PLUS, n.Type())
 				if err != nil {
 					c.errorf(n.Pos(), "%s", err)
@@ -559,7 +713,7 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 }
 
 func (c *codegen) emitConversion(n ast.Node, inType, outType types.Type) error {
-	glog.V(2).Infof("Conversion: %q to %q", inType, outType)
+	logging.V(2).Infof("Conversion: %q to %q", inType, outType)
 	switch {
 	case types.Equals(types.Int, inType) && types.Equals(types.Float, outType):
 		c.emit(n, code.I2f, nil)
@@ -13,6 +13,7 @@ import (
 	"github.com/google/mtail/internal/vm/checker"
 	"github.com/google/mtail/internal/vm/code"
 	"github.com/google/mtail/internal/vm/codegen"
+	"github.com/google/mtail/internal/vm/object"
 	"github.com/google/mtail/internal/vm/parser"
 )
 
@@ -467,6 +468,185 @@ getfilename()
 		},
 	},
 
+	{"getingesttime", `syntax = "v2"
+getingesttime()
+`,
+		[]code.Instr{
+			{code.Getingesttime, 0, 1},
+		},
+	},
+
+	{"getlinenumber", `syntax = "v2"
+getlinenumber()
+`,
+		[]code.Instr{
+			{code.Getlinenumber, 0, 1},
+		},
+	},
+
+	{"parseint", `syntax = "v2"
+parseint("1,234")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Parseint, 1, 1},
+		},
+	},
+
+	{"parsedur", `syntax = "v2"
+parsedur("1h30m")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Parsedur, 1, 1},
+		},
+	},
+
+	{"parsesize", `syntax = "v2"
+parsesize("1.5GiB")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Parsesize, 1, 1},
+		},
+	},
+
+	{"urlquery", `syntax = "v2"
+urlquery("/search?q=x", "q")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Str, 1, 1},
+			{code.Urlquery, 2, 1},
+		},
+	},
+
+	{"cef", `syntax = "v2"
+cef("CEF:0|a|b|1|2|n|1|", "name")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Str, 1, 1},
+			{code.Cef, 2, 1},
+		},
+	},
+
+	{"csvcol", `syntax = "v2"
+csvcol(2)
+`,
+		[]code.Instr{
+			{code.Push, int64(2), 1},
+			{code.Csvcol, 1, 1},
+		},
+	},
+
+	{"field", `syntax = "v2"
+field("status")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Field, 1, 1},
+		},
+	},
+
+	{"w3c", `syntax = "v2"
+w3c("sc-status")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.W3c, 1, 1},
+		},
+	},
+
+	{"sample", `syntax = "v2"
+counter a
+gauge b
+/x/ {
+  sample 1/10 {
+    a++
+    a += 2
+    sample random 1/2 {
+      b += 1.5
+    }
+  }
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 3},
+			{code.Jnm, 27, 3},
+			{code.Setmatched, false, 3},
+			{code.Sample, 0, 4},
+			{code.Jnm, 26, 4},
+			{code.Mload, 0, 5},
+			{code.Dload, 0, 5},
+			{code.Push, int64(10), 5},
+			{code.Inc, 0, 5},
+			{code.Mload, 0, 6},
+			{code.Dload, 0, 6},
+			{code.Push, int64(2), 6},
+			{code.Push, int64(10), 6},
+			{code.Imul, nil, 6},
+			{code.Inc, 0, 6},
+			{code.Sample, 1, 7},
+			{code.Jnm, 26, 7},
+			{code.Mload, 1, 8},
+			{code.Dload, 0, 8},
+			{code.Mload, 1, 8},
+			{code.Dload, 0, 8},
+			{code.Push, 1.5, 8},
+			{code.Push, 20.0, 8},
+			{code.Fmul, nil, 8},
+			{code.Fadd, nil, 8},
+			{code.Fset, nil, 8},
+			{code.Setmatched, true, 3}},
+	},
+
+	{"filter", `syntax = "v2"
+filter filename =~ /nginx/
+counter a
+/x/ {
+  a++
+}
+`,
+		[]code.Instr{
+			{code.Match, 0, 3},
+			{code.Jnm, 7, 3},
+			{code.Setmatched, false, 3},
+			{code.Mload, 0, 4},
+			{code.Dload, 0, 4},
+			{code.Inc, nil, 4},
+			{code.Setmatched, true, 3}},
+	},
+
+	{"getlineoffset", `syntax = "v2"
+getlineoffset()
+`,
+		[]code.Instr{
+			{code.Getlineoffset, 0, 1},
+		},
+	},
+
+	{"alert", `syntax = "v2"
+alert("FATAL in " + getfilename())
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Getfilename, 0, 1},
+			{code.Cat, nil, 1},
+			{code.Alert, 1, 1},
+		},
+	},
+
+	{"exec", `syntax = "v2"
+exec("restart", getfilename())
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Getfilename, 0, 1},
+			{code.Exec, 2, 1},
+		},
+	},
+
 	{"dimensioned counter",
 		`counter c by a,b,c
 /(\d) (\d) (\d)/ {
@@ -906,3 +1086,53 @@ func TestCodegen(t *testing.T) {
 		})
 	}
 }
+
+func TestCodegenFilters(t *testing.T) {
+	obj := compile(t, "filters", "syntax = \"v2\"\npragma case_insensitive\nfilter filename =~ /nginx/\nfilter filename !~ /\\.gz$/\n")
+	defer codegen.Release(obj)
+	if len(obj.Filters) != 2 {
+		t.Fatalf("expected 2 filters, got %v", obj.Filters)
+	}
+	testutil.ExpectNoDiff(t, "(?i)nginx", obj.Filters[0].Regexp.String())
+	testutil.ExpectNoDiff(t, false, obj.Filters[0].Negate)
+	testutil.ExpectNoDiff(t, `(?i)\.gz$`, obj.Filters[1].Regexp.String())
+	testutil.ExpectNoDiff(t, true, obj.Filters[1].Negate)
+}
+
+// compile compiles the program source to an object.
+func compile(t *testing.T, name, source string) *object.Object {
+	t.Helper()
+	ast, err := parser.Parse(name, strings.NewReader(source))
+	testutil.FatalIfErr(t, err)
+	ast, err = checker.Check(ast)
+	testutil.FatalIfErr(t, err)
+	obj, err := codegen.CodeGen(name, ast)
+	testutil.FatalIfErr(t, err)
+	return obj
+}
+
+func TestRegexpsShared(t *testing.T) {
+	source := "/shared (\\d+)/ {}\n/(*PCRE)(\\w)\\1/ {}\n"
+	a := compile(t, "a", source)
+	b := compile(t, "b", source+"/other/ {}\n")
+	if a.Regexps[0] != b.Regexps[0] {
+		t.Error("expected programs with the same pattern to share its regexp")
+	}
+	if a.Backtracking[1] != b.Backtracking[1] {
+		t.Error("expected programs with the same pattern to share its backtracking regexp")
+	}
+
+	// The regexp is kept while any program uses it.
+	codegen.Release(a)
+	c := compile(t, "c", source)
+	if c.Regexps[0] != b.Regexps[0] {
+		t.Error("expected the regexp to be kept for the programs still using it")
+	}
+	codegen.Release(b)
+	codegen.Release(c)
+	d := compile(t, "d", source)
+	defer codegen.Release(d)
+	if d.Regexps[0] == a.Regexps[0] {
+		t.Error("expected the regexp to be compiled again once no program used it")
+	}
+}
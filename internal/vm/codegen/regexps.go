@@ -0,0 +1,123 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package codegen
+
+import (
+	"expvar"
+	"regexp"
+	"sync"
+
+	"github.com/google/mtail/internal/vm/object"
+	"github.com/google/mtail/internal/vm/pcre"
+)
+
+var (
+	// regexpCacheHits counts the regular expressions a program shared with
+	// the programs already loaded, rather than compiled.
+	regexpCacheHits = expvar.NewInt("regexp_cache_hits_total")
+	// regexpCacheSize is the number of distinct regular expressions the
+	// programs loaded use.
+	regexpCacheSize = expvar.NewInt("regexp_cache_size")
+)
+
+// regexps holds the regular expressions compiled for every program in the
+// process, so that programs sharing a pattern, such as one for timestamps or
+// addresses, share its compiled form.  Both engines' compiled expressions are
+// safe for concurrent use.
+var regexps = &regexpCache{entries: make(map[string]*regexpEntry)}
+
+// regexpCache is a reference counted cache of compiled regular expressions,
+// by their pattern.
+type regexpCache struct {
+	mu      sync.Mutex
+	entries map[string]*regexpEntry
+}
+
+// regexpEntry is a compiled regular expression, by one of the two engines,
+// and the number of uses of it by the objects compiled.
+type regexpEntry struct {
+	re           *regexp.Regexp
+	backtracking *pcre.Regexp
+	refs         int
+}
+
+// acquire returns the entry for pattern, compiling it with compile if it
+// isn't in the cache, and counts a use of it.
+func (c *regexpCache) acquire(pattern string, compile func(*regexpEntry) error) (*regexpEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[pattern]; ok {
+		e.refs++
+		regexpCacheHits.Add(1)
+		return e, nil
+	}
+	e := &regexpEntry{refs: 1}
+	if err := compile(e); err != nil {
+		return nil, err
+	}
+	c.entries[pattern] = e
+	regexpCacheSize.Add(1)
+	return e, nil
+}
+
+// release gives up a use of the entry for pattern, forgetting it once it has
+// no more.
+func (c *regexpCache) release(pattern string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[pattern]
+	if !ok {
+		return
+	}
+	e.refs--
+	if e.refs <= 0 {
+		delete(c.entries, pattern)
+		regexpCacheSize.Add(-1)
+	}
+}
+
+// CompileRegexp returns the compiled form of the Go regular expression
+// pattern, shared with any other program using it.
+func CompileRegexp(pattern string) (*regexp.Regexp, error) {
+	e, err := regexps.acquire(pattern, func(e *regexpEntry) (err error) {
+		e.re, err = regexp.Compile(pattern)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e.re, nil
+}
+
+// CompileBacktracking returns the compiled form of the backtracking regular
+// expression pattern, without its marker, shared with any other program
+// using it.
+func CompileBacktracking(pattern string) (*pcre.Regexp, error) {
+	e, err := regexps.acquire(pcre.Marker+pattern, func(e *regexpEntry) (err error) {
+		e.backtracking, err = pcre.Compile(pattern)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e.backtracking, nil
+}
+
+// Release gives up the object's uses of the shared regular expressions, so
+// that those no other program uses can be freed.  It is called when the
+// program compiled to the object is unloaded or replaced, and the object must
+// not be released twice.
+func Release(obj *object.Object) {
+	for _, re := range obj.Regexps {
+		if re != nil {
+			regexps.release(re.String())
+		}
+	}
+	for _, re := range obj.Backtracking {
+		regexps.release(pcre.Marker + re.String())
+	}
+	for _, f := range obj.Filters {
+		regexps.release(f.Regexp.String())
+	}
+}
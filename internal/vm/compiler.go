@@ -8,41 +8,57 @@ import (
 	"path/filepath"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/vm/checker"
 	"github.com/google/mtail/internal/vm/codegen"
 	"github.com/google/mtail/internal/vm/parser"
 )
 
+// CompileOptions control how Compile compiles a program.  The zero value
+// compiles it with none of them.
+type CompileOptions struct {
+	EmitAst              bool              // Log the AST after parsing.
+	EmitAstTypes         bool              // Log the AST after type checking.
+	InstrumentConditions bool              // Count the matches of each top-level condition.
+	SyslogUseCurrentYear bool              // Give timestamps parsed without a year the current one.
+	OverrideLocation     *time.Location    // The timezone of timestamps parsed without one, if not the local one.
+	ExternConsts         map[string]string // The values of the extern consts declared by the program, by name.
+}
+
 // Compile compiles a program from the input into a virtual machine or a list
-// of compile errors.  It takes the program's name and the metric store as
-// additional arguments to build the virtual machine.
-func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, syslogUseCurrentYear bool, loc *time.Location) (*VM, error) {
+// of compile errors.  It takes the program's name and the options to compile
+// it with as additional arguments to build the virtual machine.
+func Compile(name string, input io.Reader, opts CompileOptions) (*VM, error) {
 	name = filepath.Base(name)
 
 	ast, err := parser.Parse(name, input)
 	if err != nil {
 		return nil, err
 	}
-	if emitAst {
+	if opts.EmitAst {
 		s := parser.Sexp{}
-		glog.Infof("%s AST:\n%s", name, s.Dump(ast))
+		logging.Infof("%s AST:\n%s", name, s.Dump(ast))
 	}
 
-	if ast, err = checker.Check(ast); err != nil {
+	if ast, err = checker.Check(ast, checker.ExternConsts(opts.ExternConsts)); err != nil {
 		return nil, err
 	}
-	if emitAstTypes {
+	if opts.EmitAstTypes {
 		s := parser.Sexp{}
 		s.EmitTypes = true
-		glog.Infof("%s AST with Type Annotation:\n%s", name, s.Dump(ast))
+		logging.Infof("%s AST with Type Annotation:\n%s", name, s.Dump(ast))
 	}
 
-	obj, err := codegen.CodeGen(name, ast)
+	var cgOpts []codegen.Option
+	if opts.InstrumentConditions {
+		cgOpts = append(cgOpts, codegen.InstrumentConditions())
+	}
+	obj, err := codegen.CodeGen(name, ast, cgOpts...)
 	if err != nil {
 		return nil, err
 	}
 
-	vm := New(name, obj, syslogUseCurrentYear, loc)
+	vm := New(name, obj, opts.SyslogUseCurrentYear, opts.OverrideLocation)
+	vm.ast = ast
 	return vm, nil
 }
@@ -0,0 +1,133 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/google/mtail/internal/vm/code"
+	"github.com/pkg/errors"
+)
+
+// LineCoverage records how often one line of program source was exercised.
+type LineCoverage struct {
+	SourceLine int   // Line number in the program source.
+	Executions int64 // Times the most executed instruction generated from this line ran.
+	Condition  bool  // Whether a condition starts on this line.
+	Matches    int64 // Times the conditions starting on this line were true.
+}
+
+// coverage counts the executions of each instruction of a program.
+type coverage struct {
+	source []byte  // The program source, for annotating.
+	counts []int64 // Executions by program counter; accessed atomically.
+}
+
+// EnableCoverage instructs the VM to count the executions of each instruction,
+// so that the lines of the program source src exercised by a test can be
+// reported.  It must be called before the VM processes any log lines.
+func (v *VM) EnableCoverage(src []byte) {
+	v.coverage = &coverage{source: src, counts: make([]int64, len(v.prog))}
+}
+
+// processCoveredLogLine is the fetch-execute cycle of ProcessLogLine,
+// counting each instruction executed.
+func (v *VM) processCoveredLogLine(t *thread) {
+	for t.pc < len(v.prog) {
+		v.cover(t.pc)
+		i := v.prog[t.pc]
+		t.pc++
+		v.execute(t, i)
+		if v.terminate {
+			v.terminate = false
+			return
+		}
+	}
+}
+
+// cover counts the instruction at pc as executed, if coverage is enabled.
+// The profiled and traced cycles count it too, so coverage isn't lost when
+// the program is also profiled or traced.
+func (v *VM) cover(pc int) {
+	if v.coverage != nil {
+		atomic.AddInt64(&v.coverage.counts[pc], 1)
+	}
+}
+
+// Coverage returns the coverage of each line of the program source that
+// generated any instructions, sorted by source line, or nil if coverage isn't
+// enabled.
+func (v *VM) Coverage() []LineCoverage {
+	if v.coverage == nil {
+		return nil
+	}
+	lines := make(map[int]*LineCoverage)
+	for pc, i := range v.prog {
+		n := atomic.LoadInt64(&v.coverage.counts[pc])
+		l, ok := lines[i.SourceLine]
+		if !ok {
+			l = &LineCoverage{SourceLine: i.SourceLine + 1}
+			lines[i.SourceLine] = l
+		}
+		if n > l.Executions {
+			l.Executions = n
+		}
+		// Only a condition clears the matched flag, as its block begins.
+		if i.Opcode == code.Setmatched && i.Operand == false {
+			l.Condition = true
+			l.Matches += n
+		}
+	}
+	r := make([]LineCoverage, 0, len(lines))
+	for _, l := range lines {
+		r = append(r, *l)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].SourceLine < r[j].SourceLine })
+	return r
+}
+
+// WriteCoverage writes the program source to w, each line annotated with the
+// times it was executed and, for conditions, the times they matched.  Lines
+// that generated no instructions are marked "-", and those never executed
+// "#####".
+func (v *VM) WriteCoverage(w io.Writer) error {
+	if v.coverage == nil {
+		return errors.Errorf("coverage of %s is not enabled", v.name)
+	}
+	lines := make(map[int]LineCoverage)
+	for _, l := range v.Coverage() {
+		lines[l.SourceLine] = l
+	}
+	if _, err := fmt.Fprintf(w, "%9s %9s: %s\n", "executed", "matched", v.name); err != nil {
+		return err
+	}
+	s := bufio.NewScanner(bytes.NewReader(v.coverage.source))
+	for n := 1; s.Scan(); n++ {
+		executions, matches := "-", ""
+		if l, ok := lines[n]; ok {
+			executions = coverageCount(l.Executions)
+			if l.Condition {
+				matches = coverageCount(l.Matches)
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%9s %9s: %s\n", executions, matches, s.Text()); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// coverageCount formats the count n, highlighting zero.
+func coverageCount(n int64) string {
+	if n == 0 {
+		return "#####"
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/pkg/errors"
+)
+
+// csvFormat is how a program's logs of delimiter-separated values are written,
+// for the csv and csvcol builtins.
+type csvFormat struct {
+	delimiter string
+	quote     string
+	header    bool // The first line of each log names its columns.
+}
+
+// defaultCSVFormat is used by programs without csv pragmas.
+var defaultCSVFormat = csvFormat{delimiter: ",", quote: `"`}
+
+// newCSVFormat returns the default format with any non-empty setting
+// replaced.
+func newCSVFormat(delimiter, quote string, header bool) csvFormat {
+	f := defaultCSVFormat
+	if delimiter != "" {
+		f.delimiter = delimiter
+	}
+	if quote != "" {
+		f.quote = quote
+	}
+	f.header = header
+	return f
+}
+
+// split splits a line into its values.  A value that starts with the quote
+// character runs to the next quote on its own, may contain the delimiter, and
+// has each doubled quote inside it read as one.
+func (f csvFormat) split(s string) []string {
+	var values []string
+	for {
+		if !strings.HasPrefix(s, f.quote) {
+			i := strings.Index(s, f.delimiter)
+			if i < 0 {
+				return append(values, s)
+			}
+			values = append(values, s[:i])
+			s = s[i+len(f.delimiter):]
+			continue
+		}
+		var b strings.Builder
+		s = s[len(f.quote):]
+		for {
+			i := strings.Index(s, f.quote)
+			if i < 0 {
+				b.WriteString(s)
+				s = ""
+				break
+			}
+			b.WriteString(s[:i])
+			s = s[i+len(f.quote):]
+			if !strings.HasPrefix(s, f.quote) {
+				break
+			}
+			b.WriteString(f.quote)
+			s = s[len(f.quote):]
+		}
+		// Anything between the closing quote and the delimiter is kept.
+		i := strings.Index(s, f.delimiter)
+		if i < 0 {
+			return append(values, b.String()+s)
+		}
+		values = append(values, b.String()+s[:i])
+		s = s[i+len(f.delimiter):]
+	}
+}
+
+// readCSVHeader records the column names given by line, and reports whether
+// it was a header, if the program's logs have headers.  The header is the
+// first line of each log, read again when the log is rotated or truncated.
+// A log that mtail starts reading part way through has no header until then.
+// The headers of the logs read least recently are forgotten once
+// maxScopedLogs logs have them.
+func (v *VM) readCSVHeader(line *logline.LogLine) bool {
+	if !v.csv.header || line.Offset != 0 {
+		return false
+	}
+	if _, ok := v.csvHeaders.Get(line.Filename); ok && line.Number != 1 {
+		return false
+	}
+	columns := make(map[string]int)
+	for i, name := range v.csv.split(strings.TrimPrefix(line.Line, "\ufeff")) {
+		name = strings.TrimSpace(name)
+		if _, ok := columns[name]; !ok {
+			columns[name] = i
+		}
+	}
+	v.csvHeaders.Add(line.Filename, columns)
+	return true
+}
+
+// csvValues returns the values of the current line, split once per line.
+func (v *VM) csvValues() []string {
+	if v.csvLine != v.input {
+		v.csvLineValues = v.csv.split(v.input.Line)
+		v.csvLine = v.input
+	}
+	return v.csvLineValues
+}
+
+// csvColumn returns the value in the column named name of the current line,
+// or the empty string if the log has no such column.
+func (v *VM) csvColumn(name string) (string, error) {
+	columns, ok := v.csvHeaders.Get(v.input.Filename)
+	if !ok {
+		return "", errors.Errorf("no csv header yet in %q", v.input.Filename)
+	}
+	i, ok := columns.(map[string]int)[name]
+	if !ok {
+		return "", nil
+	}
+	return v.csvPosition(i + 1)
+}
+
+// csvPosition returns the value in column n of the current line, counting
+// from 1, or the empty string if the line has fewer columns.
+func (v *VM) csvPosition(n int) (string, error) {
+	if n < 1 {
+		return "", errors.Errorf("csv column %d out of range, expecting 1 or more", n)
+	}
+	values := v.csvValues()
+	if n > len(values) {
+		return "", nil
+	}
+	return values[n-1], nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestCSVSplit(t *testing.T) {
+	for _, tc := range []struct {
+		format   csvFormat
+		input    string
+		expected []string
+	}{
+		{defaultCSVFormat, "", []string{""}},
+		{defaultCSVFormat, "a,b,,c,", []string{"a", "b", "", "c", ""}},
+		{defaultCSVFormat, `"a,b","say ""hi""",c`, []string{"a,b", `say "hi"`, "c"}},
+		{defaultCSVFormat, `"a"b,"unterminated`, []string{"ab", "unterminated"}},
+		{defaultCSVFormat, `x "y",z`, []string{`x "y"`, "z"}},
+		{newCSVFormat("\t", "'", false), "a\t'b\tc'\t'it''s'", []string{"a", "b\tc", "it's"}},
+		{newCSVFormat("|", "", false), `a|"b|c"`, []string{"a", "b|c"}},
+	} {
+		testutil.ExpectNoDiff(t, tc.expected, tc.format.split(tc.input))
+	}
+}
+
+func TestCSVColumns(t *testing.T) {
+	src := "syntax = \"v2\"\npragma csv_header\ncounter logins by user, result\ncounter lines\n/./ {\n  lines++\n  logins[csv(\"user\")][csvcol(3)]++\n}\n"
+	v, err := Compile("csv", strings.NewReader(src), CompileOptions{SyslogUseCurrentYear: true})
+	testutil.FatalIfErr(t, err)
+	for _, l := range []*logline.LogLine{
+		{Filename: "a.csv", Line: "\ufefftime,user,result", Number: 1},
+		{Filename: "a.csv", Line: `12:00,"bob",ok`, Number: 2, Offset: 21},
+		{Filename: "b.csv", Line: "time,user,result", Number: 1},
+		{Filename: "b.csv", Line: "12:01,alice,fail", Number: 2, Offset: 17},
+		// a.csv is rotated, and its new file has its columns reordered.
+		{Filename: "a.csv", Line: "user,time,result", Number: 1},
+		{Filename: "a.csv", Line: "bob,12:02,ok", Number: 2, Offset: 17},
+	} {
+		l.Context = context.Background()
+		v.ProcessLogLine(context.Background(), l)
+	}
+	testutil.ExpectNoDiff(t, "", v.RuntimeErrorString())
+	lines, err := v.m[1].GetDatum()
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, int64(3), datum.GetInt(lines))
+	for _, tc := range []struct {
+		user, result string
+		expected     int64
+	}{
+		{"bob", "ok", 2},
+		{"alice", "fail", 1},
+	} {
+		d, err := v.m[0].GetDatum(tc.user, tc.result)
+		testutil.FatalIfErr(t, err)
+		testutil.ExpectNoDiff(t, tc.expected, datum.GetInt(d))
+	}
+
+	// A log first read part way through has no header.
+	v.ProcessLogLine(context.Background(), &logline.LogLine{Context: context.Background(), Filename: "c.csv", Line: "12:03,carol,ok", Number: 1, Offset: 100})
+	if v.RuntimeErrorString() == "" {
+		t.Error("expected a runtime error for a log without a header")
+	}
+
+	// The headers of the logs read least recently are forgotten.
+	for i := 0; i < maxScopedLogs-1; i++ {
+		v.ProcessLogLine(context.Background(), &logline.LogLine{Context: context.Background(), Filename: fmt.Sprintf("%d.csv", i), Line: "time,user,result", Number: 1})
+	}
+	testutil.ExpectNoDiff(t, maxScopedLogs, v.csvHeaders.Len())
+	if _, ok := v.csvHeaders.Get("b.csv"); ok {
+		t.Error("header of the log read least recently remembered")
+	}
+	if _, ok := v.csvHeaders.Get("a.csv"); !ok {
+		t.Error("header of a log read since forgotten")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+	"time"
+)
+
+// layoutHasZone reports whether a time layout parses a timezone, in which
+// case the parsed times are never ambiguous.
+func layoutHasZone(layout string) bool {
+	return strings.Contains(layout, "MST") || strings.Contains(layout, "Z07") || strings.Contains(layout, "-07")
+}
+
+// repeatedWallClock returns the other time with the same wall clock as tm in
+// tm's location, if tm is in the hour that repeats when the clocks go back.
+func repeatedWallClock(tm time.Time) (time.Time, bool) {
+	_, offset := tm.Zone()
+	// Look for a change of offset either side of tm.
+	for _, probe := range []time.Duration{-3 * time.Hour, 3 * time.Hour} {
+		_, o := tm.Add(probe).Zone()
+		if o == offset {
+			continue
+		}
+		alt := tm.Add(time.Duration(offset-o) * time.Second)
+		if sameWallClock(tm, alt) {
+			return alt, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func sameWallClock(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	ah, amin, as := a.Clock()
+	bh, bmin, bs := b.Clock()
+	return ay == by && am == bm && ad == bd && ah == bh && amin == bmin && as == bs
+}
+
+// disambiguate chooses between the two times that a wall clock time in the
+// hour repeated when the clocks go back could be, which time.Parse otherwise
+// always takes as the first.  It takes the earliest that doesn't go back
+// before the last timestamp from the same log, so time keeps moving forward
+// through the repeated hour.
+func (v *VM) disambiguate(tm time.Time) time.Time {
+	last, ok := v.lastTimes[v.input.Filename]
+	if alt, ambiguous := repeatedWallClock(tm); ambiguous && ok {
+		early, late := tm, alt
+		if alt.Before(tm) {
+			early, late = alt, tm
+		}
+		if early.Before(last) {
+			tm = late
+		} else {
+			tm = early
+		}
+	}
+	// Forget the logs seen so far rather than grow without bound when many
+	// logs come and go.
+	if !ok && len(v.lastTimes) >= maxScopedLogs {
+		v.lastTimes = make(map[string]time.Time)
+	}
+	v.lastTimes[v.input.Filename] = tm
+	return tm
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseDuration returns the number of seconds in s, for the parsedur builtin.
+// s is either a duration as understood by time.ParseDuration, like "1h2m3.5s"
+// or "250ms", or a clock duration of the form [[h:]m:]s, like "00:01:02",
+// where the seconds may have a fraction.
+func parseDuration(s string) (float64, error) {
+	if !strings.Contains(s, ":") {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, err
+		}
+		return d.Seconds(), nil
+	}
+	neg := strings.HasPrefix(s, "-")
+	fields := strings.Split(strings.TrimPrefix(s, "-"), ":")
+	if len(fields) > 3 {
+		return 0, fmt.Errorf("parsedur: too many fields in duration %q", s)
+	}
+	var secs float64
+	for i, f := range fields {
+		// Only the seconds may have a fraction, and no field a sign or exponent.
+		digits := f
+		if i == len(fields)-1 {
+			digits = strings.Replace(f, ".", "", 1)
+		}
+		if digits == "" || strings.Trim(digits, "0123456789") != "" {
+			return 0, fmt.Errorf("parsedur: invalid duration %q", s)
+		}
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil || (i > 0 && v >= 60) {
+			return 0, fmt.Errorf("parsedur: invalid duration %q", s)
+		}
+		secs = secs*60 + v
+	}
+	if neg {
+		secs = -secs
+	}
+	return secs, nil
+}
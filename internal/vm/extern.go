@@ -0,0 +1,58 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// externConsts returns the values of the extern consts given to the loader,
+// reading them again from the file of them if reload is set or they haven't
+// been read yet, so the file is read once each time the programs are loaded.
+func (l *Loader) externConsts(reload bool) (map[string]string, error) {
+	l.externMu.Lock()
+	defer l.externMu.Unlock()
+	if l.externValues != nil && !reload {
+		return l.externValues, nil
+	}
+	values := make(map[string]string)
+	if l.externConstsFile != "" {
+		if err := readExternConsts(l.externConstsFile, values); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range l.externConstsGiven {
+		values[k] = v
+	}
+	l.externValues = values
+	return values, nil
+}
+
+// readExternConsts adds the values of the extern consts in the file at path,
+// made of NAME=value lines, to values.  Blank lines and lines starting with #
+// are ignored.
+func readExternConsts(path string, values map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "reading extern consts")
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return errors.Errorf("reading extern consts from %s: %q is not of the form NAME=value", path, line)
+		}
+		values[strings.TrimSpace(line[:i])] = line[i+1:]
+	}
+	return errors.Wrap(s.Err(), "reading extern consts")
+}
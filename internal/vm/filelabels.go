@@ -0,0 +1,160 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/pkg/errors"
+)
+
+// FileLabelRule adds labels to the metrics updated by lines from the logs
+// whose paths match the regular expression Path.  The named groups of Path
+// are labels too, with the text they match as their values.
+type FileLabelRule struct {
+	Path   string            `json:"path"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// LoadFileLabels reads a list of file label rules from the JSON file path,
+// such as
+//
+//	[{"path": "^/var/log/app-(?P<env>\\w+)/", "labels": {"team": "web"}}]
+func LoadFileLabels(path string) ([]FileLabelRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []FileLabelRule
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&rules); err != nil {
+		return nil, errors.Wrapf(err, "invalid file labels in %s", path)
+	}
+	return rules, nil
+}
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type fileLabelRule struct {
+	path   *regexp.Regexp
+	labels map[string]string
+}
+
+// fileLabels holds the compiled file label rules.
+type fileLabels struct {
+	rules []fileLabelRule
+	names []string // The names of all the labels of the rules, sorted.
+}
+
+// newFileLabels compiles rules, or returns nil if there are none.
+func newFileLabels(rules []FileLabelRule) (*fileLabels, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	f := &fileLabels{}
+	seen := make(map[string]bool)
+	add := func(name string) error {
+		if !labelName.MatchString(name) {
+			return errors.Errorf("invalid label name %q", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			f.names = append(f.names, name)
+		}
+		return nil
+	}
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "file label path %q", rule.Path)
+		}
+		for _, name := range re.SubexpNames()[1:] {
+			if name == "" {
+				continue
+			}
+			if err := add(name); err != nil {
+				return nil, errors.Wrapf(err, "file label path %q", rule.Path)
+			}
+		}
+		for name := range rule.Labels {
+			if err := add(name); err != nil {
+				return nil, errors.Wrapf(err, "file label path %q", rule.Path)
+			}
+		}
+		f.rules = append(f.rules, fileLabelRule{re, rule.Labels})
+	}
+	sort.Strings(f.names)
+	return f, nil
+}
+
+// match returns the labels of the log filename.  Every rule whose path
+// matches applies, with later rules overriding the labels of earlier ones.
+func (f *fileLabels) match(filename string) map[string]string {
+	labels := make(map[string]string)
+	for _, rule := range f.rules {
+		m := rule.path.FindStringSubmatch(filename)
+		if m == nil {
+			continue
+		}
+		for name, value := range rule.labels {
+			labels[name] = value
+		}
+		for i, name := range rule.path.SubexpNames() {
+			if i > 0 && name != "" {
+				labels[name] = m[i]
+			}
+		}
+	}
+	return labels
+}
+
+// addKeys adds the names of the file labels that m doesn't already have to
+// its keys, after the program's own.  A program's own key of the same name
+// wins.  The data m already has get empty values for them.
+func (f *fileLabels) addKeys(m *metrics.Metric) {
+	have := make(map[string]bool, len(m.Keys))
+	for _, k := range m.Keys {
+		have[k] = true
+	}
+	var added int
+	for _, name := range f.names {
+		if !have[name] {
+			m.Keys = append(m.Keys, name)
+			added++
+		}
+	}
+	for _, lv := range m.LabelValues {
+		for i := 0; i < added; i++ {
+			lv.Labels = append(lv.Labels, "")
+		}
+	}
+}
+
+// fileLabelValues appends to keys, the label values the program gave, the
+// values of the file labels of m for the current log line.
+func (v *VM) fileLabelValues(m *metrics.Metric, keys []string) []string {
+	if len(m.Keys) <= len(keys) {
+		return keys
+	}
+	labels, ok := v.fileLabelCache[v.input.Filename]
+	if !ok {
+		labels = v.fileLabels.match(v.input.Filename)
+		// Forget the logs seen so far rather than grow without bound when
+		// many logs come and go; their labels are matched again.
+		if len(v.fileLabelCache) >= maxScopedLogs {
+			v.fileLabelCache = make(map[string]map[string]string)
+		}
+		v.fileLabelCache[v.input.Filename] = labels
+	}
+	for _, name := range m.Keys[len(keys):] {
+		keys = append(keys, labels[name])
+	}
+	return keys
+}
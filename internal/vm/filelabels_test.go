@@ -0,0 +1,133 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestFileLabelsMatch(t *testing.T) {
+	f, err := newFileLabels([]FileLabelRule{
+		{Path: `^/var/log/app-(?P<env>\w+)/`, Labels: map[string]string{"team": "web"}},
+		{Path: `/canary/`, Labels: map[string]string{"env": "canary"}},
+	})
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, []string{"env", "team"}, f.names)
+	for _, tc := range []struct {
+		filename string
+		expected map[string]string
+	}{
+		{"/var/log/app-prod/access.log", map[string]string{"env": "prod", "team": "web"}},
+		// Later rules override earlier ones.
+		{"/var/log/app-prod/canary/access.log", map[string]string{"env": "canary", "team": "web"}},
+		{"/var/log/syslog", map[string]string{}},
+	} {
+		testutil.ExpectNoDiff(t, tc.expected, f.match(tc.filename))
+	}
+}
+
+func TestFileLabelsErrors(t *testing.T) {
+	for _, rules := range [][]FileLabelRule{
+		{{Path: `(`}},
+		{{Path: `(?P<bad-name>x)`}},
+		{{Path: `x`, Labels: map[string]string{"0": "y"}}},
+	} {
+		if _, err := newFileLabels(rules); err == nil {
+			t.Errorf("%v: expected an error", rules)
+		}
+	}
+	f, err := newFileLabels(nil)
+	testutil.FatalIfErr(t, err)
+	if f != nil {
+		t.Errorf("expected no file labels without rules, received %v", f)
+	}
+}
+
+func TestLoadFileLabels(t *testing.T) {
+	dir, rmTempDir := testutil.TestTempDir(t)
+	defer rmTempDir()
+	path := filepath.Join(dir, "labels.json")
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte(`[{"path": "^/a/", "labels": {"env": "a"}}]`), 0600))
+	rules, err := LoadFileLabels(path)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, []FileLabelRule{{Path: "^/a/", Labels: map[string]string{"env": "a"}}}, rules)
+
+	testutil.FatalIfErr(t, ioutil.WriteFile(path, []byte(`[{"pattern": "^/a/"}]`), 0600))
+	if _, err := LoadFileLabels(path); err == nil {
+		t.Error("expected an error for an unknown key")
+	}
+}
+
+func TestLoaderFileLabels(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store, FileLabels([]FileLabelRule{
+		{Path: `^/var/log/app-(?P<env>\w+)/`},
+		{Path: `/web/`, Labels: map[string]string{"team": "web"}},
+	}))
+	testutil.FatalIfErr(t, err)
+	prog := `counter lines
+counter requests by code, team
+hidden gauge last by code
+/(\d+)/ {
+  lines++
+  requests[$1]["ops"]++
+  last[$1] = 1
+}
+`
+	testutil.FatalIfErr(t, l.CompileAndRun("Test", strings.NewReader(prog)))
+	for _, filename := range []string{"/var/log/app-prod/web/access.log", "/var/log/app-dev/access.log", "/var/log/app-dev/access.log", "/tmp/other.log"} {
+		l.ProcessLogLine(ctx, logline.New(ctx, filename, "200"))
+	}
+
+	// The program's own team label wins over the file's.
+	requests := store.Metrics["requests"][0]
+	testutil.ExpectNoDiff(t, []string{"code", "team", "env"}, requests.Keys)
+	for labels, expected := range map[string]int64{"200,ops,prod": 1, "200,ops,dev": 2, "200,ops,": 1} {
+		lv := requests.FindLabelValueOrNil(strings.Split(labels, ","))
+		if lv == nil {
+			t.Errorf("no datum for %s", labels)
+			continue
+		}
+		testutil.ExpectNoDiff(t, expected, datum.GetInt(lv.Value))
+	}
+
+	// The zero datum of a scalar is for logs with no labels.
+	lines := store.Metrics["lines"][0]
+	testutil.ExpectNoDiff(t, []string{"env", "team"}, lines.Keys)
+	lv := lines.FindLabelValueOrNil([]string{"", ""})
+	if lv == nil {
+		t.Fatal("no datum for logs without labels")
+	}
+	testutil.ExpectNoDiff(t, int64(1), datum.GetInt(lv.Value))
+
+	// Hidden metrics are kept across logs.
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	for _, m := range l.handles["Test"].m {
+		if m.Name == "last" {
+			testutil.ExpectNoDiff(t, []string{"code"}, m.Keys)
+		}
+	}
+
+	// The logs whose labels are remembered are limited.
+	v := l.handles["Test"]
+	for i := 0; i <= maxScopedLogs; i++ {
+		v.ProcessLogLine(ctx, logline.New(ctx, fmt.Sprintf("/var/log/app-prod/%d.log", i), "200"))
+	}
+	if len(v.fileLabelCache) > maxScopedLogs {
+		t.Errorf("file labels of %d logs remembered", len(v.fileLabelCache))
+	}
+}
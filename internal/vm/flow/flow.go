@@ -0,0 +1,229 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package flow analyses the bytecode of mtail programs for the compilers that
+// translate it to other forms, finding the kinds of the values on the stack
+// before each instruction.
+//
+// The programs compiled by mtail only jump forward, and the values left on the
+// stack by a statement are never popped by those after it, so the kinds are
+// found in one pass over the program.
+package flow
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/mtail/internal/vm/code"
+	"github.com/pkg/errors"
+)
+
+// Kind is the kind of a value on the stack of a program.
+type Kind byte
+
+// The kinds of values.
+const (
+	Int      Kind = 'i' // An int64.
+	Float    Kind = 'f' // A float64.
+	Bool     Kind = 'b' // A bool.
+	String   Kind = 's' // A string.
+	Datum    Kind = 'd' // A datum.Datum.
+	Metric   Kind = 'm' // A *metrics.Metric.
+	Index    Kind = 'n' // An int, like the index of a regular expression.
+	Duration Kind = 'u' // A time.Duration.
+)
+
+// Valid returns whether k is one of the kinds of values.
+func (k Kind) Valid() bool {
+	return strings.IndexByte("ifbsdmnu", byte(k)) >= 0
+}
+
+// Flow is the result of analysing a program.
+type Flow struct {
+	// Targets are the distinct targets of the jumps of the program, in order.
+	Targets []int
+	// Reachable is whether each instruction can be reached.
+	Reachable []bool
+	// Stacks are the kinds of values on the stack before each instruction,
+	// the last being the top, and after the last instruction.  At a target
+	// it's the part of the stack that is the same on every way there.
+	Stacks [][]Kind
+}
+
+// Target returns whether pc is the target of a jump.
+func (f *Flow) Target(pc int) bool {
+	i := sort.SearchInts(f.Targets, pc)
+	return i < len(f.Targets) && f.Targets[i] == pc
+}
+
+// Analyze returns the flow of prog, or an error if it has an instruction
+// whose operands are missing from the stack, or that can't be analysed.
+func Analyze(prog []code.Instr) (*Flow, error) {
+	f := &Flow{
+		Reachable: make([]bool, len(prog)+1),
+		Stacks:    make([][]Kind, len(prog)+1),
+	}
+	if err := f.findTargets(prog); err != nil {
+		return nil, err
+	}
+	entries := make(map[int][]Kind)
+	merge := func(target int, stack []Kind) {
+		e, ok := entries[target]
+		if !ok {
+			entries[target] = append([]Kind(nil), stack...)
+			return
+		}
+		n := 0
+		for n < len(e) && n < len(stack) && e[n] == stack[n] {
+			n++
+		}
+		entries[target] = e[:n]
+	}
+	var stack []Kind
+	dead := false
+	for pc := 0; pc <= len(prog); pc++ {
+		if e, ok := entries[pc]; ok {
+			if !dead {
+				merge(pc, stack)
+				e = entries[pc]
+			}
+			stack = append(stack[:0], e...)
+			dead = false
+		}
+		if dead {
+			continue
+		}
+		f.Reachable[pc] = true
+		f.Stacks[pc] = append([]Kind(nil), stack...)
+		if pc == len(prog) {
+			break
+		}
+		i := prog[pc]
+		pops, result, err := Effect(i, stack)
+		if err == nil && len(stack) < pops {
+			err = errors.Errorf("the stack has %d values, not the %d popped", len(stack), pops)
+		}
+		if err == nil && (i.Opcode == code.Jnm || i.Opcode == code.Jm) {
+			if k := stack[len(stack)-1]; k != Bool && k != Int {
+				err = errors.Errorf("can't jump on a value of kind %q", k)
+			}
+		}
+		if err != nil {
+			return nil, errors.Errorf("instruction %d {%s, %v} from line %d can't be compiled: %s", pc, i.Opcode, i.Operand, i.SourceLine+1, err)
+		}
+		stack = stack[:len(stack)-pops]
+		if result != 0 {
+			stack = append(stack, result)
+		}
+		switch i.Opcode {
+		case code.Jnm, code.Jm:
+			merge(i.Operand.(int), stack)
+		case code.Jmp:
+			merge(i.Operand.(int), stack)
+			dead = true
+		case code.Stop:
+			dead = true
+		}
+	}
+	return f, nil
+}
+
+// findTargets finds the targets of the jumps of prog.
+func (f *Flow) findTargets(prog []code.Instr) error {
+	seen := make(map[int]bool)
+	for pc, i := range prog {
+		switch i.Opcode {
+		case code.Jmp, code.Jm, code.Jnm:
+			t, ok := i.Operand.(int)
+			if !ok || t <= pc || t > len(prog) {
+				return errors.Errorf("instruction %d {%s, %v} from line %d isn't a jump forward", pc, i.Opcode, i.Operand, i.SourceLine+1)
+			}
+			if !seen[t] {
+				seen[t] = true
+				f.Targets = append(f.Targets, t)
+			}
+		}
+	}
+	sort.Ints(f.Targets)
+	return nil
+}
+
+// Effect returns the number of values that i pops off stack, and the kind of
+// the value it pushes, or zero if it pushes none.
+func Effect(i code.Instr, stack []Kind) (pops int, result Kind, err error) {
+	switch i.Opcode {
+	case code.Push:
+		switch i.Operand.(type) {
+		case int64:
+			return 0, Int, nil
+		case int:
+			return 0, Index, nil
+		case time.Duration:
+			return 0, Duration, nil
+		case float64:
+			return 0, Float, nil
+		case bool:
+			return 0, Bool, nil
+		}
+		return 0, 0, errors.Errorf("can't push a %T", i.Operand)
+	case code.Str:
+		return 0, String, nil
+	case code.Mload:
+		return 0, Metric, nil
+	case code.Setmatched, code.Jmp, code.Stop, code.Condmatch:
+		return 0, 0, nil
+	case code.Jnm, code.Jm:
+		return 1, 0, nil
+	case code.Match, code.Sample, code.Otherwise:
+		return 0, Bool, nil
+	case code.Smatch, code.Not:
+		return 1, Bool, nil
+	case code.Cmp, code.Icmp, code.Fcmp, code.Scmp:
+		return 2, Bool, nil
+	case code.Inc, code.Dec, code.S2i:
+		if i.Operand != nil {
+			return 2, Int, nil
+		}
+		return 1, Int, nil
+	case code.Iset, code.Fset, code.Sset:
+		return 2, 0, nil
+	case code.Strptime:
+		// The time is either a string or a capture group of a regular
+		// expression, both given by index.
+		if len(stack) >= 2 && stack[len(stack)-2] == Index {
+			return 3, 0, nil
+		}
+		return 2, 0, nil
+	case code.Settime, code.Alert:
+		return 1, 0, nil
+	case code.Timestamp, code.Getlinenumber, code.Getlineoffset, code.Getingesttime:
+		return 0, Int, nil
+	case code.Getfilename:
+		return 0, String, nil
+	case code.Capref, code.Tolower, code.Urlhost, code.Urlpath, code.W3c, code.Csv, code.Csvcol, code.Field,
+		code.Normpath, code.Uaclass, code.Sha256, code.Hmac, code.Redact, code.I2s, code.F2s, code.Geoipcountry, code.Sget:
+		return 1, String, nil
+	case code.Urlquery, code.Cef, code.Leef, code.Cat:
+		return 2, String, nil
+	case code.Iadd, code.Isub, code.Imul, code.Idiv, code.Imod, code.Ipow, code.Shl, code.Shr, code.And, code.Or, code.Xor:
+		return 2, Int, nil
+	case code.Fadd, code.Fsub, code.Fmul, code.Fdiv, code.Fmod, code.Fpow:
+		return 2, Float, nil
+	case code.Neg, code.Parseint, code.Geoipasn, code.Iget:
+		return 1, Int, nil
+	case code.Length:
+		return 1, Index, nil
+	case code.S2f, code.I2f, code.Parsefloat, code.Parsedur, code.Parsesize, code.Fget:
+		return 1, Float, nil
+	case code.Dload:
+		return i.Operand.(int) + 1, Datum, nil
+	case code.Del:
+		return i.Operand.(int) + 1, 0, nil
+	case code.Expire:
+		return i.Operand.(int) + 2, 0, nil
+	case code.Exec:
+		return i.Operand.(int), 0, nil
+	}
+	return 0, 0, errors.New("unknown instruction")
+}
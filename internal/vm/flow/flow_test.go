@@ -0,0 +1,97 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package flow
+
+import (
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/vm/code"
+)
+
+func TestAnalyze(t *testing.T) {
+	// /x/ { c++ } otherwise { stop }
+	f, err := Analyze([]code.Instr{
+		{Opcode: code.Match, Operand: 0},
+		{Opcode: code.Jnm, Operand: 6},
+		{Opcode: code.Setmatched, Operand: false},
+		{Opcode: code.Mload, Operand: 0},
+		{Opcode: code.Dload, Operand: 0},
+		{Opcode: code.Inc},
+		{Opcode: code.Setmatched, Operand: true},
+		{Opcode: code.Otherwise},
+		{Opcode: code.Jnm, Operand: 10},
+		{Opcode: code.Stop},
+	})
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, []int{6, 10}, f.Targets)
+	testutil.ExpectNoDiff(t, []bool{true, true, true, true, true, true, true, true, true, true, true}, f.Reachable)
+	testutil.ExpectNoDiff(t, []Kind{Bool}, f.Stacks[1])
+	testutil.ExpectNoDiff(t, []Kind{Metric}, f.Stacks[4])
+	// The count left by the increment isn't on the way from the match.
+	testutil.ExpectNoDiff(t, []Kind(nil), f.Stacks[6])
+	testutil.ExpectNoDiff(t, []Kind(nil), f.Stacks[10])
+	if !f.Target(6) || f.Target(7) {
+		t.Errorf("targets wrong: %v", f.Targets)
+	}
+}
+
+func TestAnalyzeMerge(t *testing.T) {
+	f, err := Analyze([]code.Instr{
+		{Opcode: code.Push, Operand: int64(1)},
+		{Opcode: code.Push, Operand: true},
+		{Opcode: code.Jnm, Operand: 6},
+		{Opcode: code.Push, Operand: int64(2)},
+		{Opcode: code.Jmp, Operand: 7},
+		{Opcode: code.Neg},
+		{Opcode: code.Push, Operand: 1.0},
+	})
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, []Kind{Int}, f.Stacks[6])
+	testutil.ExpectNoDiff(t, []Kind{Int}, f.Stacks[7])
+	testutil.ExpectNoDiff(t, false, f.Reachable[5])
+	testutil.ExpectNoDiff(t, []Kind(nil), f.Stacks[5])
+}
+
+func TestEffect(t *testing.T) {
+	for _, tc := range []struct {
+		i      code.Instr
+		stack  []Kind
+		pops   int
+		result Kind
+	}{
+		{code.Instr{Opcode: code.Push, Operand: 2}, nil, 0, Index},
+		{code.Instr{Opcode: code.Dload, Operand: 2}, []Kind{String, String, Metric}, 3, Datum},
+		{code.Instr{Opcode: code.Strptime}, []Kind{String, String}, 2, 0},
+		{code.Instr{Opcode: code.Strptime}, []Kind{Index, Index, String}, 3, 0},
+		{code.Instr{Opcode: code.Inc, Operand: 0}, []Kind{Datum, Int}, 2, Int},
+	} {
+		pops, result, err := Effect(tc.i, tc.stack)
+		testutil.FatalIfErr(t, err)
+		if pops != tc.pops || result != tc.result {
+			t.Errorf("Effect(%v, %q) = %d, %q; want %d, %q", tc.i, tc.stack, pops, result, tc.pops, tc.result)
+		}
+	}
+}
+
+func TestAnalyzeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		prog []code.Instr
+	}{
+		{"jump backward", []code.Instr{{Opcode: code.Push, Operand: true}, {Opcode: code.Jnm, Operand: 0}}},
+		{"jump past the end", []code.Instr{{Opcode: code.Jmp, Operand: 2}}},
+		{"empty stack", []code.Instr{{Opcode: code.Iadd}}},
+		{"unknown operand", []code.Instr{{Opcode: code.Push, Operand: "x"}}},
+		{"unknown instruction", []code.Instr{{Opcode: code.Bad}}},
+		{"jump on a string", []code.Instr{{Opcode: code.Str, Operand: 0}, {Opcode: code.Jm, Operand: 2}}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Analyze(tc.prog); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -32,7 +32,7 @@ func Fuzz(data []byte) int {
 	// libfuzzer main, which we don't want to intercept here.
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 	flag.CommandLine.Parse([]string{})
-	v, err := Compile("fuzz", bytes.NewReader(data[:offset]), dumpDebug, dumpDebug, false, nil)
+	v, err := Compile("fuzz", bytes.NewReader(data[:offset]), CompileOptions{EmitAst: dumpDebug, EmitAstTypes: dumpDebug})
 	if err != nil {
 		if dumpDebug {
 			fmt.Print(err)
@@ -40,7 +40,7 @@ func Fuzz(data []byte) int {
 		return 0 // false
 	}
 	v.HardCrash = true
-	scanner := bufio.NewScanner(bytes.NewBuffer(data[offset+2:]))
+	scanner := bufio.NewScanner(bytes.NewBuffer(data[offset+len(SEP):]))
 	for scanner.Scan() {
 		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "fuzz", scanner.Text()))
 	}
@@ -0,0 +1,51 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build go1.18
+// +build go1.18
+
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// fuzzSep separates the program from the log lines in a fuzz input; it
+// matches SEP in fuzz.go so crash artifacts from go-fuzz can be replayed here.
+const fuzzSep = "␤"
+
+func FuzzVM(f *testing.F) {
+	for _, pattern := range []string{"../../examples/*.mtail", "fuzz/*.mtail"} {
+		matches, err := filepath.Glob(pattern)
+		testutil.FatalIfErr(f, err)
+		for _, m := range matches {
+			data, err := ioutil.ReadFile(m)
+			testutil.FatalIfErr(f, err)
+			f.Add(data)
+		}
+	}
+	f.Add([]byte("counter a\n/(\\d+)/ { a += $1 }\n" + fuzzSep + "1\n22\nfoo\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		prog, input := data, []byte{}
+		if offset := bytes.Index(data, []byte(fuzzSep)); offset >= 0 {
+			prog, input = data[:offset], data[offset+len(fuzzSep):]
+		}
+		v, err := Compile("fuzz", bytes.NewReader(prog), CompileOptions{})
+		if err != nil {
+			return
+		}
+		v.HardCrash = true
+		scanner := bufio.NewScanner(bytes.NewReader(input))
+		for scanner.Scan() {
+			v.ProcessLogLine(context.Background(), logline.New(context.Background(), "fuzz", scanner.Text()))
+		}
+	})
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package grok expands the named patterns of Logstash's Grok filter, like
+// %{COMBINEDAPACHELOG} and %{IP:client}, into regular expressions, so that
+// programs can share a library of patterns instead of repeating them.
+package grok
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/mtail/internal/vm/types"
+	"github.com/pkg/errors"
+)
+
+var patternsDir = flag.String("grok_patterns_dir", "", "Directory of pattern files in the Logstash Grok format, whose patterns are available to programs as %{NAME} in addition to, or instead of, the bundled ones.  The files are read each time a program is compiled.")
+
+// maxDepth is the deepest that patterns may refer to other patterns.
+const maxDepth = 100
+
+// Library maps the names of patterns to their definitions, which may refer to
+// other patterns in the library.
+type Library map[string]string
+
+// Load returns the bundled library, with the patterns defined in the files of
+// the --grok_patterns_dir directory added to it.
+func Load() (Library, error) {
+	l := Bundled()
+	if *patternsDir == "" {
+		return l, nil
+	}
+	files, err := ioutil.ReadDir(*patternsDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading grok patterns")
+	}
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(*patternsDir, fi.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading grok patterns")
+		}
+		err = l.Add(path, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Bundled returns a new copy of the patterns bundled with mtail.
+func Bundled() Library {
+	l := make(Library)
+	if err := l.Add("bundled", strings.NewReader(bundled)); err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// Add adds the patterns read from r, the pattern file called name, to the
+// library, replacing any with the same names.  Each line of a pattern file
+// names a pattern and gives its definition, separated by whitespace.  Blank
+// lines, and lines starting with #, are ignored.
+func (l Library) Add(name string, r io.Reader) error {
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 || !patternName.MatchString(line[:i]) {
+			return errors.Errorf("%s:%d: expecting a pattern name and definition, but got %q", name, n, line)
+		}
+		l[line[:i]] = strings.TrimSpace(line[i:])
+	}
+	return s.Err()
+}
+
+// Names returns the sorted names of the patterns in the library.
+func (l Library) Names() []string {
+	r := make([]string, 0, len(l))
+	for name := range l {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+var (
+	patternName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// reference matches %{NAME}, %{NAME:field}, and %{NAME:field:type}.
+	reference = regexp.MustCompile(`%\{([A-Za-z_][A-Za-z0-9_]*)(?::([^:}]*))?(?::([^:}]*))?\}`)
+)
+
+// fieldTypes are the types a reference may give the field it captures.
+var fieldTypes = map[string]types.Type{
+	"int":   types.Int,
+	"float": types.Float,
+}
+
+// Expand returns pattern with each reference to a pattern in the library
+// replaced by its definition, in a group that captures the field the
+// reference names, if any.  It also returns the types given to fields by
+// their references.  A reference whose % is escaped by a backslash is left
+// alone.
+func (l Library) Expand(pattern string) (string, map[string]types.Type, error) {
+	var fields map[string]types.Type
+	e := &expansion{lib: l, active: make(map[string]bool)}
+	r, err := e.expand(pattern, 0, func(field, typ string) error {
+		t, ok := fieldTypes[typ]
+		if !ok {
+			return errors.Errorf("unknown type %q for grok field %q, expecting int or float", typ, field)
+		}
+		if fields == nil {
+			fields = make(map[string]types.Type)
+		}
+		fields[field] = t
+		return nil
+	})
+	return r, fields, err
+}
+
+// expansion is the state of expanding one pattern.
+type expansion struct {
+	lib    Library
+	active map[string]bool // The patterns being expanded, to find cycles.
+}
+
+// expand expands the references in pattern, at depth references from the
+// original pattern, calling typed with each field given a type.
+func (e *expansion) expand(pattern string, depth int, typed func(field, typ string) error) (string, error) {
+	if depth > maxDepth {
+		return "", errors.Errorf("grok patterns nested more than %d deep", maxDepth)
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range reference.FindAllStringSubmatchIndex(pattern, -1) {
+		if escaped(pattern, m[0]) {
+			continue
+		}
+		name := pattern[m[2]:m[3]]
+		def, ok := e.lib[name]
+		if !ok {
+			return "", errors.Errorf("unknown grok pattern %q", name)
+		}
+		if e.active[name] {
+			return "", errors.Errorf("grok pattern %q refers to itself", name)
+		}
+		e.active[name] = true
+		sub, err := e.expand(def, depth+1, typed)
+		delete(e.active, name)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(pattern[last:m[0]])
+		switch {
+		case m[4] < 0:
+			fmt.Fprintf(&b, "(?:%s)", sub)
+		default:
+			field := pattern[m[4]:m[5]]
+			if !patternName.MatchString(field) {
+				return "", errors.Errorf("invalid grok field name %q in %q, expecting letters, digits, and underscores", field, pattern[m[0]:m[1]])
+			}
+			if m[6] >= 0 {
+				if err := typed(field, pattern[m[6]:m[7]]); err != nil {
+					return "", err
+				}
+			}
+			fmt.Fprintf(&b, "(?P<%s>%s)", field, sub)
+		}
+		last = m[1]
+	}
+	b.WriteString(pattern[last:])
+	return b.String(), nil
+}
+
+// escaped reports whether the character at i of pattern is escaped by a
+// backslash.
+func escaped(pattern string, i int) bool {
+	n := 0
+	for i > 0 && pattern[i-1] == '\\' {
+		n++
+		i--
+	}
+	return n%2 == 1
+}
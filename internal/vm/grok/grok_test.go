@@ -0,0 +1,162 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package grok
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/vm/types"
+)
+
+func TestBundledPatternsCompile(t *testing.T) {
+	l := Bundled()
+	for _, name := range l.Names() {
+		p, _, err := l.Expand("%{" + name + "}")
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if _, err := regexp.Compile(p); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
+
+var bundledMatchTests = []struct {
+	pattern  string
+	input    string
+	expected map[string]string
+}{
+	{`^%{COMBINEDAPACHELOG}$`,
+		`192.0.2.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08"`,
+		map[string]string{
+			"clientip":    "192.0.2.1",
+			"ident":       "-",
+			"auth":        "frank",
+			"timestamp":   "10/Oct/2000:13:55:36 -0700",
+			"verb":        "GET",
+			"request":     "/apache_pb.gif",
+			"httpversion": "1.0",
+			"rawrequest":  "",
+			"response":    "200",
+			"bytes":       "2326",
+			"referrer":    `"http://www.example.com/start.html"`,
+			"agent":       `"Mozilla/4.08"`,
+		}},
+	{`^%{SYSLOGBASE} %{GREEDYDATA:message}`,
+		`Oct  4 12:00:01 host1 sshd[1234]: Accepted publickey for root`,
+		map[string]string{
+			"timestamp": "Oct  4 12:00:01",
+			"facility":  "",
+			"priority":  "",
+			"logsource": "host1",
+			"program":   "sshd",
+			"pid":       "1234",
+			"message":   "Accepted publickey for root",
+		}},
+	{`^%{TIMESTAMP_ISO8601:ts} %{LOGLEVEL:level} %{IP:addr}`,
+		`2020-10-14T12:00:01Z WARN 2001:db8::1`,
+		map[string]string{"ts": "2020-10-14T12:00:01Z", "level": "WARN", "addr": "2001:db8::1"}},
+	{`%{IPV4:ip}`,
+		`from 10.0.0.255 to`,
+		map[string]string{"ip": "10.0.0.255"}},
+}
+
+func TestBundledPatternsMatch(t *testing.T) {
+	l := Bundled()
+	for _, tc := range bundledMatchTests {
+		p, _, err := l.Expand(tc.pattern)
+		testutil.FatalIfErr(t, err)
+		re := regexp.MustCompile(p)
+		m := re.FindStringSubmatch(tc.input)
+		if m == nil {
+			t.Errorf("%s didn't match %q", tc.pattern, tc.input)
+			continue
+		}
+		got := make(map[string]string)
+		for i, name := range re.SubexpNames() {
+			if name != "" {
+				got[name] = m[i]
+			}
+		}
+		testutil.ExpectNoDiff(t, tc.expected, got)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	l := Library{
+		"DIGITS": `\d+`,
+		"PAIR":   `%{DIGITS:a}-%{DIGITS:b:float}`,
+		"EITHER": `x|y`,
+	}
+	for _, tc := range []struct {
+		pattern    string
+		expected   string
+		fieldTypes map[string]types.Type
+	}{
+		{`^%{DIGITS}$`, `^(?:\d+)$`, nil},
+		{`%{DIGITS:n:int} %{EITHER}`, `(?P<n>\d+) (?:x|y)`, map[string]types.Type{"n": types.Int}},
+		{`%{PAIR:pair}`, `(?P<pair>(?P<a>\d+)-(?P<b>\d+))`, map[string]types.Type{"b": types.Float}},
+		{`\%{DIGITS} \\%{DIGITS}`, `\%{DIGITS} \\(?:\d+)`, nil},
+		{`a%{2} %{ DIGITS}`, `a%{2} %{ DIGITS}`, nil},
+	} {
+		got, fieldTypes, err := l.Expand(tc.pattern)
+		testutil.FatalIfErr(t, err)
+		testutil.ExpectNoDiff(t, tc.expected, got)
+		testutil.ExpectNoDiff(t, tc.fieldTypes, fieldTypes)
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	l := Library{
+		"A":    `%{B}`,
+		"B":    `%{A}`,
+		"WORD": `\w+`,
+	}
+	for _, tc := range []struct {
+		pattern  string
+		expected string
+	}{
+		{`%{NOPE}`, `unknown grok pattern "NOPE"`},
+		{`%{A}`, `grok pattern "A" refers to itself`},
+		{`%{WORD:x:bool}`, `unknown type "bool" for grok field "x", expecting int or float`},
+		{`%{WORD:[x]}`, `invalid grok field name "[x]" in "%{WORD:[x]}", expecting letters, digits, and underscores`},
+	} {
+		_, _, err := l.Expand(tc.pattern)
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.pattern)
+			continue
+		}
+		testutil.ExpectNoDiff(t, tc.expected, err.Error())
+	}
+}
+
+func TestAdd(t *testing.T) {
+	l := Library{"WORD": `\w+`}
+	testutil.FatalIfErr(t, l.Add("test", strings.NewReader("# comment\n\nWORD  [a-z]+\nGREETING\thello %{WORD}\n")))
+	testutil.ExpectNoDiff(t, Library{"WORD": `[a-z]+`, "GREETING": `hello %{WORD}`}, l)
+
+	err := l.Add("bad", strings.NewReader("OK x\nNODEFINITION\n"))
+	if err == nil || err.Error() != `bad:2: expecting a pattern name and definition, but got "NODEFINITION"` {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, rmDir := testutil.TestTempDir(t)
+	defer rmDir()
+	testutil.FatalIfErr(t, ioutil.WriteFile(filepath.Join(dir, "app"), []byte("APPID app-%{INT}\nWORD [a-z]+\n"), 0600))
+	defer testutil.TestSetFlag(t, "grok_patterns_dir", dir)()
+
+	l, err := Load()
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "app-%{INT}", l["APPID"])
+	testutil.ExpectNoDiff(t, "[a-z]+", l["WORD"])
+	testutil.ExpectNoDiff(t, Bundled()["IPV4"], l["IPV4"])
+}
@@ -0,0 +1,437 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/vm/code"
+	"github.com/google/mtail/internal/vm/flow"
+)
+
+// progJITCompiles counts the programs the JIT compiled once they were hot.
+var progJITCompiles = expvar.NewMap("prog_jit_compiles_total")
+
+// jit is the program of a VM compiled to Go closures, one for each
+// instruction, which run in place of the fetch-execute cycle of the
+// interpreter once the program has spent long enough being interpreted.
+//
+// The values on the stack are kept in registers by their depth: integers and
+// bools, as 0 or 1, unboxed in ints, floats unboxed in floats, and the values
+// of every other kind in vals, as they are on the stack of a thread.  The
+// control flow, the matched flag, regular expression matches and captures,
+// and the arithmetic and comparisons of integers and floats are compiled to
+// closures on the registers, a match or comparison followed by a conditional
+// jump being one closure.  Every other instruction is executed by the
+// interpreter, on the stack of the thread, as are those compiled whose
+// operands are out of their bounds, like a division by zero, so that their
+// errors are the same.
+type jit struct {
+	ops []jitOp // By program counter, nil for the instructions that can't be reached.
+
+	ints   []int64
+	floats []float64
+	vals   []interface{}
+}
+
+// jitOp executes the instruction it was compiled from on t, and returns the
+// program counter of the next instruction, or -1 to stop.
+type jitOp func(t *thread) int
+
+// compileJIT compiles the program of v to closures.
+func compileJIT(v *VM) (*jit, error) {
+	f, err := flow.Analyze(v.prog)
+	if err != nil {
+		return nil, err
+	}
+	depth := 0
+	for _, s := range f.Stacks {
+		if len(s) >= depth {
+			depth = len(s) + 1
+		}
+	}
+	j := &jit{
+		ops:    make([]jitOp, len(v.prog)),
+		ints:   make([]int64, depth),
+		floats: make([]float64, depth),
+		vals:   make([]interface{}, depth),
+	}
+	for pc := range v.prog {
+		if f.Reachable[pc] {
+			j.ops[pc] = j.compile(v, f, pc)
+		}
+	}
+	return j, nil
+}
+
+// interpreted notes the time since start spent interpreting a line, and
+// compiles the program once it's been long enough.  A program that can't be
+// compiled is interpreted from then on.
+func (v *VM) interpreted(start time.Time) {
+	v.jitElapsed += time.Since(start)
+	if v.jitElapsed < v.jitAfter {
+		return
+	}
+	v.jitAfter = 0
+	j, err := compileJIT(v)
+	if err != nil {
+		logging.Infof("%s: interpreting, as the program can't be compiled: %s", v.name, err)
+		return
+	}
+	progJITCompiles.Add(v.name, 1)
+	logging.V(1).Infof("%s: compiled after %s interpreting", v.name, v.jitElapsed)
+	v.jit = j
+}
+
+// processCompiledLogLine runs the compiled program on t, in place of the
+// fetch-execute cycle of ProcessLogLine.
+func (v *VM) processCompiledLogLine(t *thread) {
+	ops := v.jit.ops
+	for pc := 0; pc >= 0 && pc < len(ops); {
+		pc = ops[pc](t)
+	}
+	// Terminate only stops this invocation on this line of input; reset the terminate flag.
+	v.terminate = false
+}
+
+// compile returns the closure of the instruction at pc.
+func (j *jit) compile(v *VM, f *flow.Flow, pc int) jitOp {
+	i, stack := v.prog[pc], f.Stacks[pc]
+	ints, floats, vals := j.ints, j.floats, j.vals
+	top := func(kinds ...flow.Kind) bool {
+		if len(stack) < len(kinds) {
+			return false
+		}
+		for n, k := range stack[len(stack)-len(kinds):] {
+			if k != kinds[n] {
+				return false
+			}
+		}
+		return true
+	}
+	// The depth of the value pushed by an instruction that pops none, of the
+	// value on top of the stack, and of the one below it.
+	d, y, x := len(stack), len(stack)-1, len(stack)-2
+	next := pc + 1
+	interpret := j.interpret(v, f, pc)
+
+	switch i.Opcode {
+	case code.Push:
+		switch c := i.Operand.(type) {
+		case int64:
+			return func(*thread) int { ints[d] = c; return next }
+		case float64:
+			return func(*thread) int { floats[d] = c; return next }
+		case bool:
+			n := boolInt(c)
+			return func(*thread) int { ints[d] = n; return next }
+		}
+		val := i.Operand
+		return func(*thread) int { vals[d] = val; return next }
+
+	case code.Str:
+		var val interface{} = v.str[i.Operand.(int)]
+		return func(*thread) int { vals[d] = val; return next }
+
+	case code.Mload:
+		var val interface{} = v.m[i.Operand.(int)]
+		return func(*thread) int { vals[d] = val; return next }
+
+	case code.Setmatched:
+		matched := i.Operand.(bool)
+		return func(t *thread) int { t.matched = matched; return next }
+
+	case code.Otherwise:
+		return j.test(v, f, pc, d, func(t *thread) bool { return !t.matched })
+
+	case code.Match:
+		index := i.Operand.(int)
+		return j.test(v, f, pc, d, func(t *thread) bool {
+			// A backtracking match that gives up is a runtime error of this
+			// instruction.
+			t.pc = next
+			t.matches[index] = v.match(index, v.input.Line)
+			return t.matches[index] != nil
+		})
+
+	case code.Jnm, code.Jm:
+		target, jm := i.Operand.(int), i.Opcode == code.Jm
+		return func(*thread) int {
+			if (ints[y] != 0) == jm {
+				return target
+			}
+			return next
+		}
+
+	case code.Jmp:
+		target := i.Operand.(int)
+		return func(*thread) int { return target }
+
+	case code.Stop:
+		return func(*thread) int { return -1 }
+
+	case code.Capref:
+		op, ok := i.Operand.(int)
+		if !ok || !top(flow.Index) {
+			break
+		}
+		return func(t *thread) int {
+			re, _ := vals[y].(int)
+			m := t.matches[re]
+			if op >= len(m) {
+				return interpret(t)
+			}
+			vals[y] = m[op]
+			return next
+		}
+
+	case code.Cmp, code.Icmp, code.Fcmp:
+		switch {
+		case i.Opcode != code.Fcmp && top(flow.Int, flow.Int):
+			switch i.Operand {
+			case -1:
+				return j.test(v, f, pc, x, func(*thread) bool { return ints[x] < ints[y] })
+			case 0:
+				return j.test(v, f, pc, x, func(*thread) bool { return ints[x] == ints[y] })
+			case 1:
+				return j.test(v, f, pc, x, func(*thread) bool { return ints[x] > ints[y] })
+			}
+		case i.Opcode != code.Icmp && top(flow.Float, flow.Float):
+			switch i.Operand {
+			case -1:
+				return j.test(v, f, pc, x, func(*thread) bool { return floats[x] < floats[y] })
+			case 0:
+				return j.test(v, f, pc, x, func(*thread) bool { return floats[x] == floats[y] })
+			case 1:
+				return j.test(v, f, pc, x, func(*thread) bool { return floats[x] > floats[y] })
+			}
+		}
+
+	case code.Iadd, code.Isub, code.Imul, code.Idiv, code.Imod, code.Ipow, code.Shl, code.Shr, code.And, code.Or, code.Xor:
+		if !top(flow.Int, flow.Int) {
+			break
+		}
+		switch i.Opcode {
+		case code.Iadd:
+			return func(*thread) int { ints[x] += ints[y]; return next }
+		case code.Isub:
+			return func(*thread) int { ints[x] -= ints[y]; return next }
+		case code.Imul:
+			return func(*thread) int { ints[x] *= ints[y]; return next }
+		case code.Idiv, code.Imod:
+			div := i.Opcode == code.Idiv
+			return func(t *thread) int {
+				if ints[y] == 0 {
+					return interpret(t)
+				}
+				if div {
+					ints[x] /= ints[y]
+				} else {
+					ints[x] %= ints[y]
+				}
+				return next
+			}
+		case code.Ipow:
+			return func(*thread) int { ints[x] = int64(math.Pow(float64(ints[x]), float64(ints[y]))); return next }
+		case code.Shl:
+			return func(*thread) int { ints[x] <<= uint(ints[y]); return next }
+		case code.Shr:
+			return func(*thread) int { ints[x] >>= uint(ints[y]); return next }
+		case code.And:
+			return func(*thread) int { ints[x] &= ints[y]; return next }
+		case code.Or:
+			return func(*thread) int { ints[x] |= ints[y]; return next }
+		case code.Xor:
+			return func(*thread) int { ints[x] ^= ints[y]; return next }
+		}
+
+	case code.Fadd, code.Fsub, code.Fmul, code.Fdiv, code.Fmod, code.Fpow:
+		if !top(flow.Float, flow.Float) {
+			break
+		}
+		switch i.Opcode {
+		case code.Fadd:
+			return func(*thread) int { floats[x] += floats[y]; return next }
+		case code.Fsub:
+			return func(*thread) int { floats[x] -= floats[y]; return next }
+		case code.Fmul:
+			return func(*thread) int { floats[x] *= floats[y]; return next }
+		case code.Fdiv:
+			return func(*thread) int { floats[x] /= floats[y]; return next }
+		case code.Fmod:
+			return func(*thread) int { floats[x] = math.Mod(floats[x], floats[y]); return next }
+		case code.Fpow:
+			return func(*thread) int { floats[x] = math.Pow(floats[x], floats[y]); return next }
+		}
+
+	case code.Neg:
+		if top(flow.Int) {
+			return func(*thread) int { ints[y] = ^ints[y]; return next }
+		}
+
+	case code.Not:
+		if top(flow.Bool) {
+			return func(*thread) int { ints[y] ^= 1; return next }
+		}
+
+	case code.I2f:
+		if top(flow.Int) {
+			return func(*thread) int { floats[y] = float64(ints[y]); return next }
+		}
+
+	case code.S2i:
+		if i.Operand != nil || !top(flow.String) {
+			break
+		}
+		return func(t *thread) int {
+			s, _ := vals[y].(string)
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return interpret(t)
+			}
+			ints[y] = n
+			return next
+		}
+
+	case code.S2f:
+		if !top(flow.String) {
+			break
+		}
+		return func(t *thread) int {
+			s, _ := vals[y].(string)
+			r, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return interpret(t)
+			}
+			floats[y] = r
+			return next
+		}
+	}
+	return interpret
+}
+
+// test returns the closure of the instruction at pc, which pushes the bool
+// cond at depth d, fused with the conditional jump that follows it unless
+// that is the target of another jump.  The program stops if cond terminated
+// it, as the interpreter would.
+func (j *jit) test(v *VM, f *flow.Flow, pc, d int, cond func(t *thread) bool) jitOp {
+	next := pc + 1
+	if next < len(v.prog) && !f.Target(next) {
+		if i := v.prog[next]; i.Opcode == code.Jnm || i.Opcode == code.Jm {
+			target, jm, after := i.Operand.(int), i.Opcode == code.Jm, next+1
+			return func(t *thread) int {
+				c := cond(t)
+				switch {
+				case v.terminate:
+					return -1
+				case c == jm:
+					return target
+				}
+				return after
+			}
+		}
+	}
+	ints := j.ints
+	return func(t *thread) int {
+		ints[d] = boolInt(cond(t))
+		if v.terminate {
+			return -1
+		}
+		return next
+	}
+}
+
+// interpret returns the closure executing the instruction at pc by the
+// interpreter, which moves the values it pops from the registers to the stack
+// of the thread, and the value it pushes, if any, back.
+func (j *jit) interpret(v *VM, f *flow.Flow, pc int) jitOp {
+	i, stack := v.prog[pc], f.Stacks[pc]
+	// The program was analysed, so the effect is known.
+	pops, result, _ := flow.Effect(i, stack)
+	base := len(stack) - pops
+	args := stack[base:]
+	next := pc + 1
+	return func(t *thread) int {
+		t.stack = t.stack[:0]
+		for n, k := range args {
+			t.Push(j.box(k, base+n))
+		}
+		t.pc = next
+		v.execute(t, i)
+		if v.terminate {
+			return -1
+		}
+		if result == 0 {
+			return next
+		}
+		if len(t.stack) == 0 {
+			v.errorf("jit: nothing pushed for a %q", result)
+			return -1
+		}
+		if val := t.Pop(); !j.unbox(result, base, val) {
+			v.errorf("jit: a %T pushed for a %q", val, result)
+			return -1
+		}
+		return next
+	}
+}
+
+// box returns the value of kind k in the registers at depth d, as it is on
+// the stack of a thread.
+func (j *jit) box(k flow.Kind, d int) interface{} {
+	switch k {
+	case flow.Int:
+		return j.ints[d]
+	case flow.Bool:
+		return j.ints[d] != 0
+	case flow.Float:
+		return j.floats[d]
+	}
+	return j.vals[d]
+}
+
+// unbox sets the register of kind k at depth d to val, and returns whether
+// val is of that kind.
+func (j *jit) unbox(k flow.Kind, d int, val interface{}) (ok bool) {
+	switch k {
+	case flow.Int:
+		j.ints[d], ok = val.(int64)
+		return ok
+	case flow.Bool:
+		var x bool
+		x, ok = val.(bool)
+		j.ints[d] = boolInt(x)
+		return ok
+	case flow.Float:
+		j.floats[d], ok = val.(float64)
+		return ok
+	}
+	switch val.(type) {
+	case string:
+		ok = k == flow.String
+	case datum.Datum:
+		ok = k == flow.Datum
+	case *metrics.Metric:
+		ok = k == flow.Metric
+	case int:
+		ok = k == flow.Index
+	case time.Duration:
+		ok = k == flow.Duration
+	}
+	j.vals[d] = val
+	return ok
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
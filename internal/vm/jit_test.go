@@ -0,0 +1,156 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestJITEndToEnd(t *testing.T) {
+	for _, tc := range vmTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			store := metrics.NewStore()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			l, err := NewLoader(ctx, "", store, ErrorsAbort(), OmitMetricSource())
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, l.CompileAndRun(tc.name, strings.NewReader(tc.prog)))
+			// Every line is processed by the compiled program.
+			v := l.handles[tc.name]
+			v.jit, err = compileJIT(v)
+			testutil.FatalIfErr(t, err)
+			errorsBefore := runtimeErrorCount(tc.name)
+			scanner := bufio.NewScanner(strings.NewReader(tc.log))
+			for scanner.Scan() {
+				l.ProcessLogLine(ctx, logline.New(ctx, tc.name, scanner.Text()))
+			}
+			l.Close()
+
+			testutil.ExpectNoDiff(t, int64(0), runtimeErrorCount(tc.name)-errorsBefore)
+			testutil.ExpectNoDiff(t, tc.metrics, store.Metrics, testutil.IgnoreUnexported(sync.RWMutex{}), testutil.IgnoreFields(datum.BaseDatum{}, "Time"))
+		})
+	}
+}
+
+func TestJITAfter(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store, JIT(time.Nanosecond))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("after", strings.NewReader(`counter total
+counter errors
+gauge ratio
+/^(\d+) (\d+)$/ {
+  total += $1 / $2
+  ratio = float($1) / float($2)
+  $1 > 10 {
+    errors++
+  }
+}
+`)))
+	v := l.handles["after"]
+	process := func(line string) {
+		l.ProcessLogLine(ctx, logline.New(ctx, "after.log", line))
+	}
+	value := func(name string) string {
+		d, err := store.Metrics[name][0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		return d.ValueString()
+	}
+
+	compilesBefore := jitCompileCount("after")
+	process("4 2")
+	if v.jit == nil {
+		t.Fatal("program not compiled after it was interpreted for longer than the limit")
+	}
+	testutil.ExpectNoDiff(t, int64(1), jitCompileCount("after")-compilesBefore)
+	testutil.ExpectNoDiff(t, "2", value("total"))
+
+	process("30 5")
+	testutil.ExpectNoDiff(t, "8", value("total"))
+	testutil.ExpectNoDiff(t, "6", value("ratio"))
+	testutil.ExpectNoDiff(t, "1", value("errors"))
+
+	// The division by zero is executed by the interpreter, which reports it.
+	errorsBefore := runtimeErrorCount("after")
+	process("3 0")
+	testutil.ExpectNoDiff(t, int64(1), runtimeErrorCount("after")-errorsBefore)
+	testutil.ExpectNoDiff(t, "8", value("total"))
+
+	process("not numbers")
+	process("7 7")
+	testutil.ExpectNoDiff(t, "9", value("total"))
+	testutil.ExpectNoDiff(t, "1", value("errors"))
+	testutil.ExpectNoDiff(t, int64(1), jitCompileCount("after")-compilesBefore)
+	l.Close()
+}
+
+func TestJITTerminatingMatch(t *testing.T) {
+	src := `counter hit
+counter later by x
+/(*PCRE)^(a+)+$/ {
+  hit++
+}
+/b/ {
+  later["y"]++
+}
+`
+	v, err := Compile("jit_terminating_match", strings.NewReader(src), CompileOptions{SyslogUseCurrentYear: true})
+	testutil.FatalIfErr(t, err)
+	v.jit, err = compileJIT(v)
+	testutil.FatalIfErr(t, err)
+	v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", strings.Repeat("a", 40)+"b"))
+
+	// The match that gave up stops the program on the line, so the second
+	// pattern is never tried.
+	if n := progBacktrackingStepLimits.Get("jit_terminating_match"); n == nil || n.String() != "1" {
+		t.Errorf("step limits: expected 1, received %v", n)
+	}
+	testutil.ExpectNoDiff(t, 0, len(v.m[1].LabelValues))
+	if e := v.RuntimeErrorString(); !strings.Contains(e, "Error occurred at instruction 0 {match, 0}, originating in jit_terminating_match at line 3") {
+		t.Errorf("runtime error doesn't name the match: %q", e)
+	}
+	if v.terminate {
+		t.Error("terminate not reset")
+	}
+}
+
+func TestJITLoadErrors(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := NewLoader(ctx, "", store, JIT(0)); err == nil {
+		t.Error("expected an error for a zero duration")
+	}
+}
+
+// runtimeErrorCount returns the number of runtime errors of prog.
+func runtimeErrorCount(prog string) int64 {
+	if v, ok := progRuntimeErrors.Get(prog).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// jitCompileCount returns the number of times prog was compiled by the JIT.
+func jitCompileCount(prog string) int64 {
+	if v, ok := progJITCompiles.Get(prog).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
@@ -11,7 +11,9 @@ package vm
 // of mtail programs.
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"expvar"
 	"fmt"
 	"html/template"
@@ -22,16 +24,24 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/action"
+	"github.com/google/mtail/internal/alert"
+	"github.com/google/mtail/internal/logging"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.opencensus.io/trace"
 
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/geoip"
+	"github.com/google/mtail/internal/health"
 	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
 )
@@ -44,6 +54,10 @@ var (
 	// ProgLoadErrors counts the number of program load errors.
 	ProgLoadErrors    = expvar.NewMap("prog_load_errors_total")
 	progRuntimeErrors = expvar.NewMap("prog_runtime_errors_total")
+	// progRuntimePanics counts the panics recovered while executing programs.
+	progRuntimePanics = expvar.NewMap("prog_runtime_panics_total")
+	// progConversionErrors counts the conversion and timestamp parse errors in strict programs.
+	progConversionErrors = expvar.NewMap("prog_conversion_errors_total")
 )
 
 const (
@@ -52,12 +66,53 @@ const (
 
 // LoadAllPrograms loads all programs in a directory and starts watching the
 // directory for filesystem changes.  Any compile errors are stored for later retrieival.
+// Programs loaded before whose files are no longer in the directory are unloaded.
 // This function returns an error if an internal error occurs.
 func (l *Loader) LoadAllPrograms() error {
+	return l.loadAllPrograms(func(programPath string) error {
+		err := l.LoadProgram(programPath)
+		if err != nil && !l.errorsAbort {
+			logging.Warning(err)
+			return nil
+		}
+		return err
+	})
+}
+
+// CompileAllPrograms loads all programs like LoadAllPrograms, but rather than
+// logging the programs that fail to load and carrying on with the rest, it
+// returns an error listing every one of them.  It is used to fail at startup
+// before any log is read, instead of starting with only some of the metrics.
+func (l *Loader) CompileAllPrograms() error {
+	var failed []string
+	if err := l.loadAllPrograms(func(programPath string) error {
+		compileErr, err := l.loadProgram(programPath)
+		switch {
+		case err != nil:
+			failed = append(failed, err.Error())
+		case compileErr != nil:
+			failed = append(failed, fmt.Sprintf("Compile errors for %s:\n%s", filepath.Base(programPath), compileErr))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("%d programs failed to load:\n%s", len(failed), strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// loadAllPrograms loads each program with load, stopping at the first error
+// it returns.
+func (l *Loader) loadAllPrograms(load func(programPath string) error) error {
 	s, err := os.Stat(l.programPath)
 	if err != nil {
 		return errors.Wrapf(err, "failed to stat %q", l.programPath)
 	}
+	if _, err := l.externConsts(true); err != nil {
+		return err
+	}
 	switch {
 	case s.IsDir():
 		fis, rerr := ioutil.ReadDir(l.programPath)
@@ -65,62 +120,91 @@ func (l *Loader) LoadAllPrograms() error {
 			return errors.Wrapf(rerr, "Failed to list programs in %q", l.programPath)
 		}
 
+		present := make(map[string]struct{})
 		for _, fi := range fis {
-			if fi.IsDir() {
-				continue
+			present[fi.Name()] = struct{}{}
+		}
+		l.handleMu.RLock()
+		var gone []string
+		for name := range l.handles {
+			file := name
+			if bundle, ok := l.bundled[name]; ok {
+				file = bundle
 			}
-			err = l.LoadProgram(path.Join(l.programPath, fi.Name()))
-			if err != nil {
-				if l.errorsAbort {
-					return err
-				}
-				glog.Warning(err)
+			if _, ok := present[file]; !ok {
+				gone = append(gone, name)
 			}
 		}
-	default:
-		err = l.LoadProgram(l.programPath)
-		if err != nil {
-			if l.errorsAbort {
+		l.handleMu.RUnlock()
+		for _, name := range gone {
+			l.UnloadProgram(name)
+		}
+
+		for _, fi := range fis {
+			if fi.IsDir() {
+				continue
+			}
+			if err := load(path.Join(l.programPath, fi.Name())); err != nil {
 				return err
 			}
-			glog.Warning(err)
 		}
+	default:
+		return load(l.programPath)
 	}
 	return nil
 }
 
 // LoadProgram loads or reloads a program from the full pathname programPath.  The name of
-// the program is the basename of the file.
+// the program is the basename of the file.  A bundle of precompiled programs,
+// ending in .mtailc, loads each of the programs in it.
 func (l *Loader) LoadProgram(programPath string) error {
+	compileErr, err := l.loadProgram(programPath)
+	if err != nil {
+		return err
+	}
+	if compileErr != nil {
+		if l.errorsAbort {
+			return compileErr
+		}
+		logging.Infof("Compile errors for %s:\n%s", filepath.Base(programPath), compileErr)
+	}
+	return nil
+}
+
+// loadProgram loads or reloads the program at programPath, returning the
+// errors compiling it, or the error reading it.
+func (l *Loader) loadProgram(programPath string) (compileErr, err error) {
 	name := filepath.Base(programPath)
 	if strings.HasPrefix(name, ".") {
-		glog.V(2).Infof("Skipping %s because it is a hidden file.", programPath)
-		return nil
+		logging.V(2).Infof("Skipping %s because it is a hidden file.", programPath)
+		return nil, nil
+	}
+	if filepath.Ext(name) == bundleExt {
+		return l.loadBundle(programPath)
 	}
 	if filepath.Ext(name) != fileExt {
-		glog.V(2).Infof("Skipping %s due to file extension.", programPath)
-		return nil
+		logging.V(2).Infof("Skipping %s due to file extension.", programPath)
+		return nil, nil
 	}
 	f, err := os.OpenFile(programPath, os.O_RDONLY, 0600)
 	if err != nil {
 		ProgLoadErrors.Add(name, 1)
-		return errors.Wrapf(err, "Failed to read program %q", programPath)
+		return nil, errors.Wrapf(err, "Failed to read program %q", programPath)
 	}
 	defer func() {
 		if err := f.Close(); err != nil {
-			glog.Warning(err)
+			logging.Warning(err)
 		}
 	}()
+	src, err := ioutil.ReadAll(f)
+	if err != nil {
+		ProgLoadErrors.Add(name, 1)
+		return nil, errors.Wrapf(err, "Failed to read program %q", programPath)
+	}
 	l.programErrorMu.Lock()
 	defer l.programErrorMu.Unlock()
-	l.programErrors[name] = l.CompileAndRun(name, f)
-	if l.programErrors[name] != nil {
-		if l.errorsAbort {
-			return l.programErrors[name]
-		}
-		glog.Infof("Compile errors for %s:\n%s", name, l.programErrors[name])
-	}
-	return nil
+	l.programErrors[name] = l.compileProgramFile(name, programPath, src)
+	return l.programErrors[name], nil
 }
 
 const loaderTemplate = `
@@ -189,14 +273,65 @@ func (l *Loader) WriteStatusHTML(w io.Writer) error {
 	return t.Execute(w, data)
 }
 
+// compileProgramFile compiles the program source src read from programPath,
+// with the sidecar manifest next to it if there is one.
+func (l *Loader) compileProgramFile(name, programPath string, src []byte) error {
+	m, ok, err := readSidecarManifest(programPath)
+	if err != nil {
+		ProgLoadErrors.Add(name, 1)
+		return err
+	}
+	var sidecar *Manifest
+	if ok {
+		sidecar = &m
+	}
+	return l.compileAndRun(name, src, sidecar)
+}
+
 // CompileAndRun compiles a program read from the input, starting execution if
 // it succeeds.  If an existing virtual machine of the same name already
 // exists, the previous virtual machine is terminated and the new loaded over
 // it.  If the new program fails to compile, any existing virtual machine with
 // the same name remains running.
 func (l *Loader) CompileAndRun(name string, input io.Reader) error {
-	glog.V(2).Infof("CompileAndRun %s", name)
-	v, errs := Compile(name, input, l.dumpAst, l.dumpAstTypes, l.syslogUseCurrentYear, l.overrideLocation)
+	src, err := ioutil.ReadAll(input)
+	if err != nil {
+		ProgLoadErrors.Add(name, 1)
+		return errors.Wrapf(err, "Failed to read program %q", name)
+	}
+	return l.compileAndRun(name, src, nil)
+}
+
+// compileAndRun compiles and starts the program source src, whose manifest is
+// either embedded in it or the sidecar.
+func (l *Loader) compileAndRun(name string, src []byte, sidecar *Manifest) (err error) {
+	logging.V(2).Infof("CompileAndRun %s", name)
+	// A compiler bug triggered by a malformed program must not take down
+	// the other programs, so report it as a load error instead.
+	defer func() {
+		if r := recover(); r != nil {
+			ProgLoadErrors.Add(name, 1)
+			err = errors.Errorf("Internal error: compiler panic for %s: %v", name, r)
+		}
+	}()
+	manifest, err := programManifest(src, sidecar)
+	if err != nil {
+		ProgLoadErrors.Add(name, 1)
+		return errors.Wrapf(err, "invalid manifest for %s", name)
+	}
+	externs, err := l.externConsts(false)
+	if err != nil {
+		ProgLoadErrors.Add(name, 1)
+		return errors.Wrapf(err, "compile failed for %s", name)
+	}
+	v, errs := Compile(name, bytes.NewReader(src), CompileOptions{
+		EmitAst:              l.dumpAst,
+		EmitAstTypes:         l.dumpAstTypes,
+		InstrumentConditions: l.instrumentConditions,
+		SyslogUseCurrentYear: l.syslogUseCurrentYear,
+		OverrideLocation:     l.overrideLocation,
+		ExternConsts:         externs,
+	})
 	if errs != nil {
 		ProgLoadErrors.Add(name, 1)
 		return errors.Errorf("compile failed for %s:\n%s", name, errs)
@@ -205,35 +340,81 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 		ProgLoadErrors.Add(name, 1)
 		return errors.Errorf("Internal error: Compilation failed for %s: No program returned, but no errors.", name)
 	}
+	return l.run(name, v, src, manifest, "")
+}
+
+// run starts the program called name, compiled to v from the source src, in
+// place of any program of the same name.  The bundle is the name of the
+// bundle the program was loaded from, if it was.
+func (l *Loader) run(name string, v *VM, src []byte, manifest Manifest, bundle string) error {
+	v.timestampBounds = l.timestampBounds
+	v.overflowPolicy = l.overflowPolicy
+	v.alerter = l.alerter
+	v.executor = l.executor
+	v.locator = l.locator
+	v.hmacKey = l.hmacKey
+	v.fileLabels = l.fileLabels
+	v.onUpdate = l.onUpdate
+	v.clock = l.clock
+	v.lastMatch = l.clock.Now().UnixNano()
+	v.manifest = manifest
+	if l.sandbox != nil {
+		s, err := newSandbox(v, *l.sandbox)
+		if err != nil {
+			ProgLoadErrors.Add(name, 1)
+			v.release()
+			return errors.Wrapf(err, "failed to sandbox %s", name)
+		}
+		v.sandbox = s
+	}
+	v.jitAfter = l.jitAfter
+	if l.coverage {
+		v.EnableCoverage(src)
+	}
 
 	if l.dumpBytecode {
-		glog.Info("Dumping program objects and bytecode\n", v.DumpByteCode())
+		logging.Info("Dumping program objects and bytecode\n", v.DumpByteCode())
 	}
 
 	// Load the metrics from the compilation into the global metric storage for export.
 	for _, m := range v.m {
 		if !m.Hidden {
+			if l.fileLabels != nil {
+				l.fileLabels.addKeys(m)
+			}
 			if l.omitMetricSource {
 				m.Source = ""
 			}
-			err := l.ms.Add(m)
-			if err != nil {
+			if err := l.ms.Add(m); err != nil {
+				v.release()
 				return err
 			}
 		}
 	}
 
 	ProgLoads.Add(name, 1)
-	glog.Infof("Loaded program %s", name)
+	logging.Infof("Loaded program %s", name)
 
 	if l.compileOnly {
+		v.release()
 		return nil
 	}
 
 	l.handleMu.Lock()
 	defer l.handleMu.Unlock()
 
+	// A reloaded program carries on from the last match of the old one.
+	if old, ok := l.handles[name]; ok {
+		v.lastMatch = atomic.LoadInt64(&old.lastMatch)
+		old.release()
+	}
 	l.handles[name] = v
+	if bundle != "" {
+		l.bundled[name] = bundle
+	} else {
+		delete(l.bundled, name)
+	}
+	l.router.reset()
 	return nil
 }
 
@@ -241,13 +422,17 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 // the configured program source directory, compiling changes to programs, and
 // managing the virtual machines.
 type Loader struct {
+	health health.Activity // records each line processed, and kept first so it is 64-bit aligned
+
 	ctx         context.Context       // a cancellable context
+	cancel      context.CancelFunc    // cancels ctx when the Loader is closed
 	ms          *metrics.Store        // pointer to metrics.Store to pass to compiler
 	reg         prometheus.Registerer // plce to reg metrics
 	programPath string                // Path that contains mtail programs.
 
-	handleMu sync.RWMutex   // guards accesses to handles
-	handles  map[string]*VM // map of program names to virtual machines
+	handleMu sync.RWMutex      // guards accesses to handles
+	handles  map[string]*VM    // map of program names to virtual machines
+	bundled  map[string]string // the bundles programs were loaded from, by program name
 
 	programErrorMu sync.RWMutex     // guards access to programErrors
 	programErrors  map[string]error // errors from the last compile attempt of the program
@@ -260,8 +445,35 @@ type Loader struct {
 	dumpBytecode         bool           // Instructs the loader to dump to stdout the compiled program after compilation.
 	syslogUseCurrentYear bool           // Instructs the VM to overwrite zero years with the current year in a strptime instruction.
 	omitMetricSource     bool
+	instrumentConditions bool // Count the matches of each top-level condition of each program.
+	coverage             bool // Record the coverage of each program's source by the lines processed.
+
+	sandbox  *SandboxLimits // If set, the limits of the sandbox each program is run in.
+	jitAfter time.Duration  // How long each program is interpreted before it's compiled to closures, or zero to never compile them.
+
+	timestampBounds timestampBounds // Applied to the metric updates of each program.
+	overflowPolicy  OverflowPolicy  // Applied to the integer metrics of each program.
+
+	alerter  alert.Alerter   // Receives the alerts raised by each program.
+	executor action.Executor // Runs the commands requested by each program.
+	locator  geoip.Locator   // Looks up the addresses given to the geoip builtins by each program.
+	hmacKey  []byte          // The key of the hmac builtin in each program.
+
+	fileLabels *fileLabels // Added to the metrics of each program from the paths of logs.
 
-	signalQuit chan struct{} // When closed stops the signal handler goroutine.
+	externConstsGiven map[string]string // The values of extern consts given to the loader.
+	externConstsFile  string            // The file of the values of extern consts not given, if any.
+	externMu          sync.Mutex        // guards externValues
+	externValues      map[string]string // The values of extern consts as of the last load of the programs.
+
+	onUpdate func(Update) // Called with each change programs make to their metrics.
+
+	clock clock.Clock // Tells the time of each program's metric updates and matches.
+
+	scopes *scopes // The log patterns that programs are bound to, if any.
+	router router  // The programs that process each log, by their filename filters.
+
+	signalDone chan struct{} // Closed when the signal handler goroutine has stopped.
 }
 
 // Option configures a new program Loader.
@@ -323,6 +535,99 @@ func SyslogUseCurrentYear() Option {
 	}
 }
 
+// BoundTimestamps sets what programs do with metric updates whose timestamp
+// is more than maxFuture ahead of the current time or maxAge behind it.  A
+// zero bound is not checked.
+func BoundTimestamps(policy TimestampPolicy, maxFuture, maxAge time.Duration) Option {
+	return func(l *Loader) error {
+		if maxFuture < 0 || maxAge < 0 {
+			return errors.New("timestamp bounds must not be negative")
+		}
+		l.timestampBounds = timestampBounds{policy, maxFuture, maxAge}
+		return nil
+	}
+}
+
+// IntOverflow sets what programs do when incrementing or decrementing an
+// integer metric passes the limits of an int64.
+func IntOverflow(policy OverflowPolicy) Option {
+	return func(l *Loader) error {
+		l.overflowPolicy = policy
+		return nil
+	}
+}
+
+// Alerter sets where the alerts raised by the alert() builtin are sent.
+// Without one, alerts are logged.
+func Alerter(a alert.Alerter) Option {
+	return func(l *Loader) error {
+		l.alerter = a
+		return nil
+	}
+}
+
+// Executor sets what runs the commands requested by the exec() builtin.
+// Without one, exec() is a runtime error.
+func Executor(e action.Executor) Option {
+	return func(l *Loader) error {
+		l.executor = e
+		return nil
+	}
+}
+
+// GeoIP sets what looks up the addresses given to the geoip_country() and
+// geoip_asn() builtins.  Without one, they are runtime errors.
+func GeoIP(g geoip.Locator) Option {
+	return func(l *Loader) error {
+		l.locator = g
+		return nil
+	}
+}
+
+// HMACKey sets the secret key of the hmac() builtin.  Without one, hmac() is a
+// runtime error.
+func HMACKey(key []byte) Option {
+	return func(l *Loader) error {
+		l.hmacKey = key
+		return nil
+	}
+}
+
+// FileLabels adds labels to the metrics of every program, with values given
+// by the rule for the path of the log that each update came from.  Updates
+// from logs that no rule matches have empty values.
+func FileLabels(rules []FileLabelRule) Option {
+	return func(l *Loader) error {
+		f, err := newFileLabels(rules)
+		if err != nil {
+			return err
+		}
+		l.fileLabels = f
+		return nil
+	}
+}
+
+// ExternConsts gives the values of the extern consts declared by programs, by
+// name, and the file of NAME=value lines giving those not in values, if any.
+// The file is read each time all the programs are loaded.  Extern consts
+// given in neither are read from the environment.
+func ExternConsts(values map[string]string, file string) Option {
+	return func(l *Loader) error {
+		l.externConstsGiven = values
+		l.externConstsFile = file
+		return nil
+	}
+}
+
+// Clock sets the clock that programs tell the time by, instead of the system
+// clock.
+func Clock(c clock.Clock) Option {
+	return func(l *Loader) error {
+		l.clock = c
+		return nil
+	}
+}
+
 // OmitMetricSource instructs the Loader to not annotate metrics with their program source when added to the metric store.
 func OmitMetricSource() Option {
 	return func(l *Loader) error {
@@ -331,6 +636,50 @@ func OmitMetricSource() Option {
 	}
 }
 
+// InstrumentConditions instructs the Loader to compile programs that count the
+// lines matching each of their top-level conditions, exported by source line.
+func InstrumentConditions() Option {
+	return func(l *Loader) error {
+		l.instrumentConditions = true
+		return nil
+	}
+}
+
+// Coverage instructs the Loader to record which lines of each program's
+// source are exercised, for WriteCoverage.
+func Coverage() Option {
+	return func(l *Loader) error {
+		l.coverage = true
+		return nil
+	}
+}
+
+// Sandbox instructs the Loader to compile each program to WebAssembly and run
+// it in a sandbox with the limits given, instead of interpreting it.  It is
+// experimental, and needs mtail to be built with Go 1.18 or later.
+func Sandbox(limits SandboxLimits) Option {
+	return func(l *Loader) error {
+		if limits.LineTimeout <= 0 || limits.LineBytes <= 0 {
+			return errors.New("sandbox limits must be positive")
+		}
+		l.sandbox = &limits
+		return nil
+	}
+}
+
+// JIT instructs the Loader to compile the bytecode of each program to Go
+// closures once it has spent the duration given interpreting lines, so that
+// the hottest programs are no longer interpreted.
+func JIT(after time.Duration) Option {
+	return func(l *Loader) error {
+		if after <= 0 {
+			return errors.New("the time programs are interpreted before they're compiled must be positive")
+		}
+		l.jitAfter = after
+		return nil
+	}
+}
+
 // PrometheusRegisterer passes in a registry for setting up exported metrics.
 func PrometheusRegisterer(reg prometheus.Registerer) Option {
 	return func(l *Loader) error {
@@ -345,30 +694,33 @@ func NewLoader(ctx context.Context, programPath string, store *metrics.Store, op
 		return nil, errors.New("loader needs a store")
 	}
 	l := &Loader{
-		ctx:           ctx,
 		ms:            store,
 		programPath:   programPath,
 		handles:       make(map[string]*VM),
+		bundled:       make(map[string]string),
 		programErrors: make(map[string]error),
-		signalQuit:    make(chan struct{}),
+		signalDone:    make(chan struct{}),
+		clock:         clock.Real,
 	}
 	if err := l.SetOption(options...); err != nil {
 		return nil, err
 	}
+	l.ctx, l.cancel = context.WithCancel(ctx)
 	if l.reg != nil {
-		l.reg.MustRegister(lineProcessingDurations)
+		l.reg.MustRegister(lineProcessingDurations, lineLatencies, l)
 	}
 	go func() {
+		defer close(l.signalDone)
 		n := make(chan os.Signal, 1)
 		signal.Notify(n, syscall.SIGHUP)
 		defer signal.Stop(n)
 		for {
 			select {
-			case <-ctx.Done():
+			case <-l.ctx.Done():
 				return
 			case <-n:
 				if err := l.LoadAllPrograms(); err != nil {
-					glog.Info(err)
+					logging.Info(err)
 				}
 			}
 		}
@@ -386,13 +738,19 @@ func (l *Loader) SetOption(options ...Option) error {
 	return nil
 }
 
+// Close stops the Loader reloading programs on SIGHUP, and removes the
+// programs.
 func (l *Loader) Close() {
-	glog.Info("Shutting down loader.")
+	logging.Info("Shutting down loader.")
+	l.cancel()
+	<-l.signalDone
 	l.handleMu.Lock()
 	defer l.handleMu.Unlock()
-	for prog := range l.handles {
+	for prog, v := range l.handles {
+		v.release()
 		delete(l.handles, prog)
 	}
+	l.router.reset()
 }
 
 // ProcessLogLine satisfies the LogLine.Processor interface.
@@ -400,23 +758,71 @@ func (l *Loader) ProcessLogLine(ctx context.Context, ll *logline.LogLine) {
 	ctx, span := trace.StartSpan(ctx, "Loader.ProcessLogLine")
 	defer span.End()
 	LineCount.Add(1)
+	l.health.Start()
+	defer l.health.Done()
 	l.handleMu.RLock()
 	defer l.handleMu.RUnlock()
-	for prog := range l.handles {
+	// The metric updates made by every program for this line are one batch,
+	// so that an export never sees some of them without the rest.
+	l.ms.BeginUpdate()
+	defer l.ms.EndUpdate()
+	for _, prog := range l.router.route(ll.Filename, l.handles) {
+		if !l.scopes.inScope(prog, ll.Filename) {
+			continue
+		}
 		l.handles[prog].ProcessLogLine(ctx, ll)
 	}
 }
 
-// UnloadProgram removes the named program, any currently running VM goroutine.
+// UnloadProgram removes the named program, any currently running VM goroutine,
+// and the metrics it defined from the store.  A bundle's name removes all the
+// programs loaded from it.
 func (l *Loader) UnloadProgram(pathname string) {
 	name := filepath.Base(pathname)
+	if filepath.Ext(name) == bundleExt {
+		l.unloadBundle(name)
+		return
+	}
+	l.programErrorMu.Lock()
+	delete(l.programErrors, name)
+	l.programErrorMu.Unlock()
 	l.handleMu.Lock()
-	defer l.handleMu.Unlock()
-	if _, ok := l.handles[name]; ok {
-		delete(l.handles, name)
+	v, ok := l.handles[name]
+	delete(l.handles, name)
+	delete(l.bundled, name)
+	l.router.reset()
+	l.handleMu.Unlock()
+	if !ok {
+		return
 	}
+	v.release()
+	if l.ms != nil {
+		l.ms.RemoveProgram(name)
+	}
+	logging.Infof("Unloaded program %s", name)
+}
+
+// WriteCoverage writes the annotated source of each program, in order of
+// name, showing the lines exercised since it was loaded.  The Loader must have
+// been created with the Coverage option.
+func (l *Loader) WriteCoverage(w io.Writer) error {
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	names := make([]string, 0, len(l.handles))
+	for name := range l.handles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := l.handles[name].WriteCoverage(w); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// ProgzHandler lists the programs loaded and their manifests, as JSON with
+// format=json, or shows the bytecode of the program named by prog.
 func (l *Loader) ProgzHandler(w http.ResponseWriter, r *http.Request) {
 	prog := r.URL.Query().Get("prog")
 	if prog != "" {
@@ -427,16 +833,223 @@ func (l *Loader) ProgzHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "No program found", http.StatusNotFound)
 			return
 		}
+		m := v.manifest
+		fmt.Fprintf(w, "Name: %s\nVersion: %s\nAuthor: %s\nChecksum: %s\n\n", m.Name, m.Version, m.Author, m.Checksum)
 		fmt.Fprintf(w, v.DumpByteCode())
 		fmt.Fprintf(w, "\nLast runtime error:\n%s", v.RuntimeErrorString())
 		return
 	}
 	l.handleMu.RLock()
 	defer l.handleMu.RUnlock()
+	if r.URL.Query().Get("format") == "json" {
+		manifests := make(map[string]Manifest, len(l.handles))
+		for prog, v := range l.handles {
+			manifests[prog] = v.manifest
+		}
+		w.Header().Set("Content-type", "application/json")
+		if err := json.NewEncoder(w).Encode(manifests); err != nil {
+			logging.Warning(err)
+		}
+		return
+	}
 	w.Header().Add("Content-type", "text/html")
 	fmt.Fprintf(w, "<ul>")
-	for prog := range l.handles {
-		fmt.Fprintf(w, "<li><a href=\"?prog=%s\">%s</a></li>", prog, prog)
+	for prog, v := range l.handles {
+		fmt.Fprintf(w, "<li><a href=\"?prog=%s\">%s</a>", prog, prog)
+		if v.manifest.Version != "" {
+			fmt.Fprintf(w, " %s", template.HTMLEscapeString(v.manifest.Version))
+		}
+		fmt.Fprintf(w, " (<a href=\"/progz/%s/ast\">ast</a>, <a href=\"/progz/%s/ast?format=dot\">dot</a>)", prog, prog)
+		fmt.Fprintf(w, "</li>")
 	}
 	fmt.Fprintf(w, "</ul>")
 }
+
+// ASTHandler serves the syntax tree and bytecode of the program named in a
+// path of the form /progz/<name>/ast, as JSON, or with format=dot as a
+// graphviz graph.
+func (l *Loader) ASTHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/progz/")
+	if !strings.HasSuffix(name, "/ast") {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.TrimSuffix(name, "/ast")
+	l.handleMu.RLock()
+	v, ok := l.handles[name]
+	l.handleMu.RUnlock()
+	if !ok {
+		http.Error(w, "No program found", http.StatusNotFound)
+		return
+	}
+	var err error
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		w.Header().Set("Content-type", "application/json")
+		err = v.WriteASTJSON(w)
+	case "dot":
+		w.Header().Set("Content-type", "text/vnd.graphviz")
+		err = v.WriteDot(w)
+	default:
+		http.Error(w, fmt.Sprintf("Unknown format %q, expecting json or dot", format), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logging.Warning(err)
+	}
+}
+
+// Health reports when the Loader last finished processing a log line, and the
+// runtime errors of the programs loaded.  It is ready once at least one
+// program is loaded.
+func (l *Loader) Health() health.Status {
+	s := l.health.Status("loader")
+	s.Critical = true
+	l.handleMu.RLock()
+	for name := range l.handles {
+		if v, ok := progRuntimeErrors.Get(name).(*expvar.Int); ok {
+			s.Errors += v.Value()
+		}
+	}
+	loaded := len(l.handles)
+	l.handleMu.RUnlock()
+	l.programErrorMu.RLock()
+	failed := 0
+	for _, err := range l.programErrors {
+		if err != nil {
+			failed++
+		}
+	}
+	l.programErrorMu.RUnlock()
+	s.Ready = loaded > 0
+	s.Message = fmt.Sprintf("%d programs loaded, %d failed to compile", loaded, failed)
+	return s
+}
+
+// ProgramNames returns the names of the programs currently loaded.
+func (l *Loader) ProgramNames() (names []string) {
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	for name := range l.handles {
+		names = append(names, name)
+	}
+	return
+}
+
+// ProgramStatus describes the state of a program known to the Loader.
+type ProgramStatus struct {
+	Name             string    `json:"name"`
+	Version          string    `json:"version,omitempty"` // From the program's manifest.
+	Loaded           bool      `json:"loaded"`            // False if the program has never compiled.
+	CompileError     string    `json:"compile_error,omitempty"`
+	Loads            int64     `json:"loads"`
+	LoadErrors       int64     `json:"load_errors"`
+	RuntimeErrors    int64     `json:"runtime_errors"`
+	LastRuntimeError string    `json:"last_runtime_error,omitempty"`
+	LastMatch        time.Time `json:"last_match"` // When a line last matched, or when the program was loaded.
+}
+
+// mapCounter returns the value of key in m, or zero.
+func mapCounter(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// ProgramStatuses returns the state of each program loaded or that failed to
+// compile, ordered by name.
+func (l *Loader) ProgramStatuses() []ProgramStatus {
+	// Compiling a program holds programErrorMu while taking handleMu.
+	l.programErrorMu.RLock()
+	defer l.programErrorMu.RUnlock()
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	r := make([]ProgramStatus, 0, len(l.programErrors))
+	for name, v := range l.handles {
+		r = append(r, l.programStatus(name, v))
+	}
+	for name := range l.programErrors {
+		if _, ok := l.handles[name]; !ok {
+			r = append(r, l.programStatus(name, nil))
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
+// programStatus returns the state of the program called name, running in v if
+// it has compiled.  The caller holds programErrorMu.
+func (l *Loader) programStatus(name string, v *VM) ProgramStatus {
+	s := ProgramStatus{
+		Name:          name,
+		Loads:         mapCounter(ProgLoads, name),
+		LoadErrors:    mapCounter(ProgLoadErrors, name),
+		RuntimeErrors: mapCounter(progRuntimeErrors, name),
+	}
+	if err := l.programErrors[name]; err != nil {
+		s.CompileError = err.Error()
+	}
+	if v != nil {
+		s.Loaded = true
+		s.Version = v.manifest.Version
+		s.LastRuntimeError = v.RuntimeErrorString()
+		s.LastMatch = v.LastMatchTime()
+	}
+	return s
+}
+
+// progSilenceDesc describes the time since each program last matched a line,
+// so that a log that has stopped reporting what a program looks for can be
+// alerted on without a timer in every program.
+var progSilenceDesc = prometheus.NewDesc(
+	"mtail_prog_seconds_since_last_match",
+	"number of seconds since a line last matched any pattern of each program, or since it was loaded if never",
+	[]string{"prog"}, nil)
+
+// progInfoDesc describes the manifest of each program, so that the versions
+// deployed can be compared across a fleet.
+var progInfoDesc = prometheus.NewDesc(
+	"mtail_prog_info",
+	"a metric with a constant '1' value labelled by the manifest of each program",
+	[]string{"prog", "name", "version", "author", "checksum"}, nil)
+
+// progSyntaxDesc describes the language version each program is written in,
+// so that the programs still to be moved to a new version can be found.
+var progSyntaxDesc = prometheus.NewDesc(
+	"mtail_prog_syntax_info",
+	"a metric with a constant '1' value labelled by the language version of each program",
+	[]string{"prog", "syntax"}, nil)
+
+// conditionMatchesDesc describes the number of lines matched by each top-level
+// condition of a program compiled with InstrumentConditions, so that hot and
+// dead branches can be found in production.
+var conditionMatchesDesc = prometheus.NewDesc(
+	"mtail_program_condition_matches_total",
+	"number of lines matched by each top-level condition of each program, by source line",
+	[]string{"prog", "line"}, nil)
+
+// Describe implements prometheus.Collector.
+func (l *Loader) Describe(c chan<- *prometheus.Desc) {
+	c <- progSilenceDesc
+	c <- progInfoDesc
+	c <- progSyntaxDesc
+	c <- conditionMatchesDesc
+}
+
+// Collect implements prometheus.Collector, reporting the silence, the
+// manifest, and the language version of each loaded program.
+func (l *Loader) Collect(c chan<- prometheus.Metric) {
+	now := l.clock.Now()
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	for name, v := range l.handles {
+		c <- prometheus.MustNewConstMetric(progSilenceDesc, prometheus.GaugeValue, now.Sub(v.LastMatchTime()).Seconds(), name)
+		m := v.manifest
+		c <- prometheus.MustNewConstMetric(progInfoDesc, prometheus.GaugeValue, 1, name, m.Name, m.Version, m.Author, m.Checksum)
+		c <- prometheus.MustNewConstMetric(progSyntaxDesc, prometheus.GaugeValue, 1, name, v.Syntax())
+		for i, line := range v.conditions {
+			c <- prometheus.MustNewConstMetric(conditionMatchesDesc, prometheus.CounterValue, float64(atomic.LoadInt64(&v.conditionMatches[i])), name, strconv.Itoa(line+1))
+		}
+	}
+}
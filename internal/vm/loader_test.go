@@ -5,13 +5,23 @@ package vm
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestNewLoader(t *testing.T) {
@@ -22,6 +32,21 @@ func TestNewLoader(t *testing.T) {
 	cancel()
 }
 
+func TestLoaderClose(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store)
+	testutil.FatalIfErr(t, err)
+	l.Close()
+	// Close waits for the signal handler to stop.
+	select {
+	case <-l.signalDone:
+	default:
+		t.Error("signal handler still running after Close")
+	}
+}
+
 func TestCompileAndRun(t *testing.T) {
 	var testProgram = "/$/ {}\n"
 	store := metrics.NewStore()
@@ -66,8 +91,286 @@ func TestLoadProg(t *testing.T) {
 		f := testutil.TestOpenFile(t, path.Join(tmpDir, name))
 		n, err := f.WriteString(testProgram)
 		testutil.FatalIfErr(t, err)
-		glog.Infof("Wrote %d bytes", n)
+		logging.Infof("Wrote %d bytes", n)
 		err = l.LoadProgram(path.Join(tmpDir, name))
 		testutil.FatalIfErr(t, err)
 	}
 }
+
+func TestLoadAllProgramsUnloadsRemoved(t *testing.T) {
+	store := metrics.NewStore()
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, tmpDir, store)
+	testutil.FatalIfErr(t, err)
+
+	for _, name := range []string{"keep.mtail", "remove.mtail"} {
+		f := testutil.TestOpenFile(t, path.Join(tmpDir, name))
+		m := strings.TrimSuffix(name, ".mtail")
+		_, err := f.WriteString("counter " + m + "\n/$/ {\n  " + m + "++\n}\n")
+		testutil.FatalIfErr(t, err)
+		testutil.FatalIfErr(t, f.Close())
+	}
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+	if len(store.Metrics) != 2 {
+		t.Fatalf("expected 2 metrics, not %v", store.Metrics)
+	}
+
+	testutil.FatalIfErr(t, os.Remove(path.Join(tmpDir, "remove.mtail")))
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+	testutil.ExpectNoDiff(t, []string{"keep.mtail"}, l.ProgramNames())
+	if _, ok := store.Metrics["remove"]; ok || len(store.Metrics) != 1 {
+		t.Errorf("expected only the metric of keep.mtail, not %v", store.Metrics)
+	}
+}
+
+func TestProgramStatuses(t *testing.T) {
+	store := metrics.NewStore()
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, tmpDir, store)
+	testutil.FatalIfErr(t, err)
+
+	for name, src := range map[string]string{
+		"good.mtail": "counter good\n/$/ {\n  good++\n}\n",
+		"bad.mtail":  "counter bad\n/$/ {\n  bad++\n",
+	} {
+		f := testutil.TestOpenFile(t, path.Join(tmpDir, name))
+		_, err := f.WriteString(src)
+		testutil.FatalIfErr(t, err)
+		testutil.FatalIfErr(t, f.Close())
+	}
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+	s := l.ProgramStatuses()
+	if len(s) != 2 {
+		t.Fatalf("expected 2 programs, not %v", s)
+	}
+	testutil.ExpectNoDiff(t, "bad.mtail", s[0].Name)
+	if s[0].Loaded || s[0].CompileError == "" {
+		t.Errorf("expected bad.mtail not loaded with a compile error, not %+v", s[0])
+	}
+	testutil.ExpectNoDiff(t, "good.mtail", s[1].Name)
+	if !s[1].Loaded || s[1].CompileError != "" {
+		t.Errorf("expected good.mtail loaded, not %+v", s[1])
+	}
+}
+
+func TestCompileAllPrograms(t *testing.T) {
+	store := metrics.NewStore()
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, tmpDir, store)
+	testutil.FatalIfErr(t, err)
+
+	for name, src := range map[string]string{
+		"good.mtail":  "counter good\n/$/ {\n  good++\n}\n",
+		"bad.mtail":   "counter bad\n/$/ {\n  bad++\n",
+		"worse.mtail": "/$/ {\n  worse++\n}\n",
+	} {
+		f := testutil.TestOpenFile(t, path.Join(tmpDir, name))
+		_, err := f.WriteString(src)
+		testutil.FatalIfErr(t, err)
+		testutil.FatalIfErr(t, f.Close())
+	}
+	err = l.CompileAllPrograms()
+	if err == nil {
+		t.Fatal("expected compile errors")
+	}
+	for _, name := range []string{"bad.mtail", "worse.mtail"} {
+		if !strings.Contains(err.Error(), "Compile errors for "+name) {
+			t.Errorf("expected errors for %s in %q", name, err)
+		}
+	}
+	if strings.Contains(err.Error(), "good.mtail") {
+		t.Errorf("unexpected errors for good.mtail in %q", err)
+	}
+	// The programs that compiled are still loaded.
+	testutil.ExpectNoDiff(t, 1, len(l.handles))
+}
+
+// lastMatchSeconds returns the value of the only mtail_prog_seconds_since_last_match collected from l.
+func lastMatchSeconds(t *testing.T, l *Loader) float64 {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	testutil.FatalIfErr(t, reg.Register(l))
+	mfs, err := reg.Gather()
+	testutil.FatalIfErr(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == "mtail_prog_seconds_since_last_match" {
+			return mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatal("mtail_prog_seconds_since_last_match not collected")
+	return 0
+}
+
+func TestLoaderLastMatch(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("Test", strings.NewReader("/match/ {}\n")))
+
+	hourAgo := time.Now().Add(-time.Hour)
+	l.handleMu.Lock()
+	l.handles["Test"].lastMatch = hourAgo.UnixNano()
+	l.handleMu.Unlock()
+	l.ProcessLogLine(ctx, logline.New(ctx, "log", "no"))
+	if s := lastMatchSeconds(t, l); s < 3600 {
+		t.Errorf("seconds since last match %v after a line that doesn't match, expected at least an hour", s)
+	}
+
+	// A reload keeps the time of the last match.
+	testutil.FatalIfErr(t, l.CompileAndRun("Test", strings.NewReader("/match/ {}\n")))
+	l.handleMu.RLock()
+	testutil.ExpectNoDiff(t, hourAgo.UnixNano(), l.handles["Test"].LastMatchTime().UnixNano())
+	l.handleMu.RUnlock()
+
+	l.ProcessLogLine(ctx, logline.New(ctx, "log", "match"))
+	if s := lastMatchSeconds(t, l); s > 60 {
+		t.Errorf("seconds since last match %v after a matching line, expected about zero", s)
+	}
+}
+
+func TestLoaderClock(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store, Clock(clock.NewFake(now)))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("Test", strings.NewReader("gauge seen\n/match/ {\n  seen = timestamp()\n}\n")))
+
+	l.ProcessLogLine(ctx, logline.New(ctx, "log", "match"))
+
+	m := store.Metrics["seen"][0]
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, now.Unix(), datum.GetInt(d))
+	testutil.ExpectNoDiff(t, now, d.TimeUTC())
+}
+
+func TestLoaderExternConsts(t *testing.T) {
+	store := metrics.NewStore()
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	progs := path.Join(tmpDir, "progs")
+	testutil.FatalIfErr(t, os.Mkdir(progs, 0o700))
+	prog := path.Join(progs, "extern.mtail")
+	f := testutil.TestOpenFile(t, prog)
+	testutil.WriteString(t, f, "syntax = \"v2\"\nextern const ROLE\nextern const DATACENTER\ncounter requests by role, dc\n/$/ {\n  requests[ROLE][DATACENTER]++\n}\n")
+	testutil.FatalIfErr(t, f.Close())
+	file := path.Join(tmpDir, "externs")
+	f = testutil.TestOpenFile(t, file)
+	testutil.WriteString(t, f, "# The role of this host.\nROLE=frontend\nDATACENTER=eu-west2\n")
+	testutil.FatalIfErr(t, f.Close())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, progs, store, ErrorsAbort(), ExternConsts(map[string]string{"DATACENTER": "us-east1"}, file))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+
+	l.ProcessLogLine(ctx, logline.New(ctx, "log", "line"))
+	testutil.ExpectNoDiff(t, []string{"frontend", "us-east1"}, store.Metrics["requests"][0].LabelValues[0].Labels)
+
+	// Reloading one program, as when its file changes, doesn't reread the
+	// file of values, but loading them all does.
+	testutil.FatalIfErr(t, os.Remove(file))
+	testutil.FatalIfErr(t, l.LoadProgram(prog))
+	if err := l.LoadAllPrograms(); err == nil {
+		t.Error("expected an error reading the removed file of extern consts")
+	}
+}
+
+func TestLoaderInstrumentConditions(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store, InstrumentConditions())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("Test", strings.NewReader("/a/ {\n  /b/ {}\n}\n/c/ {}\n")))
+
+	for _, line := range []string{"ab", "a", "x"} {
+		l.ProcessLogLine(ctx, logline.New(ctx, "log", line))
+	}
+	// The nested condition isn't counted.
+	expected := `
+# HELP mtail_program_condition_matches_total number of lines matched by each top-level condition of each program, by source line
+# TYPE mtail_program_condition_matches_total counter
+mtail_program_condition_matches_total{line="1",prog="Test"} 2
+mtail_program_condition_matches_total{line="4",prog="Test"} 0
+`
+	testutil.FatalIfErr(t, promtest.CollectAndCompare(l, strings.NewReader(expected), "mtail_program_condition_matches_total"))
+}
+
+func TestLoaderSyntax(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("old", strings.NewReader("counter a\n/x/ {\n  a++\n}\n")))
+	testutil.FatalIfErr(t, l.CompileAndRun("new", strings.NewReader("syntax = \"v2\"\ncounter a\n/x/ {\n  a++ # comment\n}\n")))
+
+	expected := `
+# HELP mtail_prog_syntax_info a metric with a constant '1' value labelled by the language version of each program
+# TYPE mtail_prog_syntax_info gauge
+mtail_prog_syntax_info{prog="new",syntax="v2"} 1
+mtail_prog_syntax_info{prog="old",syntax="v1"} 1
+`
+	testutil.FatalIfErr(t, promtest.CollectAndCompare(l, strings.NewReader(expected), "mtail_prog_syntax_info"))
+}
+
+func TestASTHandler(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("test.mtail", strings.NewReader("counter a\n/x/ {\n  a++\n}\n")))
+
+	rec := httptest.NewRecorder()
+	l.ASTHandler(rec, httptest.NewRequest(http.MethodGet, "/progz/test.mtail/ast", nil))
+	testutil.ExpectNoDiff(t, http.StatusOK, rec.Code)
+	var dump struct {
+		Name     string
+		AST      struct{ Node string }
+		Bytecode []struct {
+			Op   string
+			Line int
+		}
+	}
+	testutil.FatalIfErr(t, json.Unmarshal(rec.Body.Bytes(), &dump))
+	testutil.ExpectNoDiff(t, "test.mtail", dump.Name)
+	testutil.ExpectNoDiff(t, "StmtList", dump.AST.Node)
+	if len(dump.Bytecode) == 0 || dump.Bytecode[0].Op != "match" || dump.Bytecode[0].Line != 2 {
+		t.Errorf("unexpected bytecode %v", dump.Bytecode)
+	}
+
+	rec = httptest.NewRecorder()
+	l.ASTHandler(rec, httptest.NewRequest(http.MethodGet, "/progz/test.mtail/ast?format=dot", nil))
+	for _, want := range []string{`digraph "test.mtail" {`, "subgraph cluster_ast {", `ast_n1 [label="StmtList\n"`, "pc0 -> pc1\n", "pc1 -> pc7 [style=dashed]\n"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("dot output doesn't contain %q:\n%s", want, rec.Body.String())
+		}
+	}
+
+	for path, code := range map[string]int{
+		"/progz/missing.mtail/ast":          http.StatusNotFound,
+		"/progz/test.mtail/bytecode":        http.StatusNotFound,
+		"/progz/test.mtail/ast?format=yaml": http.StatusBadRequest,
+	} {
+		rec = httptest.NewRecorder()
+		l.ASTHandler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != code {
+			t.Errorf("%s: expected status %d, received %d", path, code, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// manifestPrefix starts the comment lines of a manifest embedded in a program.
+const manifestPrefix = "# mtail:"
+
+// manifestExt is appended to the filename of a program to name its sidecar
+// manifest file.
+const manifestExt = ".manifest"
+
+// checksumPrefix starts a checksum, naming its algorithm.
+const checksumPrefix = "sha256:"
+
+// Manifest describes a program, so that the versions of programs deployed can
+// be checked.  It is either embedded in the program as comment lines such as
+//
+//	# mtail:version 1.2
+//
+// or given in a sidecar JSON file next to it, named like the program with
+// .manifest appended.
+type Manifest struct {
+	Name     string `json:"name,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Author   string `json:"author,omitempty"`
+	Checksum string `json:"checksum,omitempty"` // The SHA-256 of the program source, as sha256:<hex>.
+}
+
+// checksum returns the checksum of the program source src, omitting any
+// embedded checksum line so that a program can carry its own checksum.
+func checksum(src []byte) string {
+	h := sha256.New()
+	for _, line := range bytes.SplitAfter(src, []byte("\n")) {
+		if strings.HasPrefix(strings.TrimSpace(string(line)), manifestPrefix+"checksum") {
+			continue
+		}
+		h.Write(line)
+	}
+	return checksumPrefix + hex.EncodeToString(h.Sum(nil))
+}
+
+// parseEmbeddedManifest returns the manifest embedded in the comments of the
+// program source src, and whether there was one.
+func parseEmbeddedManifest(src []byte) (m Manifest, ok bool, err error) {
+	seen := make(map[string]bool)
+	for i, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, manifestPrefix) {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimPrefix(line, manifestPrefix), " ", 2)
+		key, value := fields[0], ""
+		if len(fields) == 2 {
+			value = strings.TrimSpace(fields[1])
+		}
+		var field *string
+		switch key {
+		case "name":
+			field = &m.Name
+		case "version":
+			field = &m.Version
+		case "author":
+			field = &m.Author
+		case "checksum":
+			field = &m.Checksum
+		default:
+			return m, false, errors.Errorf("line %d: unknown manifest key %q", i+1, key)
+		}
+		if seen[key] {
+			return m, false, errors.Errorf("line %d: manifest key %q given more than once", i+1, key)
+		}
+		seen[key] = true
+		*field = value
+	}
+	return m, len(seen) > 0, nil
+}
+
+// readSidecarManifest returns the manifest in the sidecar file of the program
+// at programPath, and whether there was one.
+func readSidecarManifest(programPath string) (m Manifest, ok bool, err error) {
+	f, err := os.Open(programPath + manifestExt)
+	if os.IsNotExist(err) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, err
+	}
+	defer f.Close()
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&m); err != nil {
+		return m, false, errors.Wrapf(err, "parsing manifest %s", f.Name())
+	}
+	return m, true, nil
+}
+
+// validate checks that the manifest m and the program source src agree, and
+// returns m with the checksum of src.
+func (m Manifest) validate(src []byte) (Manifest, error) {
+	if m.Version == "" {
+		return m, errors.New("manifest has no version")
+	}
+	sum := checksum(src)
+	if m.Checksum != "" {
+		if !strings.HasPrefix(m.Checksum, checksumPrefix) {
+			return m, errors.Errorf("manifest checksum %q is not %s<hex>", m.Checksum, checksumPrefix)
+		}
+		if m.Checksum != sum {
+			return m, errors.Errorf("manifest checksum %s does not match the program's %s", m.Checksum, sum)
+		}
+	}
+	m.Checksum = sum
+	return m, nil
+}
+
+// programManifest returns the manifest of the program source src, embedded
+// in it or given by sidecar, and validated.  It returns only the checksum of
+// src for a program that has no manifest.
+func programManifest(src []byte, sidecar *Manifest) (Manifest, error) {
+	m, ok, err := parseEmbeddedManifest(src)
+	if err != nil {
+		return m, err
+	}
+	if sidecar != nil {
+		if ok {
+			return m, errors.New("manifest both embedded in the program and in a sidecar file")
+		}
+		m, ok = *sidecar, true
+	}
+	if !ok {
+		return Manifest{Checksum: checksum(src)}, nil
+	}
+	return m.validate(src)
+}
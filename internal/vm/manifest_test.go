@@ -0,0 +1,111 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/testutil"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const manifestProgram = "# mtail:name apache\n# mtail:version 1.2\n# mtail:author Ops <ops@example.com>\ncounter a\n/$/ {\n  a++\n}\n"
+
+func TestProgramManifest(t *testing.T) {
+	src := []byte(manifestProgram)
+	m, err := programManifest(src, nil)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, Manifest{"apache", "1.2", "Ops <ops@example.com>", checksum(src)}, m)
+
+	// A program can carry its own checksum, which is left out of the sum.
+	withSum := []byte(manifestProgram + "# mtail:checksum " + checksum(src) + "\n")
+	m, err = programManifest(withSum, nil)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, checksum(src), m.Checksum)
+
+	// A program without a manifest still has its checksum.
+	m, err = programManifest([]byte("/$/ {}\n"), nil)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, Manifest{Checksum: checksum([]byte("/$/ {}\n"))}, m)
+
+	m, err = programManifest([]byte("/$/ {}\n"), &Manifest{Version: "2"})
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "2", m.Version)
+}
+
+func TestProgramManifestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		src     string
+		sidecar *Manifest
+	}{
+		{"unknown key", "# mtail:version 1\n# mtail:owner me\n", nil},
+		{"duplicate key", "# mtail:version 1\n# mtail:version 2\n", nil},
+		{"no version", "# mtail:name apache\n", nil},
+		{"wrong checksum", "# mtail:version 1\n# mtail:checksum sha256:00\n", nil},
+		{"checksum algorithm", "# mtail:version 1\n# mtail:checksum md5:00\n", nil},
+		{"embedded and sidecar", "# mtail:version 1\n", &Manifest{Version: "1"}},
+		{"sidecar checksum", "/$/ {}\n", &Manifest{Version: "1", Checksum: "sha256:00"}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := programManifest([]byte(tc.src), tc.sidecar); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestLoadProgramManifest(t *testing.T) {
+	store := metrics.NewStore()
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, tmpDir, store)
+	testutil.FatalIfErr(t, err)
+
+	prog := filepath.Join(tmpDir, "sidecar.mtail")
+	testutil.FatalIfErr(t, ioutil.WriteFile(prog, []byte("/$/ {}\n"), 0644))
+	testutil.FatalIfErr(t, ioutil.WriteFile(prog+manifestExt, []byte(`{"name": "sidecar", "version": "3"}`), 0644))
+	testutil.FatalIfErr(t, ioutil.WriteFile(filepath.Join(tmpDir, "embedded.mtail"), []byte(manifestProgram), 0644))
+	testutil.FatalIfErr(t, l.LoadAllPrograms())
+
+	rec := httptest.NewRecorder()
+	l.ProgzHandler(rec, httptest.NewRequest(http.MethodGet, "/progz?format=json", nil))
+	var manifests map[string]Manifest
+	testutil.FatalIfErr(t, json.Unmarshal(rec.Body.Bytes(), &manifests))
+	expected := map[string]Manifest{
+		"sidecar.mtail":  {Name: "sidecar", Version: "3", Checksum: checksum([]byte("/$/ {}\n"))},
+		"embedded.mtail": {"apache", "1.2", "Ops <ops@example.com>", checksum([]byte(manifestProgram))},
+	}
+	testutil.ExpectNoDiff(t, expected, manifests)
+
+	info := `
+# HELP mtail_prog_info a metric with a constant '1' value labelled by the manifest of each program
+# TYPE mtail_prog_info gauge
+mtail_prog_info{author="Ops <ops@example.com>",checksum="` + checksum([]byte(manifestProgram)) + `",name="apache",prog="embedded.mtail",version="1.2"} 1
+mtail_prog_info{author="",checksum="` + checksum([]byte("/$/ {}\n")) + `",name="sidecar",prog="sidecar.mtail",version="3"} 1
+`
+	testutil.FatalIfErr(t, promtest.CollectAndCompare(l, strings.NewReader(info), "mtail_prog_info"))
+
+	// A sidecar that doesn't validate is a load error, and the old version
+	// keeps running.
+	testutil.FatalIfErr(t, ioutil.WriteFile(prog+manifestExt, []byte(`{"version": "4", "checksum": "sha256:00"}`), 0644))
+	testutil.FatalIfErr(t, l.LoadProgram(prog))
+	if l.programErrors["sidecar.mtail"] == nil {
+		t.Error("expected a load error for a wrong checksum")
+	}
+	l.handleMu.RLock()
+	testutil.ExpectNoDiff(t, "3", l.handles["sidecar.mtail"].manifest.Version)
+	l.handleMu.RUnlock()
+}
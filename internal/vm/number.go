@@ -0,0 +1,74 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// numberFormat is the decimal and thousands separators a program's numbers
+// are written with, for the parseint and parsefloat builtins.
+type numberFormat struct {
+	decimal   string
+	thousands string
+}
+
+// defaultNumberFormat is used by programs without separator pragmas.
+var defaultNumberFormat = numberFormat{decimal: ".", thousands: ","}
+
+// newNumberFormat returns the default format with any non-empty separator
+// replaced.  A separator set to the default of the other swaps the other's
+// default, so that setting the decimal separator to a comma alone reads
+// "1.234,56".
+func newNumberFormat(decimal, thousands string) numberFormat {
+	f := defaultNumberFormat
+	if decimal != "" {
+		f.decimal = decimal
+		if decimal == defaultNumberFormat.thousands {
+			f.thousands = defaultNumberFormat.decimal
+		}
+	}
+	if thousands != "" {
+		f.thousands = thousands
+		if thousands == defaultNumberFormat.decimal && decimal == "" {
+			f.decimal = defaultNumberFormat.thousands
+		}
+	}
+	return f
+}
+
+// normalize rewrites the number s with the thousands separators removed and
+// the decimal separator replaced by a point, so that strconv can parse it.
+// A thousands separator must be between two digits before any decimal
+// separator.
+func (f numberFormat) normalize(s string) (string, error) {
+	integer, fraction := s, ""
+	hasFraction := false
+	if i := strings.Index(s, f.decimal); i >= 0 {
+		integer, fraction, hasFraction = s[:i], s[i+len(f.decimal):], true
+	}
+	if strings.Contains(fraction, f.thousands) {
+		return "", fmt.Errorf("thousands separator %q after the decimal separator in %q", f.thousands, s)
+	}
+	groups := strings.Split(integer, f.thousands)
+	for i := 1; i < len(groups); i++ {
+		if !endsWithDigit(groups[i-1]) || !startsWithDigit(groups[i]) {
+			return "", fmt.Errorf("misplaced thousands separator %q in %q", f.thousands, s)
+		}
+	}
+	r := strings.Join(groups, "")
+	if hasFraction {
+		r += "." + fraction
+	}
+	return r, nil
+}
+
+func startsWithDigit(s string) bool {
+	return s != "" && s[0] >= '0' && s[0] <= '9'
+}
+
+func endsWithDigit(s string) bool {
+	return s != "" && s[len(s)-1] >= '0' && s[len(s)-1] <= '9'
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/vm/code"
+	"github.com/google/mtail/internal/vm/pcre"
 )
 
 // Object is the data and bytecode resulting from compiled program source.
@@ -16,4 +17,34 @@ type Object struct {
 	Strings []string          // Static strings.
 	Regexps []*regexp.Regexp  // Static regular expressions.
 	Metrics []*metrics.Metric // Metrics accessible to this program.
+	Strict  bool              // Conversion and timestamp errors are counted separately, and never cached.
+	Syntax  string            // The language version the program is written in.
+
+	Backtracking map[int]*pcre.Regexp // The regular expressions compiled by the backtracking engine, by their index in Regexps, where they are nil.
+
+	DecimalSeparator   string // The decimal separator for parseint and parsefloat, if not the default.
+	ThousandsSeparator string // The thousands separator for parseint and parsefloat, if not the default.
+
+	CSVDelimiter string // The column delimiter for the csv builtins, if not a comma.
+	CSVQuote     string // The quote character for the csv builtins, if not a double quote.
+	CSVHeader    bool   // The first line of each log names the columns for the csv builtin.
+
+	Samples []Sample // The sample statements, indexed by the operand of the sample instruction.
+
+	Filters []Filter // The filter statements; the program only processes the logs that pass them all.
+
+	Conditions []int // The source lines of the instrumented conditions, indexed by the operand of the condmatch instruction.
+}
+
+// Sample describes a sample statement in the program.
+type Sample struct {
+	Rate   int64 // The block runs one in Rate of the times the statement is reached.
+	Random bool  // Whether the times are chosen at random, rather than every Rate'th.
+	Line   int   // The source line of the statement.
+}
+
+// Filter describes a filter statement in the program.
+type Filter struct {
+	Regexp *regexp.Regexp // Matched against the log filename.
+	Negate bool           // Whether the filename must not match, rather than match.
 }
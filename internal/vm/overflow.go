@@ -0,0 +1,67 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+// progIntOverflows counts the increments and decrements of integer metrics
+// that passed the limits of an int64, per program.
+var progIntOverflows = expvar.NewMap("prog_int_overflows_total")
+
+// OverflowPolicy says what a program does when incrementing or decrementing
+// an integer metric passes the limits of an int64.
+type OverflowPolicy int
+
+const (
+	// WrapOverflow wraps the value around, as Go's integers do.  A counter
+	// that wraps looks to a collector like a counter reset.
+	WrapOverflow OverflowPolicy = iota
+	// SaturateOverflow stops the value at the limit it passed.
+	SaturateOverflow
+)
+
+var overflowPolicyNames = map[OverflowPolicy]string{
+	WrapOverflow:     "wrap",
+	SaturateOverflow: "saturate",
+}
+
+func (p OverflowPolicy) String() string {
+	return overflowPolicyNames[p]
+}
+
+// ParseOverflowPolicy returns the policy named by s, one of "wrap" or
+// "saturate".
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	for p, name := range overflowPolicyNames {
+		if s == name {
+			return p, nil
+		}
+	}
+	return WrapOverflow, errors.Errorf("unknown overflow policy %q, expecting wrap or saturate", s)
+}
+
+// incBy adds delta to the integer datum d at ts, or subtracts it if dec, by
+// the program's overflow policy.
+func (v *VM) incBy(d datum.Datum, delta int64, ts time.Time, dec bool) {
+	var overflowed bool
+	switch {
+	case v.overflowPolicy == SaturateOverflow && dec:
+		overflowed = datum.SaturatingDecIntBy(d, delta, ts)
+	case v.overflowPolicy == SaturateOverflow:
+		overflowed = datum.SaturatingIncIntBy(d, delta, ts)
+	case dec:
+		overflowed = datum.DecIntBy(d, delta, ts)
+	default:
+		overflowed = datum.IncIntBy(d, delta, ts)
+	}
+	if overflowed {
+		progIntOverflows.Add(v.name, 1)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package parser
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/google/mtail/internal/vm/ast"
+)
+
+// nodeName returns the name of the type of node, like "CondStmt".
+func nodeName(node ast.Node) string {
+	name := fmt.Sprintf("%T", node)
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// nodeDetail returns what distinguishes node from others of its type, like
+// the name of a variable or the value of a literal, if anything.
+func nodeDetail(node ast.Node) string {
+	switch n := node.(type) {
+	case *ast.VarDecl:
+		return fmt.Sprintf("%s %s", n.Kind, n.Name)
+	case *ast.DecoDecl:
+		return n.Name
+	case *ast.DecoStmt:
+		return n.Name
+	case *ast.IdTerm:
+		return n.Name
+	case *ast.CaprefTerm:
+		return fmt.Sprintf("$%s", n.Name)
+	case *ast.IntLit:
+		return fmt.Sprintf("%d", n.I)
+	case *ast.FloatLit:
+		return fmt.Sprintf("%g", n.F)
+	case *ast.PatternLit:
+		return fmt.Sprintf("/%s/", n.Pattern)
+	case *ast.StringLit:
+		return n.Text
+	case *ast.BinaryExpr:
+		return Kind(n.Op).String()
+	case *ast.UnaryExpr:
+		return Kind(n.Op).String()
+	case *ast.BuiltinExpr:
+		return n.Name
+	case *ast.PragmaStmt:
+		return strings.TrimSpace(n.Name + " " + n.Value)
+	case *ast.SampleStmt:
+		return strings.TrimSpace(fmt.Sprintf("%s %d/%d", n.Mode, n.Num, n.Rate))
+	case *ast.FilterStmt:
+		if n.Negate {
+			return n.Subject + " !~"
+		}
+		return n.Subject + " =~"
+	}
+	return ""
+}
+
+// dotter emits the nodes of a syntax tree as a graphviz graph.
+type dotter struct {
+	w        io.Writer
+	prefix   string // Prefix of the node IDs, so that graphs can be combined.
+	id       int
+	parentID []int // id of the parent node
+}
+
+func (d *dotter) nextID() int {
+	d.id++
+	return d.id
+}
+
+func (d *dotter) emitNode(id int, node ast.Node) {
+	attrs := map[string]string{
+		"label":   nodeName(node) + "\n" + nodeDetail(node),
+		"shape":   "box",
+		"style":   "filled",
+		"tooltip": node.Type().String(),
+	}
+	switch node.(type) {
+	case *ast.VarDecl, *ast.DecoDecl:
+		attrs["fillcolor"] = "lightgreen"
+	case *ast.IdTerm, *ast.CaprefTerm, *ast.IntLit, *ast.FloatLit, *ast.PatternLit, *ast.StringLit:
+		attrs["fillcolor"] = "pink"
+		attrs["shape"] = "ellipse"
+	case *ast.IndexedExpr, *ast.BinaryExpr, *ast.UnaryExpr, *ast.PatternExpr, *ast.BuiltinExpr:
+		attrs["fillcolor"] = "lightblue"
+	}
+	pos := node.Pos()
+	if pos != nil {
+		attrs["xlabel"] = pos.String()
+	}
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(d.w, "%sn%d [", d.prefix, id)
+	for _, k := range keys {
+		fmt.Fprintf(d.w, "%s=%s ", k, DotQuote(attrs[k]))
+	}
+	fmt.Fprintf(d.w, "]\n")
+}
+
+func (d *dotter) emitLine(src, dst int) {
+	fmt.Fprintf(d.w, "%sn%d -> %sn%d\n", d.prefix, src, d.prefix, dst)
+}
+
+func (d *dotter) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
+	id := d.nextID()
+	d.emitNode(id, node)
+	if len(d.parentID) > 0 {
+		parentID := d.parentID[len(d.parentID)-1]
+		d.emitLine(parentID, id)
+	}
+	d.parentID = append(d.parentID, id)
+	return d, node
+}
+
+func (d *dotter) VisitAfter(node ast.Node) ast.Node {
+	d.parentID = d.parentID[:len(d.parentID)-1]
+	return node
+}
+
+// WriteDot writes the nodes and edges of the syntax tree n to w, as the body
+// of a graphviz graph.  The IDs of the nodes start with prefix, so that more
+// than one graph can be drawn together.
+func WriteDot(w io.Writer, n ast.Node, prefix string) {
+	ast.Walk(&dotter{w: w, prefix: prefix}, n)
+}
+
+// DotQuote returns s as a quoted graphviz string.
+func DotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
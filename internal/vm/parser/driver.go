@@ -21,9 +21,10 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/vm/ast"
 	"github.com/google/mtail/internal/vm/errors"
 	"github.com/google/mtail/internal/vm/position"
@@ -50,7 +51,13 @@ type parser struct {
 	errors errors.ErrorList
 	l      *Lexer
 	t      Token             // Most recently lexed token.
+	prev   Token             // The token lexed before t.
 	pos    position.Position // Optionally contains the position of the start of a production
+
+	imported map[string]struct{} // Names of library modules already imported by this program.
+
+	keepTokens bool    // Whether to record the tokens lexed.
+	tokens     []Token // Tokens lexed, if keepTokens is set.
 }
 
 func newParser(name string, input io.Reader) *parser {
@@ -62,13 +69,20 @@ func (p *parser) ErrorP(s string, pos *position.Position) {
 }
 
 func (p *parser) Error(s string) {
+	if w := p.laterWord(); w != "" && strings.HasPrefix(s, "syntax error") {
+		s = fmt.Sprintf("%s\n\tTry declaring `syntax = %q' at the start of the program to use `%s'.", s, SyntaxVersions[reservedSince[w]-1], w)
+	}
 	p.errors.Add(&p.t.Pos, s)
 }
 
 // Lex reads the next token from the Lexer, turning it into a form useful for the goyacc generated parser.
 // The variable lval is modified to carry token information, and the token type is returned.
 func (p *parser) Lex(lval *mtailSymType) int {
+	p.prev = p.t
 	p.t = p.l.NextToken()
+	if p.keepTokens {
+		p.tokens = append(p.tokens, p.t)
+	}
 	switch p.t.Kind {
 	case INVALID:
 		p.Error(p.t.Spelling)
@@ -104,7 +118,7 @@ func (p *parser) Lex(lval *mtailSymType) int {
 }
 
 func (p *parser) inRegex() {
-	glog.V(2).Info("Entering regex")
+	logging.V(2).Info("Entering regex")
 	p.l.InRegex = true
 }
 
@@ -0,0 +1,363 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/mtail/internal/vm/ast"
+)
+
+// Format reads the program named name from the input and returns it rewritten
+// in the canonical style:
+//
+//   - statements are indented two spaces for each enclosing block;
+//   - tokens are separated by a single space, except around brackets, commas,
+//     and unary operators, and in regular expressions;
+//   - runs of blank lines are collapsed into one, and blank lines at the ends
+//     of the program and of blocks are removed;
+//   - top level const and extern const definitions are moved, in order, to
+//     directly after any leading comments, syntax version, pragmas, and
+//     imports.
+//
+// The line breaks and comments of the program are kept.  The program must
+// parse, but need not type check.
+func Format(name string, input io.Reader) ([]byte, error) {
+	src, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	root, lines, err := parseLines(name, src)
+	if err != nil {
+		return nil, err
+	}
+	out := layout(lines)
+
+	// The formatter only moves tokens between lines, so this is a check
+	// against bugs in it rather than in the program.
+	formatted, _, err := parseLines(name, out)
+	if err != nil {
+		return nil, fmt.Errorf("%s: formatted program doesn't parse: %s", name, err)
+	}
+	if !sameProgram(root, formatted) {
+		return nil, fmt.Errorf("%s: formatting changed the meaning of the program", name)
+	}
+	return out, nil
+}
+
+// srcLine is a line of program source broken into tokens.
+type srcLine struct {
+	tokens  []Token // The tokens on the line, excluding the newline.
+	comment string  // The comment ending the line, if any.
+}
+
+func (l srcLine) blank() bool {
+	return len(l.tokens) == 0 && l.comment == ""
+}
+
+// first returns the kind of the first token on the line, or EOF if there are
+// none.
+func (l srcLine) first() Kind {
+	if len(l.tokens) == 0 {
+		return EOF
+	}
+	return l.tokens[0].Kind
+}
+
+// continued reports whether the expression on the line continues on the next,
+// by ending with a binary operator.
+func (l srcLine) continued() bool {
+	if len(l.tokens) == 0 {
+		return false
+	}
+	return continuation[l.tokens[len(l.tokens)-1].Kind]
+}
+
+// parseLines parses the program in src and returns its AST and its lines.
+func parseLines(name string, src []byte) (ast.Node, []srcLine, error) {
+	p := newParser(name, bytes.NewReader(src))
+	p.keepTokens = true
+	p.l.keepComments = true
+	if r := mtailParse(p); r != 0 || p.errors != nil {
+		return nil, nil, p.errors
+	}
+	lines := make([]srcLine, bytes.Count(src, []byte{'\n'})+1)
+	for _, t := range p.tokens {
+		if t.Kind == NL || t.Kind == EOF {
+			continue
+		}
+		lines[t.Pos.Line].tokens = append(lines[t.Pos.Line].tokens, t)
+	}
+	for _, c := range p.l.comments {
+		lines[c.pos.Line].comment = strings.TrimRight(c.text, " \t\r")
+	}
+	for i := range lines {
+		lines[i].tokens = joinRegexes(lines[i].tokens)
+	}
+	return p.root, lines, nil
+}
+
+// joinRegexes replaces each regular expression and the slashes around it with
+// one REGEX token spelled as written in the program.
+func joinRegexes(tokens []Token) []Token {
+	var r []Token
+	for i := 0; i < len(tokens); i++ {
+		if i+2 < len(tokens) && tokens[i].Kind == DIV && tokens[i+1].Kind == REGEX && tokens[i+2].Kind == DIV {
+			t := tokens[i+1]
+			t.Spelling = "/" + strings.Replace(t.Spelling, "/", `\/`, -1) + "/"
+			r = append(r, t)
+			i += 2
+			continue
+		}
+		r = append(r, tokens[i])
+	}
+	return r
+}
+
+// continuation holds the kinds of token after which an expression may
+// continue on the next line.
+var continuation = map[Kind]bool{
+	ASSIGN: true, ADD_ASSIGN: true,
+	AND: true, OR: true, BITAND: true, BITOR: true, XOR: true,
+	LT: true, GT: true, LE: true, GE: true, EQ: true, NE: true,
+	SHL: true, SHR: true, PLUS: true, MINUS: true,
+	MUL: true, DIV: true, MOD: true, POW: true,
+	MATCH: true, NOT_MATCH: true,
+}
+
+// operand holds the kinds of token that end an operand, after which an
+// operator is binary.
+var operand = map[Kind]bool{
+	ID: true, BUILTIN: true, CAPREF: true, CAPREF_NAMED: true,
+	INTLITERAL: true, FLOATLITERAL: true, DURATIONLITERAL: true,
+	STRING: true, REGEX: true, RPAREN: true, RSQUARE: true, INC: true, DEC: true,
+}
+
+// spelling returns the text of the token t as it is written in a program.
+func spelling(t Token) string {
+	switch t.Kind {
+	case STRING:
+		return `"` + strings.Replace(t.Spelling, `"`, `\"`, -1) + `"`
+	case CAPREF, CAPREF_NAMED:
+		return "$" + t.Spelling
+	case DECO:
+		return "@" + t.Spelling
+	}
+	return t.Spelling
+}
+
+// formatTokens returns the tokens of a line separated by canonical spacing.
+func formatTokens(tokens []Token) string {
+	var b strings.Builder
+	unary := false // Whether the previous token was a unary operator.
+	for i, t := range tokens {
+		if i > 0 && !unary && spaced(tokens, i) {
+			b.WriteString(" ")
+		}
+		unary = (t.Kind == MINUS || t.Kind == NOT) && (i == 0 || !operand[tokens[i-1].Kind])
+		b.WriteString(spelling(t))
+	}
+	return b.String()
+}
+
+// spaced reports whether the token at i is separated from the one before.
+func spaced(tokens []Token, i int) bool {
+	prev, t := tokens[i-1].Kind, tokens[i].Kind
+	switch {
+	case t == RPAREN || t == RSQUARE || t == COMMA || t == INC || t == DEC:
+		return false
+	case prev == LPAREN || prev == LSQUARE:
+		return false
+	case prev == LCURLY && t == RCURLY:
+		return false
+	case t == LPAREN:
+		return prev != BUILTIN && prev != ID && prev != DECO
+	case t == LSQUARE:
+		return !operand[prev]
+	case tokens[0].Kind == SAMPLE && (t == DIV || prev == DIV):
+		// The 1/N of a sample statement is written as a fraction.
+		return false
+	}
+	return true
+}
+
+// chunk is a top level statement of a program and the comments directly
+// before it, or a block of comments on their own.
+type chunk struct {
+	lines       []outLine
+	kind        Kind // The kind of the first token of the statement, or EOF if none.
+	comments    bool // Whether the statement follows comments.
+	blankBefore bool // Whether a blank line separates the chunk from the one before.
+}
+
+// outLine is a line of formatted program text.
+type outLine struct {
+	text   string
+	opens  bool // Whether the line ends by opening a block.
+	closes bool // Whether the line starts by closing a block.
+}
+
+// layout returns the program made of lines in the canonical style.
+func layout(lines []srcLine) []byte {
+	var chunks []chunk
+	var c chunk
+	blank := false
+	depth := 0
+	for _, l := range lines {
+		if depth == 0 && l.blank() {
+			if len(c.lines) > 0 {
+				chunks = append(chunks, c)
+				c = chunk{}
+			}
+			blank = true
+			continue
+		}
+		if len(c.lines) == 0 {
+			c.blankBefore = blank
+			blank = false
+		}
+		indent := depth
+		for _, t := range l.tokens {
+			switch t.Kind {
+			case LCURLY:
+				depth++
+			case RCURLY:
+				depth--
+			}
+		}
+		if l.first() == RCURLY {
+			indent--
+		}
+		if indent < 0 {
+			indent = 0
+		}
+		c.lines = append(c.lines, formatLine(indent, l))
+		if len(l.tokens) == 0 {
+			continue
+		}
+		if c.kind == EOF && len(c.lines) > 1 {
+			c.comments = true
+		}
+		if c.kind == EOF {
+			c.kind = l.first()
+		}
+		if depth == 0 && !l.continued() {
+			chunks = append(chunks, c)
+			c = chunk{}
+		}
+	}
+	if len(c.lines) > 0 {
+		chunks = append(chunks, c)
+	}
+
+	chunks = moveConsts(chunks)
+
+	var out []outLine
+	for i, c := range chunks {
+		if i > 0 && c.blankBefore {
+			out = append(out, outLine{})
+		}
+		out = append(out, c.lines...)
+	}
+	var b bytes.Buffer
+	for i, l := range out {
+		if l.text == "" {
+			// Leave out repeated blank lines, and those at the ends of blocks.
+			if i == 0 || out[i-1].text == "" || out[i-1].opens {
+				continue
+			}
+			if i+1 == len(out) || out[i+1].closes {
+				continue
+			}
+		}
+		b.WriteString(l.text)
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// formatLine returns the line l, indented by depth blocks.
+func formatLine(depth int, l srcLine) outLine {
+	s := formatTokens(l.tokens)
+	if l.comment != "" {
+		if s != "" {
+			s += " "
+		}
+		s += l.comment
+	}
+	if s == "" {
+		return outLine{}
+	}
+	n := len(l.tokens)
+	return outLine{
+		text:   strings.Repeat("  ", depth) + s,
+		opens:  n > 0 && l.tokens[n-1].Kind == LCURLY,
+		closes: l.first() == RCURLY,
+	}
+}
+
+// moveConsts moves the const definitions in chunks to directly after the
+// leading comments, syntax version, pragmas, and imports, keeping their
+// order, and separates them from the chunks either side by a blank line.
+func moveConsts(chunks []chunk) []chunk {
+	header := 0
+	for header < len(chunks) {
+		if k := chunks[header].kind; k != EOF && k != SYNTAX && k != PRAGMA && k != IMPORT {
+			break
+		}
+		header++
+	}
+	var consts, rest []chunk
+	for _, c := range chunks[header:] {
+		if c.kind == CONST || c.kind == EXTERN {
+			consts = append(consts, c)
+		} else {
+			rest = append(rest, c)
+		}
+	}
+	if len(consts) == 0 {
+		return chunks
+	}
+	for i := range consts {
+		consts[i].blankBefore = i == 0 || consts[i].comments
+	}
+	if len(rest) > 0 {
+		rest[0].blankBefore = true
+	}
+	r := append([]chunk{}, chunks[:header]...)
+	r = append(r, consts...)
+	return append(r, rest...)
+}
+
+// sameProgram reports whether the programs a and b are the same, apart from
+// the order of their top level const definitions.
+func sameProgram(a, b ast.Node) bool {
+	as, bs := a.(*ast.StmtList), b.(*ast.StmtList)
+	if len(as.Children) != len(bs.Children) {
+		return false
+	}
+	aConsts, aRest := unparseTopLevel(as)
+	bConsts, bRest := unparseTopLevel(bs)
+	return aConsts == bConsts && aRest == bRest
+}
+
+// unparseTopLevel returns the program text of the const definitions and the
+// other statements of s.
+func unparseTopLevel(s *ast.StmtList) (string, string) {
+	var consts, rest strings.Builder
+	for _, n := range s.Children {
+		u := Unparser{}
+		switch n.(type) {
+		case *ast.PatternFragment, *ast.ExternConst:
+			consts.WriteString(u.Unparse(n) + "\n")
+		default:
+			rest.WriteString(u.Unparse(n) + "\n")
+		}
+	}
+	return consts.String(), rest.String()
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package parser
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+var formatTests = []struct {
+	name     string
+	program  string
+	expected string
+}{
+	{"indentation",
+		"counter a\n/foo/ {\n/bar/ {\n      a++\n}\n    }\n",
+		"counter a\n/foo/ {\n  /bar/ {\n    a++\n  }\n}\n"},
+
+	{"spacing",
+		"counter  a   by x,y\n/(?P<x>.) (?P<y>.)/{\na[$x][ $y ]+=  1*( 2+3 )\n  a[$x][$y] = ~ 1\n  strptime( $x,\"2006\" )\n}\n",
+		"counter a by x, y\n/(?P<x>.) (?P<y>.)/ {\n  a[$x][$y] += 1 * (2 + 3)\n  a[$x][$y] = ~1\n  strptime($x, \"2006\")\n}\n"},
+
+	{"blank lines",
+		"\n\ncounter a\n\n\n\ncounter b\n/x/ {\n\n  a++\n\n\n  b++\n\n}\n\n\n",
+		"counter a\n\ncounter b\n/x/ {\n  a++\n\n  b++\n}\n"},
+
+	{"comments",
+		"# header\n\ncounter a   # the count\n/x/ {\n    # inside\n  a++\n      # end of block\n}\n",
+		"# header\n\ncounter a # the count\n/x/ {\n  # inside\n  a++\n  # end of block\n}\n"},
+
+	{"regex escapes and strings",
+		"text t\n/a\\/b\"/ {\n  t = \"say \\\"hi\\\"\"\n}\n",
+		"text t\n/a\\/b\"/ {\n  t = \"say \\\"hi\\\"\"\n}\n"},
+
+	{"continued regex",
+		"const A /a/ +\n   /b/ # the b\ncounter c\n//+A+\n  /c/{\n  c++\n}\n",
+		"const A /a/ +\n/b/ # the b\n\ncounter c\n// + A +\n/c/ {\n  c++\n}\n"},
+
+	{"else and otherwise",
+		"counter a\n/x/ {\n  a++\n}   else   {\n  otherwise{\n  a--\n  }\n}\n/y/{}\n",
+		"counter a\n/x/ {\n  a++\n} else {\n  otherwise {\n    a--\n  }\n}\n/y/ {}\n"},
+
+	{"sample",
+		"syntax = \"v2\"\ncounter a\n/x/ {\n  sample 1 / 10 {\n    a ++\n  }\n}\n",
+		"syntax = \"v2\"\ncounter a\n/x/ {\n  sample 1/10 {\n    a++\n  }\n}\n"},
+
+	{"filter",
+		"syntax = \"v2\"\nfilter   filename=~/nginx/\ncounter a\n",
+		"syntax = \"v2\"\nfilter filename =~ /nginx/\ncounter a\n"},
+
+	{"consts move to the top",
+		"syntax = \"v2\"\n# Copyright\n\nimport \"timestamp\"\ncounter a\n\nconst A /a/\n/x/ + A {\n  a++\n}\n\n# The B.\nconst B /b/ + A\n\n/y/ + B {\n  a++\n}\n",
+		"syntax = \"v2\"\n# Copyright\n\nimport \"timestamp\"\n\nconst A /a/\n\n# The B.\nconst B /b/ + A\n\ncounter a\n/x/ + A {\n  a++\n}\n\n/y/ + B {\n  a++\n}\n"},
+
+	{"syntax version",
+		"syntax  =  \"v2\"\ncounter a # the a\nconst A /a/\n",
+		"syntax = \"v2\"\n\nconst A /a/\n\ncounter a # the a\n"},
+
+	{"decorators",
+		"def foo{\n  /x/ {\n    next\n  }\n}\n@foo   {\n  /y/ {\n  }\n}\n",
+		"def foo {\n  /x/ {\n    next\n  }\n}\n@foo {\n  /y/ {\n  }\n}\n"},
+}
+
+func TestFormat(t *testing.T) {
+	for _, tc := range formatTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := Format(tc.name, strings.NewReader(tc.program))
+			testutil.FatalIfErr(t, err)
+			testutil.ExpectNoDiff(t, tc.expected, string(out))
+
+			again, err := Format(tc.name, bytes.NewReader(out))
+			testutil.FatalIfErr(t, err)
+			testutil.ExpectNoDiff(t, string(out), string(again))
+		})
+	}
+}
+
+func TestFormatInvalidProgram(t *testing.T) {
+	if _, err := Format("invalid", strings.NewReader("/x/ {\n")); err == nil {
+		t.Error("invalid program formatted")
+	}
+}
+
+// TestFormatIdempotent checks that formatting the parser tests and the example
+// programs keeps their meaning, and that formatting them again changes nothing.
+func TestFormatIdempotent(t *testing.T) {
+	programs := make(map[string]string)
+	for _, tc := range parserTests {
+		programs[tc.name] = tc.program
+	}
+	examples, err := filepath.Glob("../../../examples/*.mtail")
+	testutil.FatalIfErr(t, err)
+	for _, name := range examples {
+		src, err := ioutil.ReadFile(name)
+		testutil.FatalIfErr(t, err)
+		programs[filepath.Base(name)] = string(src)
+	}
+	for name, program := range programs {
+		out, err := Format(name, strings.NewReader(program))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		again, err := Format(name, bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("%s: formatted program: %s", name, err)
+			continue
+		}
+		if diff := testutil.Diff(string(out), string(again)); diff != "" {
+			t.Errorf("%s: formatting again changed the program:\n%s", name, diff)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build gofuzz
+// +build gofuzz
+
+package parser
+
+import (
+	"bytes"
+)
+
+// FuzzLexer tokenises the input until EOF.  The lexer must terminate and
+// never panic on any input.
+func FuzzLexer(data []byte) int {
+	l := NewLexer("fuzz", bytes.NewReader(data))
+	r := 1
+	for {
+		t := l.NextToken()
+		if t.Kind == EOF {
+			return r
+		}
+		if t.Kind == INVALID {
+			r = 0
+		}
+	}
+}
+
+// Fuzz parses the input as an mtail program.
+func Fuzz(data []byte) int {
+	if _, err := Parse("fuzz", bytes.NewReader(data)); err != nil {
+		return 0
+	}
+	return 1
+}
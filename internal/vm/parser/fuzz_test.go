@@ -0,0 +1,47 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build go1.18
+// +build go1.18
+
+package parser
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+// addSeedCorpus adds the example programs and the fuzzer crash corpus to the
+// seed corpus of f.
+func addSeedCorpus(f *testing.F) {
+	for _, pattern := range []string{"../../../examples/*.mtail", "../fuzz/*.mtail"} {
+		matches, err := filepath.Glob(pattern)
+		testutil.FatalIfErr(f, err)
+		for _, m := range matches {
+			data, err := ioutil.ReadFile(m)
+			testutil.FatalIfErr(f, err)
+			f.Add(data)
+		}
+	}
+}
+
+func FuzzLexer(f *testing.F) {
+	addSeedCorpus(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		l := NewLexer("fuzz", bytes.NewReader(data))
+		for tok := l.NextToken(); tok.Kind != EOF; tok = l.NextToken() {
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	addSeedCorpus(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Errors are expected, panics are not.
+		_, _ = Parse("fuzz", bytes.NewReader(data))
+	})
+}
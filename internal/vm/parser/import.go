@@ -0,0 +1,139 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/mtail/internal/vm/ast"
+)
+
+// library contains the source of the standard library modules that programs
+// can load with an `import "name"` statement.  Each module defines one or
+// more decorators for a common log format, so that programs don't need to
+// repeat the boilerplate to extract and parse the timestamp.
+var library = map[string]string{
+	// The Apache common and combined formats, which are also the nginx
+	// defaults.  The combined decorator also makes the referer and user agent
+	// available to the decorated block.
+	"apache": `
+def apache_common {
+  /^/ +
+  /(?P<remote_host>[0-9A-Za-z\.:-]+) / +
+  /(?P<remote_logname>[0-9A-Za-z-]+) / +
+  /(?P<remote_username>[0-9A-Za-z-]+) / +
+  /\[(?P<apache_timestamp>\d{2}\/\w{3}\/\d{4}:\d{2}:\d{2}:\d{2} (\+|-)\d{4})\] / +
+  /"(?P<request_method>[A-Z]+) (?P<request_uri>\S+) (?P<http_version>HTTP\/[0-9\.]+)" / +
+  /(?P<status_code>\d{3}) / +
+  /((?P<response_size>\d+)|-)/ {
+    strptime($apache_timestamp, "02/Jan/2006:15:04:05 -0700")
+    next
+  }
+}
+
+def apache_combined {
+  /^/ +
+  /(?P<remote_host>[0-9A-Za-z\.:-]+) / +
+  /(?P<remote_logname>[0-9A-Za-z-]+) / +
+  /(?P<remote_username>[0-9A-Za-z-]+) / +
+  /\[(?P<apache_timestamp>\d{2}\/\w{3}\/\d{4}:\d{2}:\d{2}:\d{2} (\+|-)\d{4})\] / +
+  /"(?P<request_method>[A-Z]+) (?P<request_uri>\S+) (?P<http_version>HTTP\/[0-9\.]+)" / +
+  /(?P<status_code>\d{3}) / +
+  /((?P<response_size>\d+)|-) / +
+  /"(?P<referer>[^"]*)" / +
+  /"(?P<user_agent>[^"]*)"/ {
+    strptime($apache_timestamp, "02/Jan/2006:15:04:05 -0700")
+    next
+  }
+}
+`,
+	// nginx's default "combined" log_format is identical to Apache's; the
+	// nginx_combined decorator is provided so programs can name what they
+	// are parsing.
+	"nginx": `
+def nginx_combined {
+  /^/ +
+  /(?P<remote_addr>[0-9A-Za-z\.:-]+) - / +
+  /(?P<remote_user>[0-9A-Za-z-]+) / +
+  /\[(?P<time_local>\d{2}\/\w{3}\/\d{4}:\d{2}:\d{2}:\d{2} (\+|-)\d{4})\] / +
+  /"(?P<request_method>[A-Z]+) (?P<request_uri>\S+) (?P<http_version>HTTP\/[0-9\.]+)" / +
+  /(?P<status>\d{3}) / +
+  /(?P<body_bytes_sent>\d+) / +
+  /"(?P<http_referer>[^"]*)" / +
+  /"(?P<http_user_agent>[^"]*)"/ {
+    strptime($time_local, "02/Jan/2006:15:04:05 -0700")
+    next
+  }
+}
+`,
+	// The rsyslog RSYSLOG_TraditionalFileFormat, the classic BSD syslog file
+	// format.  The year is not present in the timestamp, see the
+	// --syslog_use_current_year flag.
+	"rsyslog": `
+def rsyslog_traditional {
+  /^(?P<date>\w+\s+\d+\s+\d+:\d+:\d+)\s+/ +
+  /(?P<hostname>[\w\.-]+)\s+/ +
+  /(?P<application>[\w\.\/-]+)(\[(?P<pid>\d+)\])?:\s+/ +
+  /(?P<message>.*)/ {
+    strptime($date, "Jan _2 15:04:05")
+    next
+  }
+}
+`,
+	// A generic timestamp prefix decorator, parameterised by the pattern
+	// that matches the timestamp, which must define a capture group named
+	// "timestamp", and the layout to parse it with.
+	"timestamp": `
+def timestamp_prefix(pattern, layout) {
+  /^/ + pattern {
+    strptime($timestamp, layout)
+    next
+  }
+}
+`,
+}
+
+// LibraryModules returns the sorted names of the standard library modules
+// available to an `import` statement.
+func LibraryModules() (r []string) {
+	for name := range library {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return
+}
+
+// importLibrary parses the library module named name and returns its
+// statement list, or nil if the module has already been imported or could not
+// be parsed.
+func importLibrary(mtaillex mtailLexer, name string) ast.Node {
+	p := mtaillex.(*parser)
+	src, ok := library[name]
+	if !ok {
+		p.Error(fmt.Sprintf("unknown module %q in import, expecting one of %s", name, strings.Join(LibraryModules(), ", ")))
+		return nil
+	}
+	if _, ok := p.imported[name]; ok {
+		return nil
+	}
+	if p.imported == nil {
+		p.imported = make(map[string]struct{})
+	}
+	p.imported[name] = struct{}{}
+
+	root, err := Parse("<import "+name+">", strings.NewReader(src))
+	if err != nil {
+		p.Error(fmt.Sprintf("import %q: %s", name, err))
+		return nil
+	}
+	stmts := root.(*ast.StmtList)
+	for _, s := range stmts.Children {
+		if d, ok := s.(*ast.DecoDecl); ok {
+			d.Module = name
+		}
+	}
+	return stmts
+}
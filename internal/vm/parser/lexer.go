@@ -11,7 +11,7 @@ import (
 	"strings"
 	"unicode"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/vm/position"
 )
 
@@ -19,36 +19,122 @@ import (
 var keywords = map[string]Kind{
 	"after":     AFTER,
 	"as":        AS,
+	"avg":       AVG,
 	"buckets":   BUCKETS,
 	"by":        BY,
 	"const":     CONST,
 	"counter":   COUNTER,
 	"def":       DEF,
 	"del":       DEL,
+	"distinct":  DISTINCT,
 	"else":      ELSE,
+	"every":     EVERY,
+	"extern":    EXTERN,
+	"filter":    FILTER,
 	"gauge":     GAUGE,
 	"hidden":    HIDDEN,
 	"histogram": HISTOGRAM,
+	"import":    IMPORT,
+	"max":       MAX,
+	"min":       MIN,
 	"next":      NEXT,
 	"otherwise": OTHERWISE,
+	"pragma":    PRAGMA,
+	"reset":     RESET,
+	"sample":    SAMPLE,
 	"stop":      STOP,
 	"text":      TEXT,
 	"timer":     TIMER,
+	"topk":      TOPK,
+	"window":    WINDOW,
+
+	"timestamped":   TIMESTAMPED,
+	"untimestamped": UNTIMESTAMPED,
 }
 
 // List of builtin functions.  Keep this list sorted!
 var builtins = []string{
+	"alert",
 	"bool",
+	"cef",
+	"csv",
+	"csvcol",
+	"exec",
+	"field",
 	"float",
+	"geoip_asn",
+	"geoip_country",
 	"getfilename",
+	"getingesttime",
+	"getlinenumber",
+	"getlineoffset",
+	"hmac",
 	"int",
+	"leef",
 	"len",
+	"normpath",
+	"parsedur",
+	"parsefloat",
+	"parseint",
+	"parsesize",
+	"redact",
 	"settime",
+	"sha256",
 	"string",
 	"strptime",
 	"strtol",
 	"timestamp",
 	"tolower",
+	"uaclass",
+	"urlhost",
+	"urlpath",
+	"urlquery",
+	"w3c",
+}
+
+// The syntax version from which each word added to the language since v1 is
+// reserved, so that older programs can still use it as a name.
+var reservedSince = map[string]int{
+	"alert":         2,
+	"avg":           2,
+	"cef":           2,
+	"csv":           2,
+	"csvcol":        2,
+	"distinct":      2,
+	"every":         2,
+	"exec":          2,
+	"extern":        2,
+	"field":         2,
+	"filter":        2,
+	"geoip_asn":     2,
+	"geoip_country": 2,
+	"getingesttime": 2,
+	"getlinenumber": 2,
+	"getlineoffset": 2,
+	"hmac":          2,
+	"import":        2,
+	"leef":          2,
+	"max":           2,
+	"min":           2,
+	"normpath":      2,
+	"parsedur":      2,
+	"parsefloat":    2,
+	"parseint":      2,
+	"parsesize":     2,
+	"pragma":        2,
+	"redact":        2,
+	"reset":         2,
+	"sample":        2,
+	"sha256":        2,
+	"timestamped":   2,
+	"topk":          2,
+	"uaclass":       2,
+	"untimestamped": 2,
+	"urlhost":       2,
+	"urlpath":       2,
+	"urlquery":      2,
+	"w3c":           2,
+	"window":        2,
 }
 
 // Dictionary returns a list of all keywords and builtins of the language.
@@ -79,11 +165,24 @@ type Lexer struct {
 
 	InRegex bool // Context aware flag from parser to say we're in a regex
 
+	syntax  int  // The syntax version of the program, as set by the parser.
+	started bool // Whether any token other than a newline has been emitted.
+
 	// The currently being lexed token.
 	startcol int             // Starting column of the current token.
 	text     strings.Builder // the text of the current token
 
 	tokens chan Token // Output channel for tokens emitted.
+
+	keepComments bool      // Whether to record the comments skipped over.
+	comments     []comment // Comments skipped over, if keepComments is set.
+}
+
+// comment is the text of a comment, including the leading '#', and where it
+// is in the program.
+type comment struct {
+	text string
+	pos  position.Position
 }
 
 // NewLexer creates a new scanner type that reads the input provided.
@@ -93,6 +192,7 @@ func NewLexer(name string, input io.Reader) *Lexer {
 		input:  bufio.NewReader(input),
 		state:  lexProg,
 		tokens: make(chan Token, 2),
+		syntax: 1,
 	}
 	return l
 }
@@ -113,8 +213,11 @@ func (l *Lexer) NextToken() Token {
 // emit passes a token to the client.
 func (l *Lexer) emit(kind Kind) {
 	pos := position.Position{l.name, l.line, l.startcol, l.col - 1}
-	glog.V(2).Infof("Emitting %v spelled %q at %v", kind, l.text.String(), pos)
+	logging.V(2).Infof("Emitting %v spelled %q at %v", kind, l.text.String(), pos)
 	l.tokens <- Token{kind, l.text.String(), pos}
+	if kind != NL {
+		l.started = true
+	}
 	// Reset the current token
 	l.text.Reset()
 	l.startcol = l.col
@@ -142,7 +245,7 @@ func (l *Lexer) backup() {
 		return
 	}
 	if err := l.input.UnreadRune(); err != nil {
-		glog.Info(err)
+		logging.Info(err)
 	}
 }
 
@@ -378,19 +481,32 @@ func lexProg(l *Lexer) stateFn {
 
 // Lex a comment.
 func lexComment(l *Lexer) stateFn {
-	l.ignore()
+	l.accept()
+	pos := position.Position{l.name, l.line, l.startcol, l.col - 1}
 Loop:
 	for {
-		switch l.next() {
-		case '\n':
-			l.skip()
-			fallthrough
-		case eof:
+		switch r := l.next(); r {
+		case '\n', eof:
+			pos.Endcol = l.col - 1
+			l.startcol = l.col
+			// Before v2 the newline ending a comment is lost with it, so a
+			// statement can't be followed by a comment on the same line.
+			if r == '\n' {
+				if l.syntax >= 2 {
+					l.backup()
+				} else {
+					l.skip()
+				}
+			}
 			break Loop
 		default:
-			l.ignore()
+			l.accept()
 		}
 	}
+	if l.keepComments {
+		l.comments = append(l.comments, comment{l.text.String(), pos})
+	}
+	l.text.Reset()
 	return lexProg
 }
 
@@ -534,8 +650,14 @@ Loop:
 			break Loop
 		}
 	}
-	if r, ok := keywords[l.text.String()]; ok {
+	if l.syntax < reservedSince[l.text.String()] {
+		l.emit(ID)
+	} else if r, ok := keywords[l.text.String()]; ok {
 		l.emit(r)
+	} else if l.text.String() == "syntax" && !l.started {
+		// Only a keyword at the start of a program, so that existing
+		// programs can still use it as a name.
+		l.emit(SYNTAX)
 	} else if r := sort.SearchStrings(builtins, l.text.String()); r >= 0 && r < len(builtins) && builtins[r] == l.text.String() {
 		l.emit(BUILTIN)
 	} else {
@@ -550,8 +672,8 @@ Loop:
 func lexRegex(l *Lexer) stateFn {
 	// Exit regex mode when leaving this function.
 	defer func() {
-		glog.V(2).Info("Exiting regex")
-		glog.V(2).Infof("Regex at line %d, startcol %d, col %d", l.line, l.startcol, l.col)
+		logging.V(2).Info("Exiting regex")
+		logging.V(2).Infof("Regex at line %d, startcol %d, col %d", l.line, l.startcol, l.col)
 		l.InRegex = false
 	}()
 Loop:
@@ -10,7 +10,7 @@ import __yyfmt__ "fmt"
 import (
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/vm/ast"
 	"github.com/google/mtail/internal/vm/position"
@@ -18,17 +18,18 @@ import (
 
 //line parser.y:18
 type mtailSymType struct {
-	yys      int
-	intVal   int64
-	floatVal float64
-	floats   []float64
-	op       int
-	text     string
-	texts    []string
-	flag     bool
-	n        ast.Node
-	kind     metrics.Kind
-	duration time.Duration
+	yys       int
+	intVal    int64
+	floatVal  float64
+	floats    []float64
+	op        int
+	text      string
+	texts     []string
+	flag      bool
+	n         ast.Node
+	kind      metrics.Kind
+	duration  time.Duration
+	timestamp metrics.TimestampExport
 }
 
 const INVALID = 57346
@@ -37,63 +38,79 @@ const GAUGE = 57348
 const TIMER = 57349
 const TEXT = 57350
 const HISTOGRAM = 57351
-const AFTER = 57352
-const AS = 57353
-const BY = 57354
-const CONST = 57355
-const HIDDEN = 57356
-const DEF = 57357
-const DEL = 57358
-const NEXT = 57359
-const OTHERWISE = 57360
-const ELSE = 57361
-const STOP = 57362
-const BUCKETS = 57363
-const BUILTIN = 57364
-const REGEX = 57365
-const STRING = 57366
-const CAPREF = 57367
-const CAPREF_NAMED = 57368
-const ID = 57369
-const DECO = 57370
-const INTLITERAL = 57371
-const FLOATLITERAL = 57372
-const DURATIONLITERAL = 57373
-const INC = 57374
-const DEC = 57375
-const DIV = 57376
-const MOD = 57377
-const MUL = 57378
-const MINUS = 57379
-const PLUS = 57380
-const POW = 57381
-const SHL = 57382
-const SHR = 57383
-const LT = 57384
-const GT = 57385
-const LE = 57386
-const GE = 57387
-const EQ = 57388
-const NE = 57389
-const BITAND = 57390
-const XOR = 57391
-const BITOR = 57392
-const NOT = 57393
-const AND = 57394
-const OR = 57395
-const ADD_ASSIGN = 57396
-const ASSIGN = 57397
-const CONCAT = 57398
-const MATCH = 57399
-const NOT_MATCH = 57400
-const LCURLY = 57401
-const RCURLY = 57402
-const LPAREN = 57403
-const RPAREN = 57404
-const LSQUARE = 57405
-const RSQUARE = 57406
-const COMMA = 57407
-const NL = 57408
+const TOPK = 57352
+const DISTINCT = 57353
+const MIN = 57354
+const MAX = 57355
+const AVG = 57356
+const AFTER = 57357
+const AS = 57358
+const BY = 57359
+const CONST = 57360
+const HIDDEN = 57361
+const DEF = 57362
+const DEL = 57363
+const NEXT = 57364
+const OTHERWISE = 57365
+const ELSE = 57366
+const STOP = 57367
+const BUCKETS = 57368
+const WINDOW = 57369
+const RESET = 57370
+const EVERY = 57371
+const IMPORT = 57372
+const PRAGMA = 57373
+const SAMPLE = 57374
+const SYNTAX = 57375
+const EXTERN = 57376
+const FILTER = 57377
+const TIMESTAMPED = 57378
+const UNTIMESTAMPED = 57379
+const BUILTIN = 57380
+const REGEX = 57381
+const STRING = 57382
+const CAPREF = 57383
+const CAPREF_NAMED = 57384
+const ID = 57385
+const DECO = 57386
+const INTLITERAL = 57387
+const FLOATLITERAL = 57388
+const DURATIONLITERAL = 57389
+const INC = 57390
+const DEC = 57391
+const DIV = 57392
+const MOD = 57393
+const MUL = 57394
+const MINUS = 57395
+const PLUS = 57396
+const POW = 57397
+const SHL = 57398
+const SHR = 57399
+const LT = 57400
+const GT = 57401
+const LE = 57402
+const GE = 57403
+const EQ = 57404
+const NE = 57405
+const BITAND = 57406
+const XOR = 57407
+const BITOR = 57408
+const NOT = 57409
+const AND = 57410
+const OR = 57411
+const ADD_ASSIGN = 57412
+const ASSIGN = 57413
+const CONCAT = 57414
+const MATCH = 57415
+const NOT_MATCH = 57416
+const LCURLY = 57417
+const RCURLY = 57418
+const LPAREN = 57419
+const RPAREN = 57420
+const LSQUARE = 57421
+const RSQUARE = 57422
+const COMMA = 57423
+const NL = 57424
 
 var mtailToknames = [...]string{
 	"$end",
@@ -105,6 +122,11 @@ var mtailToknames = [...]string{
 	"TIMER",
 	"TEXT",
 	"HISTOGRAM",
+	"TOPK",
+	"DISTINCT",
+	"MIN",
+	"MAX",
+	"AVG",
 	"AFTER",
 	"AS",
 	"BY",
@@ -117,6 +139,17 @@ var mtailToknames = [...]string{
 	"ELSE",
 	"STOP",
 	"BUCKETS",
+	"WINDOW",
+	"RESET",
+	"EVERY",
+	"IMPORT",
+	"PRAGMA",
+	"SAMPLE",
+	"SYNTAX",
+	"EXTERN",
+	"FILTER",
+	"TIMESTAMPED",
+	"UNTIMESTAMPED",
 	"BUILTIN",
 	"REGEX",
 	"STRING",
@@ -170,9 +203,9 @@ const mtailEofCode = 1
 const mtailErrCode = 2
 const mtailInitialStackSize = 16
 
-//line parser.y:651
+//line parser.y:867
 
-//  tokenpos returns the position of the current token.
+// tokenpos returns the position of the current token.
 func tokenpos(mtaillex mtailLexer) position.Position {
 	return mtaillex.(*parser).t.Pos
 }
@@ -190,150 +223,196 @@ var mtailExca = [...]int{
 	-2, 0,
 	-1, 2,
 	1, 1,
-	15, 116,
-	28, 116,
-	34, 116,
-	-2, 88,
-	-1, 24,
-	66, 21,
-	-2, 66,
-	-1, 107,
-	15, 116,
-	28, 116,
-	34, 116,
-	-2, 88,
+	20, 154,
+	31, 154,
+	32, 154,
+	33, 154,
+	35, 154,
+	44, 154,
+	50, 154,
+	-2, 95,
+	-1, 33,
+	82, 27,
+	-2, 72,
+	-1, 130,
+	20, 154,
+	31, 154,
+	32, 154,
+	33, 154,
+	35, 154,
+	44, 154,
+	50, 154,
+	-2, 95,
 }
 
 const mtailPrivate = 57344
 
-const mtailLast = 233
+const mtailLast = 308
 
 var mtailAct = [...]int{
-	158, 21, 92, 64, 44, 29, 28, 43, 42, 27,
-	26, 30, 47, 93, 14, 41, 24, 91, 123, 46,
-	19, 154, 152, 153, 153, 88, 106, 53, 52, 168,
-	22, 167, 50, 51, 63, 89, 49, 13, 50, 51,
-	31, 28, 127, 94, 87, 49, 11, 25, 2, 20,
-	10, 15, 90, 12, 165, 33, 13, 36, 34, 35,
-	45, 60, 38, 39, 45, 11, 25, 142, 20, 10,
-	15, 113, 12, 105, 33, 114, 36, 34, 35, 45,
-	140, 38, 39, 161, 40, 80, 81, 103, 83, 82,
-	124, 124, 104, 133, 37, 50, 51, 112, 107, 16,
-	85, 86, 1, 40, 66, 68, 67, 131, 126, 28,
-	29, 28, 162, 37, 100, 101, 99, 130, 16, 102,
-	136, 24, 146, 28, 28, 19, 141, 143, 145, 144,
-	151, 150, 156, 155, 147, 148, 132, 149, 69, 116,
-	73, 74, 75, 76, 77, 78, 117, 97, 96, 70,
-	71, 61, 79, 118, 98, 166, 119, 120, 121, 171,
-	170, 122, 164, 163, 62, 95, 48, 65, 169, 128,
-	60, 33, 129, 36, 34, 35, 45, 84, 38, 39,
-	33, 115, 36, 34, 35, 45, 72, 38, 39, 33,
-	18, 36, 34, 35, 45, 157, 38, 39, 160, 111,
-	40, 159, 110, 70, 71, 138, 137, 134, 135, 40,
-	37, 125, 54, 109, 9, 139, 8, 7, 108, 37,
-	55, 56, 57, 58, 59, 6, 32, 23, 37, 17,
-	5, 4, 3,
+	58, 210, 51, 182, 30, 114, 21, 53, 38, 52,
+	84, 50, 131, 37, 115, 36, 128, 33, 31, 39,
+	188, 35, 87, 63, 102, 26, 55, 153, 232, 85,
+	225, 233, 222, 19, 224, 223, 206, 204, 205, 205,
+	60, 129, 83, 64, 230, 229, 111, 16, 34, 112,
+	27, 15, 22, 113, 18, 116, 60, 37, 180, 20,
+	103, 104, 187, 17, 106, 105, 126, 42, 141, 45,
+	43, 44, 54, 110, 47, 48, 227, 61, 62, 138,
+	60, 42, 139, 45, 43, 44, 54, 157, 47, 48,
+	42, 2, 45, 43, 44, 54, 49, 47, 48, 241,
+	61, 62, 61, 62, 219, 146, 46, 60, 119, 118,
+	49, 23, 147, 89, 91, 90, 154, 154, 191, 148,
+	46, 155, 149, 150, 151, 108, 109, 152, 160, 46,
+	122, 123, 121, 161, 158, 124, 38, 159, 179, 37,
+	156, 37, 186, 40, 145, 33, 76, 162, 177, 93,
+	94, 231, 130, 26, 217, 202, 199, 200, 194, 198,
+	37, 37, 203, 201, 197, 208, 207, 196, 195, 193,
+	239, 238, 236, 86, 143, 19, 142, 93, 94, 42,
+	226, 45, 43, 44, 54, 192, 47, 48, 135, 16,
+	34, 221, 27, 15, 22, 212, 18, 183, 211, 125,
+	213, 20, 184, 185, 190, 17, 216, 215, 49, 42,
+	228, 45, 43, 44, 54, 54, 47, 48, 46, 134,
+	144, 140, 133, 234, 57, 137, 186, 235, 178, 218,
+	127, 237, 56, 240, 136, 1, 168, 167, 49, 96,
+	97, 98, 99, 100, 101, 77, 169, 163, 46, 214,
+	166, 171, 170, 23, 92, 120, 79, 81, 80, 117,
+	82, 172, 173, 174, 59, 88, 107, 95, 25, 78,
+	220, 175, 176, 209, 164, 76, 67, 68, 69, 70,
+	71, 66, 72, 73, 74, 75, 189, 165, 65, 29,
+	14, 28, 13, 12, 11, 181, 4, 132, 10, 9,
+	8, 7, 41, 32, 24, 6, 5, 3,
 }
 
 var mtailPact = [...]int{
-	-1000, -1000, 52, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
-	-1000, 37, -1000, -1000, -14, -23, -1000, -39, 215, 136,
-	167, 56, -1000, -1000, 117, -1000, 98, -1000, 28, 34,
-	60, 6, -38, -26, -1000, -1000, -1000, 158, -1000, -1000,
-	158, 110, -1000, -1000, 80, -1000, -1000, 73, -40, -1000,
-	-1000, -1000, -1000, -1000, 175, -1000, -1000, -1000, -1000, -1000,
-	-1000, 44, -23, 171, -1000, -40, -1000, -1000, -1000, -1000,
-	-1000, -1000, -40, -1000, -1000, -1000, -1000, -1000, -1000, -40,
-	-1000, -1000, -40, -40, -40, -1000, -1000, -40, 158, 149,
-	-20, 27, -1000, 117, -1000, -40, -1000, -1000, -40, -1000,
-	-1000, -1000, -1000, 6, -23, 158, -1000, 33, 194, -1000,
-	-1000, -1000, 57, -23, -1000, 36, 158, 158, 167, 158,
-	158, 158, 37, -42, 56, -1000, -41, -1000, 158, 158,
-	-1000, 56, -1000, -1000, -1000, -1000, -1000, 174, 59, 133,
-	20, -1000, -1000, 98, 60, -1000, -1000, 43, 43, 110,
-	-1000, -1000, -1000, 158, -1000, 80, -1000, -34, -1000, -1000,
-	-1000, -1000, -36, -1000, -1000, -1000, 56, 174, 130, -1000,
+	-1000, -1000, 29, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
+	-1000, -1000, -1000, -1000, -1000, -1000, 172, 214, -1000, -1000,
+	184, 32, -35, -1000, -39, 271, 225, 52, -35, -1000,
+	49, -1000, -1000, 101, -1000, 181, -1000, -13, -6, 69,
+	19, -33, -28, -1000, -1000, -1000, 141, -1000, -1000, 141,
+	55, -1000, -1000, 80, -1000, -1000, 172, -1000, 206, -41,
+	-1000, -1000, -1000, -1000, -1000, 179, 143, -1000, -1000, -1000,
+	-1000, -1000, -1000, -1000, -1000, -1000, -1000, 182, 5, 178,
+	-3, 131, 177, 129, -1000, -1000, 19, 96, -41, -1000,
+	-1000, -1000, -1000, -1000, -1000, -41, -1000, -1000, -1000, -1000,
+	-1000, -1000, -41, -1000, -1000, -41, -41, -41, -1000, -1000,
+	-41, 141, 43, 9, -1000, 101, -1000, -41, -1000, -1000,
+	-41, -1000, -1000, -1000, -1000, 19, -1000, -35, 141, -1000,
+	171, 235, -1000, -1000, -1000, 179, 189, -19, -1000, 157,
+	-20, 164, 68, 140, -13, 111, 141, 141, 52, 141,
+	141, 141, 172, -43, 49, -1000, -42, -1000, 141, 141,
+	-1000, 49, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
+	155, 160, 161, 107, 200, -1000, -1000, 235, 54, -1000,
+	148, -46, -1000, -1000, -1000, -1000, -1000, -1000, -48, -52,
+	-1000, 135, 26, -1000, -1000, 181, 69, -1000, -1000, 34,
+	34, 55, -1000, -1000, -1000, 141, -1000, 80, -1000, -36,
+	-1000, -1000, -1000, -1000, -37, -1000, -1000, -1000, 104, -1000,
+	-50, -1000, -35, 157, -1000, -1000, -1000, 127, 49, 155,
+	125, -1000, -35, 56, -1000, -1000, -1000, -1000, -1000, -1000,
 	-1000, -1000,
 }
 
 var mtailPgo = [...]int{
-	0, 48, 232, 18, 12, 231, 230, 229, 3, 4,
-	15, 13, 2, 227, 10, 11, 1, 14, 226, 7,
-	40, 9, 225, 218, 217, 216, 8, 30, 214, 213,
-	212, 208, 0, 207, 195, 190, 186, 177, 167, 166,
-	165, 154, 152, 138, 120, 112, 102, 73, 17, 97,
+	0, 91, 307, 27, 0, 306, 305, 304, 10, 7,
+	11, 14, 5, 303, 21, 19, 4, 6, 302, 9,
+	143, 15, 301, 12, 300, 299, 2, 18, 298, 297,
+	296, 295, 3, 294, 293, 292, 291, 290, 289, 288,
+	287, 1, 286, 274, 273, 270, 268, 267, 266, 265,
+	264, 259, 255, 24, 254, 250, 249, 246, 237, 236,
+	235, 16, 22, 234,
 }
 
 var mtailR1 = [...]int{
-	0, 46, 1, 1, 2, 2, 2, 2, 2, 2,
-	2, 2, 2, 2, 5, 5, 5, 6, 6, 4,
-	7, 7, 13, 13, 17, 17, 17, 17, 39, 39,
-	16, 16, 38, 38, 38, 14, 14, 36, 36, 36,
-	36, 36, 36, 15, 15, 37, 37, 10, 10, 27,
-	27, 27, 42, 42, 21, 20, 20, 20, 40, 40,
-	9, 9, 41, 41, 41, 41, 12, 12, 11, 11,
-	43, 43, 8, 8, 8, 8, 8, 8, 8, 8,
-	8, 18, 18, 19, 3, 3, 26, 22, 35, 35,
-	23, 23, 23, 23, 29, 29, 30, 30, 30, 30,
-	30, 33, 34, 34, 31, 44, 45, 45, 45, 45,
-	24, 25, 28, 28, 32, 32, 48, 49, 47, 47,
+	0, 60, 1, 1, 1, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	5, 5, 5, 6, 6, 4, 7, 7, 13, 13,
+	17, 17, 17, 17, 50, 50, 16, 16, 49, 49,
+	49, 14, 14, 47, 47, 47, 47, 47, 47, 15,
+	15, 48, 48, 10, 10, 27, 27, 27, 53, 53,
+	21, 20, 20, 20, 51, 51, 9, 9, 52, 52,
+	52, 52, 12, 12, 11, 11, 54, 54, 8, 8,
+	8, 8, 8, 8, 8, 8, 8, 18, 18, 19,
+	3, 3, 26, 22, 22, 46, 46, 23, 23, 23,
+	23, 23, 23, 23, 29, 29, 39, 39, 39, 39,
+	39, 39, 39, 39, 39, 43, 44, 44, 40, 57,
+	57, 58, 59, 55, 56, 56, 56, 56, 24, 24,
+	45, 45, 25, 25, 31, 31, 32, 32, 32, 32,
+	33, 33, 34, 42, 35, 36, 36, 37, 38, 30,
+	28, 28, 41, 41, 62, 63, 61, 61,
 }
 
 var mtailR2 = [...]int{
-	0, 1, 0, 2, 1, 1, 1, 1, 1, 1,
-	1, 3, 1, 1, 4, 2, 2, 1, 2, 3,
-	1, 1, 4, 4, 1, 1, 4, 4, 1, 1,
-	1, 4, 1, 1, 1, 1, 4, 1, 1, 1,
-	1, 1, 1, 1, 4, 1, 1, 1, 4, 1,
-	4, 4, 1, 1, 1, 1, 4, 4, 1, 1,
-	1, 4, 1, 1, 1, 1, 1, 2, 1, 2,
-	1, 1, 1, 3, 4, 1, 1, 1, 3, 1,
-	1, 1, 4, 1, 1, 3, 5, 3, 0, 1,
+	0, 1, 0, 2, 2, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 3, 3, 1, 1,
+	4, 2, 2, 1, 2, 3, 1, 1, 4, 4,
+	1, 1, 4, 4, 1, 1, 1, 4, 1, 1,
+	1, 1, 4, 1, 1, 1, 1, 1, 1, 1,
+	4, 1, 1, 1, 4, 1, 4, 4, 1, 1,
+	1, 1, 4, 4, 1, 1, 1, 4, 1, 1,
+	1, 1, 1, 2, 1, 2, 1, 1, 1, 3,
+	4, 1, 1, 1, 3, 1, 1, 1, 4, 1,
+	1, 3, 5, 3, 4, 0, 1, 2, 2, 2,
 	2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
-	1, 2, 1, 3, 2, 2, 1, 1, 3, 3,
-	4, 3, 4, 2, 1, 1, 0, 0, 0, 1,
+	1, 1, 1, 1, 1, 2, 1, 3, 2, 1,
+	1, 2, 3, 2, 1, 1, 3, 3, 4, 7,
+	1, 3, 3, 6, 1, 3, 1, 1, 1, 1,
+	4, 5, 5, 1, 2, 5, 6, 2, 4, 2,
+	4, 2, 1, 1, 0, 0, 0, 1,
 }
 
 var mtailChk = [...]int{
-	-1000, -46, -1, -2, -5, -6, -22, -24, -25, -28,
-	17, 13, 20, 4, -17, 18, 66, -7, -35, -48,
-	16, -16, -27, -13, -11, 14, -14, -21, -8, -12,
-	-15, -20, -18, 22, 25, 26, 24, 61, 29, 30,
-	51, -10, -26, -19, -9, 27, -19, -4, -39, 59,
-	52, 53, -4, 66, -30, 5, 6, 7, 8, 9,
-	34, 15, 28, -11, -8, -38, 48, 50, 49, -43,
-	32, 33, -36, 42, 43, 44, 45, 46, 47, -42,
-	57, 58, 55, 54, -37, 40, 41, 38, 63, 61,
-	-17, -48, -12, -11, -12, -40, 38, 37, -41, 36,
-	34, 35, 39, -20, 19, -47, 66, -1, -23, -29,
-	27, 24, -49, 27, -4, 10, -47, -47, -47, -47,
-	-47, -47, -47, -3, -16, 62, -3, 62, -47, -47,
-	-4, -16, -27, 60, -33, -31, -44, 12, 11, 21,
-	23, -4, 31, -14, -15, -21, -8, -17, -17, -10,
-	-26, -19, 64, 65, 62, -9, -12, -34, -32, 27,
-	24, 24, -45, 30, 29, 34, -16, 65, 65, -32,
-	30, 29,
+	-1000, -60, -1, -2, -30, -5, -6, -22, -24, -25,
+	-28, -33, -34, -35, -37, 22, 18, 34, 25, 4,
+	30, -17, 23, 82, -7, -46, -62, 21, -36, -38,
+	-16, -27, -13, -11, 19, -14, -21, -8, -12, -15,
+	-20, -18, 38, 41, 42, 40, 77, 45, 46, 67,
+	-10, -26, -19, -9, 43, -19, 18, 40, -4, -50,
+	75, 68, 69, -4, 82, -39, 10, 5, 6, 7,
+	8, 9, 11, 12, 13, 14, 50, 20, 44, 31,
+	33, 32, 35, -11, -8, -4, -20, -62, -49, 64,
+	66, 65, -54, 48, 49, -47, 58, 59, 60, 61,
+	62, 63, -53, 73, 74, 71, 70, -48, 56, 57,
+	54, 79, 77, -17, -12, -11, -12, -51, 54, 53,
+	-52, 52, 50, 51, 55, -20, -19, 24, -61, 82,
+	-1, -23, -29, 43, 40, 45, -63, 43, -4, 77,
+	43, 71, 45, 43, 43, 15, -61, -61, -61, -61,
+	-61, -61, -61, -3, -16, 78, -3, 78, -61, -61,
+	-4, -16, -27, 76, -43, -40, -55, -58, -59, -57,
+	17, 16, 26, 27, 28, 36, 37, -23, 39, -4,
+	77, -31, -32, 40, 45, 46, -26, 82, 40, -42,
+	40, 50, 45, -53, 47, -14, -15, -21, -8, -17,
+	-17, -10, -26, -19, 80, 81, 78, -9, -12, -44,
+	-41, 43, 40, 40, -56, 46, 45, 47, 29, 50,
+	-45, 43, 78, 81, 82, 82, 45, 50, -16, 81,
+	81, 47, 78, 81, -4, -32, 45, -41, 46, 45,
+	-4, 43,
 }
 
 var mtailDef = [...]int{
 	2, -2, -2, 3, 4, 5, 6, 7, 8, 9,
-	10, 0, 12, 13, 0, 0, 17, 0, 0, 0,
-	0, 24, 25, 20, -2, 89, 30, 49, 68, 60,
-	35, 54, 72, 0, 75, 76, 77, 116, 79, 80,
-	0, 43, 55, 81, 47, 83, 116, 15, 118, 2,
-	28, 29, 16, 18, 0, 96, 97, 98, 99, 100,
-	117, 0, 0, 113, 68, 118, 32, 33, 34, 69,
-	70, 71, 118, 37, 38, 39, 40, 41, 42, 118,
-	52, 53, 118, 118, 118, 45, 46, 118, 0, 0,
-	0, 0, 60, 66, 67, 118, 58, 59, 118, 62,
-	63, 64, 65, 11, 0, 116, 119, -2, 87, 93,
-	94, 95, 0, 0, 111, 0, 0, 0, 116, 116,
-	116, 0, 116, 0, 84, 73, 0, 78, 0, 0,
-	14, 26, 27, 19, 90, 91, 92, 0, 0, 0,
-	0, 110, 112, 31, 36, 50, 51, 22, 23, 44,
-	56, 57, 82, 0, 74, 48, 61, 101, 102, 114,
-	115, 104, 105, 106, 107, 86, 85, 0, 0, 103,
-	108, 109,
+	10, 11, 12, 13, 14, 15, 0, 0, 18, 19,
+	0, 0, 0, 23, 0, 0, 0, 0, 0, 154,
+	30, 31, 26, -2, 96, 36, 55, 74, 66, 41,
+	60, 78, 0, 81, 82, 83, 154, 85, 86, 0,
+	49, 61, 87, 53, 89, 154, 0, 149, 21, 156,
+	2, 34, 35, 22, 24, 0, 0, 106, 107, 108,
+	109, 110, 111, 112, 113, 114, 155, 0, 0, 0,
+	0, 0, 0, 151, 74, 144, 147, 0, 156, 38,
+	39, 40, 75, 76, 77, 156, 43, 44, 45, 46,
+	47, 48, 156, 58, 59, 156, 156, 156, 51, 52,
+	156, 0, 0, 0, 66, 72, 73, 156, 64, 65,
+	156, 68, 69, 70, 71, 16, 17, 0, 154, 157,
+	-2, 93, 103, 104, 105, 0, 0, 0, 132, 154,
+	0, 0, 0, 0, 0, 0, 0, 0, 154, 154,
+	154, 0, 154, 0, 90, 79, 0, 84, 0, 0,
+	20, 32, 33, 25, 97, 98, 99, 100, 101, 102,
+	0, 0, 0, 0, 0, 119, 120, 94, 0, 128,
+	0, 0, 134, 136, 137, 138, 139, 140, 0, 0,
+	143, 0, 0, 148, 150, 37, 42, 56, 57, 28,
+	29, 50, 62, 63, 88, 0, 80, 54, 67, 115,
+	116, 152, 153, 118, 123, 124, 125, 121, 0, 92,
+	0, 130, 0, 154, 141, 142, 145, 0, 91, 0,
+	0, 122, 0, 0, 133, 135, 146, 117, 126, 127,
+	129, 131,
 }
 
 var mtailTok1 = [...]int{
@@ -347,7 +426,9 @@ var mtailTok2 = [...]int{
 	32, 33, 34, 35, 36, 37, 38, 39, 40, 41,
 	42, 43, 44, 45, 46, 47, 48, 49, 50, 51,
 	52, 53, 54, 55, 56, 57, 58, 59, 60, 61,
-	62, 63, 64, 65, 66,
+	62, 63, 64, 65, 66, 67, 68, 69, 70, 71,
+	72, 73, 74, 75, 76, 77, 78, 79, 80, 81,
+	82,
 }
 
 var mtailTok3 = [...]int{
@@ -359,12 +440,12 @@ var mtailErrorMessages = [...]struct {
 	token int
 	msg   string
 }{
-	{112, 4, "unexpected end of file, expecting '/' to end regex"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
-	{14, 63, "unexpected indexing of an expression"},
-	{14, 66, "statement with no effect, missing an assignment, `+' concatenation, or `{}' block?"},
+	{136, 4, "unexpected end of file, expecting '/' to end regex"},
+	{25, 1, "unexpected end of file, expecting '}' to end block"},
+	{25, 1, "unexpected end of file, expecting '}' to end block"},
+	{25, 1, "unexpected end of file, expecting '}' to end block"},
+	{21, 79, "unexpected indexing of an expression"},
+	{21, 82, "statement with no effect, missing an assignment, `+' concatenation, or `{}' block?"},
 }
 
 //line yaccpar:1
@@ -700,19 +781,19 @@ mtaildefault:
 
 	case 1:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:91
+//line parser.y:96
 		{
 			mtaillex.(*parser).root = mtailDollar[1].n
 		}
 	case 2:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:98
+//line parser.y:103
 		{
 			mtailVAL.n = &ast.StmtList{}
 		}
 	case 3:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:102
+//line parser.y:107
 		{
 			mtailVAL.n = mtailDollar[1].n
 			if mtailDollar[2].n != nil {
@@ -720,74 +801,115 @@ mtaildefault:
 			}
 		}
 	case 4:
-		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:112
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:114
 		{
 			mtailVAL.n = mtailDollar[1].n
+			// Imported definitions are spliced into the enclosing list so that they
+			// share the scope of the importing program.
+			if mtailDollar[2].n != nil {
+				mtailVAL.n.(*ast.StmtList).Children = append(mtailVAL.n.(*ast.StmtList).Children, mtailDollar[2].n.(*ast.StmtList).Children...)
+			}
 		}
 	case 5:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:114
+//line parser.y:126
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 6:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:116
+//line parser.y:128
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 7:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:118
+//line parser.y:130
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 8:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:120
+//line parser.y:132
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 9:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:122
+//line parser.y:134
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 10:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:124
+//line parser.y:136
 		{
-			mtailVAL.n = &ast.NextStmt{tokenpos(mtaillex)}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 11:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:138
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 12:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:140
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 13:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:142
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 14:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:144
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 15:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:146
+		{
+			mtailVAL.n = &ast.NextStmt{tokenpos(mtaillex)}
+		}
+	case 16:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:128
+//line parser.y:150
 		{
 			mtailVAL.n = &ast.PatternFragment{Id: mtailDollar[2].n, Expr: mtailDollar[3].n}
 		}
-	case 12:
+	case 17:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:154
+		{
+			mtailVAL.n = &ast.ExternConst{Id: mtailDollar[3].n}
+		}
+	case 18:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:132
+//line parser.y:158
 		{
 			mtailVAL.n = &ast.StopStmt{tokenpos(mtaillex)}
 		}
-	case 13:
+	case 19:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:136
+//line parser.y:162
 		{
 			mtailVAL.n = &ast.Error{tokenpos(mtaillex), mtailDollar[1].text}
 		}
-	case 14:
+	case 20:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:143
+//line parser.y:169
 		{
 			mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, mtailDollar[4].n, nil}
 		}
-	case 15:
+	case 21:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:147
+//line parser.y:173
 		{
 			if mtailDollar[1].n != nil {
 				mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, nil, nil}
@@ -795,637 +917,843 @@ mtaildefault:
 				mtailVAL.n = mtailDollar[2].n
 			}
 		}
-	case 16:
+	case 22:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:155
+//line parser.y:181
 		{
 			o := &ast.OtherwiseStmt{tokenpos(mtaillex)}
 			mtailVAL.n = &ast.CondStmt{o, mtailDollar[2].n, nil, nil}
 		}
-	case 17:
+	case 23:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:163
+//line parser.y:189
 		{
 			mtailVAL.n = nil
 		}
-	case 18:
+	case 24:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:165
+//line parser.y:191
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 19:
+	case 25:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:170
+//line parser.y:196
 		{
 			mtailVAL.n = mtailDollar[2].n
 		}
-	case 20:
+	case 26:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:177
+//line parser.y:203
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 21:
+	case 27:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:179
+//line parser.y:205
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 22:
+	case 28:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:184
+//line parser.y:210
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 23:
+	case 29:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:188
+//line parser.y:214
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 24:
+	case 30:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:195
+//line parser.y:221
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 25:
+	case 31:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:197
+//line parser.y:223
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 26:
+	case 32:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:199
+//line parser.y:225
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 27:
+	case 33:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:203
+//line parser.y:229
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 28:
+	case 34:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:210
+//line parser.y:236
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 29:
+	case 35:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:212
+//line parser.y:238
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 30:
+	case 36:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:217
+//line parser.y:243
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 31:
+	case 37:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:219
+//line parser.y:245
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 32:
+	case 38:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:226
+//line parser.y:252
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 33:
+	case 39:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:228
+//line parser.y:254
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 34:
+	case 40:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:230
+//line parser.y:256
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 35:
+	case 41:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:235
+//line parser.y:261
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 36:
+	case 42:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:237
+//line parser.y:263
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 37:
+	case 43:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:244
+//line parser.y:270
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 38:
+	case 44:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:246
+//line parser.y:272
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 39:
+	case 45:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:248
+//line parser.y:274
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 40:
+	case 46:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:250
+//line parser.y:276
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 41:
+	case 47:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:252
+//line parser.y:278
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 42:
+	case 48:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:254
+//line parser.y:280
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 43:
+	case 49:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:259
+//line parser.y:285
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 44:
+	case 50:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:261
+//line parser.y:287
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 45:
+	case 51:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:268
+//line parser.y:294
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 46:
+	case 52:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:270
+//line parser.y:296
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 47:
+	case 53:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:275
+//line parser.y:301
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 48:
+	case 54:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:277
+//line parser.y:303
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 49:
+	case 55:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:284
+//line parser.y:310
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 50:
+	case 56:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:286
+//line parser.y:312
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 51:
+	case 57:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:290
+//line parser.y:316
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 52:
+	case 58:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:297
+//line parser.y:323
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 53:
+	case 59:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:299
+//line parser.y:325
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 54:
+	case 60:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:304
+//line parser.y:330
 		{
 			mtailVAL.n = &ast.PatternExpr{Expr: mtailDollar[1].n}
 		}
-	case 55:
+	case 61:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:311
+//line parser.y:337
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 56:
+	case 62:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:313
+//line parser.y:339
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: CONCAT}
 		}
-	case 57:
+	case 63:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:317
+//line parser.y:343
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: CONCAT}
 		}
-	case 58:
+	case 64:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:324
+//line parser.y:350
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 59:
+	case 65:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:326
+//line parser.y:352
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 60:
+	case 66:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:331
+//line parser.y:357
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 61:
+	case 67:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:333
+//line parser.y:359
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 62:
+	case 68:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:340
+//line parser.y:366
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 63:
+	case 69:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:342
+//line parser.y:368
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 64:
+	case 70:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:344
+//line parser.y:370
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 65:
+	case 71:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:346
+//line parser.y:372
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 66:
+	case 72:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:351
+//line parser.y:377
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 67:
+	case 73:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:353
+//line parser.y:379
 		{
 			mtailVAL.n = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: mtailDollar[2].n, Op: mtailDollar[1].op}
 		}
-	case 68:
+	case 74:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:360
+//line parser.y:386
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 69:
+	case 75:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:362
+//line parser.y:388
 		{
 			mtailVAL.n = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: mtailDollar[1].n, Op: mtailDollar[2].op}
 		}
-	case 70:
+	case 76:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:369
+//line parser.y:395
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 71:
+	case 77:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:371
+//line parser.y:397
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 72:
+	case 78:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:376
+//line parser.y:402
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 73:
+	case 79:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:378
+//line parser.y:404
 		{
 			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: nil}
 		}
-	case 74:
+	case 80:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:382
+//line parser.y:408
 		{
 			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: mtailDollar[3].n}
 		}
-	case 75:
+	case 81:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:386
+//line parser.y:412
 		{
 			mtailVAL.n = &ast.CaprefTerm{tokenpos(mtaillex), mtailDollar[1].text, false, nil}
 		}
-	case 76:
+	case 82:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:390
+//line parser.y:416
 		{
 			mtailVAL.n = &ast.CaprefTerm{tokenpos(mtaillex), mtailDollar[1].text, true, nil}
 		}
-	case 77:
+	case 83:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:394
+//line parser.y:420
 		{
 			mtailVAL.n = &ast.StringLit{tokenpos(mtaillex), mtailDollar[1].text}
 		}
-	case 78:
+	case 84:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:398
+//line parser.y:424
 		{
 			mtailVAL.n = mtailDollar[2].n
 		}
-	case 79:
+	case 85:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:402
+//line parser.y:428
 		{
 			mtailVAL.n = &ast.IntLit{tokenpos(mtaillex), mtailDollar[1].intVal}
 		}
-	case 80:
+	case 86:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:406
+//line parser.y:432
 		{
 			mtailVAL.n = &ast.FloatLit{tokenpos(mtaillex), mtailDollar[1].floatVal}
 		}
-	case 81:
+	case 87:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:413
+//line parser.y:439
 		{
 			mtailVAL.n = &ast.IndexedExpr{Lhs: mtailDollar[1].n, Index: &ast.ExprList{}}
 		}
-	case 82:
+	case 88:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:417
+//line parser.y:443
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.IndexedExpr).Index.(*ast.ExprList).Children = append(
 				mtailVAL.n.(*ast.IndexedExpr).Index.(*ast.ExprList).Children,
 				mtailDollar[3].n.(*ast.ExprList).Children...)
 		}
-	case 83:
+	case 89:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:427
+//line parser.y:453
 		{
 			mtailVAL.n = &ast.IdTerm{tokenpos(mtaillex), mtailDollar[1].text, nil, false}
 		}
-	case 84:
+	case 90:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:434
+//line parser.y:460
 		{
 			mtailVAL.n = &ast.ExprList{}
 			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[1].n)
 		}
-	case 85:
+	case 91:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:439
+//line parser.y:465
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[3].n)
 		}
-	case 86:
+	case 92:
 		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
-//line parser.y:447
+//line parser.y:473
 		{
 			mp := markedpos(mtaillex)
 			tp := tokenpos(mtaillex)
 			pos := ast.MergePosition(&mp, &tp)
 			mtailVAL.n = &ast.PatternLit{P: *pos, Pattern: mtailDollar[4].text}
 		}
-	case 87:
+	case 93:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:457
+//line parser.y:483
 		{
 			mtailVAL.n = mtailDollar[3].n
 			d := mtailVAL.n.(*ast.VarDecl)
 			d.Kind = mtailDollar[2].kind
 			d.Hidden = mtailDollar[1].flag
 		}
-	case 88:
+	case 94:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:490
+		{
+			mtailVAL.n = mtailDollar[4].n
+			d := mtailVAL.n.(*ast.VarDecl)
+			d.Kind = metrics.TopK
+			d.Limit = int(mtailDollar[3].intVal)
+			d.Hidden = mtailDollar[1].flag
+		}
+	case 95:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:467
+//line parser.y:501
 		{
 			mtailVAL.flag = false
 		}
-	case 89:
+	case 96:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:471
+//line parser.y:505
 		{
 			mtailVAL.flag = true
 		}
-	case 90:
+	case 97:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:478
+//line parser.y:512
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.VarDecl).Keys = mtailDollar[2].texts
 		}
-	case 91:
+	case 98:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:483
+//line parser.y:517
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.VarDecl).ExportedName = mtailDollar[2].text
 		}
-	case 92:
+	case 99:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:488
+//line parser.y:522
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.VarDecl).Buckets = mtailDollar[2].floats
 		}
-	case 93:
+	case 100:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:527
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Window = mtailDollar[2].duration
+		}
+	case 101:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:532
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Reset = mtailDollar[2].duration
+		}
+	case 102:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:537
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.VarDecl).Timestamp = mtailDollar[2].timestamp
+		}
+	case 103:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:493
+//line parser.y:542
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 94:
+	case 104:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:500
+//line parser.y:549
 		{
 			mtailVAL.n = &ast.VarDecl{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
 		}
-	case 95:
+	case 105:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:504
+//line parser.y:553
 		{
 			mtailVAL.n = &ast.VarDecl{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
 		}
-	case 96:
+	case 106:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:511
+//line parser.y:560
 		{
 			mtailVAL.kind = metrics.Counter
 		}
-	case 97:
+	case 107:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:515
+//line parser.y:564
 		{
 			mtailVAL.kind = metrics.Gauge
 		}
-	case 98:
+	case 108:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:519
+//line parser.y:568
 		{
 			mtailVAL.kind = metrics.Timer
 		}
-	case 99:
+	case 109:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:523
+//line parser.y:572
 		{
 			mtailVAL.kind = metrics.Text
 		}
-	case 100:
+	case 110:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:527
+//line parser.y:576
 		{
 			mtailVAL.kind = metrics.Histogram
 		}
-	case 101:
+	case 111:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:580
+		{
+			mtailVAL.kind = metrics.Distinct
+		}
+	case 112:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:584
+		{
+			mtailVAL.kind = metrics.Min
+		}
+	case 113:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:588
+		{
+			mtailVAL.kind = metrics.Max
+		}
+	case 114:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:592
+		{
+			mtailVAL.kind = metrics.Avg
+		}
+	case 115:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:534
+//line parser.y:599
 		{
 			mtailVAL.texts = mtailDollar[2].texts
 		}
-	case 102:
+	case 116:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:541
+//line parser.y:606
 		{
 			mtailVAL.texts = make([]string, 0)
 			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[1].text)
 		}
-	case 103:
+	case 117:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:546
+//line parser.y:611
 		{
 			mtailVAL.texts = mtailDollar[1].texts
 			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[3].text)
 		}
-	case 104:
+	case 118:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:554
+//line parser.y:619
 		{
 			mtailVAL.text = mtailDollar[2].text
 		}
-	case 105:
+	case 119:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:626
+		{
+			mtailVAL.timestamp = metrics.EmitTimestamp
+		}
+	case 120:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:630
+		{
+			mtailVAL.timestamp = metrics.OmitTimestamp
+		}
+	case 121:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:561
+//line parser.y:637
+		{
+			mtailVAL.duration = mtailDollar[2].duration
+		}
+	case 122:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:644
+		{
+			mtailVAL.duration = mtailDollar[3].duration
+		}
+	case 123:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:651
 		{
 			mtailVAL.floats = mtailDollar[2].floats
 		}
-	case 106:
+	case 124:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:567
+//line parser.y:657
 		{
 			mtailVAL.floats = make([]float64, 0)
 			mtailVAL.floats = append(mtailVAL.floats, mtailDollar[1].floatVal)
 		}
-	case 107:
+	case 125:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:572
+//line parser.y:662
 		{
 			mtailVAL.floats = make([]float64, 0)
 			mtailVAL.floats = append(mtailVAL.floats, float64(mtailDollar[1].intVal))
 		}
-	case 108:
+	case 126:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:577
+//line parser.y:667
 		{
 			mtailVAL.floats = mtailDollar[1].floats
 			mtailVAL.floats = append(mtailVAL.floats, mtailDollar[3].floatVal)
 		}
-	case 109:
+	case 127:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:582
+//line parser.y:672
 		{
 			mtailVAL.floats = mtailDollar[1].floats
 			mtailVAL.floats = append(mtailVAL.floats, float64(mtailDollar[3].intVal))
 		}
-	case 110:
+	case 128:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:589
+//line parser.y:679
 		{
 			mtailVAL.n = &ast.DecoDecl{P: markedpos(mtaillex), Name: mtailDollar[3].text, Block: mtailDollar[4].n}
 		}
-	case 111:
+	case 129:
+		mtailDollar = mtailS[mtailpt-7 : mtailpt+1]
+//line parser.y:683
+		{
+			mtailVAL.n = &ast.DecoDecl{P: markedpos(mtaillex), Name: mtailDollar[3].text, Params: mtailDollar[5].texts, Block: mtailDollar[7].n}
+		}
+	case 130:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:690
+		{
+			mtailVAL.texts = make([]string, 0)
+			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[1].text)
+		}
+	case 131:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:596
+//line parser.y:695
 		{
-			mtailVAL.n = &ast.DecoStmt{markedpos(mtaillex), mtailDollar[2].text, mtailDollar[3].n, nil, nil}
+			mtailVAL.texts = mtailDollar[1].texts
+			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[3].text)
 		}
-	case 112:
+	case 132:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:703
+		{
+			mtailVAL.n = &ast.DecoStmt{P: markedpos(mtaillex), Name: mtailDollar[2].text, Block: mtailDollar[3].n}
+		}
+	case 133:
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:707
+		{
+			mtailVAL.n = &ast.DecoStmt{P: markedpos(mtaillex), Name: mtailDollar[2].text, Args: mtailDollar[4].n, Block: mtailDollar[6].n}
+		}
+	case 134:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:714
+		{
+			mtailVAL.n = &ast.ExprList{}
+			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[1].n)
+		}
+	case 135:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:719
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[3].n)
+		}
+	case 136:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:727
+		{
+			mtailVAL.n = &ast.StringLit{tokenpos(mtaillex), mtailDollar[1].text}
+		}
+	case 137:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:731
+		{
+			mtailVAL.n = &ast.IntLit{tokenpos(mtaillex), mtailDollar[1].intVal}
+		}
+	case 138:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:735
+		{
+			mtailVAL.n = &ast.FloatLit{tokenpos(mtaillex), mtailDollar[1].floatVal}
+		}
+	case 139:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:739
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 140:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:744
+		{
+			mtailVAL.n = newPragma(mtaillex, markedpos(mtaillex), mtailDollar[3].text, "")
+		}
+	case 141:
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+//line parser.y:748
+		{
+			mtailVAL.n = newPragma(mtaillex, markedpos(mtaillex), mtailDollar[3].text, mtailDollar[4].text)
+		}
+	case 142:
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+//line parser.y:757
+		{
+			mtailVAL.n = &ast.PragmaStmt{P: markedpos(mtaillex), Name: "syntax", Value: mtailDollar[4].text}
+		}
+	case 143:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:766
+		{
+			mtailVAL.text = mtailDollar[1].text
+			setSyntax(mtaillex, mtailDollar[1].text)
+		}
+	case 144:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:774
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.SampleStmt).Block = mtailDollar[2].n
+		}
+	case 145:
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+//line parser.y:784
+		{
+			mtailVAL.n = &ast.SampleStmt{P: markedpos(mtaillex), Num: mtailDollar[3].intVal, Rate: mtailDollar[5].intVal}
+		}
+	case 146:
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:788
+		{
+			mtailVAL.n = &ast.SampleStmt{P: markedpos(mtaillex), Mode: mtailDollar[3].text, Num: mtailDollar[4].intVal, Rate: mtailDollar[6].intVal}
+		}
+	case 147:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:795
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.FilterStmt).Pattern = mtailDollar[2].n
+		}
+	case 148:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:603
+//line parser.y:805
+		{
+			mtailVAL.n = &ast.FilterStmt{P: markedpos(mtaillex), Subject: mtailDollar[3].text, Negate: mtailDollar[4].op == NOT_MATCH}
+		}
+	case 149:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:812
+		{
+			mtailVAL.n = importLibrary(mtaillex, mtailDollar[2].text)
+		}
+	case 150:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:819
 		{
 			mtailVAL.n = &ast.DelStmt{P: tokenpos(mtaillex), N: mtailDollar[2].n, Expiry: mtailDollar[4].duration}
 		}
-	case 113:
+	case 151:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:607
+//line parser.y:823
 		{
 			mtailVAL.n = &ast.DelStmt{P: tokenpos(mtaillex), N: mtailDollar[2].n}
 		}
-	case 114:
+	case 152:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:613
+//line parser.y:829
 		{
 			mtailVAL.text = mtailDollar[1].text
 		}
-	case 115:
+	case 153:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:617
+//line parser.y:833
 		{
 			mtailVAL.text = mtailDollar[1].text
 		}
-	case 116:
+	case 154:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:627
+//line parser.y:843
 		{
-			glog.V(2).Infof("position marked at %v", tokenpos(mtaillex))
+			logging.V(2).Infof("position marked at %v", tokenpos(mtaillex))
 			mtaillex.(*parser).pos = tokenpos(mtaillex)
 		}
-	case 117:
+	case 155:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:637
+//line parser.y:853
 		{
 			mtaillex.(*parser).inRegex()
 		}
@@ -10,7 +10,7 @@ import (
     "github.com/google/mtail/internal/metrics"
     "github.com/google/mtail/internal/vm/ast"
     "github.com/google/mtail/internal/vm/position"
-    "github.com/golang/glog"
+    "github.com/google/mtail/internal/logging"
 )
 
 %}
@@ -27,26 +27,31 @@ import (
     n ast.Node
     kind metrics.Kind
     duration time.Duration
+    timestamp metrics.TimestampExport
 }
 
 %type <n> stmt_list stmt arg_expr_list compound_statement conditional_statement expression_statement
 %type <n> expr primary_expr multiplicative_expr additive_expr postfix_expr unary_expr assign_expr
 %type <n> rel_expr shift_expr bitwise_expr logical_expr indexed_expr id_expr concat_expr pattern_expr
 %type <n> declaration decl_attribute_spec decorator_declaration decoration_statement regex_pattern match_expr
-%type <n> delete_statement var_name_spec
+%type <n> delete_statement var_name_spec import_statement deco_arg_list deco_arg pragma_statement syntax_statement
+%type <n> sample_statement sample_spec filter_statement filter_spec
 %type <kind> type_spec
-%type <text> as_spec id_or_string
-%type <texts> by_spec by_expr_list
+%type <text> as_spec id_or_string syntax_version
+%type <texts> by_spec by_expr_list deco_param_list
 %type <flag> hide_spec
 %type <op> rel_op shift_op bitwise_op logical_op add_op mul_op match_op postfix_op
 %type <floats> buckets_spec buckets_list
+%type <timestamp> timestamp_spec
+%type <duration> window_spec reset_spec
 // Tokens and types are defined here.
 // Invalid input
 %token <text> INVALID
 // Types
-%token COUNTER GAUGE TIMER TEXT HISTOGRAM
+%token COUNTER GAUGE TIMER TEXT HISTOGRAM TOPK DISTINCT MIN MAX AVG
 // Reserved words
-%token AFTER AS BY CONST HIDDEN DEF DEL NEXT OTHERWISE ELSE STOP BUCKETS
+%token AFTER AS BY CONST HIDDEN DEF DEL NEXT OTHERWISE ELSE STOP BUCKETS WINDOW RESET EVERY IMPORT PRAGMA SAMPLE SYNTAX EXTERN FILTER
+%token TIMESTAMPED UNTIMESTAMPED
 // Builtins
 %token <text> BUILTIN
 // Literals: re2 syntax regular expression, quoted strings, regex capture group
@@ -105,6 +110,15 @@ stmt_list
       $$.(*ast.StmtList).Children = append($$.(*ast.StmtList).Children, $2)
     }
   }
+  | stmt_list import_statement
+  {
+    $$ = $1
+    // Imported definitions are spliced into the enclosing list so that they
+    // share the scope of the importing program.
+    if ($2 != nil) {
+      $$.(*ast.StmtList).Children = append($$.(*ast.StmtList).Children, $2.(*ast.StmtList).Children...)
+    }
+  }
   ;
 
 stmt
@@ -120,6 +134,14 @@ stmt
   { $$ = $1 }
   | delete_statement
   { $$ = $1 }
+  | pragma_statement
+  { $$ = $1 }
+  | syntax_statement
+  { $$ = $1 }
+  | sample_statement
+  { $$ = $1 }
+  | filter_statement
+  { $$ = $1 }
   | NEXT
   {
     $$ = &ast.NextStmt{tokenpos(mtaillex)}
@@ -128,6 +150,10 @@ stmt
   {
     $$ = &ast.PatternFragment{Id: $2, Expr: $3}
   }
+  | EXTERN CONST id_expr
+  {
+    $$ = &ast.ExternConst{Id: $3}
+  }
   | STOP
   {
     $$ = &ast.StopStmt{tokenpos(mtaillex)}
@@ -460,6 +486,14 @@ declaration
     d.Kind = $2
     d.Hidden = $1
   }
+  | hide_spec TOPK INTLITERAL decl_attribute_spec
+  {
+    $$ = $4
+    d := $$.(*ast.VarDecl)
+    d.Kind = metrics.TopK
+    d.Limit = int($3)
+    d.Hidden = $1
+  }
   ;
 
 hide_spec
@@ -489,6 +523,21 @@ decl_attribute_spec
     $$ = $1
     $$.(*ast.VarDecl).Buckets = $2
   }
+  | decl_attribute_spec window_spec
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Window = $2
+  }
+  | decl_attribute_spec reset_spec
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Reset = $2
+  }
+  | decl_attribute_spec timestamp_spec
+  {
+    $$ = $1
+    $$.(*ast.VarDecl).Timestamp = $2
+  }
   | var_name_spec
   {
     $$ = $1
@@ -527,6 +576,22 @@ type_spec
   {
     $$ = metrics.Histogram
   }
+  | DISTINCT
+  {
+    $$ = metrics.Distinct
+  }
+  | MIN
+  {
+    $$ = metrics.Min
+  }
+  | MAX
+  {
+    $$ = metrics.Max
+  }
+  | AVG
+  {
+    $$ = metrics.Avg
+  }
   ;
 
 by_spec
@@ -556,6 +621,31 @@ as_spec
   }
   ;
 
+timestamp_spec
+  : TIMESTAMPED
+  {
+    $$ = metrics.EmitTimestamp
+  }
+  | UNTIMESTAMPED
+  {
+    $$ = metrics.OmitTimestamp
+  }
+  ;
+
+window_spec
+  : WINDOW DURATIONLITERAL
+  {
+    $$ = $2
+  }
+  ;
+
+reset_spec
+  : RESET EVERY DURATIONLITERAL
+  {
+    $$ = $3
+  }
+  ;
+
 buckets_spec
   : BUCKETS buckets_list
   {
@@ -589,12 +679,138 @@ decorator_declaration
   {
     $$ = &ast.DecoDecl{P: markedpos(mtaillex), Name: $3, Block: $4}
   }
+  | mark_pos DEF ID LPAREN deco_param_list RPAREN compound_statement
+  {
+    $$ = &ast.DecoDecl{P: markedpos(mtaillex), Name: $3, Params: $5, Block: $7}
+  }
+  ;
+
+deco_param_list
+  : ID
+  {
+    $$ = make([]string, 0)
+    $$ = append($$, $1)
+  }
+  | deco_param_list COMMA ID
+  {
+    $$ = $1
+    $$ = append($$, $3)
+  }
   ;
 
 decoration_statement
   : mark_pos DECO compound_statement
   {
-    $$ = &ast.DecoStmt{markedpos(mtaillex), $2, $3, nil, nil}
+    $$ = &ast.DecoStmt{P: markedpos(mtaillex), Name: $2, Block: $3}
+  }
+  | mark_pos DECO LPAREN deco_arg_list RPAREN compound_statement
+  {
+    $$ = &ast.DecoStmt{P: markedpos(mtaillex), Name: $2, Args: $4, Block: $6}
+  }
+  ;
+
+deco_arg_list
+  : deco_arg
+  {
+    $$ = &ast.ExprList{}
+    $$.(*ast.ExprList).Children = append($$.(*ast.ExprList).Children, $1)
+  }
+  | deco_arg_list COMMA deco_arg
+  {
+    $$ = $1
+    $$.(*ast.ExprList).Children = append($$.(*ast.ExprList).Children, $3)
+  }
+  ;
+
+deco_arg
+  : STRING
+  {
+    $$ = &ast.StringLit{tokenpos(mtaillex), $1}
+  }
+  | INTLITERAL
+  {
+    $$ = &ast.IntLit{tokenpos(mtaillex), $1}
+  }
+  | FLOATLITERAL
+  {
+    $$ = &ast.FloatLit{tokenpos(mtaillex), $1}
+  }
+  | regex_pattern
+  { $$ = $1 }
+  ;
+
+pragma_statement
+  : mark_pos PRAGMA ID NL
+  {
+    $$ = newPragma(mtaillex, markedpos(mtaillex), $3, "")
+  }
+  | mark_pos PRAGMA ID STRING NL
+  {
+    $$ = newPragma(mtaillex, markedpos(mtaillex), $3, $4)
+  }
+  ;
+
+// The syntax statement is kept as a pragma, but is spelled differently as the
+// lexer only recognises it at the start of the program.
+syntax_statement
+  : mark_pos SYNTAX ASSIGN syntax_version NL
+  {
+    $$ = &ast.PragmaStmt{P: markedpos(mtaillex), Name: "syntax", Value: $4}
+  }
+  ;
+
+// The version is set as soon as it is read, so that the lexer applies it to
+// the rest of the line.
+syntax_version
+  : STRING
+  {
+    $$ = $1
+    setSyntax(mtaillex, $1)
+  }
+  ;
+
+sample_statement
+  : sample_spec compound_statement
+  {
+    $$ = $1
+    $$.(*ast.SampleStmt).Block = $2
+  }
+  ;
+
+// The position is taken before the block is parsed, as statements in the
+// block mark their own positions.
+sample_spec
+  : mark_pos SAMPLE INTLITERAL DIV INTLITERAL
+  {
+    $$ = &ast.SampleStmt{P: markedpos(mtaillex), Num: $3, Rate: $5}
+  }
+  | mark_pos SAMPLE ID INTLITERAL DIV INTLITERAL
+  {
+    $$ = &ast.SampleStmt{P: markedpos(mtaillex), Mode: $3, Num: $4, Rate: $6}
+  }
+  ;
+
+filter_statement
+  : filter_spec concat_expr
+  {
+    $$ = $1
+    $$.(*ast.FilterStmt).Pattern = $2
+  }
+  ;
+
+// The position is taken before the pattern is parsed, as regular expressions
+// mark their own positions.
+filter_spec
+  : mark_pos FILTER ID match_op
+  {
+    $$ = &ast.FilterStmt{P: markedpos(mtaillex), Subject: $3, Negate: $4 == NOT_MATCH}
+  }
+  ;
+
+import_statement
+  : IMPORT STRING
+  {
+    $$ = importLibrary(mtaillex, $2)
   }
   ;
 
@@ -625,7 +841,7 @@ id_or_string
 mark_pos
   : /* empty */
   {
-    glog.V(2).Infof("position marked at %v", tokenpos(mtaillex))
+    logging.V(2).Infof("position marked at %v", tokenpos(mtaillex))
     mtaillex.(*parser).pos = tokenpos(mtaillex)
   }
   ;
@@ -650,7 +866,7 @@ opt_nl
 
 %%
 
-//  tokenpos returns the position of the current token.
+// tokenpos returns the position of the current token.
 func tokenpos(mtaillex mtailLexer) position.Position {
     return mtaillex.(*parser).t.Pos
 }
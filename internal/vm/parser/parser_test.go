@@ -49,6 +49,26 @@ var parserTests = []struct {
 	{"declare text",
 		"text stringy\n"},
 
+	{"declare topk",
+		"syntax = \"v2\"\n" +
+			"topk 10 clients by ip\n"},
+	{"declare hidden topk",
+		"syntax = \"v2\"\n" +
+			"hidden topk 5 paths by method, path\n"},
+	{"declare distinct",
+		"syntax = \"v2\"\n" +
+			"distinct users by country\n"},
+	{"declare distinct window",
+		"syntax = \"v2\"\n" +
+			"distinct users window 1h0m0s\n"},
+	{"declare aggregates",
+		"syntax = \"v2\"\n" +
+			"min latency_min by path\n" +
+			"max latency_max by path\n" +
+			"avg latency_avg\n"},
+	{"declare reset",
+		"syntax = \"v2\"\n" +
+			"counter reqs by code reset every 1h0m0s\n"},
 	{"declare histogram",
 		"histogram foo buckets 0, 1, 2\n"},
 	{"declare histogram float",
@@ -58,6 +78,11 @@ var parserTests = []struct {
 	{"declare histogram reversed syntax ",
 		"histogram foo buckets 0, 1, 2 by code\n"},
 
+	{"declare timestamped",
+		"syntax = \"v2\"\n" +
+			"counter foo by code timestamped\n" +
+			"gauge bar untimestamped\n"},
+
 	{"simple pattern action",
 		"/foo/ {}\n"},
 
@@ -184,6 +209,38 @@ var parserTests = []struct {
 			"@foo { }\n",
 	},
 
+	{"decorator with parameters",
+		"def foo(x, y) { /a/ + x {\n strptime($1, y)\n next\n }\n }\n" +
+			"@foo(/(b)/, \"2006\") { }\n",
+	},
+
+	{"pragma",
+		"syntax = \"v2\"\n" +
+			"pragma strict\n" +
+			"pragma foo \"bar\"\n",
+	},
+
+	{"sample",
+		"syntax = \"v2\"\n" +
+			"sample 1/100 {\n" +
+			"  sample random 1/2 {\n" +
+			"  }\n" +
+			"}\n",
+	},
+
+	{"filter",
+		"syntax = \"v2\"\n" +
+			"const LOG /access/\n" +
+			"filter filename =~ /nginx\\// + LOG\n" +
+			"filter filename !~ /\\.gz$/\n",
+	},
+
+	{"import",
+		"syntax = \"v2\"\n" +
+			"import \"rsyslog\"\n" +
+			"@rsyslog_traditional { }\n",
+	},
+
 	{"const regex",
 		"const X /foo/\n" +
 			"/foo / + X + / bar/ {\n" +
@@ -213,6 +270,15 @@ var parserTests = []struct {
 	{"const",
 		`const IP /\d+(\.\d+){3}/`},
 
+	{"extern const",
+		"syntax = \"v2\"\n" +
+			"extern const DATACENTER\n" +
+			"counter requests by dc\n" +
+			"/GET/ {\n" +
+			"  requests[DATACENTER]++\n" +
+			"}\n",
+	},
+
 	{"bitwise",
 		`gauge a
 /foo(\d)/ {
@@ -328,6 +394,99 @@ $foo =~ X {
 // {
   stop
 }`},
+
+	{"syntax v2", `syntax = "v2" # comments end lines
+counter a # and statements
+/x/ { # and blocks
+  a++ # in v2
+}
+`},
+
+	{"syntax as a name in v1", `counter syntax
+/x/ {
+  syntax++
+}
+`},
+
+	{"words reserved in v2 as names in v1", `counter field
+counter topk
+counter distinct
+counter window
+counter every
+counter reset
+gauge max
+counter extern
+counter filter
+counter sample
+counter import
+counter pragma
+counter timestamped
+gauge untimestamped
+counter getlinenumber
+counter getlineoffset
+counter getingesttime
+counter alert
+counter exec
+counter parsefloat
+counter parseint
+counter parsedur
+counter parsesize
+counter normpath
+counter urlhost
+counter urlpath
+counter urlquery
+counter uaclass
+counter geoip_asn
+counter geoip_country
+counter hmac
+counter redact
+counter sha256
+counter cef
+counter leef
+counter w3c
+counter csv
+counter csvcol
+/x/ {
+  field++
+  topk++
+  distinct++
+  window++
+  every++
+  reset++
+  max = 1
+  extern++
+  filter++
+  sample++
+  import++
+  pragma++
+  timestamped++
+  untimestamped = 1
+  getlinenumber++
+  getlineoffset++
+  getingesttime++
+  alert++
+  exec++
+  parsefloat++
+  parseint++
+  parsedur++
+  parsesize++
+  normpath++
+  urlhost++
+  urlpath++
+  urlquery++
+  uaclass++
+  geoip_asn++
+  geoip_country++
+  hmac++
+  redact++
+  sha256++
+  cef++
+  leef++
+  w3c++
+  csv++
+  csvcol++
+}
+`},
 }
 
 func TestParserRoundTrip(t *testing.T) {
@@ -427,11 +586,37 @@ var parserInvalidPrograms = []parserInvalidProgram{
  timestamp() - $1
 }`, []string{"statement with no effect:3:18: syntax error: statement with no effect, missing an assignment, `+' concatenation, or `{}' block?"}},
 
+	{"unknown import",
+		"syntax = \"v2\"\nimport \"nope\"\n",
+		[]string{"unknown import:2:8-13: unknown module \"nope\" in import, expecting one of apache, nginx, rsyslog, timestamp"}},
+
 	{"pattern without block",
 		`/(?P<a>.)/
 	/(?P<b>.)/ {}
 	`,
 		[]string{"pattern without block:2:11: syntax error: statement with no effect, missing an assignment, `+' concatenation, or `{}' block?"}},
+
+	{"unknown syntax version",
+		"syntax = \"v9\"\n",
+		[]string{"unknown syntax version:1:10-13: unknown syntax version \"v9\", expecting one of v1, v2"}},
+
+	{"syntax pragma",
+		"syntax = \"v2\"\npragma syntax \"v2\"\n",
+		[]string{"syntax pragma:2:1-6: the syntax version must be declared as the first statement of the program, like `syntax = \"v2\"'"}},
+
+	{"comment ending a statement in v1",
+		"counter a\n/x/ {\n  a++ # a comment\n}\n",
+		[]string{"comment ending a statement in v1:4:18: syntax error: unexpected RCURLY, expecting AND or OR or LCURLY"}},
+
+	{"v2 declaration in v1",
+		"topk 10 clients by ip\n",
+		[]string{"v2 declaration in v1:1:6-7: syntax error: unexpected INTLITERAL, expecting AND or OR or LCURLY",
+			"\tTry declaring `syntax = \"v2\"' at the start of the program to use `topk'."}},
+
+	{"v2 statement in v1",
+		"extern const DATACENTER\n",
+		[]string{"v2 statement in v1:1:8-12: syntax error: unexpected CONST, expecting AND or OR or LCURLY",
+			"\tTry declaring `syntax = \"v2\"' at the start of the program to use `extern'."}},
 }
 
 func TestParseInvalidPrograms(t *testing.T) {
@@ -67,6 +67,10 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		n = ast.Walk(s, v.Id)
 		s.emit(" ")
 
+	case *ast.ExternConst:
+		s.emit("extern const ")
+		n = ast.Walk(s, v.Id)
+
 	case *ast.PatternLit:
 		s.emit(fmt.Sprintf("%q", v.Pattern))
 
@@ -148,6 +152,16 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			s.emit("timer ")
 		case metrics.Text:
 			s.emit("text ")
+		case metrics.TopK:
+			s.emit(fmt.Sprintf("topk %d ", v.Limit))
+		case metrics.Distinct:
+			s.emit("distinct ")
+		case metrics.Min:
+			s.emit("min ")
+		case metrics.Max:
+			s.emit("max ")
+		case metrics.Avg:
+			s.emit("avg ")
 		}
 		s.emit(v.Name)
 		if len(v.Keys) > 0 {
@@ -198,8 +212,14 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.StopStmt:
 		s.emit("stop")
 
+	case *ast.PragmaStmt:
+		s.emit(fmt.Sprintf("pragma %q %q", v.Name, v.Value))
+
 	case *ast.DecoDecl:
 		s.emit(fmt.Sprintf("%q", v.Name))
+		if len(v.Params) > 0 {
+			s.emit(fmt.Sprintf(" %q", v.Params))
+		}
 		s.newline()
 		s.emitScope(v.Scope)
 
@@ -207,6 +227,14 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		s.emit(fmt.Sprintf("%q", v.Name))
 		s.newline()
 
+	case *ast.SampleStmt:
+		s.emit(fmt.Sprintf("sample %q %d/%d", v.Mode, v.Num, v.Rate))
+		s.newline()
+
+	case *ast.FilterStmt:
+		s.emit(fmt.Sprintf("filter %q %t", v.Subject, v.Negate))
+		s.newline()
+
 	case *ast.StmtList:
 		s.emitScope(v.Scope)
 
@@ -0,0 +1,58 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/mtail/internal/vm/ast"
+	"github.com/google/mtail/internal/vm/position"
+)
+
+// SyntaxVersions are the versions of the language, oldest first.  A program
+// written in a later version than the first declares it with its first
+// statement, like `syntax = "v2"`, so that changes to the language that would
+// break existing programs only apply to those that ask for them.
+//
+// v2 keeps the newline at the end of a comment, so statements can be
+// followed by a comment on the same line, and reserves the words added to the
+// language since v1.
+var SyntaxVersions = []string{"v1", "v2"}
+
+// DefaultSyntax is the version of programs that don't declare one.
+const DefaultSyntax = "v1"
+
+// setSyntax sets the syntax version of the program being parsed.
+func setSyntax(mtaillex mtailLexer, version string) {
+	p := mtaillex.(*parser)
+	for i, v := range SyntaxVersions {
+		if v == version {
+			p.l.syntax = i + 1
+			return
+		}
+	}
+	p.Error(fmt.Sprintf("unknown syntax version %q, expecting one of %s", version, strings.Join(SyntaxVersions, ", ")))
+}
+
+// laterWord returns the word at or just before the token being parsed if it
+// was read as a name because it is only reserved in a later syntax version,
+// as a likely cause of a syntax error there, or the empty string otherwise.
+func (p *parser) laterWord() string {
+	for _, t := range []Token{p.t, p.prev} {
+		if t.Kind == ID && reservedSince[t.Spelling] > p.l.syntax {
+			return t.Spelling
+		}
+	}
+	return ""
+}
+
+// newPragma returns a pragma statement, unless it is the syntax version,
+// which must be declared by the first statement, before the program is lexed.
+func newPragma(mtaillex mtailLexer, pos position.Position, name, value string) ast.Node {
+	if name == "syntax" {
+		mtaillex.(*parser).ErrorP(fmt.Sprintf("the syntax version must be declared as the first statement of the program, like `syntax = %q'", value), &pos)
+	}
+	return &ast.PragmaStmt{P: pos, Name: name, Value: value}
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package parser
+
+import (
+	"github.com/google/mtail/internal/vm/ast"
+)
+
+// TreeNode is a node of a syntax tree in a form that can be encoded as JSON.
+type TreeNode struct {
+	Node     string      `json:"node"`               // The type of the node, like "CondStmt".
+	Detail   string      `json:"detail,omitempty"`   // What distinguishes the node from others of its type, like the name of a variable.
+	Type     string      `json:"type,omitempty"`     // The type of the node's value, once checked.
+	Pos      string      `json:"pos,omitempty"`      // The position of the node in the program source.
+	Children []*TreeNode `json:"children,omitempty"` // The nodes below this one, in order.
+}
+
+// treeBuilder converts a syntax tree into TreeNodes.
+type treeBuilder struct {
+	root  *TreeNode
+	stack []*TreeNode // The ancestors of the current node.
+}
+
+func (b *treeBuilder) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
+	t := &TreeNode{Node: nodeName(node), Detail: nodeDetail(node)}
+	if typ := node.Type(); typ != nil {
+		t.Type = typ.String()
+	}
+	if pos := node.Pos(); pos != nil {
+		t.Pos = pos.String()
+	}
+	if len(b.stack) == 0 {
+		b.root = t
+	} else {
+		parent := b.stack[len(b.stack)-1]
+		parent.Children = append(parent.Children, t)
+	}
+	b.stack = append(b.stack, t)
+	return b, node
+}
+
+func (b *treeBuilder) VisitAfter(node ast.Node) ast.Node {
+	b.stack = b.stack[:len(b.stack)-1]
+	return node
+}
+
+// Tree returns the syntax tree n as TreeNodes.
+func Tree(n ast.Node) *TreeNode {
+	b := &treeBuilder{}
+	ast.Walk(b, n)
+	return b.root
+}
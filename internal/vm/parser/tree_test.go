@@ -0,0 +1,40 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package parser
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestTree(t *testing.T) {
+	n, err := Parse("tree", strings.NewReader("counter a\n/x/ {\n  a++\n}\n"))
+	testutil.FatalIfErr(t, err)
+	got := Tree(n)
+	var shape func(*TreeNode) []interface{}
+	shape = func(t *TreeNode) []interface{} {
+		r := []interface{}{t.Node, t.Detail}
+		for _, c := range t.Children {
+			r = append(r, shape(c))
+		}
+		return r
+	}
+	expected := []interface{}{"StmtList", "",
+		[]interface{}{"VarDecl", "Counter a"},
+		[]interface{}{"CondStmt", "",
+			[]interface{}{"PatternExpr", "", []interface{}{"PatternLit", "/x/"}},
+			[]interface{}{"StmtList", "",
+				[]interface{}{"UnaryExpr", "INC",
+					[]interface{}{"IndexedExpr", "", []interface{}{"ExprList", ""}, []interface{}{"IdTerm", "a"}}}}}}
+	testutil.ExpectNoDiff(t, expected, shape(got))
+	if got.Pos == "" {
+		t.Error("no position on the root node")
+	}
+}
+
+func TestDotQuote(t *testing.T) {
+	testutil.ExpectNoDiff(t, `"a \"b\"\n\\d"`, DotQuote("a \"b\"\n\\d"))
+}
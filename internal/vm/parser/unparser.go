@@ -18,6 +18,7 @@ type Unparser struct {
 	output    strings.Builder
 	line      strings.Builder
 	emitTypes bool
+	imported  map[string]struct{} // Library modules already emitted as imports.
 }
 
 func (u *Unparser) indent() {
@@ -91,6 +92,10 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		u.emit(" ")
 		ast.Walk(u, v.Expr)
 
+	case *ast.ExternConst:
+		u.emit("extern const ")
+		ast.Walk(u, v.Id)
+
 	case *ast.PatternLit:
 		u.emit("/" + strings.Replace(v.Pattern, "/", "\\/", -1) + "/")
 
@@ -185,6 +190,16 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			u.emit("text ")
 		case metrics.Histogram:
 			u.emit("histogram ")
+		case metrics.TopK:
+			u.emit(fmt.Sprintf("topk %d ", v.Limit))
+		case metrics.Distinct:
+			u.emit("distinct ")
+		case metrics.Min:
+			u.emit("min ")
+		case metrics.Max:
+			u.emit("max ")
+		case metrics.Avg:
+			u.emit("avg ")
 		}
 		u.emit(v.Name)
 		if len(v.Keys) > 0 {
@@ -198,6 +213,18 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 			}
 			u.emit(buckets.String()[:buckets.Len()-2])
 		}
+		if v.Window > 0 {
+			u.emit(fmt.Sprintf(" window %s", v.Window))
+		}
+		if v.Reset > 0 {
+			u.emit(fmt.Sprintf(" reset every %s", v.Reset))
+		}
+		switch v.Timestamp {
+		case metrics.EmitTimestamp:
+			u.emit(" timestamped")
+		case metrics.OmitTimestamp:
+			u.emit(" untimestamped")
+		}
 
 	case *ast.UnaryExpr:
 		switch v.Op {
@@ -224,7 +251,22 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		u.emit(strconv.FormatFloat(v.F, 'g', -1, 64))
 
 	case *ast.DecoDecl:
-		u.emit(fmt.Sprintf("def %s {", v.Name))
+		if v.Module != "" {
+			// Library definitions are unparsed as the import that loaded them.
+			if _, ok := u.imported[v.Module]; !ok {
+				if u.imported == nil {
+					u.imported = make(map[string]struct{})
+				}
+				u.imported[v.Module] = struct{}{}
+				u.emit(fmt.Sprintf("import %q", v.Module))
+			}
+			break
+		}
+		if len(v.Params) > 0 {
+			u.emit(fmt.Sprintf("def %s(%s) {", v.Name, strings.Join(v.Params, ", ")))
+		} else {
+			u.emit(fmt.Sprintf("def %s {", v.Name))
+		}
 		u.newline()
 		u.indent()
 		ast.Walk(u, v.Block)
@@ -232,16 +274,51 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 		u.emit("}")
 
 	case *ast.DecoStmt:
-		u.emit(fmt.Sprintf("@%s {", v.Name))
+		u.emit(fmt.Sprintf("@%s", v.Name))
+		if v.Args != nil {
+			u.emit("(")
+			ast.Walk(u, v.Args)
+			u.emit(")")
+		}
+		u.emit(" {")
 		u.newline()
 		u.indent()
 		ast.Walk(u, v.Block)
 		u.outdent()
 		u.emit("}")
 
+	case *ast.SampleStmt:
+		u.emit("sample ")
+		if v.Mode != "" {
+			u.emit(v.Mode + " ")
+		}
+		u.emit(fmt.Sprintf("%d/%d {", v.Num, v.Rate))
+		u.newline()
+		u.indent()
+		ast.Walk(u, v.Block)
+		u.outdent()
+		u.emit("}")
+
+	case *ast.FilterStmt:
+		op := "=~"
+		if v.Negate {
+			op = "!~"
+		}
+		u.emit(fmt.Sprintf("filter %s %s ", v.Subject, op))
+		ast.Walk(u, v.Pattern)
+
 	case *ast.NextStmt:
 		u.emit("next")
 
+	case *ast.PragmaStmt:
+		if v.Name == "syntax" {
+			u.emit(fmt.Sprintf("syntax = %q", v.Value))
+		} else if v.Value != "" {
+			u.emit(fmt.Sprintf("pragma %s %q", v.Name, v.Value))
+		} else {
+			u.emit(fmt.Sprintf("pragma %s", v.Name))
+		}
+
 	case *ast.OtherwiseStmt:
 		u.emit("otherwise")
 
@@ -0,0 +1,612 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package pcre
+
+import (
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error codes for the constructs RE2 doesn't have.
+const (
+	ErrInvalidBackref syntax.ErrorCode = "invalid backreference"
+	ErrInvalidFlag    syntax.ErrorCode = "invalid or unsupported flag"
+)
+
+// maxRepeat is the largest count allowed in a repetition, as in RE2.
+const maxRepeat = 1000
+
+// flags are the options set by (?imsxU) groups.
+type flags struct {
+	fold      bool // i: match case insensitively.
+	multiline bool // m: ^ and $ match at the start and end of lines.
+	dotNL     bool // s: . matches a newline.
+	extended  bool // x: ignore whitespace and # comments in the pattern.
+	ungreedy  bool // U: swap the meaning of x* and x*?, x+ and x+?, and so on.
+}
+
+// parser is the state of parsing a regular expression.
+type parser struct {
+	expr    string // The whole expression.
+	s       string // The rest of the expression to parse.
+	flags   flags
+	names   []string // The names of the capture groups so far, by number.
+	sources []string // The text of the capture groups so far, by number.
+	refs    []*backref
+}
+
+func (p *parser) error(code syntax.ErrorCode, expr string) error {
+	return &syntax.Error{Code: code, Expr: expr}
+}
+
+// parse parses the whole expression.
+func (p *parser) parse() (node, error) {
+	n, err := p.alternation()
+	if err != nil {
+		return nil, err
+	}
+	if p.s != "" {
+		// The alternation only stops early at a close paren.
+		return nil, p.error(syntax.ErrUnexpectedParen, p.expr)
+	}
+	for _, r := range p.refs {
+		if r.name != "" {
+			for i, name := range p.names {
+				if name == r.name {
+					r.index = i
+				}
+			}
+		}
+		if r.index < 1 || r.index >= len(p.names) {
+			return nil, p.error(ErrInvalidBackref, r.text)
+		}
+	}
+	return n, nil
+}
+
+// alternation parses alternatives separated by |, up to a close paren or the
+// end of the expression.
+func (p *parser) alternation() (node, error) {
+	var alts alternation
+	for {
+		n, err := p.sequence()
+		if err != nil {
+			return nil, err
+		}
+		alts = append(alts, n)
+		if !strings.HasPrefix(p.s, "|") {
+			break
+		}
+		p.s = p.s[1:]
+	}
+	if len(alts) == 1 {
+		return alts[0], nil
+	}
+	return alts, nil
+}
+
+// sequence parses the nodes of one alternative.
+func (p *parser) sequence() (node, error) {
+	var seq sequence
+	for {
+		p.skipExtended()
+		if p.s == "" || p.s[0] == '|' || p.s[0] == ')' {
+			break
+		}
+		n, err := p.atom()
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			continue
+		}
+		p.skipExtended()
+		q, err := p.quantifier(n)
+		if err != nil {
+			return nil, err
+		}
+		// Runs of literal text are matched at once.
+		if l, ok := q.(*literal); ok && len(seq) > 0 {
+			if prev, ok := seq[len(seq)-1].(*literal); ok && prev.fold == l.fold {
+				seq[len(seq)-1] = &literal{s: prev.s + l.s, fold: l.fold}
+				continue
+			}
+		}
+		seq = append(seq, q)
+	}
+	if len(seq) == 1 {
+		return seq[0], nil
+	}
+	return seq, nil
+}
+
+// skipExtended skips the whitespace and comments of the pattern in extended
+// mode.
+func (p *parser) skipExtended() {
+	for p.flags.extended && p.s != "" {
+		switch p.s[0] {
+		case ' ', '\t', '\n', '\r', '\f', '\v':
+			p.s = p.s[1:]
+		case '#':
+			if i := strings.IndexByte(p.s, '\n'); i >= 0 {
+				p.s = p.s[i+1:]
+			} else {
+				p.s = ""
+			}
+		default:
+			return
+		}
+	}
+}
+
+// atom parses a node that may be repeated.  It returns a nil node for groups
+// that only set flags, and comments.
+func (p *parser) atom() (node, error) {
+	switch p.s[0] {
+	case '(':
+		return p.group()
+	case '[':
+		return p.class()
+	case '\\':
+		return p.escape()
+	case '.':
+		p.s = p.s[1:]
+		if p.flags.dotNL {
+			return class(func(rune) bool { return true }), nil
+		}
+		return class(func(r rune) bool { return r != '\n' }), nil
+	case '^':
+		p.s = p.s[1:]
+		if p.flags.multiline {
+			return beginLine, nil
+		}
+		return beginText, nil
+	case '$':
+		p.s = p.s[1:]
+		if p.flags.multiline {
+			return endLine, nil
+		}
+		return endTextNewline, nil
+	case '*', '+', '?':
+		return nil, p.error(syntax.ErrMissingRepeatArgument, p.s[:1])
+	case '{':
+		if _, _, size, ok := parseRepeat(p.s); ok {
+			return nil, p.error(syntax.ErrMissingRepeatArgument, p.s[:size])
+		}
+	}
+	r, size := utf8.DecodeRuneInString(p.s)
+	p.s = p.s[size:]
+	return &literal{s: string(r), fold: p.flags.fold}, nil
+}
+
+// quantifier parses any repetition of the node n.
+func (p *parser) quantifier(n node) (node, error) {
+	if p.s == "" {
+		return n, nil
+	}
+	min, max, size := 0, -1, 1
+	switch p.s[0] {
+	case '*':
+	case '+':
+		min = 1
+	case '?':
+		max = 1
+	case '{':
+		var ok bool
+		min, max, size, ok = parseRepeat(p.s)
+		if !ok {
+			return n, nil
+		}
+		if min > maxRepeat || max > maxRepeat || max >= 0 && max < min {
+			return nil, p.error(syntax.ErrInvalidRepeatSize, p.s[:size])
+		}
+	default:
+		return n, nil
+	}
+	op := p.s[:size]
+	p.s = p.s[size:]
+	greedy, possessive := !p.flags.ungreedy, false
+	if p.s != "" {
+		switch p.s[0] {
+		case '?':
+			greedy = !greedy
+			op += p.s[:1]
+			p.s = p.s[1:]
+		case '+':
+			possessive = true
+			op += p.s[:1]
+			p.s = p.s[1:]
+		}
+	}
+	if p.s != "" && strings.IndexByte("*+?", p.s[0]) >= 0 {
+		return nil, p.error(syntax.ErrInvalidRepeatOp, op+p.s[:1])
+	}
+	r := &repeat{sub: n, min: min, max: max, greedy: greedy}
+	if possessive {
+		return &atomic{r}, nil
+	}
+	return r, nil
+}
+
+// parseRepeat parses the counted repetition {n}, {n,}, or {n,m} at the start
+// of s, returning the bounds and its length.  ok is false if s doesn't start
+// with one, in which case the brace is a literal.
+func parseRepeat(s string) (min, max, size int, ok bool) {
+	end := strings.IndexByte(s, '}')
+	if end < 0 {
+		return 0, 0, 0, false
+	}
+	lo, hi := s[1:end], ""
+	comma := strings.IndexByte(lo, ',')
+	if comma >= 0 {
+		lo, hi = lo[:comma], lo[comma+1:]
+	}
+	min, err := strconv.Atoi(lo)
+	if err != nil || lo[0] == '+' || lo[0] == '-' {
+		return 0, 0, 0, false
+	}
+	switch {
+	case comma < 0:
+		max = min
+	case hi == "":
+		max = -1
+	default:
+		max, err = strconv.Atoi(hi)
+		if err != nil || hi[0] == '+' || hi[0] == '-' {
+			return 0, 0, 0, false
+		}
+	}
+	return min, max, end + 1, true
+}
+
+// group parses a parenthesised group.
+func (p *parser) group() (node, error) {
+	start := p.s
+	p.s = p.s[1:]
+	if !strings.HasPrefix(p.s, "?") {
+		return p.capture("", start)
+	}
+	switch {
+	case strings.HasPrefix(p.s, "?#"):
+		end := strings.IndexByte(p.s, ')')
+		if end < 0 {
+			return nil, p.error(syntax.ErrMissingParen, start)
+		}
+		p.s = p.s[end+1:]
+		return nil, nil
+	case strings.HasPrefix(p.s, "?:"):
+		p.s = p.s[2:]
+		return p.body(start)
+	case strings.HasPrefix(p.s, "?>"):
+		p.s = p.s[2:]
+		n, err := p.body(start)
+		if err != nil {
+			return nil, err
+		}
+		return &atomic{n}, nil
+	case strings.HasPrefix(p.s, "?="), strings.HasPrefix(p.s, "?!"):
+		negate := p.s[1] == '!'
+		p.s = p.s[2:]
+		n, err := p.body(start)
+		if err != nil {
+			return nil, err
+		}
+		return &look{sub: n, negate: negate}, nil
+	case strings.HasPrefix(p.s, "?<="), strings.HasPrefix(p.s, "?<!"):
+		negate := p.s[2] == '!'
+		p.s = p.s[3:]
+		n, err := p.body(start)
+		if err != nil {
+			return nil, err
+		}
+		return &look{sub: n, behind: true, negate: negate}, nil
+	case strings.HasPrefix(p.s, "?P="):
+		end := strings.IndexByte(p.s, ')')
+		if end < 0 {
+			return nil, p.error(syntax.ErrMissingParen, start)
+		}
+		name := p.s[3:end]
+		p.s = p.s[end+1:]
+		return p.backref(0, name, start[:end+2])
+	case strings.HasPrefix(p.s, "?P<"), strings.HasPrefix(p.s, "?<"), strings.HasPrefix(p.s, "?'"):
+		open := strings.IndexAny(p.s, "<'")
+		close := byte('>')
+		if p.s[open] == '\'' {
+			close = '\''
+		}
+		end := strings.IndexByte(p.s[open+1:], close)
+		if end < 0 {
+			return nil, p.error(syntax.ErrInvalidNamedCapture, start)
+		}
+		name := p.s[open+1 : open+1+end]
+		text := start[:open+end+3]
+		if !isValidName(name) {
+			return nil, p.error(syntax.ErrInvalidNamedCapture, text)
+		}
+		for _, n := range p.names {
+			if n == name {
+				return nil, p.error(syntax.ErrInvalidNamedCapture, text)
+			}
+		}
+		p.s = p.s[open+end+2:]
+		return p.capture(name, start)
+	}
+	return p.flagGroup(start)
+}
+
+// capture parses the body of a capture group called name, which begins at
+// start.
+func (p *parser) capture(name, start string) (node, error) {
+	index := len(p.names)
+	p.names = append(p.names, name)
+	p.sources = append(p.sources, "")
+	body := p.s
+	n, err := p.body(start)
+	if err != nil {
+		return nil, err
+	}
+	p.sources[index] = body[:len(body)-len(p.s)-1]
+	return &capture{index: index, sub: n}, nil
+}
+
+// body parses the alternatives of a group up to its close paren.  Flags set
+// in the group end with it.
+func (p *parser) body(start string) (node, error) {
+	saved := p.flags
+	n, err := p.alternation()
+	p.flags = saved
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(p.s, ")") {
+		return nil, p.error(syntax.ErrMissingParen, start)
+	}
+	p.s = p.s[1:]
+	return n, nil
+}
+
+// flagGroup parses a (?flags) group, which sets flags for the rest of the
+// enclosing group, or a (?flags:...) group, which sets them inside it.
+func (p *parser) flagGroup(start string) (node, error) {
+	f := p.flags
+	on := true
+	for i := 1; i < len(p.s); i++ {
+		switch c := p.s[i]; c {
+		case 'i':
+			f.fold = on
+		case 'm':
+			f.multiline = on
+		case 's':
+			f.dotNL = on
+		case 'x':
+			f.extended = on
+		case 'U':
+			f.ungreedy = on
+		case '-':
+			if !on || i == 1 {
+				return nil, p.error(ErrInvalidFlag, start[:i+2])
+			}
+			on = false
+		case ')', ':':
+			if i == 1 || p.s[i-1] == '-' {
+				return nil, p.error(ErrInvalidFlag, start[:i+2])
+			}
+			p.s = p.s[i+1:]
+			if c == ')' {
+				p.flags = f
+				return nil, nil
+			}
+			saved := p.flags
+			p.flags = f
+			n, err := p.body(start)
+			p.flags = saved
+			return n, err
+		default:
+			return nil, p.error(ErrInvalidFlag, start[:i+2])
+		}
+	}
+	return nil, p.error(syntax.ErrMissingParen, start)
+}
+
+// isValidName reports whether name may name a capture group, as in RE2.
+func isValidName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c >= utf8.RuneSelf || !isWordByte(byte(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// class parses a bracketed character class.
+func (p *parser) class() (node, error) {
+	s := p.s
+	i := 1
+	if i < len(s) && s[i] == '^' {
+		i++
+	}
+	if i < len(s) && s[i] == ']' {
+		i++
+	}
+	for ; i < len(s) && s[i] != ']'; i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case strings.HasPrefix(s[i:], "[:"):
+			if j := strings.Index(s[i+2:], ":]"); j >= 0 {
+				i += j + 3
+			}
+		}
+	}
+	if i >= len(s) {
+		return nil, p.error(syntax.ErrMissingBracket, s)
+	}
+	p.s = s[i+1:]
+	return p.runeClass(s[:i+1])
+}
+
+// escape parses a backslash escape.
+func (p *parser) escape() (node, error) {
+	s := p.s
+	if len(s) < 2 {
+		return nil, p.error(syntax.ErrTrailingBackslash, "")
+	}
+	switch c := s[1]; c {
+	case '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		end := 2
+		for end < len(s) && '0' <= s[end] && s[end] <= '9' {
+			end++
+		}
+		p.s = s[end:]
+		index, err := strconv.Atoi(s[1:end])
+		if err != nil {
+			return nil, p.error(ErrInvalidBackref, s[:end])
+		}
+		return p.backref(index, "", s[:end])
+	case 'k', 'g':
+		if len(s) < 3 {
+			return nil, p.error(ErrInvalidBackref, s)
+		}
+		var ref string
+		switch s[2] {
+		case '<', '{', '\'':
+			close := map[byte]byte{'<': '>', '{': '}', '\'': '\''}[s[2]]
+			end := strings.IndexByte(s[3:], close)
+			if end < 0 {
+				return nil, p.error(ErrInvalidBackref, s)
+			}
+			ref = s[3 : 3+end]
+			p.s = s[4+end:]
+		default:
+			if c == 'k' {
+				return nil, p.error(ErrInvalidBackref, s[:3])
+			}
+			end := 2
+			for end < len(s) && '0' <= s[end] && s[end] <= '9' {
+				end++
+			}
+			ref = s[2:end]
+			p.s = s[end:]
+		}
+		text := s[:len(s)-len(p.s)]
+		if index, err := strconv.Atoi(ref); err == nil && c == 'g' && index > 0 {
+			return p.backref(index, "", text)
+		}
+		if !isValidName(ref) {
+			return nil, p.error(ErrInvalidBackref, text)
+		}
+		return p.backref(0, ref, text)
+	case 'A':
+		p.s = s[2:]
+		return beginText, nil
+	case 'z':
+		p.s = s[2:]
+		return endText, nil
+	case 'Z':
+		p.s = s[2:]
+		return endTextNewline, nil
+	case 'b':
+		p.s = s[2:]
+		return wordBoundary, nil
+	case 'B':
+		p.s = s[2:]
+		return notWordBoundary, nil
+	case 'Q':
+		lit := s[2:]
+		if end := strings.Index(lit, `\E`); end >= 0 {
+			lit, p.s = lit[:end], lit[end+2:]
+		} else {
+			p.s = ""
+		}
+		if lit == "" {
+			return nil, nil
+		}
+		return &literal{s: lit, fold: p.flags.fold}, nil
+	case 'E':
+		// A \E without a \Q is ignored, as in Perl.
+		p.s = s[2:]
+		return nil, nil
+	}
+	size := escapeLen(s)
+	p.s = s[size:]
+	return p.runeClass(s[:size])
+}
+
+// escapeLen returns the length of the escape at the start of s that matches
+// one rune.
+func escapeLen(s string) int {
+	switch s[1] {
+	case 'p', 'P', 'x':
+		if len(s) > 2 && s[2] == '{' {
+			if end := strings.IndexByte(s, '}'); end >= 0 {
+				return end + 1
+			}
+			return len(s)
+		}
+		if s[1] == 'x' {
+			if len(s) < 4 {
+				return len(s)
+			}
+			return 4
+		}
+		if len(s) == 2 {
+			return 2
+		}
+		_, size := utf8.DecodeRuneInString(s[2:])
+		return 2 + size
+	case '0':
+		end := 2
+		for end < len(s) && end < 4 && '0' <= s[end] && s[end] <= '7' {
+			end++
+		}
+		return end
+	}
+	_, size := utf8.DecodeRuneInString(s[1:])
+	return 1 + size
+}
+
+// backref records a backreference, to be checked once all the groups are
+// known.
+func (p *parser) backref(index int, name, text string) (node, error) {
+	b := &backref{index: index, name: name, fold: p.flags.fold, text: text}
+	p.refs = append(p.refs, b)
+	return b, nil
+}
+
+// runeClass returns a node matching the one rune matched by the RE2 pattern
+// expr, in the current flags.
+func (p *parser) runeClass(expr string) (node, error) {
+	f := syntax.Perl
+	if p.flags.fold {
+		f |= syntax.FoldCase
+	}
+	re, err := syntax.Parse(expr, f)
+	if err != nil {
+		return nil, err
+	}
+	switch re.Op {
+	case syntax.OpLiteral:
+		if len(re.Rune) == 1 {
+			return &literal{s: string(re.Rune[0]), fold: re.Flags&syntax.FoldCase != 0}, nil
+		}
+	case syntax.OpCharClass:
+		ranges := re.Rune
+		return class(func(r rune) bool {
+			for i := 0; i < len(ranges); i += 2 {
+				if ranges[i] <= r && r <= ranges[i+1] {
+					return true
+				}
+			}
+			return false
+		}), nil
+	case syntax.OpNoMatch:
+		return class(func(rune) bool { return false }), nil
+	}
+	return nil, p.error(syntax.ErrInvalidEscape, expr)
+}
@@ -0,0 +1,517 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package pcre implements a backtracking regular expression engine for the
+// Perl compatible features that RE2, and so Go's regexp package, leaves out:
+// backreferences, lookahead and lookbehind assertions, atomic groups, and
+// possessive quantifiers.  Character classes and escapes are those of RE2.
+//
+// RE2 matches in time linear in the length of its input, but a backtracking
+// engine may take time exponential in it.  To bound the cost of a pathological
+// pattern, a match gives up after MaxSteps steps.
+package pcre
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Marker selects the backtracking engine for the pattern it begins.  It is
+// never a valid RE2 pattern, so it can't change the meaning of one.
+const Marker = "(*PCRE)"
+
+// Selected returns the pattern without its leading Marker, and whether it had
+// one.
+func Selected(pattern string) (string, bool) {
+	if !strings.HasPrefix(pattern, Marker) {
+		return pattern, false
+	}
+	return pattern[len(Marker):], true
+}
+
+// MaxSteps is the number of steps a match may take before giving up.
+const MaxSteps = 1000000
+
+// ErrStepLimit is returned by a match that gave up after MaxSteps steps.
+var ErrStepLimit = errors.Errorf("backtracking match gave up after %d steps", MaxSteps)
+
+// Regexp is a compiled regular expression.  It is safe for concurrent use.
+type Regexp struct {
+	expr     string
+	prog     node
+	anchored bool     // Whether the pattern can only match at the start of the input.
+	names    []string // The names of the capture groups, by number; group 0 is the whole match.
+	sources  []string // The pattern text inside the parentheses of each capture group, by number.
+}
+
+// Compile parses the regular expression expr.
+func Compile(expr string) (*Regexp, error) {
+	p := &parser{expr: expr, s: expr, names: []string{""}, sources: []string{expr}}
+	prog, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	return &Regexp{
+		expr:     expr,
+		prog:     prog,
+		anchored: anchored(prog),
+		names:    p.names,
+		sources:  p.sources,
+	}, nil
+}
+
+// MustCompile is like Compile but panics if the expression can't be parsed.
+func MustCompile(expr string) *Regexp {
+	re, err := Compile(expr)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+// String returns the source text of the regular expression.
+func (re *Regexp) String() string {
+	return re.expr
+}
+
+// NumSubexp returns the number of capture groups in the regular expression.
+func (re *Regexp) NumSubexp() int {
+	return len(re.names) - 1
+}
+
+// SubexpNames returns the names of the capture groups, indexed by group number
+// with the whole match as group 0.  Unnamed groups have the empty name.
+func (re *Regexp) SubexpNames() []string {
+	return re.names
+}
+
+// SubexpSource returns the pattern text between the parentheses of the i'th
+// capture group, or the whole pattern if i is zero.
+func (re *Regexp) SubexpSource(i int) string {
+	return re.sources[i]
+}
+
+// FindStringSubmatch returns the leftmost match of the regular expression in
+// s and the matches of its capture groups, like the method of the same name in
+// the regexp package, or nil if there is no match.  Groups that took no part
+// in the match are empty.  The error is ErrStepLimit if the match gave up.
+func (re *Regexp) FindStringSubmatch(s string) ([]string, error) {
+	m := &machine{input: s, caps: make([]int, 2*len(re.names))}
+	for start := 0; start <= len(s); {
+		for i := range m.caps {
+			m.caps[i] = -1
+		}
+		if re.prog.match(m, start, func(end int) bool {
+			m.caps[0], m.caps[1] = start, end
+			return true
+		}) {
+			return m.submatches(), nil
+		}
+		if m.steps > MaxSteps {
+			return nil, ErrStepLimit
+		}
+		if re.anchored || start == len(s) {
+			break
+		}
+		_, size := utf8.DecodeRuneInString(s[start:])
+		start += size
+	}
+	return nil, nil
+}
+
+// machine is the state of one match.
+type machine struct {
+	input string
+	caps  []int // The start and end offsets of each capture group, or -1 if unset.
+	steps int
+}
+
+// step counts a step of the match, and reports whether it may continue.
+func (m *machine) step() bool {
+	m.steps++
+	return m.steps <= MaxSteps
+}
+
+func (m *machine) submatches() []string {
+	r := make([]string, len(m.caps)/2)
+	for i := range r {
+		if m.caps[2*i] >= 0 {
+			r[i] = m.input[m.caps[2*i]:m.caps[2*i+1]]
+		}
+	}
+	return r
+}
+
+// node is a part of a compiled regular expression.
+type node interface {
+	// match matches the node at offset i of the input, calling k with the
+	// end of each way it matches in order of preference until k returns true.
+	// It reports whether k did.
+	match(m *machine, i int, k func(int) bool) bool
+	// width returns the most runes the node can match, or -1 if there's no
+	// limit.
+	width() int
+}
+
+// anchored reports whether n can only match at the start of the input.
+func anchored(n node) bool {
+	if s, ok := n.(sequence); ok && len(s) > 0 {
+		n = s[0]
+	}
+	a, ok := n.(assertion)
+	return ok && a == beginText
+}
+
+// literal matches a string.
+type literal struct {
+	s    string
+	fold bool // Whether to match case insensitively.
+}
+
+func (l *literal) match(m *machine, i int, k func(int) bool) bool {
+	if !m.step() {
+		return false
+	}
+	if !l.fold {
+		return strings.HasPrefix(m.input[i:], l.s) && k(i+len(l.s))
+	}
+	end, ok := hasPrefixFold(m.input, i, l.s)
+	return ok && k(end)
+}
+
+func (l *literal) width() int {
+	return utf8.RuneCountInString(l.s)
+}
+
+// hasPrefixFold reports whether the input at offset i begins with prefix under
+// simple case folding, and returns the end of the prefix in the input.
+func hasPrefixFold(input string, i int, prefix string) (int, bool) {
+	for _, p := range prefix {
+		if i >= len(input) {
+			return 0, false
+		}
+		r, size := utf8.DecodeRuneInString(input[i:])
+		if !equalFold(r, p) {
+			return 0, false
+		}
+		i += size
+	}
+	return i, true
+}
+
+// equalFold reports whether a and b are equal under simple case folding.
+func equalFold(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	for f := unicode.SimpleFold(a); f != a; f = unicode.SimpleFold(f) {
+		if f == b {
+			return true
+		}
+	}
+	return false
+}
+
+// class matches one rune.
+type class func(rune) bool
+
+func (c class) match(m *machine, i int, k func(int) bool) bool {
+	if !m.step() || i >= len(m.input) {
+		return false
+	}
+	r, size := utf8.DecodeRuneInString(m.input[i:])
+	return c(r) && k(i+size)
+}
+
+func (c class) width() int {
+	return 1
+}
+
+// assertion matches the empty string at some offsets.
+type assertion int
+
+const (
+	beginText       assertion = iota // \A, and ^ outside multiline mode.
+	endText                          // \z
+	endTextNewline                   // \Z, and $ outside multiline mode: the end, or before a final newline.
+	beginLine                        // ^ in multiline mode.
+	endLine                          // $ in multiline mode.
+	wordBoundary                     // \b
+	notWordBoundary                  // \B
+)
+
+func (a assertion) match(m *machine, i int, k func(int) bool) bool {
+	return m.step() && a.at(m.input, i) && k(i)
+}
+
+func (a assertion) at(s string, i int) bool {
+	switch a {
+	case beginText:
+		return i == 0
+	case endText:
+		return i == len(s)
+	case endTextNewline:
+		return i == len(s) || i == len(s)-1 && s[i] == '\n'
+	case beginLine:
+		return i == 0 || s[i-1] == '\n'
+	case endLine:
+		return i == len(s) || s[i] == '\n'
+	case wordBoundary:
+		return isWordBoundary(s, i)
+	case notWordBoundary:
+		return !isWordBoundary(s, i)
+	}
+	return false
+}
+
+func (a assertion) width() int {
+	return 0
+}
+
+// isWordBoundary reports whether offset i of s is between an ASCII word
+// character and something else, as \b is in RE2.
+func isWordBoundary(s string, i int) bool {
+	before := i > 0 && isWordByte(s[i-1])
+	after := i < len(s) && isWordByte(s[i])
+	return before != after
+}
+
+func isWordByte(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || b == '_'
+}
+
+// sequence matches each of its nodes in turn.
+type sequence []node
+
+func (s sequence) match(m *machine, i int, k func(int) bool) bool {
+	if len(s) == 0 {
+		return k(i)
+	}
+	return s[0].match(m, i, func(j int) bool {
+		return s[1:].match(m, j, k)
+	})
+}
+
+func (s sequence) width() int {
+	w := 0
+	for _, n := range s {
+		nw := n.width()
+		if nw < 0 {
+			return -1
+		}
+		w += nw
+	}
+	return w
+}
+
+// alternation matches any one of its nodes, preferring the first.
+type alternation []node
+
+func (a alternation) match(m *machine, i int, k func(int) bool) bool {
+	for _, n := range a {
+		if n.match(m, i, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a alternation) width() int {
+	w := 0
+	for _, n := range a {
+		nw := n.width()
+		if nw < 0 {
+			return -1
+		}
+		if nw > w {
+			w = nw
+		}
+	}
+	return w
+}
+
+// repeat matches its node between min and max times, or at least min times if
+// max is -1.
+type repeat struct {
+	sub      node
+	min, max int
+	greedy   bool // Whether to prefer more repetitions to fewer.
+}
+
+func (r *repeat) match(m *machine, i int, k func(int) bool) bool {
+	return r.iterate(m, 0, i, k)
+}
+
+// iterate matches the repetitions after the first n, from offset i.
+func (r *repeat) iterate(m *machine, n, i int, k func(int) bool) bool {
+	if !m.step() {
+		return false
+	}
+	more := r.max < 0 || n < r.max
+	next := func(j int) bool {
+		// Once the minimum is met, repeating after an empty match would
+		// make no progress.
+		if j == i && n >= r.min {
+			return k(j)
+		}
+		return r.iterate(m, n+1, j, k)
+	}
+	if r.greedy {
+		if more && r.sub.match(m, i, next) {
+			return true
+		}
+		return n >= r.min && k(i)
+	}
+	if n >= r.min && k(i) {
+		return true
+	}
+	return more && r.sub.match(m, i, next)
+}
+
+func (r *repeat) width() int {
+	w := r.sub.width()
+	if w == 0 {
+		return 0
+	}
+	if w < 0 || r.max < 0 {
+		return -1
+	}
+	return w * r.max
+}
+
+// capture records the offsets of its node's match as a capture group.
+type capture struct {
+	index int
+	sub   node
+}
+
+func (c *capture) match(m *machine, i int, k func(int) bool) bool {
+	if !m.step() {
+		return false
+	}
+	return c.sub.match(m, i, func(j int) bool {
+		start, end := m.caps[2*c.index], m.caps[2*c.index+1]
+		m.caps[2*c.index], m.caps[2*c.index+1] = i, j
+		if k(j) {
+			return true
+		}
+		m.caps[2*c.index], m.caps[2*c.index+1] = start, end
+		return false
+	})
+}
+
+func (c *capture) width() int {
+	return c.sub.width()
+}
+
+// backref matches the text last matched by a capture group.
+type backref struct {
+	index int
+	name  string // The name the group was referred to by, if any.
+	fold  bool   // Whether to match case insensitively.
+	text  string // The backreference as written, for errors.
+}
+
+func (b *backref) match(m *machine, i int, k func(int) bool) bool {
+	if !m.step() {
+		return false
+	}
+	start, end := m.caps[2*b.index], m.caps[2*b.index+1]
+	if start < 0 {
+		// As in Perl, a reference to a group that hasn't matched fails.
+		return false
+	}
+	s := m.input[start:end]
+	if !b.fold {
+		return strings.HasPrefix(m.input[i:], s) && k(i+len(s))
+	}
+	j, ok := hasPrefixFold(m.input, i, s)
+	return ok && k(j)
+}
+
+func (b *backref) width() int {
+	return -1
+}
+
+// atomic matches its node as it first matches, never backtracking into it.
+type atomic struct {
+	sub node
+}
+
+func (a *atomic) match(m *machine, i int, k func(int) bool) bool {
+	if !m.step() {
+		return false
+	}
+	saved := append([]int(nil), m.caps...)
+	end := -1
+	if !a.sub.match(m, i, func(j int) bool {
+		end = j
+		return true
+	}) {
+		return false
+	}
+	if k(end) {
+		return true
+	}
+	copy(m.caps, saved)
+	return false
+}
+
+func (a *atomic) width() int {
+	return a.sub.width()
+}
+
+// look asserts that its node matches, or doesn't, directly before or after the
+// current offset, without consuming any input.
+type look struct {
+	sub    node
+	behind bool
+	negate bool
+}
+
+func (l *look) match(m *machine, i int, k func(int) bool) bool {
+	if !m.step() {
+		return false
+	}
+	saved := append([]int(nil), m.caps...)
+	if l.find(m, i) == l.negate {
+		copy(m.caps, saved)
+		return false
+	}
+	if l.negate {
+		copy(m.caps, saved)
+	}
+	if k(i) {
+		return true
+	}
+	copy(m.caps, saved)
+	return false
+}
+
+// find reports whether the node matches at offset i, or ends there if this is
+// a lookbehind.
+func (l *look) find(m *machine, i int) bool {
+	if !l.behind {
+		return l.sub.match(m, i, func(int) bool { return true })
+	}
+	lo := 0
+	if w := l.sub.width(); w >= 0 && i-w*utf8.UTFMax > 0 {
+		lo = i - w*utf8.UTFMax
+	}
+	for j := i; j >= lo; j-- {
+		if j < len(m.input) && !utf8.RuneStart(m.input[j]) {
+			continue
+		}
+		if l.sub.match(m, j, func(end int) bool { return end == i }) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *look) width() int {
+	return 0
+}
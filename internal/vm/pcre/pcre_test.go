@@ -0,0 +1,192 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package pcre
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+var matchTests = []struct {
+	pattern  string
+	input    string
+	expected []string // nil if there's no match.
+}{
+	{`abc`, "xabcx", []string{"abc"}},
+	{`a.c`, "abc", []string{"abc"}},
+	{`a.c`, "a\nc", nil},
+	{`(?s)a.c`, "a\nc", []string{"a\nc"}},
+	{`^b`, "ab", nil},
+	{`(?m)^b`, "a\nb", []string{"b"}},
+	{`a$`, "a\n", []string{"a"}},
+	{`a\z`, "a\n", nil},
+	{`\bfoo\b`, "a foo b", []string{"foo"}},
+	{`\Bfoo`, "afoo", []string{"foo"}},
+	{`(a+)(b*)`, "xaaab", []string{"aaab", "aaa", "b"}},
+	{`(a)|(b)`, "b", []string{"b", "", "b"}},
+	{`a*?b`, "aab", []string{"aab"}},
+	{`<.+>`, "<a><b>", []string{"<a><b>"}},
+	{`<.+?>`, "<a><b>", []string{"<a>"}},
+	{`(?U)<.+>`, "<a><b>", []string{"<a>"}},
+	{`a{2,3}`, "aaaa", []string{"aaa"}},
+	{`a{2}`, "a", nil},
+	{`a{,2}`, "a{,2}", []string{"a{,2}"}},
+	{`[a-c]+`, "xbcay", []string{"bca"}},
+	{`[^\d\s]+`, "12 ab3", []string{"ab"}},
+	{`[[:alpha:]]+`, "1ab2", []string{"ab"}},
+	{`\d+\.\d+`, "v1.25", []string{"1.25"}},
+	{`\pL+`, "1héllo2", []string{"héllo"}},
+	{`(?i)héllo`, "HÉLLO", []string{"HÉLLO"}},
+	{`(?i:a)b`, "Ab", []string{"Ab"}},
+	{`(?i:a)b`, "AB", nil},
+	{`(?x) a b  # comment`, "ab", []string{"ab"}},
+	{`\Qa.b\E.`, "a.bc", []string{"a.bc"}},
+	{`a(?#comment)b`, "ab", []string{"ab"}},
+
+	// Backreferences.
+	{`(\w+) \1`, "hello hello", []string{"hello hello", "hello"}},
+	{`(\w+) \1\b`, "the then", nil},
+	{`(?P<word>\w+) (?P=word)`, "bye bye", []string{"bye bye", "bye"}},
+	{`(?<q>["']).*?\k<q>`, `say 'it"s' ok`, []string{`'it"s'`, "'"}},
+	{`(?i)(a) \1`, "a A", []string{"a A", "a"}},
+	{`(a)?b\1`, "b", nil},
+	{`(a)\g{1}`, "aa", []string{"aa", "a"}},
+
+	// Lookaround.
+	{`foo(?=bar)`, "foobaz foobar", []string{"foo"}},
+	{`\w+(?=\.)`, "a b.", []string{"b"}},
+	{`foo(?!bar)\w`, "foobar", nil},
+	{`foo(?!bar)`, "foobar foo", []string{"foo"}},
+	{`(?<=\$)\d+`, "cost: $42", []string{"42"}},
+	{`(?<!\$)\b\d+`, "$42 17", []string{"17"}},
+	{`(?<=a|bc)d`, "bcd", []string{"d"}},
+	{`(?<=^|,)\w+`, ",x", []string{"x"}},
+	{`(?=(\w+))\w`, "ab", []string{"a", "ab"}},
+
+	// Atomic groups and possessive quantifiers.
+	{`(?>a+)b`, "aab", []string{"aab"}},
+	{`(?>a+)a`, "aaa", nil},
+	{`a++a`, "aaa", nil},
+	{`a*+b`, "aab", []string{"aab"}},
+	{`"[^"]*+"`, `x "y" z`, []string{`"y"`}},
+}
+
+func TestMatch(t *testing.T) {
+	for _, tc := range matchTests {
+		tc := tc
+		t.Run(tc.pattern, func(t *testing.T) {
+			re, err := Compile(tc.pattern)
+			testutil.FatalIfErr(t, err)
+			got, err := re.FindStringSubmatch(tc.input)
+			testutil.FatalIfErr(t, err)
+			testutil.ExpectNoDiff(t, tc.expected, got)
+		})
+	}
+}
+
+// TestMatchLikeRegexp checks that patterns RE2 accepts match as they do in the
+// regexp package.
+func TestMatchLikeRegexp(t *testing.T) {
+	inputs := []string{"", "a", "abc", "aaa bbb", "foo=bar; baz=12", "x\ny\n", "ÀéÎ 123 ,.-", "2020-10-14T12:00:01Z"}
+	for _, tc := range matchTests {
+		want, err := regexp.Compile(tc.pattern)
+		if err != nil {
+			continue
+		}
+		re := MustCompile(tc.pattern)
+		for _, input := range append(inputs, tc.input) {
+			got, err := re.FindStringSubmatch(input)
+			testutil.FatalIfErr(t, err)
+			// RE2's $ only matches at the very end.
+			if strings.HasSuffix(input, "\n") && strings.Contains(tc.pattern, "$") {
+				continue
+			}
+			if diff := testutil.Diff(want.FindStringSubmatch(input), got); diff != "" {
+				t.Errorf("/%s/ on %q:\n%s", tc.pattern, input, diff)
+			}
+		}
+	}
+}
+
+// TestEmptyRepetition checks that a repetition stops after an empty match of
+// its group, keeping that match, as in Perl.  RE2 keeps the last nonempty
+// match instead.
+func TestEmptyRepetition(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, input string
+		expected       []string
+	}{
+		{`(a*)*b`, "b", []string{"b", ""}},
+		{`(a*)*b`, "ab", []string{"ab", ""}},
+		{`(a|)+c`, "aac", []string{"aac", ""}},
+		{`(a|){3,}c`, "c", []string{"c", ""}},
+	} {
+		got, err := MustCompile(tc.pattern).FindStringSubmatch(tc.input)
+		testutil.FatalIfErr(t, err)
+		if diff := testutil.Diff(tc.expected, got); diff != "" {
+			t.Errorf("/%s/ on %q:\n%s", tc.pattern, tc.input, diff)
+		}
+	}
+}
+
+func TestSubexps(t *testing.T) {
+	re := MustCompile(`(?P<a>\d+)(?:x)(b|(?'c'[cd]))(?<=d)`)
+	testutil.ExpectNoDiff(t, 3, re.NumSubexp())
+	testutil.ExpectNoDiff(t, []string{"", "a", "", "c"}, re.SubexpNames())
+	testutil.ExpectNoDiff(t, `\d+`, re.SubexpSource(1))
+	testutil.ExpectNoDiff(t, `b|(?'c'[cd])`, re.SubexpSource(2))
+	testutil.ExpectNoDiff(t, `[cd]`, re.SubexpSource(3))
+}
+
+var invalidTests = []struct {
+	pattern string
+	err     string
+}{
+	{`(a`, "error parsing regexp: missing closing ): `(a`"},
+	{`a)`, "error parsing regexp: unexpected ): `a)`"},
+	{`*a`, "error parsing regexp: missing argument to repetition operator: `*`"},
+	{`a**`, "error parsing regexp: invalid nested repetition operator: `**`"},
+	{`a{1001}`, "error parsing regexp: invalid repeat count: `{1001}`"},
+	{`a{3,2}`, "error parsing regexp: invalid repeat count: `{3,2}`"},
+	{`[a`, "error parsing regexp: missing closing ]: `[a`"},
+	{`(a)\2`, "error parsing regexp: invalid backreference: `\\2`"},
+	{`\k<x>(?P<y>a)`, "error parsing regexp: invalid backreference: `\\k<x>`"},
+	{`(?P<x>a)(?P<x>b)`, "error parsing regexp: invalid named capture: `(?P<x>`"},
+	{`(?<x-y>a)`, "error parsing regexp: invalid named capture: `(?<x-y>`"},
+	{`(?z)`, "error parsing regexp: invalid or unsupported flag: `(?z`"},
+	{`\pX`, "error parsing regexp: invalid character class range: `\\pX`"},
+	{`a\`, "error parsing regexp: trailing backslash at end of expression: ``"},
+}
+
+func TestCompileInvalid(t *testing.T) {
+	for _, tc := range invalidTests {
+		_, err := Compile(tc.pattern)
+		if err == nil {
+			t.Errorf("/%s/ compiled", tc.pattern)
+			continue
+		}
+		testutil.ExpectNoDiff(t, tc.err, err.Error())
+	}
+}
+
+func TestStepLimit(t *testing.T) {
+	re := MustCompile(`^(a|aa)+$`)
+	m, err := re.FindStringSubmatch(strings.Repeat("a", 100) + "b")
+	if err != ErrStepLimit {
+		t.Errorf("match of a pathological pattern didn't give up: %v, %q", err, m)
+	}
+}
+
+func TestSelected(t *testing.T) {
+	p, ok := Selected(Marker + `(\w)\1`)
+	if !ok || p != `(\w)\1` {
+		t.Errorf("Selected(marked) = %q, %v", p, ok)
+	}
+	if p, ok := Selected(`\w`); ok || p != `\w` {
+		t.Errorf("Selected(unmarked) = %q, %v", p, ok)
+	}
+}
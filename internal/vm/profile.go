@@ -0,0 +1,67 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"sort"
+	"time"
+)
+
+// ProfileEntry records the cost of executing the instructions generated from
+// one line of program source.
+type ProfileEntry struct {
+	SourceLine  int   // Line number in the program source.
+	Executions  int64 // Number of instructions executed that were generated from this line.
+	Nanoseconds int64 // Total time spent executing those instructions.
+}
+
+// profiler accumulates ProfileEntries, indexed by source line.
+type profiler struct {
+	entries map[int]*ProfileEntry
+}
+
+// EnableProfile instructs the VM to measure the time spent executing each
+// line of the program source.  Timing every instruction is expensive, so this
+// is only meant for benchmarking programs offline.  It must be called before
+// the VM processes any log lines.
+func (v *VM) EnableProfile() {
+	v.profiler = &profiler{entries: make(map[int]*ProfileEntry)}
+}
+
+// Profile returns the profile accumulated since EnableProfile, sorted by source line.
+func (v *VM) Profile() []ProfileEntry {
+	if v.profiler == nil {
+		return nil
+	}
+	r := make([]ProfileEntry, 0, len(v.profiler.entries))
+	for _, e := range v.profiler.entries {
+		r = append(r, *e)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].SourceLine < r[j].SourceLine })
+	return r
+}
+
+// processProfiledLogLine is the fetch-execute cycle of ProcessLogLine, timing
+// each instruction executed.
+func (v *VM) processProfiledLogLine(t *thread) {
+	for t.pc < len(v.prog) {
+		v.cover(t.pc)
+		i := v.prog[t.pc]
+		t.pc++
+		start := time.Now()
+		v.execute(t, i)
+		elapsed := time.Since(start)
+		e, ok := v.profiler.entries[i.SourceLine]
+		if !ok {
+			e = &ProfileEntry{SourceLine: i.SourceLine + 1}
+			v.profiler.entries[i.SourceLine] = e
+		}
+		e.Executions++
+		e.Nanoseconds += elapsed.Nanoseconds()
+		if v.terminate {
+			v.terminate = false
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+
+	"github.com/google/mtail/internal/logging"
+)
+
+var (
+	// progFilteredLogs counts the logs each program doesn't process, because
+	// their filename didn't pass the program's filters.
+	progFilteredLogs = expvar.NewMap("prog_filtered_logs_total")
+)
+
+// router remembers which programs process the lines of each log, so that the
+// programs' filename filters are matched once for each log rather than once
+// for each line.
+type router struct {
+	mu       sync.RWMutex
+	routes   map[string][]string            // the names of the programs that process each log, by filename
+	filtered map[string]map[string]struct{} // the names of the programs counted as not processing each log, by filename
+}
+
+// route returns the names of the programs in handles that process the lines
+// of the log filename.  The caller holds the loader's handle lock.
+func (r *router) route(filename string, handles map[string]*VM) []string {
+	r.mu.RLock()
+	progs, ok := r.routes[filename]
+	r.mu.RUnlock()
+	if ok {
+		return progs
+	}
+	progs = make([]string, 0, len(handles))
+	var filtered []string
+	for prog, v := range handles {
+		if !v.ProcessesLog(filename) {
+			filtered = append(filtered, prog)
+			continue
+		}
+		progs = append(progs, prog)
+	}
+	sort.Strings(progs)
+	logging.V(2).Infof("Log %s is for programs %v", filename, progs)
+	r.mu.Lock()
+	r.countFiltered(filename, filtered)
+	// Forget the logs seen so far rather than grow without bound when many
+	// logs come and go.
+	if r.routes == nil || len(r.routes) >= maxScopedLogs {
+		r.routes = make(map[string][]string)
+	}
+	r.routes[filename] = progs
+	r.mu.Unlock()
+	return progs
+}
+
+// countFiltered counts the log filename as not processed by the programs
+// filtered, unless it's been counted for them already.  The filtered logs
+// outlive the routes, so that a log isn't counted again each time the routes
+// are reset, but are forgotten in the same way when there are too many.  The
+// caller holds r.mu.
+func (r *router) countFiltered(filename string, filtered []string) {
+	if len(filtered) == 0 {
+		return
+	}
+	if r.filtered == nil || len(r.filtered) >= maxScopedLogs {
+		r.filtered = make(map[string]map[string]struct{})
+	}
+	counted, ok := r.filtered[filename]
+	if !ok {
+		counted = make(map[string]struct{})
+		r.filtered[filename] = counted
+	}
+	for _, prog := range filtered {
+		if _, ok := counted[prog]; ok {
+			continue
+		}
+		counted[prog] = struct{}{}
+		progFilteredLogs.Add(prog, 1)
+	}
+}
+
+// reset forgets the routes of every log, as the programs loaded have
+// changed.  The caller holds the loader's handle lock for writing.
+func (r *router) reset() {
+	r.mu.Lock()
+	r.routes = nil
+	r.mu.Unlock()
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"context"
+	"expvar"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestFilenameFilters(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("nginx.mtail", strings.NewReader("syntax = \"v2\"\nfilter filename =~ /nginx/\nfilter filename !~ /error/\ncounter nginx_lines\n/$/ {\n  nginx_lines++\n}\n")))
+	testutil.FatalIfErr(t, l.CompileAndRun("all.mtail", strings.NewReader("counter all_lines\n/$/ {\n  all_lines++\n}\n")))
+
+	filteredBefore := filteredCount("nginx.mtail")
+	for _, filename := range []string{"/var/log/nginx/access.log", "/var/log/nginx/error.log", "/var/log/syslog", "/var/log/nginx/access.log"} {
+		l.ProcessLogLine(ctx, logline.New(ctx, filename, "line"))
+	}
+
+	for name, expected := range map[string]string{"nginx_lines": "2", "all_lines": "4"} {
+		d, err := store.Metrics[name][0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		testutil.ExpectNoDiff(t, expected, d.ValueString())
+	}
+	// Each log is routed once, however many lines it has.
+	testutil.ExpectNoDiff(t, int64(2), filteredCount("nginx.mtail")-filteredBefore)
+
+	// Loading another program routes the logs again, but doesn't count them
+	// again.
+	testutil.FatalIfErr(t, l.CompileAndRun("other.mtail", strings.NewReader("counter other_lines\n/$/ {\n  other_lines++\n}\n")))
+	for _, filename := range []string{"/var/log/nginx/error.log", "/var/log/syslog"} {
+		l.ProcessLogLine(ctx, logline.New(ctx, filename, "line"))
+	}
+	testutil.ExpectNoDiff(t, int64(2), filteredCount("nginx.mtail")-filteredBefore)
+
+	// Reloading the program without the filter routes the logs again.
+	testutil.FatalIfErr(t, l.CompileAndRun("nginx.mtail", strings.NewReader("counter nginx_lines\n/$/ {\n  nginx_lines++\n}\n")))
+	l.ProcessLogLine(ctx, logline.New(ctx, "/var/log/syslog", "line"))
+	ms := store.Metrics["nginx_lines"]
+	d, err := ms[len(ms)-1].GetDatum()
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, "1", d.ValueString())
+}
+
+// filteredCount returns the number of logs filtered out for prog.
+func filteredCount(prog string) int64 {
+	if v, ok := progFilteredLogs.Get(prog).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"math/rand"
+	"strconv"
+
+	"github.com/google/mtail/internal/vm/object"
+)
+
+var (
+	// progSampleRates exports the rate of each sample statement, by program
+	// and source line, so that sampled metrics can be told apart.
+	progSampleRates = expvar.NewMap("prog_sample_rate")
+	// progSampleSkips counts the times a sample statement skipped its block,
+	// per program.
+	progSampleSkips = expvar.NewMap("prog_sample_skipped_total")
+)
+
+// sampler decides when the block of a sample statement runs.
+type sampler struct {
+	object.Sample
+	n int64 // The times the statement has been reached, in deterministic mode.
+}
+
+// take returns whether the block should run this time the statement is
+// reached.  In deterministic mode the first of every Rate times is taken.
+func (s *sampler) take() bool {
+	if s.Random {
+		return s.Rate <= 1 || rand.Int63n(s.Rate) == 0
+	}
+	ok := s.n%s.Rate == 0
+	s.n++
+	return ok
+}
+
+// newSamplers returns the samplers of the sample statements in a program,
+// and exports their rates.
+func newSamplers(name string, samples []object.Sample) []*sampler {
+	if len(samples) == 0 {
+		progSampleRates.Delete(name)
+		return nil
+	}
+	rates := new(expvar.Map).Init()
+	s := make([]*sampler, 0, len(samples))
+	for _, sample := range samples {
+		r := new(expvar.Int)
+		r.Set(sample.Rate)
+		rates.Set(strconv.Itoa(sample.Line+1), r)
+		s = append(s, &sampler{Sample: sample})
+	}
+	progSampleRates.Set(name, rates)
+	return s
+}
@@ -0,0 +1,21 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"time"
+)
+
+// progSandboxTimeouts counts the lines that sandboxed programs ran out of time
+// processing, per program.
+var progSandboxTimeouts = expvar.NewMap("prog_sandbox_timeouts_total")
+
+// SandboxLimits are the limits on the processing of each line by a program
+// run in the WebAssembly sandbox.  A program that passes one is stopped, and
+// the line reported as a runtime error.
+type SandboxLimits struct {
+	LineTimeout time.Duration // The longest a program may take on a line.
+	LineBytes   int           // The most bytes of strings a program may make from a line, like the captures it refers to.
+}
@@ -0,0 +1,252 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build go1.18
+// +build go1.18
+
+package vm
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/vm/flow"
+	"github.com/google/mtail/internal/vm/wasm"
+	"github.com/pkg/errors"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// errSandboxTerminated unwinds the WebAssembly module when the instruction the
+// host executed for it terminated the program on the line.
+var errSandboxTerminated = errors.New("program terminated")
+
+// sandbox runs a program compiled to WebAssembly by wazero, in place of the
+// interpreter.  The instructions that aren't compiled are executed by the VM
+// for the module, on the stack of the current thread.
+type sandbox struct {
+	v      *VM
+	limits SandboxLimits
+
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	module   api.Module   // The instance of the program, or nil once closed by running out of time, until the next line.
+	process  api.Function // The function of module that processes a line.
+
+	strs   []string      // The strings of the line being processed, by handle, starting with the program's constants.
+	datums []datum.Datum // The datums the line being processed loaded, by handle.
+	bytes  int           // The bytes of the strings the line being processed made.
+}
+
+// newSandbox compiles the program of v to WebAssembly, and instantiates it in
+// a sandbox of its own with the limits given.
+func newSandbox(v *VM, limits SandboxLimits) (*sandbox, error) {
+	bin, err := wasm.Compile(v.obj)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	s := &sandbox{
+		v:       v,
+		limits:  limits,
+		runtime: wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true)),
+	}
+	if err := s.load(ctx, bin); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load compiles the module bin, provides the host instructions it imports,
+// and instantiates it.
+func (s *sandbox) load(ctx context.Context, bin []byte) (err error) {
+	s.compiled, err = s.runtime.CompileModule(ctx, bin)
+	if err != nil {
+		return errors.Wrap(err, "invalid WebAssembly module")
+	}
+	host := s.runtime.NewHostModuleBuilder(wasm.ImportModule)
+	for _, f := range s.compiled.ImportedFunctions() {
+		_, name, _ := f.Import()
+		args, result, err := wasm.ParseImport(name)
+		if err != nil {
+			return err
+		}
+		host.NewFunctionBuilder().WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, _ api.Module, stack []uint64) {
+			s.exec(ctx, stack, args, result)
+		}), f.ParamTypes(), f.ResultTypes()).Export(name)
+	}
+	if _, err := host.Instantiate(ctx); err != nil {
+		return err
+	}
+	return s.instantiate(ctx)
+}
+
+// instantiate makes a new instance of the program.
+func (s *sandbox) instantiate(ctx context.Context) (err error) {
+	s.module, err = s.runtime.InstantiateModule(ctx, s.compiled, wazero.NewModuleConfig().WithName(s.v.name))
+	if err != nil {
+		return err
+	}
+	s.process = s.module.ExportedFunction(wasm.ProcessFunction)
+	return nil
+}
+
+// close frees the runtime and everything in it.
+func (s *sandbox) close() {
+	_ = s.runtime.Close(context.Background())
+}
+
+// processSandboxedLogLine runs the program on the input line in its sandbox,
+// in place of the fetch-execute cycle of ProcessLogLine.
+func (v *VM) processSandboxedLogLine(ctx context.Context) {
+	s := v.sandbox
+	s.strs = append(s.strs[:0], v.str...)
+	s.datums = s.datums[:0]
+	s.bytes = 0
+	defer func() {
+		v.terminate = false
+	}()
+	if s.module == nil {
+		if err := s.instantiate(ctx); err != nil {
+			v.errorf("sandbox: %s", err)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.limits.LineTimeout)
+	defer cancel()
+	_, err := s.process.Call(ctx)
+	switch {
+	case err == nil, errors.Is(err, errSandboxTerminated):
+		return
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		progSandboxTimeouts.Add(v.name, 1)
+		v.errorf("line not processed within the sandbox's limit of %s", s.limits.LineTimeout)
+	default:
+		v.errorf("sandbox: %s", err)
+	}
+	// A module that was stopped can't be called again.
+	var exit *sys.ExitError
+	if errors.As(err, &exit) || ctx.Err() != nil {
+		_ = s.module.Close(context.Background())
+		s.module = nil
+	}
+}
+
+// exec is the host instruction imported by the module: it executes the
+// instruction at the program counter first on stack, popping the values of
+// the kinds of args that follow, and returns the value of the kind result
+// that it pushes, if any, at the start of stack.
+func (s *sandbox) exec(ctx context.Context, stack []uint64, args []flow.Kind, result flow.Kind) {
+	v, t := s.v, s.v.t
+	if ctx.Err() != nil {
+		panic(ctx.Err())
+	}
+	pc := int(uint32(stack[0]))
+	if pc >= len(v.prog) {
+		v.errorf("sandbox: no instruction %d", pc)
+		panic(errSandboxTerminated)
+	}
+	t.pc = pc + 1
+	t.stack = t.stack[:0]
+	for i, k := range args {
+		val, err := s.value(k, stack[i+1])
+		if err != nil {
+			v.errorf("sandbox: %s", err)
+			panic(errSandboxTerminated)
+		}
+		t.Push(val)
+	}
+	v.execute(t, v.prog[pc])
+	if v.terminate {
+		panic(errSandboxTerminated)
+	}
+	if result == 0 {
+		return
+	}
+	if len(t.stack) == 0 {
+		v.errorf("sandbox: nothing pushed for a %q", result)
+		panic(errSandboxTerminated)
+	}
+	r, err := s.encode(result, t.Pop())
+	if err != nil {
+		v.errorf("sandbox: %s", err)
+		panic(errSandboxTerminated)
+	}
+	stack[0] = r
+}
+
+// value returns the value of kind k passed by the module as x.
+func (s *sandbox) value(k flow.Kind, x uint64) (interface{}, error) {
+	switch k {
+	case flow.Int:
+		return int64(x), nil
+	case flow.Float:
+		return api.DecodeF64(x), nil
+	case flow.Bool:
+		return uint32(x) != 0, nil
+	case flow.Index:
+		return int(int64(x)), nil
+	case flow.Duration:
+		return time.Duration(x), nil
+	}
+	h := int(uint32(x))
+	switch {
+	case k == flow.String && h < len(s.strs):
+		return s.strs[h], nil
+	case k == flow.Datum && h < len(s.datums):
+		return s.datums[h], nil
+	case k == flow.Metric && h < len(s.v.m):
+		return s.v.m[h], nil
+	}
+	return nil, errors.Errorf("invalid handle %d to a %q", h, k)
+}
+
+// encode returns the value val pushed by an instruction, of kind k, as it is
+// passed to the module, adding strings and datums to those of the line.
+func (s *sandbox) encode(k flow.Kind, val interface{}) (uint64, error) {
+	var x uint64
+	ok := false
+	switch k {
+	case flow.Int:
+		var n int64
+		n, ok = val.(int64)
+		x = uint64(n)
+	case flow.Float:
+		var f float64
+		f, ok = val.(float64)
+		x = api.EncodeF64(f)
+	case flow.Bool:
+		var b bool
+		b, ok = val.(bool)
+		if b {
+			x = 1
+		}
+	case flow.Index:
+		var n int
+		n, ok = val.(int)
+		x = uint64(int64(n))
+	case flow.String:
+		var str string
+		if str, ok = val.(string); ok {
+			s.bytes += len(str)
+			if s.bytes > s.limits.LineBytes {
+				return 0, errors.Errorf("line made more than the sandbox's limit of %d bytes of strings", s.limits.LineBytes)
+			}
+			x = uint64(len(s.strs))
+			s.strs = append(s.strs, str)
+		}
+	case flow.Datum:
+		var d datum.Datum
+		if d, ok = val.(datum.Datum); ok {
+			x = uint64(len(s.datums))
+			s.datums = append(s.datums, d)
+		}
+	}
+	if !ok {
+		return 0, errors.Errorf("a %T pushed for a %q", val, k)
+	}
+	return x, nil
+}
@@ -0,0 +1,25 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !go1.18
+// +build !go1.18
+
+package vm
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// sandbox is empty, as wazero needs Go 1.18.
+type sandbox struct{}
+
+// newSandbox returns an error, as wazero needs Go 1.18.
+func newSandbox(v *VM, limits SandboxLimits) (*sandbox, error) {
+	return nil, errors.New("programs can only be sandboxed by an mtail built with Go 1.18 or later")
+}
+
+func (v *VM) processSandboxedLogLine(ctx context.Context) {}
+
+func (s *sandbox) close() {}
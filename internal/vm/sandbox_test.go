@@ -0,0 +1,112 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build go1.18
+// +build go1.18
+
+package vm
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+var testSandboxLimits = SandboxLimits{LineTimeout: time.Minute, LineBytes: 1 << 20}
+
+func TestSandboxEndToEnd(t *testing.T) {
+	for _, tc := range vmTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			store := metrics.NewStore()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			l, err := NewLoader(ctx, "", store, ErrorsAbort(), OmitMetricSource(), Sandbox(testSandboxLimits))
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, l.CompileAndRun(tc.name, strings.NewReader(tc.prog)))
+			errorsBefore := runtimeErrorCount(tc.name)
+			scanner := bufio.NewScanner(strings.NewReader(tc.log))
+			for scanner.Scan() {
+				l.ProcessLogLine(ctx, logline.New(ctx, tc.name, scanner.Text()))
+			}
+			l.Close()
+
+			testutil.ExpectNoDiff(t, int64(0), runtimeErrorCount(tc.name)-errorsBefore)
+			testutil.ExpectNoDiff(t, tc.metrics, store.Metrics, testutil.IgnoreUnexported(sync.RWMutex{}), testutil.IgnoreFields(datum.BaseDatum{}, "Time"))
+		})
+	}
+}
+
+func TestSandboxLimits(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store, Sandbox(SandboxLimits{LineTimeout: time.Minute, LineBytes: 8}))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("limits", strings.NewReader(`counter lines
+text last
+/^(\S+)$/ {
+  lines++
+  last = $1
+}
+`)))
+	v := l.handles["limits"]
+	process := func(line string) {
+		l.ProcessLogLine(ctx, logline.New(ctx, "limits.log", line))
+	}
+	value := func(name string) string {
+		d, err := store.Metrics[name][0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		return d.ValueString()
+	}
+
+	process("short")
+	testutil.ExpectNoDiff(t, "short", value("last"))
+
+	// The string referring to the capture is longer than the limit.
+	errorsBefore := runtimeErrorCount("limits")
+	process("far_too_long")
+	testutil.ExpectNoDiff(t, int64(1), runtimeErrorCount("limits")-errorsBefore)
+	testutil.ExpectNoDiff(t, "short", value("last"))
+	testutil.ExpectNoDiff(t, "2", value("lines"))
+
+	timeoutsBefore := sandboxTimeoutCount("limits")
+	v.sandbox.limits.LineTimeout = time.Nanosecond
+	process("late")
+	testutil.ExpectNoDiff(t, int64(1), sandboxTimeoutCount("limits")-timeoutsBefore)
+	testutil.ExpectNoDiff(t, "2", value("lines"))
+
+	// The program stopped by the timeout is instantiated again.
+	v.sandbox.limits.LineTimeout = time.Minute
+	process("again")
+	testutil.ExpectNoDiff(t, "again", value("last"))
+	testutil.ExpectNoDiff(t, "3", value("lines"))
+	l.Close()
+}
+
+func TestSandboxLoadErrors(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := NewLoader(ctx, "", store, Sandbox(SandboxLimits{})); err == nil {
+		t.Error("expected an error for zero limits")
+	}
+}
+
+// sandboxTimeoutCount returns the number of lines prog ran out of time on.
+func sandboxTimeoutCount(prog string) int64 {
+	if v, ok := progSandboxTimeouts.Get(prog).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
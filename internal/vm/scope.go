@@ -0,0 +1,106 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/pkg/errors"
+)
+
+var (
+	// progScopedLines counts the lines given to each program bound to log
+	// patterns.
+	progScopedLines = expvar.NewMap("prog_scoped_lines_total")
+	// progScopedLinesSkipped counts the lines not given to each program bound
+	// to log patterns, because their log matched none of them.
+	progScopedLinesSkipped = expvar.NewMap("prog_scoped_lines_skipped_total")
+)
+
+// maxScopedLogs limits how many logs the bound programs are remembered for.
+const maxScopedLogs = 10000
+
+// ProgramLogPatterns binds programs, by name, to the glob patterns of the logs
+// they process.  Programs not bound process the lines of every log.
+func ProgramLogPatterns(patterns map[string][]string) Option {
+	return func(l *Loader) error {
+		s := &scopes{patterns: make(map[string][]string, len(patterns))}
+		for prog, ps := range patterns {
+			for _, p := range ps {
+				abs, err := filepath.Abs(p)
+				if err != nil {
+					return err
+				}
+				if _, err := filepath.Match(abs, ""); err != nil {
+					return errors.Wrapf(err, "log pattern %q for program %s", p, prog)
+				}
+				s.patterns[prog] = append(s.patterns[prog], abs)
+			}
+		}
+		l.scopes = s
+		return nil
+	}
+}
+
+// scopes holds the log patterns that programs are bound to.
+type scopes struct {
+	patterns map[string][]string // absolute glob patterns of each bound program
+
+	mu      sync.RWMutex
+	matches map[string]map[string]bool // the bound programs each log is for, by filename
+}
+
+// inScope returns whether the program prog processes the lines of the log
+// filename.
+func (s *scopes) inScope(prog, filename string) bool {
+	if s == nil {
+		return true
+	}
+	if _, ok := s.patterns[prog]; !ok {
+		return true
+	}
+	s.mu.RLock()
+	m, ok := s.matches[filename]
+	s.mu.RUnlock()
+	if !ok {
+		m = s.match(filename)
+	}
+	if m[prog] {
+		progScopedLines.Add(prog, 1)
+		return true
+	}
+	progScopedLinesSkipped.Add(prog, 1)
+	return false
+}
+
+// match finds and remembers the bound programs whose patterns match filename.
+func (s *scopes) match(filename string) map[string]bool {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		abs = filename
+	}
+	m := make(map[string]bool)
+	for prog, patterns := range s.patterns {
+		for _, p := range patterns {
+			// Patterns were checked when bound, so can't be malformed.
+			if ok, _ := filepath.Match(p, abs); ok {
+				m[prog] = true
+				break
+			}
+		}
+	}
+	logging.V(2).Infof("Log %s is for bound programs %v", filename, m)
+	s.mu.Lock()
+	// Forget the logs seen so far rather than grow without bound when many
+	// logs come and go.
+	if s.matches == nil || len(s.matches) >= maxScopedLogs {
+		s.matches = make(map[string]map[string]bool)
+	}
+	s.matches[filename] = m
+	s.mu.Unlock()
+	return m
+}
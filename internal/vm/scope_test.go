@@ -0,0 +1,56 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"context"
+	"expvar"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestProgramLogPatterns(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store, ProgramLogPatterns(map[string][]string{
+		"apache.mtail": {"/var/log/apache2/*.log", "/var/log/httpd.log"},
+	}))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("apache.mtail", strings.NewReader("counter apache_lines\n/$/ {\n  apache_lines++\n}\n")))
+	testutil.FatalIfErr(t, l.CompileAndRun("all.mtail", strings.NewReader("counter all_lines\n/$/ {\n  all_lines++\n}\n")))
+
+	skippedBefore := skippedCount("apache.mtail")
+	for _, filename := range []string{"/var/log/apache2/access.log", "/var/log/httpd.log", "/var/log/syslog", "/var/log/apache2/access.log"} {
+		l.ProcessLogLine(ctx, logline.New(ctx, filename, "line"))
+	}
+
+	for name, expected := range map[string]string{"apache_lines": "3", "all_lines": "4"} {
+		d, err := store.Metrics[name][0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		testutil.ExpectNoDiff(t, expected, d.ValueString())
+	}
+	testutil.ExpectNoDiff(t, int64(1), skippedCount("apache.mtail")-skippedBefore)
+}
+
+// skippedCount returns the number of lines skipped for prog.
+func skippedCount(prog string) int64 {
+	if v, ok := progScopedLinesSkipped.Get(prog).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestProgramLogPatternsErrors(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := NewLoader(ctx, "", store, ProgramLogPatterns(map[string][]string{"apache.mtail": {"/var/log/[.log"}})); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits are the multipliers of the size unit prefixes, in order of size.
+var sizeUnits = []string{"k", "m", "g", "t", "p", "e"}
+
+// parseSize returns the number of bytes in s, for the parsesize builtin.  s
+// is a number, optionally followed by a unit like "KB" or "GiB".  Units with
+// an "i" are binary, multiples of 1024, and those without are decimal,
+// multiples of 1000.  The case of the unit is ignored, and the "B" may be
+// left out.
+func parseSize(s string) (float64, error) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= '0' && r <= '9' || r == '.')
+	})
+	if i == -1 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsesize: invalid size %q", s)
+	}
+	unit := strings.ToLower(strings.TrimSpace(s[i:]))
+	unit = strings.TrimSuffix(unit, "b")
+	if unit == "" {
+		return n, nil
+	}
+	base := 1000.0
+	if strings.HasSuffix(unit, "i") {
+		base = 1024
+		unit = strings.TrimSuffix(unit, "i")
+	}
+	for p, u := range sizeUnits {
+		if unit == u {
+			for ; p >= 0; p-- {
+				n *= base
+			}
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("parsesize: unknown unit in size %q", s)
+}
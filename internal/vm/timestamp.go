@@ -0,0 +1,95 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// progTimestampsClamped counts metric updates whose timestamp was out of
+	// bounds and replaced with the current time, per program.
+	progTimestampsClamped = expvar.NewMap("prog_timestamps_clamped_total")
+	// progTimestampsDropped counts metric updates discarded because their
+	// timestamp was out of bounds, per program.
+	progTimestampsDropped = expvar.NewMap("prog_timestamps_dropped_total")
+)
+
+// TimestampPolicy says what a program does with a metric update whose
+// timestamp, as set by strptime or settime, is too far in the future or past.
+type TimestampPolicy int
+
+const (
+	// AcceptTimestamps keeps the update at its timestamp.
+	AcceptTimestamps TimestampPolicy = iota
+	// ClampTimestamps makes the update at the current time instead.
+	ClampTimestamps
+	// DropTimestamps discards the update.
+	DropTimestamps
+)
+
+var timestampPolicyNames = map[TimestampPolicy]string{
+	AcceptTimestamps: "accept",
+	ClampTimestamps:  "clamp",
+	DropTimestamps:   "drop",
+}
+
+func (p TimestampPolicy) String() string {
+	return timestampPolicyNames[p]
+}
+
+// ParseTimestampPolicy returns the policy named by s, one of "accept",
+// "clamp", or "drop".
+func ParseTimestampPolicy(s string) (TimestampPolicy, error) {
+	for p, name := range timestampPolicyNames {
+		if s == name {
+			return p, nil
+		}
+	}
+	return AcceptTimestamps, errors.Errorf("unknown timestamp policy %q, expecting accept, clamp, or drop", s)
+}
+
+// timestampBounds applies a TimestampPolicy to timestamps more than maxFuture
+// ahead of or maxAge behind the current time.  A zero bound is not checked.
+type timestampBounds struct {
+	policy    TimestampPolicy
+	maxFuture time.Duration
+	maxAge    time.Duration
+}
+
+// inBounds reports whether ts is within the bounds at now.
+func (b timestampBounds) inBounds(ts, now time.Time) bool {
+	if b.maxFuture > 0 && ts.After(now.Add(b.maxFuture)) {
+		return false
+	}
+	if b.maxAge > 0 && ts.Before(now.Add(-b.maxAge)) {
+		return false
+	}
+	return true
+}
+
+// updateTime returns the timestamp for a metric update made by the thread,
+// and false if the update should be dropped.
+func (v *VM) updateTime(t *thread) (time.Time, bool) {
+	if t.time.IsZero() {
+		// Without a timestamp from the log, the update is made now.
+		return v.clock.Now(), true
+	}
+	if v.timestampBounds.policy == AcceptTimestamps {
+		return t.time, true
+	}
+	now := v.clock.Now()
+	if v.timestampBounds.inBounds(t.time, now) {
+		return t.time, true
+	}
+	if v.timestampBounds.policy == DropTimestamps {
+		progTimestampsDropped.Add(v.name, 1)
+		return t.time, false
+	}
+	progTimestampsClamped.Add(v.name, 1)
+	return now, true
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/vm/code"
+)
+
+// maxTraceLines limits the number of lines that can be traced in one request,
+// as each traced line records every instruction executed.
+const maxTraceLines = 100
+
+// TraceStep records the execution of a single instruction.
+type TraceStep struct {
+	PC         int      `json:"pc"`
+	Opcode     string   `json:"opcode"`
+	Operand    string   `json:"operand,omitempty"`
+	SourceLine int      `json:"source_line"`
+	Stack      []string `json:"stack"` // Stack contents after the instruction executed, bottom first.
+	Matched    bool     `json:"matched"`
+	Terminate  bool     `json:"terminate,omitempty"`
+}
+
+// LineTrace records the execution of the program over one line of input.
+type LineTrace struct {
+	Filename     string      `json:"filename"`
+	Line         string      `json:"line"`
+	Steps        []TraceStep `json:"steps"`
+	RuntimeError string      `json:"runtime_error,omitempty"`
+}
+
+// Trace is the result of tracing a program.
+type Trace struct {
+	Program   string       `json:"program"`
+	Remaining int          `json:"remaining"` // Number of lines still to be traced.
+	Lines     []*LineTrace `json:"lines"`
+}
+
+// tracer holds the trace state of a VM.
+type tracer struct {
+	remaining int32 // Number of lines left to trace, accessed atomically so the untraced path doesn't take a lock.
+
+	mu    sync.Mutex
+	lines []*LineTrace
+}
+
+// StartTrace instructs the VM to record the execution of the next n lines of
+// input, discarding any previous trace.
+func (v *VM) StartTrace(n int) {
+	v.tracer.mu.Lock()
+	defer v.tracer.mu.Unlock()
+	v.tracer.lines = nil
+	atomic.StoreInt32(&v.tracer.remaining, int32(n))
+}
+
+// Trace returns the execution trace recorded since the last StartTrace.
+func (v *VM) Trace() *Trace {
+	v.tracer.mu.Lock()
+	defer v.tracer.mu.Unlock()
+	lines := make([]*LineTrace, len(v.tracer.lines))
+	copy(lines, v.tracer.lines)
+	return &Trace{
+		Program:   v.name,
+		Remaining: int(atomic.LoadInt32(&v.tracer.remaining)),
+		Lines:     lines,
+	}
+}
+
+// tracing returns true if this line of input should be traced, and consumes
+// one line from the trace budget.
+func (v *VM) tracing() bool {
+	for {
+		n := atomic.LoadInt32(&v.tracer.remaining)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&v.tracer.remaining, n, n-1) {
+			return true
+		}
+	}
+}
+
+// traceStep records the state of thread t after executing instruction i at pc.
+func (v *VM) traceStep(lt *LineTrace, t *thread, pc int, i code.Instr) {
+	s := TraceStep{
+		PC:         pc,
+		Opcode:     i.Opcode.String(),
+		SourceLine: i.SourceLine + 1,
+		Stack:      make([]string, 0, len(t.stack)),
+		Matched:    t.matched,
+		Terminate:  v.terminate,
+	}
+	if i.Operand != nil {
+		s.Operand = fmt.Sprintf("%v", i.Operand)
+	}
+	for _, e := range t.stack {
+		s.Stack = append(s.Stack, traceValue(e))
+	}
+	lt.Steps = append(lt.Steps, s)
+}
+
+// processTracedLogLine is the fetch-execute cycle of ProcessLogLine, recording
+// each instruction executed in a LineTrace.
+func (v *VM) processTracedLogLine(t *thread, line *logline.LogLine) {
+	lt := &LineTrace{Filename: line.Filename, Line: line.Line}
+	defer v.finishTrace(lt)
+	v.runtimeErrorMu.RLock()
+	lastError := v.runtimeError
+	v.runtimeErrorMu.RUnlock()
+	for t.pc < len(v.prog) {
+		pc := t.pc
+		v.cover(pc)
+		i := v.prog[t.pc]
+		t.pc++
+		v.execute(t, i)
+		v.traceStep(lt, t, pc, i)
+		if v.terminate {
+			v.terminate = false
+			break
+		}
+	}
+	v.runtimeErrorMu.RLock()
+	if v.runtimeError != lastError {
+		lt.RuntimeError = v.runtimeError
+	}
+	v.runtimeErrorMu.RUnlock()
+}
+
+// finishTrace stores a completed line trace.
+func (v *VM) finishTrace(lt *LineTrace) {
+	v.tracer.mu.Lock()
+	defer v.tracer.mu.Unlock()
+	v.tracer.lines = append(v.tracer.lines, lt)
+}
+
+// traceValue formats a stack value for the trace.
+func traceValue(e interface{}) string {
+	switch e := e.(type) {
+	case *metrics.Metric:
+		return "metric " + e.Name
+	case datum.Datum:
+		return "datum " + e.ValueString()
+	case string:
+		return strconv.Quote(e)
+	default:
+		return fmt.Sprintf("%v", e)
+	}
+}
+
+// TraceHandler handles requests to trace the execution of a program.  A POST
+// with the `prog` and `lines` parameters starts tracing the next `lines` lines
+// processed by the program, and a GET returns the trace recorded so far as
+// JSON.
+func (l *Loader) TraceHandler(w http.ResponseWriter, r *http.Request) {
+	prog := r.URL.Query().Get("prog")
+	if prog == "" {
+		http.Error(w, "No program specified, try adding ?prog=name", http.StatusBadRequest)
+		return
+	}
+	l.handleMu.RLock()
+	v, ok := l.handles[prog]
+	l.handleMu.RUnlock()
+	if !ok {
+		http.Error(w, "No program found", http.StatusNotFound)
+		return
+	}
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodPost:
+		n := 1
+		if s := r.URL.Query().Get("lines"); s != "" {
+			var err error
+			n, err = strconv.Atoi(s)
+			if err != nil || n < 1 || n > maxTraceLines {
+				http.Error(w, fmt.Sprintf("lines must be a number from 1 to %d", maxTraceLines), http.StatusBadRequest)
+				return
+			}
+		}
+		logging.Infof("Tracing the next %d lines of program %s", n, prog)
+		v.StartTrace(n)
+		status = http.StatusAccepted
+	case http.MethodGet:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := json.MarshalIndent(v.Trace(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(b); err != nil {
+		logging.Warning(err)
+	}
+}
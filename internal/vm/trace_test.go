@@ -0,0 +1,86 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestTraceHandler(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("trace", strings.NewReader("counter a\n/(\\d+)/ {\n  a += $1\n}\n")))
+
+	rec := httptest.NewRecorder()
+	l.TraceHandler(rec, httptest.NewRequest(http.MethodPost, "/progz/trace?prog=trace&lines=1", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("start trace: expected status %d, received %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+	}
+
+	l.ProcessLogLine(ctx, logline.New(ctx, "log", "12"))
+	l.ProcessLogLine(ctx, logline.New(ctx, "log", "34"))
+
+	rec = httptest.NewRecorder()
+	l.TraceHandler(rec, httptest.NewRequest(http.MethodGet, "/progz/trace?prog=trace", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get trace: expected status %d, received %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	var tr Trace
+	testutil.FatalIfErr(t, json.Unmarshal(rec.Body.Bytes(), &tr))
+	if tr.Remaining != 0 {
+		t.Errorf("expected no remaining lines, received %d", tr.Remaining)
+	}
+	if len(tr.Lines) != 1 {
+		t.Fatalf("expected one traced line, received %d", len(tr.Lines))
+	}
+	if tr.Lines[0].Line != "12" {
+		t.Errorf("expected first line to be traced, received %q", tr.Lines[0].Line)
+	}
+	steps := tr.Lines[0].Steps
+	if len(steps) != len(l.handles["trace"].prog) {
+		t.Errorf("expected a step for each instruction, received %d steps: %v", len(steps), steps)
+	}
+	if steps[0].Opcode != "match" || len(steps[0].Stack) != 1 || steps[0].Stack[0] != "true" {
+		t.Errorf("unexpected first step: %+v", steps[0])
+	}
+}
+
+func TestTraceHandlerErrors(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("trace", strings.NewReader("/x/ {}\n")))
+
+	for _, tc := range []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{http.MethodGet, "/progz/trace", http.StatusBadRequest},
+		{http.MethodGet, "/progz/trace?prog=nope", http.StatusNotFound},
+		{http.MethodPost, "/progz/trace?prog=trace&lines=0", http.StatusBadRequest},
+		{http.MethodPost, "/progz/trace?prog=trace&lines=x", http.StatusBadRequest},
+		{http.MethodDelete, "/progz/trace?prog=trace", http.StatusMethodNotAllowed},
+	} {
+		rec := httptest.NewRecorder()
+		l.TraceHandler(rec, httptest.NewRequest(tc.method, tc.url, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%s %s: expected status %d, received %d", tc.method, tc.url, tc.code, rec.Code)
+		}
+	}
+}
@@ -9,7 +9,7 @@ import (
 	"strings"
 	"sync"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
 )
 
 // Type represents a type in the mtail program.
@@ -198,17 +198,42 @@ var (
 
 // Builtins is a mapping of the builtin language functions to their type definitions.
 var Builtins = map[string]Type{
-	"int":         Function(NewVariable(), Int),
-	"bool":        Function(NewVariable(), Bool),
-	"float":       Function(NewVariable(), Float),
-	"string":      Function(NewVariable(), String),
-	"timestamp":   Function(Int),
-	"len":         Function(String, Int),
-	"settime":     Function(Int, None),
-	"strptime":    Function(String, String, None),
-	"strtol":      Function(String, Int, Int),
-	"tolower":     Function(String, String),
-	"getfilename": Function(String),
+	"alert":         Function(String, None),
+	"exec":          Function(String, None), // and any number of String arguments after
+	"int":           Function(NewVariable(), Int),
+	"bool":          Function(NewVariable(), Bool),
+	"float":         Function(NewVariable(), Float),
+	"string":        Function(NewVariable(), String),
+	"timestamp":     Function(Int),
+	"len":           Function(String, Int),
+	"parseint":      Function(String, Int),
+	"parsefloat":    Function(String, Float),
+	"parsedur":      Function(String, Float),
+	"parsesize":     Function(String, Float),
+	"settime":       Function(Int, None),
+	"strptime":      Function(String, String, None),
+	"strtol":        Function(String, Int, Int),
+	"tolower":       Function(String, String),
+	"urlhost":       Function(String, String),
+	"urlpath":       Function(String, String),
+	"urlquery":      Function(String, String, String),
+	"normpath":      Function(String, String),
+	"cef":           Function(String, String, String),
+	"leef":          Function(String, String, String),
+	"w3c":           Function(String, String),
+	"csv":           Function(String, String),
+	"csvcol":        Function(Int, String),
+	"field":         Function(String, String),
+	"uaclass":       Function(String, String),
+	"sha256":        Function(String, String),
+	"hmac":          Function(String, String),
+	"redact":        Function(String, String),
+	"geoip_country": Function(String, String),
+	"geoip_asn":     Function(String, Int),
+	"getfilename":   Function(String),
+	"getingesttime": Function(Int),
+	"getlinenumber": Function(Int),
+	"getlineoffset": Function(Int),
 }
 
 // FreshType returns a new type from the provided type scheme, replacing any
@@ -232,7 +257,7 @@ func FreshType(t Type) Type {
 			}
 			return &Operator{p1.Name, args}
 		default:
-			glog.V(1).Infof("Unexpected type p1: %v", p1)
+			logging.V(1).Infof("Unexpected type p1: %v", p1)
 		}
 		return tp
 	}
@@ -277,7 +302,7 @@ func (e *TypeError) Error() string {
 	} else {
 		rstr = "incomplete type"
 	}
-	glog.V(2).Infof("type mismatch: expected %q received %q", e.expected, e.received)
+	logging.V(2).Infof("type mismatch: expected %q received %q", e.expected, e.received)
 	return fmt.Sprintf("type mismatch; expected %s received %s", estr, rstr)
 }
 
@@ -287,14 +312,14 @@ func (e *TypeError) Error() string {
 // variable is unified with the LUB.  In reporting errors, it is assumed that a
 // is the expected type and b is the type observed.
 func Unify(a, b Type) error {
-	glog.V(2).Infof("Unifying %v and %v", a, b)
+	logging.V(2).Infof("Unifying %v and %v", a, b)
 	a1, b1 := a.Root(), b.Root()
 	switch a2 := a1.(type) {
 	case *Variable:
 		switch b2 := b1.(type) {
 		case *Variable:
 			if a2.ID != b2.ID {
-				glog.V(2).Infof("Making %q type %q", a2, b1)
+				logging.V(2).Infof("Making %q type %q", a2, b1)
 				a2.SetInstance(&b1)
 				return nil
 			}
@@ -302,7 +327,7 @@ func Unify(a, b Type) error {
 			if occursInType(a2, b2) {
 				return fmt.Errorf("recursive unification on %v and %v", a2, b2)
 			}
-			glog.V(2).Infof("Making %q type %q", a2, b1)
+			logging.V(2).Infof("Making %q type %q", a2, b1)
 			a2.SetInstance(&b1)
 			return nil
 		}
@@ -324,7 +349,7 @@ func Unify(a, b Type) error {
 			}
 			if a2.Name != b2.Name {
 				t := LeastUpperBound(a, b)
-				glog.V(2).Infof("Got LUB = %q", t)
+				logging.V(2).Infof("Got LUB = %q", t)
 				if t == Error {
 					return &TypeError{a2, b2}
 				}
@@ -350,7 +375,7 @@ func Unify(a, b Type) error {
 // LeastUpperBound returns the smallest type that may contain both parameter types.
 func LeastUpperBound(a, b Type) Type {
 	a1, b1 := a.Root(), b.Root()
-	glog.V(2).Infof("Computing LUB(%q, %q)", a1, b1)
+	logging.V(2).Infof("Computing LUB(%q, %q)", a1, b1)
 
 	if Equals(a1, b1) {
 		return a1
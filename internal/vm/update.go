@@ -0,0 +1,49 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+)
+
+// Update describes a change made by a program to one of its metrics.
+type Update struct {
+	Program string          // The program that made the change.
+	Metric  *metrics.Metric // The metric changed.
+	Labels  []string        // The label values of the datum changed, in the order of Metric.Keys.
+	Datum   datum.Datum     // The datum changed, holding its new value.
+}
+
+// OnUpdate sets a function called with each change programs make to their
+// metrics.  It is called synchronously by the program making the change, so it
+// must not block or modify the metric.
+func OnUpdate(f func(Update)) Option {
+	return func(l *Loader) error {
+		l.onUpdate = f
+		return nil
+	}
+}
+
+// dload records a datum loaded by the thread and where it was loaded from, so
+// that updates to it can be described.
+type dload struct {
+	d    datum.Datum
+	m    *metrics.Metric
+	keys []string
+}
+
+// notify calls the update function with the change just made to datum d.
+func (v *VM) notify(t *thread, d datum.Datum) {
+	if v.onUpdate == nil {
+		return
+	}
+	// The datum updated is almost always the one most recently loaded.
+	for i := len(t.dloads) - 1; i >= 0; i-- {
+		if t.dloads[i].d == d {
+			v.onUpdate(Update{Program: v.name, Metric: t.dloads[i].m, Labels: t.dloads[i].keys, Datum: d})
+			return
+		}
+	}
+}
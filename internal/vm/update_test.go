@@ -0,0 +1,74 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestOnUpdate(t *testing.T) {
+	type update struct {
+		Metric string
+		Labels []string
+		Value  string
+	}
+	var got []update
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store, OnUpdate(func(u Update) {
+		got = append(got, update{u.Metric.Name, u.Labels, u.Datum.ValueString()})
+	}))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("test.mtail", strings.NewReader(`counter requests by code
+gauge size
+text last
+/(\d+) (\d+) (\w+)/ {
+  requests[$1]++
+  size = $2
+  last = $3
+}
+`)))
+
+	l.ProcessLogLine(ctx, logline.New(ctx, "log", "200 12 foo"))
+	l.ProcessLogLine(ctx, logline.New(ctx, "log", "no match"))
+	l.ProcessLogLine(ctx, logline.New(ctx, "log", "404 4 bar"))
+
+	expected := []update{
+		{"requests", []string{"200"}, "1"},
+		{"size", []string{}, "12"},
+		{"last", []string{}, "foo"},
+		{"requests", []string{"404"}, "1"},
+		{"size", []string{}, "4"},
+		{"last", []string{}, "bar"},
+	}
+	testutil.ExpectNoDiff(t, expected, got)
+}
+
+func TestOnUpdateHistogram(t *testing.T) {
+	var got []datum.Datum
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := NewLoader(ctx, "", store, OnUpdate(func(u Update) {
+		got = append(got, u.Datum)
+	}))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("test.mtail", strings.NewReader("histogram latency buckets 1, 2, 4\n/(\\d+)/ {\n  latency = $1\n}\n")))
+
+	l.ProcessLogLine(ctx, logline.New(ctx, "log", "3"))
+
+	if len(got) != 1 {
+		t.Fatalf("expected one update, got %v", got)
+	}
+	testutil.ExpectNoDiff(t, uint64(1), datum.GetBucketsCount(got[0]))
+	testutil.ExpectNoDiff(t, 3.0, datum.GetBucketsSum(got[0]))
+}
@@ -0,0 +1,29 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"regexp"
+	"strings"
+)
+
+// idPlaceholder replaces the path segments that normalizePath treats as IDs.
+const idPlaceholder = ":id"
+
+// idSegment matches a path segment that is a number, a UUID, or a long hex
+// string like a hash.
+var idSegment = regexp.MustCompile(`^(?:[0-9]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})$`)
+
+// normalizePath returns the URL path p with each segment that looks like an
+// ID replaced by ":id", for the normpath builtin, so that the paths of
+// requests for different objects become one label value.
+func normalizePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		if idSegment.MatchString(s) {
+			segments[i] = idPlaceholder
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+)
+
+// The classes of client returned by the uaclass builtin.
+const (
+	uaBot     = "bot"
+	uaMobile  = "mobile"
+	uaBrowser = "browser"
+	uaOther   = "other"
+)
+
+// uaSignatures are the lowercase substrings of user agents that identify the
+// class of client, in the order they are tried.  Bots come first, as crawlers
+// often claim to be browsers, and mobile before browser as every mobile
+// browser's user agent is also a browser's.
+var uaSignatures = []struct {
+	substr string
+	class  string
+}{
+	{"bot", uaBot},
+	{"crawler", uaBot},
+	{"spider", uaBot},
+	{"slurp", uaBot},
+	{"facebookexternalhit", uaBot},
+	{"headlesschrome", uaBot},
+	{"curl/", uaBot},
+	{"wget/", uaBot},
+	{"python-requests", uaBot},
+	{"go-http-client", uaBot},
+	{"java/", uaBot},
+	{"mobile", uaMobile},
+	{"android", uaMobile},
+	{"iphone", uaMobile},
+	{"ipad", uaMobile},
+	{"ipod", uaMobile},
+	{"windows phone", uaMobile},
+	{"blackberry", uaMobile},
+	{"opera mini", uaMobile},
+	{"mozilla/", uaBrowser},
+	{"opera/", uaBrowser},
+}
+
+// classifyUserAgent returns the class of client that sent the user agent ua,
+// for the uaclass builtin: "bot" for crawlers and scripts, "mobile" for
+// browsers on phones and tablets, "browser" for other browsers, and "other"
+// for anything unrecognised.
+func classifyUserAgent(ua string) string {
+	ua = strings.ToLower(ua)
+	for _, s := range uaSignatures {
+		if strings.Contains(ua, s.substr) {
+			return s.class
+		}
+	}
+	return uaOther
+}
@@ -11,21 +11,31 @@ import (
 	"flag"
 	"fmt"
 	"math"
+	"net"
+	"net/url"
 	"regexp"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/tabwriter"
 	"time"
 
-	"github.com/golang/glog"
 	"github.com/golang/groupcache/lru"
+	"github.com/google/mtail/internal/action"
+	"github.com/google/mtail/internal/alert"
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/geoip"
+	"github.com/google/mtail/internal/logging"
 	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/vm/ast"
 	"github.com/google/mtail/internal/vm/code"
+	"github.com/google/mtail/internal/vm/codegen"
 	"github.com/google/mtail/internal/vm/object"
+	"github.com/google/mtail/internal/vm/pcre"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -38,8 +48,18 @@ var (
 		Help:      "VM line processing time distribution in seconds.",
 		Buckets:   prometheus.ExponentialBuckets(0.00002, 2.0, 10),
 	}, []string{"prog"})
+	lineLatencies = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mtail",
+		Subsystem: "vm",
+		Name:      "line_latency_seconds",
+		Help:      "Time from a line being written to the log, or if that's not known read from it, to the end of its VM processing, in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2.0, 16),
+	}, []string{"prog"})
 
 	runtimeLogError = flag.Bool("vm_logs_runtime_errors", true, "Enables logging of runtime errors to the standard log.  Set to false to only have the errors printed to the HTTP console.")
+
+	runtimeErrorLogRate  = flag.Float64("vm_runtime_error_log_rate", 1, "Runtime errors logged per second from each instruction of a program, after a burst of --vm_runtime_error_log_burst; the rest are counted and summarised by the next one logged.  Zero or less logs every error.")
+	runtimeErrorLogBurst = flag.Int("vm_runtime_error_log_burst", 10, "Runtime errors logged at once from each instruction of a program before --vm_runtime_error_log_rate applies.")
 )
 
 type thread struct {
@@ -48,6 +68,8 @@ type thread struct {
 	matches map[int][]string // Match result variables.
 	time    time.Time        // Time register.
 	stack   []interface{}    // Data stack.
+
+	dloads []dload // The datums loaded, if updates are being notified.
 }
 
 // VM describes the virtual machine for each program.  It contains virtual
@@ -55,15 +77,33 @@ type thread struct {
 // expressions), mutable state (metrics), and a stack for the current thread of
 // execution.
 type VM struct {
+	lastMatch int64 // When a line last matched one of the program's patterns, in nanoseconds since the epoch; accessed atomically, so first for 64-bit alignment.
+
+	manifest Manifest // Describes the version of the program.
+
 	name string
 	prog []code.Instr
+	ast  ast.Node // The checked syntax tree the program was compiled from.
 
 	re  []*regexp.Regexp  // Regular expression constants
 	str []string          // String constants
 	m   []*metrics.Metric // Metrics accessible to this program.
 
+	backtracking map[int]*pcre.Regexp // Regular expression constants compiled by the backtracking engine, by index in re.
+
 	timeMemos *lru.Cache // memo of time string parse results
 
+	lastEvent *securityEvent // The CEF or LEEF event last decoded.
+
+	w3cFields *lru.Cache       // The field names from the latest #Fields directive of each of the logs last read.
+	w3cLine   *logline.LogLine // The input line last split into W3C values.
+	w3cValues []string         // The W3C values of w3cLine.
+
+	csv           csvFormat        // How the program's logs of delimiter-separated values are written.
+	csvHeaders    *lru.Cache       // The columns named by the header of each of the logs last read, by name.
+	csvLine       *logline.LogLine // The input line last split into values.
+	csvLineValues []string         // The values of csvLine.
+
 	t *thread // Current thread of execution
 
 	input *logline.LogLine // Log line input to this round of execution.
@@ -75,8 +115,51 @@ type VM struct {
 	runtimeErrorMu sync.RWMutex //protects runtimeError
 	runtimeError   string       // records the last runtime error from errorf()
 
+	errorLimiters map[int]*logging.RateLimiter // Limits the logging of runtime errors from each instruction, by pc.
+
 	syslogUseCurrentYear bool           // Overwrite zero years with the current year in a strptime.
 	loc                  *time.Location // Override local timezone with provided, if not empty
+
+	strict bool   // Count conversion errors separately and never cache failed timestamp parses.
+	syntax string // The language version the program is written in.
+
+	numberFormat numberFormat // The separators in numbers converted by parseint and parsefloat.
+
+	samplers []*sampler // The state of the sample statements, by the operand of the sample instruction.
+
+	filters []object.Filter // The filename filters a log must pass for the program to process it.
+
+	obj *object.Object // The object the program was compiled to, whose regular expressions are shared with other programs.
+
+	conditions       []int   // The source lines of the instrumented conditions.
+	conditionMatches []int64 // The lines matched by each instrumented condition; accessed atomically.
+
+	lastTimes map[string]time.Time // The last timestamp parsed from each log, for disambiguating repeated hours.
+
+	timestampBounds timestampBounds // What to do with metric updates at implausible timestamps.
+	overflowPolicy  OverflowPolicy  // What to do when an integer metric passes the limits of an int64.
+
+	alerter  alert.Alerter   // Receives the alerts raised by the program, or nil to log them.
+	executor action.Executor // Runs the commands requested by the program, or nil if exec() is disabled.
+	locator  geoip.Locator   // Looks up the addresses given to the geoip builtins, or nil if there are no databases.
+	hmacKey  []byte          // The key of the hmac builtin, or nil if it is disabled.
+
+	fileLabels     *fileLabels                  // The labels added to metrics from the paths of logs, or nil if there are none.
+	fileLabelCache map[string]map[string]string // The file labels of each log.
+
+	onUpdate func(Update) // Called with each change to the program's metrics, if not nil.
+
+	clock clock.Clock // Tells the time of metric updates and of the timestamp builtins.
+
+	tracer   tracer    // Execution trace state, for debugging.
+	profiler *profiler // Optional per source line execution cost, for benchmarking.
+	coverage *coverage // Optional per instruction execution counts, for testing.
+
+	sandbox *sandbox // Runs the program compiled to WebAssembly in place of the interpreter, if set.
+
+	jitAfter   time.Duration // How long the program is interpreted before it's compiled to closures, or zero to always interpret it.
+	jitElapsed time.Duration // How long the program has been interpreted.
+	jit        *jit          // Runs the compiled program in place of the interpreter, once set.
 }
 
 // Push a value onto the stack
@@ -94,7 +177,10 @@ func (t *thread) Pop() (value interface{}) {
 
 // Log a runtime error and terminate the program
 func (v *VM) errorf(format string, args ...interface{}) {
-	i := v.prog[v.t.pc-1]
+	var i code.Instr
+	if v.t.pc > 0 && v.t.pc <= len(v.prog) {
+		i = v.prog[v.t.pc-1]
+	}
 	progRuntimeErrors.Add(v.name, 1)
 	v.runtimeErrorMu.Lock()
 	v.runtimeError = fmt.Sprintf(format+"\n", args...)
@@ -102,28 +188,58 @@ func (v *VM) errorf(format string, args ...interface{}) {
 		"Error occurred at instruction %d {%s, %v}, originating in %s at line %d\n",
 		v.t.pc-1, i.Opcode, i.Operand, v.name, i.SourceLine+1)
 	v.runtimeError += fmt.Sprintf("Full input text from %q was %q", v.input.Filename, v.input.Line)
-	if *runtimeLogError || bool(glog.V(1)) {
-		glog.Info(v.name + ": Runtime error: " + v.runtimeError)
-
-		glog.Infof("Set logging verbosity higher (-v1 or more) to see full VM state dump.")
-	}
-	if glog.V(1) {
-		glog.Infof("VM stack:\n%s", debug.Stack())
-		glog.Infof("Dumping vm state")
-		glog.Infof("Name: %s", v.name)
-		glog.Infof("Input: %#v", v.input)
-		glog.Infof("Thread:")
-		glog.Infof(" PC %v", v.t.pc-1)
-		glog.Infof(" Matched %v", v.t.matched)
-		glog.Infof(" Matches %v", v.t.matches)
-		glog.Infof(" Timestamp %v", v.t.time)
-		glog.Infof(" Stack %v", v.t.stack)
-		glog.Infof(v.DumpByteCode())
+	if (*runtimeLogError || bool(logging.V(1))) && v.allowErrorLog(v.t.pc-1) {
+		logging.Info(v.name + ": Runtime error: " + v.runtimeError)
+
+		logging.Infof("Set logging verbosity higher (-v1 or more) to see full VM state dump.")
+	}
+	if logging.V(1) {
+		logging.Infof("VM stack:\n%s", debug.Stack())
+		logging.Infof("Dumping vm state")
+		logging.Infof("Name: %s", v.name)
+		logging.Infof("Input: %#v", v.input)
+		logging.Infof("Thread:")
+		logging.Infof(" PC %v", v.t.pc-1)
+		logging.Infof(" Matched %v", v.t.matched)
+		logging.Infof(" Matches %v", v.t.matches)
+		logging.Infof(" Timestamp %v", v.t.time)
+		logging.Infof(" Stack %v", v.t.stack)
+		logging.Infof(v.DumpByteCode())
 	}
 	v.runtimeErrorMu.Unlock()
 	v.terminate = true
 }
 
+// allowErrorLog reports whether the runtime error at pc may be logged, so that
+// a program failing on every line of a log doesn't flood the log of mtail.
+// When it may, the errors suppressed since the last one logged are reported.
+// runtimeErrorMu is held.
+func (v *VM) allowErrorLog(pc int) bool {
+	l, ok := v.errorLimiters[pc]
+	if !ok {
+		if v.errorLimiters == nil {
+			v.errorLimiters = make(map[int]*logging.RateLimiter)
+		}
+		l = logging.NewRateLimiter(*runtimeErrorLogRate, *runtimeErrorLogBurst)
+		v.errorLimiters[pc] = l
+	}
+	allow, suppressed := l.Allow()
+	if suppressed > 0 {
+		logging.Infof("%s: suppressed %d similar runtime errors at instruction %d", v.name, suppressed, pc)
+	}
+	return allow
+}
+
+// conversionErrorf logs a runtime error caused by bad input data, and in strict
+// mode also counts it as a conversion error.  Either way the program is
+// terminated on this line, so no metric is updated with a zero value.
+func (v *VM) conversionErrorf(format string, args ...interface{}) {
+	if v.strict {
+		progConversionErrors.Add(v.name, 1)
+	}
+	v.errorf(format, args...)
+}
+
 func (t *thread) PopInt() (int64, error) {
 	val := t.Pop()
 	switch n := val.(type) {
@@ -305,28 +421,38 @@ func compare(a, b interface{}, opnd int) (bool, error) {
 // ParseTime performs location and syslog-year aware timestamp parsing.
 func (v *VM) ParseTime(layout, value string) (tm time.Time) {
 	var err error
-	if v.loc != nil {
-		tm, err = time.ParseInLocation(layout, value, v.loc)
+	loc := v.location()
+	if loc != nil {
+		tm, err = time.ParseInLocation(layout, value, loc)
 	} else {
 		tm, err = time.Parse(layout, value)
 	}
 	if err != nil {
-		v.errorf("strptime (%v, %v, %v) failed: %s", layout, value, v.loc, err)
+		v.conversionErrorf("strptime (%v, %v, %v) failed: %s", layout, value, loc, err)
 		return
 	}
 	// Hack for yearless syslog.
 	if tm.Year() == 0 && v.syslogUseCurrentYear {
 		// No .UTC() as we use local time to match the local log.
-		now := time.Now()
+		now := v.clock.Now()
 		// unless there's a timezone
-		if v.loc != nil {
-			now = now.In(v.loc)
+		if loc != nil {
+			now = now.In(loc)
 		}
 		tm = tm.AddDate(now.Year(), 0, 0)
 	}
 	return
 }
 
+// location returns the timezone for timestamps in the current input, which
+// may be set for the log it came from.
+func (v *VM) location() *time.Location {
+	if v.input != nil && v.input.Location != nil {
+		return v.input.Location
+	}
+	return v.loc
+}
+
 // execute performs an instruction cycle in the VM. acting on the instruction
 // i in thread t.
 func (v *VM) execute(t *thread, i code.Instr) {
@@ -337,6 +463,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 				fmt.Printf("panic in thread %#v at instr %q: %s\n", t, i, r)
 				panic(r)
 			}
+			progRuntimePanics.Add(v.name, 1)
 			v.errorf("panic in thread %#v at instr %q: %s", t, i, r)
 			v.terminate = true
 		}
@@ -354,7 +481,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		// Store the results in the operandth element of the stack,
 		// where i.opnd == the matched re index
 		index := i.Operand.(int)
-		t.matches[index] = v.re[index].FindStringSubmatch(v.input.Line)
+		t.matches[index] = v.match(index, v.input.Line)
 		t.Push(t.matches[index] != nil)
 
 	case code.Smatch:
@@ -365,7 +492,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			v.errorf("+%v", err)
 			return
 		}
-		t.matches[index] = v.re[index].FindStringSubmatch(line)
+		t.matches[index] = v.match(index, line)
 		t.Push(t.matches[index] != nil)
 
 	case code.Cmp:
@@ -479,7 +606,10 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			}
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
-			datum.IncIntBy(n, delta, t.time)
+			if ts, ok := v.updateTime(t); ok {
+				v.incBy(n, delta, ts, false)
+				v.notify(t, n)
+			}
 			t.Push(datum.GetInt(n))
 		} else {
 			v.errorf("Unexpected type to increment: %T %q", n, n)
@@ -499,7 +629,10 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			}
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
-			datum.DecIntBy(n, delta, t.time)
+			if ts, ok := v.updateTime(t); ok {
+				v.incBy(n, delta, ts, true)
+				v.notify(t, n)
+			}
 			t.Push(datum.GetInt(n))
 		} else {
 			v.errorf("Unexpected type to increment: %T %q", n, n)
@@ -514,7 +647,10 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			return
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
-			datum.SetInt(n, value, t.time)
+			if ts, ok := v.updateTime(t); ok {
+				datum.SetInt(n, value, ts)
+				v.notify(t, n)
+			}
 		} else {
 			v.errorf("Unexpected type to iset: %T %q", n, n)
 			return
@@ -528,7 +664,10 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			return
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
-			datum.SetFloat(n, value, t.time)
+			if ts, ok := v.updateTime(t); ok {
+				datum.SetFloat(n, value, ts)
+				v.notify(t, n)
+			}
 		} else {
 			v.errorf("Unexpected type to fset: %T %q", n, n)
 			return
@@ -542,7 +681,10 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			return
 		}
 		if n, ok := t.Pop().(datum.Datum); ok {
-			datum.SetString(n, value, t.time)
+			if ts, ok := v.updateTime(t); ok {
+				datum.SetString(n, value, ts)
+				v.notify(t, n)
+			}
 		} else {
 			v.errorf("Unexpected type to sset: %T %q", n, n)
 			return
@@ -567,18 +709,30 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			// Store the result from the re'th index at the s'th index
 			ts = t.matches[re][s]
 		}
-		if cached, ok := v.timeMemos.Get(ts); !ok {
+		// The same text is a different time in another log's timezone.
+		key := ts
+		if v.input != nil && v.input.Location != nil {
+			key = v.input.Location.String() + " " + ts
+		}
+		if cached, ok := v.timeMemos.Get(key); !ok {
 			tm := v.ParseTime(layout, ts)
-			v.timeMemos.Add(ts, tm)
+			// In strict mode a failed parse is not remembered, so that
+			// every line with a bad timestamp is reported.
+			if !v.strict || !tm.IsZero() {
+				v.timeMemos.Add(key, tm)
+			}
 			t.time = tm
 		} else {
 			t.time = cached.(time.Time)
 		}
+		if v.input != nil && v.location() != nil && !t.time.IsZero() && !layoutHasZone(layout) {
+			t.time = v.disambiguate(t.time)
+		}
 
 	case code.Timestamp:
 		// Put the time register onto the stack, unless it's zero in which case use system time.
 		if t.time.IsZero() {
-			t.Push(time.Now().Unix())
+			t.Push(v.clock.Now().Unix())
 		} else {
 			// Put the time register onto the stack
 			t.Push(t.time.Unix())
@@ -731,12 +885,16 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			//fmt.Printf("Keys: %v\n", keys)
 		}
 		//fmt.Printf("Keys: %v\n", keys)
+		keys = v.fileLabelValues(m, keys)
 		d, err := m.GetDatum(keys...)
 		if err != nil {
 			v.errorf("dload (GetDatum) failed: %s", err)
 			return
 		}
 		//fmt.Printf("Found %v\n", d)
+		if v.onUpdate != nil {
+			t.dloads = append(t.dloads, dload{d, m, keys})
+		}
 		t.Push(d)
 
 	case code.Iget, code.Fget, code.Sget:
@@ -766,7 +924,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			}
 			keys[j] = s
 		}
-		err := m.RemoveDatum(keys...)
+		err := m.RemoveDatum(v.fileLabelValues(m, keys)...)
 		if err != nil {
 			v.errorf("del (RemoveDatum) failed: %s", err)
 			return
@@ -785,7 +943,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			keys[j] = s
 		}
 		expiry := t.Pop().(time.Duration)
-		if err := m.ExpireDatum(expiry, keys...); err != nil {
+		if err := m.ExpireDatum(expiry, v.fileLabelValues(m, keys)...); err != nil {
 			v.errorf("%s", err)
 			return
 		}
@@ -808,6 +966,170 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		t.Push(len(s))
 
+	case code.Urlhost, code.Urlpath:
+		// Parse a URL from TOS, and push its host or path.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			v.conversionErrorf("%s", err)
+			return
+		}
+		if i.Opcode == code.Urlhost {
+			t.Push(u.Hostname())
+		} else {
+			t.Push(u.Path)
+		}
+
+	case code.Urlquery:
+		// Pop a parameter name and a URL, and push the parameter's first value.
+		name, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			v.conversionErrorf("%s", err)
+			return
+		}
+		t.Push(u.Query().Get(name))
+
+	case code.Cef, code.Leef:
+		// Pop a field name and an event, and push the event's field.
+		name, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		format := "CEF"
+		if i.Opcode == code.Leef {
+			format = "LEEF"
+		}
+		f, err := v.eventField(format, s, name)
+		if err != nil {
+			v.conversionErrorf("%s", err)
+			return
+		}
+		t.Push(f)
+
+	case code.W3c:
+		// Pop a field name, and push its value in the input line.
+		name, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		f, err := v.w3cField(name)
+		if err != nil {
+			v.conversionErrorf("%s", err)
+			return
+		}
+		t.Push(f)
+
+	case code.Csv:
+		// Pop a column name, and push its value in the input line.
+		name, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		s, err := v.csvColumn(name)
+		if err != nil {
+			v.conversionErrorf("%s", err)
+			return
+		}
+		t.Push(s)
+
+	case code.Csvcol:
+		// Pop a column number, and push its value in the input line.
+		n, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		s, err := v.csvPosition(int(n))
+		if err != nil {
+			v.conversionErrorf("%s", err)
+			return
+		}
+		t.Push(s)
+
+	case code.Field:
+		// Pop a field path, and push its value in the input record.
+		name, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if v.input.Fields == nil {
+			v.conversionErrorf("field(%q) of a line from %q that isn't a record with fields", name, v.input.Filename)
+			return
+		}
+		t.Push(v.input.Fields[name])
+
+	case code.Normpath:
+		// Replace the IDs in a URL path from TOS, and push result back.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(normalizePath(s))
+
+	case code.Uaclass:
+		// Classify a user agent from TOS, and push its class.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(classifyUserAgent(s))
+
+	case code.Sha256:
+		// Hash a string from TOS, and push result back.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(sha256Hex(s))
+
+	case code.Hmac:
+		// Hash a string from TOS with the key, and push result back.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if len(v.hmacKey) == 0 {
+			v.errorf("hmac() needs a key, and none is set")
+			return
+		}
+		t.Push(hmacHex(v.hmacKey, s))
+
+	case code.Redact:
+		// Redact a string from TOS, and push result back.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(redact(s))
+
 	case code.S2i:
 		base := int64(10)
 		var err error
@@ -826,7 +1148,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		i, err := strconv.ParseInt(str, int(base), 64)
 		if err != nil {
-			v.errorf("%s", err)
+			v.conversionErrorf("%s", err)
 			return
 		}
 		t.Push(i)
@@ -839,7 +1161,69 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		f, err := strconv.ParseFloat(str, 64)
 		if err != nil {
-			v.errorf("%s", err)
+			v.conversionErrorf("%s", err)
+			return
+		}
+		t.Push(f)
+
+	case code.Parseint:
+		str, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		str, err = v.numberFormat.normalize(str)
+		if err != nil {
+			v.conversionErrorf("%s", err)
+			return
+		}
+		i, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			v.conversionErrorf("%s", err)
+			return
+		}
+		t.Push(i)
+
+	case code.Parsefloat:
+		str, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		str, err = v.numberFormat.normalize(str)
+		if err != nil {
+			v.conversionErrorf("%s", err)
+			return
+		}
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			v.conversionErrorf("%s", err)
+			return
+		}
+		t.Push(f)
+
+	case code.Parsedur:
+		str, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		f, err := parseDuration(str)
+		if err != nil {
+			v.conversionErrorf("%s", err)
+			return
+		}
+		t.Push(f)
+
+	case code.Parsesize:
+		str, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		f, err := parseSize(str)
+		if err != nil {
+			v.conversionErrorf("%s", err)
 			return
 		}
 		t.Push(f)
@@ -871,6 +1255,17 @@ func (v *VM) execute(t *thread, i code.Instr) {
 	case code.Setmatched:
 		t.matched = i.Operand.(bool)
 
+	case code.Sample:
+		s := v.samplers[i.Operand.(int)]
+		ok := s.take()
+		if !ok {
+			progSampleSkips.Add(v.name, 1)
+		}
+		t.Push(ok)
+
+	case code.Condmatch:
+		atomic.AddInt64(&v.conditionMatches[i.Operand.(int)], 1)
+
 	case code.Otherwise:
 		// Only match if the matched flag is false.
 		t.Push(!t.matched)
@@ -878,6 +1273,90 @@ func (v *VM) execute(t *thread, i code.Instr) {
 	case code.Getfilename:
 		t.Push(v.input.Filename)
 
+	case code.Getlinenumber:
+		t.Push(v.input.Number)
+
+	case code.Getlineoffset:
+		t.Push(v.input.Offset)
+
+	case code.Getingesttime:
+		// Lines that didn't come from the tailer have no ingest time, so use
+		// system time like the timestamp register does.
+		if v.input.IngestTime.IsZero() {
+			t.Push(v.clock.Now().Unix())
+		} else {
+			t.Push(v.input.IngestTime.Unix())
+		}
+
+	case code.Alert:
+		// Pop the message from TOS, and raise it as an alert.
+		msg, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		a := alert.Alert{Program: v.name, Message: msg, Filename: v.input.Filename, Line: v.input.Number, Time: t.time}
+		if a.Time.IsZero() {
+			a.Time = v.clock.Now().UTC()
+		}
+		if v.alerter == nil {
+			logging.Infof("Alert from %s: %s", v.name, msg)
+			return
+		}
+		v.alerter.Alert(a)
+
+	case code.Exec:
+		// Pop the arguments, then the command name, and run the command.
+		n := i.Operand.(int)
+		args := make([]string, n)
+		for j := n - 1; j >= 0; j-- {
+			s, err := t.PopString()
+			if err != nil {
+				v.errorf("%+v", err)
+				return
+			}
+			args[j] = s
+		}
+		if v.executor == nil {
+			v.errorf("exec(%q) not run: no commands are allowed", args[0])
+			return
+		}
+		if err := v.executor.Exec(v.name, args[0], args[1:]); err != nil {
+			v.errorf("exec(%q) not run: %s", args[0], err)
+		}
+
+	case code.Geoipcountry, code.Geoipasn:
+		// Pop an IP address, and push its country or autonomous system.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if v.locator == nil {
+			v.errorf("%s() needs a GeoIP database, and none is loaded", i.Opcode)
+			return
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			v.conversionErrorf("invalid IP address %q", s)
+			return
+		}
+		if i.Opcode == code.Geoipcountry {
+			c, err := v.locator.Country(ip)
+			if err != nil {
+				v.errorf("%s", err)
+				return
+			}
+			t.Push(c)
+		} else {
+			n, err := v.locator.ASN(ip)
+			if err != nil {
+				v.errorf("%s", err)
+				return
+			}
+			t.Push(n)
+		}
+
 	case code.Cat:
 		b, berr := t.PopString()
 		if berr != nil {
@@ -901,14 +1380,60 @@ func (v *VM) execute(t *thread, i code.Instr) {
 func (v *VM) ProcessLogLine(ctx context.Context, line *logline.LogLine) {
 	start := time.Now()
 	defer func() {
-		lineProcessingDurations.WithLabelValues(v.name).Observe(time.Since(start).Seconds())
+		end := time.Now()
+		lineProcessingDurations.WithLabelValues(v.name).Observe(end.Sub(start).Seconds())
+		if written := lineWritten(line, end); !written.IsZero() {
+			lineLatencies.WithLabelValues(v.name).Observe(end.Sub(written).Seconds())
+		}
+	}()
+	// Instruction panics are recovered in execute; this catches anything else
+	// so that a bad program or hostile input only costs the current line.
+	defer func() {
+		if r := recover(); r != nil {
+			if v.HardCrash {
+				panic(r)
+			}
+			v.terminate = false
+			progRuntimePanics.Add(v.name, 1)
+			progRuntimeErrors.Add(v.name, 1)
+			logging.Infof("%s: recovered from panic processing line %q from %q: %s", v.name, line.Line, line.Filename, r)
+		}
 	}()
 	t := new(thread)
 	t.matched = false
 	v.t = t
 	v.input = line
+	v.readW3CDirective(line)
+	if v.readCSVHeader(line) {
+		return
+	}
 	t.stack = make([]interface{}, 0)
 	t.matches = make(map[int][]string, len(v.re))
+	defer v.recordMatch(t)
+	// A sandboxed program is never interpreted, even to trace it.
+	if v.sandbox != nil {
+		v.processSandboxedLogLine(ctx)
+		return
+	}
+	if v.tracing() {
+		v.processTracedLogLine(t, line)
+		return
+	}
+	if v.profiler != nil {
+		v.processProfiledLogLine(t)
+		return
+	}
+	if v.coverage != nil {
+		v.processCoveredLogLine(t)
+		return
+	}
+	if v.jit != nil {
+		v.processCompiledLogLine(t)
+		return
+	}
+	if v.jitAfter > 0 {
+		defer v.interpreted(start)
+	}
 	for {
 		if t.pc >= len(v.prog) {
 			return
@@ -924,19 +1449,90 @@ func (v *VM) ProcessLogLine(ctx context.Context, line *logline.LogLine) {
 	}
 }
 
+// lineWritten returns the time by which line is known to have been written
+// to its log: its WriteTime, or else the time it was read.  A WriteTime after
+// the end of processing is from a skewed clock, like a network filesystem's,
+// so isn't trusted.  It returns the zero time for lines not read by a tailer.
+func lineWritten(line *logline.LogLine, end time.Time) time.Time {
+	if !line.WriteTime.IsZero() && !line.WriteTime.After(end) {
+		return line.WriteTime
+	}
+	return line.IngestTime
+}
+
 // New creates a new virtual machine with the given name, and compiler
 // artifacts for executable and data segments.
 func New(name string, obj *object.Object, syslogUseCurrentYear bool, loc *time.Location) *VM {
 	return &VM{
+		lastMatch:            time.Now().UnixNano(),
+		clock:                clock.Real,
 		name:                 name,
 		re:                   obj.Regexps,
+		backtracking:         obj.Backtracking,
 		str:                  obj.Strings,
 		m:                    obj.Metrics,
 		prog:                 obj.Program,
 		timeMemos:            lru.New(64),
+		lastTimes:            make(map[string]time.Time),
+		fileLabelCache:       make(map[string]map[string]string),
+		w3cFields:            lru.New(maxScopedLogs),
+		csv:                  newCSVFormat(obj.CSVDelimiter, obj.CSVQuote, obj.CSVHeader),
+		csvHeaders:           lru.New(maxScopedLogs),
 		syslogUseCurrentYear: syslogUseCurrentYear,
 		loc:                  loc,
+		strict:               obj.Strict,
+		syntax:               obj.Syntax,
+		numberFormat:         newNumberFormat(obj.DecimalSeparator, obj.ThousandsSeparator),
+		samplers:             newSamplers(name, obj.Samples),
+		conditions:           obj.Conditions,
+		filters:              obj.Filters,
+		obj:                  obj,
+		conditionMatches:     make([]int64, len(obj.Conditions)),
+	}
+}
+
+// release gives up the program's uses of the regular expressions it shares
+// with other programs, and closes its sandbox, once it has been unloaded or
+// replaced.
+func (v *VM) release() {
+	codegen.Release(v.obj)
+	if v.sandbox != nil {
+		v.sandbox.close()
+	}
+}
+
+// ProcessesLog returns whether the program processes the lines of the log
+// named filename, that is, whether the filename passes all of the program's
+// filters.
+func (v *VM) ProcessesLog(filename string) bool {
+	for _, f := range v.filters {
+		if f.Regexp.MatchString(filename) == f.Negate {
+			return false
+		}
 	}
+	return true
+}
+
+// recordMatch notes the current time as the time of the last match, if the
+// line run in t matched any pattern.
+func (v *VM) recordMatch(t *thread) {
+	for _, m := range t.matches {
+		if m != nil {
+			atomic.StoreInt64(&v.lastMatch, v.clock.Now().UnixNano())
+			return
+		}
+	}
+}
+
+// LastMatchTime returns when a line last matched one of the program's
+// patterns, or when the program was loaded if none has.
+func (v *VM) LastMatchTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&v.lastMatch))
+}
+
+// Syntax returns the language version the program is written in.
+func (v *VM) Syntax() string {
+	return v.syntax
 }
 
 // DumpByteCode emits the program disassembly and program objects to a string.
@@ -951,6 +1547,10 @@ func (v *VM) DumpByteCode() string {
 	}
 	fmt.Fprintln(b, "Regexps")
 	for i, re := range v.re {
+		if bre, ok := v.backtracking[i]; ok {
+			fmt.Fprintf(b, " %8d /%s%s/\n", i, pcre.Marker, bre)
+			continue
+		}
 		fmt.Fprintf(b, " %8d /%s/\n", i, re)
 	}
 	fmt.Fprintln(b, "Strings")
@@ -965,7 +1565,7 @@ func (v *VM) DumpByteCode() string {
 		fmt.Fprintf(w, "\t%d\t%s\t%v\t%d\t\n", n, i.Opcode, i.Operand, i.SourceLine+1)
 	}
 	if err := w.Flush(); err != nil {
-		glog.Infof("flush error: %s", err)
+		logging.Infof("flush error: %s", err)
 	}
 	return b.String()
 }
@@ -976,3 +1576,19 @@ func (v *VM) RuntimeErrorString() string {
 	defer v.runtimeErrorMu.RUnlock()
 	return v.runtimeError
 }
+
+// Metrics returns the metrics accessible to the program, including those
+// hidden from export.
+func (v *VM) Metrics() []*metrics.Metric {
+	return v.m
+}
+
+// LineTime returns the timestamp of the last line processed, as set by the
+// program with strptime or settime, or the zero time if the program didn't
+// set one.  It must not be called concurrently with ProcessLogLine.
+func (v *VM) LineTime() time.Time {
+	if v.t == nil {
+		return time.Time{}
+	}
+	return v.t.time
+}
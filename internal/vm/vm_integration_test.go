@@ -11,6 +11,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
@@ -53,6 +54,113 @@ var vmTests = []struct {
 			},
 		},
 	},
+	{"topk",
+		`syntax = "v2"
+topk 2 clients by ip
+
+/^(\S+) / {
+  clients[$1]++
+}
+`, `10.0.0.1 a
+10.0.0.1 b
+10.0.0.2 c
+10.0.0.3 d
+10.0.0.1 e
+`,
+		map[string][]*metrics.Metric{
+			"clients": {
+				{
+					Name:    "clients",
+					Program: "topk",
+					Kind:    metrics.TopK,
+					Type:    metrics.Int,
+					Keys:    []string{"ip"},
+					Limit:   2,
+					LabelValues: []*metrics.LabelValue{
+						{
+							Labels: []string{"10.0.0.1"},
+							Value:  &datum.Int{Value: 3},
+						},
+						{
+							Labels: []string{"10.0.0.3"},
+							Value:  &datum.Int{Value: 2},
+						},
+					},
+				},
+			},
+		},
+	},
+	{"aggregates",
+		`syntax = "v2"
+min latency_min by path
+max latency_max by path
+avg latency_avg
+
+/^(\S+) (\d+)$/ {
+  latency_min[$1] = $2
+  latency_max[$1] = $2
+  latency_avg = $2
+}
+`, `/a 30
+/a 10
+/b 20
+`,
+		map[string][]*metrics.Metric{
+			"latency_min": {
+				{
+					Name:    "latency_min",
+					Program: "aggregates",
+					Kind:    metrics.Min,
+					Type:    metrics.Aggregate,
+					Keys:    []string{"path"},
+					LabelValues: []*metrics.LabelValue{
+						{
+							Labels: []string{"/a"},
+							Value:  &datum.Aggregate{Func: datum.AggregateMin, Count: 2, Sum: 40, Min: 10, Max: 30},
+						},
+						{
+							Labels: []string{"/b"},
+							Value:  &datum.Aggregate{Func: datum.AggregateMin, Count: 1, Sum: 20, Min: 20, Max: 20},
+						},
+					},
+				},
+			},
+			"latency_max": {
+				{
+					Name:    "latency_max",
+					Program: "aggregates",
+					Kind:    metrics.Max,
+					Type:    metrics.Aggregate,
+					Keys:    []string{"path"},
+					LabelValues: []*metrics.LabelValue{
+						{
+							Labels: []string{"/a"},
+							Value:  &datum.Aggregate{Func: datum.AggregateMax, Count: 2, Sum: 40, Min: 10, Max: 30},
+						},
+						{
+							Labels: []string{"/b"},
+							Value:  &datum.Aggregate{Func: datum.AggregateMax, Count: 1, Sum: 20, Min: 20, Max: 20},
+						},
+					},
+				},
+			},
+			"latency_avg": {
+				{
+					Name:    "latency_avg",
+					Program: "aggregates",
+					Kind:    metrics.Avg,
+					Type:    metrics.Aggregate,
+					Keys:    []string{},
+					LabelValues: []*metrics.LabelValue{
+						{
+							Labels: []string{},
+							Value:  &datum.Aggregate{Func: datum.AggregateAvg, Count: 3, Sum: 60, Min: 10, Max: 30},
+						},
+					},
+				},
+			},
+		},
+	},
 	{"histogram",
 		`histogram hist1 buckets 1, 2, 4, 8
 histogram hist2 by code buckets 0, 1, 2, 4, 8
@@ -186,6 +294,65 @@ b 3
 			},
 		},
 	},
+	{"parameterised and imported decorators",
+		`syntax = "v2"
+counter requests_total by status
+counter hits_total
+
+import "apache"
+import "timestamp"
+
+@apache_common {
+  requests_total[$status_code]++
+}
+
+@timestamp_prefix(/(?P<timestamp>\d{4}\/\d{2}\/\d{2} \d{2}:\d{2}:\d{2}) /, "2006/01/02 15:04:05") {
+  /hit/ {
+    hits_total++
+  }
+}
+`,
+		`127.0.0.1 - - [14/May/2019:11:10:05 +0000] "GET / HTTP/1.1" 200 512
+127.0.0.1 - - [14/May/2019:11:10:06 +0000] "GET /x HTTP/1.1" 404 -
+2019/05/14 11:11:06 hit
+2019/05/14 11:11:07 miss
+`,
+		map[string][]*metrics.Metric{
+			"requests_total": {
+				{
+					Name:    "requests_total",
+					Program: "parameterised and imported decorators",
+					Kind:    metrics.Counter,
+					Type:    metrics.Int,
+					Keys:    []string{"status"},
+					LabelValues: []*metrics.LabelValue{
+						{
+							Labels: []string{"200"},
+							Value:  &datum.Int{Value: 1},
+						},
+						{
+							Labels: []string{"404"},
+							Value:  &datum.Int{Value: 1},
+						},
+					},
+				},
+			},
+			"hits_total": {
+				{
+					Name:    "hits_total",
+					Program: "parameterised and imported decorators",
+					Kind:    metrics.Counter,
+					Type:    metrics.Int,
+					Keys:    []string{},
+					LabelValues: []*metrics.LabelValue{
+						{
+							Value: &datum.Int{Value: 1},
+						},
+					},
+				},
+			},
+		},
+	},
 }
 
 func TestVmEndToEnd(t *testing.T) {
@@ -221,3 +388,81 @@ func TestVmEndToEnd(t *testing.T) {
 		})
 	}
 }
+
+func TestVmDistinct(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := NewLoader(ctx, "", store, ErrorsAbort(), OmitMetricSource())
+	testutil.FatalIfErr(t, err)
+	prog := `syntax = "v2"
+distinct users by country window 1h
+distinct requests
+
+/^(?P<country>\S+) (?P<user>\S+) (?P<id>\d+)$/ {
+  users[$country] = $user
+  requests = $id
+}
+`
+	testutil.FatalIfErr(t, l.CompileAndRun("distinct", strings.NewReader(prog)))
+	for _, line := range []string{
+		"au alice 1",
+		"au bob 2",
+		"au alice 3",
+		"nz carol 4",
+		"nz carol 4",
+	} {
+		l.ProcessLogLine(ctx, logline.New(ctx, "distinct", line))
+	}
+	l.Close()
+
+	estimates := map[string]uint64{}
+	for _, m := range store.Metrics["users"] {
+		testutil.ExpectNoDiff(t, metrics.Sketch, m.Type)
+		testutil.ExpectNoDiff(t, time.Hour, m.Window)
+		for _, lv := range m.LabelValues {
+			estimates[lv.Labels[0]] = datum.GetSketch(lv.Value).Estimate()
+		}
+	}
+	testutil.ExpectNoDiff(t, map[string]uint64{"au": 2, "nz": 1}, estimates)
+	d, err := store.Metrics["requests"][0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, uint64(4), datum.GetSketch(d).Estimate())
+}
+
+func TestVmExternConst(t *testing.T) {
+	store := metrics.NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := NewLoader(ctx, "", store, ErrorsAbort(), OmitMetricSource(), ExternConsts(map[string]string{"DATACENTER": "us-east1"}, ""))
+	testutil.FatalIfErr(t, err)
+	prog := `syntax = "v2"
+extern const DATACENTER
+counter requests by dc
+counter local
+
+/^(?P<dc>\S+) / {
+  requests[DATACENTER]++
+  $dc == DATACENTER {
+    local++
+  }
+}
+`
+	testutil.FatalIfErr(t, l.CompileAndRun("extern", strings.NewReader(prog)))
+	for _, line := range []string{
+		"us-east1 GET /",
+		"eu-west2 GET /",
+	} {
+		l.ProcessLogLine(ctx, logline.New(ctx, "extern", line))
+	}
+	l.Close()
+
+	d, err := store.Metrics["requests"][0].GetDatum("us-east1")
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, int64(2), datum.GetInt(d))
+	d, err = store.Metrics["local"][0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, int64(1), datum.GetInt(d))
+}
@@ -5,16 +5,25 @@ package vm
 
 import (
 	"context"
+	"expvar"
+	"fmt"
+	"math"
+	"net"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/mtail/internal/alert"
 	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/testutil"
 	"github.com/google/mtail/internal/vm/code"
 	"github.com/google/mtail/internal/vm/object"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var instructions = []struct {
@@ -316,6 +325,111 @@ var instructions = []struct {
 		[]interface{}{"1.0"},
 		[]interface{}{float64(1.0)},
 		thread{pc: 0, matches: map[int][]string{}}},
+	{"parseint",
+		code.Instr{code.Parseint, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"-1,234,567"},
+		[]interface{}{int64(-1234567)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"parsefloat",
+		code.Instr{code.Parsefloat, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"1,234.5"},
+		[]interface{}{float64(1234.5)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"parsedur",
+		code.Instr{code.Parsedur, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"1m30s"},
+		[]interface{}{float64(90)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"parsesize",
+		code.Instr{code.Parsesize, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"2KiB"},
+		[]interface{}{float64(2048)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urlhost",
+		code.Instr{code.Urlhost, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"https://example.com:8080/a%20b?q=1"},
+		[]interface{}{"example.com"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urlpath",
+		code.Instr{code.Urlpath, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"https://example.com:8080/a%20b?q=1"},
+		[]interface{}{"/a b"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urlquery",
+		code.Instr{code.Urlquery, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/search?q=caf%C3%A9&page=2", "q"},
+		[]interface{}{"café"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urlquery missing",
+		code.Instr{code.Urlquery, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/search?q=x", "page"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"cef",
+		code.Instr{code.Cef, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"CEF:0|Acme|Firewall|1.0|100|Blocked|5|src=10.0.0.1 act=deny", "act"},
+		[]interface{}{"deny"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"leef",
+		code.Instr{code.Leef, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"LEEF:1.0|Acme|IDS|2.1|login|usrName=bob\tsev=5", "usrName"},
+		[]interface{}{"bob"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"field",
+		code.Instr{code.Field, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"request.path"},
+		[]interface{}{"/a"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"uaclass",
+		code.Instr{code.Uaclass, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"},
+		[]interface{}{"bot"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"sha256",
+		code.Instr{code.Sha256, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"alice"},
+		[]interface{}{"2bd806c97f0e00af1a1fc3328fa763a9269723c8db8fac4f93af71db186d6e90"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"redact",
+		code.Instr{code.Redact, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"login failed for bob@example.com from 192.0.2.1"},
+		[]interface{}{"login failed for [email] from [ip]"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"normpath",
+		code.Instr{code.Normpath, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/users/1234/orders/3f2504e0-4f89-11d3-9a0c-0305e82c3301"},
+		[]interface{}{"/users/:id/orders/:id"},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"i2f",
 		code.Instr{code.I2f, nil, 0},
 		[]*regexp.Regexp{},
@@ -414,6 +528,27 @@ var instructions = []struct {
 		[]interface{}{},
 		[]interface{}{testFilename},
 		thread{pc: 0, matches: map[int][]string{}}},
+	{"getlinenumber",
+		code.Instr{code.Getlinenumber, nil, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{},
+		[]interface{}{int64(3)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"getlineoffset",
+		code.Instr{code.Getlineoffset, nil, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{},
+		[]interface{}{int64(40)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"getingesttime",
+		code.Instr{code.Getingesttime, nil, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{},
+		[]interface{}{int64(1600000000)},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"i2s",
 		code.Instr{code.I2s, nil, 0},
 		[]*regexp.Regexp{},
@@ -479,7 +614,7 @@ func TestInstrs(t *testing.T) {
 				v.t.Push(item)
 			}
 			v.t.matches = make(map[int][]string)
-			v.input = logline.New(context.Background(), testFilename, "aaaab")
+			v.input = &logline.LogLine{Context: context.Background(), Filename: testFilename, Line: "aaaab", Offset: 40, Number: 3, IngestTime: time.Unix(1600000000, 0), Fields: map[string]string{"request.path": "/a"}}
 			v.execute(v.t, tc.i)
 			if v.terminate {
 				t.Fatalf("Execution failed, see info log.")
@@ -684,6 +819,78 @@ func TestStrptimeWithTimezone(t *testing.T) {
 	}
 }
 
+func TestStrptimeWithLogTimezone(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	obj := &object.Object{Program: []code.Instr{{code.Strptime, 0, 0}}}
+	vm := New("strptimelogzone", obj, true, berlin)
+	// The same text parses in each log's own timezone, despite the memo.
+	for _, loc := range []*time.Location{tokyo, nil} {
+		vm.input = &logline.LogLine{Context: context.Background(), Filename: "test", Location: loc}
+		vm.t = new(thread)
+		vm.t.stack = make([]interface{}, 0)
+		vm.t.Push("2012/01/18 06:25:00")
+		vm.t.Push("2006/01/02 15:04:05")
+		vm.execute(vm.t, obj.Program[0])
+		expectedLoc := loc
+		if loc == nil {
+			expectedLoc = berlin
+		}
+		if vm.t.time != time.Date(2012, 01, 18, 06, 25, 00, 00, expectedLoc) {
+			t.Errorf("Time didn't parse in %s: %s received", expectedLoc, vm.t.time)
+		}
+	}
+}
+
+func TestStrptimeRepeatedHour(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	testutil.FatalIfErr(t, err)
+	obj := &object.Object{Program: []code.Instr{{code.Strptime, 0, 0}}}
+	vm := New("strptimedst", obj, true, loc)
+	strptime := func(filename, ts, layout string) time.Time {
+		vm.input = logline.New(context.Background(), filename, "")
+		vm.t = new(thread)
+		vm.t.stack = make([]interface{}, 0)
+		vm.t.Push(ts)
+		vm.t.Push(layout)
+		vm.execute(vm.t, obj.Program[0])
+		return vm.t.time.UTC()
+	}
+	const layout = "2006/01/02 15:04:05"
+	// The clocks went back from 02:00 EDT to 01:00 EST on 2020-11-01.
+	for _, tc := range []struct {
+		ts       string
+		expected time.Time
+	}{
+		{"2020/11/01 00:50:00", time.Date(2020, 11, 1, 4, 50, 0, 0, time.UTC)},
+		{"2020/11/01 01:10:00", time.Date(2020, 11, 1, 5, 10, 0, 0, time.UTC)},
+		{"2020/11/01 01:50:00", time.Date(2020, 11, 1, 5, 50, 0, 0, time.UTC)},
+		// The second 01:10, after 01:50 EDT, is EST.
+		{"2020/11/01 01:10:00", time.Date(2020, 11, 1, 6, 10, 0, 0, time.UTC)},
+		{"2020/11/01 01:50:00", time.Date(2020, 11, 1, 6, 50, 0, 0, time.UTC)},
+		{"2020/11/01 02:10:00", time.Date(2020, 11, 1, 7, 10, 0, 0, time.UTC)},
+	} {
+		if got := strptime("a", tc.ts, layout); !got.Equal(tc.expected) {
+			t.Errorf("%s: expected %s, received %s", tc.ts, tc.expected, got)
+		}
+	}
+	// Another log's progress doesn't affect this one.
+	if got, expected := strptime("b", "2020/11/01 01:10:00", layout), time.Date(2020, 11, 1, 5, 10, 0, 0, time.UTC); !got.Equal(expected) {
+		t.Errorf("other log: expected %s, received %s", expected, got)
+	}
+	// A timestamp with its own zone is never moved.
+	if got, expected := strptime("a", "2020/11/01 01:10:00 -0400", layout+" -0700"), time.Date(2020, 11, 1, 5, 10, 0, 0, time.UTC); !got.Equal(expected) {
+		t.Errorf("zoned timestamp: expected %s, received %s", expected, got)
+	}
+	// The logs remembered are limited.
+	for i := 0; i <= maxScopedLogs; i++ {
+		strptime(fmt.Sprintf("log%d", i), "2020/11/01 00:50:00", layout)
+	}
+	if len(vm.lastTimes) > maxScopedLogs {
+		t.Errorf("last times of %d logs remembered", len(vm.lastTimes))
+	}
+}
+
 func TestStrptimeWithoutTimezone(t *testing.T) {
 	obj := &object.Object{Program: []code.Instr{{code.Strptime, 0, 0}}}
 	vm := New("strptimezone", obj, true, nil)
@@ -697,6 +904,204 @@ func TestStrptimeWithoutTimezone(t *testing.T) {
 	}
 }
 
+func TestStrictStrptimeErrors(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		obj := &object.Object{Program: []code.Instr{{code.Strptime, 0, 0}}, Strict: strict}
+		name := fmt.Sprintf("strict_strptime_%v", strict)
+		vm := New(name, obj, true, nil)
+		vm.input = logline.New(context.Background(), "test", "bad")
+		for n := 0; n < 2; n++ {
+			vm.t = new(thread)
+			vm.t.pc = 1
+			vm.t.stack = make([]interface{}, 0)
+			vm.t.Push("not a time")
+			vm.t.Push("2006/01/02 15:04:05")
+			vm.execute(vm.t, obj.Program[0])
+			vm.terminate = false
+		}
+		var errs string
+		if v := progConversionErrors.Get(name); v != nil {
+			errs = v.String()
+		}
+		// Strict mode counts both lines, as the failed parse is not cached.
+		if strict && errs != "2" {
+			t.Errorf("strict conversion errors: expected 2, received %q", errs)
+		}
+		if !strict && errs != "" {
+			t.Errorf("non-strict conversion errors: expected none, received %q", errs)
+		}
+	}
+}
+
+func TestNumberFormat(t *testing.T) {
+	for _, tc := range []struct {
+		decimal, thousands string
+		s                  string
+		want               string
+		wantErr            bool
+	}{
+		{"", "", "1,234.56", "1234.56", false},
+		{"", "", "-1,234", "-1234", false},
+		{"", "", "12", "12", false},
+		{",", "", "1.234,56", "1234.56", false},
+		{"", ".", "1.234,56", "1234.56", false},
+		{",", " ", "1 234 567,8", "1234567.8", false},
+		{",", "'", "-1'234", "-1234", false},
+		{"", "", "1,,234", "", true},
+		{"", "", ",234", "", true},
+		{"", "", "1,234.5,6", "", true},
+		{",", ".", "1.234.", "", true},
+	} {
+		f := newNumberFormat(tc.decimal, tc.thousands)
+		got, err := f.normalize(tc.s)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%+v: normalize(%q) expected error, received %q", f, tc.s, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%+v: normalize(%q) expected %q, received %q, %v", f, tc.s, tc.want, got, err)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		want    float64
+		wantErr bool
+	}{
+		{"1h2m3.5s", 3723.5, false},
+		{"250ms", 0.25, false},
+		{"-2s", -2, false},
+		{"00:01:02", 62, false},
+		{"1:02.5", 62.5, false},
+		{"26:00:00", 93600, false},
+		{"-0:30", -30, false},
+		{"42", 0, true},
+		{"1:60", 0, true},
+		{"1:2:3:4", 0, true},
+		{"1.5:00", 0, true},
+		{"1:+2", 0, true},
+		{"1:NaN", 0, true},
+		{":30", 0, true},
+	} {
+		got, err := parseDuration(tc.s)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseDuration(%q) expected error, received %g", tc.s, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("parseDuration(%q) expected %g, received %g, %v", tc.s, tc.want, got, err)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		want    float64
+		wantErr bool
+	}{
+		{"1048576", 1048576, false},
+		{"200KB", 200000, false},
+		{"1.5GiB", 1.5 * 1024 * 1024 * 1024, false},
+		{"3 MiB", 3 * 1024 * 1024, false},
+		{"10k", 10000, false},
+		{"2T", 2e12, false},
+		{"512b", 512, false},
+		{"1.5", 1.5, false},
+		{"", 0, true},
+		{"GB", 0, true},
+		{"-1KB", 0, true},
+		{"1XB", 0, true},
+		{"1iB", 0, true},
+	} {
+		got, err := parseSize(tc.s)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseSize(%q) expected error, received %g", tc.s, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("parseSize(%q) expected %g, received %g, %v", tc.s, tc.want, got, err)
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	for _, tc := range []struct {
+		p, want string
+	}{
+		{"/", "/"},
+		{"/api/v2/items", "/api/v2/items"},
+		{"/items/42/", "/items/:id/"},
+		{"/blobs/0123456789abcdef0123", "/blobs/:id"},
+		{"/blobs/cafe", "/blobs/cafe"},
+		{"/users/3F2504E0-4F89-11D3-9A0C-0305E82C3301/avatar", "/users/:id/avatar"},
+	} {
+		if got := normalizePath(tc.p); got != tc.want {
+			t.Errorf("normalizePath(%q) expected %q, received %q", tc.p, tc.want, got)
+		}
+	}
+}
+
+func TestClassifyUserAgent(t *testing.T) {
+	for _, tc := range []struct {
+		ua, want string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/86.0.4240.75 Safari/537.36", "browser"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:82.0) Gecko/20100101 Firefox/82.0", "browser"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 14_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0 Mobile/15E148 Safari/604.1", "mobile"},
+		{"Mozilla/5.0 (Linux; Android 10; SM-G973F) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/86.0.4240.75 Mobile Safari/537.36", "mobile"},
+		{"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", "bot"},
+		{"Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/86.0.4240.75 Mobile Safari/537.36 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "bot"},
+		{"curl/7.68.0", "bot"},
+		{"python-requests/2.24.0", "bot"},
+		{"", "other"},
+		{"-", "other"},
+	} {
+		if got := classifyUserAgent(tc.ua); got != tc.want {
+			t.Errorf("classifyUserAgent(%q) expected %q, received %q", tc.ua, tc.want, got)
+		}
+	}
+}
+
+func TestParsefloatWithSeparators(t *testing.T) {
+	obj := &object.Object{Program: []code.Instr{{code.Parsefloat, 1, 0}}, DecimalSeparator: ","}
+	vm := New("parsefloat_separators", obj, true, nil)
+	vm.t = new(thread)
+	vm.t.stack = make([]interface{}, 0)
+	vm.t.Push("-1.234,56")
+	vm.execute(vm.t, obj.Program[0])
+	f, err := vm.t.PopFloat()
+	testutil.FatalIfErr(t, err)
+	if f != -1234.56 {
+		t.Errorf("parsefloat: expected -1234.56, received %g", f)
+	}
+}
+
+func TestRuntimeErrorLogLimit(t *testing.T) {
+	vm := New("error_limit", &object.Object{}, true, nil)
+	var allowed int
+	for n := 0; n < 2**runtimeErrorLogBurst; n++ {
+		if vm.allowErrorLog(3) {
+			allowed++
+		}
+	}
+	if allowed != *runtimeErrorLogBurst {
+		t.Errorf("allowed %d errors from one instruction, expected %d", allowed, *runtimeErrorLogBurst)
+	}
+	// Another instruction has its own limit.
+	if !vm.allowErrorLog(4) {
+		t.Error("first error from another instruction not allowed")
+	}
+}
+
 // code.Instructions with datum retrieve
 func TestDatumFetchInstrs(t *testing.T) {
 	var m []*metrics.Metric
@@ -817,3 +1222,437 @@ func TestTimestampInstr(t *testing.T) {
 		t.Errorf("Expecting timestamp to be %s, was %s", newT, tos)
 	}
 }
+
+type fakeAlerter []alert.Alert
+
+func (f *fakeAlerter) Alert(a alert.Alert) {
+	*f = append(*f, a)
+}
+
+func TestAlertInstr(t *testing.T) {
+	var alerts fakeAlerter
+	v := makeVM(code.Instr{code.Alert, 1, 0}, nil)
+	v.alerter = &alerts
+	v.input.Number = 7
+	v.t.time = time.Unix(37, 0).UTC()
+	v.t.Push("FATAL seen")
+	v.execute(v.t, v.prog[0])
+	if v.terminate {
+		t.Fatal("execution failed, see info log")
+	}
+	expected := fakeAlerter{{Program: "test", Message: "FATAL seen", Filename: testFilename, Line: 7, Time: time.Unix(37, 0).UTC()}}
+	testutil.ExpectNoDiff(t, expected, alerts)
+}
+
+type fakeExecutor [][]string
+
+func (f *fakeExecutor) Exec(program, name string, args []string) error {
+	if name != "restart" {
+		return errors.New("not allowed")
+	}
+	*f = append(*f, append([]string{program, name}, args...))
+	return nil
+}
+
+func TestExecInstr(t *testing.T) {
+	var runs fakeExecutor
+	v := makeVM(code.Instr{code.Exec, 3, 0}, nil)
+	v.executor = &runs
+	v.t.Push("restart")
+	v.t.Push("foo")
+	v.t.Push("now")
+	v.execute(v.t, v.prog[0])
+	if v.terminate {
+		t.Fatal("execution failed, see info log")
+	}
+	testutil.ExpectNoDiff(t, fakeExecutor{{"test", "restart", "foo", "now"}}, runs)
+
+	// A command the executor doesn't allow is a runtime error.
+	v.t.Push("rm")
+	v.t.Push("-rf")
+	v.t.Push("/")
+	v.execute(v.t, v.prog[0])
+	if !v.terminate {
+		t.Error("exec of a disallowed command didn't fail")
+	}
+}
+
+type fakeLocator map[string]string
+
+func (f fakeLocator) Country(ip net.IP) (string, error) {
+	return f[ip.String()], nil
+}
+
+func (f fakeLocator) ASN(ip net.IP) (int64, error) {
+	return 0, errors.New("no ASN database")
+}
+
+func TestGeoIPInstr(t *testing.T) {
+	v := makeVM(code.Instr{code.Geoipcountry, 1, 0}, nil)
+	// Without a locator, the builtins are runtime errors.
+	v.t.Push("192.0.2.1")
+	v.execute(v.t, v.prog[0])
+	if !v.terminate {
+		t.Error("geoip_country without a database didn't fail")
+	}
+
+	v = makeVM(code.Instr{code.Geoipcountry, 1, 0}, nil)
+	v.locator = fakeLocator{"192.0.2.1": "NZ"}
+	v.t.Push("192.0.2.1")
+	v.execute(v.t, v.prog[0])
+	if v.terminate {
+		t.Fatal("execution failed, see info log")
+	}
+	testutil.ExpectNoDiff(t, []interface{}{"NZ"}, v.t.stack)
+
+	v.t.stack = v.t.stack[:0]
+	v.t.Push("not an address")
+	v.execute(v.t, v.prog[0])
+	if !v.terminate {
+		t.Error("geoip_country of an invalid address didn't fail")
+	}
+}
+
+func TestHmacInstr(t *testing.T) {
+	v := makeVM(code.Instr{code.Hmac, 1, 0}, nil)
+	// Without a key, hmac is a runtime error.
+	v.t.Push("what do ya want for nothing?")
+	v.execute(v.t, v.prog[0])
+	if !v.terminate {
+		t.Error("hmac without a key didn't fail")
+	}
+
+	// RFC 4231 test case 2.
+	v = makeVM(code.Instr{code.Hmac, 1, 0}, nil)
+	v.hmacKey = []byte("Jefe")
+	v.t.Push("what do ya want for nothing?")
+	v.execute(v.t, v.prog[0])
+	if v.terminate {
+		t.Fatal("execution failed, see info log")
+	}
+	testutil.ExpectNoDiff(t, []interface{}{"5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"}, v.t.stack)
+}
+
+func TestSampleInstr(t *testing.T) {
+	obj := &object.Object{
+		Program: []code.Instr{{code.Sample, 0, 0}},
+		Samples: []object.Sample{{Rate: 3, Line: 4}},
+	}
+	v := New("sample", obj, true, nil)
+	v.t = new(thread)
+	var got []interface{}
+	for n := 0; n < 5; n++ {
+		v.execute(v.t, v.prog[0])
+		got = append(got, v.t.Pop())
+	}
+	testutil.ExpectNoDiff(t, []interface{}{true, false, false, true, false}, got)
+	if s := progSampleSkips.Get("sample"); s == nil || s.String() != "3" {
+		t.Errorf("sample skips: expected 3, received %v", s)
+	}
+	rates, ok := progSampleRates.Get("sample").(*expvar.Map)
+	if !ok || rates.Get("5") == nil || rates.Get("5").String() != "3" {
+		t.Errorf("sample rates: expected {\"5\": 3}, received %v", rates)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for _, tc := range []struct {
+		s, want string
+	}{
+		{"user jane.doe+tag@mail.example.org logged in", "user [email] logged in"},
+		{"client 10.1.2.3:8080", "client [ip]:8080"},
+		{"from 2001:db8::1 and fe80:0:0:0:200:f8ff:fe21:67cf", "from [ip] and [ip]"},
+		{"call 555-123-4567 or +44 20 7946 0958", "call [number] or +44 [number]"},
+		{"account 123456789", "account [number]"},
+		{"card 4111 1111 1111 1111", "card [number]"},
+		{"at 2020-11-01 12:34:56 in Foo::Bar", "at 2020-11-01 12:34:56 in Foo::Bar"},
+		{"request 12345 took 250ms", "request 12345 took 250ms"},
+	} {
+		if got := redact(tc.s); got != tc.want {
+			t.Errorf("redact(%q) expected %q, received %q", tc.s, tc.want, got)
+		}
+	}
+}
+
+func TestTimestampBounds(t *testing.T) {
+	future := time.Now().Add(48 * time.Hour).UTC()
+	for _, tc := range []struct {
+		policy        TimestampPolicy
+		expectedValue string
+		clamped       string
+		dropped       string
+	}{
+		{AcceptTimestamps, "1", "", ""},
+		{ClampTimestamps, "1", "1", ""},
+		{DropTimestamps, "0", "", "1"},
+	} {
+		tc := tc
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			m := []*metrics.Metric{metrics.NewMetric("a", "tst", metrics.Gauge, metrics.Int)}
+			v := makeVM(code.Instr{code.Iset, nil, 0}, m)
+			v.name = "bounds_" + tc.policy.String()
+			v.timestampBounds = timestampBounds{tc.policy, time.Hour, time.Hour}
+			d, err := m[0].GetDatum()
+			testutil.FatalIfErr(t, err)
+			v.t.time = future
+			v.t.Push(d)
+			v.t.Push(int64(1))
+			v.execute(v.t, v.prog[0])
+			if v.terminate {
+				t.Fatal("execution failed, see info log")
+			}
+			if d.ValueString() != tc.expectedValue {
+				t.Errorf("Unexpected value %v", d)
+			}
+			if tc.policy == ClampTimestamps && !d.TimeUTC().Before(future.Add(-time.Hour)) {
+				t.Errorf("timestamp %s not clamped", d.TimeUTC())
+			}
+			if tc.policy == AcceptTimestamps && !d.TimeUTC().Equal(future) {
+				t.Errorf("timestamp %s, expected %s", d.TimeUTC(), future)
+			}
+			var clamped, dropped string
+			if c := progTimestampsClamped.Get(v.name); c != nil {
+				clamped = c.String()
+			}
+			if c := progTimestampsDropped.Get(v.name); c != nil {
+				dropped = c.String()
+			}
+			if clamped != tc.clamped || dropped != tc.dropped {
+				t.Errorf("clamped %q dropped %q, expected %q and %q", clamped, dropped, tc.clamped, tc.dropped)
+			}
+		})
+	}
+}
+
+func TestParseTimestampPolicy(t *testing.T) {
+	for _, p := range []TimestampPolicy{AcceptTimestamps, ClampTimestamps, DropTimestamps} {
+		r, err := ParseTimestampPolicy(p.String())
+		testutil.FatalIfErr(t, err)
+		if r != p {
+			t.Errorf("parsed %q as %v", p, r)
+		}
+	}
+	if _, err := ParseTimestampPolicy("ignore"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+func TestIntOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		policy        OverflowPolicy
+		opcode        code.Opcode
+		start         int64
+		expectedValue int64
+	}{
+		{WrapOverflow, code.Inc, math.MaxInt64, math.MinInt64},
+		{WrapOverflow, code.Dec, math.MinInt64, math.MaxInt64},
+		{SaturateOverflow, code.Inc, math.MaxInt64, math.MaxInt64},
+		{SaturateOverflow, code.Dec, math.MinInt64, math.MinInt64},
+	} {
+		tc := tc
+		t.Run(fmt.Sprintf("%s %s", tc.policy, tc.opcode), func(t *testing.T) {
+			m := []*metrics.Metric{metrics.NewMetric("a", "tst", metrics.Counter, metrics.Int)}
+			v := makeVM(code.Instr{tc.opcode, nil, 0}, m)
+			v.name = fmt.Sprintf("overflow_%s_%s", tc.policy, tc.opcode)
+			v.overflowPolicy = tc.policy
+			d, err := m[0].GetDatum()
+			testutil.FatalIfErr(t, err)
+			datum.SetInt(d, tc.start, time.Now())
+			v.t.Push(d)
+			v.execute(v.t, v.prog[0])
+			if v.terminate {
+				t.Fatal("execution failed, see info log")
+			}
+			if r := datum.GetInt(d); r != tc.expectedValue {
+				t.Errorf("value %d, expected %d", r, tc.expectedValue)
+			}
+			if c := progIntOverflows.Get(v.name); c == nil || c.String() != "1" {
+				t.Errorf("overflows %v, expected 1", c)
+			}
+		})
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, p := range []OverflowPolicy{WrapOverflow, SaturateOverflow} {
+		r, err := ParseOverflowPolicy(p.String())
+		testutil.FatalIfErr(t, err)
+		if r != p {
+			t.Errorf("parsed %q as %v", p, r)
+		}
+	}
+	if _, err := ParseOverflowPolicy("clamp"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+func TestProfile(t *testing.T) {
+	obj := &object.Object{Program: []code.Instr{
+		{code.Push, int64(1), 0},
+		{code.Push, int64(2), 1},
+		{code.Iadd, nil, 1},
+	}}
+	v := New("profile", obj, true, nil)
+	v.EnableProfile()
+	for n := 0; n < 3; n++ {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "a"))
+	}
+	p := v.Profile()
+	if len(p) != 2 {
+		t.Fatalf("expected two source lines in profile, received %v", p)
+	}
+	if p[0].SourceLine != 1 || p[0].Executions != 3 {
+		t.Errorf("unexpected profile for line 1: %+v", p[0])
+	}
+	if p[1].SourceLine != 2 || p[1].Executions != 6 {
+		t.Errorf("unexpected profile for line 2: %+v", p[1])
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	src := "counter a\n/a/ {\n  a++\n} else {\n  a++\n}\n"
+	expected := []LineCoverage{
+		{SourceLine: 2, Executions: 3, Condition: true, Matches: 2},
+		{SourceLine: 3, Executions: 2},
+		{SourceLine: 5, Executions: 1},
+	}
+	// Coverage is recorded whether or not the program is profiled too.
+	for _, profile := range []bool{false, true} {
+		v, err := Compile("coverage", strings.NewReader(src), CompileOptions{SyslogUseCurrentYear: true})
+		testutil.FatalIfErr(t, err)
+		v.EnableCoverage([]byte(src))
+		if profile {
+			v.EnableProfile()
+		}
+		for _, line := range []string{"a", "b", "ba"} {
+			v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+		}
+		testutil.ExpectNoDiff(t, expected, v.Coverage())
+	}
+}
+
+func TestRegexPragmas(t *testing.T) {
+	src := "syntax = \"v2\"\npragma case_insensitive\npragma unicode_classes\ncounter a\n/^error: \\w+$/ {\n  a++\n}\n"
+	v, err := Compile("regex_pragmas", strings.NewReader(src), CompileOptions{SyslogUseCurrentYear: true})
+	testutil.FatalIfErr(t, err)
+	v.EnableCoverage([]byte(src))
+	for _, line := range []string{"ERROR: café", "Error: naïve", "error: two words"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	expected := []LineCoverage{
+		{SourceLine: 5, Executions: 3, Condition: true, Matches: 2},
+		{SourceLine: 6, Executions: 2},
+	}
+	testutil.ExpectNoDiff(t, expected, v.Coverage())
+}
+
+func TestBacktrackingPatterns(t *testing.T) {
+	src := "counter repeats by word\ncounter total\n/(*PCRE)\\b(?P<word>\\w+) \\k<word>\\b/ {\n  repeats[$word]++\n}\n/(*PCRE)(?<=took )(\\d+)(?=ms)/ {\n  total += $1\n}\n"
+	v, err := Compile("backtracking", strings.NewReader(src), CompileOptions{SyslogUseCurrentYear: true})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{"the the request took 12ms", "then the end took 3ms", "took 7s"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	testutil.ExpectNoDiff(t, "", v.RuntimeErrorString())
+	repeats, err := v.m[0].GetDatum("the")
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, int64(1), datum.GetInt(repeats))
+	total, err := v.m[1].GetDatum()
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, int64(15), datum.GetInt(total))
+}
+
+func TestGrokPatterns(t *testing.T) {
+	src := "counter bytes_total by verb\n/^%{COMMONAPACHELOG}$/ {\n  bytes_total[$verb] += $bytes\n}\n"
+	v, err := Compile("grok", strings.NewReader(src), CompileOptions{SyslogUseCurrentYear: true})
+	testutil.FatalIfErr(t, err)
+	for _, line := range []string{
+		`192.0.2.1 - - [10/Oct/2000:13:55:36 -0700] "GET /a.gif HTTP/1.0" 200 2326`,
+		`192.0.2.1 - - [10/Oct/2000:13:55:37 -0700] "GET /b.gif HTTP/1.0" 200 100`,
+		`192.0.2.1 - - [10/Oct/2000:13:55:38 -0700] "POST /c HTTP/1.0" 201 7`,
+	} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	testutil.ExpectNoDiff(t, "", v.RuntimeErrorString())
+	d, err := v.m[0].GetDatum("GET")
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, int64(2426), datum.GetInt(d))
+}
+
+func TestBacktrackingStepLimit(t *testing.T) {
+	src := "counter a\n/(*PCRE)^(a|aa)+$/ {\n  a++\n}\n"
+	v, err := Compile("backtracking_step_limit", strings.NewReader(src), CompileOptions{SyslogUseCurrentYear: true})
+	testutil.FatalIfErr(t, err)
+	v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", strings.Repeat("a", 100)+"b"))
+	if n := progBacktrackingStepLimits.Get("backtracking_step_limit"); n == nil || n.String() != "1" {
+		t.Errorf("step limits: expected 1, received %v", n)
+	}
+	if v.RuntimeErrorString() == "" {
+		t.Error("expected a runtime error to be recorded")
+	}
+}
+
+func TestRuntimePanicRecovered(t *testing.T) {
+	// Iadd on an empty stack underflows it, which panics.
+	obj := &object.Object{Program: []code.Instr{{code.Iadd, nil, 0}}}
+	v := New("runtime_panic", obj, true, nil)
+	for n := 0; n < 2; n++ {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "a"))
+		if v.terminate {
+			t.Fatalf("line %d: terminate not reset after panic", n)
+		}
+	}
+	if p := progRuntimePanics.Get("runtime_panic"); p == nil || p.String() != "2" {
+		t.Errorf("runtime panics: expected 2, received %v", p)
+	}
+	if v.RuntimeErrorString() == "" {
+		t.Error("expected a runtime error to be recorded")
+	}
+}
+
+func TestLineWritten(t *testing.T) {
+	end := time.Now()
+	read := end.Add(-time.Second)
+	written := end.Add(-time.Minute)
+	for _, tc := range []struct {
+		name     string
+		line     logline.LogLine
+		expected time.Time
+	}{
+		{"not from a tailer", logline.LogLine{}, time.Time{}},
+		{"no modification time", logline.LogLine{IngestTime: read}, read},
+		{"modification time", logline.LogLine{IngestTime: read, WriteTime: written}, written},
+		{"skewed modification time", logline.LogLine{IngestTime: read, WriteTime: end.Add(time.Minute)}, read},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.ExpectNoDiff(t, tc.expected, lineWritten(&tc.line, end))
+		})
+	}
+}
+
+// lineLatencyCount returns the number of lines observed in the latency
+// histogram of prog, and their total latency.
+func lineLatencyCount(t *testing.T, prog string) (uint64, float64) {
+	t.Helper()
+	m := &dto.Metric{}
+	testutil.FatalIfErr(t, lineLatencies.WithLabelValues(prog).(prometheus.Histogram).Write(m))
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestLineLatency(t *testing.T) {
+	obj := &object.Object{Program: []code.Instr{}}
+	v := New("line_latency", obj, true, nil)
+	ctx := context.Background()
+	count, sum := lineLatencyCount(t, "line_latency")
+	// Lines that weren't read by a tailer aren't observed.
+	v.ProcessLogLine(ctx, logline.New(ctx, "test", "a"))
+	ll := logline.New(ctx, "test", "b")
+	ll.IngestTime = time.Now().Add(-time.Minute)
+	v.ProcessLogLine(ctx, ll)
+	newCount, newSum := lineLatencyCount(t, "line_latency")
+	testutil.ExpectNoDiff(t, count+1, newCount)
+	if l := newSum - sum; l < 60 || l > 120 {
+		t.Errorf("latency %vs, expected about a minute", l)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/pkg/errors"
+)
+
+// w3cFieldsDirective starts the line of a W3C extended log, like those written
+// by IIS, that names the fields of the lines after it.
+const w3cFieldsDirective = "#Fields:"
+
+// readW3CDirective records the field names given by line, if it is a #Fields
+// directive.  A log's directive is repeated whenever its fields change, and at
+// the top of each new file after a rotation, so the latest one for the log
+// applies to the lines that follow.  The fields of the logs read least
+// recently are forgotten once maxScopedLogs logs have them.
+func (v *VM) readW3CDirective(line *logline.LogLine) {
+	if !strings.HasPrefix(line.Line, w3cFieldsDirective) {
+		return
+	}
+	v.w3cFields.Add(line.Filename, strings.Fields(line.Line[len(w3cFieldsDirective):]))
+}
+
+// w3cField returns the value of the field called name in the current line,
+// or the empty string if the log has no such field or the line is a
+// directive.
+func (v *VM) w3cField(name string) (string, error) {
+	f, ok := v.w3cFields.Get(v.input.Filename)
+	if !ok {
+		return "", errors.Errorf("no %s directive yet in %q", w3cFieldsDirective, v.input.Filename)
+	}
+	fields := f.([]string)
+	if strings.HasPrefix(v.input.Line, "#") {
+		return "", nil
+	}
+	if v.w3cLine != v.input {
+		v.w3cValues = splitW3C(v.input.Line)
+		v.w3cLine = v.input
+	}
+	for i, f := range fields {
+		if f == name {
+			if i < len(v.w3cValues) {
+				return v.w3cValues[i], nil
+			}
+			break
+		}
+	}
+	return "", nil
+}
+
+// splitW3C splits a line of a W3C extended log into its values, which are
+// separated by spaces.  A value may be a quoted string, which is returned
+// without its quotes and with each "" inside it replaced by ".
+func splitW3C(s string) []string {
+	var values []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return values
+		}
+		if s[0] != '"' {
+			i := strings.IndexAny(s, " \t")
+			if i < 0 {
+				return append(values, s)
+			}
+			values = append(values, s[:i])
+			s = s[i:]
+			continue
+		}
+		var b strings.Builder
+		i := 1
+		for ; i < len(s); i++ {
+			if s[i] == '"' {
+				if i+1 < len(s) && s[i+1] == '"' {
+					i++
+				} else {
+					break
+				}
+			}
+			b.WriteByte(s[i])
+		}
+		values = append(values, b.String())
+		if i >= len(s) {
+			return values
+		}
+		s = s[i+1:]
+	}
+}
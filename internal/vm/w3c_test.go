@@ -0,0 +1,76 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestSplitW3C(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected []string
+	}{
+		{"", nil},
+		{"2020-10-14 12:00:01 GET /a 200", []string{"2020-10-14", "12:00:01", "GET", "/a", "200"}},
+		{`GET  "Mozilla/5.0 (X11)" - "say ""hi""" ""`, []string{"GET", "Mozilla/5.0 (X11)", "-", `say "hi"`, ""}},
+		{`a "unterminated b`, []string{"a", "unterminated b"}},
+	} {
+		testutil.ExpectNoDiff(t, tc.expected, splitW3C(tc.input))
+	}
+}
+
+func TestW3CFields(t *testing.T) {
+	src := "syntax = \"v2\"\ncounter requests by path, status\n/^[^#]/ {\n  requests[w3c(\"cs-uri-stem\")][w3c(\"sc-status\")]++\n}\n"
+	v, err := Compile("w3c", strings.NewReader(src), CompileOptions{SyslogUseCurrentYear: true})
+	testutil.FatalIfErr(t, err)
+	for _, l := range []struct{ filename, line string }{
+		{"u_ex1.log", "#Software: Microsoft Internet Information Services 10.0"},
+		{"u_ex1.log", "#Fields: date time cs-method cs-uri-stem sc-status"},
+		{"u_ex1.log", "2020-10-14 12:00:01 GET /a 200"},
+		{"u_ex2.log", "#Fields: sc-status cs-uri-stem"},
+		{"u_ex2.log", "404 /b"},
+		// The first log is rotated, and its new file logs fewer fields.
+		{"u_ex1.log", "#Fields: date cs-uri-stem sc-status"},
+		{"u_ex1.log", "2020-10-15 /a 200"},
+	} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), l.filename, l.line))
+	}
+	testutil.ExpectNoDiff(t, "", v.RuntimeErrorString())
+	for _, tc := range []struct {
+		path, status string
+		expected     int64
+	}{
+		{"/a", "200", 2},
+		{"/b", "404", 1},
+	} {
+		d, err := v.m[0].GetDatum(tc.path, tc.status)
+		testutil.FatalIfErr(t, err)
+		testutil.ExpectNoDiff(t, tc.expected, datum.GetInt(d))
+	}
+
+	v.ProcessLogLine(context.Background(), logline.New(context.Background(), "other.log", "GET /c 200"))
+	if v.RuntimeErrorString() == "" {
+		t.Error("expected a runtime error for a log without a #Fields directive")
+	}
+
+	// The fields of the logs read least recently are forgotten.
+	for i := 0; i < maxScopedLogs-1; i++ {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), fmt.Sprintf("u_ex%d.log", i+3), "#Fields: cs-uri-stem sc-status"))
+	}
+	testutil.ExpectNoDiff(t, maxScopedLogs, v.w3cFields.Len())
+	if _, ok := v.w3cFields.Get("u_ex2.log"); ok {
+		t.Error("fields of the log read least recently remembered")
+	}
+	if _, ok := v.w3cFields.Get("u_ex1.log"); !ok {
+		t.Error("fields of a log read since forgotten")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package wasm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// The value types of WebAssembly.
+const (
+	i32 byte = 0x7f
+	i64 byte = 0x7e
+	f64 byte = 0x7c
+)
+
+// The WebAssembly instructions the compiler emits.
+const (
+	opBlock      byte = 0x02
+	opEnd        byte = 0x0b
+	opBr         byte = 0x0c
+	opBrIf       byte = 0x0d
+	opReturn     byte = 0x0f
+	opCall       byte = 0x10
+	opLocalGet   byte = 0x20
+	opLocalSet   byte = 0x21
+	opI32Const   byte = 0x41
+	opI64Const   byte = 0x42
+	opF64Const   byte = 0x44
+	opI32Eqz     byte = 0x45
+	opI64Eqz     byte = 0x50
+	opI64Eq      byte = 0x51
+	opI64LtS     byte = 0x53
+	opI64GtS     byte = 0x55
+	opF64Eq      byte = 0x61
+	opF64Lt      byte = 0x63
+	opF64Gt      byte = 0x64
+	opI64Add     byte = 0x7c
+	opI64Sub     byte = 0x7d
+	opI64Mul     byte = 0x7e
+	opI64And     byte = 0x83
+	opI64Or      byte = 0x84
+	opI64Xor     byte = 0x85
+	opF64Add     byte = 0xa0
+	opF64Sub     byte = 0xa1
+	opF64Mul     byte = 0xa2
+	opF64Div     byte = 0xa3
+	opF64Convert byte = 0xb9 // f64.convert_i64_s
+
+	blockEmpty byte = 0x40 // The block type of a block without results.
+)
+
+// The ids of the sections of a module.
+const (
+	sectionType     byte = 1
+	sectionImport   byte = 2
+	sectionFunction byte = 3
+	sectionExport   byte = 7
+	sectionCode     byte = 10
+)
+
+// encoder appends the binary encoding of WebAssembly values to a buffer.
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) u32(n uint32) {
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n != 0 {
+			b |= 0x80
+		}
+		e.WriteByte(b)
+		if n == 0 {
+			return
+		}
+	}
+}
+
+func (e *encoder) s64(n int64) {
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if (n == 0 && b&0x40 == 0) || (n == -1 && b&0x40 != 0) {
+			e.WriteByte(b)
+			return
+		}
+		e.WriteByte(b | 0x80)
+	}
+}
+
+func (e *encoder) f64(f float64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+	e.Write(b[:])
+}
+
+func (e *encoder) name(s string) {
+	e.u32(uint32(len(s)))
+	e.WriteString(s)
+}
+
+// op appends an instruction with an index or a constant as its immediate.
+func (e *encoder) op(op byte, imm uint32) {
+	e.WriteByte(op)
+	e.u32(imm)
+}
+
+// section appends the section id, with contents written by body.
+func (e *encoder) section(id byte, body func(*encoder)) {
+	var s encoder
+	body(&s)
+	e.WriteByte(id)
+	e.u32(uint32(s.Len()))
+	e.Write(s.Bytes())
+}
+
+// funcType is the signature of a function.
+type funcType struct {
+	params, results string // The value types, one per byte.
+}
+
+// funcType appends the signature t; a vector of value types is encoded like
+// a name.
+func (e *encoder) funcType(t funcType) {
+	e.WriteByte(0x60)
+	e.name(t.params)
+	e.name(t.results)
+}
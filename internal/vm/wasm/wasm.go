@@ -0,0 +1,504 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package wasm compiles the bytecode of mtail programs to WebAssembly modules,
+// so that programs that aren't trusted can be run in a sandbox.  It is
+// experimental.
+//
+// A module exports one function, process, that runs the program on the line
+// being processed.  The control flow, the matched flag, and the arithmetic and
+// comparisons of integers and floats are compiled to WebAssembly, and every
+// other instruction is executed by the host, through a function imported from
+// the module "mtail".  Each import takes the program counter of the
+// instruction to execute followed by the values it pops, and returns the value
+// it pushes, if any.  It is named "exec_" followed by the kinds of its
+// arguments, an underscore, and the kind of its result, so that the host can
+// provide it however many the module imports.
+//
+// The module has no memory.  Strings and datums are handles to values held by
+// the host, the string constants of the program being the first handles to
+// strings, and metrics are their index in the program.
+package wasm
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/mtail/internal/vm/code"
+	"github.com/google/mtail/internal/vm/flow"
+	"github.com/google/mtail/internal/vm/object"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ImportModule is the module the host instructions are imported from.
+	ImportModule = "mtail"
+	// ProcessFunction is the function the program is run by, once per line.
+	ProcessFunction = "process"
+
+	importPrefix = "exec_"
+)
+
+// valueType returns the WebAssembly type that values of kind k are passed as:
+// an i64 for integers and durations, an f64 for floats, and an i32 for bools,
+// 0 or 1, and for handles and metrics.
+func valueType(k flow.Kind) byte {
+	switch k {
+	case flow.Int, flow.Index, flow.Duration:
+		return i64
+	case flow.Float:
+		return f64
+	}
+	return i32
+}
+
+// importName returns the name of the import executing instructions that pop
+// args and push result, or no result if it is zero.
+func importName(args []flow.Kind, result flow.Kind) string {
+	var b strings.Builder
+	b.WriteString(importPrefix)
+	for _, k := range args {
+		b.WriteByte(byte(k))
+	}
+	b.WriteByte('_')
+	if result != 0 {
+		b.WriteByte(byte(result))
+	}
+	return b.String()
+}
+
+// ParseImport returns the kinds of the arguments and result of the host
+// instructions executed by the import called name.  The result is zero if
+// they push nothing.
+func ParseImport(name string) (args []flow.Kind, result flow.Kind, err error) {
+	s := strings.TrimPrefix(name, importPrefix)
+	i := strings.IndexByte(s, '_')
+	if s == name || i < 0 || len(s) > i+2 {
+		return nil, 0, errors.Errorf("unknown import %q", name)
+	}
+	for _, k := range []byte(s[:i]) {
+		if !flow.Kind(k).Valid() {
+			return nil, 0, errors.Errorf("unknown kind %q in import %q", k, name)
+		}
+		args = append(args, flow.Kind(k))
+	}
+	if len(s) == i+2 {
+		result = flow.Kind(s[i+1])
+		if !result.Valid() {
+			return nil, 0, errors.Errorf("unknown kind %q in import %q", result, name)
+		}
+	}
+	return args, result, nil
+}
+
+// matchedLocal is the local holding the matched flag.
+const matchedLocal = 0
+
+// slot is a position on the stack holding values of one WebAssembly type, and
+// is kept in a local.
+type slot struct {
+	depth     int
+	valueType byte
+}
+
+// compiler translates the program of an object to the body of the process
+// function.  The stack of the program is kept in locals, by position and type,
+// so that the WebAssembly operand stack is empty between instructions and
+// every block is without parameters or results.
+type compiler struct {
+	prog []code.Instr
+	flow *flow.Flow
+
+	// Each jump target ends a block opened at the start of the function, so
+	// that a br to it is a jump forward to the target.
+	next int // The index in the targets of the flow of the innermost open block.
+
+	stack []flow.Kind // The kinds of the values on the stack.
+
+	locals     map[slot]uint32
+	localTypes []byte // The type of each local.
+
+	imports     []string
+	importIndex map[string]uint32
+
+	body encoder
+}
+
+// Compile returns the binary form of the WebAssembly module that runs the
+// program of obj.  Its string constants and metrics are those of obj.
+func Compile(obj *object.Object) ([]byte, error) {
+	f, err := flow.Analyze(obj.Program)
+	if err != nil {
+		return nil, err
+	}
+	c := &compiler{
+		prog:        obj.Program,
+		flow:        f,
+		locals:      make(map[slot]uint32),
+		localTypes:  []byte{i32},
+		importIndex: make(map[string]uint32),
+	}
+	for pc, i := range c.prog {
+		c.label(pc)
+		if !f.Reachable[pc] {
+			continue
+		}
+		c.stack = append(c.stack[:0], f.Stacks[pc]...)
+		if err := c.instr(pc, i); err != nil {
+			return nil, errors.Errorf("instruction %d {%s, %v} from line %d can't be compiled: %s", pc, i.Opcode, i.Operand, i.SourceLine+1, err)
+		}
+	}
+	c.label(len(c.prog))
+	return c.module(), nil
+}
+
+// label ends the block of the jumps to pc, if it's a target.
+func (c *compiler) label(pc int) {
+	if c.next >= len(c.flow.Targets) || c.flow.Targets[c.next] != pc {
+		return
+	}
+	c.body.WriteByte(opEnd)
+	c.next++
+}
+
+// depth returns the label index of a br to target.
+func (c *compiler) depth(target int) uint32 {
+	return uint32(sort.SearchInts(c.flow.Targets, target) - c.next)
+}
+
+// local returns the local holding the value of kind k at depth on the stack.
+func (c *compiler) local(depth int, k flow.Kind) uint32 {
+	s := slot{depth, valueType(k)}
+	l, ok := c.locals[s]
+	if !ok {
+		l = uint32(len(c.localTypes))
+		c.locals[s] = l
+		c.localTypes = append(c.localTypes, s.valueType)
+	}
+	return l
+}
+
+// push returns the local to set to a value of kind k pushed on the stack.
+func (c *compiler) push(k flow.Kind) uint32 {
+	l := c.local(len(c.stack), k)
+	c.stack = append(c.stack, k)
+	return l
+}
+
+// pop returns the kind of the value on top of the stack and its local.
+func (c *compiler) pop() (flow.Kind, uint32, error) {
+	if len(c.stack) == 0 {
+		return 0, 0, errors.New("the stack is empty")
+	}
+	k := c.stack[len(c.stack)-1]
+	c.stack = c.stack[:len(c.stack)-1]
+	return k, c.local(len(c.stack), k), nil
+}
+
+// top returns whether the values on top of the stack are of kinds, the last
+// being the top.
+func (c *compiler) top(kinds ...flow.Kind) bool {
+	if len(c.stack) < len(kinds) {
+		return false
+	}
+	for i, k := range c.stack[len(c.stack)-len(kinds):] {
+		if k != kinds[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *compiler) get(l uint32) {
+	c.body.op(opLocalGet, l)
+}
+
+func (c *compiler) set(l uint32) {
+	c.body.op(opLocalSet, l)
+}
+
+func (c *compiler) i32(n int64) {
+	c.body.WriteByte(opI32Const)
+	c.body.s64(n)
+}
+
+func (c *compiler) i64(n int64) {
+	c.body.WriteByte(opI64Const)
+	c.body.s64(n)
+}
+
+func (c *compiler) instr(pc int, i code.Instr) error {
+	switch i.Opcode {
+	case code.Push:
+		switch v := i.Operand.(type) {
+		case int64:
+			c.i64(v)
+			c.set(c.push(flow.Int))
+		case int:
+			c.i64(int64(v))
+			c.set(c.push(flow.Index))
+		case time.Duration:
+			c.i64(int64(v))
+			c.set(c.push(flow.Duration))
+		case float64:
+			c.body.WriteByte(opF64Const)
+			c.body.f64(v)
+			c.set(c.push(flow.Float))
+		case bool:
+			c.i32(boolValue(v))
+			c.set(c.push(flow.Bool))
+		default:
+			return errors.Errorf("can't push a %T", i.Operand)
+		}
+
+	case code.Str:
+		c.i32(int64(i.Operand.(int)))
+		c.set(c.push(flow.String))
+
+	case code.Mload:
+		c.i32(int64(i.Operand.(int)))
+		c.set(c.push(flow.Metric))
+
+	case code.Setmatched:
+		c.i32(boolValue(i.Operand.(bool)))
+		c.set(matchedLocal)
+
+	case code.Otherwise:
+		c.get(matchedLocal)
+		c.body.WriteByte(opI32Eqz)
+		c.set(c.push(flow.Bool))
+
+	case code.Jnm, code.Jm:
+		k, l, err := c.pop()
+		if err != nil {
+			return err
+		}
+		c.get(l)
+		switch k {
+		case flow.Bool:
+			if i.Opcode == code.Jnm {
+				c.body.WriteByte(opI32Eqz)
+			}
+		case flow.Int:
+			c.body.WriteByte(opI64Eqz)
+			if i.Opcode == code.Jm {
+				c.body.WriteByte(opI32Eqz)
+			}
+		default:
+			return errors.Errorf("can't jump on a value of kind %q", k)
+		}
+		c.body.op(opBrIf, c.depth(i.Operand.(int)))
+
+	case code.Jmp:
+		c.body.op(opBr, c.depth(i.Operand.(int)))
+
+	case code.Stop:
+		c.body.WriteByte(opReturn)
+
+	default:
+		if c.native(i) {
+			return nil
+		}
+		return c.host(pc, i)
+	}
+	return nil
+}
+
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// binaryOps are the instructions compiled to WebAssembly when both their
+// operands are of the kind given.
+var binaryOps = map[code.Opcode]struct {
+	kind flow.Kind
+	op   byte
+}{
+	code.Iadd: {flow.Int, opI64Add},
+	code.Isub: {flow.Int, opI64Sub},
+	code.Imul: {flow.Int, opI64Mul},
+	code.And:  {flow.Int, opI64And},
+	code.Or:   {flow.Int, opI64Or},
+	code.Xor:  {flow.Int, opI64Xor},
+	code.Fadd: {flow.Float, opF64Add},
+	code.Fsub: {flow.Float, opF64Sub},
+	code.Fmul: {flow.Float, opF64Mul},
+	code.Fdiv: {flow.Float, opF64Div},
+}
+
+// compareOps are the comparisons of each kind, by the operand of a compare
+// instruction.
+var compareOps = map[flow.Kind]map[int]byte{
+	flow.Int:   {-1: opI64LtS, 0: opI64Eq, 1: opI64GtS},
+	flow.Float: {-1: opF64Lt, 0: opF64Eq, 1: opF64Gt},
+}
+
+// native compiles i to WebAssembly if its operands are of kinds it can be, and
+// returns whether it did.  Division, shifts and powers, which are checked or
+// differ at the limits, are executed by the host.
+func (c *compiler) native(i code.Instr) bool {
+	if b, ok := binaryOps[i.Opcode]; ok && c.top(b.kind, b.kind) {
+		c.compute(b.op, b.kind, b.kind, b.kind)
+		return true
+	}
+	switch i.Opcode {
+	case code.Cmp, code.Icmp, code.Fcmp:
+		for _, k := range []flow.Kind{flow.Int, flow.Float} {
+			if (i.Opcode == code.Icmp && k != flow.Int) || (i.Opcode == code.Fcmp && k != flow.Float) || !c.top(k, k) {
+				continue
+			}
+			op, ok := compareOps[k][i.Operand.(int)]
+			if !ok {
+				return false
+			}
+			c.compute(op, flow.Bool, k, k)
+			return true
+		}
+
+	case code.Neg:
+		if c.top(flow.Int) {
+			// Bitwise not, as x xor -1.
+			c.i64(-1)
+			c.compute(opI64Xor, flow.Int, flow.Int)
+			return true
+		}
+
+	case code.Not:
+		if c.top(flow.Bool) {
+			c.compute(opI32Eqz, flow.Bool, flow.Bool)
+			return true
+		}
+
+	case code.I2f:
+		if c.top(flow.Int) {
+			c.compute(opF64Convert, flow.Float, flow.Int)
+			return true
+		}
+	}
+	return false
+}
+
+// compute compiles an instruction that pops values of the kinds of operands,
+// the last being the top, and pushes one of kind result computed from them
+// by op.  Any constant operand of op is emitted before.
+func (c *compiler) compute(op byte, result flow.Kind, operands ...flow.Kind) {
+	locals := make([]uint32, len(operands))
+	for j := len(operands) - 1; j >= 0; j-- {
+		_, locals[j], _ = c.pop()
+	}
+	for _, l := range locals {
+		c.get(l)
+	}
+	c.body.WriteByte(op)
+	c.set(c.push(result))
+}
+
+// host compiles a call of the import that executes i on the host.
+func (c *compiler) host(pc int, i code.Instr) error {
+	pops, result, err := flow.Effect(i, c.stack)
+	if err != nil {
+		return err
+	}
+	if len(c.stack) < pops {
+		return errors.Errorf("the stack has %d values, not the %d popped", len(c.stack), pops)
+	}
+	base := len(c.stack) - pops
+	args := append([]flow.Kind(nil), c.stack[base:]...)
+	c.i32(int64(pc))
+	for d, k := range args {
+		c.get(c.local(base+d, k))
+	}
+	c.body.op(opCall, c.importFunc(importName(args, result)))
+	c.stack = c.stack[:base]
+	if result != 0 {
+		c.set(c.push(result))
+	}
+	return nil
+}
+
+// importFunc returns the index of the imported function called name.
+func (c *compiler) importFunc(name string) uint32 {
+	f, ok := c.importIndex[name]
+	if !ok {
+		f = uint32(len(c.imports))
+		c.importIndex[name] = f
+		c.imports = append(c.imports, name)
+	}
+	return f
+}
+
+// module returns the binary form of the module.
+func (c *compiler) module() []byte {
+	var types []funcType
+	typeIndex := make(map[funcType]uint32)
+	typeOf := func(t funcType) uint32 {
+		i, ok := typeIndex[t]
+		if !ok {
+			i = uint32(len(types))
+			typeIndex[t] = i
+			types = append(types, t)
+		}
+		return i
+	}
+	process := typeOf(funcType{})
+	importTypes := make([]uint32, len(c.imports))
+	for f, name := range c.imports {
+		args, result, _ := ParseImport(name)
+		t := funcType{params: string(i32)}
+		for _, k := range args {
+			t.params += string(valueType(k))
+		}
+		if result != 0 {
+			t.results = string(valueType(result))
+		}
+		importTypes[f] = typeOf(t)
+	}
+
+	var m encoder
+	m.WriteString("\x00asm\x01\x00\x00\x00")
+	m.section(sectionType, func(e *encoder) {
+		e.u32(uint32(len(types)))
+		for _, t := range types {
+			e.funcType(t)
+		}
+	})
+	m.section(sectionImport, func(e *encoder) {
+		e.u32(uint32(len(c.imports)))
+		for f, name := range c.imports {
+			e.name(ImportModule)
+			e.name(name)
+			e.op(0x00, importTypes[f]) // A function of the type.
+		}
+	})
+	m.section(sectionFunction, func(e *encoder) {
+		e.u32(1)
+		e.u32(process)
+	})
+	m.section(sectionExport, func(e *encoder) {
+		e.u32(1)
+		e.name(ProcessFunction)
+		e.op(0x00, uint32(len(c.imports))) // The function after the imports.
+	})
+	m.section(sectionCode, func(e *encoder) {
+		var f encoder
+		f.u32(uint32(len(c.localTypes)))
+		for _, t := range c.localTypes {
+			f.u32(1)
+			f.WriteByte(t)
+		}
+		for range c.flow.Targets {
+			f.WriteByte(opBlock)
+			f.WriteByte(blockEmpty)
+		}
+		f.Write(c.body.Bytes())
+		f.WriteByte(opEnd)
+		e.u32(1)
+		e.u32(uint32(f.Len()))
+		e.Write(f.Bytes())
+	})
+	return m.Bytes()
+}
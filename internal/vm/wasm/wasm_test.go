@@ -0,0 +1,89 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package wasm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/vm/code"
+	"github.com/google/mtail/internal/vm/flow"
+	"github.com/google/mtail/internal/vm/object"
+)
+
+func TestParseImport(t *testing.T) {
+	for _, tc := range []struct {
+		args   []flow.Kind
+		result flow.Kind
+	}{
+		{nil, flow.Bool},
+		{[]flow.Kind{flow.String, flow.Metric}, flow.Datum},
+		{[]flow.Kind{flow.Datum, flow.Int}, 0},
+	} {
+		name := importName(tc.args, tc.result)
+		args, result, err := ParseImport(name)
+		testutil.FatalIfErr(t, err)
+		testutil.ExpectNoDiff(t, tc.args, args)
+		testutil.ExpectNoDiff(t, tc.result, result)
+	}
+	for _, name := range []string{"exec", "exec_", "exec_x_", "exec_s_sb", "print_s_"} {
+		if _, _, err := ParseImport(name); err == nil {
+			t.Errorf("ParseImport(%q) expected an error", name)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	// /x/ { c++ } otherwise { stop }
+	obj := &object.Object{Program: []code.Instr{
+		{Opcode: code.Match, Operand: 0},
+		{Opcode: code.Jnm, Operand: 6},
+		{Opcode: code.Setmatched, Operand: false},
+		{Opcode: code.Mload, Operand: 0},
+		{Opcode: code.Dload, Operand: 0},
+		{Opcode: code.Inc},
+		{Opcode: code.Setmatched, Operand: true},
+		{Opcode: code.Otherwise},
+		{Opcode: code.Jnm, Operand: 10},
+		{Opcode: code.Stop},
+	}}
+	b, err := Compile(obj)
+	testutil.FatalIfErr(t, err)
+	if !bytes.HasPrefix(b, []byte("\x00asm\x01\x00\x00\x00")) {
+		t.Errorf("not a module: %q", b)
+	}
+	// The match, dload and inc are executed by the host.
+	for _, name := range []string{"exec__b", "exec_m_d", "exec_d_i"} {
+		if !bytes.Contains(b, []byte(name)) {
+			t.Errorf("no import %q in module", name)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		prog []code.Instr
+	}{
+		{"jump backward", []code.Instr{{Opcode: code.Push, Operand: true}, {Opcode: code.Jnm, Operand: 0}}},
+		{"jump past the end", []code.Instr{{Opcode: code.Jmp, Operand: 2}}},
+		{"empty stack", []code.Instr{{Opcode: code.Iadd}}},
+		{"unknown operand", []code.Instr{{Opcode: code.Push, Operand: "x"}}},
+		{"jump on a string", []code.Instr{{Opcode: code.Str, Operand: 0}, {Opcode: code.Jm, Operand: 2}}},
+		{"value not on every way", []code.Instr{
+			{Opcode: code.Push, Operand: true},
+			{Opcode: code.Jnm, Operand: 3},
+			{Opcode: code.Push, Operand: int64(1)},
+			{Opcode: code.Neg},
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Compile(&object.Object{Program: tc.prog}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -6,27 +6,50 @@ package watcher
 import (
 	"context"
 	"path"
+	"sort"
 	"sync"
+	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logging"
+	"github.com/pkg/errors"
 )
 
 // FakeWatcher implements an in-memory Watcher.
 type FakeWatcher struct {
 	watchesMu sync.RWMutex
 	watches   map[string]map[Processor]struct{}
+	intervals map[string]time.Duration
 	isClosed  bool
+
+	holding bool    // Whether sent events are held until Release.
+	held    []Event // The events held since Hold.
+
+	observeFailures   map[string]*fakeFailure
+	unobserveFailures map[string]*fakeFailure
+}
+
+// fakeFailure is an error a FakeWatcher returns for a number of calls.
+type fakeFailure struct {
+	err error
+	n   int // The calls left to fail, or negative to fail them all.
 }
 
 // NewFakeWatcher returns a fake Watcher for use in tests.
 func NewFakeWatcher() *FakeWatcher {
 	return &FakeWatcher{
-		watches: make(map[string]map[Processor]struct{})}
+		watches:           make(map[string]map[Processor]struct{}),
+		intervals:         make(map[string]time.Duration),
+		observeFailures:   make(map[string]*fakeFailure),
+		unobserveFailures: make(map[string]*fakeFailure)}
 }
 
+// Observe adds an observer for name, unless FailObserve has made it fail.
 func (w *FakeWatcher) Observe(name string, p Processor) error {
 	w.watchesMu.Lock()
 	defer w.watchesMu.Unlock()
+	if err := fail(w.observeFailures, name); err != nil {
+		return err
+	}
 	_, ok := w.watches[name]
 	if !ok {
 		w.watches[name] = make(map[Processor]struct{})
@@ -35,6 +58,14 @@ func (w *FakeWatcher) Observe(name string, p Processor) error {
 	return nil
 }
 
+// IsWatching indicates if the name is being watched.
+func (w *FakeWatcher) IsWatching(name string) bool {
+	w.watchesMu.RLock()
+	defer w.watchesMu.RUnlock()
+	_, ok := w.watches[name]
+	return ok
+}
+
 // Close closes down the FakeWatcher
 func (w *FakeWatcher) Close() error {
 	w.isClosed = true
@@ -46,6 +77,9 @@ func (w *FakeWatcher) Close() error {
 func (w *FakeWatcher) Unobserve(name string, p Processor) error {
 	w.watchesMu.Lock()
 	defer w.watchesMu.Unlock()
+	if err := fail(w.unobserveFailures, name); err != nil {
+		return err
+	}
 
 	_, ok := w.watches[name]
 	if !ok {
@@ -58,19 +92,124 @@ func (w *FakeWatcher) Unobserve(name string, p Processor) error {
 	return nil
 }
 
-func (w *FakeWatcher) SendEvent(e Event) {
+// FailObserve makes the next n calls to Observe for name return err without
+// adding the observer, as a real watcher does when it can't add a watch.  A
+// negative n makes every call fail.
+func (w *FakeWatcher) FailObserve(name string, n int, err error) {
+	w.watchesMu.Lock()
+	defer w.watchesMu.Unlock()
+	w.observeFailures[name] = &fakeFailure{err, n}
+}
+
+// FailUnobserve makes the next n calls to Unobserve for name return err
+// without removing the observer.  A negative n makes every call fail.
+func (w *FakeWatcher) FailUnobserve(name string, n int, err error) {
+	w.watchesMu.Lock()
+	defer w.watchesMu.Unlock()
+	w.unobserveFailures[name] = &fakeFailure{err, n}
+}
+
+// fail returns the error the next call for name should fail with, if any.
+// The caller must hold watchesMu.
+func fail(failures map[string]*fakeFailure, name string) error {
+	f, ok := failures[name]
+	if !ok {
+		return nil
+	}
+	if f.n > 0 {
+		f.n--
+		if f.n == 0 {
+			delete(failures, name)
+		}
+	}
+	return f.err
+}
+
+// Watches returns the names being watched, in order.
+func (w *FakeWatcher) Watches() []string {
+	w.watchesMu.RLock()
+	defer w.watchesMu.RUnlock()
+	r := make([]string, 0, len(w.watches))
+	for name := range w.watches {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// Observers returns the number of observers of name.
+func (w *FakeWatcher) Observers(name string) int {
+	w.watchesMu.RLock()
+	defer w.watchesMu.RUnlock()
+	return len(w.watches[name])
+}
+
+// Hold makes the FakeWatcher hold the events sent from now on instead of
+// sending them, until Release.
+func (w *FakeWatcher) Hold() {
+	w.watchesMu.Lock()
+	defer w.watchesMu.Unlock()
+	w.holding = true
+}
+
+// Held returns the events held since Hold, in the order they were sent.
+func (w *FakeWatcher) Held() []Event {
 	w.watchesMu.RLock()
+	defer w.watchesMu.RUnlock()
+	return append([]Event(nil), w.held...)
+}
+
+// Release sends the events held since Hold and stops holding them.  The
+// events are sent in the order of their indices in order, or in the order
+// they were held if order is empty, so a test can deliver them out of order.
+// Held events not named in order are dropped, as a real watcher may lose
+// them.
+func (w *FakeWatcher) Release(order ...int) error {
+	w.watchesMu.Lock()
+	held := w.held
+	w.holding = false
+	w.held = nil
+	w.watchesMu.Unlock()
+	if len(order) == 0 {
+		for i := range held {
+			order = append(order, i)
+		}
+	}
+	for _, i := range order {
+		if i < 0 || i >= len(held) {
+			return errors.Errorf("no held event %d of %d", i, len(held))
+		}
+	}
+	for _, i := range order {
+		w.SendEvent(held[i])
+	}
+	return nil
+}
+
+// SendEvent sends e to the observers of its path, or holds it if Hold has
+// been called.
+func (w *FakeWatcher) SendEvent(e Event) {
+	w.watchesMu.Lock()
+	if w.holding {
+		w.held = append(w.held, e)
+		w.watchesMu.Unlock()
+		return
+	}
 	name := e.Pathname
 	if e.Op == Create {
 		name = path.Dir(name)
 	}
-	watches, ok := w.watches[name]
-	w.watchesMu.RUnlock()
+	watches := make([]Processor, 0, len(w.watches[name]))
+	for p := range w.watches[name] {
+		watches = append(watches, p)
+	}
+	_, ok := w.watches[name]
+	w.watchesMu.Unlock()
 	if !ok {
-		glog.Infof("Didn't find %s in watched list", name)
+		logging.Infof("Didn't find %s in watched list", name)
 		return
 	}
-	for p := range watches {
+	for _, p := range watches {
 		p.ProcessFileEvent(context.Background(), e)
 	}
 }
@@ -82,7 +221,7 @@ func (w *FakeWatcher) InjectCreate(name string) {
 	_, dirWatched := w.watches[dirname]
 	w.watchesMu.RUnlock()
 	if !dirWatched {
-		glog.Warningf("not watching %s to see %s", dirname, name)
+		logging.Warningf("not watching %s to see %s", dirname, name)
 		return
 	}
 	w.SendEvent(Event{Create, name})
@@ -94,7 +233,7 @@ func (w *FakeWatcher) InjectUpdate(name string) {
 	_, watched := w.watches[name]
 	w.watchesMu.RUnlock()
 	if !watched {
-		glog.Warningf("can't update: not watching %s", name)
+		logging.Warningf("can't update: not watching %s", name)
 		return
 	}
 	w.SendEvent(Event{Update, name})
@@ -106,7 +245,7 @@ func (w *FakeWatcher) InjectDelete(name string) {
 	_, watched := w.watches[name]
 	w.watchesMu.RUnlock()
 	if !watched {
-		glog.Warningf("can't delete: not watching %s", name)
+		logging.Warningf("can't delete: not watching %s", name)
 		return
 	}
 	w.SendEvent(Event{Delete, name})
@@ -115,3 +254,24 @@ func (w *FakeWatcher) InjectDelete(name string) {
 // Poll does nothing in the fake watcher; events are injected.
 func (w *FakeWatcher) Poll() {
 }
+
+// SetPollInterval records the shortest poll interval set for a watched name.
+func (w *FakeWatcher) SetPollInterval(name string, interval time.Duration) error {
+	w.watchesMu.Lock()
+	defer w.watchesMu.Unlock()
+	if _, ok := w.watches[name]; !ok {
+		return errors.Errorf("not watching %q", name)
+	}
+	if d, ok := w.intervals[name]; !ok || interval < d {
+		w.intervals[name] = interval
+	}
+	return nil
+}
+
+// PollInterval returns the poll interval set for name, or zero if none has
+// been set.
+func (w *FakeWatcher) PollInterval(name string) time.Duration {
+	w.watchesMu.RLock()
+	defer w.watchesMu.RUnlock()
+	return w.intervals[name]
+}
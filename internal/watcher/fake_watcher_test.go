@@ -5,6 +5,7 @@ package watcher
 
 import (
 	"context"
+	"errors"
 	"testing"
 
 	"github.com/google/mtail/internal/testutil"
@@ -93,3 +94,64 @@ func TestFakeWatcherUnwatchedFiles(t *testing.T) {
 		t.Errorf("Received an event, expecting nothing: %q", s.Events)
 	}
 }
+
+func TestFakeWatcherHold(t *testing.T) {
+	w := NewFakeWatcher()
+	defer w.Close()
+	s := &stubProcessor{}
+	testutil.FatalIfErr(t, w.Observe("/tmp", s))
+	testutil.FatalIfErr(t, w.Observe("/tmp/log", s))
+
+	w.Hold()
+	w.InjectCreate("/tmp/log")
+	w.InjectUpdate("/tmp/log")
+	w.InjectDelete("/tmp/log")
+	if len(s.Events) > 0 {
+		t.Errorf("Received held events: %v", s.Events)
+	}
+	testutil.ExpectNoDiff(t, []Event{{Create, "/tmp/log"}, {Update, "/tmp/log"}, {Delete, "/tmp/log"}}, w.Held())
+
+	if err := w.Release(3); err == nil {
+		t.Error("expected an error releasing a missing event")
+	}
+
+	w.Hold()
+	w.InjectCreate("/tmp/log")
+	w.InjectUpdate("/tmp/log")
+	w.InjectDelete("/tmp/log")
+	// Deliver the delete first and lose the create.
+	testutil.FatalIfErr(t, w.Release(2, 1))
+	testutil.ExpectNoDiff(t, []Event{{Delete, "/tmp/log"}, {Update, "/tmp/log"}}, s.Events)
+
+	w.InjectUpdate("/tmp/log")
+	if len(s.Events) != 3 {
+		t.Errorf("Event after release not received: %v", s.Events)
+	}
+}
+
+func TestFakeWatcherFailObserve(t *testing.T) {
+	w := NewFakeWatcher()
+	defer w.Close()
+	s := &stubProcessor{}
+	failed := errors.New("no more watches")
+
+	w.FailObserve("/tmp", 1, failed)
+	if err := w.Observe("/tmp", s); err != failed {
+		t.Errorf("Observe error %v, expected %v", err, failed)
+	}
+	if w.IsWatching("/tmp") {
+		t.Error("watching /tmp after a failed Observe")
+	}
+	testutil.FatalIfErr(t, w.Observe("/tmp", s))
+	testutil.FatalIfErr(t, w.Observe("/tmp/log", s))
+	testutil.ExpectNoDiff(t, []string{"/tmp", "/tmp/log"}, w.Watches())
+	testutil.ExpectNoDiff(t, 1, w.Observers("/tmp"))
+
+	w.FailUnobserve("/tmp/log", -1, failed)
+	for i := 0; i < 2; i++ {
+		if err := w.Unobserve("/tmp/log", s); err != failed {
+			t.Errorf("Unobserve error %v, expected %v", err, failed)
+		}
+	}
+	testutil.ExpectNoDiff(t, []string{"/tmp", "/tmp/log"}, w.Watches())
+}
@@ -0,0 +1,13 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"os"
+)
+
+// fileID returns zero, as FileInfo on windows does not carry a file index.
+func fileID(fi os.FileInfo) (dev, ino uint64) {
+	return 0, 0
+}
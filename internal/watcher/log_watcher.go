@@ -5,19 +5,25 @@ package watcher
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path"
 	"path/filepath"
 	"sync"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/health"
+	"github.com/google/mtail/internal/logging"
 	"github.com/pkg/errors"
 )
 
 type watch struct {
 	ps []Processor
 	fi os.FileInfo
+
+	interval time.Duration // Poll interval for this path, if not the LogWatcher's.
+	lastPoll time.Time
 }
 
 // hasChanged indicates that a FileInfo has changed.
@@ -30,19 +36,19 @@ type watch struct {
 // production environments.
 func hasChanged(a, b os.FileInfo) bool {
 	if a == nil || b == nil {
-		glog.V(2).Info("One or both FileInfos are nil")
+		logging.V(2).Info("One or both FileInfos are nil")
 		return true
 	}
 	if a.ModTime() != b.ModTime() {
-		glog.V(2).Info("modtimes differ")
+		logging.V(2).Info("modtimes differ")
 		return true
 	}
 	if a.Size() != b.Size() {
-		glog.V(2).Info("sizes differ")
+		logging.V(2).Info("sizes differ")
 		return true
 	}
 	if a.Mode() != b.Mode() {
-		glog.V(2).Info("modes differ")
+		logging.V(2).Info("modes differ")
 		return true
 	}
 	return false
@@ -50,31 +56,83 @@ func hasChanged(a, b os.FileInfo) bool {
 
 // LogWatcher implements a Watcher for watching real filesystems.
 type LogWatcher struct {
-	pollTicker *time.Ticker
+	health health.Activity // records each Poll, and kept first so it is 64-bit aligned
+
+	pollInterval time.Duration // protected by watchedMu
+	clock        clock.Clock   // Times the polls.
 
-	watchedMu sync.RWMutex // protects `watched'
-	watched   map[string]*watch
+	watchedMu   sync.RWMutex // protects `watched' and `tick'
+	watched     map[string]*watch
+	tick        time.Duration // Shortest poll interval of any watch.
+	tickChanged chan struct{} // Signalled when the tick is shortened, to wake runTicks.
 
-	stopTicks chan struct{} // Channel to notify ticker to stop.
-	ticksDone chan struct{} // Channel to notify when the ticks handler is done.
+	ctx       context.Context    // Cancelled to stop the LogWatcher; passed to event processors.
+	cancel    context.CancelFunc // Cancels ctx.
+	ticksDone chan struct{}      // Channel to notify when the ticks handler is done.
 
 	pollMu sync.Mutex // protects `Poll()`
 
+	backend    string        // Name of the notification backend in use.
+	notifier   notifier      // Optional source of change notifications.
+	notifyDone chan struct{} // Channel to notify when the notification handler is done.
+
+	coalesceWindow time.Duration // How long to gather notifications before polling.
+
+	pollOnly       map[string]struct{} // Watched paths the notifier couldn't add, protected by watchedMu.
+	notifyWarned   bool                // A notifier failure has been logged, protected by watchedMu.
+	fallbackTicker clock.Ticker        // Polls pollOnly paths if there is no poll interval.
+	stopFallback   chan struct{}       // Channel to notify the fallback ticker to stop.
+
+	recorder *recorder // If set, records the events sent and paths observed.
+
 	closeOnce sync.Once
 }
 
-// NewLogWatcher returns a new LogWatcher, or returns an error.
-func NewLogWatcher(pollInterval time.Duration) (*LogWatcher, error) {
+// Clock sets the clock that the LogWatcher polls by, instead of the system
+// clock.
+func Clock(c clock.Clock) Option {
+	return func(w *LogWatcher) error {
+		w.clock = c
+		return nil
+	}
+}
+
+// NewLogWatcher returns a new LogWatcher, or returns an error.  The
+// LogWatcher shuts down when ctx is cancelled, or when closed.
+func NewLogWatcher(ctx context.Context, pollInterval time.Duration, options ...Option) (*LogWatcher, error) {
 	w := &LogWatcher{
-		watched: make(map[string]*watch),
+		watched:      make(map[string]*watch),
+		pollInterval: pollInterval,
+		clock:        clock.Real,
+		tick:         pollInterval,
+		tickChanged:  make(chan struct{}, 1),
+		backend:      "poll",
+		pollOnly:     make(map[string]struct{}),
+	}
+	for _, option := range options {
+		if err := option(w); err != nil {
+			return nil, err
+		}
 	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	if w.notifier != nil {
+		w.notifyDone = make(chan struct{})
+		go w.runNotify()
+		logging.Infof("Watching for changes with %s", w.backend)
+	}
+	// Count the start as activity so a ticker that never fires is noticed.
+	w.health.Done()
 	if pollInterval > 0 {
-		w.pollTicker = time.NewTicker(pollInterval)
-		w.stopTicks = make(chan struct{})
 		w.ticksDone = make(chan struct{})
 		go w.runTicks()
-		glog.V(2).Infof("started ticker with %s interval", pollInterval)
+		logging.V(2).Infof("started ticker with %s interval", pollInterval)
 	}
+	go func() {
+		<-w.ctx.Done()
+		if err := w.Close(); err != nil {
+			logging.Info(err)
+		}
+	}()
 	return w, nil
 }
 
@@ -88,45 +146,220 @@ func (w *LogWatcher) sendEvent(e Event) {
 		watch, ok = w.watched[d]
 		w.watchedMu.RUnlock()
 		if !ok {
-			glog.V(2).Infof("No watch for path %q", e.Pathname)
+			logging.V(2).Infof("No watch for path %q", e.Pathname)
 			return
 		}
 	}
 	w.sendWatchedEvent(watch, e)
 }
 
-// Send an event to a watch; all locks assumed to be held.
+// sendWatchedEvent sends an event to the processors of a watch, recording it
+// first if the LogWatcher is recording.  Both do I/O, so watchedMu must not be
+// held.
 func (w *LogWatcher) sendWatchedEvent(watch *watch, e Event) {
+	w.record(opNames[e.Op], e.Pathname)
 	for _, p := range watch.ps {
-		p.ProcessFileEvent(context.TODO(), e)
+		p.ProcessFileEvent(w.ctx, e)
 	}
 }
 
+// runTicks polls the watched paths as they become due, waking at the
+// shortest poll interval of any of them.
 func (w *LogWatcher) runTicks() {
 	defer close(w.ticksDone)
 
-	if w.pollTicker == nil {
-		return
+	t := w.clock.NewTimer(w.tickInterval())
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C():
+			w.pollDue(now)
+			t.Reset(w.tickInterval())
+		case <-w.tickChanged:
+			// Wait the shorter tick from now, rather than the rest of the
+			// longer one.
+			if !t.Stop() {
+				select {
+				case <-t.C():
+				default:
+				}
+			}
+			t.Reset(w.tickInterval())
+		case <-w.ctx.Done():
+			return
+		}
 	}
+}
 
-	for {
+func (w *LogWatcher) tickInterval() time.Duration {
+	w.watchedMu.RLock()
+	defer w.watchedMu.RUnlock()
+	return w.tick
+}
+
+// setTick sets the tick, waking runTicks if it's shorter.  watchedMu must be
+// held.
+func (w *LogWatcher) setTick(tick time.Duration) {
+	shorter := tick < w.tick
+	w.tick = tick
+	if shorter {
 		select {
-		case <-w.pollTicker.C:
+		case w.tickChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// SetPollInterval sets how often the watched path pathname is polled,
+// instead of the LogWatcher's poll interval.  If it is set more than once,
+// for example on a directory containing logs with different intervals, the
+// shortest applies.  It has no effect if the LogWatcher isn't polling.
+func (w *LogWatcher) SetPollInterval(pathname string, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.Errorf("poll interval for %q must be positive", pathname)
+	}
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to lookup absolutepath of %q", pathname)
+	}
+	w.watchedMu.Lock()
+	defer w.watchedMu.Unlock()
+	watched, ok := w.watched[absPath]
+	if !ok {
+		return errors.Errorf("not watching %q", absPath)
+	}
+	if watched.interval == 0 || interval < watched.interval {
+		watched.interval = interval
+		logging.V(1).Infof("Polling %s every %s", absPath, interval)
+	}
+	if w.tick > 0 && interval < w.tick {
+		w.setTick(interval)
+	}
+	return nil
+}
+
+// DefaultPollInterval returns how often watched paths without their own poll
+// interval are polled.
+func (w *LogWatcher) DefaultPollInterval() time.Duration {
+	w.watchedMu.RLock()
+	defer w.watchedMu.RUnlock()
+	return w.pollInterval
+}
+
+// SetDefaultPollInterval changes how often watched paths without their own
+// poll interval are polled.  A shorter interval takes effect at once, and a
+// longer one from the next tick.  It can't start or stop
+// polling, so it fails if the LogWatcher isn't polling.
+func (w *LogWatcher) SetDefaultPollInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("poll interval must be positive")
+	}
+	w.watchedMu.Lock()
+	defer w.watchedMu.Unlock()
+	if w.pollInterval == 0 {
+		return errors.New("not polling")
+	}
+	w.pollInterval = interval
+	tick := interval
+	for _, watched := range w.watched {
+		if watched.interval > 0 && watched.interval < tick {
+			tick = watched.interval
+		}
+	}
+	w.setTick(tick)
+	logging.Infof("Polling every %s", interval)
+	return nil
+}
+
+// runNotify polls each path the notifier reports as changed, once for each
+// batch of notifications.
+func (w *LogWatcher) runNotify() {
+	defer close(w.notifyDone)
+	for first := range w.notifier.events() {
+		batch, open := w.gather(first)
+		w.pollNotified(batch)
+		if !open {
+			return
+		}
+	}
+}
+
+func (w *LogWatcher) pollNotified(batch []string) {
+	for _, pathname := range batch {
+		if pathname == "" {
+			logging.V(1).Infof("%s lost events, polling everything", w.backend)
 			w.Poll()
-		case <-w.stopTicks:
-			w.pollTicker.Stop()
 			return
 		}
 	}
+	for _, pathname := range batch {
+		w.pollNotifiedPath(pathname)
+	}
+}
+
+// pollNotifiedPath polls a path the notifier reports as changed, if it or
+// its directory is watched.
+func (w *LogWatcher) pollNotifiedPath(pathname string) {
+	w.pollMu.Lock()
+	defer w.pollMu.Unlock()
+	w.watchedMu.RLock()
+	watched, ok := w.watched[pathname]
+	w.watchedMu.RUnlock()
+	if ok {
+		w.pollWatchedPath(pathname, watched)
+		return
+	}
+	w.watchedMu.RLock()
+	parent, ok := w.watched[filepath.Dir(pathname)]
+	w.watchedMu.RUnlock()
+	if !ok {
+		return
+	}
+	fi, err := os.Stat(pathname)
+	if err != nil {
+		// Deleted before we could look; it was never observed.
+		logging.V(2).Info(err)
+		return
+	}
+	logging.V(2).Infof("sending create for %s", pathname)
+	w.sendWatchedEvent(parent, Event{Create, pathname})
+	if fi.IsDir() {
+		w.pollDirectory(parent, pathname)
+	}
 }
 
 // Poll all watched objects for updates, dispatching events if required.
 func (w *LogWatcher) Poll() {
+	w.poll(func(*watch) bool { return true })
+}
+
+// pollDue polls the watched objects whose poll interval has elapsed.
+func (w *LogWatcher) pollDue(now time.Time) {
+	w.watchedMu.RLock()
+	tick, pollInterval := w.tick, w.pollInterval
+	w.watchedMu.RUnlock()
+	w.poll(func(watched *watch) bool {
+		interval := watched.interval
+		if interval == 0 {
+			interval = pollInterval
+		}
+		// Allow for ticks arriving a little early or late.
+		return !now.Before(watched.lastPoll.Add(interval - tick/2))
+	})
+}
+
+// poll polls the watched objects selected by due.
+func (w *LogWatcher) poll(due func(*watch) bool) {
 	w.pollMu.Lock()
 	defer w.pollMu.Unlock()
-	glog.V(2).Info("Polling watched files.")
+	w.health.Start()
+	defer w.health.Done()
+	logging.V(2).Info("Polling watched files.")
 	w.watchedMu.RLock()
 	for n, watch := range w.watched {
+		if !due(watch) {
+			continue
+		}
 		w.watchedMu.RUnlock()
 		w.pollWatchedPath(n, watch)
 		w.watchedMu.RLock()
@@ -136,18 +369,19 @@ func (w *LogWatcher) Poll() {
 
 // pollWatchedPathLocked polls an already-watched path for updates.
 func (w *LogWatcher) pollWatchedPath(pathname string, watched *watch) {
-	glog.V(2).Infof("Stat %q", pathname)
+	logging.V(2).Infof("Stat %q", pathname)
 	fi, err := os.Stat(pathname)
 	if err != nil {
 		if os.IsNotExist(err) {
-			glog.V(2).Infof("sending delete for %s", pathname)
+			logging.V(2).Infof("sending delete for %s", pathname)
 			w.sendWatchedEvent(watched, Event{Delete, pathname})
 			// Need to remove the watch for any subsequent create to be sent.
 			w.watchedMu.Lock()
 			delete(w.watched, pathname)
+			w.unnotify(pathname)
 			w.watchedMu.Unlock()
 		} else {
-			glog.V(1).Info(err)
+			logging.V(1).Info(err)
 		}
 		return
 	}
@@ -155,13 +389,14 @@ func (w *LogWatcher) pollWatchedPath(pathname string, watched *watch) {
 	if fi.IsDir() {
 		w.pollDirectory(watched, pathname)
 	} else if hasChanged(fi, watched.fi) {
-		glog.V(2).Infof("sending update for %s", pathname)
+		logging.V(2).Infof("sending update for %s", pathname)
 		w.sendWatchedEvent(watched, Event{Update, pathname})
 	}
 
 	w.watchedMu.Lock()
 	if _, ok := w.watched[pathname]; ok {
 		w.watched[pathname].fi = fi
+		w.watched[pathname].lastPoll = w.clock.Now()
 	}
 	w.watchedMu.Unlock()
 }
@@ -170,7 +405,7 @@ func (w *LogWatcher) pollWatchedPath(pathname string, watched *watch) {
 func (w *LogWatcher) pollDirectory(parentWatch *watch, pathname string) {
 	matches, err := filepath.Glob(path.Join(pathname, "*"))
 	if err != nil {
-		glog.V(1).Info(err)
+		logging.V(1).Info(err)
 		return
 	}
 	for _, match := range matches {
@@ -185,12 +420,12 @@ func (w *LogWatcher) pollDirectory(parentWatch *watch, pathname string) {
 			// that we aren't watching, so we make a lot of stats below, but we
 			// need to find which ones are directories so we can traverse them.
 			// TODO(jaq): teach log watcher about the TailPatterns from tailer.
-			glog.V(2).Infof("sending create for %s", match)
+			logging.V(2).Infof("sending create for %s", match)
 			w.sendWatchedEvent(parentWatch, Event{Create, match})
 		}
 		fi, err := os.Stat(match)
 		if err != nil {
-			glog.V(1).Info(err)
+			logging.V(1).Info(err)
 			continue
 		}
 		if fi.IsDir() {
@@ -202,19 +437,31 @@ func (w *LogWatcher) pollDirectory(parentWatch *watch, pathname string) {
 // Close shuts down the LogWatcher.  It is safe to call this from multiple clients.
 func (w *LogWatcher) Close() (err error) {
 	w.closeOnce.Do(func() {
-		glog.Infof("Shutting down log watcher.")
-		if w.pollTicker != nil {
-			close(w.stopTicks)
+		logging.Infof("Shutting down log watcher.")
+		w.cancel()
+		if w.ticksDone != nil {
 			<-w.ticksDone
 		}
+		if w.notifier != nil {
+			err = w.notifier.close()
+			<-w.notifyDone
+		}
+		w.watchedMu.Lock()
+		if w.fallbackTicker != nil {
+			w.fallbackTicker.Stop()
+			close(w.stopFallback)
+			w.fallbackTicker = nil
+		}
+		w.watchedMu.Unlock()
 	})
-	return nil
+	return
 }
 
 // Observe adds a path to the list of watched items.
 // If this path has a new event, then the processor being registered will be sent the event.
 func (w *LogWatcher) Observe(path string, processor Processor) error {
 	absPath, err := w.addWatch(path)
+	w.record(RecordObserve, absPath)
 	if err != nil {
 		return err
 	}
@@ -224,20 +471,21 @@ func (w *LogWatcher) Observe(path string, processor Processor) error {
 	if !ok {
 		fi, err := os.Stat(absPath)
 		if err != nil {
-			glog.V(1).Info(err)
+			logging.V(1).Info(err)
 		}
 		w.watched[absPath] = &watch{ps: []Processor{processor}, fi: fi}
-		glog.Infof("No abspath in watched list, added new one for %s", absPath)
+		logging.Infof("No abspath in watched list, added new one for %s", absPath)
+		w.notify(absPath)
 		return nil
 	}
 	for _, p := range watched.ps {
 		if p == processor {
-			glog.Infof("Found this processor in watched list")
+			logging.Infof("Found this processor in watched list")
 			return nil
 		}
 	}
 	watched.ps = append(watched.ps, processor)
-	glog.Infof("appended this processor")
+	logging.Infof("appended this processor")
 	return nil
 }
 
@@ -246,10 +494,10 @@ func (w *LogWatcher) addWatch(path string) (string, error) {
 	if err != nil {
 		return "", errors.Wrapf(err, "Failed to lookup absolutepath of %q", path)
 	}
-	glog.V(2).Infof("Adding a watch on resolved path %q", absPath)
+	logging.V(2).Infof("Adding a watch on resolved path %q", absPath)
 	_, err = os.Stat(absPath)
 	if err != nil {
-		glog.V(2).Info(err)
+		logging.V(2).Info(err)
 		return absPath, err
 	}
 	return absPath, nil
@@ -260,10 +508,10 @@ func (w *LogWatcher) addWatch(path string) (string, error) {
 func (w *LogWatcher) IsWatching(path string) bool {
 	absPath, err := filepath.Abs(path)
 	if err != nil {
-		glog.V(2).Infof("Couldn't resolve path %q: %s", absPath, err)
+		logging.V(2).Infof("Couldn't resolve path %q: %s", absPath, err)
 		return false
 	}
-	glog.V(2).Infof("Resolved path for lookup %q", absPath)
+	logging.V(2).Infof("Resolved path for lookup %q", absPath)
 	w.watchedMu.RLock()
 	_, ok := w.watched[absPath]
 	w.watchedMu.RUnlock()
@@ -271,6 +519,7 @@ func (w *LogWatcher) IsWatching(path string) bool {
 }
 
 func (w *LogWatcher) Unobserve(path string, processor Processor) error {
+	w.record(RecordUnobserve, path)
 	w.watchedMu.Lock()
 	defer w.watchedMu.Unlock()
 	_, ok := w.watched[path]
@@ -286,6 +535,22 @@ func (w *LogWatcher) Unobserve(path string, processor Processor) error {
 	}
 	if len(w.watched[path].ps) == 0 {
 		delete(w.watched, path)
+		w.unnotify(path)
 	}
 	return nil
 }
+
+// Health reports when the LogWatcher last polled, which it is expected to do
+// every poll interval.
+func (w *LogWatcher) Health() health.Status {
+	s := w.health.Status("watcher")
+	s.Critical = true
+	w.watchedMu.RLock()
+	s.Interval = w.pollInterval
+	s.Message = fmt.Sprintf("%d paths watched with %s", len(w.watched), w.backend)
+	if len(w.pollOnly) > 0 {
+		s.Message += fmt.Sprintf(", %d by polling only", len(w.pollOnly))
+	}
+	w.watchedMu.RUnlock()
+	return s
+}
@@ -9,7 +9,9 @@ import (
 	"path"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/google/mtail/internal/clock"
 	"github.com/google/mtail/internal/testutil"
 )
 
@@ -31,7 +33,7 @@ func TestLogWatcher(t *testing.T) {
 	workdir, rmWorkdir := testutil.TestTempDir(t)
 	defer rmWorkdir()
 
-	w, err := NewLogWatcher(0)
+	w, err := NewLogWatcher(context.Background(), 0)
 	testutil.FatalIfErr(t, err)
 	defer func() {
 		testutil.FatalIfErr(t, w.Close())
@@ -74,12 +76,128 @@ func TestLogWatcher(t *testing.T) {
 	testutil.ExpectNoDiff(t, expected, s.Events)
 }
 
+func TestLogWatcherPollInterval(t *testing.T) {
+	testutil.SkipIfShort(t)
+	workdir, rmWorkdir := testutil.TestTempDir(t)
+	defer rmWorkdir()
+
+	// The fake clock never moves, so the watcher only polls when told to.
+	c := clock.NewFake(time.Now())
+	w, err := NewLogWatcher(context.Background(), time.Hour, Clock(c))
+	testutil.FatalIfErr(t, err)
+	defer func() {
+		testutil.FatalIfErr(t, w.Close())
+	}()
+
+	fast := filepath.Join(workdir, "fast")
+	slow := filepath.Join(workdir, "slow")
+	ff := testutil.TestOpenFile(t, fast)
+	defer ff.Close()
+	sf := testutil.TestOpenFile(t, slow)
+	defer sf.Close()
+	s := newStubProcessor()
+	testutil.FatalIfErr(t, w.Observe(fast, s))
+	testutil.FatalIfErr(t, w.Observe(slow, s))
+	testutil.FatalIfErr(t, w.SetPollInterval(fast, time.Minute))
+	testutil.FatalIfErr(t, w.SetPollInterval(fast, 10*time.Millisecond))
+	testutil.FatalIfErr(t, w.SetPollInterval(fast, time.Second))
+	if w.tickInterval() != 10*time.Millisecond {
+		t.Errorf("tick: expected 10ms, received %s", w.tickInterval())
+	}
+	if err := w.SetPollInterval(filepath.Join(workdir, "unwatched"), time.Second); err == nil {
+		t.Error("expected an error setting the interval of an unwatched path")
+	}
+
+	// Neither has been polled yet, so both are due.
+	w.pollDue(c.Now())
+	testutil.WriteString(t, ff, "hi")
+	testutil.WriteString(t, sf, "hi")
+	w.pollDue(c.Now().Add(20 * time.Millisecond))
+	testutil.ExpectNoDiff(t, []Event{{Update, fast}}, s.Events)
+	// An explicit Poll polls everything.
+	w.Poll()
+	testutil.ExpectNoDiff(t, []Event{{Update, fast}, {Update, slow}}, s.Events)
+}
+
+func TestLogWatcherSetDefaultPollInterval(t *testing.T) {
+	testutil.SkipIfShort(t)
+	workdir, rmWorkdir := testutil.TestTempDir(t)
+	defer rmWorkdir()
+
+	c := clock.NewFake(time.Now())
+	w, err := NewLogWatcher(context.Background(), time.Hour, Clock(c))
+	testutil.FatalIfErr(t, err)
+	defer func() {
+		testutil.FatalIfErr(t, w.Close())
+	}()
+
+	fast := filepath.Join(workdir, "fast")
+	ff := testutil.TestOpenFile(t, fast)
+	defer ff.Close()
+	testutil.FatalIfErr(t, w.Observe(fast, newStubProcessor()))
+	testutil.FatalIfErr(t, w.SetPollInterval(fast, time.Minute))
+
+	testutil.FatalIfErr(t, w.SetDefaultPollInterval(time.Second))
+	testutil.ExpectNoDiff(t, time.Second, w.DefaultPollInterval())
+	testutil.ExpectNoDiff(t, time.Second, w.tickInterval())
+	// Slowing down again keeps the tick at the fastest watched path.
+	testutil.FatalIfErr(t, w.SetDefaultPollInterval(2*time.Hour))
+	testutil.ExpectNoDiff(t, time.Minute, w.tickInterval())
+	testutil.ExpectNoDiff(t, 2*time.Hour, w.Health().Interval)
+
+	if err := w.SetDefaultPollInterval(0); err == nil {
+		t.Error("expected an error setting a zero poll interval")
+	}
+	nw, err := NewLogWatcher(context.Background(), 0)
+	testutil.FatalIfErr(t, err)
+	defer func() {
+		testutil.FatalIfErr(t, nw.Close())
+	}()
+	if err := nw.SetDefaultPollInterval(time.Second); err == nil {
+		t.Error("expected an error setting the poll interval of a watcher that isn't polling")
+	}
+}
+
+func TestLogWatcherShorterPollIntervalTakesEffect(t *testing.T) {
+	testutil.SkipIfShort(t)
+	workdir, rmWorkdir := testutil.TestTempDir(t)
+	defer rmWorkdir()
+
+	c := clock.NewFake(time.Now())
+	w, err := NewLogWatcher(context.Background(), time.Hour, Clock(c))
+	testutil.FatalIfErr(t, err)
+	defer func() {
+		testutil.FatalIfErr(t, w.Close())
+	}()
+	c.BlockUntil(1)
+
+	logfile := filepath.Join(workdir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	events := make(chanProcessor, 10)
+	testutil.FatalIfErr(t, w.Observe(logfile, events))
+	testutil.WriteString(t, f, "hi")
+	testutil.FatalIfErr(t, w.SetDefaultPollInterval(time.Second))
+
+	// The log is polled within seconds, not at the end of the hour.
+	for i := 0; i < 10; i++ {
+		c.Advance(time.Second)
+		select {
+		case e := <-events:
+			testutil.ExpectNoDiff(t, Event{Update, logfile}, e)
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	t.Error("shorter poll interval didn't take effect")
+}
+
 func TestLogWatcherAddNotFound(t *testing.T) {
 	testutil.SkipIfShort(t)
 	workdir, rmWorkdir := testutil.TestTempDir(t)
 	defer rmWorkdir()
 
-	w, err := NewLogWatcher(0)
+	w, err := NewLogWatcher(context.Background(), 0)
 	testutil.FatalIfErr(t, err)
 	defer func() {
 		testutil.FatalIfErr(t, w.Close())
@@ -101,7 +219,7 @@ func TestLogWatcherAddPermissionDenied(t *testing.T) {
 	workdir, rmWorkdir := testutil.TestTempDir(t)
 	defer rmWorkdir()
 
-	w, err := NewLogWatcher(0)
+	w, err := NewLogWatcher(context.Background(), 0)
 	testutil.FatalIfErr(t, err)
 	defer func() {
 		testutil.FatalIfErr(t, w.Close())
@@ -127,7 +245,7 @@ func TestWatcherNewFile(t *testing.T) {
 	tmpDir, rmTmpDir := testutil.TestTempDir(t)
 	defer rmTmpDir()
 
-	w, err := NewLogWatcher(0)
+	w, err := NewLogWatcher(context.Background(), 0)
 	testutil.FatalIfErr(t, err)
 
 	s := &stubProcessor{}
@@ -138,3 +256,42 @@ func TestWatcherNewFile(t *testing.T) {
 	expected := []Event{{Op: Create, Pathname: path.Join(tmpDir, "log")}}
 	testutil.ExpectNoDiff(t, expected, s.Events)
 }
+
+func TestLogWatcherContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := NewLogWatcher(ctx, time.Hour)
+	testutil.FatalIfErr(t, err)
+	cancel()
+	select {
+	case <-w.ticksDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("poll loop didn't stop when the context was cancelled")
+	}
+	// Closing after cancellation is safe.
+	testutil.FatalIfErr(t, w.Close())
+}
+
+func TestLogWatcherPollLoop(t *testing.T) {
+	testutil.SkipIfShort(t)
+	workdir, rmWorkdir := testutil.TestTempDir(t)
+	defer rmWorkdir()
+
+	c := clock.NewFake(time.Now())
+	w, err := NewLogWatcher(context.Background(), time.Second, Clock(c))
+	testutil.FatalIfErr(t, err)
+	defer func() {
+		testutil.FatalIfErr(t, w.Close())
+	}()
+
+	logfile := filepath.Join(workdir, "logfile")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	p := make(chanProcessor, 1)
+	testutil.FatalIfErr(t, w.Observe(logfile, p))
+	testutil.WriteString(t, f, "hi")
+
+	// Wait for the poll loop's timer before moving the time past it.
+	c.BlockUntil(1)
+	c.Advance(time.Second)
+	expectEvents(t, p, Event{Update, logfile})
+}
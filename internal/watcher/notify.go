@@ -0,0 +1,228 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/logging"
+	"github.com/pkg/errors"
+)
+
+var (
+	// notifyFallbacks counts the paths the notifier couldn't watch, which
+	// are polled instead.
+	notifyFallbacks = expvar.NewInt("log_watcher_notify_fallbacks_total")
+	// notifications counts the change notifications received from the
+	// notifier.
+	notifications = expvar.NewInt("log_watcher_notifications_total")
+	// notificationsCoalesced counts the notifications for a path that was
+	// already to be polled, which cost no extra poll.
+	notificationsCoalesced = expvar.NewInt("log_watcher_notifications_coalesced_total")
+)
+
+// maxCoalesce bounds the notifications gathered into one batch, so a steady
+// stream of them can't hold off the polls indefinitely.
+const maxCoalesce = 1024
+
+// fallbackPollInterval is how often paths the notifier couldn't watch are
+// polled when the LogWatcher has no poll interval of its own.
+const fallbackPollInterval = 250 * time.Millisecond
+
+// A notifier is a source of filesystem change notifications from the
+// operating system.  The LogWatcher still finds changes by polling, but a
+// notifier tells it which paths to poll as soon as they change, instead of
+// waiting for the next tick.
+type notifier interface {
+	// add asks for notifications about pathname, and the files in it if it
+	// is a directory.
+	add(pathname string) error
+	remove(pathname string)
+	// events returns the pathnames that may have changed.  An empty pathname
+	// means notifications were lost, and everything must be polled.
+	events() <-chan string
+	close() error
+}
+
+// Option configures a LogWatcher.
+type Option func(*LogWatcher) error
+
+// Backends lists the names accepted by the Backend option, in order of
+// preference for fallback.
+var Backends = []string{"fanotify", "inotify", "kqueue", "poll"}
+
+// Backend selects the source of change notifications for the LogWatcher.
+// "poll" only polls.  On Linux "inotify" watches each file and directory, and
+// "fanotify" watches each mount containing them, which needs no resources
+// per file but requires CAP_SYS_ADMIN.  On the BSDs and macOS "kqueue"
+// watches each file and directory through an open descriptor.  All of them
+// still poll at the poll interval as a safety net.  If a backend is not
+// available it falls back to the next in Backends.
+func Backend(name string) Option {
+	return func(w *LogWatcher) error {
+		i := indexOf(Backends, name)
+		if i < 0 {
+			return errors.Errorf("unknown watcher backend %q, expecting one of %q", name, Backends)
+		}
+		for _, b := range Backends[i:] {
+			if b == "poll" {
+				w.backend = b
+				return nil
+			}
+			n, err := newNotifier(b)
+			if err != nil {
+				logging.Warningf("Watcher backend %s not available, falling back: %s", b, err)
+				continue
+			}
+			w.backend = b
+			w.notifier = n
+			return nil
+		}
+		return nil
+	}
+}
+
+// CoalesceWindow sets how long the LogWatcher gathers change notifications
+// before polling the paths they name, so a burst of writes to a log causes
+// a single read of it.  With no window, only notifications already waiting
+// are gathered.
+func CoalesceWindow(d time.Duration) Option {
+	return func(w *LogWatcher) error {
+		if d < 0 {
+			return errors.Errorf("coalesce window must not be negative: %s", d)
+		}
+		w.coalesceWindow = d
+		return nil
+	}
+}
+
+// gather collects the notifications that follow the first into a batch of
+// distinct pathnames, in order of arrival.  It returns false if the
+// notifier has closed.
+func (w *LogWatcher) gather(first string) ([]string, bool) {
+	c := w.notifier.events()
+	batch := []string{first}
+	seen := map[string]struct{}{first: {}}
+	add := func(pathname string) {
+		notifications.Add(1)
+		if _, ok := seen[pathname]; ok {
+			notificationsCoalesced.Add(1)
+			return
+		}
+		seen[pathname] = struct{}{}
+		batch = append(batch, pathname)
+	}
+	notifications.Add(1)
+	var timeout <-chan time.Time
+	if w.coalesceWindow > 0 {
+		t := time.NewTimer(w.coalesceWindow)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for i := 1; i < maxCoalesce; i++ {
+		if timeout == nil {
+			select {
+			case pathname, ok := <-c:
+				if !ok {
+					return batch, false
+				}
+				add(pathname)
+			default:
+				return batch, true
+			}
+			continue
+		}
+		select {
+		case pathname, ok := <-c:
+			if !ok {
+				return batch, false
+			}
+			add(pathname)
+		case <-timeout:
+			return batch, true
+		}
+	}
+	return batch, true
+}
+
+func indexOf(l []string, s string) int {
+	for i, e := range l {
+		if e == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// notify asks the notifier to report changes to pathname.  If it can't, the
+// path is left to polling, starting a ticker for it if the LogWatcher isn't
+// already polling.  watchedMu must be held.
+func (w *LogWatcher) notify(pathname string) {
+	if w.notifier == nil {
+		return
+	}
+	err := w.notifier.add(pathname)
+	if err == nil {
+		return
+	}
+	notifyFallbacks.Add(1)
+	w.pollOnly[pathname] = struct{}{}
+	if !w.notifyWarned {
+		logging.Warningf("%s; polling for changes instead.  Further failures are logged at -v=1.", err)
+		w.notifyWarned = true
+	} else {
+		logging.V(1).Infof("%s; polling for changes instead", err)
+	}
+	if w.pollInterval > 0 || w.fallbackTicker != nil {
+		return
+	}
+	w.fallbackTicker = w.clock.NewTicker(fallbackPollInterval)
+	w.stopFallback = make(chan struct{})
+	go w.runFallbackTicks(w.fallbackTicker, w.stopFallback)
+}
+
+// unnotify stops notifications for pathname.  watchedMu must be held.
+func (w *LogWatcher) unnotify(pathname string) {
+	if w.notifier == nil {
+		return
+	}
+	if _, ok := w.pollOnly[pathname]; ok {
+		delete(w.pollOnly, pathname)
+		return
+	}
+	w.notifier.remove(pathname)
+}
+
+func (w *LogWatcher) runFallbackTicks(t clock.Ticker, stop chan struct{}) {
+	for {
+		select {
+		case <-t.C():
+			w.pollFallback()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// pollFallback polls the paths the notifier couldn't watch.
+func (w *LogWatcher) pollFallback() {
+	w.pollMu.Lock()
+	defer w.pollMu.Unlock()
+	w.watchedMu.RLock()
+	paths := make([]string, 0, len(w.pollOnly))
+	for p := range w.pollOnly {
+		paths = append(paths, p)
+	}
+	w.watchedMu.RUnlock()
+	for _, p := range paths {
+		w.watchedMu.RLock()
+		watched, ok := w.watched[p]
+		w.watchedMu.RUnlock()
+		if ok {
+			w.pollWatchedPath(p, watched)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package watcher
+
+import (
+	"sync"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func newNotifier(backend string) (notifier, error) {
+	if backend == "kqueue" {
+		return newKqueueNotifier()
+	}
+	return nil, errors.Errorf("%s is not supported on this platform", backend)
+}
+
+const kqueueFflags = unix.NOTE_WRITE | unix.NOTE_EXTEND | unix.NOTE_ATTRIB |
+	unix.NOTE_DELETE | unix.NOTE_RENAME | unix.NOTE_REVOKE
+
+// kqueueNotifier watches each path with a kqueue vnode filter, which needs
+// an open descriptor per path.  Directories only report that their entries
+// have changed, so the LogWatcher polls the directory to find which.
+type kqueueNotifier struct {
+	kq   int
+	wake [2]int // A pipe to interrupt kevent when closing.
+
+	mu    sync.Mutex // protects fds and paths
+	fds   map[int]string
+	paths map[string]int
+
+	c      chan string
+	done   chan struct{}
+	closed sync.Once
+}
+
+func newKqueueNotifier() (*kqueueNotifier, error) {
+	kq, err := unix.Kqueue()
+	if err != nil {
+		return nil, errors.Wrap(err, "kqueue")
+	}
+	unix.CloseOnExec(kq)
+	n := &kqueueNotifier{
+		kq:    kq,
+		fds:   make(map[int]string),
+		paths: make(map[string]int),
+		c:     make(chan string, 1024),
+		done:  make(chan struct{}),
+	}
+	if err := unix.Pipe(n.wake[:]); err != nil {
+		unix.Close(kq)
+		return nil, errors.Wrap(err, "pipe")
+	}
+	unix.CloseOnExec(n.wake[0])
+	unix.CloseOnExec(n.wake[1])
+	var ev unix.Kevent_t
+	unix.SetKevent(&ev, n.wake[0], unix.EVFILT_READ, unix.EV_ADD)
+	if _, err := unix.Kevent(kq, []unix.Kevent_t{ev}, nil, nil); err != nil {
+		unix.Close(kq)
+		unix.Close(n.wake[0])
+		unix.Close(n.wake[1])
+		return nil, errors.Wrap(err, "kevent")
+	}
+	go n.run()
+	return n, nil
+}
+
+func (n *kqueueNotifier) events() <-chan string {
+	return n.c
+}
+
+func (n *kqueueNotifier) add(pathname string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.paths[pathname]; ok {
+		return nil
+	}
+	// Nonblocking, so opening a named pipe with no writer doesn't hang.
+	fd, err := unix.Open(pathname, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return errors.Wrapf(err, "open %s", pathname)
+	}
+	var ev unix.Kevent_t
+	unix.SetKevent(&ev, fd, unix.EVFILT_VNODE, unix.EV_ADD|unix.EV_CLEAR)
+	ev.Fflags = kqueueFflags
+	if _, err := unix.Kevent(n.kq, []unix.Kevent_t{ev}, nil, nil); err != nil {
+		unix.Close(fd)
+		return errors.Wrapf(err, "kevent %s", pathname)
+	}
+	n.fds[fd] = pathname
+	n.paths[pathname] = fd
+	return nil
+}
+
+func (n *kqueueNotifier) remove(pathname string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	fd, ok := n.paths[pathname]
+	if !ok {
+		return
+	}
+	delete(n.paths, pathname)
+	delete(n.fds, fd)
+	// Closing the descriptor removes its events from the kqueue.
+	unix.Close(fd)
+}
+
+func (n *kqueueNotifier) run() {
+	defer close(n.c)
+	events := make([]unix.Kevent_t, 64)
+	for {
+		c, err := unix.Kevent(n.kq, nil, events, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			logging.Warningf("Reading kqueue: %s", err)
+			return
+		}
+		for _, ev := range events[:c] {
+			fd := int(ev.Ident)
+			if fd == n.wake[0] {
+				return
+			}
+			n.mu.Lock()
+			pathname, ok := n.fds[fd]
+			if ok && ev.Fflags&(unix.NOTE_DELETE|unix.NOTE_RENAME|unix.NOTE_REVOKE) != 0 {
+				// The descriptor now refers to a file that's no longer at this
+				// path, so stop watching; the LogWatcher will observe any
+				// replacement.
+				delete(n.paths, pathname)
+				delete(n.fds, fd)
+				unix.Close(fd)
+			}
+			n.mu.Unlock()
+			if !ok {
+				continue
+			}
+			select {
+			case n.c <- pathname:
+			case <-n.done:
+				return
+			}
+		}
+	}
+}
+
+func (n *kqueueNotifier) close() error {
+	n.closed.Do(func() {
+		close(n.done)
+		_, _ = unix.Write(n.wake[1], []byte{0})
+	})
+	// Wait for run to finish with the kqueue before closing it.
+	for range n.c {
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for fd := range n.fds {
+		unix.Close(fd)
+	}
+	n.fds = nil
+	n.paths = nil
+	unix.Close(n.wake[0])
+	unix.Close(n.wake[1])
+	return unix.Close(n.kq)
+}
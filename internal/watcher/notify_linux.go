@@ -0,0 +1,263 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/google/mtail/internal/logging"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func newNotifier(backend string) (notifier, error) {
+	switch backend {
+	case "inotify":
+		return newInotifyNotifier()
+	case "fanotify":
+		return newFanotifyNotifier()
+	}
+	return nil, errors.Errorf("%s is not supported on this platform", backend)
+}
+
+// notifyFile wraps a nonblocking notification descriptor in an os.File, so
+// reads wait in the runtime poller and Close interrupts them.
+type notifyFile struct {
+	fd     int // Kept separately, as os.File.Fd would make reads blocking.
+	f      *os.File
+	c      chan string
+	done   chan struct{}
+	closed sync.Once
+}
+
+func newNotifyFile(fd int, name string) *notifyFile {
+	return &notifyFile{
+		fd:   fd,
+		f:    os.NewFile(uintptr(fd), name),
+		c:    make(chan string, 1024),
+		done: make(chan struct{}),
+	}
+}
+
+func (n *notifyFile) events() <-chan string {
+	return n.c
+}
+
+// send delivers a pathname to the LogWatcher, giving up if the notifier is
+// closed while waiting.
+func (n *notifyFile) send(pathname string) bool {
+	select {
+	case n.c <- pathname:
+		return true
+	case <-n.done:
+		return false
+	}
+}
+
+// run reads from the descriptor until it is closed, passing each read to parse.
+func (n *notifyFile) run(parse func([]byte)) {
+	defer close(n.c)
+	buf := make([]byte, 64*1024)
+	for {
+		c, err := n.f.Read(buf)
+		if err != nil {
+			select {
+			case <-n.done:
+			default:
+				logging.Warningf("Reading %s: %s", n.f.Name(), err)
+			}
+			return
+		}
+		parse(buf[:c])
+	}
+}
+
+func (n *notifyFile) close() error {
+	var err error
+	n.closed.Do(func() {
+		close(n.done)
+		err = n.f.Close()
+	})
+	return err
+}
+
+const inotifyMask = unix.IN_MODIFY | unix.IN_ATTRIB | unix.IN_CLOSE_WRITE |
+	unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+// inotifyNotifier watches each path with inotify.
+type inotifyNotifier struct {
+	*notifyFile
+
+	mu    sync.Mutex // protects wds and paths
+	wds   map[int32]string
+	paths map[string]int32
+}
+
+func newInotifyNotifier() (*inotifyNotifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err == unix.EMFILE {
+		return nil, errors.Errorf("inotify instance limit reached: fs.inotify.max_user_instances is %s", inotifyLimit("max_user_instances"))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "inotify_init1")
+	}
+	n := &inotifyNotifier{
+		notifyFile: newNotifyFile(fd, "inotify"),
+		wds:        make(map[int32]string),
+		paths:      make(map[string]int32),
+	}
+	go n.run(n.parse)
+	return n, nil
+}
+
+func (n *inotifyNotifier) add(pathname string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.paths[pathname]; ok {
+		return nil
+	}
+	wd, err := unix.InotifyAddWatch(n.fd, pathname, inotifyMask)
+	if err == unix.ENOSPC {
+		return errors.Errorf("inotify watch limit reached adding %s: fs.inotify.max_user_watches is %s; raise it with sysctl, or use --watcher=fanotify", pathname, inotifyLimit("max_user_watches"))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "inotify_add_watch %s", pathname)
+	}
+	n.wds[int32(wd)] = pathname
+	n.paths[pathname] = int32(wd)
+	return nil
+}
+
+// inotifyLimit returns the value of the fs.inotify sysctl named name, for
+// diagnostics.
+func inotifyLimit(name string) string {
+	b, err := ioutil.ReadFile("/proc/sys/fs/inotify/" + name)
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func (n *inotifyNotifier) remove(pathname string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	wd, ok := n.paths[pathname]
+	if !ok {
+		return
+	}
+	delete(n.paths, pathname)
+	delete(n.wds, wd)
+	// The watch is already gone if the file was deleted.
+	_, _ = unix.InotifyRmWatch(n.fd, uint32(wd))
+}
+
+func (n *inotifyNotifier) parse(buf []byte) {
+	for len(buf) >= unix.SizeofInotifyEvent {
+		e := (*unix.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		size := unix.SizeofInotifyEvent + int(e.Len)
+		if size > len(buf) {
+			return
+		}
+		name := strings.TrimRight(string(buf[unix.SizeofInotifyEvent:size]), "\x00")
+		buf = buf[size:]
+		if e.Mask&unix.IN_Q_OVERFLOW != 0 {
+			if !n.send("") {
+				return
+			}
+			continue
+		}
+		n.mu.Lock()
+		pathname, ok := n.wds[e.Wd]
+		if ok && e.Mask&unix.IN_IGNORED != 0 {
+			delete(n.wds, e.Wd)
+			if n.paths[pathname] == e.Wd {
+				delete(n.paths, pathname)
+			}
+		}
+		n.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if name != "" {
+			pathname = filepath.Join(pathname, name)
+		}
+		if !n.send(pathname) {
+			return
+		}
+	}
+}
+
+// fanotifyNotifier marks the whole mount containing each path, so it needs
+// no kernel resources per file.  Mount marks only report modifications, with
+// a descriptor of the modified file, so new files are found when they are
+// first written and deleted files only by polling.
+type fanotifyNotifier struct {
+	*notifyFile
+}
+
+func newFanotifyNotifier() (*fanotifyNotifier, error) {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK, unix.O_RDONLY|unix.O_LARGEFILE|unix.O_CLOEXEC)
+	if err != nil {
+		return nil, errors.Wrap(err, "fanotify_init")
+	}
+	n := &fanotifyNotifier{notifyFile: newNotifyFile(fd, "fanotify")}
+	go n.run(n.parse)
+	return n, nil
+}
+
+func (n *fanotifyNotifier) add(pathname string) error {
+	// Marking a mount again is harmless, so there's no need to work out
+	// which mount the path is on.
+	if err := unix.FanotifyMark(n.fd, unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT, unix.FAN_MODIFY|unix.FAN_CLOSE_WRITE, unix.AT_FDCWD, pathname); err != nil {
+		return errors.Wrapf(err, "fanotify_mark %s", pathname)
+	}
+	return nil
+}
+
+// remove does nothing, as the mount mark is shared with other paths.
+func (n *fanotifyNotifier) remove(pathname string) {}
+
+const sizeofFanotifyEventMetadata = int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+
+func (n *fanotifyNotifier) parse(buf []byte) {
+	for len(buf) >= sizeofFanotifyEventMetadata {
+		e := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[0]))
+		if e.Event_len < uint32(sizeofFanotifyEventMetadata) || int(e.Event_len) > len(buf) {
+			return
+		}
+		buf = buf[e.Event_len:]
+		if e.Vers != unix.FANOTIFY_METADATA_VERSION {
+			logging.Warningf("Unexpected fanotify metadata version %d", e.Vers)
+			continue
+		}
+		if e.Mask&unix.FAN_Q_OVERFLOW != 0 {
+			if !n.send("") {
+				return
+			}
+			continue
+		}
+		if e.Fd < 0 {
+			continue
+		}
+		pathname, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(int(e.Fd)))
+		unix.Close(int(e.Fd))
+		if err != nil {
+			logging.V(2).Info(err)
+			continue
+		}
+		if strings.HasSuffix(pathname, " (deleted)") {
+			continue
+		}
+		if !n.send(pathname) {
+			return
+		}
+	}
+}
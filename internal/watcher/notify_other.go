@@ -0,0 +1,13 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package watcher
+
+import "github.com/pkg/errors"
+
+func newNotifier(backend string) (notifier, error) {
+	return nil, errors.Errorf("%s is not supported on this platform", backend)
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/testutil"
+	"github.com/pkg/errors"
+)
+
+type chanProcessor chan Event
+
+func (c chanProcessor) ProcessFileEvent(ctx context.Context, e Event) {
+	c <- e
+}
+
+// expectEvents waits for all the events, in any order, skipping any others,
+// as notifiers may report a change more than once.
+func expectEvents(t *testing.T, c chanProcessor, events ...Event) {
+	t.Helper()
+	want := make(map[Event]bool)
+	for _, e := range events {
+		want[e] = true
+	}
+	timeout := time.After(5 * time.Second)
+	for len(want) > 0 {
+		select {
+		case got := <-c:
+			delete(want, got)
+		case <-timeout:
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+}
+
+func TestLogWatcherNotify(t *testing.T) {
+	testutil.SkipIfShort(t)
+	for _, backend := range Backends {
+		if backend == "poll" {
+			continue
+		}
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			workdir, rmWorkdir := testutil.TestTempDir(t)
+			defer rmWorkdir()
+
+			// No poll interval, so only notifications cause events.
+			w, err := NewLogWatcher(context.Background(), 0, Backend(backend))
+			testutil.FatalIfErr(t, err)
+			defer func() {
+				testutil.FatalIfErr(t, w.Close())
+			}()
+			if w.backend != backend {
+				t.Skipf("%s not available, fell back to %s", backend, w.backend)
+			}
+
+			c := make(chanProcessor, 100)
+			testutil.FatalIfErr(t, w.Observe(workdir, c))
+
+			logfile := filepath.Join(workdir, "logfile")
+			f := testutil.TestOpenFile(t, logfile)
+			// fanotify only sees new files when they are written to.
+			testutil.WriteString(t, f, "a\n")
+			expectEvents(t, c, Event{Create, logfile})
+			testutil.FatalIfErr(t, w.Observe(logfile, c))
+
+			testutil.WriteString(t, f, "b\n")
+			expectEvents(t, c, Event{Update, logfile})
+			testutil.FatalIfErr(t, f.Close())
+
+			// fanotify mount marks don't report renames and deletes, which
+			// are left to polling.
+			poll := func() {
+				if backend == "fanotify" {
+					w.Poll()
+				}
+			}
+			rotated := filepath.Join(workdir, "logfile.1")
+			testutil.FatalIfErr(t, os.Rename(logfile, rotated))
+			poll()
+			expectEvents(t, c, Event{Delete, logfile}, Event{Create, rotated})
+			testutil.FatalIfErr(t, w.Observe(rotated, c))
+
+			testutil.FatalIfErr(t, os.Remove(rotated))
+			poll()
+			expectEvents(t, c, Event{Delete, rotated})
+		})
+	}
+}
+
+func TestBackendOption(t *testing.T) {
+	w, err := NewLogWatcher(context.Background(), 0, Backend("poll"))
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	if w.notifier != nil {
+		t.Errorf("expected no notifier for poll backend")
+	}
+	if _, err := NewLogWatcher(context.Background(), 0, Backend("dnotify")); err == nil {
+		t.Error("expected error for unknown backend")
+	}
+}
+
+// failingNotifier can't watch anything, like inotify over its watch limit.
+type failingNotifier struct {
+	c chan string
+}
+
+func (n *failingNotifier) add(pathname string) error {
+	return errors.New("watch limit reached")
+}
+func (n *failingNotifier) remove(pathname string) {}
+func (n *failingNotifier) events() <-chan string  { return n.c }
+func (n *failingNotifier) close() error {
+	close(n.c)
+	return nil
+}
+
+func TestLogWatcherNotifyFallback(t *testing.T) {
+	testutil.SkipIfShort(t)
+	workdir, rmWorkdir := testutil.TestTempDir(t)
+	defer rmWorkdir()
+
+	before := notifyFallbacks.Value()
+	w, err := NewLogWatcher(context.Background(), 0, func(w *LogWatcher) error {
+		w.backend = "failing"
+		w.notifier = &failingNotifier{c: make(chan string)}
+		return nil
+	})
+	testutil.FatalIfErr(t, err)
+	defer func() {
+		testutil.FatalIfErr(t, w.Close())
+	}()
+
+	c := make(chanProcessor, 100)
+	testutil.FatalIfErr(t, w.Observe(workdir, c))
+	if got := notifyFallbacks.Value() - before; got != 1 {
+		t.Errorf("fallbacks: expected 1, received %d", got)
+	}
+	// Without a poll interval, only the fallback ticker can find the new file.
+	logfile := filepath.Join(workdir, "logfile")
+	testutil.TestOpenFile(t, logfile)
+	expectEvents(t, c, Event{Create, logfile})
+
+	testutil.FatalIfErr(t, w.Unobserve(workdir, c))
+	w.watchedMu.RLock()
+	defer w.watchedMu.RUnlock()
+	if len(w.pollOnly) != 0 {
+		t.Errorf("pollOnly not cleared: %v", w.pollOnly)
+	}
+}
+
+// chanNotifier delivers the notifications a test sends on c.
+type chanNotifier struct {
+	c chan string
+}
+
+func (n *chanNotifier) add(pathname string) error { return nil }
+func (n *chanNotifier) remove(pathname string)    {}
+func (n *chanNotifier) events() <-chan string     { return n.c }
+func (n *chanNotifier) close() error {
+	close(n.c)
+	return nil
+}
+
+func TestLogWatcherGather(t *testing.T) {
+	n := &chanNotifier{c: make(chan string, 2000)}
+	w := &LogWatcher{notifier: n}
+	before := notificationsCoalesced.Value()
+	for i := 0; i < 1000; i++ {
+		n.c <- "/a"
+	}
+	n.c <- "/b"
+	batch, open := w.gather("/b")
+	if !open {
+		t.Error("notifier reported closed")
+	}
+	testutil.ExpectNoDiff(t, []string{"/b", "/a"}, batch)
+	if got := notificationsCoalesced.Value() - before; got != 1000 {
+		t.Errorf("coalesced: expected 1000, received %d", got)
+	}
+
+	// The window gathers notifications that arrive after the first.
+	w.coalesceWindow = 50 * time.Millisecond
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		n.c <- "/c"
+		n.c <- "/a"
+		close(n.c)
+	}()
+	batch, open = w.gather("/a")
+	if open {
+		t.Error("notifier not reported closed")
+	}
+	testutil.ExpectNoDiff(t, []string{"/a", "/c"}, batch)
+}
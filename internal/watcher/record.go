@@ -0,0 +1,128 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/logging"
+	"github.com/pkg/errors"
+)
+
+// Ops of the entries of a recording, besides the names of the event ops.
+const (
+	RecordObserve   = "observe"
+	RecordUnobserve = "unobserve"
+)
+
+var opNames = map[OpType]string{
+	Create: "create",
+	Update: "update",
+	Delete: "delete",
+}
+
+// A RecordedEvent is an entry in a recording of a LogWatcher made with the
+// Record option: an event sent to the processors of a path, or the path being
+// observed or unobserved, with a snapshot of the file at the path when it
+// happened.
+type RecordedEvent struct {
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"`
+	Pathname string    `json:"pathname"`
+	Stat     *FileStat `json:"stat,omitempty"` // Nil if there was no file at the path.
+}
+
+// FileStat is a snapshot of the metadata of a file.
+type FileStat struct {
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	Dev     uint64      `json:"dev"` // Device and inode identify the file across renames; zero on windows.
+	Ino     uint64      `json:"ino"`
+}
+
+// Event returns the event the entry recorded, or false if it recorded an
+// observe or unobserve.
+func (r RecordedEvent) Event() (Event, bool) {
+	for op, name := range opNames {
+		if r.Op == name {
+			return Event{op, r.Pathname}, true
+		}
+	}
+	return Event{}, false
+}
+
+// ReadRecording reads the entries of a recording from r.
+func ReadRecording(r io.Reader) ([]RecordedEvent, error) {
+	var events []RecordedEvent
+	d := json.NewDecoder(r)
+	for {
+		var e RecordedEvent
+		if err := d.Decode(&e); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return events, errors.Wrapf(err, "reading entry %d of recording", len(events)+1)
+		}
+		events = append(events, e)
+	}
+}
+
+// Record makes the LogWatcher write an entry to out for each event it sends,
+// and each path it is asked to observe or unobserve, so that the events can
+// be replayed into a tailer by `mtail replay-events`.  Each entry is a line of
+// JSON encoding a RecordedEvent.  Only metadata is recorded, not the contents
+// of any file.
+func Record(out io.Writer) Option {
+	return func(w *LogWatcher) error {
+		w.recorder = &recorder{out: out}
+		return nil
+	}
+}
+
+// recorder writes the entries of a recording.
+type recorder struct {
+	mu     sync.Mutex // Held only to write an entry, so entries aren't interleaved.
+	out    io.Writer
+	failed bool // A write has failed, and recording has stopped.
+}
+
+// record writes an entry for op on pathname, taking a snapshot of the file
+// there, at the time of clock c.  The snapshot is taken and the entry
+// encoded before the entry is written, so the lock is held only for the
+// write.
+func (r *recorder) record(c clock.Clock, op, pathname string) {
+	e := RecordedEvent{Time: c.Now(), Op: op, Pathname: pathname}
+	if fi, err := os.Stat(pathname); err == nil {
+		e.Stat = &FileStat{Size: fi.Size(), Mode: fi.Mode(), ModTime: fi.ModTime()}
+		e.Stat.Dev, e.Stat.Ino = fileID(fi)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		logging.Warningf("Failed to encode watcher event for %s: %s", pathname, err)
+		return
+	}
+	b = append(b, '\n')
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed {
+		return
+	}
+	if _, err := r.out.Write(b); err != nil {
+		r.failed = true
+		logging.Warningf("Stopped recording watcher events: %s", err)
+	}
+}
+
+// record records op on pathname, if the LogWatcher is recording.  It does
+// I/O, so it must be called without watchedMu held.
+func (w *LogWatcher) record(op, pathname string) {
+	if w.recorder != nil {
+		w.recorder.record(w.clock, op, pathname)
+	}
+}
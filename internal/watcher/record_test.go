@@ -0,0 +1,75 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/clock"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestLogWatcherRecord(t *testing.T) {
+	testutil.SkipIfShort(t)
+	workdir, rmWorkdir := testutil.TestTempDir(t)
+	defer rmWorkdir()
+
+	var buf bytes.Buffer
+	c := clock.NewFake(time.Unix(1604194200, 0))
+	w, err := NewLogWatcher(context.Background(), 0, Record(&buf), Clock(c))
+	testutil.FatalIfErr(t, err)
+	defer func() {
+		testutil.FatalIfErr(t, w.Close())
+	}()
+
+	logfile := filepath.Join(workdir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	s := newStubProcessor()
+	testutil.FatalIfErr(t, w.Observe(logfile, s))
+	testutil.WriteString(t, f, "hi\n")
+	testutil.FatalIfErr(t, f.Close())
+	w.Poll()
+	testutil.FatalIfErr(t, os.Remove(logfile))
+	w.Poll()
+	testutil.FatalIfErr(t, w.Unobserve(logfile, s))
+
+	events, err := ReadRecording(&buf)
+	testutil.FatalIfErr(t, err)
+	var ops []string
+	for _, e := range events {
+		ops = append(ops, e.Op)
+		if e.Pathname != logfile {
+			t.Errorf("expected %s, received %s", logfile, e.Pathname)
+		}
+		if !e.Time.Equal(c.Now()) {
+			t.Errorf("expected the time of the clock, received %s", e.Time)
+		}
+	}
+	testutil.ExpectNoDiff(t, []string{"observe", "update", "delete", "unobserve"}, ops)
+	if len(events) != 4 {
+		t.Fatalf("expected 4 entries, received %d", len(events))
+	}
+	if events[0].Stat == nil || events[0].Stat.Size != 0 {
+		t.Errorf("expected an empty file at observe, received %+v", events[0].Stat)
+	}
+	if events[1].Stat == nil || events[1].Stat.Size != 3 {
+		t.Errorf("expected 3 bytes at update, received %+v", events[1].Stat)
+	}
+	if events[2].Stat != nil {
+		t.Errorf("expected no file at delete, received %+v", events[2].Stat)
+	}
+	e, ok := events[1].Event()
+	testutil.ExpectNoDiff(t, Event{Update, logfile}, e)
+	if !ok {
+		t.Error("expected update to be an event")
+	}
+	if _, ok := events[0].Event(); ok {
+		t.Error("expected observe not to be an event")
+	}
+}
@@ -5,7 +5,10 @@
 // notifying observers when they occur.
 package watcher
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type OpType int
 
@@ -30,6 +33,19 @@ type Watcher interface {
 	Close() error
 }
 
+// PollIntervalSetter is implemented by Watchers that can poll some paths
+// more or less often than others.
+type PollIntervalSetter interface {
+	SetPollInterval(name string, interval time.Duration) error
+}
+
+// DefaultPollIntervalSetter is implemented by Watchers whose poll interval
+// can be changed while they run.
+type DefaultPollIntervalSetter interface {
+	DefaultPollInterval() time.Duration
+	SetDefaultPollInterval(interval time.Duration) error
+}
+
 // Processor describes an interface for receiving watcher.Events
 type Processor interface {
 	ProcessFileEvent(context.Context, Event)
@@ -58,15 +58,15 @@
   "Syntax table used while in `mtail-mode'.")
 
 (defconst mtail-mode-types
-  '("counter" "gauge" "text" "timer")
+  '("avg" "counter" "distinct" "gauge" "max" "min" "text" "timer" "topk")
   "All types in the mtail language.  Used for font locking.")
 
 (defconst mtail-mode-keywords
-  '("after" "as" "by" "const" "def" "del" "else" "hidden" "next" "otherwise" "stop")
+  '("after" "as" "by" "const" "def" "del" "else" "every" "extern" "filter" "hidden" "next" "otherwise" "reset" "sample" "stop" "syntax" "timestamped" "untimestamped")
   "All keywords in the mtail language.  Used for font locking.")
 
 (defconst mtail-mode-builtins
-  '("bool" "float" "getfilename" "int" "len" "settime" "string" "strptime" "strtol" "timestamp" "tolower")
+  '("alert" "bool" "cef" "csv" "csvcol" "exec" "field" "float" "geoip_asn" "geoip_country" "getfilename" "getingesttime" "getlinenumber" "getlineoffset" "hmac" "int" "leef" "len" "normpath" "parsedur" "parsefloat" "parseint" "parsesize" "redact" "settime" "sha256" "string" "strptime" "strtol" "timestamp" "tolower" "uaclass" "urlhost" "urlpath" "urlquery" "w3c")
   "All builtins in the mtail language.  Used for font locking.")
 
 (defvar mtail-mode-font-lock-defaults
@@ -0,0 +1,160 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package mtailtest helps test mtail programs from Go tests.
+//
+// A Server runs programs in the test's process.  Lines are given to it
+// directly, so no log files are written or tailed, and the metrics can be
+// checked as soon as Feed returns:
+//
+//	func TestRequests(t *testing.T) {
+//		s := mtailtest.New(t, mtail.ProgramPath("requests.mtail"))
+//		s.Feed("access.log", "GET / 200", "GET /missing 404")
+//		s.ExpectValue("requests_total", 1, "code", "404")
+//	}
+package mtailtest
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// Server runs mtail programs for a test.
+type Server struct {
+	tb  testing.TB
+	ctx context.Context
+	e   *mtail.Engine
+}
+
+// New starts a Server configured by the options, failing the test if the
+// programs don't compile.  The Server is stopped when the test ends.
+func New(tb testing.TB, options ...mtail.Option) *Server {
+	tb.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	e, err := mtail.New(ctx, options...)
+	if err != nil {
+		cancel()
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		cancel()
+		testutil.FatalIfErr(tb, e.Close())
+	})
+	return &Server{tb: tb, ctx: ctx, e: e}
+}
+
+// Engine returns the Engine running the programs.
+func (s *Server) Engine() *mtail.Engine {
+	return s.e
+}
+
+// Feed gives the lines to the programs, in order, as if read from the log
+// filename.
+func (s *Server) Feed(filename string, lines ...string) {
+	for _, line := range lines {
+		s.e.ProcessLine(s.ctx, filename, line)
+	}
+}
+
+// FeedFile gives each line of the file at path to the programs, as if read
+// from a log of the same name.
+func (s *Server) FeedFile(path string) {
+	s.tb.Helper()
+	f, err := os.Open(path)
+	testutil.FatalIfErr(s.tb, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s.e.ProcessLine(s.ctx, path, scanner.Text())
+	}
+	testutil.FatalIfErr(s.tb, scanner.Err())
+}
+
+// Metrics returns the current value of every metric.
+func (s *Server) Metrics() []mtail.Metric {
+	return s.e.Metrics()
+}
+
+// Metric returns the value of the metric name with the labels, given as
+// alternating label names and values.  If more than one program defines the
+// metric, the value from the first program by name is returned.  The test
+// fails if there is no such metric.
+func (s *Server) Metric(name string, labels ...string) mtail.Metric {
+	s.tb.Helper()
+	want := labelMap(s.tb, labels)
+	for _, m := range s.e.Metrics() {
+		if m.Name == name && sameLabels(m.Labels, want) {
+			return m
+		}
+	}
+	s.tb.Fatalf("No metric %s with labels %v", name, want)
+	return mtail.Metric{}
+}
+
+// ExpectValue checks that the numeric metric name with the labels has the
+// value want.  For a histogram, the value is the sum of its observations.
+func (s *Server) ExpectValue(name string, want float64, labels ...string) {
+	s.tb.Helper()
+	if m := s.Metric(name, labels...); m.Value != want {
+		s.tb.Errorf("Unexpected value of %s%v: got %g, want %g", name, m.Labels, m.Value, want)
+	}
+}
+
+// ExpectText checks that the text metric name with the labels has the value
+// want.
+func (s *Server) ExpectText(name, want string, labels ...string) {
+	s.tb.Helper()
+	if m := s.Metric(name, labels...); m.Text != want {
+		s.tb.Errorf("Unexpected value of %s%v: got %q, want %q", name, m.Labels, m.Text, want)
+	}
+}
+
+// ExpectMetrics checks that the metrics are exactly want, ordered as by
+// Metrics.  The times the values last changed are not compared.
+func (s *Server) ExpectMetrics(want []mtail.Metric) {
+	s.tb.Helper()
+	testutil.ExpectNoDiff(s.tb, want, s.e.Metrics(), testutil.IgnoreFields(mtail.Metric{}, "Time"))
+}
+
+// Coverage returns the source of each program annotated with the times each
+// line was executed, and each condition matched, by the lines fed so far, so
+// that the logic a test corpus leaves unexercised can be found.  The Server
+// must have been created with the mtail.Coverage option.
+func (s *Server) Coverage() string {
+	s.tb.Helper()
+	var b strings.Builder
+	testutil.FatalIfErr(s.tb, s.e.WriteCoverage(&b))
+	return b.String()
+}
+
+// labelMap pairs up alternating label names and values.
+func labelMap(tb testing.TB, labels []string) map[string]string {
+	tb.Helper()
+	if len(labels)%2 != 0 {
+		tb.Fatalf("Label %q has no value", labels[len(labels)-1])
+	}
+	r := make(map[string]string, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		r[labels[i]] = labels[i+1]
+	}
+	return r
+}
+
+// sameLabels reports whether a and b have the same labels and values.
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
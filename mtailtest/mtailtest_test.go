@@ -0,0 +1,76 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtailtest
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+const requestsProgram = `counter requests_total by code
+text last_path
+/^GET (\S+) (\d+)$/ {
+  requests_total[$2]++
+  last_path = $1
+}
+`
+
+func TestServer(t *testing.T) {
+	s := New(t, mtail.Program("requests.mtail", requestsProgram))
+	s.Feed("access.log", "GET / 200", "GET /missing 404", "GET /index.html 200")
+
+	s.ExpectValue("requests_total", 2, "code", "200")
+	s.ExpectValue("requests_total", 1, "code", "404")
+	s.ExpectText("last_path", "/index.html")
+	if m := s.Metric("requests_total", "code", "404"); m.Program != "requests.mtail" || m.Kind != "counter" {
+		t.Errorf("unexpected metric %v", m)
+	}
+}
+
+func TestServerExpectMetrics(t *testing.T) {
+	s := New(t, mtail.Program("requests.mtail", requestsProgram))
+	s.Feed("access.log", "GET / 200")
+
+	s.ExpectMetrics([]mtail.Metric{
+		{Program: "requests.mtail", Name: "last_path", Kind: "text", Labels: map[string]string{}, Text: "/"},
+		{Program: "requests.mtail", Name: "requests_total", Kind: "counter", Labels: map[string]string{"code": "200"}, Value: 1},
+	})
+}
+
+func TestServerFeedFile(t *testing.T) {
+	dir, rmdir := testutil.TestTempDir(t)
+	defer rmdir()
+	logFile := filepath.Join(dir, "access.log")
+	testutil.FatalIfErr(t, ioutil.WriteFile(logFile, []byte("GET / 200\nGET / 500\n"), 0600))
+	progFile := filepath.Join(dir, "requests.mtail")
+	testutil.FatalIfErr(t, ioutil.WriteFile(progFile, []byte(requestsProgram), 0600))
+
+	s := New(t, mtail.ProgramPath(progFile))
+	s.FeedFile(logFile)
+
+	s.ExpectValue("requests_total", 1, "code", "200")
+	s.ExpectValue("requests_total", 1, "code", "500")
+}
+
+func TestServerCoverage(t *testing.T) {
+	s := New(t, mtail.Program("requests.mtail", requestsProgram+"/^POST/ {\n  requests_total[\"post\"]++\n}\n"), mtail.Coverage())
+	s.Feed("access.log", "GET / 200", "GET /missing 404", "HEAD / 200")
+
+	expected := ` executed   matched: requests.mtail
+        -          : counter requests_total by code
+        -          : text last_path
+        3         2: /^GET (\S+) (\d+)$/ {
+        2          :   requests_total[$2]++
+        2          :   last_path = $1
+        -          : }
+        3     #####: /^POST/ {
+    #####          :   requests_total["post"]++
+        -          : }
+`
+	testutil.ExpectNoDiff(t, expected, s.Coverage())
+}